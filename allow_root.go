@@ -0,0 +1,167 @@
+package main
+
+import (
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// allowRootFS implements "-allow_root". The kernel only knows "allow_other",
+// which lets every user in, so we mount with "allow_other" and reject
+// requests from users other than the owner of the mount and root here.
+//
+// Like libfuse, we let requests on already-open file handles through (READ,
+// WRITE, RELEASE...). Getting such a handle requires an OPEN or CREATE first,
+// which is checked.
+type allowRootFS struct {
+	fuse.RawFileSystem
+	// owner is the uid gocryptfs runs as
+	owner uint32
+}
+
+func newAllowRootFS(raw fuse.RawFileSystem, owner uint32) *allowRootFS {
+	return &allowRootFS{RawFileSystem: raw, owner: owner}
+}
+
+// denied returns true if the caller in "h" may not access the filesystem.
+func (f *allowRootFS) denied(h *fuse.InHeader) bool {
+	return h.Uid != f.owner && h.Uid != 0
+}
+
+func (f *allowRootFS) Lookup(cancel <-chan struct{}, header *fuse.InHeader, name string, out *fuse.EntryOut) fuse.Status {
+	if f.denied(header) {
+		return fuse.EACCES
+	}
+	return f.RawFileSystem.Lookup(cancel, header, name, out)
+}
+
+func (f *allowRootFS) GetAttr(cancel <-chan struct{}, input *fuse.GetAttrIn, out *fuse.AttrOut) fuse.Status {
+	if f.denied(&input.InHeader) {
+		return fuse.EACCES
+	}
+	return f.RawFileSystem.GetAttr(cancel, input, out)
+}
+
+func (f *allowRootFS) SetAttr(cancel <-chan struct{}, input *fuse.SetAttrIn, out *fuse.AttrOut) fuse.Status {
+	if f.denied(&input.InHeader) {
+		return fuse.EACCES
+	}
+	return f.RawFileSystem.SetAttr(cancel, input, out)
+}
+
+func (f *allowRootFS) Mknod(cancel <-chan struct{}, input *fuse.MknodIn, name string, out *fuse.EntryOut) fuse.Status {
+	if f.denied(&input.InHeader) {
+		return fuse.EACCES
+	}
+	return f.RawFileSystem.Mknod(cancel, input, name, out)
+}
+
+func (f *allowRootFS) Mkdir(cancel <-chan struct{}, input *fuse.MkdirIn, name string, out *fuse.EntryOut) fuse.Status {
+	if f.denied(&input.InHeader) {
+		return fuse.EACCES
+	}
+	return f.RawFileSystem.Mkdir(cancel, input, name, out)
+}
+
+func (f *allowRootFS) Unlink(cancel <-chan struct{}, header *fuse.InHeader, name string) fuse.Status {
+	if f.denied(header) {
+		return fuse.EACCES
+	}
+	return f.RawFileSystem.Unlink(cancel, header, name)
+}
+
+func (f *allowRootFS) Rmdir(cancel <-chan struct{}, header *fuse.InHeader, name string) fuse.Status {
+	if f.denied(header) {
+		return fuse.EACCES
+	}
+	return f.RawFileSystem.Rmdir(cancel, header, name)
+}
+
+func (f *allowRootFS) Rename(cancel <-chan struct{}, input *fuse.RenameIn, oldName string, newName string) fuse.Status {
+	if f.denied(&input.InHeader) {
+		return fuse.EACCES
+	}
+	return f.RawFileSystem.Rename(cancel, input, oldName, newName)
+}
+
+func (f *allowRootFS) Link(cancel <-chan struct{}, input *fuse.LinkIn, filename string, out *fuse.EntryOut) fuse.Status {
+	if f.denied(&input.InHeader) {
+		return fuse.EACCES
+	}
+	return f.RawFileSystem.Link(cancel, input, filename, out)
+}
+
+func (f *allowRootFS) Symlink(cancel <-chan struct{}, header *fuse.InHeader, pointedTo string, linkName string, out *fuse.EntryOut) fuse.Status {
+	if f.denied(header) {
+		return fuse.EACCES
+	}
+	return f.RawFileSystem.Symlink(cancel, header, pointedTo, linkName, out)
+}
+
+func (f *allowRootFS) Readlink(cancel <-chan struct{}, header *fuse.InHeader) ([]byte, fuse.Status) {
+	if f.denied(header) {
+		return nil, fuse.EACCES
+	}
+	return f.RawFileSystem.Readlink(cancel, header)
+}
+
+func (f *allowRootFS) Access(cancel <-chan struct{}, input *fuse.AccessIn) fuse.Status {
+	if f.denied(&input.InHeader) {
+		return fuse.EACCES
+	}
+	return f.RawFileSystem.Access(cancel, input)
+}
+
+func (f *allowRootFS) GetXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr string, dest []byte) (uint32, fuse.Status) {
+	if f.denied(header) {
+		return 0, fuse.EACCES
+	}
+	return f.RawFileSystem.GetXAttr(cancel, header, attr, dest)
+}
+
+func (f *allowRootFS) ListXAttr(cancel <-chan struct{}, header *fuse.InHeader, dest []byte) (uint32, fuse.Status) {
+	if f.denied(header) {
+		return 0, fuse.EACCES
+	}
+	return f.RawFileSystem.ListXAttr(cancel, header, dest)
+}
+
+func (f *allowRootFS) SetXAttr(cancel <-chan struct{}, input *fuse.SetXAttrIn, attr string, data []byte) fuse.Status {
+	if f.denied(&input.InHeader) {
+		return fuse.EACCES
+	}
+	return f.RawFileSystem.SetXAttr(cancel, input, attr, data)
+}
+
+func (f *allowRootFS) RemoveXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr string) fuse.Status {
+	if f.denied(header) {
+		return fuse.EACCES
+	}
+	return f.RawFileSystem.RemoveXAttr(cancel, header, attr)
+}
+
+func (f *allowRootFS) Create(cancel <-chan struct{}, input *fuse.CreateIn, name string, out *fuse.CreateOut) fuse.Status {
+	if f.denied(&input.InHeader) {
+		return fuse.EACCES
+	}
+	return f.RawFileSystem.Create(cancel, input, name, out)
+}
+
+func (f *allowRootFS) Open(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
+	if f.denied(&input.InHeader) {
+		return fuse.EACCES
+	}
+	return f.RawFileSystem.Open(cancel, input, out)
+}
+
+func (f *allowRootFS) OpenDir(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
+	if f.denied(&input.InHeader) {
+		return fuse.EACCES
+	}
+	return f.RawFileSystem.OpenDir(cancel, input, out)
+}
+
+func (f *allowRootFS) StatFs(cancel <-chan struct{}, input *fuse.InHeader, out *fuse.StatfsOut) fuse.Status {
+	if f.denied(input) {
+		return fuse.EACCES
+	}
+	return f.RawFileSystem.StatFs(cancel, input, out)
+}
@@ -8,49 +8,112 @@ import _ "github.com/rfjakob/gocryptfs/internal/ensurefds012"
 import (
 	"flag"
 	"fmt"
+	"math"
 	"net"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
 
+	"github.com/rfjakob/gocryptfs/internal/audit"
 	"github.com/rfjakob/gocryptfs/internal/configfile"
 	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/keylock"
 	"github.com/rfjakob/gocryptfs/internal/stupidgcm"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
 // argContainer stores the parsed CLI options and arguments
 type argContainer struct {
-	debug, init, zerokey, fusedebug, openssl, passwd, fg, version,
-	plaintextnames, quiet, nosyslog, wpanic,
+	init, zerokey, fusedebug, openssl, passwd, fg, version,
+	plaintextnames, quiet, nosyslog, syslog, wpanic,
 	longnames, allow_other, reverse, aessiv, nonempty, raw64,
 	noprealloc, speed, hkdf, serialize_reads, forcedecode, hh, info,
-	sharedstorage, devrandom, fsck bool
+	sharedstorage, devrandom, fsck, fix, json, unlink_wipe, shred, destroy,
+	deterministic_names, case_insensitive, pad_names, xattr_sidecar, acl, sparse, allow_root,
+	plaintext_symlinks, zero_corrupt, merkle, afsplit, trace_plain, lazy, force bool
+	// "-d" with optional list of debug categories
+	debug debugFlag
 	// Mount options with opposites
 	dev, nodev, suid, nosuid, exec, noexec, rw, ro, kernel_cache bool
 	masterkey, mountpoint, cipherdir, cpuprofile,
-	memprofile, ko, ctlsock, fsname, force_owner, trace, fido2 string
+	memprofile, ko, ctlsock, fsname, volname, force_owner, trace, fido2, wipe,
+	cgroup, subdir, syslog_tag, log_format, metrics, trace_fuse, audit, audit_key, unmount, lock, unlock, setuid, migrate_encfs, migrate_ecryptfs string
+	// Archive files for -export and -import
+	export_archive, import_archive string
+	// Operation on the trash, "-trash list|restore|purge"
+	trash string
+	// Operation on the snapshots, "-snapshot create|list|delete", and the
+	// snapshot to mount, "-mount-snapshot"
+	snapshot, mount_snapshot string
+	// Operation on the directories with their own key, "-dirkey add|list|remove"
+	dirkey string
+	// Operation on the decrypt-only key slot, "-decrypt-only add|remove"
+	decrypt_only string
+	// Operation on the duress password, "-duress add|remove", and the
+	// command to start when it is used, "-duress-hook"
+	duress      string
+	duress_hook multipleStrings
 	// -extpass, -badname, -passfile can be passed multiple times
 	extpass, badname, passfile multipleStrings
 	// For reverse mode, several ways to specify exclusions. All can be specified multiple times.
 	exclude, excludeWildcard, excludeFrom multipleStrings
+	// For forward mode, file name patterns to store unencrypted
+	passthrough multipleStrings
 	// Configuration file name override
-	config             string
-	notifypid, scryptn int
+	config                                    string
+	notifypid, notifyfd, scryptn, longnamemax int
+	// Resource limits and cache sizes
+	nice, dircache, read_pipeline, prefetch, max_readahead int
+	// Concurrency limits, "-max_background" and "-max_threads"
+	max_background, max_threads int
+	// Largest read and write request, "-max_write"
+	max_write int
 	// Idle time before autounmount
 	idle time.Duration
+	// Pause between two background scrub passes, "-scrub"
+	scrub time.Duration
+	// How long deleted files stay in the trash, "-trash-retention"
+	trash_retention time.Duration
+	// Maximum plaintext bytes stored, "-quota"
+	quota sizeFlag
+	// How long the kernel caches file attributes, names and failed lookups
+	attr_timeout, entry_timeout, negative_timeout time.Duration
 	// Helper variables that are NOT cli options all start with an underscore
 	// _configCustom is true when the user sets a custom config file name.
 	_configCustom bool
 	// _ctlsockFd stores the control socket file descriptor (ctlsock stores the path)
 	_ctlsockFd net.Listener
+	// _metricsFd stores the listening socket of "-metrics"
+	_metricsFd net.Listener
+	// _fuseTracer writes the "-trace-fuse" file
+	_fuseTracer *fuseTracer
+	// _keyLock guards the keys for "-lock", see lock.go
+	_keyLock *keylock.KeyLock
+	// _threads has a slot for each request that may be worked on at the
+	// same time, see max_threads.go. Nil without "-max_threads".
+	_threads chan struct{}
+	// _auditLog is the open "-audit" file
+	_auditLog *audit.Log
 	// _forceOwner is, if non-nil, a parsed, validated Owner (as opposed to the string above)
 	_forceOwner *fuse.Owner
 	// _explicitScryptn is true then the user passed "-scryptn=xyz"
 	_explicitScryptn bool
+	// _explicitLongnamemax is true if the user passed "-longnamemax"
+	_explicitLongnamemax bool
+	// _passwordPrompt replaces the default "Password" prompt when several
+	// filesystems are mounted at once
+	_passwordPrompt string
+	// _duress is set by loadConfig when the duress password has been
+	// entered, see duress.go
+	_duress bool
+	// _decryptOnly is set by loadConfig when the password unlocked the
+	// decrypt-only key slot instead of the master key
+	_decryptOnly bool
 }
 
 type multipleStrings []string
@@ -70,6 +133,68 @@ func (s *multipleStrings) Empty() bool {
 	return len(s2) == 0
 }
 
+// debugFlag is a boolean flag that can also take a value, like
+// "-d=names,fuse". The value must be passed with "=", as "-d names" would
+// take "names" as a path argument.
+type debugFlag struct {
+	enabled    bool
+	categories string
+}
+
+func (d *debugFlag) IsBoolFlag() bool {
+	return true
+}
+
+func (d *debugFlag) String() string {
+	if d == nil || !d.enabled {
+		return "false"
+	}
+	if d.categories == "" {
+		return "true"
+	}
+	return d.categories
+}
+
+func (d *debugFlag) Set(val string) error {
+	switch val {
+	case "true":
+		d.enabled, d.categories = true, ""
+	case "false":
+		d.enabled, d.categories = false, ""
+	default:
+		d.enabled, d.categories = true, val
+	}
+	return nil
+}
+
+// sizeFlag is a size in bytes. It accepts the suffixes K, M, G and T for
+// powers of 1024, like "-quota 10G".
+type sizeFlag int64
+
+func (s *sizeFlag) String() string {
+	if s == nil {
+		return "0"
+	}
+	return strconv.FormatInt(int64(*s), 10)
+}
+
+func (s *sizeFlag) Set(val string) error {
+	num := val
+	var mult int64 = 1
+	if l := len(val); l > 0 {
+		if i := strings.Index("KMGT", strings.ToUpper(val[l-1:])); i >= 0 {
+			num = val[:l-1]
+			mult = 1 << (10 * uint(i+1))
+		}
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/mult {
+		return fmt.Errorf("invalid size %q", val)
+	}
+	*s = sizeFlag(n * mult)
+	return nil
+}
+
 var flagSet *flag.FlagSet
 
 // prefixOArgs transform options passed via "-o foo,bar" into regular options
@@ -108,7 +233,7 @@ func prefixOArgs(osArgs []string) ([]string, error) {
 	newArgs := []string{osArgs[0]}
 	// Add options from "-o"
 	for _, o := range oOpts {
-		if o == "" {
+		if o == "" || isFstabOnlyOpt(o) {
 			continue
 		}
 		if o == "o" || o == "-o" {
@@ -126,7 +251,15 @@ func prefixOArgs(osArgs []string) ([]string, error) {
 func parseCliOpts() (args argContainer) {
 	var err error
 	var opensslAuto string
+	var mountHelperFake bool
 
+	if isMountHelper(os.Args[0]) {
+		os.Args, mountHelperFake, err = mountHelperArgs(os.Args)
+		if err != nil {
+			tlog.Fatal.Println(err)
+			os.Exit(exitcodes.Usage)
+		}
+	}
 	os.Args, err = prefixOArgs(os.Args)
 	if err != nil {
 		tlog.Fatal.Println(err)
@@ -135,8 +268,9 @@ func parseCliOpts() (args argContainer) {
 
 	flagSet = flag.NewFlagSet(tlog.ProgramName, flag.ContinueOnError)
 	flagSet.Usage = func() {}
-	flagSet.BoolVar(&args.debug, "d", false, "")
-	flagSet.BoolVar(&args.debug, "debug", false, "Enable debug output")
+	flagSet.Var(&args.debug, "d", "")
+	flagSet.Var(&args.debug, "debug", "Enable debug output, optionally only for a comma-separated list "+
+		"of categories: names, content, fuse, locks, cache")
 	flagSet.BoolVar(&args.fusedebug, "fusedebug", false, "Enable fuse library debug output")
 	flagSet.BoolVar(&args.init, "init", false, "Initialize encrypted directory")
 	flagSet.BoolVar(&args.zerokey, "zerokey", false, "Use all-zero dummy master key")
@@ -150,25 +284,50 @@ func parseCliOpts() (args argContainer) {
 	flagSet.BoolVar(&args.quiet, "q", false, "")
 	flagSet.BoolVar(&args.quiet, "quiet", false, "Quiet - silence informational messages")
 	flagSet.BoolVar(&args.nosyslog, "nosyslog", false, "Do not redirect output to syslog when running in the background")
+	flagSet.BoolVar(&args.syslog, "syslog", false, "Redirect output to syslog also when running in the foreground")
+	flagSet.StringVar(&args.syslog_tag, "syslog-tag", tlog.ProgramName, "Tag to identify our messages in syslog")
+	flagSet.StringVar(&args.log_format, "log-format", "text", "Format of diagnostic messages: text or json")
 	flagSet.BoolVar(&args.wpanic, "wpanic", false, "When encountering a warning, panic and exit immediately")
 	flagSet.BoolVar(&args.longnames, "longnames", true, "Store names longer than 176 bytes in extra files")
 	flagSet.BoolVar(&args.allow_other, "allow_other", false, "Allow other users to access the filesystem. "+
 		"Only works if user_allow_other is set in /etc/fuse.conf.")
+	flagSet.BoolVar(&args.allow_root, "allow_root", false, "Like -allow_other, but only allow root in "+
+		"besides the user running gocryptfs.")
 	flagSet.BoolVar(&args.reverse, "reverse", false, "Reverse mode")
 	flagSet.BoolVar(&args.aessiv, "aessiv", false, "AES-SIV encryption")
 	flagSet.BoolVar(&args.nonempty, "nonempty", false, "Allow mounting over non-empty directories")
 	flagSet.BoolVar(&args.raw64, "raw64", true, "Use unpadded base64 for file names")
+	flagSet.BoolVar(&args.deterministic_names, "deterministic-names", false, "Disable diriv file name randomisation")
+	flagSet.BoolVar(&args.pad_names, "pad-names", false, "Pad file names to hide their length")
+	flagSet.BoolVar(&args.plaintext_symlinks, "plaintext-symlinks", false, "Do not encrypt symlink targets")
+	flagSet.BoolVar(&args.merkle, "merkle", false, "Store a Merkle root hash of the ciphertext with each file")
+	flagSet.BoolVar(&args.afsplit, "afsplit", false, "Store the encrypted master key split into stripes, like LUKS")
 	flagSet.BoolVar(&args.noprealloc, "noprealloc", false, "Disable preallocation before writing")
 	flagSet.BoolVar(&args.speed, "speed", false, "Run crypto speed test")
 	flagSet.BoolVar(&args.hkdf, "hkdf", true, "Use HKDF as an additional key derivation step")
 	flagSet.BoolVar(&args.serialize_reads, "serialize_reads", false, "Try to serialize read operations")
 	flagSet.BoolVar(&args.forcedecode, "forcedecode", false, "Force decode of files even if integrity check fails."+
 		" Requires gocryptfs to be compiled with openssl support and implies -openssl true")
+	flagSet.BoolVar(&args.zero_corrupt, "zero-corrupt", false, "Return zeros for blocks that fail the integrity check instead of an IO error."+
+		" Implies -ro")
 	flagSet.BoolVar(&args.hh, "hh", false, "Show this long help text")
 	flagSet.BoolVar(&args.info, "info", false, "Display information about CIPHERDIR")
+	flagSet.BoolVar(&args.json, "json", false, "Output machine-readable JSON (with -info and -fsck)")
 	flagSet.BoolVar(&args.sharedstorage, "sharedstorage", false, "Make concurrent access to a shared CIPHERDIR safer")
 	flagSet.BoolVar(&args.devrandom, "devrandom", false, "Use /dev/random for generating master key")
 	flagSet.BoolVar(&args.fsck, "fsck", false, "Run a filesystem check on CIPHERDIR")
+	flagSet.BoolVar(&args.fix, "fix", false, "Repair lost gocryptfs.diriv files (with -fsck)")
+	flagSet.StringVar(&args.migrate_encfs, "migrate-encfs", "", "Move the files from this mounted EncFS filesystem into CIPHERDIR")
+	flagSet.StringVar(&args.export_archive, "export", "", "Write CIPHERDIR into this tar archive (\"-\" for stdout)")
+	flagSet.StringVar(&args.import_archive, "import", "", "Extract this tar archive created by -export into the empty CIPHERDIR")
+	flagSet.StringVar(&args.migrate_ecryptfs, "migrate-ecryptfs", "", "Move the files from this mounted eCryptfs filesystem into CIPHERDIR")
+	flagSet.StringVar(&args.trash, "trash", "", "List, restore or purge deleted files in the trash of CIPHERDIR (list|restore|purge)")
+	flagSet.StringVar(&args.snapshot, "snapshot", "", "Create, list or delete snapshots of CIPHERDIR (create|list|delete)")
+	flagSet.StringVar(&args.decrypt_only, "decrypt-only", "", "Add or remove a password that gocryptfs only mounts read-only, not enforced cryptographically (add|remove)")
+	flagSet.StringVar(&args.duress, "duress", "", "Add or remove a password that mounts a decoy instead of CIPHERDIR (add|remove)")
+	flagSet.Var(&args.duress_hook, "duress-hook", "Command that the duress password starts (with -duress add)")
+	flagSet.StringVar(&args.dirkey, "dirkey", "", "Give a top-level directory its own key and password, list them, or remove the key (add|list|remove)")
+	flagSet.BoolVar(&args.destroy, "destroy", false, "Overwrite the config file of CIPHERDIR, making all files unrecoverable")
 
 	// Mount options with opposites
 	flagSet.BoolVar(&args.dev, "dev", false, "Allow device files")
@@ -179,7 +338,14 @@ func parseCliOpts() (args argContainer) {
 	flagSet.BoolVar(&args.noexec, "noexec", false, "Deny executables")
 	flagSet.BoolVar(&args.rw, "rw", false, "Mount the filesystem read-write")
 	flagSet.BoolVar(&args.ro, "ro", false, "Mount the filesystem read-only")
+	flagSet.StringVar(&args.mount_snapshot, "mount-snapshot", "", "Mount this snapshot of CIPHERDIR read-only")
 	flagSet.BoolVar(&args.kernel_cache, "kernel_cache", false, "Enable the FUSE kernel_cache option")
+	flagSet.BoolVar(&args.unlink_wipe, "unlink-wipe", false, "Overwrite file contents with random data before deleting")
+	flagSet.BoolVar(&args.shred, "shred", false, "Overwrite all ciphertext with random data before it is deleted or truncated")
+	flagSet.BoolVar(&args.case_insensitive, "case-insensitive", false, "Match file names regardless of case (forward mode only)")
+	flagSet.BoolVar(&args.xattr_sidecar, "xattr-sidecar", false, "Store xattrs the backing filesystem refuses in encrypted sidecar files (forward mode only)")
+	flagSet.BoolVar(&args.acl, "acl", false, "Store POSIX ACLs unencrypted and enforce them (forward mode only)")
+	flagSet.BoolVar(&args.sparse, "sparse", false, "Store blocks of zeros as file holes (forward mode only)")
 
 	flagSet.StringVar(&args.masterkey, "masterkey", "", "Mount with explicit master key")
 	flagSet.StringVar(&args.cpuprofile, "cpuprofile", "", "Write cpu profile to specified file")
@@ -187,10 +353,25 @@ func parseCliOpts() (args argContainer) {
 	flagSet.StringVar(&args.config, "config", "", "Use specified config file instead of CIPHERDIR/gocryptfs.conf")
 	flagSet.StringVar(&args.ko, "ko", "", "Pass additional options directly to the kernel, comma-separated list")
 	flagSet.StringVar(&args.ctlsock, "ctlsock", "", "Create control socket at specified path")
+	flagSet.StringVar(&args.metrics, "metrics", "", "Serve Prometheus metrics on this HTTP address")
 	flagSet.StringVar(&args.fsname, "fsname", "", "Override the filesystem name")
+	flagSet.StringVar(&args.volname, "volname", "", "Override the volume name (MacOS only)")
+	flagSet.StringVar(&args.subdir, "subdir", "", "Mount only this plaintext subdirectory of CIPHERDIR")
 	flagSet.StringVar(&args.force_owner, "force_owner", "", "uid:gid pair to coerce ownership")
 	flagSet.StringVar(&args.trace, "trace", "", "Write execution trace to file")
+	flagSet.StringVar(&args.audit, "audit", "", "Append file accesses to this audit log")
+	flagSet.StringVar(&args.audit_key, "audit-key", "", "HMAC-chain the -audit log with the key in this file")
+	flagSet.StringVar(&args.trace_fuse, "trace-fuse", "", "Write a trace of all FUSE requests to file")
+	flagSet.BoolVar(&args.trace_plain, "trace-plain", false, "Write file names to the -trace-fuse file unhashed")
 	flagSet.StringVar(&args.fido2, "fido2", "", "Protect the masterkey using a FIDO2 token instead of a password")
+	flagSet.StringVar(&args.wipe, "wipe", "", "Overwrite ciphertext file with random data and delete it")
+	flagSet.StringVar(&args.cgroup, "cgroup", "", "Move the process into this cgroup directory")
+	flagSet.StringVar(&args.setuid, "setuid", "", "When started as root, switch to this user before mounting")
+	flagSet.StringVar(&args.unmount, "unmount", "", "Unmount the gocryptfs mount at this mountpoint or of this cipherdir")
+	flagSet.BoolVar(&args.lazy, "lazy", false, "With -unmount: detach the mount even if files are still open")
+	flagSet.BoolVar(&args.force, "force", false, "With -unmount: abort all pending file operations (needs root)")
+	flagSet.StringVar(&args.lock, "lock", "", "Wipe the keys of the gocryptfs mount at this mountpoint or of this cipherdir")
+	flagSet.StringVar(&args.unlock, "unlock", "", "Ask for the password and undo -lock at this mountpoint or cipherdir")
 
 	// Exclusion options
 	flagSet.Var(&args.exclude, "e", "Alias for -exclude")
@@ -198,6 +379,7 @@ func parseCliOpts() (args argContainer) {
 	flagSet.Var(&args.excludeWildcard, "ew", "Alias for -exclude-wildcard")
 	flagSet.Var(&args.excludeWildcard, "exclude-wildcard", "Exclude path from reverse view, supporting wildcards")
 	flagSet.Var(&args.excludeFrom, "exclude-from", "File from which to read exclusion patterns (with -exclude-wildcard syntax)")
+	flagSet.Var(&args.passthrough, "passthrough", "Store files matching this name pattern unencrypted (forward mode only)")
 
 	// multipleStrings options ([]string)
 	flagSet.Var(&args.extpass, "extpass", "Use external program for the password prompt")
@@ -206,13 +388,37 @@ func parseCliOpts() (args argContainer) {
 
 	flagSet.IntVar(&args.notifypid, "notifypid", 0, "Send USR1 to the specified process after "+
 		"successful mount - used internally for daemonization")
+	flagSet.IntVar(&args.notifyfd, "notifyfd", 0, "Write \"OK\" to the specified file descriptor and close it "+
+		"after successful mount - used internally for daemonization")
 	const scryptn = "scryptn"
 	flagSet.IntVar(&args.scryptn, scryptn, configfile.ScryptDefaultLogN, "scrypt cost parameter logN. Possible values: 10-28. "+
 		"A lower value speeds up mounting and reduces its memory needs, but makes the password susceptible to brute-force attacks")
 
+	flagSet.IntVar(&args.longnamemax, "longnamemax", 255, "Hash encrypted names that are longer than this")
+	flagSet.IntVar(&args.dircache, "dircache", fusefrontend.DirCacheSizeDefault, "Number of directories to keep open for faster path lookups")
+	flagSet.IntVar(&args.read_pipeline, "read-pipeline", 2, "Number of chunks to read ahead of decryption. 0 disables the read pipeline")
+	flagSet.IntVar(&args.prefetch, "prefetch", 0, "Number of blocks to read and decrypt ahead of sequential reads. 0 disables prefetching")
+	flagSet.IntVar(&args.max_readahead, "max_readahead", 0, "Kernel readahead in bytes. 0 keeps the kernel default")
+	flagSet.IntVar(&args.max_write, "max_write", fuse.MAX_KERNEL_WRITE, "Largest read and write request the kernel may send, in bytes")
+	flagSet.IntVar(&args.max_background, "max_background", 0, "Number of asynchronous requests the kernel may send at once. 0 keeps the kernel default")
+	flagSet.IntVar(&args.max_threads, "max_threads", 0, "Number of requests worked on at the same time. 0 means no limit")
+	flagSet.IntVar(&args.nice, "nice", 0, "CPU nice value (-20..19). Also lowers the IO priority")
+
 	flagSet.DurationVar(&args.idle, "i", 0, "Alias for -idle")
 	flagSet.DurationVar(&args.idle, "idle", 0, "Auto-unmount after specified idle duration (ignored in reverse mode). "+
 		"Durations are specified like \"500s\" or \"2h45m\". 0 means stay mounted indefinitely.")
+	flagSet.DurationVar(&args.scrub, "scrub", 0, "Verify all files in the background, pausing the specified duration between passes. "+
+		"0 disables the scrubber.")
+	flagSet.DurationVar(&args.trash_retention, "trash-retention", 0, "Move deleted files into the trash and keep them for the specified duration. "+
+		"0 deletes files immediately.")
+	flagSet.Var(&args.quota, "quota", "Fail writes with EDQUOT when the files would exceed this size. "+
+		"Accepts the suffixes K, M, G and T. 0 means no limit.")
+	flagSet.DurationVar(&args.attr_timeout, "attr_timeout", time.Second, "How long the kernel caches file attributes like size and mtime. "+
+		"0 disables the caching.")
+	flagSet.DurationVar(&args.entry_timeout, "entry_timeout", time.Second, "How long the kernel caches file names. "+
+		"0 disables the caching.")
+	flagSet.DurationVar(&args.negative_timeout, "negative_timeout", time.Second, "How long the kernel remembers that a file does not exist. "+
+		"0 disables the caching.")
 
 	var nofail bool
 	flagSet.BoolVar(&nofail, "nofail", false, "Ignored for /etc/fstab compatibility")
@@ -229,10 +435,15 @@ func parseCliOpts() (args argContainer) {
 		tlog.Fatal.Printf("Invalid command line: %s. Try '%s -help'.", prettyArgs(), tlog.ProgramName)
 		os.Exit(exitcodes.Usage)
 	}
+	if mountHelperFake {
+		// "mount -f": the command line is fine, but don't actually mount
+		os.Exit(0)
+	}
 	// We want to know if -scryptn was passed explicitly
 	if isFlagPassed(flagSet, scryptn) {
 		args._explicitScryptn = true
 	}
+	args._explicitLongnamemax = isFlagPassed(flagSet, "longnamemax")
 	// "-openssl" needs some post-processing
 	if opensslAuto == "auto" {
 		args.openssl = stupidgcm.PreferOpenSSL()
@@ -267,6 +478,22 @@ func parseCliOpts() (args argContainer) {
 		// Try to make it harder for the user to shoot himself in the foot.
 		args.ro = true
 		args.allow_other = false
+		args.allow_root = false
+		args.ko = "noexec"
+	}
+	if args.zero_corrupt {
+		if args.forcedecode {
+			tlog.Fatal.Printf("The options -zero-corrupt and -forcedecode cannot be used at the same time")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.reverse {
+			tlog.Fatal.Printf("The reverse mode and the -zero-corrupt option are not compatible")
+			os.Exit(exitcodes.Usage)
+		}
+		// Writing would turn the zeros into valid data
+		args.ro = true
+		args.allow_other = false
+		args.allow_root = false
 		args.ko = "noexec"
 	}
 	if !args.extpass.Empty() && len(args.passfile) != 0 {
@@ -289,6 +516,172 @@ func parseCliOpts() (args argContainer) {
 		tlog.Fatal.Printf("Idle timeout cannot be less than 0")
 		os.Exit(exitcodes.Usage)
 	}
+	if args.log_format != "text" && args.log_format != "json" {
+		tlog.Fatal.Printf("-log-format: unknown format %q, want text or json", args.log_format)
+		os.Exit(exitcodes.Usage)
+	}
+	if args.syslog && args.nosyslog {
+		tlog.Fatal.Printf("The options -syslog and -nosyslog cannot be used at the same time")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.fix && !args.fsck {
+		tlog.Fatal.Printf("-fix only works together with -fsck")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.audit_key != "" && args.audit == "" {
+		tlog.Fatal.Printf("-audit-key only works together with -audit")
+		os.Exit(exitcodes.Usage)
+	}
+	if (args.lazy || args.force) && args.unmount == "" {
+		tlog.Fatal.Printf("-lazy and -force only work together with -unmount")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.lock != "" && args.unlock != "" {
+		tlog.Fatal.Printf("The options -lock and -unlock cannot be used at the same time")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.trace_plain && args.trace_fuse == "" {
+		tlog.Fatal.Printf("-trace-plain only works together with -trace-fuse")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.scrub < 0 {
+		tlog.Fatal.Printf("-scrub: duration cannot be less than 0")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.trash_retention < 0 {
+		tlog.Fatal.Printf("-trash-retention: duration cannot be less than 0")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.trash_retention > 0 && args.unlink_wipe {
+		tlog.Fatal.Printf("The options -trash-retention and -unlink-wipe cannot be used at the same time")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.trash_retention > 0 && args.shred {
+		tlog.Fatal.Printf("The options -trash-retention and -shred cannot be used at the same time")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.quota > 0 && args.sharedstorage {
+		// Other machines would change the usage behind our back
+		tlog.Fatal.Printf("-quota does not work with -sharedstorage")
+		os.Exit(exitcodes.Usage)
+	}
+	switch args.trash {
+	case "", "list", "restore", "purge":
+	default:
+		tlog.Fatal.Printf("-trash: unknown operation %q, want list, restore or purge", args.trash)
+		os.Exit(exitcodes.Usage)
+	}
+	switch args.snapshot {
+	case "", "create", "list", "delete":
+	default:
+		tlog.Fatal.Printf("-snapshot: unknown operation %q, want create, list or delete", args.snapshot)
+		os.Exit(exitcodes.Usage)
+	}
+	switch args.decrypt_only {
+	case "", "add", "remove":
+	default:
+		tlog.Fatal.Printf("-decrypt-only: unknown operation %q, want add or remove", args.decrypt_only)
+		os.Exit(exitcodes.Usage)
+	}
+	switch args.duress {
+	case "", "add", "remove":
+	default:
+		tlog.Fatal.Printf("-duress: unknown operation %q, want add or remove", args.duress)
+		os.Exit(exitcodes.Usage)
+	}
+	if !args.duress_hook.Empty() && args.duress != "add" {
+		tlog.Fatal.Printf("-duress-hook only works with -duress add")
+		os.Exit(exitcodes.Usage)
+	}
+	switch args.dirkey {
+	case "", "add", "list", "remove":
+	default:
+		tlog.Fatal.Printf("-dirkey: unknown operation %q, want add, list or remove", args.dirkey)
+		os.Exit(exitcodes.Usage)
+	}
+	if args.mount_snapshot != "" && countOpFlags(&args) > 0 {
+		tlog.Fatal.Printf("-mount-snapshot only works when mounting")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.longnamemax < configfile.LongNameMaxMin || args.longnamemax > 255 {
+		tlog.Fatal.Printf("-longnamemax: value %d is outside of the allowed range %d..255",
+			args.longnamemax, configfile.LongNameMaxMin)
+		os.Exit(exitcodes.Usage)
+	}
+	if args.dircache < 0 {
+		tlog.Fatal.Printf("-dircache: value cannot be negative")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.read_pipeline < 0 {
+		tlog.Fatal.Printf("-read-pipeline: value cannot be negative")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.prefetch < 0 || args.prefetch > fusefrontend.MaxPrefetch {
+		tlog.Fatal.Printf("-prefetch: value %d is outside of the allowed range 0..%d",
+			args.prefetch, fusefrontend.MaxPrefetch)
+		os.Exit(exitcodes.Usage)
+	}
+	if args.prefetch > 0 && args.sharedstorage {
+		// We would not notice changes made by other machines
+		tlog.Fatal.Printf("-prefetch does not work with -sharedstorage")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.max_readahead < 0 {
+		tlog.Fatal.Printf("-max_readahead: value cannot be negative")
+		os.Exit(exitcodes.Usage)
+	}
+	// The kernel takes a 16-bit value
+	if args.max_background < 0 || args.max_background > math.MaxUint16 {
+		tlog.Fatal.Printf("-max_background: value %d is outside of the allowed range 0..%d",
+			args.max_background, math.MaxUint16)
+		os.Exit(exitcodes.Usage)
+	}
+	// The kernel works in pages
+	if args.max_write < 4096 || args.max_write > fuse.MAX_KERNEL_WRITE || args.max_write%4096 != 0 {
+		tlog.Fatal.Printf("-max_write: value %d must be a multiple of 4096 between 4096 and %d",
+			args.max_write, fuse.MAX_KERNEL_WRITE)
+		os.Exit(exitcodes.Usage)
+	}
+	if args.max_threads < 0 {
+		tlog.Fatal.Printf("-max_threads: value cannot be negative")
+		os.Exit(exitcodes.Usage)
+	}
+	timeouts := []struct {
+		name string
+		val  time.Duration
+	}{
+		{"attr_timeout", args.attr_timeout},
+		{"entry_timeout", args.entry_timeout},
+		{"negative_timeout", args.negative_timeout},
+	}
+	for _, t := range timeouts {
+		if t.val < 0 {
+			tlog.Fatal.Printf("-%s: value cannot be negative", t.name)
+			os.Exit(exitcodes.Usage)
+		}
+		if args.sharedstorage && isFlagPassed(flagSet, t.name) {
+			// Changes made by other machines would stay invisible
+			tlog.Fatal.Printf("-%s does not work with -sharedstorage", t.name)
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if args.nice < -20 || args.nice > 19 {
+		tlog.Fatal.Printf("-nice: value %d is outside of the allowed range -20..19", args.nice)
+		os.Exit(exitcodes.Usage)
+	}
+	for i, pattern := range args.passthrough {
+		// "-passthrough .git/" is a natural way to say "the .git directory"
+		pattern = strings.TrimSuffix(pattern, "/")
+		if pattern == "" || strings.Contains(pattern, "/") {
+			tlog.Fatal.Printf("-passthrough: %q is not a file name pattern", args.passthrough[i])
+			os.Exit(exitcodes.Usage)
+		}
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			tlog.Fatal.Printf("-passthrough: %q: %v", pattern, err)
+			os.Exit(exitcodes.Usage)
+		}
+		args.passthrough[i] = pattern
+	}
 	return args
 }
 
@@ -315,6 +708,36 @@ func countOpFlags(args *argContainer) int {
 	if args.fsck {
 		count++
 	}
+	if args.destroy {
+		count++
+	}
+	if args.migrate_encfs != "" {
+		count++
+	}
+	if args.migrate_ecryptfs != "" {
+		count++
+	}
+	if args.export_archive != "" {
+		count++
+	}
+	if args.import_archive != "" {
+		count++
+	}
+	if args.trash != "" {
+		count++
+	}
+	if args.snapshot != "" {
+		count++
+	}
+	if args.dirkey != "" {
+		count++
+	}
+	if args.decrypt_only != "" {
+		count++
+	}
+	if args.duress != "" {
+		count++
+	}
 	return count
 }
 
@@ -68,6 +68,11 @@ func TestPrefixOArgs(t *testing.T) {
 			i: []string{"gocryptfs", "foo", "bar", "-o"},
 			e: true,
 		},
+		// Options for mount(8) and systemd from /etc/fstab are dropped
+		{
+			i: []string{"gocryptfs", "foo", "bar", "-o", "defaults,noauto,x-systemd.automount,ro,_netdev"},
+			o: []string{"gocryptfs", "-ro", "foo", "bar"},
+		},
 	}
 	for _, tc := range testcases {
 		o, err := prefixOArgs(tc.i)
@@ -88,3 +93,85 @@ func TestStringSlice(t *testing.T) {
 		t.Errorf("Wrong string representation: want=%q have=%q", want, have)
 	}
 }
+
+func TestSizeFlag(t *testing.T) {
+	testcases := []struct {
+		in   string
+		want int64
+		err  bool
+	}{
+		{"0", 0, false},
+		{"1000", 1000, false},
+		{"4k", 4096, false},
+		{"10M", 10 << 20, false},
+		{"2G", 2 << 30, false},
+		{"1T", 1 << 40, false},
+		{"", 0, true},
+		{"G", 0, true},
+		{"-1", 0, true},
+		{"1.5G", 0, true},
+		{"10GB", 0, true},
+		{"9223372036854775807T", 0, true},
+	}
+	for _, tc := range testcases {
+		var s sizeFlag
+		err := s.Set(tc.in)
+		if (err != nil) != tc.err || int64(s) != tc.want {
+			t.Errorf("%q: want %d err=%v, got %d err=%v", tc.in, tc.want, tc.err, s, err)
+		}
+	}
+}
+
+// TestMountHelperArgs checks the translation of the mount(8) helper command
+// line.
+func TestMountHelperArgs(t *testing.T) {
+	testcases := []struct {
+		testcase
+		fake bool
+	}{
+		{
+			testcase: testcase{
+				i: []string{"mount.fuse.gocryptfs", "/c", "/p"},
+				o: []string{"mount.fuse.gocryptfs", "/c", "/p"},
+			},
+		},
+		{
+			testcase: testcase{
+				i: []string{"mount.fuse.gocryptfs", "/c", "/p", "-n", "-o", "rw,allow_other,passfile=/pw", "-t", "fuse.gocryptfs"},
+				o: []string{"mount.fuse.gocryptfs", "/c", "/p", "-o", "rw,allow_other,passfile=/pw"},
+			},
+		},
+		{
+			testcase: testcase{
+				i: []string{"mount.gocryptfs", "-f", "-s", "-v", "/c", "/p"},
+				o: []string{"mount.gocryptfs", "/c", "/p"},
+			},
+			fake: true,
+		},
+		{
+			testcase: testcase{
+				i: []string{"mount.fuse.gocryptfs", "/c", "/p", "-N", "/proc/1/ns/mnt"},
+				e: true,
+			},
+		},
+		{
+			testcase: testcase{
+				i: []string{"mount.fuse.gocryptfs", "/c"},
+				e: true,
+			},
+		},
+		{
+			testcase: testcase{
+				i: []string{"mount.fuse.gocryptfs", "/c", "/p", "-o"},
+				e: true,
+			},
+		},
+	}
+	for _, tc := range testcases {
+		o, fake, err := mountHelperArgs(tc.i)
+		e := (err != nil)
+		if !reflect.DeepEqual(o, tc.o) || e != tc.e || fake != tc.fake {
+			t.Errorf("\n  in=%q\nwant=%q err=%v fake=%v\n got=%q err=%v fake=%v", tc.i, tc.o, tc.e, tc.fake, o, e, fake)
+		}
+	}
+}
@@ -1,12 +1,19 @@
 package ctlsock
 
 // RequestStruct is sent by a client (encoded as JSON).
-// You cannot perform both encryption and decryption in the same request.
+// You can only set one of the fields in a request.
 type RequestStruct struct {
 	// EncryptPath is the path that should be encrypted.
 	EncryptPath string
 	// DecryptPath is the path that should be decrypted.
 	DecryptPath string
+	// Stats requests the statistics of the mounted filesystem.
+	Stats bool `json:",omitempty"`
+	// Lock wipes the keys from memory, see "-lock". The filesystem stays
+	// mounted, but returns EACCES until it is unlocked.
+	Lock bool `json:",omitempty"`
+	// Unlock is the password that undoes Lock.
+	Unlock string `json:",omitempty"`
 }
 
 // ResponseStruct is sent by the server in response to a request
@@ -23,4 +30,31 @@ type ResponseStruct struct {
 	// WarnText contains warnings that may have been encountered while
 	// processing the message.
 	WarnText string
+	// Stats is the answer to a Stats request.
+	Stats *StatsStruct `json:",omitempty"`
+}
+
+// StatsStruct contains the statistics of a mounted filesystem. The counters
+// start at zero when it is mounted.
+type StatsStruct struct {
+	// Seconds is the time since the filesystem was mounted.
+	Seconds float64
+	// OpenFiles is the number of files that are currently open.
+	OpenFiles int
+	// DirCacheEntries is the number of entries in the directory cache, and
+	// DirCacheSize the number it may hold at the moment.
+	DirCacheEntries int
+	DirCacheSize    int
+	// DirCacheLookups and DirCacheHits count the lookups in the directory
+	// cache and the ones that found an entry.
+	DirCacheLookups uint64
+	DirCacheHits    uint64
+	// BytesRead and BytesWritten count the plaintext bytes read from and
+	// written to files.
+	BytesRead    uint64
+	BytesWritten uint64
+	// ContentDecryptFailures counts file headers and blocks, and
+	// NameDecryptFailures file names, that could not be decrypted.
+	ContentDecryptFailures uint64
+	NameDecryptFailures    uint64
 }
@@ -2,9 +2,9 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
-	"os/signal"
 	"syscall"
 
 	"github.com/rfjakob/gocryptfs/internal/exitcodes"
@@ -12,20 +12,18 @@ import (
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
-// The child sends us USR1 if the mount was successful. Exit with error code
-// 0 if we get it.
-func exitOnUsr1() {
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGUSR1)
-	go func() {
-		<-c
-		os.Exit(0)
-	}()
-}
+// notifyMsg is what the child writes to the "-notifyfd" pipe once all
+// filesystems are mounted and serving.
+const notifyMsg = "OK\n"
 
 // forkChild - execute ourselves once again, this time with the "-fg" flag, and
-// wait for SIGUSR1 or child exit.
+// wait until the child reports a successful mount, or exits.
 // This is a workaround for the missing true fork function in Go.
+//
+// The child gets the write end of a pipe as fd 3 ("-notifyfd=3"), and writes
+// notifyMsg to it when the mount is serving. If the child exits before, the
+// pipe is closed without a message and we exit with the exit code of the
+// child. The child has printed the error message to our stderr already.
 func forkChild() int {
 	name := os.Args[0]
 	// Use the full path to our executable if we can get if from /proc.
@@ -35,18 +33,32 @@ func forkChild() int {
 		name = string(buf[:n])
 		tlog.Debug.Printf("forkChild: readlink worked: %q", name)
 	}
-	newArgs := []string{"-fg", fmt.Sprintf("-notifypid=%d", os.Getpid())}
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		tlog.Fatal.Printf("forkChild: %v", err)
+		return exitcodes.ForkChild
+	}
+	// ExtraFiles[0] becomes fd 3 in the child
+	newArgs := []string{"-fg", "-notifyfd=3"}
 	newArgs = append(newArgs, os.Args[1:]...)
 	c := exec.Command(name, newArgs...)
 	c.Stdout = os.Stdout
 	c.Stderr = os.Stderr
 	c.Stdin = os.Stdin
-	exitOnUsr1()
+	c.ExtraFiles = []*os.File{pw}
 	err = c.Start()
+	pw.Close()
 	if err != nil {
 		tlog.Fatal.Printf("forkChild: starting %s failed: %v", name, err)
 		return exitcodes.ForkChild
 	}
+	buf = make([]byte, len(notifyMsg))
+	n, _ = io.ReadFull(pr, buf)
+	pr.Close()
+	if string(buf[:n]) == notifyMsg {
+		// The child is serving and keeps running in the background
+		return 0
+	}
 	err = c.Wait()
 	if err != nil {
 		if exiterr, ok := err.(*exec.ExitError); ok {
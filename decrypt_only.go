@@ -0,0 +1,72 @@
+package main
+
+import (
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/readpassword"
+	"github.com/rfjakob/gocryptfs/internal/secmem"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// decryptOnly adds or removes the decrypt-only key slot of CIPHERDIR. This
+// is called when you pass the "-decrypt-only" option.
+//
+// The slot does not hold the master key, but the keys for file names and
+// contents derived from it (cryptocore.DecryptOnlyKey). A filesystem that is
+// unlocked with it is mounted read-only and refuses to encrypt file
+// contents. The keys are symmetric, so this is enforced by gocryptfs only.
+func decryptOnly(args *argContainer) (exitcode int) {
+	if args.reverse {
+		tlog.Fatal.Printf("-decrypt-only only works in forward mode")
+		return exitcodes.Usage
+	}
+	masterkey, confFile := loadMasterkey(args)
+	defer func() {
+		secmem.Free(masterkey)
+	}()
+	if args.decrypt_only == "remove" {
+		if confFile.FindKeySlot(configfile.KeySlotDecryptOnly) == nil {
+			tlog.Fatal.Printf("-decrypt-only: there is no decrypt-only key slot")
+			return exitcodes.Usage
+		}
+		confFile.RemoveKeySlot(configfile.KeySlotDecryptOnly)
+	} else {
+		if !confFile.IsFeatureFlagSet(configfile.FlagHKDF) {
+			tlog.Fatal.Printf("-decrypt-only needs the HKDF feature flag, which filesystems created by gocryptfs v1.2 and older do not have")
+			return exitcodes.Usage
+		}
+		if confFile.IsFeatureFlagSet(configfile.FlagFIDO2) {
+			// Mounting would ask the FIDO2 token, not for a password
+			tlog.Fatal.Printf("-decrypt-only does not work with -fido2")
+			return exitcodes.Usage
+		}
+		backend := cryptocore.BackendGoGCM
+		if confFile.IsFeatureFlagSet(configfile.FlagAESSIV) {
+			backend = cryptocore.BackendAESSIV
+		}
+		key := cryptocore.DecryptOnlyKey(masterkey, backend)
+		tlog.Info.Println("Please enter the password for the decrypt-only key slot.")
+		password := readpassword.Twice([]string(args.extpass), []string(args.passfile))
+		logN := confFile.ScryptObject.LogN()
+		if args._explicitScryptn {
+			logN = args.scryptn
+		}
+		confFile.SetKeySlot(configfile.KeySlotDecryptOnly, key, password, logN)
+		for i := range password {
+			password[i] = 0
+		}
+		secmem.Free(key)
+	}
+	confFile.UpdateMAC(masterkey)
+	if err := confFile.WriteFile(); err != nil {
+		tlog.Fatal.Println(err)
+		return exitcodes.WriteConf
+	}
+	if args.decrypt_only == "remove" {
+		tlog.Info.Printf(tlog.ColorGreen + "Decrypt-only key slot removed." + tlog.ColorReset)
+	} else {
+		tlog.Info.Printf(tlog.ColorGreen + "Decrypt-only key slot set. Its password mounts the filesystem read-only." + tlog.ColorReset)
+	}
+	return 0
+}
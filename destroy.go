@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// destroyConfirm is what the user has to type to confirm "-destroy".
+const destroyConfirm = "DESTROY"
+
+// destroy overwrites the config file with random data and deletes it. As the
+// config file holds the only copy of the encrypted master key, this makes the
+// filesystem unrecoverable (unless the user has written down the master key).
+// This is called when you pass the "-destroy" option.
+func destroy(args *argContainer) (exitcode int) {
+	// Make sure that we are actually looking at a gocryptfs config file, so a
+	// typo in "-config" cannot wipe an unrelated file
+	cf, err := configfile.Load(args.config)
+	if err != nil {
+		tlog.Fatal.Printf("-destroy: %v", err)
+		return exitcodes.LoadConf
+	}
+	fmt.Fprintf(os.Stderr, tlog.ColorYellow+
+		"This will overwrite %q and make all files in %q unrecoverable.\n"+
+		"Type %q to continue: "+tlog.ColorReset, args.config, args.cipherdir, destroyConfirm)
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	if strings.TrimSpace(line) != destroyConfirm {
+		tlog.Fatal.Printf("Aborted")
+		return exitcodes.Usage
+	}
+	// A backup created by "-passwd -masterkey" contains the master key as
+	// well, and so do the copies in the snapshots and the config files of
+	// the subtrees
+	files := []string{args.config, args.config + ".bak"}
+	if !args.reverse {
+		files = append(files, destroyKeyFiles(args.cipherdir, cf)...)
+	}
+	for _, fn := range files {
+		err := destroyFile(fn)
+		if os.IsNotExist(err) && fn != args.config {
+			continue
+		}
+		if err != nil {
+			tlog.Fatal.Printf("-destroy: %v", err)
+			return exitcodes.WriteConf
+		}
+	}
+	tlog.Info.Printf(tlog.ColorGreen+"%s has been destroyed."+tlog.ColorReset, args.config)
+	return 0
+}
+
+// destroyKeyFiles returns the config files below "cipherdir" that hold the
+// master key or a key derived from it: the ones of the snapshots and of the
+// subtrees of "-dirkey". Both are CIPHERDIRs of their own, so they are
+// searched as well. The files may not exist.
+func destroyKeyFiles(cipherdir string, cf *configfile.ConfFile) (files []string) {
+	entries, _ := ioutil.ReadDir(cipherdir)
+	for _, e := range entries {
+		if !e.IsDir() || e.Name() == fusefrontend.TrashDirName {
+			continue
+		}
+		dir := filepath.Join(cipherdir, e.Name())
+		if e.Name() == fusefrontend.SnapshotDirName {
+			snapshots, _ := ioutil.ReadDir(dir)
+			for _, s := range snapshots {
+				if !s.IsDir() {
+					continue
+				}
+				snapshot := filepath.Join(dir, s.Name())
+				conf := filepath.Join(snapshot, configfile.ConfDefaultName)
+				files = append(files, conf, conf+".bak")
+				files = append(files, destroyKeyFiles(snapshot, cf)...)
+			}
+			continue
+		}
+		// Subtree keys are derived from the DirIV. Without it, the directory
+		// may well contain a file of the user called gocryptfs.conf.
+		if cf.IsFeatureFlagSet(configfile.FlagPlaintextNames) || cf.IsFeatureFlagSet(configfile.FlagDeterministicNames) {
+			continue
+		}
+		conf := filepath.Join(dir, fusefrontend.SubtreeConfName)
+		if _, err := os.Lstat(conf); err != nil {
+			continue
+		}
+		files = append(files, conf, conf+".bak")
+		files = append(files, destroyKeyFiles(dir, cf)...)
+	}
+	return files
+}
+
+// destroyFile overwrites file "fn" with random data and deletes it.
+func destroyFile(fn string) error {
+	// The config file is created with 0400 permissions
+	err := os.Chmod(fn, 0600)
+	if err != nil {
+		return err
+	}
+	fd, err := syscall.Open(fn, syscall.O_WRONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	err = syscallcompat.Wipe(fd)
+	syscall.Close(fd)
+	if err != nil {
+		return err
+	}
+	return os.Remove(fn)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/readpassword"
+	"github.com/rfjakob/gocryptfs/internal/secmem"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// dirkey gives a top-level directory of CIPHERDIR its own key, lists the
+// directories that have one, or removes it again. This is called when you
+// pass the "-dirkey" option. "dirs" are the plaintext directories given
+// after CIPHERDIR.
+//
+// A directory with its own key is a CIPHERDIR by itself. Its gocryptfs.conf
+// stores the key, encrypted with a password of its own, so it can be
+// mounted without knowing the password of the whole filesystem. See
+// internal/fusefrontend/subtree.go.
+func dirkey(args *argContainer, dirs []string) (exitcode int) {
+	if args.reverse {
+		tlog.Fatal.Printf("-dirkey only works in forward mode")
+		return exitcodes.Usage
+	}
+	if args.dirkey != "list" && len(dirs) != 1 {
+		tlog.Fatal.Printf("Usage: %s -dirkey %s CIPHERDIR DIR", tlog.ProgramName, args.dirkey)
+		return exitcodes.Usage
+	}
+	if args.dirkey == "list" {
+		// Keep stdout free for the list
+		tlog.Info.Logger.SetOutput(os.Stderr)
+	} else if m, err := findMount(args.cipherdir); err == nil {
+		// The mount would not know about the change
+		tlog.Fatal.Printf("-dirkey: %q is mounted at %q. Unmount it first.",
+			args.cipherdir, m.mountpoint)
+		return exitcodes.DirKey
+	}
+	masterkey, confFile := loadMasterkey(args)
+	defer func() {
+		secmem.Free(masterkey)
+	}()
+	if confFile.IsFeatureFlagSet(configfile.FlagPlaintextNames) || confFile.IsFeatureFlagSet(configfile.FlagDeterministicNames) {
+		// The key is derived from the DirIV of the directory
+		tlog.Fatal.Printf("-dirkey does not work with plaintextnames or deterministic names")
+		return exitcodes.Usage
+	}
+	pfs, wipeKeys := initFuseFrontendKey(args, masterkey, confFile)
+	defer wipeKeys()
+	rn := pfs.(*fusefrontend.RootNode)
+	if args.dirkey == "list" {
+		names, err := rn.ListSubtrees()
+		if err != nil {
+			tlog.Fatal.Printf("-dirkey: %v", err)
+			return exitcodes.DirKey
+		}
+		for _, cName := range names {
+			name, err := rn.DecryptPath(cName)
+			if err != nil {
+				name = "?"
+			}
+			fmt.Printf("%s  %s\n", name, filepath.Join(args.cipherdir, cName))
+		}
+		return 0
+	}
+	dir := strings.Trim(filepath.Clean("/"+dirs[0]), "/")
+	if dir == "" || strings.Contains(dir, "/") {
+		tlog.Fatal.Printf("-dirkey: %q is not a top-level directory", dirs[0])
+		return exitcodes.Usage
+	}
+	cDir, err := rn.EncryptPath(dir)
+	if err != nil {
+		tlog.Fatal.Printf("-dirkey: %q: %v", dir, err)
+		return exitcodes.DirKey
+	}
+	cPath := filepath.Join(args.cipherdir, cDir)
+	conf := filepath.Join(cPath, fusefrontend.SubtreeConfName)
+	// Everything in the directory is encrypted with the key that it has
+	// now, so it has to be empty
+	entries, err := ioutil.ReadDir(cPath)
+	if err != nil {
+		tlog.Fatal.Printf("-dirkey: %q: %v", dir, err)
+		return exitcodes.DirKey
+	}
+	for _, e := range entries {
+		if e.Name() != nametransform.DirIVFilename && e.Name() != fusefrontend.SubtreeConfName {
+			tlog.Fatal.Printf("-dirkey: %q is not empty", dir)
+			return exitcodes.DirKey
+		}
+	}
+	_, err = os.Lstat(conf)
+	hasKey := err == nil
+	if args.dirkey == "remove" {
+		if !hasKey {
+			tlog.Fatal.Printf("-dirkey: %q does not have its own key", dir)
+			return exitcodes.DirKey
+		}
+		if err = os.Remove(conf); err != nil {
+			tlog.Fatal.Printf("-dirkey: %v", err)
+			return exitcodes.DirKey
+		}
+		tlog.Info.Printf(tlog.ColorGreen+"Removed the key of %q"+tlog.ColorReset, dir)
+		return 0
+	}
+	if hasKey {
+		tlog.Fatal.Printf("-dirkey: %q has its own key already", dir)
+		return exitcodes.DirKey
+	}
+	dirIV, err := rn.SubtreeDirIV(cDir)
+	if err != nil {
+		tlog.Fatal.Printf("-dirkey: %q: %v", dir, err)
+		return exitcodes.DirKey
+	}
+	key := cryptocore.SubtreeKey(masterkey, dirIV)
+	tlog.Info.Printf("Choose a password for %q.", dir)
+	password := readpassword.Twice([]string(args.extpass), []string(args.passfile))
+	logN := confFile.ScryptObject.LogN()
+	if args._explicitScryptn {
+		logN = args.scryptn
+	}
+	err = confFile.CreateSubtree(conf, key, password, logN)
+	for i := range password {
+		password[i] = 0
+	}
+	secmem.Free(key)
+	if err != nil {
+		tlog.Fatal.Printf("-dirkey: %v", err)
+		return exitcodes.DirKey
+	}
+	tlog.Info.Printf(tlog.ColorGreen+"%q has its own key now. Mount it with:\n    %s %s MOUNTPOINT"+tlog.ColorReset,
+		dir, tlog.ProgramName, cPath)
+	return 0
+}
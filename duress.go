@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/readpassword"
+	"github.com/rfjakob/gocryptfs/internal/secmem"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// Duress password, "-duress". The duress key slot of the config file
+// stores a duressSlot, encrypted with the duress password. When that
+// password is entered, gocryptfs mounts the decoy CIPHERDIR, or an empty
+// volume, instead of CIPHERDIR, and starts the hook. Nothing in the output
+// tells the difference.
+
+// duressSlot is the content of the duress key slot
+type duressSlot struct {
+	// Decoy is the CIPHERDIR that is mounted instead. Empty for an empty
+	// volume.
+	Decoy string `json:",omitempty"`
+	// DecoyKey is the master key of Decoy
+	DecoyKey []byte `json:",omitempty"`
+	// Hook is the command that is started in the background
+	Hook []string `json:",omitempty"`
+}
+
+// duress adds or removes the duress password of CIPHERDIR. This is called
+// when you pass the "-duress" option. "decoy" is the decoy CIPHERDIR given
+// after CIPHERDIR, if any.
+func duress(args *argContainer, decoy []string) (exitcode int) {
+	if args.reverse {
+		tlog.Fatal.Printf("-duress only works in forward mode")
+		return exitcodes.Usage
+	}
+	if len(decoy) > 1 || (args.duress == "remove" && len(decoy) > 0) {
+		tlog.Fatal.Printf("Usage: %s -duress add [-duress-hook CMD] CIPHERDIR [DECOY]", tlog.ProgramName)
+		return exitcodes.Usage
+	}
+	masterkey, confFile := loadMasterkey(args)
+	defer func() {
+		secmem.Free(masterkey)
+	}()
+	if args.duress == "remove" {
+		if confFile.FindKeySlot(configfile.KeySlotDuress) == nil {
+			tlog.Fatal.Printf("-duress: there is no duress password")
+			return exitcodes.Usage
+		}
+		confFile.RemoveKeySlot(configfile.KeySlotDuress)
+	} else {
+		if confFile.IsFeatureFlagSet(configfile.FlagFIDO2) {
+			// Mounting would ask the FIDO2 token, not for a password
+			tlog.Fatal.Printf("-duress does not work with -fido2")
+			return exitcodes.Usage
+		}
+		d := duressSlot{Hook: args.duress_hook}
+		if len(decoy) == 1 {
+			d.Decoy, _ = filepath.Abs(decoy[0])
+			if d.Decoy == args.cipherdir {
+				tlog.Fatal.Printf("-duress: the decoy cannot be CIPHERDIR itself")
+				return exitcodes.Usage
+			}
+			a := *args
+			a.cipherdir = d.Decoy
+			a.config = filepath.Join(d.Decoy, configfile.ConfDefaultName)
+			a._passwordPrompt = "Password for " + d.Decoy
+			d.DecoyKey, _ = loadMasterkey(&a)
+		}
+		payload, err := json.Marshal(d)
+		secmem.Free(d.DecoyKey)
+		if err != nil {
+			tlog.Fatal.Println(err)
+			return exitcodes.Other
+		}
+		tlog.Info.Println("Please enter the duress password.")
+		password := readpassword.Twice([]string(args.extpass), []string(args.passfile))
+		// DecryptKey stops at the first slot that fits, so a duress password
+		// that is the same as another one would never be used
+		tlog.Warn.Enabled = false
+		key, slot, err := confFile.DecryptKey(password)
+		tlog.Warn.Enabled = true
+		secmem.Free(key)
+		if err == nil && slot != configfile.KeySlotDuress {
+			tlog.Fatal.Printf("-duress: the duress password must be different from the other passwords")
+			return exitcodes.Usage
+		}
+		logN := confFile.ScryptObject.LogN()
+		if args._explicitScryptn {
+			logN = args.scryptn
+		}
+		confFile.SetKeySlot(configfile.KeySlotDuress, payload, password, logN)
+		for i := range password {
+			password[i] = 0
+		}
+		secmem.Free(payload)
+	}
+	confFile.UpdateMAC(masterkey)
+	if err := confFile.WriteFile(); err != nil {
+		tlog.Fatal.Println(err)
+		return exitcodes.WriteConf
+	}
+	if args.duress == "remove" {
+		tlog.Info.Printf(tlog.ColorGreen + "Duress password removed." + tlog.ColorReset)
+	} else {
+		tlog.Info.Printf(tlog.ColorGreen + "Duress password set." + tlog.ColorReset)
+	}
+	return 0
+}
+
+// unlockDuress is called by loadConfig when the duress password has been
+// entered. "payload" is the content of the duress key slot, "cf" the config
+// file of CIPHERDIR. Starts the hook and returns the master key and the
+// config file of the decoy, after pointing "args" at it. For an empty
+// volume, the master key is nil, see emptyVolume.
+func unlockDuress(args *argContainer, cf *configfile.ConfFile, payload []byte) ([]byte, *configfile.ConfFile, error) {
+	var d duressSlot
+	err := json.Unmarshal(payload, &d)
+	secmem.Free(payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	args._duress = true
+	if len(d.Hook) > 0 {
+		startDuressHook(d.Hook)
+	}
+	// The mount shows up as CIPHERDIR
+	if args.fsname == "" {
+		args.fsname = args.cipherdir
+	}
+	if d.Decoy == "" {
+		return nil, cf, nil
+	}
+	args.cipherdir = d.Decoy
+	args.config = filepath.Join(d.Decoy, configfile.ConfDefaultName)
+	decoyConf, err := configfile.Load(args.config)
+	if err == nil {
+		err = decoyConf.VerifyMAC(d.DecoyKey)
+	}
+	if err != nil {
+		tlog.Fatal.Printf("Cannot open config file: %v", err)
+		return nil, nil, err
+	}
+	return d.DecoyKey, decoyConf, nil
+}
+
+// startDuressHook starts "hook" in the background, in a session of its own,
+// and does not wait for it. A single "hook" is split on spaces, like
+// "-extpass".
+func startDuressHook(hook []string) {
+	if len(hook) == 1 {
+		hook = strings.Split(hook[0], " ")
+	}
+	cmd := exec.Command(hook[0], hook[1:]...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		tlog.Debug.Printf("duress hook: %v", err)
+		return
+	}
+	go cmd.Wait()
+}
+
+// emptyVolume points "args" at a new, empty CIPHERDIR in a temporary
+// directory, for the duress password without a decoy. "cf" is the config
+// file of CIPHERDIR, which the empty volume copies the feature flags of.
+// Returns a random master key and a function that deletes the directory.
+func emptyVolume(args *argContainer, cf *configfile.ConfFile) (masterkey []byte, cleanup func()) {
+	dir, err := ioutil.TempDir("", "gocryptfs.")
+	if err != nil {
+		tlog.Fatal.Printf("Password incorrect.")
+		os.Exit(exitcodes.PasswordIncorrect)
+	}
+	cleanup = func() { os.RemoveAll(dir) }
+	if !cf.IsFeatureFlagSet(configfile.FlagPlaintextNames) && !cf.IsFeatureFlagSet(configfile.FlagDeterministicNames) {
+		dirfd, err := syscallcompat.Open(dir, syscall.O_DIRECTORY|syscall.O_RDONLY, 0)
+		if err == nil {
+			err = nametransform.WriteDirIVAt(dirfd)
+			syscall.Close(dirfd)
+		}
+		if err != nil {
+			cleanup()
+			tlog.Fatal.Printf("Password incorrect.")
+			os.Exit(exitcodes.PasswordIncorrect)
+		}
+	}
+	args.cipherdir = dir
+	return cryptocore.RandBytes(cryptocore.KeyLen), cleanup
+}
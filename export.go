@@ -0,0 +1,310 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// Archives written by "-export" are plain tar files of CIPHERDIR. Everything
+// in them is encrypted already, so they can be stored anywhere, and no
+// password is needed to create or import them. Extended attributes are
+// stored as "SCHILY.xattr.*" PAX records, like GNU tar does.
+
+// paxXattrPrefix is the prefix of PAX records that hold extended attributes
+const paxXattrPrefix = "SCHILY.xattr."
+
+// exportCipherdir writes CIPHERDIR into the tar archive "archive", or to
+// stdout if "archive" is "-". Called for "-export".
+func exportCipherdir(args *argContainer, archive string) (exitcode int) {
+	if args._configCustom {
+		tlog.Warn.Printf("-export: the config file %q is outside of CIPHERDIR and will not be exported",
+			args.config)
+	}
+	out := os.Stdout
+	if archive == "-" {
+		// Keep stdout free for the archive
+		tlog.Info.Logger.SetOutput(os.Stderr)
+	} else {
+		abs, _ := filepath.Abs(archive)
+		if strings.HasPrefix(abs, args.cipherdir+"/") {
+			tlog.Fatal.Printf("-export: the archive must not be inside CIPHERDIR")
+			return exitcodes.Usage
+		}
+		f, err := os.OpenFile(archive, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			tlog.Fatal.Printf("-export: %v", err)
+			return exitcodes.Archive
+		}
+		defer f.Close()
+		out = f
+	}
+	tw := tar.NewWriter(out)
+	// Paths of hard-linked files that we have already written, by inode number
+	links := make(map[uint64]string)
+	var count int
+	err := filepath.Walk(args.cipherdir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(args.cipherdir, path)
+		if err != nil || name == "." {
+			return err
+		}
+		if fi.Mode()&os.ModeSocket != 0 {
+			tlog.Warn.Printf("-export: skipping socket %q", name)
+			return nil
+		}
+		hdr, err := exportHeader(path, name, fi)
+		if err != nil {
+			return err
+		}
+		st := fi.Sys().(*syscall.Stat_t)
+		if fi.Mode().IsRegular() && st.Nlink > 1 {
+			if first, ok := links[uint64(st.Ino)]; ok {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = first
+				hdr.Size = 0
+			} else {
+				links[uint64(st.Ino)] = hdr.Name
+			}
+		}
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		count++
+		if hdr.Typeflag != tar.TypeReg {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err == nil {
+		err = tw.Close()
+	}
+	if err != nil {
+		tlog.Fatal.Printf("-export: %v", err)
+		if archive != "-" {
+			os.Remove(archive)
+		}
+		return exitcodes.Archive
+	}
+	tlog.Info.Printf("Exported %d files and directories of %q", count, args.cipherdir)
+	return 0
+}
+
+// exportHeader returns the tar header for "path", which is "name" relative
+// to CIPHERDIR, including its extended attributes.
+func exportHeader(path string, name string, fi os.FileInfo) (*tar.Header, error) {
+	var target string
+	var err error
+	if fi.Mode()&os.ModeSymlink != 0 {
+		if target, err = os.Readlink(path); err != nil {
+			return nil, err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(fi, target)
+	if err != nil {
+		return nil, err
+	}
+	// PAX keeps the nanoseconds of the timestamps
+	hdr.Format = tar.FormatPAX
+	hdr.Name = filepath.ToSlash(name)
+	if fi.IsDir() {
+		hdr.Name += "/"
+	}
+	attrs, err := syscallcompat.Llistxattr(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range attrs {
+		val, err := syscallcompat.Lgetxattr(path, a)
+		if err != nil {
+			return nil, err
+		}
+		if hdr.PAXRecords == nil {
+			hdr.PAXRecords = make(map[string]string)
+		}
+		hdr.PAXRecords[paxXattrPrefix+a] = string(val)
+	}
+	return hdr, nil
+}
+
+// importEntryPath checks the path "name" from the archive and returns where it
+// goes inside CIPHERDIR. "symlinks" holds the symlinks that we have created so
+// far. We never extract through them, so a crafted archive cannot write
+// outside of CIPHERDIR.
+func importEntryPath(cipherdir string, name string, symlinks map[string]bool) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(name))
+	if filepath.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("invalid path %q", name)
+	}
+	for p := filepath.Dir(clean); p != "."; p = filepath.Dir(p) {
+		if symlinks[p] {
+			return "", fmt.Errorf("path %q goes through a symlink", name)
+		}
+	}
+	return filepath.Join(cipherdir, clean), nil
+}
+
+// importCipherdir extracts the tar archive "archive", or stdin if "archive" is
+// "-", into the empty directory CIPHERDIR. Called for "-import".
+func importCipherdir(args *argContainer, archive string) (exitcode int) {
+	if err := isEmptyDir(args.cipherdir); err != nil {
+		tlog.Fatal.Printf("-import: %v", err)
+		return exitcodes.CipherDir
+	}
+	in := os.Stdin
+	if archive != "-" {
+		f, err := os.Open(archive)
+		if err != nil {
+			tlog.Fatal.Printf("-import: %v", err)
+			return exitcodes.Archive
+		}
+		defer f.Close()
+		in = f
+	}
+	var count int
+	err := importTar(tar.NewReader(in), args.cipherdir, &count)
+	if err != nil {
+		tlog.Fatal.Printf("-import: %v", err)
+		tlog.Info.Printf("%q is incomplete now. Empty it before trying again.", args.cipherdir)
+		return exitcodes.Archive
+	}
+	tlog.Info.Printf(tlog.ColorGreen+"Imported %d files and directories into %q"+tlog.ColorReset,
+		count, args.cipherdir)
+	return 0
+}
+
+// importTar extracts all entries of "tr" into "cipherdir", counting them in
+// "count".
+func importTar(tr *tar.Reader, cipherdir string, count *int) error {
+	symlinks := make(map[string]bool)
+	// Permissions and times of directories are set at the end. Before,
+	// we may not be allowed to write into them, and writing would change
+	// the times.
+	var dirs []*tar.Header
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		path, err := importEntryPath(cipherdir, hdr.Name, symlinks)
+		if err != nil {
+			return err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.Mkdir(path, 0700)
+			dirs = append(dirs, hdr)
+		case tar.TypeReg:
+			err = importFile(tr, path)
+		case tar.TypeSymlink:
+			err = os.Symlink(hdr.Linkname, path)
+			rel, _ := filepath.Rel(cipherdir, path)
+			symlinks[rel] = true
+		case tar.TypeLink:
+			var target string
+			target, err = importEntryPath(cipherdir, hdr.Linkname, symlinks)
+			if err == nil {
+				err = os.Link(target, path)
+			}
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			mode := uint32(hdr.Mode & 07777)
+			switch hdr.Typeflag {
+			case tar.TypeChar:
+				mode |= syscall.S_IFCHR
+			case tar.TypeBlock:
+				mode |= syscall.S_IFBLK
+			default:
+				mode |= syscall.S_IFIFO
+			}
+			err = syscall.Mknod(path, mode, int(unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor))))
+		default:
+			err = fmt.Errorf("unsupported type %q", hdr.Typeflag)
+		}
+		if err != nil {
+			return fmt.Errorf("%q: %v", hdr.Name, err)
+		}
+		*count++
+		if hdr.Typeflag == tar.TypeDir || hdr.Typeflag == tar.TypeLink {
+			continue
+		}
+		if err = importMeta(path, hdr); err != nil {
+			return fmt.Errorf("%q: %v", hdr.Name, err)
+		}
+	}
+	// Innermost first
+	sort.Slice(dirs, func(i, j int) bool { return dirs[i].Name > dirs[j].Name })
+	for _, hdr := range dirs {
+		path, _ := importEntryPath(cipherdir, hdr.Name, nil)
+		if err := importMeta(path, hdr); err != nil {
+			return fmt.Errorf("%q: %v", hdr.Name, err)
+		}
+	}
+	return nil
+}
+
+// importFile writes the contents of the current entry of "tr" to the new file
+// "path"
+func importFile(tr *tar.Reader, path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, tr)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// importMeta sets the extended attributes, the owner (when running as root),
+// the permissions and the modification time from "hdr" on "path"
+func importMeta(path string, hdr *tar.Header) error {
+	isSymlink := hdr.Typeflag == tar.TypeSymlink
+	for k, v := range hdr.PAXRecords {
+		if !strings.HasPrefix(k, paxXattrPrefix) {
+			continue
+		}
+		err := unix.Lsetxattr(path, strings.TrimPrefix(k, paxXattrPrefix), []byte(v), 0)
+		if err != nil {
+			return err
+		}
+	}
+	if runsAsRoot() {
+		if err := os.Lchown(path, hdr.Uid, hdr.Gid); err != nil {
+			return err
+		}
+	}
+	if !isSymlink {
+		if err := syscall.Chmod(path, uint32(hdr.Mode&07777)); err != nil {
+			return err
+		}
+	}
+	mtime := unix.NsecToTimespec(hdr.ModTime.UnixNano())
+	ts := []unix.Timespec{mtime, mtime}
+	if !hdr.AccessTime.IsZero() {
+		ts[0] = unix.NsecToTimespec(hdr.AccessTime.UnixNano())
+	}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, path, ts, unix.AT_SYMLINK_NOFOLLOW)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -20,40 +21,110 @@ import (
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
+// Number of directory entries fsck reads at once
+const fsckDirBatch = 1000
+
 type fsckObj struct {
 	rootNode *fusefrontend.RootNode
 	// mnt is the mountpoint of the temporary mount
 	mnt string
-	// List of corrupt files
-	corruptList []string
-	// List of skipped files
-	skippedList []string
-	// Protects corruptList
+	// Number of corrupt files. Only counted, so that a badly damaged
+	// filesystem with millions of files does not make us run out of memory.
+	// The files are printed when they are found.
+	corruptCount int
+	// Number of skipped files
+	skippedCount int
+	// Number of problems repaired by "-fix"
+	fixedCount int
+	// Protects corruptCount, skippedCount and fixedCount
 	listLock sync.Mutex
 	// stop a running watchMitigatedCorruptions thread
 	watchDone chan struct{}
-	// Inode numbers of hard-linked files (Nlink > 1) that we have already checked
-	seenInodes map[uint64]struct{}
+	// Inode numbers of hard-linked files (Nlink > 1) that we have already
+	// checked, and how many of their links we have not seen yet. Inodes are
+	// dropped when we have seen all links, so this only grows with the number
+	// of hard-linked files whose links are spread over the tree.
+	seenInodes map[uint64]uint32
 	// abort the running fsck operation? Checked in a few long-running loops.
 	abort bool
+	// Human-readable messages go here. This is stdout, or stderr with
+	// "-json", so that stdout only carries the JSON report.
+	out io.Writer
+	// Writes the JSON report for "-json", nil otherwise
+	report *json.Encoder
+}
+
+// fsckDamage is one line of the "-fsck -json" report
+type fsckDamage struct {
+	// Path relative to the root of the filesystem. Damaged xattrs are
+	// reported as "PATH xattr:NAME".
+	Path string
+	// "corrupt", "skipped" if we could not check the path, or "fixed" if
+	// "-fix" has repaired it
+	Status string
+	// Human-readable description of the problem
+	Message string
 }
 
 func runsAsRoot() bool {
 	return syscall.Geteuid() == 0
 }
 
-func (ck *fsckObj) markCorrupt(path string) {
+// markCorrupt reports "path" as corrupt, with "msg" describing the problem
+func (ck *fsckObj) markCorrupt(path string, msg string) {
+	ck.listLock.Lock()
+	ck.corruptCount++
+	ck.reportDamage(path, "corrupt", msg)
+	ck.listLock.Unlock()
+}
+
+// markSkipped reports "path" as skipped, with "msg" saying why
+func (ck *fsckObj) markSkipped(path string, msg string) {
 	ck.listLock.Lock()
-	ck.corruptList = append(ck.corruptList, path)
+	ck.skippedCount++
+	ck.reportDamage(path, "skipped", msg)
 	ck.listLock.Unlock()
 }
 
-func (ck *fsckObj) markSkipped(path string) {
+// markFixed reports that the problem "msg" with "path" has been repaired
+func (ck *fsckObj) markFixed(path string, msg string) {
 	ck.listLock.Lock()
-	ck.skippedList = append(ck.skippedList, path)
+	ck.fixedCount++
+	ck.reportDamage(path, "fixed", msg)
 	ck.listLock.Unlock()
 }
 
+// checkDirIVs looks for lost gocryptfs.diriv files, and repairs them with
+// "-fix". This works on CIPHERDIR directly and must run before mounting.
+func (ck *fsckObj) checkDirIVs(fix bool) {
+	err := ck.rootNode.CheckDirIVs(fix, func(pDir string, renamed int, err error) {
+		if !fix {
+			ck.markCorrupt(pDir, fmt.Sprintf("dir %q: gocryptfs.diriv is missing, the names in it "+
+				"cannot be decrypted. Run with -fix to give the entries new names.", pDir))
+		} else if err != nil {
+			ck.markCorrupt(pDir, fmt.Sprintf("dir %q: gocryptfs.diriv is missing, repair failed: %v", pDir, err))
+		} else {
+			ck.markFixed(pDir, fmt.Sprintf("dir %q: gocryptfs.diriv was missing. Created a new one and "+
+				"renamed %d entries to %s*", pDir, renamed, fusefrontend.RecoveredPrefix))
+		}
+	})
+	if err != nil {
+		ck.markCorrupt("", fmt.Sprintf("error checking gocryptfs.diriv files: %v", err))
+	}
+}
+
+// reportDamage prints the message, and the JSON report line with "-json".
+// Caller must hold listLock.
+func (ck *fsckObj) reportDamage(path string, status string, msg string) {
+	fmt.Fprintf(ck.out, "fsck: %s\n", msg)
+	if ck.report != nil {
+		err := ck.report.Encode(fsckDamage{Path: path, Status: status, Message: msg})
+		if err != nil {
+			tlog.Warn.Printf("fsck: writing report: %v", err)
+		}
+	}
+}
+
 func (ck *fsckObj) abs(relPath string) (absPath string) {
 	return filepath.Join(ck.mnt, relPath)
 }
@@ -63,8 +134,8 @@ func (ck *fsckObj) watchMitigatedCorruptionsOpenDir(path string) {
 	for {
 		select {
 		case item := <-ck.rootNode.MitigatedCorruptions:
-			fmt.Printf("fsck: corrupt entry in dir %q: %q\n", path, item)
-			ck.markCorrupt(filepath.Join(path, item))
+			ck.markCorrupt(filepath.Join(path, item),
+				fmt.Sprintf("corrupt entry in dir %q: %q", path, item))
 		case <-ck.watchDone:
 			return
 		}
@@ -80,22 +151,37 @@ func (ck *fsckObj) dir(relPath string) {
 	f, err := os.Open(ck.abs(relPath))
 	ck.watchDone <- struct{}{}
 	if err != nil {
-		fmt.Printf("fsck: error opening dir %q: %v\n", relPath, err)
+		msg := fmt.Sprintf("error opening dir %q: %v", relPath, err)
 		if err == os.ErrPermission && !runsAsRoot() {
-			ck.markSkipped(relPath)
+			ck.markSkipped(relPath, msg)
 		} else {
-			ck.markCorrupt(relPath)
+			ck.markCorrupt(relPath, msg)
 		}
 		return
 	}
-	go ck.watchMitigatedCorruptionsOpenDir(relPath)
-	entries, err := f.Readdirnames(0)
-	ck.watchDone <- struct{}{}
-	if err != nil {
-		fmt.Printf("fsck: error reading dir %q: %v\n", relPath, err)
-		ck.markCorrupt(relPath)
-		return
+	defer f.Close()
+	for {
+		if ck.abort {
+			return
+		}
+		// Read the directory in batches so that huge directories do not
+		// have to fit into memory
+		go ck.watchMitigatedCorruptionsOpenDir(relPath)
+		entries, err := f.Readdirnames(fsckDirBatch)
+		ck.watchDone <- struct{}{}
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			ck.markCorrupt(relPath, fmt.Sprintf("error reading dir %q: %v", relPath, err))
+			return
+		}
+		ck.dirEntries(relPath, entries)
 	}
+}
+
+// dirEntries checks the entries "entries" of directory "relPath"
+func (ck *fsckObj) dirEntries(relPath string, entries []string) {
 	for _, entry := range entries {
 		if ck.abort {
 			return
@@ -107,7 +193,7 @@ func (ck *fsckObj) dir(relPath string) {
 		var st syscall.Stat_t
 		err := syscall.Lstat(ck.abs(nextPath), &st)
 		if err != nil {
-			ck.markCorrupt(filepath.Join(relPath, entry))
+			ck.markCorrupt(nextPath, fmt.Sprintf("error stating %q: %v", nextPath, err))
 			continue
 		}
 		filetype := st.Mode & syscall.S_IFMT
@@ -122,7 +208,7 @@ func (ck *fsckObj) dir(relPath string) {
 		case syscall.S_IFIFO, syscall.S_IFSOCK, syscall.S_IFBLK, syscall.S_IFCHR:
 			// nothing to check
 		default:
-			fmt.Printf("fsck: unhandled file type %x\n", filetype)
+			fmt.Fprintf(ck.out, "fsck: unhandled file type %x\n", filetype)
 		}
 	}
 }
@@ -130,8 +216,7 @@ func (ck *fsckObj) dir(relPath string) {
 func (ck *fsckObj) symlink(relPath string) {
 	_, err := os.Readlink(ck.abs(relPath))
 	if err != nil {
-		ck.markCorrupt(relPath)
-		fmt.Printf("fsck: error reading symlink %q: %v\n", relPath, err)
+		ck.markCorrupt(relPath, fmt.Sprintf("error reading symlink %q: %v", relPath, err))
 	}
 }
 
@@ -140,8 +225,7 @@ func (ck *fsckObj) watchMitigatedCorruptionsRead(path string) {
 	for {
 		select {
 		case item := <-ck.rootNode.MitigatedCorruptions:
-			fmt.Printf("fsck: corrupt file %q (inode %s)\n", path, item)
-			ck.markCorrupt(path)
+			ck.markCorrupt(path, fmt.Sprintf("corrupt file %q (inode %s)", path, item))
 		case <-ck.watchDone:
 			return
 		}
@@ -154,26 +238,30 @@ func (ck *fsckObj) file(relPath string) {
 	var st syscall.Stat_t
 	err := syscall.Lstat(ck.abs(relPath), &st)
 	if err != nil {
-		ck.markCorrupt(relPath)
-		fmt.Printf("fsck: error stating file %q: %v\n", relPath, err)
+		ck.markCorrupt(relPath, fmt.Sprintf("error stating file %q: %v", relPath, err))
 		return
 	}
 	if st.Nlink > 1 {
 		// Due to hard links, we may have already checked this file.
-		if _, ok := ck.seenInodes[st.Ino]; ok {
+		if left, ok := ck.seenInodes[st.Ino]; ok {
 			tlog.Debug.Printf("ck.file : skipping %q (inode number %d already seen)\n", relPath, st.Ino)
+			if left <= 1 {
+				delete(ck.seenInodes, st.Ino)
+			} else {
+				ck.seenInodes[st.Ino] = left - 1
+			}
 			return
 		}
-		ck.seenInodes[st.Ino] = struct{}{}
+		ck.seenInodes[st.Ino] = uint32(st.Nlink) - 1
 	}
 	ck.xattrs(relPath)
 	f, err := os.Open(ck.abs(relPath))
 	if err != nil {
-		fmt.Printf("fsck: error opening file %q: %v\n", relPath, err)
+		msg := fmt.Sprintf("error opening file %q: %v", relPath, err)
 		if err == os.ErrPermission && !runsAsRoot() {
-			ck.markSkipped(relPath)
+			ck.markSkipped(relPath, msg)
 		} else {
-			ck.markCorrupt(relPath)
+			ck.markCorrupt(relPath, msg)
 		}
 		return
 	}
@@ -192,8 +280,7 @@ func (ck *fsckObj) file(relPath string) {
 		tlog.Debug.Printf("ck.file: read %d bytes from offset %d\n", len(buf), off)
 		n, err := f.ReadAt(buf, off)
 		if err != nil && err != io.EOF {
-			ck.markCorrupt(relPath)
-			fmt.Printf("fsck: error reading file %q (inum %d): %v\n", relPath, inum(f), err)
+			ck.markCorrupt(relPath, fmt.Sprintf("error reading file %q (inum %d): %v", relPath, inum(f), err))
 			return
 		}
 		// EOF
@@ -220,8 +307,8 @@ func (ck *fsckObj) watchMitigatedCorruptionsListXAttr(path string) {
 	for {
 		select {
 		case item := <-ck.rootNode.MitigatedCorruptions:
-			fmt.Printf("fsck: corrupt xattr name on file %q: %q\n", path, item)
-			ck.markCorrupt(path + " xattr:" + item)
+			ck.markCorrupt(path+" xattr:"+item,
+				fmt.Sprintf("corrupt xattr name on file %q: %q", path, item))
 		case <-ck.watchDone:
 			return
 		}
@@ -235,19 +322,18 @@ func (ck *fsckObj) xattrs(relPath string) {
 	attrs, err := syscallcompat.Llistxattr(ck.abs(relPath))
 	ck.watchDone <- struct{}{}
 	if err != nil {
-		fmt.Printf("fsck: error listing xattrs on %q: %v\n", relPath, err)
-		ck.markCorrupt(relPath)
+		ck.markCorrupt(relPath, fmt.Sprintf("error listing xattrs on %q: %v", relPath, err))
 		return
 	}
 	// Try to read all xattr values
 	for _, a := range attrs {
 		_, err := syscallcompat.Lgetxattr(ck.abs(relPath), a)
 		if err != nil {
-			fmt.Printf("fsck: error reading xattr %q from %q: %v\n", a, relPath, err)
+			msg := fmt.Sprintf("error reading xattr %q from %q: %v", a, relPath, err)
 			if err == syscall.EACCES && !runsAsRoot() {
-				ck.markSkipped(relPath)
+				ck.markSkipped(relPath, msg)
 			} else {
-				ck.markCorrupt(relPath)
+				ck.markCorrupt(relPath, msg)
 			}
 		}
 	}
@@ -259,6 +345,10 @@ func fsck(args *argContainer) (exitcode int) {
 		os.Exit(exitcodes.Usage)
 	}
 	args.allow_other = false
+	if args.json {
+		// Keep stdout free for the JSON report
+		tlog.Info.Logger.SetOutput(os.Stderr)
+	}
 	var err error
 	args.mountpoint, err = ioutil.TempDir("", "gocryptfs.fsck.")
 	if err != nil {
@@ -266,16 +356,29 @@ func fsck(args *argContainer) (exitcode int) {
 		os.Exit(exitcodes.MountPoint)
 	}
 	pfs, wipeKeys := initFuseFrontend(args)
+	if args.fix && args._decryptOnly {
+		tlog.Fatal.Printf("-fix needs the password of the filesystem, not the one of the decrypt-only key slot")
+		os.Exit(exitcodes.Usage)
+	}
 	rn := pfs.(*fusefrontend.RootNode)
 	rn.MitigatedCorruptions = make(chan string)
 	ck := fsckObj{
 		mnt:        args.mountpoint,
 		rootNode:   rn,
 		watchDone:  make(chan struct{}),
-		seenInodes: make(map[uint64]struct{}),
+		seenInodes: make(map[uint64]uint32),
+		out:        os.Stdout,
+	}
+	if args.json {
+		ck.out = os.Stderr
+		ck.report = json.NewEncoder(os.Stdout)
 	}
+	ck.checkDirIVs(args.fix)
 	// Mount
-	srv := initGoFuse(pfs, args)
+	srv, err := initGoFuse(pfs, args)
+	if err != nil {
+		os.Exit(exitcodes.FuseNewServer)
+	}
 	// Handle SIGINT & SIGTERM
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, os.Interrupt)
@@ -292,20 +395,36 @@ func fsck(args *argContainer) (exitcode int) {
 	}()
 	// Recursively check the root dir
 	ck.dir("")
+	// Fix the usage if the filesystem has been mounted with "-quota"
+	if !ck.abort {
+		before, after, err := rn.RecomputeQuota()
+		if err == nil && before != after {
+			tlog.Info.Printf("fsck: quota usage was %d bytes, corrected to %d bytes", before, after)
+		} else if err != nil && !os.IsNotExist(err) {
+			tlog.Warn.Printf("fsck: quota: %v", err)
+		}
+	}
 	// Report results
 	wipeKeys()
 	if ck.abort {
 		tlog.Info.Printf("fsck: aborted")
 		return exitcodes.Other
 	}
-	if len(ck.corruptList) == 0 && len(ck.skippedList) == 0 {
-		tlog.Info.Printf("fsck summary: no problems found\n")
+	if ck.corruptCount == 0 && ck.skippedCount == 0 {
+		if ck.fixedCount > 0 {
+			tlog.Info.Printf("fsck summary: %d problems fixed, no problems left\n", ck.fixedCount)
+		} else {
+			tlog.Info.Printf("fsck summary: no problems found\n")
+		}
 		return 0
 	}
-	if len(ck.skippedList) > 0 {
+	if ck.skippedCount > 0 {
 		tlog.Warn.Printf("fsck: re-run this program as root to check all files!\n")
 	}
-	fmt.Printf("fsck summary: %d corrupt files, %d files skipped\n", len(ck.corruptList), len(ck.skippedList))
+	if ck.fixedCount > 0 {
+		fmt.Fprintf(ck.out, "fsck: %d problems fixed\n", ck.fixedCount)
+	}
+	fmt.Fprintf(ck.out, "fsck summary: %d corrupt files, %d files skipped\n", ck.corruptCount, ck.skippedCount)
 	return exitcodes.FsckErrors
 }
 
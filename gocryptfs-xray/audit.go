@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/rfjakob/gocryptfs/internal/audit"
+)
+
+// verifyAudit checks the HMAC chain of the audit log "logFile" written by
+// "gocryptfs -audit -audit-key keyFile". Exits with code 1 if it is broken.
+func verifyAudit(logFile string, keyFile string) {
+	key, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		errExit(err)
+	}
+	f, err := os.Open(logFile)
+	if err != nil {
+		errExit(err)
+	}
+	defer f.Close()
+	n, err := audit.Verify(f, key)
+	if err != nil {
+		fmt.Printf("FAIL after %d good entries: %v\n", n, err)
+		os.Exit(1)
+	}
+	fmt.Printf("%d entries ok\n", n)
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+)
+
+// conformanceChecker validates a CIPHERDIR against the on-disk format as
+// described in Documentation/file-format.md. It does not need the master key,
+// so it can only check the structure, not the authentication tags.
+type conformanceChecker struct {
+	cipherdir string
+	// Path of "cipherdir" relative to the CIPHERDIR that is checked, for
+	// snapshots and subtrees
+	prefix string
+	cf     *configfile.ConfFile
+	b64    *base64.Encoding
+	// Statistics for the report
+	dirs, files, symlinks int
+	problems              int
+}
+
+// fail records a conformance problem with "relPath".
+func (c *conformanceChecker) fail(relPath string, format string, a ...interface{}) {
+	c.problems++
+	fmt.Printf("FAIL %s: %s\n", filepath.Join(c.prefix, relPath), fmt.Sprintf(format, a...))
+}
+
+// conformance checks "cipherdir" and prints a report. Exits with code 1 if
+// problems were found.
+func conformance(cipherdir string) {
+	c := conformanceChecker{cipherdir: cipherdir}
+	c.run()
+	fmt.Printf("Checked %d directories, %d files, %d symlinks: %d problems\n",
+		c.dirs, c.files, c.symlinks, c.problems)
+	if c.problems > 0 {
+		os.Exit(1)
+	}
+}
+
+// run checks c.cipherdir and adds the results to the statistics
+func (c *conformanceChecker) run() {
+	var err error
+	c.cf, err = configfile.Load(filepath.Join(c.cipherdir, configfile.ConfDefaultName))
+	if err != nil {
+		c.fail(configfile.ConfDefaultName, "%v", err)
+		return
+	}
+	label := "Config"
+	if c.prefix != "" {
+		label += " " + filepath.Join(c.prefix, configfile.ConfDefaultName)
+	}
+	fmt.Printf("%s: Version=%d FeatureFlags=%s\n", label, c.cf.Version, strings.Join(c.cf.FeatureFlags, " "))
+	c.b64 = base64.URLEncoding
+	if c.cf.IsFeatureFlagSet(configfile.FlagRaw64) {
+		c.b64 = base64.RawURLEncoding
+	}
+	err = filepath.Walk(c.cipherdir, c.walkFn)
+	if err != nil {
+		errExit(err)
+	}
+}
+
+// checkSnapshots checks every snapshot in the directory "path" as a
+// CIPHERDIR of its own, with the config file that was copied into it.
+func (c *conformanceChecker) checkSnapshots(path string, relPath string) {
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		c.fail(relPath, "%v", err)
+		return
+	}
+	for _, e := range entries {
+		if !e.IsDir() || e.Name()[0] == '.' {
+			// ".NAME.incomplete" is a snapshot that is still being created
+			continue
+		}
+		c.checkCipherdir(filepath.Join(path, e.Name()), filepath.Join(relPath, e.Name()))
+	}
+}
+
+// checkCipherdir checks "path", a snapshot or a subtree of "-dirkey", as a
+// CIPHERDIR of its own and adds the results to the statistics
+func (c *conformanceChecker) checkCipherdir(path string, relPath string) {
+	sub := conformanceChecker{
+		cipherdir: path,
+		prefix:    filepath.Join(c.prefix, relPath),
+	}
+	sub.run()
+	c.dirs += sub.dirs
+	c.files += sub.files
+	c.symlinks += sub.symlinks
+	c.problems += sub.problems
+}
+
+// isSubtree returns true if the top-level directory "path" has its own key,
+// see "-dirkey". Subtree keys are derived from the DirIV, so there are none
+// without it.
+func (c *conformanceChecker) isSubtree(path string) bool {
+	if c.cf.IsFeatureFlagSet(configfile.FlagPlaintextNames) || c.cf.IsFeatureFlagSet(configfile.FlagDeterministicNames) {
+		return false
+	}
+	_, err := os.Lstat(filepath.Join(path, fusefrontend.SubtreeConfName))
+	return err == nil
+}
+
+// walkFn is called by filepath.Walk for every entry in CIPHERDIR.
+// filepath.Walk does not follow symlinks.
+func (c *conformanceChecker) walkFn(path string, fi os.FileInfo, err error) error {
+	relPath, _ := filepath.Rel(c.cipherdir, path)
+	if err != nil {
+		c.fail(relPath, "%v", err)
+		return nil
+	}
+	name := fi.Name()
+	if relPath == "." {
+		c.dirs++
+		c.checkDirIV(path, relPath)
+		return nil
+	}
+	if filepath.Dir(relPath) == "." && strings.HasPrefix(name, configfile.ConfDefaultName) {
+		// gocryptfs.conf and backups like gocryptfs.conf.bak
+		return nil
+	}
+	if filepath.Dir(relPath) == "." && (name == fusefrontend.QuotaFileName || name == fusefrontend.QuotaFileName+".tmp") {
+		// The plaintext JSON of "-quota"
+		return nil
+	}
+	if filepath.Dir(relPath) == "." && name == fusefrontend.TrashDirName && fi.IsDir() {
+		// The entries of "-trash-retention" are renamed to IDs that are not
+		// encrypted names, see internal/fusefrontend/trash.go
+		return filepath.SkipDir
+	}
+	if filepath.Dir(relPath) == "." && name == fusefrontend.SnapshotDirName && fi.IsDir() {
+		c.checkSnapshots(path, relPath)
+		return filepath.SkipDir
+	}
+	if filepath.Dir(relPath) == "." && fi.IsDir() && c.isSubtree(path) {
+		c.checkName(path, relPath, name)
+		c.checkCipherdir(path, relPath)
+		return filepath.SkipDir
+	}
+	if name == nametransform.DirIVFilename || nametransform.IsXattrSidecar(name) {
+		// gocryptfs.xattr.* is the encrypted blob written by "-xattr-sidecar"
+		return nil
+	}
+	c.checkName(path, relPath, name)
+	switch {
+	case fi.IsDir():
+		c.dirs++
+		c.checkDirIV(path, relPath)
+	case fi.Mode()&os.ModeSymlink != 0:
+		c.symlinks++
+		c.checkSymlink(path, relPath)
+	case fi.Mode().IsRegular():
+		if nametransform.NameType(name) == nametransform.LongNameFilename {
+			return nil
+		}
+		c.files++
+		c.checkContent(path, relPath, fi.Size())
+	}
+	return nil
+}
+
+// checkDirIV verifies that directory "path" contains a 16-byte gocryptfs.diriv
+// file if the DirIV feature flag is set.
+func (c *conformanceChecker) checkDirIV(path string, relPath string) {
+	if !c.cf.IsFeatureFlagSet(configfile.FlagDirIV) {
+		return
+	}
+	st, err := os.Lstat(filepath.Join(path, nametransform.DirIVFilename))
+	if err != nil {
+		c.fail(relPath, "%v", err)
+		return
+	}
+	if !st.Mode().IsRegular() || st.Size() != nametransform.DirIVLen {
+		c.fail(relPath, "%s: want a %d-byte regular file, have mode %v, size %d",
+			nametransform.DirIVFilename, nametransform.DirIVLen, st.Mode(), st.Size())
+	}
+}
+
+// checkName verifies that the encrypted name "name" is valid base64 that
+// decodes to a non-empty multiple of the AES block size. For long names, the
+// hash and the .name file are checked.
+func (c *conformanceChecker) checkName(path string, relPath string, name string) {
+	if c.cf.IsFeatureFlagSet(configfile.FlagPlaintextNames) {
+		return
+	}
+	switch nametransform.NameType(name) {
+	case nametransform.LongNameFilename:
+		// Checked together with the content file
+		content := nametransform.RemoveLongNameSuffix(path)
+		if _, err := os.Lstat(content); err != nil {
+			c.fail(relPath, "orphaned .name file: %v", err)
+		}
+		return
+	case nametransform.LongNameContent:
+		if !c.cf.IsFeatureFlagSet(configfile.FlagLongNames) {
+			c.fail(relPath, "long name but LongNames feature flag is not set")
+		}
+		hash := strings.TrimPrefix(name, "gocryptfs.longname.")
+		bin, err := c.b64.DecodeString(hash)
+		if err != nil || len(bin) != 32 {
+			c.fail(relPath, "long name hash is not a base64-encoded SHA256 hash")
+		}
+		longName, err := ioutil.ReadFile(path + nametransform.LongNameSuffix)
+		if err != nil {
+			c.fail(relPath, "%v", err)
+			return
+		}
+		c.checkEncryptedName(relPath+nametransform.LongNameSuffix, string(longName))
+	default:
+		c.checkEncryptedName(relPath, name)
+		max := nametransform.NameMax
+		if c.cf.IsFeatureFlagSet(configfile.FlagLongNameMax) {
+			max = int(c.cf.LongNameMax)
+		}
+		if len(name) > max {
+			c.fail(relPath, "name is longer than %d bytes", max)
+		}
+	}
+}
+
+// checkEncryptedName checks a (not hashed) base64-encoded encrypted name.
+func (c *conformanceChecker) checkEncryptedName(relPath string, cName string) {
+	bin, err := c.b64.DecodeString(cName)
+	if err != nil {
+		c.fail(relPath, "name is not valid base64: %v", err)
+		return
+	}
+	if len(bin) == 0 || len(bin)%16 != 0 {
+		c.fail(relPath, "decoded name length %d is not a positive multiple of 16", len(bin))
+	} else if c.cf.IsFeatureFlagSet(configfile.FlagPadNames) && !nametransform.IsPadBucket(len(bin)) {
+		c.fail(relPath, "decoded name length %d does not match PadNames", len(bin))
+	}
+}
+
+// checkSymlink verifies that the symlink target is a base64-encoded
+// encrypted block. With PlaintextNames or PlaintextSymlinks, symlink targets
+// are stored as-is.
+func (c *conformanceChecker) checkSymlink(path string, relPath string) {
+	if c.cf.IsFeatureFlagSet(configfile.FlagPlaintextNames) || c.cf.IsFeatureFlagSet(configfile.FlagPlaintextSymlinks) {
+		return
+	}
+	target, err := os.Readlink(path)
+	if err != nil {
+		c.fail(relPath, "%v", err)
+		return
+	}
+	if target == "" {
+		return
+	}
+	bin, err := c.b64.DecodeString(target)
+	if err != nil {
+		c.fail(relPath, "symlink target is not valid base64: %v", err)
+		return
+	}
+	if len(bin) < ivLen+authTagLen+1 {
+		c.fail(relPath, "symlink target is too short: %d bytes", len(bin))
+	}
+}
+
+// checkContent verifies the file header and the block layout of a regular
+// file.
+func (c *conformanceChecker) checkContent(path string, relPath string, size int64) {
+	if size == 0 {
+		return
+	}
+	if size < contentenc.HeaderLen {
+		c.fail(relPath, "file is shorter than the header: %d bytes", size)
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		c.fail(relPath, "%v", err)
+		return
+	}
+	defer f.Close()
+	buf := make([]byte, contentenc.HeaderLen)
+	_, err = io.ReadFull(f, buf)
+	if err != nil {
+		c.fail(relPath, "%v", err)
+		return
+	}
+	if _, err = contentenc.ParseHeader(buf); err != nil {
+		c.fail(relPath, "%v", err)
+	}
+	// Every block, including the last one, carries at least one byte of data
+	lastBlock := (size - contentenc.HeaderLen) % blockSize
+	if lastBlock > 0 && lastBlock < ivLen+authTagLen+1 {
+		c.fail(relPath, "last block is truncated: %d bytes", lastBlock)
+	}
+}
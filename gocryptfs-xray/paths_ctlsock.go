@@ -8,23 +8,45 @@ import (
 	"github.com/rfjakob/gocryptfs/ctlsock"
 )
 
-func decryptPaths(socketPath string, sep0 bool) {
-	var req ctlsock.RequestStruct
-	transformPaths(socketPath, &req, &req.DecryptPath, sep0)
+func decryptPaths(target string, sep0 bool, k keyArgs) {
+	transformPaths(pathQuery(target, false, k), sep0)
 }
 
-func encryptPaths(socketPath string, sep0 bool) {
-	var req ctlsock.RequestStruct
-	transformPaths(socketPath, &req, &req.EncryptPath, sep0)
+func encryptPaths(target string, sep0 bool, k keyArgs) {
+	transformPaths(pathQuery(target, true, k), sep0)
 }
 
-func transformPaths(socketPath string, req *ctlsock.RequestStruct, in *string, sep0 bool) {
-	errorCount := 0
-	c, err := ctlsock.New(socketPath)
+// pathQuery returns a function that encrypts or decrypts one path. "target"
+// is either the control socket of a mounted filesystem, or a CIPHERDIR,
+// which is then accessed directly without mounting it.
+func pathQuery(target string, encrypt bool, k keyArgs) func(string) (string, string, error) {
+	if fi, err := os.Stat(target); err == nil && fi.IsDir() {
+		return offlineQuery(offlineBackend(target, k), encrypt)
+	}
+	c, err := ctlsock.New(target)
 	if err != nil {
 		fmt.Printf("fatal: %v\n", err)
 		os.Exit(1)
 	}
+	return func(in string) (string, string, error) {
+		var req ctlsock.RequestStruct
+		if encrypt {
+			req.EncryptPath = in
+		} else {
+			req.DecryptPath = in
+		}
+		resp, err := c.Query(&req)
+		if err != nil {
+			return "", "", err
+		}
+		return resp.Result, resp.WarnText, nil
+	}
+}
+
+// transformPaths reads paths from stdin, one per line (or \0-separated with
+// "sep0"), and prints the result of "query" for each.
+func transformPaths(query func(string) (string, string, error), sep0 bool) {
+	errorCount := 0
 	line := 1
 	var separator byte = '\n'
 	if sep0 {
@@ -43,17 +65,17 @@ func transformPaths(socketPath string, req *ctlsock.RequestStruct, in *string, s
 			// drop trailing separator
 			val = val[:len(val)-1]
 		}
-		*in = string(val)
-		resp, err := c.Query(req)
+		in := string(val)
+		result, warnText, err := query(in)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "error at input line %d %q: %v\n", line, *in, err)
+			fmt.Fprintf(os.Stderr, "error at input line %d %q: %v\n", line, in, err)
 			errorCount++
 			continue
 		}
-		if resp.WarnText != "" {
-			fmt.Fprintf(os.Stderr, "warning at input line %d %q: %v\n", line, *in, resp.WarnText)
+		if warnText != "" {
+			fmt.Fprintf(os.Stderr, "warning at input line %d %q: %v\n", line, in, warnText)
 		}
-		fmt.Printf("%s%c", resp.Result, separator)
+		fmt.Printf("%s%c", result, separator)
 	}
 	if errorCount == 0 {
 		os.Exit(0)
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/ctlsocksrv"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/fido2"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/readpassword"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// keyArgs are the options that tell us where to get the master key from.
+type keyArgs struct {
+	masterkey string
+	passfile  string
+	fido2     string
+}
+
+// offlineBackend sets up the path transformation of the forward-mode
+// CIPHERDIR "cipherdir" without mounting it. The result translates paths
+// exactly like the control socket of a mounted filesystem does.
+func offlineBackend(cipherdir string, k keyArgs) ctlsocksrv.Interface {
+	tlog.Info.Enabled = false
+	cf, err := configfile.Load(filepath.Join(cipherdir, configfile.ConfDefaultName))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		exitcodes.Exit(err)
+	}
+	var masterkey []byte
+	if k.masterkey != "" {
+		masterkey, err = hex.DecodeString(strings.Replace(k.masterkey, "-", "", -1))
+		if err != nil || len(masterkey) != cryptocore.KeyLen {
+			tlog.Fatal.Printf("Could not parse master key")
+			os.Exit(exitcodes.MasterKey)
+		}
+	} else {
+		var pw []byte
+		if cf.IsFeatureFlagSet(configfile.FlagFIDO2) {
+			if k.fido2 == "" {
+				tlog.Fatal.Printf("Masterkey encrypted using FIDO2 token; need to use the --fido2 option.")
+				os.Exit(exitcodes.Usage)
+			}
+			pw = fido2.Secret(k.fido2, cf.FIDO2.CredentialID, cf.FIDO2.HMACSalt)
+		} else {
+			var passfile []string
+			if k.passfile != "" {
+				passfile = []string{k.passfile}
+			} else if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+				// The paths are read from stdin, so the password cannot be
+				tlog.Fatal.Printf("stdin is not a terminal: use -passfile or -masterkey")
+				os.Exit(exitcodes.Usage)
+			}
+			pw = readpassword.Once(nil, passfile, "")
+		}
+		masterkey, err = cf.DecryptMasterKey(pw)
+		for i := range pw {
+			pw[i] = 0
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			exitcodes.Exit(err)
+		}
+	}
+	// Same feature flag handling as mount.go
+	cryptoBackend := cryptocore.BackendGoGCM
+	if cf.IsFeatureFlagSet(configfile.FlagAESSIV) {
+		cryptoBackend = cryptocore.BackendAESSIV
+	}
+	frontendArgs := fusefrontend.Args{
+		Cipherdir:          cipherdir,
+		PlaintextNames:     cf.IsFeatureFlagSet(configfile.FlagPlaintextNames),
+		DeterministicNames: cf.IsFeatureFlagSet(configfile.FlagDeterministicNames),
+		LongNames:          true,
+	}
+	longNameMax := 0
+	if cf.IsFeatureFlagSet(configfile.FlagLongNameMax) {
+		longNameMax = int(cf.LongNameMax)
+	}
+	cCore := cryptocore.New(masterkey, cryptoBackend, contentenc.DefaultIVBits,
+		cf.IsFeatureFlagSet(configfile.FlagHKDF), false)
+	for i := range masterkey {
+		masterkey[i] = 0
+	}
+	cEnc := contentenc.New(cCore, contentenc.DefaultBS, false, false)
+	nameTransform := nametransform.New(cCore.EMECipher, frontendArgs.LongNames, uint8(longNameMax),
+		cf.IsFeatureFlagSet(configfile.FlagRaw64), cf.IsFeatureFlagSet(configfile.FlagPadNames))
+	return fusefrontend.NewRootNode(frontendArgs, cEnc, nameTransform)
+}
+
+// offlineQuery returns a query function for transformPaths() that uses
+// "backend" directly, with the same input canonicalization as the control
+// socket.
+func offlineQuery(backend ctlsocksrv.Interface, encrypt bool) func(string) (string, string, error) {
+	return func(in string) (result string, warnText string, err error) {
+		clean := ctlsocksrv.SanitizePath(in)
+		if in != clean {
+			warnText = fmt.Sprintf("Non-canonical input path '%s' has been interpreted as '%s'.", in, clean)
+		}
+		if clean == "" {
+			return "", warnText, fmt.Errorf("Empty input after canonicalization")
+		}
+		if encrypt {
+			result, err = backend.EncryptPath(clean)
+		} else {
+			result, err = backend.DecryptPath(clean)
+		}
+		return result, warnText, err
+	}
+}
@@ -48,7 +48,11 @@ func usage() {
 		"Examples:\n"+
 		"  gocryptfs-xray myfs/mCXnISiv7nEmyc0glGuhTQ\n"+
 		"  gocryptfs-xray -dumpmasterkey myfs/gocryptfs.conf\n"+
-		"  gocryptfs-xray -encrypt-paths myfs.sock\n")
+		"  gocryptfs-xray -encrypt-paths myfs.sock\n"+
+		"  gocryptfs-xray -decrypt-paths -passfile pw.txt myfs\n"+
+		"  gocryptfs-xray -conformance myfs\n"+
+		"  gocryptfs-xray -merkle myfs\n"+
+		"  gocryptfs-xray -audit-verify audit.key audit.log\n")
 }
 
 // sum counts the number of true values
@@ -66,19 +70,32 @@ func main() {
 		dumpmasterkey *bool
 		decryptPaths  *bool
 		encryptPaths  *bool
+		conformance   *bool
+		merkle        *bool
 		aessiv        *bool
 		sep0          *bool
 		fido2         *string
+		masterkey     *string
+		passfile      *string
+		auditVerify   *string
 	}
 	args.dumpmasterkey = flag.Bool("dumpmasterkey", false, "Decrypt and dump the master key")
-	args.decryptPaths = flag.Bool("decrypt-paths", false, "Decrypt file paths using gocryptfs control socket")
-	args.encryptPaths = flag.Bool("encrypt-paths", false, "Encrypt file paths using gocryptfs control socket")
+	args.decryptPaths = flag.Bool("decrypt-paths", false, "Decrypt file paths using gocryptfs control socket, or CIPHERDIR directly")
+	args.encryptPaths = flag.Bool("encrypt-paths", false, "Encrypt file paths using gocryptfs control socket, or CIPHERDIR directly")
+	args.conformance = flag.Bool("conformance", false, "Check that CIPHERDIR conforms to the on-disk format")
+	args.merkle = flag.Bool("merkle", false, "Verify the Merkle roots of all files in CIPHERDIR")
 	args.sep0 = flag.Bool("0", false, "Use \\0 instead of \\n as separator")
 	args.aessiv = flag.Bool("aessiv", false, "Assume AES-SIV mode instead of AES-GCM")
 	args.fido2 = flag.String("fido2", "", "Protect the masterkey using a FIDO2 token instead of a password")
+	args.masterkey = flag.String("masterkey", "", "Use explicit master key for -encrypt-paths and -decrypt-paths on CIPHERDIR")
+	args.passfile = flag.String("passfile", "", "Read password from file for -encrypt-paths and -decrypt-paths on CIPHERDIR")
+	args.auditVerify = flag.String("audit-verify", "", "Verify the HMAC chain of a gocryptfs -audit log with the key in this file")
 	flag.Usage = usage
 	flag.Parse()
-	s := sum(args.dumpmasterkey, args.decryptPaths, args.encryptPaths)
+	s := sum(args.dumpmasterkey, args.decryptPaths, args.encryptPaths, args.conformance, args.merkle)
+	if *args.auditVerify != "" {
+		s++
+	}
 	if s > 1 {
 		fmt.Printf("fatal: %d operations were requested\n", s)
 		os.Exit(1)
@@ -88,11 +105,24 @@ func main() {
 		os.Exit(1)
 	}
 	fn := flag.Arg(0)
+	k := keyArgs{masterkey: *args.masterkey, passfile: *args.passfile, fido2: *args.fido2}
 	if *args.decryptPaths {
-		decryptPaths(fn, *args.sep0)
+		decryptPaths(fn, *args.sep0, k)
 	}
 	if *args.encryptPaths {
-		encryptPaths(fn, *args.sep0)
+		encryptPaths(fn, *args.sep0, k)
+	}
+	if *args.conformance {
+		conformance(fn)
+		os.Exit(0)
+	}
+	if *args.merkle {
+		verifyMerkle(fn)
+		os.Exit(0)
+	}
+	if *args.auditVerify != "" {
+		verifyAudit(fn, *args.auditVerify)
+		os.Exit(0)
 	}
 	fd, err := os.Open(fn)
 	if err != nil {
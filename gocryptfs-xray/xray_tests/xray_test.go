@@ -4,9 +4,13 @@ import (
 	"bytes"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"os/exec"
+	"strings"
 	"testing"
 
+	"golang.org/x/sys/unix"
+
 	"github.com/rfjakob/gocryptfs/tests/test_helpers"
 )
 
@@ -44,6 +48,138 @@ func TestAessivXray(t *testing.T) {
 	}
 }
 
+func TestConformance(t *testing.T) {
+	for _, dir := range []string{"aesgcm_fs", "aessiv_fs"} {
+		out, err := exec.Command("../gocryptfs-xray", "-conformance", dir).CombinedOutput()
+		if err != nil {
+			t.Errorf("%s: %v\n%s", dir, err, string(out))
+		}
+	}
+	// Truncate a file so that the last block only contains the IV
+	cDir := test_helpers.InitFS(t)
+	fn := cDir + "/" + "VnvoeSetPaOFjZDaZAh0lA"
+	err := ioutil.WriteFile(fn, make([]byte, 18+16), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command("../gocryptfs-xray", "-conformance", cDir).CombinedOutput()
+	if err == nil {
+		t.Errorf("corrupt file was not detected:\n%s", string(out))
+	}
+}
+
+// TestConformanceTrash checks that the trash directory of -trash-retention
+// is not reported as a problem
+func TestConformanceTrash(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test", "-trash-retention=1h")
+	if err := ioutil.WriteFile(pDir+"/file", []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(pDir + "/file"); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(pDir)
+	if _, err := os.Stat(cDir + "/gocryptfs.trash"); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command("../gocryptfs-xray", "-conformance", cDir).CombinedOutput()
+	if err != nil {
+		t.Errorf("%v\n%s", err, string(out))
+	}
+}
+
+// TestConformanceQuota checks that the usage file of -quota is not reported
+// as a problem, neither in CIPHERDIR nor in a snapshot
+func TestConformanceQuota(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test", "-quota=100K")
+	if err := ioutil.WriteFile(pDir+"/file", []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(pDir)
+	if _, err := os.Stat(cDir + "/gocryptfs.quota"); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-snapshot", "create", cDir, "snap1")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v\n%s", err, string(out))
+	}
+	out, err := exec.Command("../gocryptfs-xray", "-conformance", cDir).CombinedOutput()
+	if err != nil {
+		t.Errorf("%v\n%s", err, string(out))
+	}
+}
+
+// TestConformanceSnapshot checks that snapshots are checked as CIPHERDIRs of
+// their own
+func TestConformanceSnapshot(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	if err := ioutil.WriteFile(pDir+"/file", []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(pDir)
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-snapshot", "create", cDir, "snap1")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v\n%s", err, string(out))
+	}
+	out, err := exec.Command("../gocryptfs-xray", "-conformance", cDir).CombinedOutput()
+	if err != nil {
+		t.Errorf("%v\n%s", err, string(out))
+	}
+	// Truncate the copy of "file" in the snapshot so that the last block only
+	// contains the IV
+	snap := cDir + "/gocryptfs.snapshots/snap1"
+	entries, err := ioutil.ReadDir(snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), "gocryptfs.") {
+			if err = ioutil.WriteFile(snap+"/"+e.Name(), make([]byte, 18+16), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	out, err = exec.Command("../gocryptfs-xray", "-conformance", cDir).CombinedOutput()
+	if err == nil || !strings.Contains(string(out), "FAIL gocryptfs.snapshots/snap1/") {
+		t.Errorf("corrupt file in the snapshot was not detected:\n%s", string(out))
+	}
+}
+
+// TestConformanceDirKey checks that a directory with its own key is checked
+// as a CIPHERDIR of its own, with its own gocryptfs.conf
+func TestConformanceDirKey(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	if err := os.Mkdir(pDir+"/sub", 0700); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(pDir)
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-dirkey", "add", "-scryptn=10", cDir, "sub")
+	cmd.Stdin = strings.NewReader("test\nsub\n")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v\n%s", err, string(out))
+	}
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	if err := ioutil.WriteFile(pDir+"/sub/file", []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(pDir)
+	out, err := exec.Command("../gocryptfs-xray", "-conformance", cDir).CombinedOutput()
+	if err != nil {
+		t.Errorf("%v\n%s", err, string(out))
+	}
+	if !strings.Contains(string(out), "/gocryptfs.conf: Version=") {
+		t.Errorf("the subtree config was not checked:\n%s", string(out))
+	}
+}
+
 func TestDumpmasterkey(t *testing.T) {
 	expected := "b4d8b25c324dd6eaa328c9906e8a2a3c6038552a042ced4326cfff210c62957a\n"
 	cmd := exec.Command("../gocryptfs-xray", "-dumpmasterkey", "aesgcm_fs/gocryptfs.conf")
@@ -108,3 +244,115 @@ func TestEncryptPaths(t *testing.T) {
 		}
 	}
 }
+
+// TestPathsOffline checks that -encrypt-paths and -decrypt-paths on an
+// unmounted CIPHERDIR give the same results as the control socket.
+func TestPathsOffline(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test")
+	longName := strings.Repeat("x", 200)
+	if err := os.MkdirAll(pDir+"/dir1/"+longName, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(pDir+"/dir1/"+longName+"/file1", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	in := "dir1\ndir1/" + longName + "\ndir1/" + longName + "/file1\n"
+	xray := func(stdin string, args ...string) string {
+		cmd := exec.Command("../gocryptfs-xray", args...)
+		cmd.Stdin = bytes.NewBufferString(stdin)
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("%v: %v", args, err)
+		}
+		return string(out)
+	}
+	wantCipher := xray(in, "-encrypt-paths", sock)
+	test_helpers.UnmountPanic(pDir)
+
+	passfile := cDir + ".pw"
+	if err := ioutil.WriteFile(passfile, []byte("test"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	haveCipher := xray(in, "-encrypt-paths", "-passfile", passfile, cDir)
+	if haveCipher != wantCipher {
+		t.Errorf("-encrypt-paths: want %q, have %q", wantCipher, haveCipher)
+	}
+	for _, p := range strings.Split(strings.TrimSpace(haveCipher), "\n") {
+		if _, err := os.Lstat(cDir + "/" + p); err != nil {
+			t.Error(err)
+		}
+	}
+	havePlain := xray(haveCipher, "-decrypt-paths", "-passfile", passfile, cDir)
+	if havePlain != in {
+		t.Errorf("-decrypt-paths: want %q, have %q", in, havePlain)
+	}
+	// Wrong password
+	ioutil.WriteFile(passfile, []byte("wrong"), 0600)
+	cmd := exec.Command("../gocryptfs-xray", "-encrypt-paths", "-passfile", passfile, cDir)
+	cmd.Stdin = bytes.NewBufferString(in)
+	if out, err := cmd.CombinedOutput(); err == nil {
+		t.Errorf("wrong password was accepted: %s", out)
+	}
+}
+
+// TestMerkle checks that the Merkle roots stay up to date through writes and
+// truncates, and that -merkle detects a flipped bit.
+func TestMerkle(t *testing.T) {
+	cDir := test_helpers.InitFS(t, "-merkle")
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	f, err := os.Create(pDir + "/big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(make([]byte, 300000))
+	f.WriteAt([]byte("middle"), 123456)
+	f.Sync()
+	f.Truncate(200000)
+	f.WriteAt([]byte("far away"), 500000)
+	f.Truncate(400001)
+	f.Close()
+	if err := ioutil.WriteFile(pDir+"/small", []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(pDir+"/empty", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	// The root is not visible through the mount
+	if sz, err := unix.Listxattr(pDir+"/big", nil); err != nil || sz != 0 {
+		t.Errorf("Listxattr: sz=%d err=%v", sz, err)
+	}
+	test_helpers.UnmountPanic(pDir)
+
+	out, err := exec.Command("../gocryptfs-xray", "-merkle", cDir).CombinedOutput()
+	if err != nil || !strings.Contains(string(out), "2 files ok, 0 without root, 0 failed") {
+		t.Fatalf("err=%v\n%s", err, out)
+	}
+	// Flip a bit in the last block of "big"
+	entries, err := ioutil.ReadDir(cDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var big string
+	for _, e := range entries {
+		if e.Size() > 400000 {
+			big = cDir + "/" + e.Name()
+		}
+	}
+	cf, err := os.OpenFile(big, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1)
+	cf.ReadAt(buf, 400000)
+	buf[0] ^= 1
+	cf.WriteAt(buf, 400000)
+	cf.Close()
+	out, err = exec.Command("../gocryptfs-xray", "-merkle", cDir).CombinedOutput()
+	if err == nil || !strings.Contains(string(out), "Merkle root mismatch") {
+		t.Errorf("corruption was not detected: err=%v\n%s", err, out)
+	}
+}
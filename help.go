@@ -8,7 +8,16 @@ import (
 
 const tUsage = "" +
 	"Usage: " + tlog.ProgramName + " -init|-passwd|-info [OPTIONS] CIPHERDIR\n" +
-	"  or   " + tlog.ProgramName + " [OPTIONS] CIPHERDIR MOUNTPOINT\n"
+	"  or   " + tlog.ProgramName + " [OPTIONS] CIPHERDIR MOUNTPOINT [CIPHERDIR2 MOUNTPOINT2 ...]\n" +
+	"  or   " + tlog.ProgramName + " -unmount [-lazy|-force] MOUNTPOINT|CIPHERDIR\n" +
+	"  or   " + tlog.ProgramName + " -lock|-unlock MOUNTPOINT|CIPHERDIR\n" +
+	"  or   " + tlog.ProgramName + " -migrate-encfs|-migrate-ecryptfs MOUNTPOINT [OPTIONS] CIPHERDIR\n" +
+	"  or   " + tlog.ProgramName + " -export|-import ARCHIVE [OPTIONS] CIPHERDIR\n" +
+	"  or   " + tlog.ProgramName + " -trash list|restore|purge [OPTIONS] CIPHERDIR [ID ...]\n" +
+	"  or   " + tlog.ProgramName + " -snapshot create|list|delete [OPTIONS] CIPHERDIR [NAME]\n" +
+	"  or   " + tlog.ProgramName + " -dirkey add|list|remove [OPTIONS] CIPHERDIR [DIR]\n" +
+	"  or   " + tlog.ProgramName + " -decrypt-only add|remove [OPTIONS] CIPHERDIR\n" +
+	"  or   " + tlog.ProgramName + " -duress add|remove [-duress-hook CMD] [OPTIONS] CIPHERDIR [DECOY]\n"
 
 // helpShort is what gets displayed when passed "-h" or on syntax error.
 func helpShort() {
@@ -40,6 +49,7 @@ Common Options (use -hh to show all):
   -reverse           Enable reverse mode
   -ro                Mount read-only
   -speed             Run crypto speed test
+  -unmount           Unmount a gocryptfs filesystem
   -version           Print version information
   --                 Stop option parsing
 `)
@@ -5,18 +5,87 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/rfjakob/gocryptfs/internal/configfile"
 	"github.com/rfjakob/gocryptfs/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
+// infoStruct is what "-info -json" prints. It only contains non-sensitive
+// data and is also used to generate the human-readable output.
+type infoStruct struct {
+	Version      uint16
+	Creator      string
+	Cipher       string
+	FeatureFlags []string
+	// KDF is "scrypt" or "FIDO2"
+	KDF    string
+	Scrypt *infoScrypt `json:",omitempty"`
+	// Created is the modification time of the root gocryptfs.diriv file,
+	// which is written once on "-init" and never touched again. If there is
+	// no such file (plaintextnames, reverse mode), the modification time of
+	// the config file is used.
+	Created time.Time
+	// KeySlots is the number of encrypted keys that are stored in the config
+	// file: the master key, and the decrypt-only key if there is one.
+	KeySlots     int
+	EncryptedKey int
+}
+
+// infoScrypt describes the scrypt parameters without the actual salt.
+type infoScrypt struct {
+	SaltLen int
+	N       int
+	R       int
+	P       int
+	KeyLen  int
+}
+
+// cipherName returns a human-readable description of the content
+// encryption algorithm implied by the feature flags.
+func cipherName(cf *configfile.ConfFile) string {
+	var name string
+	if cf.IsFeatureFlagSet(configfile.FlagAESSIV) {
+		name = "AES-SIV-512"
+	} else {
+		name = "AES-GCM-256"
+		if cf.IsFeatureFlagSet(configfile.FlagGCMIV128) {
+			name += " (128-bit IV)"
+		} else {
+			name += " (96-bit IV)"
+		}
+	}
+	if cf.IsFeatureFlagSet(configfile.FlagHKDF) {
+		name += ", HKDF-SHA256 key derivation"
+	}
+	return name
+}
+
+// creationTime returns our best guess of when CIPHERDIR was created. See
+// infoStruct.Created for details.
+func creationTime(cipherdir string, configPath string) (time.Time, error) {
+	st, err := os.Stat(filepath.Join(cipherdir, nametransform.DirIVFilename))
+	if err == nil {
+		return st.ModTime(), nil
+	}
+	st, err = os.Stat(configPath)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return st.ModTime(), nil
+}
+
 // info pretty-prints the contents of the config file at "filename" for human
 // consumption, stripping out sensitive data.
-// This is called when you pass the "-info" option.
-func info(filename string) {
+// This is called when you pass the "-info" option. With "-json", the output
+// is machine-readable.
+func info(args *argContainer) {
+	filename := args.config
 	// Read from disk
 	js, err := ioutil.ReadFile(filename)
 	if err != nil {
@@ -34,11 +103,54 @@ func info(filename string) {
 		tlog.Fatal.Printf("Unsupported on-disk format %d", cf.Version)
 		os.Exit(exitcodes.LoadConf)
 	}
+	created, err := creationTime(args.cipherdir, filename)
+	if err != nil {
+		tlog.Fatal.Printf("Stat failed: %v", err)
+		os.Exit(exitcodes.LoadConf)
+	}
+	i := infoStruct{
+		Version:      cf.Version,
+		Creator:      cf.Creator,
+		Cipher:       cipherName(&cf),
+		FeatureFlags: cf.FeatureFlags,
+		KDF:          "scrypt",
+		Created:      created,
+		KeySlots:     1 + len(cf.KeySlots),
+		EncryptedKey: len(cf.EncryptedKey),
+	}
+	if cf.IsFeatureFlagSet(configfile.FlagFIDO2) {
+		i.KDF = "FIDO2"
+	} else {
+		s := cf.ScryptObject
+		i.Scrypt = &infoScrypt{
+			SaltLen: len(s.Salt),
+			N:       s.N,
+			R:       s.R,
+			P:       s.P,
+			KeyLen:  s.KeyLen,
+		}
+	}
+	if args.json {
+		out, err := json.MarshalIndent(i, "", "\t")
+		if err != nil {
+			tlog.Fatal.Printf("Failed to marshal JSON: %v", err)
+			os.Exit(exitcodes.Other)
+		}
+		fmt.Println(string(out))
+		return
+	}
 	// Pretty-print
-	fmt.Printf("Creator:      %s\n", cf.Creator)
-	fmt.Printf("FeatureFlags: %s\n", strings.Join(cf.FeatureFlags, " "))
-	fmt.Printf("EncryptedKey: %dB\n", len(cf.EncryptedKey))
-	s := cf.ScryptObject
-	fmt.Printf("ScryptObject: Salt=%dB N=%d R=%d P=%d KeyLen=%d\n",
-		len(s.Salt), s.N, s.R, s.P, s.KeyLen)
+	fmt.Printf("Version:      %d\n", i.Version)
+	fmt.Printf("Creator:      %s\n", i.Creator)
+	fmt.Printf("Cipher:       %s\n", i.Cipher)
+	fmt.Printf("FeatureFlags: %s\n", strings.Join(i.FeatureFlags, " "))
+	fmt.Printf("Created:      %s\n", i.Created.Format(time.RFC3339))
+	fmt.Printf("KeySlots:     %d\n", i.KeySlots)
+	fmt.Printf("EncryptedKey: %dB\n", i.EncryptedKey)
+	if s := i.Scrypt; s != nil {
+		fmt.Printf("ScryptObject: Salt=%dB N=%d R=%d P=%d KeyLen=%d\n",
+			s.SaltLen, s.N, s.R, s.P, s.KeyLen)
+	} else {
+		fmt.Printf("KDF:          %s\n", i.KDF)
+	}
 }
@@ -86,8 +86,24 @@ func initDir(args *argContainer) {
 			fido2HmacSalt = nil
 		}
 		creator := tlog.ProgramName + " " + GitVersion
-		err = configfile.Create(args.config, password, args.plaintextnames,
-			args.scryptn, creator, args.aessiv, args.devrandom, fido2CredentialID, fido2HmacSalt)
+		err = configfile.Create(&configfile.CreateArgs{
+			Filename:           args.config,
+			Password:           password,
+			PlaintextNames:     args.plaintextnames,
+			LogN:               args.scryptn,
+			Creator:            creator,
+			AESSIV:             args.aessiv,
+			Devrandom:          args.devrandom,
+			Fido2CredentialID:  fido2CredentialID,
+			Fido2HmacSalt:      fido2HmacSalt,
+			LongNameMax:        uint8(args.longnamemax),
+			DeterministicNames: args.deterministic_names,
+			PadNames:           args.pad_names,
+			PlaintextSymlinks:  args.plaintext_symlinks,
+			MerkleRoots:        args.merkle,
+			AFSplit:            args.afsplit,
+			Passthrough:        args.passthrough,
+		})
 		if err != nil {
 			tlog.Fatal.Println(err)
 			os.Exit(exitcodes.WriteConf)
@@ -98,8 +114,8 @@ func initDir(args *argContainer) {
 		// password runs out of scope here
 	}
 	// Forward mode with filename encryption enabled needs a gocryptfs.diriv file
-	// in the root dir
-	if !args.plaintextnames && !args.reverse {
+	// in the root dir (unless -deterministic-names is used)
+	if !args.plaintextnames && !args.reverse && !args.deterministic_names {
 		// Open cipherdir (following symlinks)
 		dirfd, err := syscall.Open(args.cipherdir, syscall.O_DIRECTORY|syscallcompat.O_PATH, 0)
 		if err == nil {
@@ -0,0 +1,184 @@
+// Package audit writes the log of file accesses that is enabled with
+// "-audit".
+//
+// The log is a text file with one JSON object per event. It is only ever
+// appended to. If a key is given, every entry carries an HMAC-SHA256 over
+// the entry and the HMAC of the entry before it, so entries cannot be
+// modified, removed or inserted without the key. Removing entries at the
+// end cannot be detected that way, so the log should also be shipped to
+// somewhere else regularly.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Event is one entry in the audit log
+type Event struct {
+	Time time.Time
+	// Op is "open", "create", "rename", "unlink" or "rmdir"
+	Op string
+	// Path is the plaintext path relative to the mountpoint. NewPath is
+	// the target of a rename.
+	Path    string
+	NewPath string `json:",omitempty"`
+	// Flags are the open(2) flags of "open" and "create"
+	Flags uint32 `json:",omitempty"`
+	// Uid, Gid and Pid of the calling process
+	Uid uint32
+	Gid uint32
+	Pid uint32
+	// Errno is the error number returned to the caller, 0 on success.
+	Errno int32
+	// Chain is the hex-encoded HMAC of the entry when a key is used
+	Chain string `json:",omitempty"`
+}
+
+// Log is an open audit log
+type Log struct {
+	sync.Mutex
+	f *os.File
+	// HMAC key, nil if the log is not chained
+	key []byte
+	// Chain value of the last entry
+	prev []byte
+}
+
+// Open opens the audit log at "path" for appending, and creates it if it
+// does not exist. If "key" is not nil, the entries are HMAC-chained,
+// continuing the chain from the last entry in the file.
+func Open(path string, key []byte) (*Log, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	l := &Log{f: f, key: key}
+	if key != nil {
+		l.prev, err = lastChain(path)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// lastChain returns the chain value of the last entry in the file at
+// "path", or nil if the file is empty.
+func lastChain(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var last []byte
+	s := bufio.NewScanner(f)
+	s.Buffer(nil, 1024*1024)
+	for s.Scan() {
+		if len(s.Bytes()) > 0 {
+			last = append(last[:0], s.Bytes()...)
+		}
+	}
+	if err = s.Err(); err != nil || last == nil {
+		return nil, err
+	}
+	var e Event
+	if err = json.Unmarshal(last, &e); err != nil {
+		return nil, fmt.Errorf("last entry: %v", err)
+	}
+	if e.Chain == "" {
+		return nil, fmt.Errorf("last entry is not chained")
+	}
+	return hex.DecodeString(e.Chain)
+}
+
+// chain computes the chain value of entry "e", whose Chain field must be
+// empty, following "prev".
+func chain(key []byte, prev []byte, e *Event) ([]byte, error) {
+	j, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	h := hmac.New(sha256.New, key)
+	h.Write(prev)
+	h.Write(j)
+	return h.Sum(nil), nil
+}
+
+// Write appends "e" to the log.
+func (l *Log) Write(e Event) error {
+	l.Lock()
+	defer l.Unlock()
+	e.Chain = ""
+	if l.key != nil {
+		c, err := chain(l.key, l.prev, &e)
+		if err != nil {
+			return err
+		}
+		e.Chain = hex.EncodeToString(c)
+		l.prev = c
+	}
+	j, err := json.Marshal(&e)
+	if err != nil {
+		return err
+	}
+	// One write per entry, so that concurrent writers to the same file
+	// cannot interleave
+	_, err = l.f.Write(append(j, '\n'))
+	return err
+}
+
+// Close closes the log.
+func (l *Log) Close() error {
+	l.Lock()
+	defer l.Unlock()
+	return l.f.Close()
+}
+
+// Verify checks the HMAC chain of the log read from "r". It returns the
+// number of entries and an error that names the first bad line.
+func Verify(r io.Reader, key []byte) (n int, err error) {
+	var prev []byte
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1024*1024)
+	for line := 1; s.Scan(); line++ {
+		if len(s.Bytes()) == 0 {
+			continue
+		}
+		var e Event
+		if err = json.Unmarshal(s.Bytes(), &e); err != nil {
+			return n, fmt.Errorf("line %d: %v", line, err)
+		}
+		have, err := hex.DecodeString(e.Chain)
+		if err != nil || e.Chain == "" {
+			return n, fmt.Errorf("line %d: entry is not chained", line)
+		}
+		e.Chain = ""
+		want, err := chain(key, prev, &e)
+		if err != nil {
+			return n, fmt.Errorf("line %d: %v", line, err)
+		}
+		if !hmac.Equal(have, want) {
+			return n, fmt.Errorf("line %d: HMAC mismatch, the log has been modified", line)
+		}
+		// The HMAC covers the decoded entry. Make sure the line does not
+		// contain anything else, like unknown or duplicate keys.
+		e.Chain = hex.EncodeToString(have)
+		if j, _ := json.Marshal(&e); !bytes.Equal(j, s.Bytes()) {
+			return n, fmt.Errorf("line %d: entry is not in canonical form", line)
+		}
+		prev = have
+		n++
+	}
+	return n, s.Err()
+}
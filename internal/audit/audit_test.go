@@ -0,0 +1,68 @@
+package audit
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+	key := []byte("0123456789abcdef")
+	// Two sessions, the second one continues the chain
+	for i := 0; i < 2; i++ {
+		l, err := Open(path, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Write(Event{Time: time.Now(), Op: "open", Path: "foo", Uid: 1000, Pid: 42})
+		l.Write(Event{Time: time.Now(), Op: "rename", Path: "foo", NewPath: "bar\xff"})
+		l.Close()
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := Verify(bytes.NewReader(content), key)
+	if err != nil || n != 4 {
+		t.Fatalf("n=%d err=%v", n, err)
+	}
+	if _, err = Verify(bytes.NewReader(content), []byte("wrong key")); err == nil {
+		t.Error("wrong key was accepted")
+	}
+	lines := strings.SplitAfter(string(content), "\n")
+	// Modified entry
+	bad := strings.Replace(string(content), `"Uid":1000`, `"Uid":0`, 1)
+	if _, err = Verify(strings.NewReader(bad), key); err == nil || !strings.Contains(err.Error(), "line 1") {
+		t.Errorf("modified entry: %v", err)
+	}
+	// Removed entry
+	bad = lines[0] + lines[2] + lines[3]
+	if _, err = Verify(strings.NewReader(bad), key); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("removed entry: %v", err)
+	}
+	// Extra key
+	bad = strings.Replace(string(content), `{"Time"`, `{"X":1,"Time"`, 1)
+	if _, err = Verify(strings.NewReader(bad), key); err == nil {
+		t.Error("extra key was accepted")
+	}
+	// An unchained log cannot be continued with a key
+	l, err := Open(path+".2", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Write(Event{Time: time.Now(), Op: "unlink", Path: "foo"})
+	l.Close()
+	if _, err = Open(path+".2", key); err == nil {
+		t.Error("chaining an unchained log should fail")
+	}
+}
@@ -0,0 +1,141 @@
+package configfile
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"os"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// Anti-forensic splitting, like in LUKS. With the AFSplit feature flag, a
+// key is expanded into AFStripes stripes before it is encrypted with the
+// password. All stripes are needed to get the key back, so overwriting any
+// part of them destroys it. This matters on flash media, where wear
+// leveling may keep copies of some of the overwritten pages around.
+//
+// See "Anti-Forensic Information Splitter" in "New Methods in Hard Disk
+// Encryption", Clemens Fruhwirth, 2005.
+
+// AFStripes is the number of stripes a key is split into. 4000 is what
+// LUKS uses. For the 32-byte master key, the stripes take 125 kB.
+const AFStripes = 4000
+
+// afDiffuse mixes "d" in place, hashing each 32-byte block of it together
+// with its index
+func afDiffuse(d []byte) {
+	var idx [4]byte
+	for i := 0; i*sha256.Size < len(d); i++ {
+		block := d[i*sha256.Size:]
+		if len(block) > sha256.Size {
+			block = block[:sha256.Size]
+		}
+		binary.BigEndian.PutUint32(idx[:], uint32(i))
+		h := sha256.New()
+		h.Write(idx[:])
+		h.Write(block)
+		copy(block, h.Sum(nil))
+	}
+}
+
+// afSplit expands "key" into "stripes" stripes. The first stripes-1 stripes
+// are random, the last one is the key XORed with the diffused XOR of the
+// others.
+func afSplit(key []byte, stripes int) []byte {
+	n := len(key)
+	out := cryptocore.RandBytes(n * stripes)
+	d := make([]byte, n)
+	for i := 0; i < stripes-1; i++ {
+		s := out[i*n : (i+1)*n]
+		for j := range d {
+			d[j] ^= s[j]
+		}
+		afDiffuse(d)
+	}
+	last := out[(stripes-1)*n:]
+	for j := range last {
+		last[j] = d[j] ^ key[j]
+	}
+	for j := range d {
+		d[j] = 0
+	}
+	return out
+}
+
+// afMerge is the inverse of afSplit
+func afMerge(split []byte, stripes int) ([]byte, error) {
+	if len(split) == 0 || len(split)%stripes != 0 {
+		return nil, fmt.Errorf("AFSplit: length %d is not a multiple of %d stripes", len(split), stripes)
+	}
+	n := len(split) / stripes
+	d := make([]byte, n)
+	for i := 0; i < stripes-1; i++ {
+		s := split[i*n : (i+1)*n]
+		for j := range d {
+			d[j] ^= s[j]
+		}
+		afDiffuse(d)
+	}
+	last := split[(stripes-1)*n:]
+	for j := range d {
+		d[j] ^= last[j]
+	}
+	return d, nil
+}
+
+// splitKey returns "key" split into AFStripes stripes if the AFSplit
+// feature flag is set, and "key" itself otherwise. This is what gets
+// encrypted with the password.
+func (cf *ConfFile) splitKey(key []byte) []byte {
+	if !cf.IsFeatureFlagSet(FlagAFSplit) {
+		return key
+	}
+	return afSplit(key, AFStripes)
+}
+
+// mergeKey is the inverse of splitKey. It wipes "split".
+func (cf *ConfFile) mergeKey(split []byte) ([]byte, error) {
+	if !cf.IsFeatureFlagSet(FlagAFSplit) {
+		return split, nil
+	}
+	key, err := afMerge(split, AFStripes)
+	for i := range split {
+		split[i] = 0
+	}
+	return key, err
+}
+
+// openOldConf opens the existing config file "filename" for writing, so it
+// can be overwritten after it has been replaced. Returns nil if there is
+// none.
+func openOldConf(filename string) *os.File {
+	// gocryptfs.conf is read-only
+	if err := os.Chmod(filename, 0600); err != nil {
+		return nil
+	}
+	f, err := os.OpenFile(filename, os.O_WRONLY, 0)
+	if err != nil {
+		tlog.Warn.Printf("Cannot overwrite the old config file: %v", err)
+		return nil
+	}
+	return f
+}
+
+// overwriteOldConf overwrites the content of "f", the replaced config file,
+// with random data and closes it. This destroys the old stripes, as far as
+// the filesystem and the disk overwrite in place.
+func overwriteOldConf(f *os.File) {
+	defer f.Close()
+	fi, err := f.Stat()
+	if err == nil {
+		_, err = f.WriteAt(cryptocore.RandBytes(int(fi.Size())), 0)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		tlog.Warn.Printf("Cannot overwrite the old config file: %v", err)
+	}
+}
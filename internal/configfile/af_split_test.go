@@ -0,0 +1,76 @@
+package configfile
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+)
+
+func TestAFSplitMerge(t *testing.T) {
+	for _, n := range []int{32, 33, 64, 100} {
+		key := cryptocore.RandBytes(n)
+		split := afSplit(key, AFStripes)
+		if len(split) != n*AFStripes {
+			t.Fatalf("n=%d: wrong length %d", n, len(split))
+		}
+		merged, err := afMerge(split, AFStripes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(key, merged) {
+			t.Errorf("n=%d: merged key differs", n)
+		}
+		// Flipping a bit in any stripe destroys the key
+		split[len(split)/2] ^= 1
+		merged, _ = afMerge(split, AFStripes)
+		if bytes.Equal(key, merged) {
+			t.Errorf("n=%d: key survived a damaged stripe", n)
+		}
+	}
+	if _, err := afMerge(make([]byte, AFStripes+1), AFStripes); err == nil {
+		t.Error("afMerge should reject a length that is not a multiple of the stripes")
+	}
+}
+
+func TestCreateConfAFSplit(t *testing.T) {
+	err := Create(&CreateArgs{
+		Filename: "config_test/tmp.conf",
+		Password: testPw,
+		LogN:     10,
+		Creator:  "test",
+		AFSplit:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, c, err := LoadAndDecrypt("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key) != cryptocore.KeyLen || !c.IsFeatureFlagSet(FlagAFSplit) {
+		t.Fatalf("key length %d, AFSplit flag %v", len(key), c.IsFeatureFlagSet(FlagAFSplit))
+	}
+	// Key slots are split as well
+	slotKey := cryptocore.RandBytes(64)
+	c.SetKeySlot(KeySlotDecryptOnly, slotKey, []byte("slot"), 10)
+	c.UpdateMAC(key)
+	if err = c.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	c, err = Load("config_test/tmp.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l := len(c.FindKeySlot(KeySlotDecryptOnly).EncryptedKey); l < 64*AFStripes {
+		t.Errorf("key slot is not split: %d bytes", l)
+	}
+	key2, slot, err := c.DecryptKey([]byte("slot"))
+	if err != nil || slot != KeySlotDecryptOnly || !bytes.Equal(key2, slotKey) {
+		t.Errorf("key slot: %v %q", err, slot)
+	}
+	key2, slot, err = c.DecryptKey(testPw)
+	if err != nil || slot != "" || !bytes.Equal(key2, key) {
+		t.Errorf("master key: %v %q", err, slot)
+	}
+}
@@ -15,6 +15,7 @@ import (
 	"github.com/rfjakob/gocryptfs/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/internal/cryptocore"
 	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/secmem"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
@@ -27,6 +28,10 @@ const (
 	// the config file gets stored next to the plain-text files. Make it hidden
 	// (start with dot) to not annoy the user.
 	ConfReverseName = ".gocryptfs.reverse.conf"
+	// LongNameMaxMin is the smallest allowed value for -longnamemax. Hashed
+	// long names ("gocryptfs.longname." plus a base64-encoded SHA256 hash) are
+	// 62 bytes long and must fit.
+	LongNameMaxMin = 62
 )
 
 // FIDO2Params is a structure for storing FIDO2 parameters.
@@ -57,6 +62,19 @@ type ConfFile struct {
 	FeatureFlags []string
 	// FIDO2 parameters
 	FIDO2 FIDO2Params
+	// LongNameMax corresponds to the -longnamemax flag. It is only set if the
+	// LongNameMax feature flag is enabled.
+	LongNameMax uint8 `json:",omitempty"`
+	// Passthrough holds the "-passthrough" name patterns. It is only set if
+	// the Passthrough feature flag is enabled.
+	Passthrough []string `json:",omitempty"`
+	// ConfigMAC is an HMAC-SHA256 over all other fields except Creator and
+	// EncryptedKey, keyed with a key derived from the master key. It is only
+	// set if the ConfigMAC feature flag is enabled. See config_mac.go.
+	ConfigMAC []byte `json:",omitempty"`
+	// KeySlots holds more copies of keys, encrypted with other passwords.
+	// See key_slot.go.
+	KeySlots []KeySlot `json:",omitempty"`
 	// Filename is the name of the config file. Not exported to JSON.
 	filename string
 }
@@ -76,39 +94,92 @@ func randBytesDevRandom(n int) []byte {
 	return b
 }
 
+// CreateArgs exists because the argument list of Create() got too long.
+type CreateArgs struct {
+	Filename          string
+	Password          []byte
+	PlaintextNames    bool
+	LogN              int
+	Creator           string
+	AESSIV            bool
+	Devrandom         bool
+	Fido2CredentialID []byte
+	Fido2HmacSalt     []byte
+	// LongNameMax is the length limit for encrypted names before they are
+	// hashed. Zero means the default, NameMax (255).
+	LongNameMax uint8
+	// DeterministicNames disables gocryptfs.diriv files
+	DeterministicNames bool
+	// PadNames pads file names to fixed buckets before encryption
+	PadNames bool
+	// PlaintextSymlinks stores symlink targets unencrypted
+	PlaintextSymlinks bool
+	// MerkleRoots maintains per-file Merkle roots of the ciphertext
+	MerkleRoots bool
+	// AFSplit stores the encrypted keys split into AFStripes stripes
+	AFSplit bool
+	// Passthrough are the name patterns of files that are stored
+	// unencrypted
+	Passthrough []string
+}
+
 // Create - create a new config with a random key encrypted with
-// "password" and write it to "filename".
-// Uses scrypt with cost parameter logN.
-func Create(filename string, password []byte, plaintextNames bool,
-	logN int, creator string, aessiv bool, devrandom bool, fido2CredentialID []byte, fido2HmacSalt []byte) error {
+// "args.Password" and write it to "args.Filename".
+// Uses scrypt with cost parameter "args.LogN".
+func Create(args *CreateArgs) error {
 	var cf ConfFile
-	cf.filename = filename
-	cf.Creator = creator
+	cf.filename = args.Filename
+	cf.Creator = args.Creator
 	cf.Version = contentenc.CurrentVersion
 
 	// Set feature flags
 	cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagGCMIV128])
 	cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagHKDF])
-	if plaintextNames {
+	if args.PlaintextNames {
 		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagPlaintextNames])
 	} else {
-		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagDirIV])
+		if args.DeterministicNames {
+			cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagDeterministicNames])
+		} else {
+			cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagDirIV])
+		}
 		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagEMENames])
 		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagLongNames])
 		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagRaw64])
+		if args.LongNameMax > 0 && args.LongNameMax < 255 {
+			cf.LongNameMax = args.LongNameMax
+			cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagLongNameMax])
+		}
+		if args.PadNames {
+			cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagPadNames])
+		}
+		if args.PlaintextSymlinks {
+			cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagPlaintextSymlinks])
+		}
+	}
+	if args.MerkleRoots {
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagMerkleRoots])
 	}
-	if aessiv {
+	if args.AESSIV {
 		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagAESSIV])
 	}
-	if len(fido2CredentialID) > 0 {
+	if args.AFSplit {
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagAFSplit])
+	}
+	if len(args.Passthrough) > 0 {
+		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagPassthrough])
+		cf.Passthrough = args.Passthrough
+	}
+	if len(args.Fido2CredentialID) > 0 {
 		cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagFIDO2])
-		cf.FIDO2.CredentialID = fido2CredentialID
-		cf.FIDO2.HMACSalt = fido2HmacSalt
+		cf.FIDO2.CredentialID = args.Fido2CredentialID
+		cf.FIDO2.HMACSalt = args.Fido2HmacSalt
 	}
+	cf.FeatureFlags = append(cf.FeatureFlags, knownFlags[FlagConfigMAC])
 	{
 		// Generate new random master key
 		var key []byte
-		if devrandom {
+		if args.Devrandom {
 			key = randBytesDevRandom(cryptocore.KeyLen)
 		} else {
 			key = cryptocore.RandBytes(cryptocore.KeyLen)
@@ -117,7 +188,7 @@ func Create(filename string, password []byte, plaintextNames bool,
 		// Encrypt it using the password
 		// This sets ScryptObject and EncryptedKey
 		// Note: this looks at the FeatureFlags, so call it AFTER setting them.
-		cf.EncryptKey(key, password, logN)
+		cf.EncryptKey(key, args.Password, args.LogN)
 		for i := range key {
 			key[i] = 0
 		}
@@ -191,6 +262,8 @@ func Load(filename string) (*ConfFile, error) {
 	var requiredFlags []flagIota
 	if cf.IsFeatureFlagSet(FlagPlaintextNames) {
 		requiredFlags = requiredFlagsPlaintextNames
+	} else if cf.IsFeatureFlagSet(FlagDeterministicNames) {
+		requiredFlags = requiredFlagsDeterministicNames
 	} else {
 		requiredFlags = requiredFlagsNormal
 	}
@@ -216,6 +289,14 @@ func Load(filename string) (*ConfFile, error) {
 		return nil, exitcodes.NewErr("Deprecated filesystem", exitcodes.DeprecatedFS)
 	}
 
+	if cf.IsFeatureFlagSet(FlagLongNameMax) && cf.LongNameMax < LongNameMaxMin {
+		return nil, fmt.Errorf("LongNameMax=%d is below the minimum of %d", cf.LongNameMax, LongNameMaxMin)
+	}
+
+	if cf.IsFeatureFlagSet(FlagPassthrough) != (len(cf.Passthrough) > 0) {
+		return nil, fmt.Errorf("the Passthrough feature flag and the Passthrough patterns do not match")
+	}
+
 	// All good
 	return &cf, nil
 }
@@ -223,6 +304,22 @@ func Load(filename string) (*ConfFile, error) {
 // DecryptMasterKey decrypts the masterkey stored in cf.EncryptedKey using
 // password.
 func (cf *ConfFile) DecryptMasterKey(password []byte) (masterkey []byte, err error) {
+	masterkey, err = cf.decryptMasterKey(password)
+	if err != nil {
+		tlog.Warn.Printf("failed to unlock master key: %s", err.Error())
+		return nil, exitcodes.NewErr("Password incorrect.", exitcodes.PasswordIncorrect)
+	}
+	err = cf.VerifyMAC(masterkey)
+	if err != nil {
+		secmem.Free(masterkey)
+		return nil, err
+	}
+	return masterkey, nil
+}
+
+// decryptMasterKey is DecryptMasterKey without the MAC check. It returns the
+// error of the decryption as it is.
+func (cf *ConfFile) decryptMasterKey(password []byte) (masterkey []byte, err error) {
 	// Generate derived key from password
 	scryptHash := cf.ScryptObject.DeriveKey(password)
 
@@ -230,51 +327,83 @@ func (cf *ConfFile) DecryptMasterKey(password []byte) (masterkey []byte, err err
 	useHKDF := cf.IsFeatureFlagSet(FlagHKDF)
 	ce := getKeyEncrypter(scryptHash, useHKDF)
 
+	warn := tlog.Warn.Enabled
 	tlog.Warn.Enabled = false // Silence DecryptBlock() error messages on incorrect password
-	masterkey, err = ce.DecryptBlock(cf.EncryptedKey, 0, nil)
-	tlog.Warn.Enabled = true
+	masterkey, err = ce.DecryptBlock(cf.EncryptedKey, 0, cf.keyAD())
+	tlog.Warn.Enabled = warn
+	if err == nil {
+		masterkey, err = cf.mergeKey(masterkey)
+	}
+	if err == nil {
+		masterkey = lockKey(masterkey)
+	}
 
 	// Purge scrypt-derived key
-	for i := range scryptHash {
-		scryptHash[i] = 0
-	}
+	secmem.Free(scryptHash)
 	scryptHash = nil
 	ce.Wipe()
 	ce = nil
 
-	if err != nil {
-		tlog.Warn.Printf("failed to unlock master key: %s", err.Error())
-		return nil, exitcodes.NewErr("Password incorrect.", exitcodes.PasswordIncorrect)
-	}
-	return masterkey, nil
+	return masterkey, err
 }
 
 // EncryptKey - encrypt "key" using an scrypt hash generated from "password"
 // and store it in cf.EncryptedKey.
 // Uses scrypt with cost parameter logN and stores the scrypt parameters in
-// cf.ScryptObject.
+// cf.ScryptObject. If the ConfigMAC feature flag is set, cf.ConfigMAC is
+// updated as well.
 func (cf *ConfFile) EncryptKey(key []byte, password []byte, logN int) {
 	// Generate scrypt-derived key from password
 	cf.ScryptObject = NewScryptKDF(logN)
 	scryptHash := cf.ScryptObject.DeriveKey(password)
 
+	// The MAC covers the scrypt parameters
+	cf.UpdateMAC(key)
+
 	// Lock master key using password-based key
 	useHKDF := cf.IsFeatureFlagSet(FlagHKDF)
 	ce := getKeyEncrypter(scryptHash, useHKDF)
-	cf.EncryptedKey = ce.EncryptBlock(key, 0, nil)
+	split := cf.splitKey(key)
+	cf.EncryptedKey = ce.EncryptBlock(split, 0, cf.keyAD())
+	if cf.IsFeatureFlagSet(FlagAFSplit) {
+		for i := range split {
+			split[i] = 0
+		}
+	}
 
 	// Purge scrypt-derived key
-	for i := range scryptHash {
-		scryptHash[i] = 0
-	}
+	secmem.Free(scryptHash)
 	scryptHash = nil
 	ce.Wipe()
 	ce = nil
 }
 
+// CreateSubtree writes a config file for a directory that has its own
+// master key "key" ("-dirkey") to "filename". The key is encrypted with
+// "password". The directory uses the same feature flags as "cf", except
+// FIDO2: only the password unlocks it.
+func (cf *ConfFile) CreateSubtree(filename string, key []byte, password []byte, logN int) error {
+	sub := ConfFile{
+		filename:    filename,
+		Creator:     cf.Creator,
+		Version:     cf.Version,
+		LongNameMax: cf.LongNameMax,
+		Passthrough: cf.Passthrough,
+	}
+	for _, flag := range cf.FeatureFlags {
+		if flag != knownFlags[FlagFIDO2] {
+			sub.FeatureFlags = append(sub.FeatureFlags, flag)
+		}
+	}
+	// Note: this looks at the FeatureFlags, so call it AFTER setting them.
+	sub.EncryptKey(key, password, logN)
+	return sub.WriteFile()
+}
+
 // WriteFile - write out config in JSON format to file "filename.tmp"
 // then rename over "filename".
 // This way a password change atomically replaces the file.
+// With the AFSplit feature flag, the old file is overwritten afterwards.
 func (cf *ConfFile) WriteFile() error {
 	tmp := cf.filename + ".tmp"
 	// 0400 permissions: gocryptfs.conf should be kept secret and never be written to.
@@ -304,7 +433,19 @@ func (cf *ConfFile) WriteFile() error {
 	if err != nil {
 		return err
 	}
+	var old *os.File
+	if cf.IsFeatureFlagSet(FlagAFSplit) {
+		// Keep the old file open, so it can be overwritten after the rename
+		old = openOldConf(cf.filename)
+	}
 	err = os.Rename(tmp, cf.filename)
+	if old != nil {
+		if err == nil {
+			overwriteOldConf(old)
+		} else {
+			old.Close()
+		}
+	}
 	return err
 }
 
@@ -318,6 +459,6 @@ func getKeyEncrypter(scryptHash []byte, useHKDF bool) *contentenc.ContentEnc {
 		IVLen = contentenc.DefaultIVBits
 	}
 	cc := cryptocore.New(scryptHash, cryptocore.BackendGoGCM, IVLen, useHKDF, false)
-	ce := contentenc.New(cc, 4096, false)
+	ce := contentenc.New(cc, 4096, false, false)
 	return ce
 }
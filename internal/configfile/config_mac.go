@@ -0,0 +1,80 @@
+package configfile
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"log"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/secmem"
+)
+
+// macLen is the length of ConfFile.ConfigMAC (HMAC-SHA256).
+const macLen = sha256.Size
+
+// keyADConfigMAC is the associated data that is used when encrypting the
+// master key of a config file with the ConfigMAC feature flag. It has to be
+// exactly as long as a file ID.
+var keyADConfigMAC = []byte("gocryptfsConfMAC")
+
+// macData returns the canonical serialization of the config file that is
+// covered by the MAC: the whole file, so fields that are added later are
+// covered as well. Creator is purely informational, EncryptedKey is already
+// authenticated by GCM and ConfigMAC is the MAC itself, so these are left out.
+func (cf *ConfFile) macData() []byte {
+	d := *cf
+	d.Creator = ""
+	d.EncryptedKey = nil
+	d.ConfigMAC = nil
+	js, err := json.Marshal(d)
+	if err != nil {
+		log.Panic(err)
+	}
+	return js
+}
+
+// computeMAC returns the HMAC-SHA256 over macData(), keyed with a key that is
+// derived from "masterkey" using HKDF.
+func (cf *ConfFile) computeMAC(masterkey []byte) []byte {
+	key := cryptocore.ConfigMACKey(masterkey)
+	h := hmac.New(sha256.New, key)
+	h.Write(cf.macData())
+	secmem.Free(key)
+	return h.Sum(nil)
+}
+
+// keyAD returns the associated data that is used when encrypting the master
+// key. Binding the master key to the ConfigMAC feature flag means that an
+// attacker cannot simply strip the MAC and the flag from the config file:
+// decrypting the master key would fail. The AD does not depend on the MAC,
+// so the MAC can be updated with the master key alone, see UpdateMAC.
+// Config files without the flag get nil, like before.
+func (cf *ConfFile) keyAD() []byte {
+	if !cf.IsFeatureFlagSet(FlagConfigMAC) {
+		return nil
+	}
+	return keyADConfigMAC
+}
+
+// UpdateMAC recomputes cf.ConfigMAC with "masterkey". Call it after changing
+// the config file, for example the key slots, and before WriteFile.
+func (cf *ConfFile) UpdateMAC(masterkey []byte) {
+	if cf.IsFeatureFlagSet(FlagConfigMAC) {
+		cf.ConfigMAC = cf.computeMAC(masterkey)
+	}
+}
+
+// VerifyMAC checks cf.ConfigMAC against the config file contents using
+// "masterkey". It returns an error if the config file has been tampered with.
+// Config files without the ConfigMAC flag and without a MAC pass.
+func (cf *ConfFile) VerifyMAC(masterkey []byte) error {
+	if !cf.IsFeatureFlagSet(FlagConfigMAC) && len(cf.ConfigMAC) == 0 {
+		return nil
+	}
+	if len(cf.ConfigMAC) != macLen || !hmac.Equal(cf.ConfigMAC, cf.computeMAC(masterkey)) {
+		return exitcodes.NewErr("Config file MAC mismatch: gocryptfs.conf has been tampered with", exitcodes.LoadConf)
+	}
+	return nil
+}
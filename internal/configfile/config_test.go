@@ -62,7 +62,12 @@ func TestLoadV2StrangeFeature(t *testing.T) {
 }
 
 func TestCreateConfDefault(t *testing.T) {
-	err := Create("config_test/tmp.conf", testPw, false, 10, "test", false, false, nil, nil)
+	err := Create(&CreateArgs{
+		Filename: "config_test/tmp.conf",
+		Password: testPw,
+		LogN:     10,
+		Creator:  "test",
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -73,7 +78,7 @@ func TestCreateConfDefault(t *testing.T) {
 	// Check that all expected feature flags are set
 	want := []flagIota{
 		FlagGCMIV128, FlagDirIV, FlagEMENames, FlagLongNames,
-		FlagRaw64, FlagHKDF,
+		FlagRaw64, FlagHKDF, FlagConfigMAC,
 	}
 	for _, f := range want {
 		if !c.IsFeatureFlagSet(f) {
@@ -83,14 +88,26 @@ func TestCreateConfDefault(t *testing.T) {
 }
 
 func TestCreateConfDevRandom(t *testing.T) {
-	err := Create("config_test/tmp.conf", testPw, false, 10, "test", false, true, nil, nil)
+	err := Create(&CreateArgs{
+		Filename:  "config_test/tmp.conf",
+		Password:  testPw,
+		LogN:      10,
+		Creator:   "test",
+		Devrandom: true,
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
 }
 
 func TestCreateConfPlaintextnames(t *testing.T) {
-	err := Create("config_test/tmp.conf", testPw, true, 10, "test", false, false, nil, nil)
+	err := Create(&CreateArgs{
+		Filename:       "config_test/tmp.conf",
+		Password:       testPw,
+		PlaintextNames: true,
+		LogN:           10,
+		Creator:        "test",
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -111,7 +128,13 @@ func TestCreateConfPlaintextnames(t *testing.T) {
 
 // Reverse mode uses AESSIV
 func TestCreateConfFileAESSIV(t *testing.T) {
-	err := Create("config_test/tmp.conf", testPw, false, 10, "test", true, false, nil, nil)
+	err := Create(&CreateArgs{
+		Filename: "config_test/tmp.conf",
+		Password: testPw,
+		LogN:     10,
+		Creator:  "test",
+		AESSIV:   true,
+	})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -124,6 +147,119 @@ func TestCreateConfFileAESSIV(t *testing.T) {
 	}
 }
 
+// Flipping a feature flag, or stripping the MAC together with the ConfigMAC
+// flag, must be detected when the master key is decrypted.
+func TestConfigMACTamper(t *testing.T) {
+	if !testing.Verbose() {
+		tlog.Warn.Enabled = false
+	}
+	err := Create(&CreateArgs{
+		Filename: "config_test/tmp.conf",
+		Password: testPw,
+		LogN:     10,
+		Creator:  "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf, err := Load("config_test/tmp.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cf.ConfigMAC) != macLen {
+		t.Fatalf("wrong MAC length %d", len(cf.ConfigMAC))
+	}
+	if _, err = cf.DecryptMasterKey(testPw); err != nil {
+		t.Fatal(err)
+	}
+	// Drop the Raw64 flag
+	var flags []string
+	for _, f := range cf.FeatureFlags {
+		if f != knownFlags[FlagRaw64] {
+			flags = append(flags, f)
+		}
+	}
+	cf.FeatureFlags = flags
+	if _, err = cf.DecryptMasterKey(testPw); err == nil {
+		t.Error("flipped feature flag was not detected")
+	}
+	// Drop the MAC and the ConfigMAC flag as well
+	flags = nil
+	for _, f := range cf.FeatureFlags {
+		if f != knownFlags[FlagConfigMAC] {
+			flags = append(flags, f)
+		}
+	}
+	cf.FeatureFlags = flags
+	cf.ConfigMAC = nil
+	if _, err = cf.DecryptMasterKey(testPw); err == nil {
+		t.Error("stripped MAC was not detected")
+	}
+}
+
+// Every field that ConfigMAC covers must be authenticated, including the key
+// slots and the fields that were added after the MAC.
+func TestConfigMACTamperFields(t *testing.T) {
+	if !testing.Verbose() {
+		tlog.Warn.Enabled = false
+	}
+	err := Create(&CreateArgs{
+		Filename:    "config_test/tmp.conf",
+		Password:    testPw,
+		LogN:        10,
+		Creator:     "test",
+		LongNameMax: 100,
+		Passthrough: []string{"*.iso"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, cf, err := LoadAndDecrypt("config_test/tmp.conf", testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf.SetKeySlot(KeySlotDecryptOnly, key, []byte("slot1"), 10)
+	cf.SetKeySlot(KeySlotDuress, []byte("{}"), []byte("slot2"), 10)
+	cf.UpdateMAC(key)
+	if err = cf.WriteFile(); err != nil {
+		t.Fatal(err)
+	}
+	tamper := map[string]func(c *ConfFile){
+		"nothing":      func(c *ConfFile) {},
+		"Version":      func(c *ConfFile) { c.Version++ },
+		"FeatureFlags": func(c *ConfFile) { c.FeatureFlags = c.FeatureFlags[1:] },
+		"FIDO2":        func(c *ConfFile) { c.FIDO2.HMACSalt = []byte{1} },
+		"LongNameMax":  func(c *ConfFile) { c.LongNameMax = 200 },
+		"Passthrough":  func(c *ConfFile) { c.Passthrough = []string{"*"} },
+		"remove slot":  func(c *ConfFile) { c.KeySlots = c.KeySlots[:1] },
+		"swap slots":   func(c *ConfFile) { c.KeySlots[0], c.KeySlots[1] = c.KeySlots[1], c.KeySlots[0] },
+		"slot type":    func(c *ConfFile) { c.KeySlots[0].Type, c.KeySlots[1].Type = c.KeySlots[1].Type, c.KeySlots[0].Type },
+		"slot MAC":     func(c *ConfFile) { c.KeySlots[1].MAC[0] ^= 1 },
+	}
+	for name, f := range tamper {
+		c, err := Load("config_test/tmp.conf")
+		if err != nil {
+			t.Fatal(err)
+		}
+		f(c)
+		_, err = c.DecryptMasterKey(testPw)
+		if name == "nothing" && err != nil {
+			t.Errorf("untouched config file: %v", err)
+		} else if name != "nothing" && err == nil {
+			t.Errorf("%s: tampering was not detected", name)
+		}
+	}
+	// The MAC of a key slot covers the config file as well
+	c, err := Load("config_test/tmp.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.LongNameMax = 200
+	if _, _, err = c.DecryptKey([]byte("slot1")); err == nil {
+		t.Error("key slot: tampering was not detected")
+	}
+}
+
 func TestIsFeatureFlagKnown(t *testing.T) {
 	// Test a few hardcoded values
 	testKnownFlags := []string{"DirIV", "PlaintextNames", "EMENames", "GCMIV128", "LongNames", "AESSIV"}
@@ -28,19 +28,52 @@ const (
 	// FlagFIDO2 means that "-fido2" was used when creating the filesystem.
 	// The masterkey is protected using a FIDO2 token instead of a password.
 	FlagFIDO2
+	// FlagConfigMAC means that the config file is authenticated using a key
+	// derived from the master key, see ConfFile.ConfigMAC.
+	FlagConfigMAC
+	// FlagLongNameMax sets a custom name length limit, names longer than that
+	// will be hashed. The limit is stored in ConfFile.LongNameMax.
+	FlagLongNameMax
+	// FlagDeterministicNames disables gocryptfs.diriv files. All directories
+	// use the same, all-zero directory IV. Replaces FlagDirIV.
+	FlagDeterministicNames
+	// FlagPadNames pads file names to 32, 64, 128 or 256 bytes before
+	// encryption, instead of to a multiple of 16 bytes. This hides the
+	// plaintext name length better.
+	FlagPadNames
+	// FlagPlaintextSymlinks stores symlink targets unencrypted. File names
+	// are still encrypted.
+	FlagPlaintextSymlinks
+	// FlagMerkleRoots means that each file stores the root hash of a Merkle
+	// tree over its ciphertext in an extended attribute, see package merkle.
+	FlagMerkleRoots
+	// FlagAFSplit means that the encrypted keys are split into AFStripes
+	// stripes (anti-forensic splitting), see af_split.go.
+	FlagAFSplit
+	// FlagPassthrough means that files matching the name patterns in
+	// ConfFile.Passthrough are stored unencrypted.
+	FlagPassthrough
 )
 
 // knownFlags stores the known feature flags and their string representation
 var knownFlags = map[flagIota]string{
-	FlagPlaintextNames: "PlaintextNames",
-	FlagDirIV:          "DirIV",
-	FlagEMENames:       "EMENames",
-	FlagGCMIV128:       "GCMIV128",
-	FlagLongNames:      "LongNames",
-	FlagAESSIV:         "AESSIV",
-	FlagRaw64:          "Raw64",
-	FlagHKDF:           "HKDF",
-	FlagFIDO2:          "FIDO2",
+	FlagPlaintextNames:     "PlaintextNames",
+	FlagDirIV:              "DirIV",
+	FlagEMENames:           "EMENames",
+	FlagGCMIV128:           "GCMIV128",
+	FlagLongNames:          "LongNames",
+	FlagAESSIV:             "AESSIV",
+	FlagRaw64:              "Raw64",
+	FlagHKDF:               "HKDF",
+	FlagFIDO2:              "FIDO2",
+	FlagConfigMAC:          "ConfigMAC",
+	FlagLongNameMax:        "LongNameMax",
+	FlagDeterministicNames: "DeterministicNames",
+	FlagPadNames:           "PadNames",
+	FlagPlaintextSymlinks:  "PlaintextSymlinks",
+	FlagMerkleRoots:        "MerkleRoots",
+	FlagAFSplit:            "AFSplit",
+	FlagPassthrough:        "Passthrough",
 }
 
 // Filesystems that do not have these feature flags set are deprecated.
@@ -50,6 +83,12 @@ var requiredFlagsNormal = []flagIota{
 	FlagGCMIV128,
 }
 
+// Filesystems with deterministic names do not have gocryptfs.diriv files.
+var requiredFlagsDeterministicNames = []flagIota{
+	FlagEMENames,
+	FlagGCMIV128,
+}
+
 // Filesystems without filename encryption obviously don't have or need the
 // filename related feature flags.
 var requiredFlagsPlaintextNames = []flagIota{
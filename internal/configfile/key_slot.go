@@ -0,0 +1,187 @@
+package configfile
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"log"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/secmem"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+const (
+	// KeySlotDecryptOnly is the type of a key slot that holds the key from
+	// cryptocore.DecryptOnlyKey instead of the master key. A filesystem
+	// that is unlocked with it is mounted read-only. This is a policy of
+	// gocryptfs: the key can encrypt file contents.
+	KeySlotDecryptOnly = "DecryptOnly"
+	// KeySlotDuress is the type of a key slot that holds what to show
+	// instead of the filesystem when it is unlocked with a duress password.
+	// The content is up to the caller.
+	KeySlotDuress = "Duress"
+)
+
+// KeySlot is an additional copy of a key, encrypted with a password of its
+// own. ConfFile.EncryptedKey is the first key slot.
+type KeySlot struct {
+	// Type is KeySlotDecryptOnly or KeySlotDuress. There is at most one
+	// slot of each type.
+	Type string
+	// EncryptedKey holds the key, encrypted like ConfFile.EncryptedKey
+	EncryptedKey []byte
+	// ScryptObject stores the scrypt parameters for the password
+	ScryptObject ScryptKDF
+	// MAC is like ConfFile.ConfigMAC, but keyed with the key of the slot, so
+	// whoever holds it can check the config file, too
+	MAC []byte
+}
+
+// macData returns the canonical serialization of the fields that the MAC of
+// slot "s" covers: what ConfFile.macData covers, and the type and the scrypt
+// parameters of the slot. The scrypt parameters of the config file and the
+// key slots are left out, so "-passwd" and changing another slot do not have
+// to update the slot. ConfigMAC covers these.
+func (s *KeySlot) macData(cf *ConfFile) []byte {
+	c := *cf
+	c.Creator = ""
+	c.EncryptedKey = nil
+	c.ScryptObject = ScryptKDF{}
+	c.ConfigMAC = nil
+	c.KeySlots = nil
+	d := struct {
+		Config       ConfFile
+		Type         string
+		ScryptObject ScryptKDF
+	}{
+		Config:       c,
+		Type:         s.Type,
+		ScryptObject: s.ScryptObject,
+	}
+	js, err := json.Marshal(d)
+	if err != nil {
+		log.Panic(err)
+	}
+	return js
+}
+
+// computeMAC returns the HMAC-SHA256 over macData(), keyed with a key that
+// is derived from "key", the key of the slot
+func (s *KeySlot) computeMAC(cf *ConfFile, key []byte) []byte {
+	macKey := cryptocore.ConfigMACKey(key)
+	h := hmac.New(sha256.New, macKey)
+	h.Write(s.macData(cf))
+	secmem.Free(macKey)
+	return h.Sum(nil)
+}
+
+// FindKeySlot returns the key slot of type "typ", or nil
+func (cf *ConfFile) FindKeySlot(typ string) *KeySlot {
+	for i := range cf.KeySlots {
+		if cf.KeySlots[i].Type == typ {
+			return &cf.KeySlots[i]
+		}
+	}
+	return nil
+}
+
+// SetKeySlot encrypts "key" with "password" and stores it in the key slot of
+// type "typ", which is created if there is none. Uses scrypt with cost
+// parameter logN. Call UpdateMAC afterwards.
+func (cf *ConfFile) SetKeySlot(typ string, key []byte, password []byte, logN int) {
+	s := cf.FindKeySlot(typ)
+	if s == nil {
+		cf.KeySlots = append(cf.KeySlots, KeySlot{Type: typ})
+		s = &cf.KeySlots[len(cf.KeySlots)-1]
+	}
+	s.ScryptObject = NewScryptKDF(logN)
+	scryptHash := s.ScryptObject.DeriveKey(password)
+	// Like in EncryptKey, the MAC covers the scrypt parameters and the
+	// key is bound to it
+	s.MAC = s.computeMAC(cf, key)
+	ce := getKeyEncrypter(scryptHash, true)
+	split := cf.splitKey(key)
+	s.EncryptedKey = ce.EncryptBlock(split, 0, s.MAC[:16])
+	if cf.IsFeatureFlagSet(FlagAFSplit) {
+		for i := range split {
+			split[i] = 0
+		}
+	}
+	secmem.Free(scryptHash)
+	ce.Wipe()
+}
+
+// RemoveKeySlot deletes the key slot of type "typ". Call UpdateMAC
+// afterwards.
+func (cf *ConfFile) RemoveKeySlot(typ string) {
+	var slots []KeySlot
+	for _, s := range cf.KeySlots {
+		if s.Type != typ {
+			slots = append(slots, s)
+		}
+	}
+	cf.KeySlots = slots
+}
+
+// decrypt decrypts the key in slot "s" with "password". Returns nil if the
+// password does not fit.
+func (s *KeySlot) decrypt(cf *ConfFile, password []byte) (key []byte, err error) {
+	if len(s.MAC) != macLen {
+		return nil, nil
+	}
+	// Same as in DecryptMasterKey
+	scryptHash := s.ScryptObject.DeriveKey(password)
+	ce := getKeyEncrypter(scryptHash, true)
+	warn := tlog.Warn.Enabled
+	tlog.Warn.Enabled = false
+	key, err = ce.DecryptBlock(s.EncryptedKey, 0, s.MAC[:16])
+	tlog.Warn.Enabled = warn
+	secmem.Free(scryptHash)
+	ce.Wipe()
+	if err != nil {
+		return nil, nil
+	}
+	if key, err = cf.mergeKey(key); err != nil {
+		return nil, err
+	}
+	key = lockKey(key)
+	if !hmac.Equal(s.MAC, s.computeMAC(cf, key)) {
+		secmem.Free(key)
+		return nil, exitcodes.NewErr("Config file MAC mismatch: gocryptfs.conf has been tampered with", exitcodes.LoadConf)
+	}
+	return key, nil
+}
+
+// DecryptKey decrypts the master key with "password", or, if the password
+// does not fit, the key in the key slot that it fits. "slot" is the type of
+// that slot, or empty for the master key.
+func (cf *ConfFile) DecryptKey(password []byte) (key []byte, slot string, err error) {
+	if len(cf.KeySlots) == 0 {
+		key, err = cf.DecryptMasterKey(password)
+		return key, "", err
+	}
+	key, masterErr := cf.decryptMasterKey(password)
+	if masterErr == nil {
+		err = cf.VerifyMAC(key)
+		if err != nil {
+			secmem.Free(key)
+			return nil, "", err
+		}
+		return key, "", nil
+	}
+	for i := range cf.KeySlots {
+		s := &cf.KeySlots[i]
+		key, err = s.decrypt(cf, password)
+		if err != nil {
+			return nil, "", err
+		}
+		if key != nil {
+			return key, s.Type, nil
+		}
+	}
+	// Same message as in DecryptMasterKey, so the key slots do not show
+	tlog.Warn.Printf("failed to unlock master key: %s", masterErr.Error())
+	return nil, "", exitcodes.NewErr("Password incorrect.", exitcodes.PasswordIncorrect)
+}
@@ -9,6 +9,7 @@ import (
 
 	"github.com/rfjakob/gocryptfs/internal/cryptocore"
 	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/secmem"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
@@ -60,7 +61,8 @@ func NewScryptKDF(logN int) ScryptKDF {
 	return s
 }
 
-// DeriveKey returns a new key from a supplied password.
+// DeriveKey returns a new key from a supplied password. The key is in
+// locked memory, release it with secmem.Free.
 func (s *ScryptKDF) DeriveKey(pw []byte) []byte {
 	s.validateParams()
 
@@ -68,7 +70,14 @@ func (s *ScryptKDF) DeriveKey(pw []byte) []byte {
 	if err != nil {
 		log.Panicf("DeriveKey failed: %v", err)
 	}
-	return k
+	return lockKey(k)
+}
+
+// lockKey moves "k" into locked memory and wipes the original
+func lockKey(k []byte) []byte {
+	l := secmem.Copy(k)
+	secmem.Wipe(k)
+	return l
 }
 
 // LogN - N is saved as 2^LogN, but LogN is much easier to work with.
@@ -7,15 +7,30 @@ import (
 
 // bPool is a byte slice pool
 type bPool struct {
-	sync.Pool
+	*sync.Pool
 	sliceLen int
 }
 
+var (
+	// sharedPools holds one pool per slice length. All ContentEnc instances
+	// in the process use them, so several mounts served by one gocryptfs
+	// process share their buffers.
+	sharedPools     = make(map[int]*sync.Pool)
+	sharedPoolsLock sync.Mutex
+)
+
 func newBPool(sliceLen int) bPool {
-	return bPool{
-		Pool: sync.Pool{
+	sharedPoolsLock.Lock()
+	defer sharedPoolsLock.Unlock()
+	p := sharedPools[sliceLen]
+	if p == nil {
+		p = &sync.Pool{
 			New: func() interface{} { return make([]byte, sliceLen) },
-		},
+		}
+		sharedPools[sliceLen] = p
+	}
+	return bPool{
+		Pool:     p,
 		sliceLen: sliceLen,
 	}
 }
@@ -13,6 +13,7 @@ import (
 	"github.com/hanwen/go-fuse/v2/fuse"
 
 	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/metrics"
 	"github.com/rfjakob/gocryptfs/internal/stupidgcm"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
@@ -53,6 +54,8 @@ type ContentEnc struct {
 	allZeroNonce []byte
 	// Force decode even if integrity check fails (openSSL only)
 	forceDecode bool
+	// Return zeros for blocks that fail to decrypt, "-zero-corrupt"
+	zeroCorrupt bool
 
 	// Ciphertext block "sync.Pool" pool. Always returns cipherBS-sized byte
 	// slices (usually 4128 bytes).
@@ -70,7 +73,7 @@ type ContentEnc struct {
 }
 
 // New returns an initialized ContentEnc instance.
-func New(cc *cryptocore.CryptoCore, plainBS uint64, forceDecode bool) *ContentEnc {
+func New(cc *cryptocore.CryptoCore, plainBS uint64, forceDecode bool, zeroCorrupt bool) *ContentEnc {
 	if fuse.MAX_KERNEL_WRITE%plainBS != 0 {
 		log.Panicf("unaligned MAX_KERNEL_WRITE=%d", fuse.MAX_KERNEL_WRITE)
 	}
@@ -89,6 +92,7 @@ func New(cc *cryptocore.CryptoCore, plainBS uint64, forceDecode bool) *ContentEn
 		allZeroBlock: make([]byte, cipherBS),
 		allZeroNonce: make([]byte, cc.IVLen),
 		forceDecode:  forceDecode,
+		zeroCorrupt:  zeroCorrupt,
 		cBlockPool:   newBPool(int(cipherBS)),
 		CReqPool:     newBPool(cReqSize),
 		pBlockPool:   newBPool(int(plainBS)),
@@ -107,6 +111,11 @@ func (be *ContentEnc) CipherBS() uint64 {
 	return be.cipherBS
 }
 
+// IsZeroBlock returns true if "plaintext" is a full-sized block of zeros.
+func (be *ContentEnc) IsZeroBlock(plaintext []byte) bool {
+	return uint64(len(plaintext)) == be.plainBS && bytes.Equal(plaintext, be.allZeroBlock[:be.plainBS])
+}
+
 // DecryptBlocks decrypts a number of blocks
 func (be *ContentEnc) DecryptBlocks(ciphertext []byte, firstBlockNo uint64, fileID []byte) ([]byte, error) {
 	cBuf := bytes.NewBuffer(ciphertext)
@@ -118,8 +127,13 @@ func (be *ContentEnc) DecryptBlocks(ciphertext []byte, firstBlockNo uint64, file
 		var pBlock []byte
 		pBlock, err = be.DecryptBlock(cBlock, blockNo, fileID)
 		if err != nil {
+			metrics.ContentDecryptFailures.Inc()
 			if be.forceDecode && err == stupidgcm.ErrAuth {
 				tlog.Warn.Printf("DecryptBlocks: authentication failure in block #%d, overridden by forcedecode", firstBlockNo)
+			} else if be.zeroCorrupt {
+				tlog.Warn.Printf("DecryptBlocks: corrupt block #%d (%v), returning zeros due to -zero-corrupt", blockNo, err)
+				pBlock = be.zeroBlock(len(cBlock))
+				err = nil
 			} else {
 				break
 			}
@@ -131,6 +145,21 @@ func (be *ContentEnc) DecryptBlocks(ciphertext []byte, firstBlockNo uint64, file
 	return pBuf.Bytes(), err
 }
 
+// zeroBlock returns an all-zero plaintext block that stands in for the
+// corrupt ciphertext block of length "cLen".
+func (be *ContentEnc) zeroBlock(cLen int) []byte {
+	pLen := cLen - int(be.cipherBS-be.plainBS)
+	if pLen < 0 {
+		// Too short to have held any data
+		pLen = 0
+	}
+	pBlock := be.pBlockPool.Get()[:pLen]
+	for i := range pBlock {
+		pBlock[i] = 0
+	}
+	return pBlock
+}
+
 // concatAD concatenates the block number and the file ID to a byte blob
 // that can be passed to AES-GCM as associated data (AD).
 // Result is: aData = [blockNo.bigEndian fileID].
@@ -161,7 +190,7 @@ func (be *ContentEnc) DecryptBlock(ciphertext []byte, blockNo uint64, fileID []b
 
 	// All-zero block?
 	if bytes.Equal(ciphertext, be.allZeroBlock) {
-		tlog.Debug.Printf("DecryptBlock: file hole encountered")
+		tlog.DebugContent.Printf("DecryptBlock: file hole encountered")
 		return make([]byte, be.plainBS), nil
 	}
 
@@ -188,8 +217,8 @@ func (be *ContentEnc) DecryptBlock(ciphertext []byte, blockNo uint64, fileID []b
 	plaintext, err := be.cryptoCore.AEADCipher.Open(plaintext, nonce, ciphertext, aData)
 
 	if err != nil {
-		tlog.Debug.Printf("DecryptBlock: %s, len=%d", err.Error(), len(ciphertextOrig))
-		tlog.Debug.Println(hex.Dump(ciphertextOrig))
+		tlog.DebugContent.Printf("DecryptBlock: %s, len=%d", err.Error(), len(ciphertextOrig))
+		tlog.DebugContent.Println(hex.Dump(ciphertextOrig))
 		if be.forceDecode && err == stupidgcm.ErrAuth {
 			return plaintext, err
 		}
@@ -205,13 +234,14 @@ func (be *ContentEnc) DecryptBlock(ciphertext []byte, blockNo uint64, fileID []b
 const encryptMaxSplit = 2
 
 // encryptBlocksParallel splits the plaintext into parts and encrypts them
-// in parallel.
-func (be *ContentEnc) encryptBlocksParallel(plaintextBlocks [][]byte, ciphertextBlocks [][]byte, firstBlockNo uint64, fileID []byte) {
+// in parallel. Each part writes to its own region of "out".
+func (be *ContentEnc) encryptBlocksParallel(plaintextBlocks [][]byte, out []byte, offsets []int, firstBlockNo uint64, fileID []byte) error {
 	ncpu := runtime.NumCPU()
 	if ncpu > encryptMaxSplit {
 		ncpu = encryptMaxSplit
 	}
 	groupSize := len(plaintextBlocks) / ncpu
+	errs := make([]error, ncpu)
 	var wg sync.WaitGroup
 	for i := 0; i < ncpu; i++ {
 		wg.Add(1)
@@ -226,49 +256,84 @@ func (be *ContentEnc) encryptBlocksParallel(plaintextBlocks [][]byte, ciphertext
 				// incurs a 1 % performance penalty.
 				high = len(plaintextBlocks)
 			}
-			be.doEncryptBlocks(plaintextBlocks[low:high], ciphertextBlocks[low:high], firstBlockNo+uint64(low), fileID)
+			errs[i] = be.doEncryptBlocks(plaintextBlocks[low:high], out, offsets[low:high+1], firstBlockNo+uint64(low), fileID)
 			wg.Done()
 		}(i)
 	}
 	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // EncryptBlocks is like EncryptBlock but takes multiple plaintext blocks.
-// Returns a byte slice from CReqPool - so don't forget to return it
-// to the pool.
-func (be *ContentEnc) EncryptBlocks(plaintextBlocks [][]byte, firstBlockNo uint64, fileID []byte) []byte {
-	ciphertextBlocks := make([][]byte, len(plaintextBlocks))
+// The blocks are encrypted straight into a byte slice from CReqPool, which
+// is returned - so don't forget to return it to the pool.
+// Fails with cryptocore.ErrNonceRepeat when the random number generator is
+// broken. The buffer has already been returned to the pool then.
+func (be *ContentEnc) EncryptBlocks(plaintextBlocks [][]byte, firstBlockNo uint64, fileID []byte) ([]byte, error) {
+	// Where each ciphertext block goes in the output
+	overhead := int(be.cipherBS - be.plainBS)
+	offsets := make([]int, len(plaintextBlocks)+1)
+	for i, v := range plaintextBlocks {
+		offsets[i+1] = offsets[i]
+		if len(v) > 0 {
+			offsets[i+1] += len(v) + overhead
+		}
+	}
+	out := be.CReqPool.Get()
+	if offsets[len(plaintextBlocks)] > len(out) {
+		log.Panicf("EncryptBlocks: %d bytes of ciphertext do not fit into %d", offsets[len(plaintextBlocks)], len(out))
+	}
 	// For large writes, we parallelize encryption.
+	var err error
 	if len(plaintextBlocks) >= 32 && runtime.NumCPU() >= 2 {
-		be.encryptBlocksParallel(plaintextBlocks, ciphertextBlocks, firstBlockNo, fileID)
+		err = be.encryptBlocksParallel(plaintextBlocks, out, offsets, firstBlockNo, fileID)
 	} else {
-		be.doEncryptBlocks(plaintextBlocks, ciphertextBlocks, firstBlockNo, fileID)
+		err = be.doEncryptBlocks(plaintextBlocks, out, offsets, firstBlockNo, fileID)
 	}
-	// Concatenate ciphertext into a single byte array.
-	tmp := be.CReqPool.Get()
-	out := bytes.NewBuffer(tmp[:0])
-	for _, v := range ciphertextBlocks {
-		out.Write(v)
-		// Return the memory to cBlockPool
-		be.cBlockPool.Put(v)
+	if err != nil {
+		be.CReqPool.Put(out)
+		return nil, err
 	}
-	return out.Bytes()
+	return out[:offsets[len(plaintextBlocks)]], nil
 }
 
-// doEncryptBlocks is called by EncryptBlocks to do the actual encryption work
-func (be *ContentEnc) doEncryptBlocks(in [][]byte, out [][]byte, firstBlockNo uint64, fileID []byte) {
+// doEncryptBlocks is called by EncryptBlocks to do the actual encryption work.
+// Block "i" goes to out[offsets[i]:offsets[i+1]].
+func (be *ContentEnc) doEncryptBlocks(in [][]byte, out []byte, offsets []int, firstBlockNo uint64, fileID []byte) error {
 	for i, v := range in {
-		out[i] = be.EncryptBlock(v, firstBlockNo+uint64(i), fileID)
+		if len(v) == 0 {
+			continue
+		}
+		nonce, err := be.cryptoCore.IVGenerator.Get()
+		if err != nil {
+			return err
+		}
+		// The capacity limit makes sure that Seal() cannot spill over into
+		// the next block
+		dst := out[offsets[i]:offsets[i]:offsets[i+1]]
+		be.doEncryptBlock(dst, v, firstBlockNo+uint64(i), fileID, nonce)
 	}
+	return nil
 }
 
 // EncryptBlock - Encrypt plaintext using a random nonce.
 // blockNo and fileID are used as associated data.
 // The output is nonce + ciphertext + tag.
+// Used for small metadata like symlink targets, xattr values and the master
+// key. Panics when the random number generator repeats nonces, file content
+// goes through EncryptBlocks, which returns an error instead.
 func (be *ContentEnc) EncryptBlock(plaintext []byte, blockNo uint64, fileID []byte) []byte {
 	// Get a fresh random nonce
-	nonce := be.cryptoCore.IVGenerator.Get()
-	return be.doEncryptBlock(plaintext, blockNo, fileID, nonce)
+	nonce, err := be.cryptoCore.IVGenerator.Get()
+	if err != nil {
+		log.Panic(err)
+	}
+	return be.doEncryptBlock(be.cBlockPool.Get()[:0], plaintext, blockNo, fileID, nonce)
 }
 
 // EncryptBlockNonce - Encrypt plaintext using a nonce chosen by the caller.
@@ -279,13 +344,14 @@ func (be *ContentEnc) EncryptBlockNonce(plaintext []byte, blockNo uint64, fileID
 	if be.cryptoCore.AEADBackend != cryptocore.BackendAESSIV {
 		log.Panic("deterministic nonces are only secure in SIV mode")
 	}
-	return be.doEncryptBlock(plaintext, blockNo, fileID, nonce)
+	return be.doEncryptBlock(be.cBlockPool.Get()[:0], plaintext, blockNo, fileID, nonce)
 }
 
-// doEncryptBlock is the backend for EncryptBlock and EncryptBlockNonce.
-// blockNo and fileID are used as associated data.
-// The output is nonce + ciphertext + tag.
-func (be *ContentEnc) doEncryptBlock(plaintext []byte, blockNo uint64, fileID []byte, nonce []byte) []byte {
+// doEncryptBlock is the backend for EncryptBlock, EncryptBlockNonce and
+// EncryptBlocks. blockNo and fileID are used as associated data.
+// The output is nonce + ciphertext + tag, appended to "dst", which should
+// have room for it.
+func (be *ContentEnc) doEncryptBlock(dst []byte, plaintext []byte, blockNo uint64, fileID []byte, nonce []byte) []byte {
 	// Empty block?
 	if len(plaintext) == 0 {
 		return plaintext
@@ -295,12 +361,8 @@ func (be *ContentEnc) doEncryptBlock(plaintext []byte, blockNo uint64, fileID []
 	}
 	// Block is authenticated with block number and file ID
 	aData := concatAD(blockNo, fileID)
-	// Get a cipherBS-sized block of memory, copy the nonce into it and truncate to
-	// nonce length
-	cBlock := be.cBlockPool.Get()
-	copy(cBlock, nonce)
-	cBlock = cBlock[0:len(nonce)]
 	// Encrypt plaintext and append to nonce
+	cBlock := append(dst, nonce...)
 	ciphertext := be.cryptoCore.AEADCipher.Seal(cBlock, nonce, plaintext, aData)
 	overhead := int(be.cipherBS - be.plainBS)
 	if len(plaintext)+overhead != len(ciphertext) {
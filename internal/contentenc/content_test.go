@@ -1,8 +1,11 @@
 package contentenc
 
 import (
+	"bytes"
 	"testing"
 
+	"github.com/hanwen/go-fuse/v2/fuse"
+
 	"github.com/rfjakob/gocryptfs/internal/cryptocore"
 )
 
@@ -24,7 +27,7 @@ func TestSplitRange(t *testing.T) {
 
 	key := make([]byte, cryptocore.KeyLen)
 	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, false)
-	f := New(cc, DefaultBS, false)
+	f := New(cc, DefaultBS, false, false)
 
 	for _, r := range ranges {
 		parts := f.ExplodePlainRange(r.offset, r.length)
@@ -52,7 +55,7 @@ func TestCiphertextRange(t *testing.T) {
 
 	key := make([]byte, cryptocore.KeyLen)
 	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, false)
-	f := New(cc, DefaultBS, false)
+	f := New(cc, DefaultBS, false, false)
 
 	for _, r := range ranges {
 
@@ -75,7 +78,7 @@ func TestCiphertextRange(t *testing.T) {
 func TestBlockNo(t *testing.T) {
 	key := make([]byte, cryptocore.KeyLen)
 	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, false)
-	f := New(cc, DefaultBS, false)
+	f := New(cc, DefaultBS, false, false)
 
 	b := f.CipherOffToBlockNo(788)
 	if b != 0 {
@@ -94,3 +97,87 @@ func TestBlockNo(t *testing.T) {
 		t.Errorf("actual: %d", b)
 	}
 }
+
+// TestDecryptBlocksZeroCorrupt checks that "-zero-corrupt" replaces corrupt
+// blocks with zeros and keeps the good ones.
+func TestDecryptBlocksZeroCorrupt(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, false)
+	fileID := make([]byte, headerIDLen)
+	fileID[0] = 1
+	plain := make([][]byte, 3)
+	for i := range plain {
+		plain[i] = make([]byte, DefaultBS)
+		for j := range plain[i] {
+			plain[i][j] = byte(i + 1)
+		}
+	}
+	// Short last block
+	plain[2] = plain[2][:100]
+	f := New(cc, DefaultBS, false, true)
+	ciphertext, err := f.EncryptBlocks(plain, 0, fileID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Corrupt the middle block
+	ciphertext[f.CipherBS()+50] ^= 1
+
+	strict := New(cc, DefaultBS, false, false)
+	if _, err := strict.DecryptBlocks(ciphertext, 0, fileID); err == nil {
+		t.Fatal("corrupt block was not detected")
+	}
+	out, err := f.DecryptBlocks(ciphertext, 0, fileID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 2*DefaultBS+100 {
+		t.Fatalf("wrong length %d", len(out))
+	}
+	for i, b := range out {
+		want := byte(i/DefaultBS + 1)
+		if i/DefaultBS == 1 {
+			want = 0
+		}
+		if b != want {
+			t.Fatalf("byte %d: want %d, have %d", i, want, b)
+		}
+	}
+}
+
+// TestEncryptBlocksLarge encrypts a maximum-size unaligned write, which takes
+// the parallel path, and decrypts it again.
+func TestEncryptBlocksLarge(t *testing.T) {
+	key := make([]byte, cryptocore.KeyLen)
+	cc := cryptocore.New(key, cryptocore.BackendGoGCM, DefaultIVBits, true, false)
+	fileID := make([]byte, headerIDLen)
+	f := New(cc, DefaultBS, false, false)
+	// One more block than fits into an aligned request, the last one short
+	n := fuse.MAX_KERNEL_WRITE/DefaultBS + 1
+	plain := make([][]byte, n)
+	var want []byte
+	for i := range plain {
+		plain[i] = make([]byte, DefaultBS)
+		for j := range plain[i] {
+			plain[i][j] = byte(i + j)
+		}
+	}
+	plain[n-1] = plain[n-1][:1000]
+	for _, p := range plain {
+		want = append(want, p...)
+	}
+	ciphertext, err := f.EncryptBlocks(plain, 7, fileID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ciphertext) != (n-1)*int(f.CipherBS())+1000+int(f.CipherBS()-f.PlainBS()) {
+		t.Fatalf("wrong ciphertext length %d", len(ciphertext))
+	}
+	out, err := f.DecryptBlocks(ciphertext, 7, fileID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, want) {
+		t.Error("content mismatch")
+	}
+	f.CReqPool.Put(ciphertext)
+}
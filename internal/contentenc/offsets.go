@@ -40,7 +40,7 @@ func (be *ContentEnc) CipherSizeToPlainSize(cipherSize uint64) uint64 {
 
 	if cipherSize == HeaderLen {
 		// This can happen between createHeader() and Write() and is harmless.
-		tlog.Debug.Printf("cipherSize %d == header size: interrupted write?\n", cipherSize)
+		tlog.DebugContent.Printf("cipherSize %d == header size: interrupted write?\n", cipherSize)
 		return 0
 	}
 
@@ -12,6 +12,7 @@ import (
 
 	"github.com/rfjakob/eme"
 
+	"github.com/rfjakob/gocryptfs/internal/secmem"
 	"github.com/rfjakob/gocryptfs/internal/siv_aead"
 	"github.com/rfjakob/gocryptfs/internal/stupidgcm"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
@@ -61,80 +62,108 @@ func New(key []byte, aeadType AEADTypeEnum, IVBitLen int, useHKDF bool, forceDec
 	if len(key) != KeyLen {
 		log.Panic(fmt.Sprintf("Unsupported key length %d", len(key)))
 	}
+	var emeKey, aeadKey []byte
+	if useHKDF {
+		emeKey = hkdfDerive(key, hkdfInfoEMENames, KeyLen)
+		aeadKey = hkdfDeriveAEADKey(key, aeadType)
+	} else {
+		emeKey = secmem.Copy(key)
+		if aeadType == BackendAESSIV {
+			// AES-SIV needs a 64-byte key, see hkdfDeriveAEADKey. Older
+			// filesystems derive it with SHA512.
+			s := sha512.Sum512(key)
+			aeadKey = secmem.Copy(s[:])
+			secmem.Wipe(s[:])
+		} else {
+			aeadKey = secmem.Copy(key)
+		}
+	}
+	return newCore(emeKey, aeadKey, aeadType, IVBitLen, forceDecode)
+}
+
+// DecryptOnlyKey derives the key of a decrypt-only key slot from the master
+// key. It consists of the keys for file names and file contents, which
+// cannot be turned back into the master key or any other key derived from
+// it, like ConfigMACKey. Needs the "HKDF" feature flag.
+//
+// Both keys are symmetric, so they can encrypt just as well as decrypt.
+// That the holder only reads is enforced by gocryptfs (NewDecryptOnly and a
+// read-only mount), not by the cryptography.
+func DecryptOnlyKey(masterkey []byte, aeadType AEADTypeEnum) []byte {
+	emeKey := hkdfDerive(masterkey, hkdfInfoEMENames, KeyLen)
+	aeadKey := hkdfDeriveAEADKey(masterkey, aeadType)
+	key := secmem.Alloc(len(emeKey) + len(aeadKey))
+	copy(key, emeKey)
+	copy(key[len(emeKey):], aeadKey)
+	secmem.Free(emeKey)
+	secmem.Free(aeadKey)
+	return key
+}
+
+// NewDecryptOnly returns a CryptoCore for the key of a decrypt-only key slot,
+// see DecryptOnlyKey, or panics. File names can be encrypted, which is
+// needed to look them up. Encrypting file contents panics. This is a
+// safeguard in gocryptfs only, the AEAD key itself could encrypt.
+func NewDecryptOnly(key []byte, aeadType AEADTypeEnum, IVBitLen int, forceDecode bool) *CryptoCore {
+	emeKey := secmem.Copy(key[:KeyLen])
+	aeadKey := secmem.Copy(key[KeyLen:])
+	c := newCore(emeKey, aeadKey, aeadType, IVBitLen, forceDecode)
+	c.AEADCipher = decryptOnlyAEAD{c.AEADCipher}
+	return c
+}
+
+// hkdfDeriveAEADKey derives the key for file content encryption with
+// "aeadType" from "masterkey"
+func hkdfDeriveAEADKey(masterkey []byte, aeadType AEADTypeEnum) []byte {
+	if aeadType == BackendAESSIV {
+		// AES-SIV uses 1/2 of the key for authentication, 1/2 for
+		// encryption, so we need a 64-bytes key for AES-256.
+		return hkdfDerive(masterkey, hkdfInfoSIVContent, siv_aead.KeyLen)
+	}
+	return hkdfDerive(masterkey, hkdfInfoGCMContent, KeyLen)
+}
+
+// newCore returns a new CryptoCore that encrypts file names with "emeKey"
+// and file contents with "aeadKey", and wipes both keys
+func newCore(emeKey []byte, aeadKey []byte, aeadType AEADTypeEnum, IVBitLen int, forceDecode bool) *CryptoCore {
 	// We want the IV size in bytes
 	IVLen := IVBitLen / 8
 
 	// Initialize EME for filename encryption.
-	var emeCipher *eme.EMECipher
-	var err error
-	{
-		var emeBlockCipher cipher.Block
-		if useHKDF {
-			emeKey := hkdfDerive(key, hkdfInfoEMENames, KeyLen)
-			emeBlockCipher, err = aes.NewCipher(emeKey)
-			for i := range emeKey {
-				emeKey[i] = 0
-			}
-		} else {
-			emeBlockCipher, err = aes.NewCipher(key)
-		}
-		if err != nil {
-			log.Panic(err)
-		}
-		emeCipher = eme.New(emeBlockCipher)
+	emeBlockCipher, err := aes.NewCipher(emeKey)
+	if err != nil {
+		log.Panic(err)
 	}
+	emeCipher := eme.New(emeBlockCipher)
+	secmem.Free(emeKey)
 
 	// Initialize an AEAD cipher for file content encryption.
 	var aeadCipher cipher.AEAD
-	if aeadType == BackendOpenSSL || aeadType == BackendGoGCM {
-		var gcmKey []byte
-		if useHKDF {
-			gcmKey = hkdfDerive(key, hkdfInfoGCMContent, KeyLen)
-		} else {
-			gcmKey = append([]byte{}, key...)
+	switch aeadType {
+	case BackendOpenSSL:
+		if IVLen != 16 {
+			log.Panic("stupidgcm only supports 128-bit IVs")
 		}
-		switch aeadType {
-		case BackendOpenSSL:
-			if IVLen != 16 {
-				log.Panic("stupidgcm only supports 128-bit IVs")
-			}
-			aeadCipher = stupidgcm.New(gcmKey, forceDecode)
-		case BackendGoGCM:
-			goGcmBlockCipher, err := aes.NewCipher(gcmKey)
-			if err != nil {
-				log.Panic(err)
-			}
-			aeadCipher, err = cipher.NewGCMWithNonceSize(goGcmBlockCipher, IVLen)
-			if err != nil {
-				log.Panic(err)
-			}
+		aeadCipher = stupidgcm.New(aeadKey, forceDecode)
+	case BackendGoGCM:
+		goGcmBlockCipher, err := aes.NewCipher(aeadKey)
+		if err != nil {
+			log.Panic(err)
 		}
-		for i := range gcmKey {
-			gcmKey[i] = 0
+		aeadCipher, err = cipher.NewGCMWithNonceSize(goGcmBlockCipher, IVLen)
+		if err != nil {
+			log.Panic(err)
 		}
-	} else if aeadType == BackendAESSIV {
+	case BackendAESSIV:
 		if IVLen != 16 {
 			// SIV supports any nonce size, but we only use 16.
 			log.Panic("AES-SIV must use 16-byte nonces")
 		}
-		// AES-SIV uses 1/2 of the key for authentication, 1/2 for
-		// encryption, so we need a 64-bytes key for AES-256. Derive it from
-		// the 32-byte master key using HKDF, or, for older filesystems, with
-		// SHA256.
-		var key64 []byte
-		if useHKDF {
-			key64 = hkdfDerive(key, hkdfInfoSIVContent, siv_aead.KeyLen)
-		} else {
-			s := sha512.Sum512(key)
-			key64 = s[:]
-		}
-		aeadCipher = siv_aead.New(key64)
-		for i := range key64 {
-			key64[i] = 0
-		}
-	} else {
+		aeadCipher = siv_aead.New(aeadKey)
+	default:
 		log.Panic("unknown backend cipher")
 	}
+	secmem.Free(aeadKey)
 
 	return &CryptoCore{
 		EMECipher:   emeCipher,
@@ -145,6 +174,24 @@ func New(key []byte, aeadType AEADTypeEnum, IVBitLen int, useHKDF bool, forceDec
 	}
 }
 
+// decryptOnlyAEAD wraps the AEAD cipher of a decrypt-only key slot. The
+// mount is read-only, so nothing should ever get here.
+type decryptOnlyAEAD struct {
+	cipher.AEAD
+}
+
+func (a decryptOnlyAEAD) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	log.Panic("decrypt-only key: refusing to encrypt file contents")
+	return nil
+}
+
+// Wipe passes Wipe on to the wrapped cipher
+func (a decryptOnlyAEAD) Wipe() {
+	if w, ok := a.AEAD.(wiper); ok {
+		w.Wipe()
+	}
+}
+
 type wiper interface {
 	Wipe()
 }
@@ -155,6 +202,19 @@ type wiper interface {
 // This is not bulletproof due to possible GC copies, but
 // still raises to bar for extracting the key.
 func (c *CryptoCore) Wipe() {
+	c.Forget()
+	c.EMECipher = nil
+}
+
+// Forget wipes the keys like Wipe, but keeps the CryptoCore usable for
+// Restore. The EMECipher object is cleared in place, so that copies of the
+// pointer, like the one in nametransform, lose the key as well. Using the
+// CryptoCore before Restore panics.
+func (c *CryptoCore) Forget() {
+	if c.AEADCipher == nil {
+		// Already wiped
+		return
+	}
 	be := c.AEADBackend
 	if be == BackendOpenSSL || be == BackendAESSIV {
 		tlog.Debug.Printf("CryptoCore.Wipe: Wiping AEADBackend %d key", be)
@@ -166,8 +226,22 @@ func (c *CryptoCore) Wipe() {
 		tlog.Debug.Printf("CryptoCore.Wipe: Only nil'ing stdlib refs")
 	}
 	// We have no access to the keys (or key-equivalents) stored inside the
-	// Go stdlib. Best we can is to nil the references and force a GC.
+	// Go stdlib. They live on the Go heap and cannot be locked into RAM like
+	// the keys in package secmem. Best we can is to nil the references and
+	// force a GC.
 	c.AEADCipher = nil
-	c.EMECipher = nil
+	*c.EMECipher = eme.EMECipher{}
 	runtime.GC()
 }
+
+// Restore moves the keys of "o", which must have been created with the same
+// parameters, into "c" after Forget. "o" must not be used afterwards.
+func (c *CryptoCore) Restore(o *CryptoCore) {
+	if c.AEADBackend != o.AEADBackend || c.IVLen != o.IVLen {
+		log.Panic("CryptoCore.Restore: parameters differ")
+	}
+	*c.EMECipher = *o.EMECipher
+	c.AEADCipher = o.AEADCipher
+	*o.EMECipher = eme.EMECipher{}
+	o.AEADCipher = nil
+}
@@ -39,3 +39,74 @@ func TestNewPanic(t *testing.T) {
 	key := make([]byte, 16)
 	New(key, BackendOpenSSL, 128, true, false)
 }
+
+// The key of a decrypt-only key slot must decrypt what the master key has
+// encrypted, and refuse to encrypt
+func TestNewDecryptOnly(t *testing.T) {
+	masterkey := RandBytes(KeyLen)
+	for _, be := range []AEADTypeEnum{BackendGoGCM, BackendAESSIV} {
+		c := New(masterkey, be, 128, true, false)
+		ro := NewDecryptOnly(DecryptOnlyKey(masterkey, be), be, 128, false)
+		nonce, err := c.IVGenerator.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ciphertext := c.AEADCipher.Seal(nil, nonce, []byte("hello"), nil)
+		plaintext, err := ro.AEADCipher.Open(nil, nonce, ciphertext, nil)
+		if err != nil || string(plaintext) != "hello" {
+			t.Errorf("backend %d: %q %v", be, plaintext, err)
+		}
+		iv := make([]byte, 16)
+		if string(ro.EMECipher.Encrypt(iv, make([]byte, 16))) != string(c.EMECipher.Encrypt(iv, make([]byte, 16))) {
+			t.Errorf("backend %d: EME keys differ", be)
+		}
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("backend %d: Seal did not panic", be)
+				}
+			}()
+			ro.AEADCipher.Seal(nil, nonce, []byte("hello"), nil)
+		}()
+	}
+}
+
+// After Forget, the EMECipher pointer that nametransform holds must not work
+// anymore. Restore brings the keys back.
+func TestForgetRestore(t *testing.T) {
+	masterkey := RandBytes(KeyLen)
+	for _, be := range []AEADTypeEnum{BackendGoGCM, BackendAESSIV} {
+		c := New(masterkey, be, 128, true, false)
+		eme := c.EMECipher
+		iv := make([]byte, 16)
+		want := string(eme.Encrypt(iv, make([]byte, 16)))
+		nonce, err := c.IVGenerator.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ciphertext := c.AEADCipher.Seal(nil, nonce, []byte("hello"), nil)
+		c.Forget()
+		if c.AEADCipher != nil {
+			t.Errorf("backend %d: AEADCipher survived", be)
+		}
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("backend %d: EME still works", be)
+				}
+			}()
+			eme.Encrypt(iv, make([]byte, 16))
+		}()
+		// A second Forget is a no-op
+		c.Forget()
+		c.Restore(New(masterkey, be, 128, true, false))
+		if string(eme.Encrypt(iv, make([]byte, 16))) != want {
+			t.Errorf("backend %d: EME key differs after Restore", be)
+		}
+		plaintext, err := c.AEADCipher.Open(nil, nonce, ciphertext, nil)
+		if err != nil || string(plaintext) != "hello" {
+			t.Errorf("backend %d: %q %v", be, plaintext, err)
+		}
+		c.Wipe()
+	}
+}
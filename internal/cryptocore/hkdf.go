@@ -5,6 +5,8 @@ import (
 	"log"
 
 	"golang.org/x/crypto/hkdf"
+
+	"github.com/rfjakob/gocryptfs/internal/secmem"
 )
 
 const (
@@ -13,17 +15,32 @@ const (
 	hkdfInfoEMENames   = "EME filename encryption"
 	hkdfInfoGCMContent = "AES-GCM file content encryption"
 	hkdfInfoSIVContent = "AES-SIV file content encryption"
+	hkdfInfoConfigMAC  = "gocryptfs.conf HMAC-SHA256"
+	hkdfInfoSubtreeKey = "per-directory master key"
 )
 
 // hkdfDerive derives "outLen" bytes from "masterkey" and "info" using
 // HKDF-SHA256 (RFC 5869).
-// It returns the derived bytes or panics.
+// It returns the derived bytes in locked memory (see secmem) or panics.
 func hkdfDerive(masterkey []byte, info string, outLen int) (out []byte) {
 	h := hkdf.New(sha256.New, masterkey, nil, []byte(info))
-	out = make([]byte, outLen)
+	out = secmem.Alloc(outLen)
 	n, err := h.Read(out)
 	if n != outLen || err != nil {
 		log.Panicf("hkdfDerive: hkdf read failed, got %d bytes, error: %v", n, err)
 	}
 	return out
 }
+
+// ConfigMACKey derives the key that is used to authenticate gocryptfs.conf
+// from the master key.
+func ConfigMACKey(masterkey []byte) []byte {
+	return hkdfDerive(masterkey, hkdfInfoConfigMAC, KeyLen)
+}
+
+// SubtreeKey derives the master key of a directory that has its own key
+// ("-dirkey") from the master key of the filesystem and the DirIV of the
+// directory.
+func SubtreeKey(masterkey []byte, dirIV []byte) []byte {
+	return hkdfDerive(masterkey, hkdfInfoSubtreeKey+string(dirIV), KeyLen)
+}
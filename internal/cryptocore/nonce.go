@@ -3,7 +3,11 @@ package cryptocore
 import (
 	"crypto/rand"
 	"encoding/binary"
+	"errors"
 	"log"
+
+	"github.com/rfjakob/gocryptfs/internal/metrics"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
 // RandBytes gets "n" random bytes from /dev/urandom or panics
@@ -22,11 +26,42 @@ func RandUint64() uint64 {
 	return binary.BigEndian.Uint64(b)
 }
 
+// ErrNonceRepeat is returned by the nonce generator when the random number
+// generator keeps handing out nonces that have been used before.
+var ErrNonceRepeat = errors.New("random number generator repeats nonces")
+
 type nonceGenerator struct {
 	nonceLen int // bytes
+	// filter detects repeated nonces, see nonce_health.go
+	filter nonceFilter
+	// read gets random bytes. Nil means the randPrefetcher. Set by tests.
+	read func(n int) []byte
+}
+
+// Get a random "nonceLen"-byte nonce. Nonces that (probably) have been handed
+// out before are discarded. Returns ErrNonceRepeat when that happens so often
+// that the random number generator must be broken. Nothing must be encrypted
+// then.
+func (n *nonceGenerator) Get() ([]byte, error) {
+	read := n.read
+	if read == nil {
+		read = randPrefetcher.read
+	}
+	for i := 0; i < nonceMaxRetries; i++ {
+		nonce := read(n.nonceLen)
+		if !n.filter.seen(nonce) {
+			return nonce, nil
+		}
+		// Usually a false positive. Counted in the stats.
+		tlog.Debug.Printf("nonceGenerator: discarding possibly repeated nonce")
+	}
+	metrics.NonceRepeatErrors.Inc()
+	tlog.Warn.Printf("nonceGenerator: %d nonces in a row have been used before. The random number generator is broken!",
+		nonceMaxRetries)
+	return nil, ErrNonceRepeat
 }
 
-// Get a random "nonceLen"-byte nonce
-func (n *nonceGenerator) Get() []byte {
-	return randPrefetcher.read(n.nonceLen)
+// Stats returns the counters of the nonce health monitor.
+func (n *nonceGenerator) Stats() NonceStats {
+	return n.filter.Stats()
 }
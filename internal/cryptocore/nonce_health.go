@@ -0,0 +1,164 @@
+package cryptocore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/rfjakob/gocryptfs/internal/metrics"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+const (
+	// Size of the nonce reuse filter in bits (4 MiB). Each shard is
+	// allocated on its first nonce.
+	nonceFilterBits = 1 << 25
+	// Number of bits set per nonce
+	nonceFilterK = 4
+	// The filter is split into this many shards with their own lock, so
+	// that parallel writers do not serialize on one mutex. A nonce goes to
+	// the shard that holds its 512-bit block.
+	nonceFilterShards = 64
+	// A shard is cleared after this many nonces. At 8 bits per nonce and
+	// k=4, the false positive rate reaches about 2.5% at this point.
+	//
+	// This means the filter only remembers a window of about the last 4
+	// million nonces (nonceFilterBits/8), which is 16 GiB of file content at
+	// 4 KiB per block. It catches a random number generator that is stuck or
+	// cycles quickly, which is how they fail in practice, but not a repeat
+	// of a nonce from long ago. A filter for the lifetime of a mount would
+	// have to grow without bound.
+	nonceFilterShardCapacity = nonceFilterBits / 8 / nonceFilterShards
+	// A false positive in the filter only makes us draw another nonce. Only
+	// this many hits in a row, which is practically impossible with a
+	// working random number generator, make us give up.
+	nonceMaxRetries = 8
+	// Consecutive failed health tests on fresh random data before we give up
+	entropyMaxFailures = 3
+)
+
+// entropyFailures counts random data that failed entropyHealthy(). Global,
+// like the randPrefetcher.
+var entropyFailures uint64
+
+// NonceStats are the counters of the nonce health monitor. They are also
+// exported to "-metrics" as gocryptfs_nonce_*.
+type NonceStats struct {
+	// Nonces handed out
+	Generated uint64
+	// Nonces that were discarded because the filter had (probably) seen
+	// them before
+	FilterHits uint64
+	// How often a shard of the filter was full and has been cleared
+	FilterResets uint64
+	// Random data that failed the health test, for all mounts in this
+	// process
+	EntropyFailures uint64
+}
+
+// nonceFilterShard is one part of the nonceFilter, with its own lock.
+type nonceFilterShard struct {
+	sync.Mutex
+	bits  []uint64
+	count int
+}
+
+// nonceFilter is a Bloom filter of the nonces generated by one CryptoCore.
+// It detects a broken random number generator that repeats nonces within
+// the window described at nonceFilterShardCapacity. Bit positions are
+// derived from the nonce XORed with a per-mount random seed, so they cannot
+// be predicted across mounts.
+type nonceFilter struct {
+	seedOnce sync.Once
+	seed     [2]uint64
+	shards   [nonceFilterShards]nonceFilterShard
+	// Counters, accessed atomically
+	generated    uint64
+	filterHits   uint64
+	filterResets uint64
+}
+
+// seen checks if "nonce" is (probably) in the filter, adds it, and updates
+// the counters.
+func (f *nonceFilter) seen(nonce []byte) bool {
+	f.seedOnce.Do(func() {
+		f.seed = [2]uint64{RandUint64(), RandUint64()}
+	})
+	// Blocked Bloom filter: h1 selects a 512-bit block (one cache line),
+	// h2 the bits inside it. This is much faster than spreading the bits
+	// over the whole 4 MiB. Nonces are at least 12 bytes, so the two words
+	// overlap for 96-bit nonces, which is fine for random data.
+	h1 := binary.LittleEndian.Uint64(nonce) ^ f.seed[0]
+	h2 := binary.LittleEndian.Uint64(nonce[len(nonce)-8:]) ^ f.seed[1]
+	block := h1 % (nonceFilterBits / 512)
+	s := &f.shards[block%nonceFilterShards]
+	block = block / nonceFilterShards * 8
+	// Note: don't use defer, this is called for every block we write
+	s.Lock()
+	if s.bits == nil || s.count >= nonceFilterShardCapacity {
+		if s.bits != nil {
+			atomic.AddUint64(&f.filterResets, 1)
+			metrics.NonceFilterResets.Inc()
+		}
+		s.bits = make([]uint64, nonceFilterBits/nonceFilterShards/64)
+		s.count = 0
+	}
+	hit := true
+	for i := uint64(0); i < nonceFilterK; i++ {
+		bit := (h2 >> (9 * i)) % 512
+		word, mask := block+bit/64, uint64(1)<<(bit%64)
+		if s.bits[word]&mask == 0 {
+			hit = false
+			s.bits[word] |= mask
+		}
+	}
+	s.count++
+	s.Unlock()
+	if hit {
+		atomic.AddUint64(&f.filterHits, 1)
+		metrics.NonceFilterHits.Inc()
+	} else {
+		atomic.AddUint64(&f.generated, 1)
+		metrics.NoncesGenerated.Inc()
+	}
+	return hit
+}
+
+// Stats returns a copy of the counters.
+func (f *nonceFilter) Stats() NonceStats {
+	return NonceStats{
+		Generated:       atomic.LoadUint64(&f.generated),
+		FilterHits:      atomic.LoadUint64(&f.filterHits),
+		FilterResets:    atomic.LoadUint64(&f.filterResets),
+		EntropyFailures: atomic.LoadUint64(&entropyFailures),
+	}
+}
+
+// entropyHealthy runs a continuous random number generator test (like FIPS
+// 140-2 CRNGT) on "fresh" random data: it must not repeat "prev", and must
+// not consist of a single repeated byte.
+func entropyHealthy(fresh []byte, prev []byte) bool {
+	if bytes.Equal(fresh, prev) {
+		return false
+	}
+	return bytes.Count(fresh, fresh[:1]) != len(fresh)
+}
+
+// healthyRandBytes is like RandBytes, but retries when the random data fails
+// entropyHealthy(), and panics if that happens repeatedly.
+func healthyRandBytes(n int, prev []byte) []byte {
+	for i := 0; i < entropyMaxFailures; i++ {
+		fresh := RandBytes(n)
+		if entropyHealthy(fresh, prev) {
+			return fresh
+		}
+		atomic.AddUint64(&entropyFailures, 1)
+		metrics.RandHealthFailures.Inc()
+		tlog.Warn.Printf("randPrefetcher: random data failed the health test")
+	}
+	log.Panicf("randPrefetcher: random data failed the health test %d times in a row. The random number generator is broken!",
+		entropyMaxFailures)
+	return nil
+}
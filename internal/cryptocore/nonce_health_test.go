@@ -0,0 +1,84 @@
+package cryptocore
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestNonceFilter(t *testing.T) {
+	var f nonceFilter
+	const n = 100000
+	for i := 0; i < n; i++ {
+		f.seen(RandBytes(16))
+	}
+	s := f.Stats()
+	// False positive rate at 100k of 4M nonces is about 1e-8
+	if s.FilterHits > 0 || s.Generated != n {
+		t.Errorf("unexpected stats for random nonces: %+v", s)
+	}
+	// Repeated nonces must always be caught, for both nonce sizes
+	for _, l := range []int{12, 16} {
+		nonce := RandBytes(l)
+		if f.seen(nonce) {
+			t.Errorf("fresh %d-byte nonce reported as seen", l)
+		}
+		if !f.seen(nonce) {
+			t.Errorf("repeated %d-byte nonce not detected", l)
+		}
+	}
+}
+
+func TestNonceGeneratorStats(t *testing.T) {
+	g := nonceGenerator{nonceLen: 16}
+	for i := 0; i < 10; i++ {
+		if _, err := g.Get(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s := g.Stats(); s.Generated != 10 || s.FilterHits != 0 {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+}
+
+// A random number generator that is stuck must make Get fail, not panic
+func TestNonceGeneratorRepeat(t *testing.T) {
+	stuck := RandBytes(16)
+	g := nonceGenerator{
+		nonceLen: 16,
+		read:     func(n int) []byte { return append([]byte(nil), stuck...) },
+	}
+	if _, err := g.Get(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.Get(); err != ErrNonceRepeat {
+		t.Errorf("want ErrNonceRepeat, got %v", err)
+	}
+	if s := g.Stats(); s.Generated != 1 || s.FilterHits != nonceMaxRetries {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+}
+
+func TestEntropyHealthy(t *testing.T) {
+	a := RandBytes(prefetchN)
+	if !entropyHealthy(a, nil) {
+		t.Error("random data failed")
+	}
+	if entropyHealthy(a, a) {
+		t.Error("repeated data passed")
+	}
+	if entropyHealthy(make([]byte, prefetchN), nil) {
+		t.Error("all-zero data passed")
+	}
+	if entropyHealthy(bytes.Repeat([]byte{0xff}, prefetchN), nil) {
+		t.Error("all-0xff data passed")
+	}
+}
+
+func BenchmarkNonceGenerator(b *testing.B) {
+	g := nonceGenerator{nonceLen: 16}
+	g.Get()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		g.Get()
+	}
+}
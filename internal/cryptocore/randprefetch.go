@@ -47,8 +47,12 @@ func (r *randPrefetcherT) read(want int) (out []byte) {
 }
 
 func (r *randPrefetcherT) refillWorker() {
+	var prev []byte
 	for {
-		r.refill <- RandBytes(prefetchN)
+		fresh := healthyRandBytes(prefetchN, prev)
+		// Keep a copy, "fresh" is handed over to the reader
+		prev = append(prev[:0], fresh...)
+		r.refill <- fresh
 	}
 }
 
@@ -21,6 +21,18 @@ type Interface interface {
 	DecryptPath(string) (string, error)
 }
 
+// StatsInterface is implemented by backends that can answer Stats requests
+type StatsInterface interface {
+	Stats() *ctlsock.StatsStruct
+}
+
+// LockInterface is implemented by backends that can wipe their keys and
+// get them back from the password
+type LockInterface interface {
+	Lock()
+	Unlock(password []byte) error
+}
+
 type ctlSockHandler struct {
 	fs     Interface
 	socket *net.UnixListener
@@ -93,12 +105,27 @@ func (ch *ctlSockHandler) handleConnection(conn *net.UnixConn) {
 func (ch *ctlSockHandler) handleRequest(in *ctlsock.RequestStruct, conn *net.UnixConn) {
 	var err error
 	var inPath, outPath, clean, warnText string
-	// You cannot perform both decryption and encryption in one request
-	if in.DecryptPath != "" && in.EncryptPath != "" {
+	// You cannot perform both decryption and encryption, or anything else,
+	// in one request
+	n := 0
+	for _, set := range []bool{in.DecryptPath != "", in.EncryptPath != "", in.Stats, in.Lock, in.Unlock != ""} {
+		if set {
+			n++
+		}
+	}
+	if n > 1 {
 		err = errors.New("Ambiguous")
 		sendResponse(conn, err, "", "")
 		return
 	}
+	if in.Stats {
+		ch.handleStats(conn)
+		return
+	}
+	if in.Lock || in.Unlock != "" {
+		ch.handleLock(in, conn)
+		return
+	}
 	// Neither encryption nor encryption has been requested, makes no sense
 	if in.DecryptPath == "" && in.EncryptPath == "" {
 		err = errors.New("Empty input")
@@ -131,6 +158,38 @@ func (ch *ctlSockHandler) handleRequest(in *ctlsock.RequestStruct, conn *net.Uni
 	sendResponse(conn, err, outPath, warnText)
 }
 
+// handleStats answers a Stats request
+func (ch *ctlSockHandler) handleStats(conn *net.UnixConn) {
+	s, ok := ch.fs.(StatsInterface)
+	if !ok {
+		sendResponse(conn, syscall.ENOTSUP, "", "")
+		return
+	}
+	writeResponse(conn, ctlsock.ResponseStruct{Stats: s.Stats()})
+}
+
+// handleLock answers Lock and Unlock requests. The response to Lock is sent
+// when the keys are gone.
+func (ch *ctlSockHandler) handleLock(in *ctlsock.RequestStruct, conn *net.UnixConn) {
+	l, ok := ch.fs.(LockInterface)
+	if !ok {
+		sendResponse(conn, syscall.ENOTSUP, "", "")
+		return
+	}
+	if in.Lock {
+		l.Lock()
+		sendResponse(conn, nil, "", "")
+		return
+	}
+	// The string in "in" cannot be wiped, but at least our copy can
+	pw := []byte(in.Unlock)
+	err := l.Unlock(pw)
+	for i := range pw {
+		pw[i] = 0
+	}
+	sendResponse(conn, err, "", "")
+}
+
 // sendResponse sends a JSON response message
 func sendResponse(conn *net.UnixConn, err error, result string, warnText string) {
 	msg := ctlsock.ResponseStruct{
@@ -145,10 +204,15 @@ func sendResponse(conn *net.UnixConn, err error, result string, warnText string)
 			if se, ok := pe.Err.(syscall.Errno); ok {
 				msg.ErrNo = int32(se)
 			}
-		} else if err == syscall.ENOENT {
-			msg.ErrNo = int32(syscall.ENOENT)
+		} else if err == syscall.ENOENT || err == syscall.ENOTSUP || err == syscall.EACCES {
+			msg.ErrNo = int32(err.(syscall.Errno))
 		}
 	}
+	writeResponse(conn, msg)
+}
+
+// writeResponse encodes "msg" as JSON and sends it
+func writeResponse(conn *net.UnixConn, msg ctlsock.ResponseStruct) {
 	jsonMsg, err := json.Marshal(msg)
 	if err != nil {
 		tlog.Warn.Printf("ctlsock: Marshal failed: %v", err)
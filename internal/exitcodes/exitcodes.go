@@ -58,8 +58,8 @@ const (
 	OpenConf = 23
 	// WriteConf - could not write the gocryptfs.conf
 	WriteConf = 24
-	// Profiler - error occurred when trying to write cpu or memory profile or
-	// execution trace
+	// Profiler - error occurred when trying to write cpu or memory profile,
+	// execution trace or FUSE trace
 	Profiler = 25
 	// FsckErrors - the filesystem check found errors
 	FsckErrors = 26
@@ -72,6 +72,26 @@ const (
 	DevNull = 30
 	// FIDO2Error - an error was encountered while interacting with a FIDO2 token
 	FIDO2Error = 31
+	// Metrics - the "-metrics" HTTP address could not be listened on
+	Metrics = 32
+	// Audit - the "-audit" log or key could not be opened
+	Audit = 33
+	// Unmount - "-unmount" failed
+	Unmount = 34
+	// Setuid - "-setuid" could not switch to the user
+	Setuid = 35
+	// Migrate - "-migrate-encfs" or "-migrate-ecryptfs" could not move all files
+	Migrate = 36
+	// Archive - "-export" or "-import" failed
+	Archive = 37
+	// Trash - "-trash" failed
+	Trash = 38
+	// Snapshot - "-snapshot" failed
+	Snapshot = 39
+	// DirKey - "-dirkey" failed
+	DirKey = 40
+	// Lock - "-lock" or "-unlock" failed
+	Lock = 41
 )
 
 // Err wraps an error with an associated numeric exit code
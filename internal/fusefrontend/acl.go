@@ -0,0 +1,12 @@
+package fusefrontend
+
+// Names of the POSIX ACL xattrs
+const (
+	aclAccess  = "system.posix_acl_access"
+	aclDefault = "system.posix_acl_default"
+)
+
+// isAcl returns true if "attr" is one of the POSIX ACL xattrs.
+func isAcl(attr string) bool {
+	return attr == aclAccess || attr == aclDefault
+}
@@ -1,7 +1,12 @@
 package fusefrontend
 
 import (
+	"time"
+
 	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/audit"
+	"github.com/rfjakob/gocryptfs/internal/keylock"
 )
 
 // Args is a container for arguments that are passed from main() to fusefrontend
@@ -46,4 +51,62 @@ type Args struct {
 	Suid bool
 	// Enable the FUSE kernel_cache option
 	KernelCache bool
+	// UnlinkWipe overwrites the ciphertext of a file with random data before
+	// it is unlinked, "-unlink-wipe"
+	UnlinkWipe bool
+	// Shred is "-shred", UnlinkWipe for all ciphertext that is deleted,
+	// see shred.go
+	Shred bool
+	// Passthrough is a list of file name patterns. Matching files and
+	// directories (and everything below them) are stored unencrypted,
+	// "-passthrough"
+	Passthrough []string
+	// DeterministicNames disables gocryptfs.diriv files. All directories
+	// use an all-zero IV, "-deterministic-names".
+	DeterministicNames bool
+	// DirCacheSize is the number of directories openBackingDir() keeps
+	// open, "-dircache". Zero disables the cache.
+	DirCacheSize int
+	// ReadPipelineDepth is the number of chunks the read path may read ahead
+	// of decryption, "-read-pipeline". Zero reads and decrypts serially.
+	ReadPipelineDepth int
+	// Prefetch is the number of blocks to read and decrypt ahead of
+	// sequential reads, "-prefetch". Zero disables prefetching.
+	Prefetch int
+	// CaseInsensitive makes lookups match existing names regardless of
+	// case, "-case-insensitive". New names are stored as given.
+	CaseInsensitive bool
+	// SharedStorage is set if "-sharedstorage" was passed. Other machines
+	// may modify CIPHERDIR, so we cannot cache anything.
+	SharedStorage bool
+	// AttrTimeout is the attribute timeout we tell the kernel,
+	// "-attr_timeout". File.Getattr() caches attributes for as long.
+	AttrTimeout time.Duration
+	// XattrSidecar stores xattrs the backing filesystem refuses in an
+	// encrypted sidecar file next to the backing file, "-xattr-sidecar"
+	XattrSidecar bool
+	// Acl stores POSIX ACLs unencrypted on the backing files, where the
+	// kernel reads them to check permissions, "-acl"
+	Acl bool
+	// Sparse stores blocks of zeros as file holes, "-sparse"
+	Sparse bool
+	// ReadOnly rejects all modifications with EROFS, "-ro"
+	ReadOnly bool
+	// PlaintextSymlinks stores symlink targets unencrypted while file names
+	// stay encrypted. Set from the "PlaintextSymlinks" feature flag.
+	PlaintextSymlinks bool
+	// MerkleRoots keeps the Merkle root hash of each file up to date. Set
+	// from the "MerkleRoots" feature flag.
+	MerkleRoots bool
+	// Audit receives the file accesses, "-audit". nil if disabled.
+	Audit *audit.Log
+	// TrashRetention is how long Unlink and Rmdir keep entries in the
+	// trash, "-trash-retention". Zero deletes immediately.
+	TrashRetention time.Duration
+	// Quota is the maximum number of plaintext bytes stored, "-quota".
+	// Zero means no limit.
+	Quota int64
+	// KeyLock guards the keys for "-lock". Whatever uses them outside of a
+	// FUSE request, like the prefetcher, must Enter it.
+	KeyLock *keylock.KeyLock `json:"-"`
 }
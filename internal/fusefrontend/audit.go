@@ -0,0 +1,52 @@
+package fusefrontend
+
+import (
+	"context"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/audit"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// audit writes an event to the "-audit" log, if enabled. "name" is joined
+// to the path of "n", like for the FUSE calls that take a name. Call it
+// deferred, with a pointer to the result, so that it sees the final errno.
+func (n *Node) audit(ctx context.Context, op string, name string, flags uint32, errno *syscall.Errno) {
+	if n.rootNode().args.Audit == nil {
+		return
+	}
+	n.rootNode().writeAudit(ctx, audit.Event{
+		Op:    op,
+		Path:  filepath.Join(n.mountPath(), name),
+		Flags: flags,
+		Errno: int32(*errno),
+	})
+}
+
+// auditRename is audit() for Rename, which has a second path.
+func (n *Node) auditRename(ctx context.Context, name string, n2 *Node, newName string, errno *syscall.Errno) {
+	if n.rootNode().args.Audit == nil {
+		return
+	}
+	n.rootNode().writeAudit(ctx, audit.Event{
+		Op:      "rename",
+		Path:    filepath.Join(n.mountPath(), name),
+		NewPath: filepath.Join(n2.mountPath(), newName),
+		Errno:   int32(*errno),
+	})
+}
+
+// writeAudit adds the time and the caller to "e" and writes it to the log.
+func (rn *RootNode) writeAudit(ctx context.Context, e audit.Event) {
+	e.Time = time.Now()
+	if caller, ok := fuse.FromContext(ctx); ok {
+		e.Uid, e.Gid, e.Pid = caller.Uid, caller.Gid, caller.Pid
+	}
+	if err := rn.args.Audit.Write(e); err != nil {
+		tlog.Warn.Printf("audit: %v", err)
+	}
+}
@@ -0,0 +1,188 @@
+package fusefrontend
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"syscall"
+	"unicode"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+const (
+	// Maximum number of directories the foldCache keeps an index for
+	foldCacheSize = 100
+	// Maximum number of names in all indexes in the foldCache together
+	foldCacheMaxNames = 200000
+	// Directories with more entries than this are not indexed. resolveCase()
+	// scans them instead, which is slow, but does not need memory.
+	foldIndexMaxNames = 50000
+)
+
+// errFoldIndexTooBig is returned by foldIndexAt() for directories with more
+// than foldIndexMaxNames entries
+var errFoldIndexTooBig = errors.New("directory too big for the fold index")
+
+// foldName maps all names that only differ in case to the same string.
+// Every rune is replaced by the smallest rune of its Unicode case folding
+// orbit, so foldName(a) == foldName(b) exactly when strings.EqualFold(a, b).
+func foldName(name string) string {
+	return strings.Map(func(r rune) rune {
+		min := r
+		for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+			if f < min {
+				min = f
+			}
+		}
+		return min
+	}, name)
+}
+
+// foldIndex maps case-folded plaintext names to the actual plaintext names
+// in one directory.
+type foldIndex struct {
+	// mtime of the backing directory when the index was built. Every
+	// create, delete and rename in the directory changes it.
+	mtime unix.Timespec
+	names map[string]string
+}
+
+// foldCacheStruct keeps the foldIndex of recently used directories, keyed by
+// device and inode number of the backing directory.
+type foldCacheStruct struct {
+	sync.Mutex
+	dirs map[[2]uint64]*foldIndex
+	// Total number of names in "dirs"
+	names int
+}
+
+// resolveCase implements "-case-insensitive". It returns the name of the
+// existing entry in the backing directory "dirfd" that matches "name" up to
+// case. If the exact name exists, or nothing matches, "name" is returned
+// unchanged.
+func (rn *RootNode) resolveCase(dirfd int, iv []byte, name string) (string, error) {
+	cName, err := rn.nameTransform.EncryptAndHashName(name, iv)
+	if err != nil {
+		return "", err
+	}
+	var st unix.Stat_t
+	err = syscallcompat.Fstatat(dirfd, cName, &st, unix.AT_SYMLINK_NOFOLLOW)
+	if err != syscall.ENOENT {
+		// Exact match, or an error the caller will run into as well
+		return name, nil
+	}
+	folded := foldName(name)
+	names, err := rn.foldIndexAt(dirfd, iv)
+	if err == errFoldIndexTooBig {
+		match := name
+		err = rn.scanDirNames(dirfd, iv, func(n string) bool {
+			if foldName(n) == folded {
+				match = n
+				return false
+			}
+			return true
+		})
+		return match, err
+	} else if err != nil {
+		return "", err
+	}
+	if match, ok := names[folded]; ok {
+		return match, nil
+	}
+	return name, nil
+}
+
+// foldIndexAt returns the foldIndex names map of the backing directory
+// "dirfd", building it if it is not cached or out of date.
+func (rn *RootNode) foldIndexAt(dirfd int, iv []byte) (map[string]string, error) {
+	var st unix.Stat_t
+	if err := unix.Fstat(dirfd, &st); err != nil {
+		return nil, err
+	}
+	key := [2]uint64{uint64(st.Dev), uint64(st.Ino)}
+	rn.foldCache.Lock()
+	idx := rn.foldCache.dirs[key]
+	rn.foldCache.Unlock()
+	if idx != nil && idx.mtime == st.Mtim {
+		return idx.names, nil
+	}
+	names := make(map[string]string)
+	err := rn.scanDirNames(dirfd, iv, func(name string) bool {
+		names[foldName(name)] = name
+		return len(names) <= foldIndexMaxNames
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(names) > foldIndexMaxNames {
+		return nil, errFoldIndexTooBig
+	}
+	tlog.DebugNames.Printf("foldIndexAt: indexed %d names in dir ino %d", len(names), st.Ino)
+	c := &rn.foldCache
+	c.Lock()
+	if old := c.dirs[key]; old != nil {
+		c.names -= len(old.names)
+	}
+	if c.dirs == nil || len(c.dirs) >= foldCacheSize || c.names+len(names) > foldCacheMaxNames {
+		c.dirs = make(map[[2]uint64]*foldIndex)
+		c.names = 0
+	}
+	c.dirs[key] = &foldIndex{mtime: st.Mtim, names: names}
+	c.names += len(names)
+	c.Unlock()
+	return names, nil
+}
+
+// scanDirNames reads and decrypts the backing directory "dirfd", similar to
+// Readdir(), and calls "fn" for every plaintext name until it returns false.
+func (rn *RootNode) scanDirNames(dirfd int, iv []byte, fn func(name string) bool) error {
+	fd, err := syscallcompat.Openat(dirfd, ".", syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	r := syscallcompat.NewDirReader(fd)
+	for {
+		entries, err := r.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			cName := e.Name
+			if cName == nametransform.DirIVFilename || nametransform.IsXattrSidecar(cName) {
+				continue
+			}
+			if rn.args.LongNames {
+				switch nametransform.NameType(cName) {
+				case nametransform.LongNameFilename:
+					continue
+				case nametransform.LongNameContent:
+					cName, err = nametransform.ReadLongNameAt(fd, cName)
+					if err != nil {
+						continue
+					}
+				}
+			}
+			name, err := rn.nameTransform.DecryptName(cName, iv)
+			if err != nil {
+				if !rn.isPassthroughName(cName) {
+					// Corrupt names are reported by Readdir(), and
+					// gocryptfs.conf ends up here as well.
+					continue
+				}
+				name = cName
+			}
+			if !fn(name) {
+				return nil
+			}
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package fusefrontend
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFoldName(t *testing.T) {
+	names := []string{"foo", "FOO", "Foo", "straße", "STRASSE", "Ä", "ä", "K", "K", "σ", "Σ", "ς"}
+	for _, a := range names {
+		for _, b := range names {
+			want := strings.EqualFold(a, b)
+			have := foldName(a) == foldName(b)
+			if want != have {
+				t.Errorf("%q %q: EqualFold=%v, but foldName equal=%v", a, b, want, have)
+			}
+		}
+	}
+}
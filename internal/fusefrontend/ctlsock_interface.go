@@ -6,19 +6,29 @@ import (
 	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 
+	"github.com/rfjakob/gocryptfs/ctlsock"
 	"github.com/rfjakob/gocryptfs/internal/ctlsocksrv"
+	"github.com/rfjakob/gocryptfs/internal/metrics"
 	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
 	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
 var _ ctlsocksrv.Interface = &RootNode{} // Verify that interface is implemented.
+var _ ctlsocksrv.StatsInterface = &RootNode{}
+var _ ctlsocksrv.LockInterface = &RootNode{}
 
 // EncryptPath implements ctlsock.Backend
 //
 // Symlink-safe through openBackingDir().
 func (rn *RootNode) EncryptPath(plainPath string) (string, error) {
+	if !rn.args.KeyLock.Enter() {
+		return "", syscall.EACCES
+	}
+	defer rn.args.KeyLock.Exit()
 	if plainPath == "" {
 		// Empty string gets encrypted as empty string
 		return plainPath, nil
@@ -26,6 +36,16 @@ func (rn *RootNode) EncryptPath(plainPath string) (string, error) {
 	if rn.args.PlaintextNames {
 		return plainPath, nil
 	}
+	if first, rest := splitFirst(plainPath); rest != "" && rn.subtrees != nil {
+		cFirst, err := rn.EncryptPath(first)
+		if err != nil {
+			return "", err
+		}
+		if sub, _ := rn.subtreeOf(cFirst); sub != nil {
+			cRest, err := sub.EncryptPath(rest)
+			return filepath.Join(cFirst, cRest), err
+		}
+	}
 	// Encrypt path level by level using openBackingDir. Pretty inefficient,
 	// but does not matter here.
 	parts := strings.Split(plainPath, "/")
@@ -40,7 +60,7 @@ func (rn *RootNode) EncryptPath(plainPath string) (string, error) {
 		syscall.Close(dirfd)
 		cPath = filepath.Join(cPath, cName)
 	}
-	tlog.Debug.Printf("encryptPath '%s' -> '%s'", plainPath, cPath)
+	tlog.DebugNames.Printf("encryptPath '%s' -> '%s'", plainPath, cPath)
 	return cPath, nil
 }
 
@@ -49,6 +69,19 @@ func (rn *RootNode) EncryptPath(plainPath string) (string, error) {
 // DecryptPath is symlink-safe because openBackingDir() and decryptPathAt()
 // are symlink-safe.
 func (rn *RootNode) DecryptPath(cipherPath string) (plainPath string, err error) {
+	if !rn.args.KeyLock.Enter() {
+		return "", syscall.EACCES
+	}
+	defer rn.args.KeyLock.Exit()
+	if sub, cRest := rn.subtreeOf(cipherPath); sub != nil && cRest != "" {
+		cFirst, _ := splitFirst(cipherPath)
+		pFirst, err := rn.DecryptPath(cFirst)
+		if err != nil {
+			return "", err
+		}
+		pRest, err := sub.DecryptPath(cRest)
+		return filepath.Join(pFirst, pRest), err
+	}
 	dirfd, _, err := rn.openBackingDir("")
 	if err != nil {
 		return "", err
@@ -57,6 +90,34 @@ func (rn *RootNode) DecryptPath(cipherPath string) (plainPath string, err error)
 	return rn.decryptPathAt(dirfd, cipherPath)
 }
 
+// Stats implements ctlsocksrv.StatsInterface
+func (rn *RootNode) Stats() *ctlsock.StatsStruct {
+	entries, size := rn.dirCache.Len()
+	return &ctlsock.StatsStruct{
+		Seconds:                time.Since(rn.startTime).Seconds(),
+		OpenFiles:              openfiletable.Count(),
+		DirCacheEntries:        entries,
+		DirCacheSize:           size,
+		DirCacheLookups:        metrics.DirCacheLookups.Value(),
+		DirCacheHits:           metrics.DirCacheHits.Value(),
+		BytesRead:              metrics.BytesRead.Value(),
+		BytesWritten:           metrics.BytesWritten.Value(),
+		ContentDecryptFailures: metrics.ContentDecryptFailures.Value(),
+		NameDecryptFailures:    metrics.NameDecryptFailures.Value(),
+	}
+}
+
+// Lock implements ctlsocksrv.LockInterface
+func (rn *RootNode) Lock() {
+	rn.args.KeyLock.Lock()
+	rn.args.KeyLock.Wait()
+}
+
+// Unlock implements ctlsocksrv.LockInterface
+func (rn *RootNode) Unlock(password []byte) error {
+	return rn.args.KeyLock.Unlock(password)
+}
+
 // decryptPathAt decrypts a ciphertext path relative to dirfd.
 //
 // Symlink-safe through ReadDirIVAt() and ReadLongNameAt().
@@ -66,25 +127,20 @@ func (rn *RootNode) decryptPathAt(dirfd int, cipherPath string) (plainPath strin
 	}
 	parts := strings.Split(cipherPath, "/")
 	wd := dirfd
+	passthrough := false
 	for i, part := range parts {
-		dirIV, err := nametransform.ReadDirIVAt(wd)
-		if err != nil {
-			fmt.Printf("ReadDirIV: %v\n", err)
-			return "", err
-		}
-		longPart := part
-		if nametransform.IsLongContent(part) {
-			longPart, err = nametransform.ReadLongNameAt(wd, part)
+		// Everything below a "-passthrough" directory is unencrypted
+		name := part
+		if !passthrough {
+			name, err = rn.decryptPart(wd, part)
+			if err != nil && rn.isPassthroughName(part) {
+				name, err = part, nil
+				passthrough = true
+			}
 			if err != nil {
-				fmt.Printf("ReadLongName: %v\n", err)
 				return "", err
 			}
 		}
-		name, err := rn.nameTransform.DecryptName(longPart, dirIV)
-		if err != nil {
-			fmt.Printf("DecryptName: %v\n", err)
-			return "", err
-		}
 		plainPath = path.Join(plainPath, name)
 		// Last path component? We are done.
 		if i == len(parts)-1 {
@@ -103,3 +159,26 @@ func (rn *RootNode) decryptPathAt(dirfd int, cipherPath string) (plainPath strin
 
 	return plainPath, nil
 }
+
+// decryptPart decrypts the ciphertext name "part" in directory "dirfd".
+func (rn *RootNode) decryptPart(dirfd int, part string) (name string, err error) {
+	dirIV, err := rn.readDirIVAt(dirfd)
+	if err != nil {
+		fmt.Printf("ReadDirIV: %v\n", err)
+		return "", err
+	}
+	longPart := part
+	if nametransform.IsLongContent(part) {
+		longPart, err = nametransform.ReadLongNameAt(dirfd, part)
+		if err != nil {
+			fmt.Printf("ReadLongName: %v\n", err)
+			return "", err
+		}
+	}
+	name, err = rn.nameTransform.DecryptName(longPart, dirIV)
+	if err != nil {
+		fmt.Printf("DecryptName: %v\n", err)
+		return "", err
+	}
+	return name, nil
+}
@@ -0,0 +1,128 @@
+package fusefrontend
+
+import (
+	"io"
+	"path/filepath"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+)
+
+// dirStream implements fs.DirStream. It reads the backing directory one
+// getdents batch at a time and decrypts the names of each batch when the
+// kernel asks for them, so listing a directory with millions of entries only
+// needs memory for one batch. go-fuse keeps the stream across READDIR calls
+// on the same directory handle and closes it on RELEASEDIR.
+type dirStream struct {
+	rn *RootNode
+	// The directory that is being read
+	node *Node
+	// Open backing directory, -1 after Close()
+	fd       int
+	r        *syscallcompat.DirReader
+	cDirName string
+	// DirIV of the directory, nil for plaintext names
+	iv []byte
+	// isRoot is set for the root directory, which contains gocryptfs.conf
+	isRoot bool
+	// plain is set if names are not encrypted (plaintextnames or
+	// "-passthrough")
+	plain bool
+	// Decrypted entries of the current batch that have not been returned yet
+	batch []fuse.DirEntry
+	// Ciphertext names of the entries in "batch", "" for names that are
+	// not encrypted
+	cNames []string
+	// Error reading the next batch, returned by the next Next() call
+	errno syscall.Errno
+	eof   bool
+}
+
+var _ fs.DirStream = &dirStream{} // Verify that interface is implemented.
+
+// HasNext reads batches until it finds one that has entries left after
+// filtering, or hits the end of the directory.
+func (ds *dirStream) HasNext() bool {
+	for len(ds.batch) == 0 && ds.errno == 0 && !ds.eof {
+		entries, err := ds.r.Next()
+		if err == io.EOF {
+			ds.eof = true
+		} else if err != nil {
+			ds.errno = fs.ToErrno(err)
+		} else {
+			ds.batch, ds.cNames = ds.decryptDirEntries(entries)
+		}
+	}
+	return len(ds.batch) > 0 || ds.errno != 0
+}
+
+// Next returns the next entry. Only called if HasNext() returned true.
+func (ds *dirStream) Next() (fuse.DirEntry, syscall.Errno) {
+	if ds.errno != 0 {
+		errno := ds.errno
+		ds.errno = 0
+		ds.eof = true
+		return fuse.DirEntry{}, errno
+	}
+	e := ds.batch[0]
+	cName := ds.cNames[0]
+	ds.batch = ds.batch[1:]
+	ds.cNames = ds.cNames[1:]
+	if cName != "" {
+		ds.node.readdirMu.Lock()
+		ds.node.readdirHint = readdirHint{name: e.Name, cName: cName}
+		ds.node.readdirMu.Unlock()
+	}
+	return e, 0
+}
+
+// Close closes the backing directory.
+func (ds *dirStream) Close() {
+	if ds.fd >= 0 {
+		syscall.Close(ds.fd)
+		ds.fd = -1
+	}
+	ds.batch = nil
+	ds.cNames = nil
+	ds.eof = true
+}
+
+// readdirHint is a directory entry that Readdir has returned
+type readdirHint struct {
+	// Plaintext name
+	name string
+	// Ciphertext name, as stored on disk. Hashed for long names.
+	cName string
+}
+
+// readdirLookup returns the directory fd and the ciphertext name of the
+// child "name" without encrypting the name, if it is the entry that Readdir
+// has returned last. This is the case for every entry of a READDIRPLUS, where
+// go-fuse calls Lookup() for each entry to return its attributes as well.
+// "ok" is false otherwise, or if the directory fd is not in the dirCache.
+//
+// The hint is used only once, so it cannot go stale.
+func (n *Node) readdirLookup(name string) (dirfd int, cName string, ok bool) {
+	n.readdirMu.Lock()
+	h := n.readdirHint
+	if h.name == name {
+		n.readdirHint = readdirHint{}
+	}
+	n.readdirMu.Unlock()
+	if h.name != name || h.cName == "" {
+		return -1, "", false
+	}
+	rn := n.rootNode()
+	p := n.Path()
+	if rn.isFiltered(filepath.Join(p, name)) {
+		return -1, "", false
+	}
+	dirfd, _ = rn.dirCache.Lookup(rn.dirCacheKey(p))
+	if dirfd <= 0 {
+		return -1, "", false
+	}
+	return dirfd, h.cName, true
+}
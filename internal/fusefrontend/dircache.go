@@ -1,26 +1,37 @@
 package fusefrontend
 
 import (
+	"container/list"
 	"fmt"
 	"log"
+	"runtime/debug"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/rfjakob/gocryptfs/internal/mempressure"
+	"github.com/rfjakob/gocryptfs/internal/metrics"
 	"github.com/rfjakob/gocryptfs/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
 const (
-	// Number of entries in the dirCache.
+	// Default number of entries in the dirCache, "-dircache".
 	// 20 entries work well for "git stat" on a small git repo on sshfs.
 	// Keep in sync with test_helpers.maxCacheFds !
 	// TODO: How to share this constant without causing an import cycle?
-	dirCacheSize = 20
-	// Enable Lookup/Store/Clear debug messages
+	DirCacheSizeDefault = 20
+	// Enable Lookup/Store/Invalidate debug messages
 	enableDebugMessages = false
 	// Enable hit rate statistics printing
 	enableStats = false
+	// How often the memory pressure is checked. Matches the averaging window
+	// of the "avg10" PSI value we look at.
+	pressureInterval = 10 * time.Second
+	// Shrink the cache when tasks were stalled waiting for memory during
+	// more than this percentage of the last 10 seconds.
+	pressureHigh = 10.0
 
 	pathFmt = "%-40q"
 )
@@ -35,8 +46,6 @@ type dirCacheEntryStruct struct {
 }
 
 func (e *dirCacheEntryStruct) Clear() {
-	// An earlier clear may have already closed the fd, or the cache
-	// has never been filled (fd is 0 in that case).
 	// Note: package ensurefds012, imported from main, guarantees that dirCache
 	// can never get fds 0,1,2.
 	if e.fd > 0 {
@@ -50,13 +59,27 @@ func (e *dirCacheEntryStruct) Clear() {
 	e.iv = nil
 }
 
+// dirCacheStruct is a least-recently-used cache of directory fds and their
+// DirIVs, keyed by the relative plaintext path of the directory. It saves
+// openBackingDir() from walking the whole path and reading a gocryptfs.diriv
+// file at every level.
 type dirCacheStruct struct {
 	sync.Mutex
-	// Cache entries
-	entries [dirCacheSize]dirCacheEntryStruct
-	// Where to store the next entry (index into entries)
-	nextIndex int
-	// On the first Lookup(), the expire thread is started, and this flag is set
+	// Configured maximum number of entries ("-dircache"). Zero disables the
+	// cache.
+	maxSize int
+	// Current maximum number of entries. Lowered below maxSize under memory
+	// pressure, see adapt().
+	size int
+	// Cache entries, most recently used first. Element values are
+	// *dirCacheEntryStruct.
+	lru *list.List
+	// index maps dirRelPath to the list element
+	index map[string]*list.Element
+	// generation is incremented on every Invalidate(). Store() drops entries
+	// that were looked up before an invalidation, as they may be stale.
+	generation uint64
+	// On the first Store(), the expire thread is started, and this flag is set
 	// to true.
 	expireThreadRunning bool
 	// Hit rate stats. Evaluated and reset by the expire thread.
@@ -64,47 +87,107 @@ type dirCacheStruct struct {
 	hits    uint64
 }
 
+// newDirCache returns a dirCache that holds up to "size" entries.
+func newDirCache(size int) *dirCacheStruct {
+	return &dirCacheStruct{
+		maxSize: size,
+		size:    size,
+		lru:     list.New(),
+		index:   make(map[string]*list.Element),
+	}
+}
+
 // Clear clears the cache contents.
 func (d *dirCacheStruct) Clear() {
 	d.dbg("Clear\n")
 	d.Lock()
 	defer d.Unlock()
-	for i := range d.entries {
-		d.entries[i].Clear()
+	for d.lru.Len() > 0 {
+		d.remove(d.lru.Back())
+	}
+}
+
+// remove deletes the element "el" and closes its fd. Caller must hold the lock.
+func (d *dirCacheStruct) remove(el *list.Element) {
+	e := d.lru.Remove(el).(*dirCacheEntryStruct)
+	delete(d.index, e.dirRelPath)
+	e.Clear()
+}
+
+// Invalidate removes "dirRelPath" and everything below it from the cache.
+// Call it when a directory is renamed or deleted.
+func (d *dirCacheStruct) Invalidate(dirRelPath string) {
+	d.dbg("Invalidate "+pathFmt+"\n", dirRelPath)
+	d.Lock()
+	defer d.Unlock()
+	d.generation++
+	prefix := dirRelPath + "/"
+	var next *list.Element
+	for el := d.lru.Front(); el != nil; el = next {
+		next = el.Next()
+		p := el.Value.(*dirCacheEntryStruct).dirRelPath
+		if dirRelPath == "" || p == dirRelPath || strings.HasPrefix(p, prefix) {
+			d.remove(el)
+		}
 	}
 }
 
+// Generation returns the current generation. Pass it to Store().
+func (d *dirCacheStruct) Generation() uint64 {
+	d.Lock()
+	defer d.Unlock()
+	return d.generation
+}
+
 // Store the entry in the cache. The passed "fd" will be Dup()ed, and the caller
-// can close their copy at will.
-func (d *dirCacheStruct) Store(dirRelPath string, fd int, iv []byte) {
+// can close their copy at will. "generation" is the value Generation()
+// returned before the caller started opening the directory.
+func (d *dirCacheStruct) Store(dirRelPath string, fd int, iv []byte, generation uint64) {
 	// Note: package ensurefds012, imported from main, guarantees that dirCache
 	// can never get fds 0,1,2.
 	if fd <= 0 || len(iv) != nametransform.DirIVLen {
 		log.Panicf("Store sanity check failed: fd=%d len=%d", fd, len(iv))
 	}
+	if d.maxSize == 0 {
+		return
+	}
 	d.Lock()
 	defer d.Unlock()
-	e := &d.entries[d.nextIndex]
-	// Round-robin works well enough
-	d.nextIndex = (d.nextIndex + 1) % dirCacheSize
-	// Close the old fd
-	e.Clear()
+	// expireThread and pressureThread are started on the first Store()
+	if !d.expireThreadRunning {
+		d.expireThreadRunning = true
+		go d.expireThread()
+		go d.pressureThread()
+	}
+	if d.size == 0 || generation != d.generation {
+		// Shrunk to zero under memory pressure, or something was renamed or
+		// deleted in the meantime
+		return
+	}
+	if el, ok := d.index[dirRelPath]; ok {
+		d.lru.MoveToFront(el)
+		return
+	}
 	fd2, err := syscall.Dup(fd)
 	if err != nil {
 		tlog.Warn.Printf("dirCache.Store: Dup failed: %v", err)
 		return
 	}
 	d.dbg("Store  "+pathFmt+" fd=%d iv=%x\n", dirRelPath, fd2, iv)
-	e.fd = fd2
-	e.dirRelPath = dirRelPath
-	e.iv = iv
-	// expireThread is started on the first Lookup()
-	if !d.expireThreadRunning {
-		d.expireThreadRunning = true
-		go d.expireThread()
+	e := &dirCacheEntryStruct{dirRelPath: dirRelPath, fd: fd2, iv: iv}
+	d.index[dirRelPath] = d.lru.PushFront(e)
+	if d.lru.Len() > d.size {
+		d.remove(d.lru.Back())
 	}
 }
 
+// Len returns the number of entries and the current maximum size.
+func (d *dirCacheStruct) Len() (entries int, size int) {
+	d.Lock()
+	defer d.Unlock()
+	return d.lru.Len(), d.size
+}
+
 // Lookup checks if relPath is in the cache, and returns an (fd, iv) pair.
 // It returns (-1, nil) if not found. The fd is internally Dup()ed and the
 // caller must close it when done.
@@ -114,41 +197,61 @@ func (d *dirCacheStruct) Lookup(dirRelPath string) (fd int, iv []byte) {
 	if enableStats {
 		d.lookups++
 	}
-	var e *dirCacheEntryStruct
-	for i := range d.entries {
-		e = &d.entries[i]
-		if e.fd <= 0 {
-			// Cache slot is empty
-			continue
-		}
-		if dirRelPath != e.dirRelPath {
-			// Not the right path
-			continue
-		}
-		var err error
-		fd, err = syscall.Dup(e.fd)
-		if err != nil {
-			tlog.Warn.Printf("dirCache.Lookup: Dup failed: %v", err)
-			return -1, nil
-		}
-		iv = e.iv
-		break
-	}
-	if fd == 0 {
+	metrics.DirCacheLookups.Inc()
+	el, ok := d.index[dirRelPath]
+	if !ok {
 		d.dbg("Lookup "+pathFmt+" miss\n", dirRelPath)
 		return -1, nil
 	}
+	e := el.Value.(*dirCacheEntryStruct)
+	fd, err := syscall.Dup(e.fd)
+	if err != nil {
+		tlog.Warn.Printf("dirCache.Lookup: Dup failed: %v", err)
+		return -1, nil
+	}
+	d.lru.MoveToFront(el)
 	if enableStats {
 		d.hits++
 	}
-	if fd <= 0 || len(iv) != nametransform.DirIVLen {
-		log.Panicf("Lookup sanity check failed: fd=%d len=%d", fd, len(iv))
+	metrics.DirCacheHits.Inc()
+	d.dbg("Lookup "+pathFmt+" hit fd=%d dup=%d iv=%x\n", dirRelPath, e.fd, fd, e.iv)
+	return fd, e.iv
+}
+
+// LookupAncestor is like Lookup, but returns the deepest directory above
+// "dirRelPath" that is in the cache. "depth" is its number of path
+// components, 0 for the root directory. It returns (-1, nil, 0) if no
+// ancestor is cached.
+func (d *dirCacheStruct) LookupAncestor(dirRelPath string) (fd int, iv []byte, depth int) {
+	d.Lock()
+	defer d.Unlock()
+	metrics.DirCacheLookups.Inc()
+	for dirRelPath != "" {
+		dirRelPath = nametransform.Dir(dirRelPath)
+		el, ok := d.index[dirRelPath]
+		if !ok {
+			continue
+		}
+		e := el.Value.(*dirCacheEntryStruct)
+		fd, err := syscall.Dup(e.fd)
+		if err != nil {
+			tlog.Warn.Printf("dirCache.LookupAncestor: Dup failed: %v", err)
+			return -1, nil, 0
+		}
+		d.lru.MoveToFront(el)
+		metrics.DirCacheHits.Inc()
+		if dirRelPath != "" {
+			depth = strings.Count(dirRelPath, "/") + 1
+		}
+		d.dbg("LookupAncestor "+pathFmt+" hit fd=%d dup=%d iv=%x\n", dirRelPath, e.fd, fd, e.iv)
+		return fd, e.iv, depth
 	}
-	d.dbg("Lookup "+pathFmt+" hit fd=%d dup=%d iv=%x\n", dirRelPath, e.fd, fd, iv)
-	return fd, iv
+	return -1, nil, 0
 }
 
-// expireThread is started on the first Lookup()
+// expireThread is started on the first Store(). It clears the cache
+// periodically so that changes to CIPHERDIR made behind our back are
+// picked up eventually.
 func (d *dirCacheStruct) expireThread() {
 	for {
 		time.Sleep(60 * time.Second)
@@ -167,6 +270,58 @@ func (d *dirCacheStruct) expireThread() {
 	}
 }
 
+// pressureThread is started on the first Store(). It periodically reads the
+// memory pressure and resizes the cache accordingly. It exits if the kernel
+// does not provide pressure information.
+func (d *dirCacheStruct) pressureThread() {
+	path, err := mempressure.Path()
+	if err != nil {
+		tlog.DebugCache.Printf("dirCache: memory pressure information not available: %v", err)
+		return
+	}
+	tlog.DebugCache.Printf("dirCache: watching memory pressure in %q", path)
+	for {
+		time.Sleep(pressureInterval)
+		avg10, err := mempressure.Read(path)
+		if err != nil {
+			tlog.Warn.Printf("dirCache: reading memory pressure failed: %v", err)
+			return
+		}
+		d.adapt(avg10)
+	}
+}
+
+// adapt halves the cache size when the memory pressure "avg10" (percent, as
+// reported by PSI) is high, and doubles it back up to maxSize once there has
+// been no pressure at all for 10 seconds. Under pressure, it also returns
+// free memory, like our block buffer pools, to the operating system.
+func (d *dirCacheStruct) adapt(avg10 float64) {
+	d.Lock()
+	oldSize := d.size
+	if avg10 >= pressureHigh {
+		d.size /= 2
+		for d.lru.Len() > d.size {
+			d.remove(d.lru.Back())
+		}
+	} else if avg10 == 0 && d.size < d.maxSize {
+		d.size *= 2
+		if d.size == 0 {
+			d.size = 1
+		}
+		if d.size > d.maxSize {
+			d.size = d.maxSize
+		}
+	}
+	newSize := d.size
+	d.Unlock()
+	if newSize != oldSize {
+		tlog.DebugCache.Printf("dirCache: memory pressure %.2f%%, size %d -> %d", avg10, oldSize, newSize)
+	}
+	if avg10 >= pressureHigh {
+		debug.FreeOSMemory()
+	}
+}
+
 // dbg prints a debug message. Usually disabled.
 func (d *dirCacheStruct) dbg(format string, a ...interface{}) {
 	if enableDebugMessages {
@@ -0,0 +1,149 @@
+package fusefrontend
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+)
+
+func testDirCacheLookup(t *testing.T, d *dirCacheStruct, dirRelPath string, wantHit bool) {
+	t.Helper()
+	fd, _ := d.Lookup(dirRelPath)
+	if fd > 0 {
+		syscall.Close(fd)
+	}
+	if (fd > 0) != wantHit {
+		t.Errorf("Lookup(%q): want hit=%v, have fd=%d", dirRelPath, wantHit, fd)
+	}
+}
+
+func TestDirCacheLRU(t *testing.T) {
+	fd, err := syscall.Open(".", syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fd)
+	iv := make([]byte, nametransform.DirIVLen)
+
+	d := newDirCache(2)
+	d.Store("a", fd, iv, d.Generation())
+	d.Store("b", fd, iv, d.Generation())
+	// Touch "a" so that "b" is the least recently used entry
+	testDirCacheLookup(t, d, "a", true)
+	d.Store("c", fd, iv, d.Generation())
+	testDirCacheLookup(t, d, "b", false)
+	testDirCacheLookup(t, d, "a", true)
+	testDirCacheLookup(t, d, "c", true)
+	d.Clear()
+	testDirCacheLookup(t, d, "a", false)
+}
+
+func TestDirCacheInvalidate(t *testing.T) {
+	fd, err := syscall.Open(".", syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fd)
+	iv := make([]byte, nametransform.DirIVLen)
+
+	d := newDirCache(10)
+	for _, p := range []string{"a", "a/b", "a/b/c", "ab", "x"} {
+		d.Store(p, fd, iv, d.Generation())
+	}
+	d.Invalidate("a")
+	testDirCacheLookup(t, d, "a", false)
+	testDirCacheLookup(t, d, "a/b", false)
+	testDirCacheLookup(t, d, "a/b/c", false)
+	testDirCacheLookup(t, d, "ab", true)
+	testDirCacheLookup(t, d, "x", true)
+	// A Store() that started before the Invalidate() must be dropped
+	gen := d.Generation()
+	d.Invalidate("y")
+	d.Store("z", fd, iv, gen)
+	testDirCacheLookup(t, d, "z", false)
+	d.Clear()
+}
+
+func TestDirCacheDisabled(t *testing.T) {
+	fd, err := syscall.Open(".", syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fd)
+	d := newDirCache(0)
+	d.Store("a", fd, make([]byte, nametransform.DirIVLen), d.Generation())
+	testDirCacheLookup(t, d, "a", false)
+}
+
+func TestDirCacheAdapt(t *testing.T) {
+	fd, err := syscall.Open(".", syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fd)
+	iv := make([]byte, nametransform.DirIVLen)
+
+	d := newDirCache(4)
+	for _, p := range []string{"a", "b", "c", "d"} {
+		d.Store(p, fd, iv, d.Generation())
+	}
+	// High pressure evicts the least recently used entries
+	d.adapt(50)
+	if d.size != 2 {
+		t.Errorf("want size 2, have %d", d.size)
+	}
+	testDirCacheLookup(t, d, "a", false)
+	testDirCacheLookup(t, d, "d", true)
+	d.adapt(50)
+	d.adapt(50)
+	if d.size != 0 {
+		t.Errorf("want size 0, have %d", d.size)
+	}
+	d.Store("a", fd, iv, d.Generation())
+	testDirCacheLookup(t, d, "a", false)
+	// Moderate pressure keeps the size
+	d.adapt(1)
+	if d.size != 0 {
+		t.Errorf("want size 0, have %d", d.size)
+	}
+	// No pressure grows the cache back to the configured size
+	for i := 0; i < 5; i++ {
+		d.adapt(0)
+	}
+	if d.size != 4 {
+		t.Errorf("want size 4, have %d", d.size)
+	}
+	d.Clear()
+}
+
+func TestDirCacheLookupAncestor(t *testing.T) {
+	fd, err := syscall.Open(".", syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fd)
+	iv := make([]byte, nametransform.DirIVLen)
+
+	d := newDirCache(10)
+	testAncestor := func(dirRelPath string, wantDepth int) {
+		t.Helper()
+		fd, _, depth := d.LookupAncestor(dirRelPath)
+		if fd > 0 {
+			syscall.Close(fd)
+		}
+		if wantDepth < 0 && fd > 0 || wantDepth >= 0 && (fd <= 0 || depth != wantDepth) {
+			t.Errorf("LookupAncestor(%q): want depth %d, have fd=%d depth=%d",
+				dirRelPath, wantDepth, fd, depth)
+		}
+	}
+	testAncestor("a/b/c", -1)
+	d.Store("", fd, iv, d.Generation())
+	testAncestor("a/b/c", 0)
+	d.Store("a/b", fd, iv, d.Generation())
+	testAncestor("a/b/c/d", 2)
+	// Only the directories above count
+	testAncestor("a/b", 0)
+	d.Invalidate("a")
+	testAncestor("a/b/c", 0)
+}
@@ -18,6 +18,7 @@ import (
 
 	"github.com/rfjakob/gocryptfs/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/internal/inomap"
+	"github.com/rfjakob/gocryptfs/internal/metrics"
 	"github.com/rfjakob/gocryptfs/internal/openfiletable"
 	"github.com/rfjakob/gocryptfs/internal/serialize_reads"
 	"github.com/rfjakob/gocryptfs/internal/stupidgcm"
@@ -51,12 +52,19 @@ type File struct {
 	lastOpCount uint64
 	// Parent filesystem
 	rootNode *RootNode
+	// Read-ahead state for "-prefetch"
+	prefetch prefetchState
 }
 
 // NewFile returns a new go-fuse File instance.
 func NewFile(fd *os.File, rn *RootNode, st *syscall.Stat_t) *File {
 	qi := inomap.QInoFromStat(st)
-	e := openfiletable.Register(qi)
+	idStat := st
+	if rn.args.SharedStorage {
+		// Other machines may replace the file behind our back
+		idStat = nil
+	}
+	e := openfiletable.Register(qi, idStat)
 
 	return &File{
 		fd:             fd,
@@ -114,6 +122,7 @@ func (f *File) createHeader() (fileID []byte, err error) {
 		}
 	}
 	// Actually write header
+	f.merkleInvalidate(0, contentenc.HeaderLen)
 	_, err = f.fd.WriteAt(buf, 0)
 	if err != nil {
 		return nil, err
@@ -153,6 +162,7 @@ func (f *File) doRead(dst []byte, off uint64, length uint64) ([]byte, syscall.Er
 			hexdump := hex.EncodeToString(buf)
 			tlog.Warn.Printf("doRead %d: corrupt header: %v\nFile hexdump (%d bytes): %s",
 				f.qIno.Ino, err, n, hexdump)
+			metrics.ContentDecryptFailures.Inc()
 			return nil, syscall.EIO
 		}
 		// Save into the file table
@@ -162,34 +172,40 @@ func (f *File) doRead(dst []byte, off uint64, length uint64) ([]byte, syscall.Er
 	if fileID == nil {
 		log.Panicf("fileID=%v", fileID)
 	}
-	// Read the backing ciphertext in one go
+	// Find the backing ciphertext blocks
 	blocks := f.contentEnc.ExplodePlainRange(off, length)
 	alignedOffset, alignedLength := blocks[0].JointCiphertextRange(blocks)
 	skip := blocks[0].Skip
-	tlog.Debug.Printf("doRead: off=%d len=%d -> off=%d len=%d skip=%d\n",
+	tlog.DebugContent.Printf("doRead: off=%d len=%d -> off=%d len=%d skip=%d\n",
 		off, length, alignedOffset, alignedLength, skip)
 
 	ciphertext := f.rootNode.contentEnc.CReqPool.Get()
 	ciphertext = ciphertext[:int(alignedLength)]
-	n, err := f.fd.ReadAt(ciphertext, int64(alignedOffset))
-	if err != nil && err != io.EOF {
-		tlog.Warn.Printf("read: ReadAt: %s", err.Error())
-		return nil, fs.ToErrno(err)
-	}
-	// The ReadAt came back empty. We can skip all the decryption and return early.
-	if n == 0 {
-		f.rootNode.contentEnc.CReqPool.Put(ciphertext)
-		return dst, 0
-	}
-	// Truncate ciphertext buffer down to actually read bytes
-	ciphertext = ciphertext[0:n]
-
 	firstBlockNo := blocks[0].BlockNo
-	tlog.Debug.Printf("ReadAt offset=%d bytes (%d blocks), want=%d, got=%d", alignedOffset, firstBlockNo, alignedLength, n)
 
-	// Decrypt it
-	plaintext, err := f.contentEnc.DecryptBlocks(ciphertext, firstBlockNo, fileID)
+	// Read and decrypt it
+	var plaintext []byte
+	var n int
+	var readErr, err error
+	if f.rootNode.args.ReadPipelineDepth > 0 && len(blocks) > readPipelineChunk {
+		plaintext, n, readErr, err = f.readDecryptPipelined(ciphertext, int64(alignedOffset), firstBlockNo, fileID)
+	} else {
+		plaintext, n, readErr, err = f.readDecrypt(ciphertext, int64(alignedOffset), firstBlockNo, fileID)
+	}
 	f.rootNode.contentEnc.CReqPool.Put(ciphertext)
+	if readErr != nil || n == 0 {
+		if plaintext != nil {
+			f.rootNode.contentEnc.PReqPool.Put(plaintext)
+		}
+		if readErr != nil {
+			tlog.Warn.Printf("read: ReadAt: %s", readErr.Error())
+			return nil, fs.ToErrno(readErr)
+		}
+		// The ReadAt came back empty
+		return dst, 0
+	}
+	tlog.DebugContent.Printf("ReadAt offset=%d bytes (%d blocks), want=%d, got=%d", alignedOffset, firstBlockNo, alignedLength, n)
+
 	if err != nil {
 		if f.rootNode.args.ForceDecode && err == stupidgcm.ErrAuth {
 			// We do not have the information which block was corrupt here anymore,
@@ -220,6 +236,32 @@ func (f *File) doRead(dst []byte, off uint64, length uint64) ([]byte, syscall.Er
 	return out, 0
 }
 
+// readDecrypt is the serial version of readDecryptPipelined(): it reads
+// "ciphertext" from disk in one go and then decrypts it.
+func (f *File) readDecrypt(ciphertext []byte, alignedOffset int64, firstBlockNo uint64,
+	fileID []byte) (plaintext []byte, n int, readErr error, decryptErr error) {
+	n, readErr = f.readCiphertext(ciphertext, alignedOffset)
+	if readErr == io.EOF {
+		readErr = nil
+	}
+	if readErr != nil || n == 0 {
+		return nil, n, readErr, nil
+	}
+	plaintext, decryptErr = f.contentEnc.DecryptBlocks(ciphertext[:n], firstBlockNo, fileID)
+	return plaintext, n, nil, decryptErr
+}
+
+// readCiphertext reads the backing file at "off" into "buf". With
+// "-serialize_reads", it waits until it is its turn. Only the read itself is
+// serialized, decryption happens in parallel.
+func (f *File) readCiphertext(buf []byte, off int64) (int, error) {
+	if f.rootNode.args.SerializeReads {
+		serialize_reads.Wait(off, len(buf))
+		defer serialize_reads.Done()
+	}
+	return f.fd.ReadAt(buf, off)
+}
+
 // Read - FUSE call
 func (f *File) Read(ctx context.Context, buf []byte, off int64) (resultData fuse.ReadResult, errno syscall.Errno) {
 	if len(buf) > fuse.MAX_KERNEL_WRITE {
@@ -227,24 +269,34 @@ func (f *File) Read(ctx context.Context, buf []byte, off int64) (resultData fuse
 		tlog.Warn.Printf("Read: rejecting oversized request with EMSGSIZE, len=%d", len(buf))
 		return nil, syscall.EMSGSIZE
 	}
+	var prefetched *prefetchBuf
+	if f.rootNode.args.Prefetch > 0 {
+		// Must happen before we take the locks, see prefetchWait()
+		prefetched = f.prefetchWait(uint64(off), uint64(len(buf)))
+	}
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
 
 	f.fileTableEntry.ContentLock.RLock()
 	defer f.fileTableEntry.ContentLock.RUnlock()
 
-	tlog.Debug.Printf("ino%d: FUSE Read: offset=%d length=%d", f.qIno.Ino, off, len(buf))
-	if f.rootNode.args.SerializeReads {
-		serialize_reads.Wait(off, len(buf))
+	tlog.DebugContent.Printf("ino%d: FUSE Read: offset=%d length=%d", f.qIno.Ino, off, len(buf))
+	var out []byte
+	var ok bool
+	if prefetched != nil {
+		out, ok = prefetched.get(uint64(off), uint64(len(buf)))
 	}
-	out, errno := f.doRead(buf[:0], uint64(off), uint64(len(buf)))
-	if f.rootNode.args.SerializeReads {
-		serialize_reads.Done()
+	if !ok {
+		out, errno = f.doRead(buf[:0], uint64(off), uint64(len(buf)))
+		if errno != 0 {
+			return nil, errno
+		}
 	}
-	if errno != 0 {
-		return nil, errno
+	if f.rootNode.args.Prefetch > 0 {
+		f.prefetchNext(uint64(off), uint64(len(buf)))
 	}
-	tlog.Debug.Printf("ino%d: Read: errno=%d, returning %d bytes", f.qIno.Ino, errno, len(out))
+	tlog.DebugContent.Printf("ino%d: Read: errno=%d, returning %d bytes", f.qIno.Ino, errno, len(out))
+	metrics.BytesRead.Add(uint64(len(out)))
 	return fuse.ReadResultData(out), errno
 }
 
@@ -295,18 +347,37 @@ func (f *File) doWrite(data []byte, off int64) (uint32, syscall.Errno) {
 			}
 			// Modify
 			blockData = f.contentEnc.MergeBlocks(oldData, blockData, int(b.Skip))
-			tlog.Debug.Printf("len(oldData)=%d len(blockData)=%d", len(oldData), len(blockData))
+			tlog.DebugContent.Printf("len(oldData)=%d len(blockData)=%d", len(oldData), len(blockData))
 		}
-		tlog.Debug.Printf("ino%d: Writing %d bytes to block #%d",
+		tlog.DebugContent.Printf("ino%d: Writing %d bytes to block #%d",
 			f.qIno.Ino, len(blockData), b.BlockNo)
 		// Write into the to-encrypt list
 		toEncrypt[i] = blockData
 	}
 	// Encrypt all blocks
-	ciphertext := f.contentEnc.EncryptBlocks(toEncrypt, blocks[0].BlockNo, f.fileTableEntry.ID)
+	ciphertext, err := f.contentEnc.EncryptBlocks(toEncrypt, blocks[0].BlockNo, f.fileTableEntry.ID)
+	if err != nil {
+		tlog.Warn.Printf("ino%d fh%d: doWrite: %v", f.qIno.Ino, f.intFd(), err)
+		return 0, syscall.EIO
+	}
+	// With -sparse, blocks of zeros are written as all-zero ciphertext, which
+	// reads back as zeros, and turned into file holes after the write.
+	var zeroBlocks []int
+	if f.rootNode.args.Sparse {
+		cBS := int(f.contentEnc.CipherBS())
+		for i := range toEncrypt {
+			if !f.contentEnc.IsZeroBlock(toEncrypt[i]) {
+				continue
+			}
+			c := ciphertext[i*cBS : (i+1)*cBS]
+			for j := range c {
+				c[j] = 0
+			}
+			zeroBlocks = append(zeroBlocks, i)
+		}
+	}
 	// Preallocate so we cannot run out of space in the middle of the write.
 	// This prevents partially written (=corrupt) blocks.
-	var err error
 	cOff := int64(blocks[0].BlockCipherOff())
 	if !f.rootNode.args.NoPrealloc {
 		err = syscallcompat.EnospcPrealloc(f.intFd(), cOff, int64(len(ciphertext)))
@@ -317,6 +388,7 @@ func (f *File) doWrite(data []byte, off int64) (uint32, syscall.Errno) {
 			if fileWasEmpty {
 				// Kill the file header again
 				f.fileTableEntry.ID = nil
+				f.merkleInvalidateFrom(0)
 				err2 := syscall.Ftruncate(f.intFd(), 0)
 				if err2 != nil {
 					tlog.Warn.Printf("ino%d fh%d: doWrite: rollback failed: %v", f.qIno.Ino, f.intFd(), err2)
@@ -326,14 +398,21 @@ func (f *File) doWrite(data []byte, off int64) (uint32, syscall.Errno) {
 		}
 	}
 	// Write
+	f.merkleInvalidate(cOff, int64(len(ciphertext)))
 	_, err = f.fd.WriteAt(ciphertext, cOff)
 	// Return memory to CReqPool
 	f.rootNode.contentEnc.CReqPool.Put(ciphertext)
 	if err != nil {
 		tlog.Warn.Printf("ino%d fh%d: doWrite: WriteAt off=%d len=%d failed: %v",
 			f.qIno.Ino, f.intFd(), cOff, len(ciphertext), err)
+		// We don't know how much has been written
+		f.fileTableEntry.InvalidateAttr()
 		return 0, fs.ToErrno(err)
 	}
+	if len(zeroBlocks) > 0 {
+		f.punchZeroBlocks(cOff, zeroBlocks)
+	}
+	f.fileTableEntry.AttrWritten(uint64(off) + uint64(len(data)))
 	return uint32(len(data)), 0
 }
 
@@ -356,6 +435,9 @@ func (f *File) Write(ctx context.Context, data []byte, off int64) (uint32, sysca
 		tlog.Warn.Printf("Write: rejecting oversized request with EMSGSIZE, len=%d", len(data))
 		return 0, syscall.EMSGSIZE
 	}
+	if errno := f.rootNode.checkWritable(); errno != 0 {
+		return 0, errno
+	}
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
 	if f.released {
@@ -365,21 +447,30 @@ func (f *File) Write(ctx context.Context, data []byte, off int64) (uint32, sysca
 	}
 	f.fileTableEntry.ContentLock.Lock()
 	defer f.fileTableEntry.ContentLock.Unlock()
-	tlog.Debug.Printf("ino%d: FUSE Write: offset=%d length=%d", f.qIno.Ino, off, len(data))
+	tlog.DebugContent.Printf("ino%d: FUSE Write: offset=%d length=%d", f.qIno.Ino, off, len(data))
+	// Reserve the quota first, zero-padding a hole grows the file, too
+	end := uint64(off) + uint64(len(data))
+	before, errno := f.quotaGrow(end)
+	if errno != 0 {
+		return 0, errno
+	}
 	// If the write creates a file hole, we have to zero-pad the last block.
 	// But if the write directly follows an earlier write, it cannot create a
 	// hole, and we can save one Stat() call.
 	if !f.isConsecutiveWrite(off) {
 		errno := f.writePadHole(off)
 		if errno != 0 {
+			f.quotaSettle(before, end)
 			return 0, errno
 		}
 	}
 	n, errno := f.doWrite(data, off)
 	if errno != 0 {
+		f.quotaSettle(before, end)
 		f.lastOpCount = openfiletable.WriteOpCount()
 		f.lastWrittenOffset = off + int64(len(data)) - 1
 	}
+	metrics.BytesWritten.Add(uint64(n))
 	return n, errno
 }
 
@@ -390,6 +481,11 @@ func (f *File) Release(ctx context.Context) syscall.Errno {
 		log.Panicf("ino%d fh%d: double release", f.qIno.Ino, f.intFd())
 	}
 	f.released = true
+	if f.rootNode.args.MerkleRoots {
+		f.fileTableEntry.ContentLock.Lock()
+		f.merkleSync()
+		f.fileTableEntry.ContentLock.Unlock()
+	}
 	openfiletable.Unregister(f.qIno)
 	err := f.fd.Close()
 	f.fdLock.Unlock()
@@ -401,6 +497,11 @@ func (f *File) Flush(ctx context.Context) syscall.Errno {
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
 
+	if f.rootNode.args.MerkleRoots {
+		f.fileTableEntry.ContentLock.Lock()
+		f.merkleSync()
+		f.fileTableEntry.ContentLock.Unlock()
+	}
 	err := syscallcompat.Flush(f.intFd())
 	return fs.ToErrno(err)
 }
@@ -410,23 +511,49 @@ func (f *File) Fsync(ctx context.Context, flags uint32) (errno syscall.Errno) {
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
 
+	if f.rootNode.args.MerkleRoots {
+		f.fileTableEntry.ContentLock.Lock()
+		f.merkleSync()
+		f.fileTableEntry.ContentLock.Unlock()
+	}
 	return fs.ToErrno(syscall.Fsync(f.intFd()))
 }
 
+// cachedAttr returns the attributes from the open file table, unless they
+// are older than the attribute timeout or caching is disabled by
+// "-sharedstorage". Writes through this mount keep the cached size exact,
+// so the timeout only bounds staleness of changes made through other paths,
+// like the link count.
+//
+// go-fuse serves a stat() through any open file handle of the inode, so
+// with "-attr_timeout=0" this must not cache either.
+func (f *File) cachedAttr() (fuse.Attr, bool) {
+	if f.rootNode.args.SharedStorage || f.rootNode.args.AttrTimeout <= 0 {
+		return fuse.Attr{}, false
+	}
+	return f.fileTableEntry.CachedAttr(f.rootNode.args.AttrTimeout)
+}
+
 // Getattr FUSE call (like stat)
 func (f *File) Getattr(ctx context.Context, a *fuse.AttrOut) syscall.Errno {
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
 
 	tlog.Debug.Printf("file.GetAttr()")
-	st := syscall.Stat_t{}
-	err := syscall.Fstat(f.intFd(), &st)
-	if err != nil {
-		return fs.ToErrno(err)
+	if attr, ok := f.cachedAttr(); ok {
+		a.Attr = attr
+	} else {
+		gen := f.fileTableEntry.AttrGeneration()
+		st := syscall.Stat_t{}
+		err := syscall.Fstat(f.intFd(), &st)
+		if err != nil {
+			return fs.ToErrno(err)
+		}
+		f.rootNode.inoMap.TranslateStat(&st)
+		a.FromStat(&st)
+		a.Size = f.contentEnc.CipherSizeToPlainSize(a.Size)
+		f.fileTableEntry.StoreAttr(&a.Attr, gen)
 	}
-	f.rootNode.inoMap.TranslateStat(&st)
-	a.FromStat(&st)
-	a.Size = f.contentEnc.CipherSizeToPlainSize(a.Size)
 	if f.rootNode.args.ForceOwner != nil {
 		a.Owner = *f.rootNode.args.ForceOwner
 	}
@@ -10,6 +10,7 @@ import (
 	"syscall"
 
 	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
 
 	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
@@ -21,6 +22,13 @@ const FALLOC_DEFAULT = 0x00
 // FALLOC_FL_KEEP_SIZE allocates disk space while not modifying the file size
 const FALLOC_FL_KEEP_SIZE = 0x01
 
+// FALLOC_FL_PUNCH_HOLE deallocates a range. Only valid together with
+// FALLOC_FL_KEEP_SIZE.
+const FALLOC_FL_PUNCH_HOLE = 0x02
+
+// FALLOC_FL_ZERO_RANGE zeroes a range and allocates disk space for it
+const FALLOC_FL_ZERO_RANGE = 0x10
+
 // Only warn once
 var allocateWarnOnce sync.Once
 
@@ -36,15 +44,26 @@ var allocateWarnOnce sync.Once
 // This allows us to reuse the file grow mechanics from Truncate as they are
 // complicated and hard to get right.
 //
-// Other modes (hole punching, zeroing) are not supported.
+// mode=FALLOC_FL_PUNCH_HOLE|FALLOC_FL_KEEP_SIZE is implemented by zeroRange.
+// FALLOC_FL_ZERO_RANGE runs zeroRange first and then proceeds like
+// FALLOC_DEFAULT or FALLOC_FL_KEEP_SIZE.
+//
+// Other modes (collapsing and inserting ranges) are not supported.
 func (f *File) Allocate(ctx context.Context, off uint64, sz uint64, mode uint32) syscall.Errno {
-	if mode != FALLOC_DEFAULT && mode != FALLOC_FL_KEEP_SIZE {
+	switch mode {
+	case FALLOC_DEFAULT, FALLOC_FL_KEEP_SIZE,
+		FALLOC_FL_PUNCH_HOLE | FALLOC_FL_KEEP_SIZE,
+		FALLOC_FL_ZERO_RANGE, FALLOC_FL_ZERO_RANGE | FALLOC_FL_KEEP_SIZE:
+	default:
 		f := func() {
-			tlog.Info.Printf("fallocate: only mode 0 (default) and 1 (keep size) are supported")
+			tlog.Info.Printf("fallocate: mode %#x is not supported", mode)
 		}
 		allocateWarnOnce.Do(f)
 		return syscall.EOPNOTSUPP
 	}
+	if errno := f.rootNode.checkWritable(); errno != 0 {
+		return errno
+	}
 
 	f.fdLock.RLock()
 	defer f.fdLock.RUnlock()
@@ -53,6 +72,22 @@ func (f *File) Allocate(ctx context.Context, off uint64, sz uint64, mode uint32)
 	}
 	f.fileTableEntry.ContentLock.Lock()
 	defer f.fileTableEntry.ContentLock.Unlock()
+	// Runs last, when the file has its final size
+	defer f.fileTableEntry.InvalidateAttr()
+
+	if mode&(FALLOC_FL_PUNCH_HOLE|FALLOC_FL_ZERO_RANGE) != 0 {
+		errno := f.zeroRange(off, sz, mode&FALLOC_FL_ZERO_RANGE != 0)
+		if errno != 0 || mode&FALLOC_FL_PUNCH_HOLE != 0 {
+			return errno
+		}
+	}
+	if mode&FALLOC_FL_KEEP_SIZE == 0 {
+		before, errno := f.quotaGrow(off + sz)
+		if errno != 0 {
+			return errno
+		}
+		defer f.quotaSettle(before, off+sz)
+	}
 
 	blocks := f.contentEnc.ExplodePlainRange(off, sz)
 	firstBlock := blocks[0]
@@ -65,12 +100,12 @@ func (f *File) Allocate(ctx context.Context, off uint64, sz uint64, mode uint32)
 	cipherSz := lastBlock.BlockCipherOff() - cipherOff +
 		f.contentEnc.BlockOverhead() + lastBlock.Skip + lastBlock.Length
 	err := syscallcompat.Fallocate(f.intFd(), FALLOC_FL_KEEP_SIZE, int64(cipherOff), int64(cipherSz))
-	tlog.Debug.Printf("Allocate off=%d sz=%d mode=%x cipherOff=%d cipherSz=%d\n",
+	tlog.DebugContent.Printf("Allocate off=%d sz=%d mode=%x cipherOff=%d cipherSz=%d\n",
 		off, sz, mode, cipherOff, cipherSz)
 	if err != nil {
 		return fs.ToErrno(err)
 	}
-	if mode == FALLOC_FL_KEEP_SIZE {
+	if mode&FALLOC_FL_KEEP_SIZE != 0 {
 		// The user did not want to change the apparent size. We are done.
 		return 0
 	}
@@ -92,11 +127,113 @@ func (f *File) Allocate(ctx context.Context, off uint64, sz uint64, mode uint32)
 	return f.truncateGrowFile(oldPlainSz, newPlainSz)
 }
 
+// punchHole is syscallcompat.PunchHole. Tests replace it to simulate a backing
+// filesystem that cannot punch holes.
+var punchHole = syscallcompat.PunchHole
+
+// zeroRange makes the plaintext range "off" to "off+sz" read as zeros,
+// without changing the file size. Blocks that are completely inside the range
+// become file holes, which read back as zeros. The partial blocks at the edges
+// are overwritten with zeros.
+//
+// If the backing filesystem cannot punch holes and "writeFallback" is set
+// (FALLOC_FL_ZERO_RANGE), the full blocks are overwritten with encrypted
+// zeros instead, like a write of zeros would do.
+//
+// The caller must hold ContentLock.
+func (f *File) zeroRange(off uint64, sz uint64, writeFallback bool) syscall.Errno {
+	plainSz, err := f.statPlainSize()
+	if err != nil {
+		return fs.ToErrno(err)
+	}
+	if off >= plainSz {
+		return 0
+	}
+	end := off + sz
+	if end > plainSz {
+		end = plainSz
+	}
+	ce := f.contentEnc
+	bs := ce.PlainBS()
+	// Blocks firstFull to lastFull-1 are completely inside the range. The
+	// last block of the file is partial unless the size is block-aligned,
+	// and is not included because "end" is capped to the file size.
+	firstFull := (off + bs - 1) / bs
+	lastFull := end / bs
+	headEnd := off
+	if firstFull < lastFull {
+		cOff := ce.BlockNoToCipherOff(firstFull)
+		cLen := ce.BlockNoToCipherOff(lastFull) - cOff
+		tlog.DebugContent.Printf("ino%d: zeroRange: punching cipherOff=%d cipherLen=%d", f.qIno.Ino, cOff, cLen)
+		f.merkleInvalidate(int64(cOff), int64(cLen))
+		err = punchHole(f.intFd(), int64(cOff), int64(cLen))
+		if err == syscall.EOPNOTSUPP && writeFallback {
+			tlog.DebugContent.Printf("ino%d: zeroRange: cannot punch holes, writing zeros", f.qIno.Ino)
+			errno := f.writeZeros(ce.BlockNoToPlainOff(firstFull), ce.BlockNoToPlainOff(lastFull))
+			if errno != 0 {
+				return errno
+			}
+		} else if err != nil {
+			return fs.ToErrno(err)
+		}
+		headEnd = ce.BlockNoToPlainOff(firstFull)
+	} else {
+		headEnd = end
+	}
+	// Zero the partial block at the start of the range, or the whole range if
+	// it does not contain a full block
+	if headEnd > off {
+		if _, errno := f.doWrite(make([]byte, headEnd-off), int64(off)); errno != 0 {
+			return errno
+		}
+	}
+	// Zero the partial block at the end of the range
+	tailStart := ce.BlockNoToPlainOff(lastFull)
+	if tailStart < headEnd {
+		tailStart = headEnd
+	}
+	if tailStart < end {
+		if _, errno := f.doWrite(make([]byte, end-tailStart), int64(tailStart)); errno != 0 {
+			return errno
+		}
+	}
+	return 0
+}
+
+// writeZeros overwrites the plaintext range "off" to "end" with zeros, in
+// pieces that fit into a FUSE write request.
+//
+// The caller must hold ContentLock.
+func (f *File) writeZeros(off uint64, end uint64) syscall.Errno {
+	zeros := make([]byte, fuse.MAX_KERNEL_WRITE)
+	for off < end {
+		n := end - off
+		if n > uint64(len(zeros)) {
+			n = uint64(len(zeros))
+		}
+		if _, errno := f.doWrite(zeros[:n], int64(off)); errno != 0 {
+			return errno
+		}
+		off += n
+	}
+	return 0
+}
+
 // truncate - called from Setattr.
 func (f *File) truncate(newSize uint64) (errno syscall.Errno) {
 	var err error
+	// Runs last, when the file has its final size
+	defer f.fileTableEntry.InvalidateAttr()
+	before, errno := f.quotaGrow(newSize)
+	if errno != 0 {
+		return errno
+	}
+	// Also frees the quota if the file shrinks
+	defer f.quotaSettle(before, newSize)
 	// Common case first: Truncate to zero
 	if newSize == 0 {
+		f.merkleInvalidateFrom(0)
+		f.shredFrom(0)
 		err = syscall.Ftruncate(int(f.fd.Fd()), 0)
 		if err != nil {
 			tlog.Warn.Printf("ino%d fh%d: Ftruncate(fd, 0) returned error: %v", f.qIno.Ino, f.intFd(), err)
@@ -115,7 +252,7 @@ func (f *File) truncate(newSize uint64) (errno syscall.Errno) {
 
 	oldB := float32(oldSize) / float32(f.contentEnc.PlainBS())
 	newB := float32(newSize) / float32(f.contentEnc.PlainBS())
-	tlog.Debug.Printf("ino%d: FUSE Truncate from %.2f to %.2f blocks (%d to %d bytes)", f.qIno.Ino, oldB, newB, oldSize, newSize)
+	tlog.DebugContent.Printf("ino%d: FUSE Truncate from %.2f to %.2f blocks (%d to %d bytes)", f.qIno.Ino, oldB, newB, oldSize, newSize)
 
 	// File size stays the same - nothing to do
 	if newSize == oldSize {
@@ -140,6 +277,8 @@ func (f *File) truncate(newSize uint64) (errno syscall.Errno) {
 		}
 	}
 	// Truncate down to the last complete block
+	f.merkleInvalidateFrom(int64(cipherOff))
+	f.shredFrom(cipherOff)
 	err = syscall.Ftruncate(int(f.fd.Fd()), int64(cipherOff))
 	if err != nil {
 		tlog.Warn.Printf("Truncate: shrink Ftruncate returned error: %v", err)
@@ -153,8 +292,12 @@ func (f *File) truncate(newSize uint64) (errno syscall.Errno) {
 	return 0
 }
 
-// statPlainSize stats the file and returns the plaintext size
+// statPlainSize returns the plaintext size from the open file table, or
+// stats the file if it is not cached.
 func (f *File) statPlainSize() (uint64, error) {
+	if attr, ok := f.cachedAttr(); ok {
+		return attr.Size, nil
+	}
 	fi, err := f.fd.Stat()
 	if err != nil {
 		tlog.Warn.Printf("ino%d fh%d: statPlainSize: %v", f.qIno.Ino, f.intFd(), err)
@@ -204,6 +347,7 @@ func (f *File) truncateGrowFile(oldPlainSz uint64, newPlainSz uint64) syscall.Er
 			f.fileTableEntry.ID = id
 		}
 		cSz := int64(f.contentEnc.PlainSizeToCipherSize(newPlainSz))
+		f.merkleInvalidateFrom(int64(f.contentEnc.PlainSizeToCipherSize(oldPlainSz)))
 		err := syscall.Ftruncate(f.intFd(), cSz)
 		if err != nil {
 			tlog.Warn.Printf("Truncate: grow Ftruncate returned error: %v", err)
@@ -0,0 +1,57 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"context"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// TestZeroRangeNoPunch checks that FALLOC_FL_ZERO_RANGE works when the
+// backing filesystem cannot punch holes, and that FALLOC_FL_PUNCH_HOLE
+// reports that it cannot.
+func TestZeroRangeNoPunch(t *testing.T) {
+	punchHole = func(fd int, off int64, len int64) error {
+		return syscall.EOPNOTSUPP
+	}
+	defer func() { punchHole = syscallcompat.PunchHole }()
+
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir})
+	ctx := context.Background()
+	_, fh, _, errno := fs.Create(ctx, "file", syscall.O_RDWR, 0600, &fuse.EntryOut{})
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	f := fh.(*File)
+	defer f.Release(ctx)
+	want := bytes.Repeat([]byte{0xff}, 10*4096+100)
+	if _, errno = f.Write(ctx, want, 0); errno != 0 {
+		t.Fatal(errno)
+	}
+	// Partial blocks at both ends, full blocks in between
+	off, sz := 1000, 6*4096
+	if errno = f.Allocate(ctx, uint64(off), uint64(sz), FALLOC_FL_ZERO_RANGE|FALLOC_FL_KEEP_SIZE); errno != 0 {
+		t.Fatal(errno)
+	}
+	for i := off; i < off+sz; i++ {
+		want[i] = 0
+	}
+	buf := make([]byte, len(want))
+	res, errno := f.Read(ctx, buf, 0)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	have, _ := res.Bytes(buf)
+	if !bytes.Equal(have, want) {
+		t.Error("wrong content after FALLOC_FL_ZERO_RANGE")
+	}
+	if errno = f.Allocate(ctx, uint64(off), uint64(sz), FALLOC_FL_PUNCH_HOLE|FALLOC_FL_KEEP_SIZE); errno != syscall.EOPNOTSUPP {
+		t.Errorf("FALLOC_FL_PUNCH_HOLE: want EOPNOTSUPP, have %v", errno)
+	}
+}
@@ -8,6 +8,7 @@ import (
 
 	"github.com/hanwen/go-fuse/v2/fs"
 
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
@@ -15,12 +16,10 @@ import (
 // ciphertext? If yes, zero-pad the last ciphertext block.
 func (f *File) writePadHole(targetOff int64) syscall.Errno {
 	// Get the current file size.
-	fi, err := f.fd.Stat()
+	plainSize, err := f.statPlainSize()
 	if err != nil {
-		tlog.Warn.Printf("checkAndPadHole: Fstat failed: %v", err)
 		return fs.ToErrno(err)
 	}
-	plainSize := f.contentEnc.CipherSizeToPlainSize(uint64(fi.Size()))
 	// Appending a single byte to the file (equivalent to writing to
 	// offset=plainSize) would write to "nextBlock".
 	nextBlock := f.contentEnc.PlainOffToBlockNo(plainSize)
@@ -51,18 +50,106 @@ func (f *File) zeroPad(plainSize uint64) syscall.Errno {
 	}
 	missing := f.contentEnc.PlainBS() - lastBlockLen
 	pad := make([]byte, missing)
-	tlog.Debug.Printf("zeroPad: Writing %d bytes\n", missing)
+	tlog.DebugContent.Printf("zeroPad: Writing %d bytes\n", missing)
 	_, errno := f.doWrite(pad, int64(plainSize))
 	return errno
 }
 
-// Lseek - FUSE call.
+// punchZeroBlocks implements "-sparse". doWrite() has just written the blocks
+// "idx", counted from ciphertext offset "cOff", as all-zero ciphertext. Turn
+// them into file holes. Failing to do so is harmless, an all-zero ciphertext
+// block reads back as zeros either way.
+func (f *File) punchZeroBlocks(cOff int64, idx []int) {
+	cBS := int64(f.contentEnc.CipherBS())
+	for i := 0; i < len(idx); {
+		// Punch runs of consecutive blocks with one call
+		j := i + 1
+		for j < len(idx) && idx[j] == idx[j-1]+1 {
+			j++
+		}
+		off := cOff + int64(idx[i])*cBS
+		err := syscallcompat.PunchHole(f.intFd(), off, int64(j-i)*cBS)
+		if err != nil {
+			tlog.DebugContent.Printf("ino%d fh%d: punchZeroBlocks: off=%d: %v", f.qIno.Ino, f.intFd(), off, err)
+			return
+		}
+		i = j
+	}
+}
+
+// Lseek - FUSE call. Implements SEEK_DATA and SEEK_HOLE.
+//
+// The backing filesystem finds holes at its own block size, which does not
+// line up with our ciphertext blocks. A block counts as data if any part of
+// it is data, so SEEK_DATA rounds down to the block start, and SEEK_HOLE
+// looks for the first block that is a hole in its entirety.
 func (f *File) Lseek(ctx context.Context, off uint64, whence uint32) (uint64, syscall.Errno) {
-	cipherOff := f.rootNode.contentEnc.PlainSizeToCipherSize(off)
-	newCipherOff, err := syscall.Seek(f.intFd(), int64(cipherOff), int(whence))
+	if whence != syscallcompat.SEEK_DATA && whence != syscallcompat.SEEK_HOLE {
+		// The kernel handles everything else itself
+		return 0, syscall.EINVAL
+	}
+	f.fdLock.RLock()
+	defer f.fdLock.RUnlock()
+	plainSize, err := f.statPlainSize()
+	if err != nil {
+		return 0, fs.ToErrno(err)
+	}
+	if off >= plainSize {
+		return 0, syscall.ENXIO
+	}
+	ce := f.contentEnc
+	blockNo := ce.PlainOffToBlockNo(off)
+	if whence == syscallcompat.SEEK_DATA {
+		var cOff int64
+		cOff, err = syscall.Seek(f.intFd(), int64(ce.BlockNoToCipherOff(blockNo)), syscallcompat.SEEK_DATA)
+		if err == nil {
+			blockNo = ce.CipherOffToBlockNo(uint64(cOff))
+		}
+	} else {
+		blockNo, err = f.seekHoleBlock(blockNo)
+	}
 	if err != nil {
 		return 0, fs.ToErrno(err)
 	}
-	newOff := f.contentEnc.CipherSizeToPlainSize(uint64(newCipherOff))
+	newOff := ce.BlockNoToPlainOff(blockNo)
+	if newOff < off {
+		newOff = off
+	}
+	if newOff > plainSize {
+		newOff = plainSize
+	}
 	return newOff, 0
 }
+
+// seekHoleBlock returns the number of the first block, starting at
+// "blockNo", that is a hole in the backing file from start to end. Blocks at
+// or after the end of the file count as holes.
+func (f *File) seekHoleBlock(blockNo uint64) (uint64, error) {
+	ce := f.contentEnc
+	fd := f.intFd()
+	cOff := int64(ce.BlockNoToCipherOff(blockNo))
+	for {
+		hole, err := syscall.Seek(fd, cOff, syscallcompat.SEEK_HOLE)
+		if err != nil {
+			return 0, err
+		}
+		// Round up to the next block boundary
+		blockNo = ce.CipherOffToBlockNo(uint64(hole))
+		if int64(ce.BlockNoToCipherOff(blockNo)) != hole {
+			blockNo++
+		}
+		// Does the hole extend to the end of the block?
+		start := int64(ce.BlockNoToCipherOff(blockNo))
+		data, err := syscall.Seek(fd, start, syscallcompat.SEEK_DATA)
+		if err == syscall.ENXIO {
+			// No data after "start", or "start" is after the end of the file
+			return blockNo, nil
+		} else if err != nil {
+			return 0, err
+		}
+		if data >= start+int64(ce.CipherBS()) {
+			return blockNo, nil
+		}
+		cOff = data
+	}
+}
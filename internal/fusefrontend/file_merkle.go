@@ -0,0 +1,95 @@
+package fusefrontend
+
+// Per-file Merkle roots, "MerkleRoots" feature flag. See package merkle for
+// the tree itself.
+//
+// While a file is being modified, its leaf hashes live in the open file
+// table. Every modification marks the ciphertext range it touches as out of
+// date, and Flush, Fsync and Release re-hash only these parts and store the
+// new root in an xattr of the backing file.
+
+import (
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/merkle"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+var merkleWarnOnce sync.Once
+
+// merkleTree returns the Merkle tree of the file, or nil if Merkle roots are
+// disabled. Call it before modifying the file: if the stored root is up to
+// date, it is removed first, so a crash in the middle of the modification
+// leaves the file without a root instead of with a wrong one.
+//
+// The caller must hold ContentLock exclusively.
+func (f *File) merkleTree() *merkle.Tree {
+	if !f.rootNode.args.MerkleRoots {
+		return nil
+	}
+	e := f.fileTableEntry
+	if e.Merkle != nil && e.Merkle.Dirty() {
+		return e.Merkle
+	}
+	err := unix.Fremovexattr(f.intFd(), merkle.XattrName)
+	if err != nil && err != errNoXattr && err != syscall.EOPNOTSUPP {
+		tlog.Warn.Printf("ino%d: removing Merkle root: %v", f.qIno.Ino, err)
+	}
+	if e.Merkle == nil {
+		// We do not know the leaves yet. The first Sync reads the whole file.
+		e.Merkle = merkle.New(contentenc.HeaderLen, int(f.contentEnc.CipherBS()))
+	}
+	return e.Merkle
+}
+
+// merkleInvalidate marks the ciphertext range "cOff" to "cOff+cLen" as
+// modified. The caller must hold ContentLock exclusively.
+func (f *File) merkleInvalidate(cOff int64, cLen int64) {
+	if t := f.merkleTree(); t != nil {
+		t.Invalidate(cOff, cLen)
+	}
+}
+
+// merkleInvalidateFrom marks everything starting at ciphertext offset "cOff"
+// as modified. Call it when the file size changes. The caller must hold
+// ContentLock exclusively.
+func (f *File) merkleInvalidateFrom(cOff int64) {
+	if t := f.merkleTree(); t != nil {
+		t.InvalidateFrom(cOff)
+	}
+}
+
+// merkleSync updates the Merkle tree of a modified file and stores the new
+// root. Failures are logged but not returned: the file content is fine, it
+// is just left without a root.
+//
+// The caller must hold ContentLock exclusively.
+func (f *File) merkleSync() {
+	t := f.fileTableEntry.Merkle
+	if t == nil || !t.Dirty() {
+		return
+	}
+	var st syscall.Stat_t
+	err := syscall.Fstat(f.intFd(), &st)
+	if err == nil {
+		err = t.Sync(f.fd, st.Size)
+	}
+	if err != nil {
+		tlog.Warn.Printf("ino%d: updating Merkle tree: %v", f.qIno.Ino, err)
+		// Start over with the next modification
+		f.fileTableEntry.Merkle = nil
+		return
+	}
+	err = unix.Fsetxattr(f.intFd(), merkle.XattrName, t.Root(), 0)
+	if err == syscall.EOPNOTSUPP {
+		merkleWarnOnce.Do(func() {
+			tlog.Info.Printf("Merkle roots: the backing filesystem does not support xattrs, not storing them")
+		})
+	} else if err != nil {
+		tlog.Warn.Printf("ino%d: storing Merkle root: %v", f.qIno.Ino, err)
+	}
+}
@@ -0,0 +1,149 @@
+package fusefrontend
+
+import (
+	"sync"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// MaxPrefetch is the largest allowed value for "-prefetch". 256 blocks are
+// 1 MiB of plaintext.
+const MaxPrefetch = 256
+
+// prefetchState is the read-ahead state of an open file, "-prefetch".
+// For sequential reads, we read and decrypt the next args.Prefetch blocks in
+// the background, while the application is busy with the data it already
+// has.
+type prefetchState struct {
+	sync.Mutex
+	// Where the last read ended. A read that starts here is sequential.
+	nextOff uint64
+	// The prefetch that is running or has finished, nil if there is none
+	cur *prefetchBuf
+}
+
+// prefetchBuf holds the plaintext of one prefetch
+type prefetchBuf struct {
+	// Plaintext offset and length that have been requested
+	off    uint64
+	length uint64
+	// openfiletable.WriteOpCount() before the prefetch started. The data may be
+	// stale if it has changed since.
+	writeOps uint64
+	// Closed when "data" and "ok" are valid
+	done chan struct{}
+	data []byte
+	// false if the read has failed
+	ok bool
+}
+
+// covers returns true if the read at "off" starts in the prefetched range
+func (p *prefetchBuf) covers(off uint64) bool {
+	return off >= p.off && off < p.off+p.length
+}
+
+// prefetchWait returns the prefetch that covers the read [off, off+length),
+// after it has finished, or nil. The caller must not hold fdLock or
+// ContentLock, as the prefetch needs them as well.
+func (f *File) prefetchWait(off uint64, length uint64) *prefetchBuf {
+	f.prefetch.Lock()
+	p := f.prefetch.cur
+	f.prefetch.Unlock()
+	if p == nil || !p.covers(off) {
+		return nil
+	}
+	<-p.done
+	return p
+}
+
+// get returns the plaintext for the read [off, off+length). "ok" is false if
+// the data is not usable. Caller must hold ContentLock for reading.
+func (p *prefetchBuf) get(off uint64, length uint64) (out []byte, ok bool) {
+	if !p.ok || openfiletable.WriteOpCount() != p.writeOps {
+		return nil, false
+	}
+	eof := uint64(len(p.data)) < p.length
+	start := off - p.off
+	end := start + length
+	if end > p.length && !eof {
+		// The read extends beyond what we have prefetched
+		return nil, false
+	}
+	if start >= uint64(len(p.data)) {
+		// Beyond the end of the file
+		return nil, true
+	}
+	if end > uint64(len(p.data)) {
+		end = uint64(len(p.data))
+	}
+	return p.data[start:end], true
+}
+
+// prefetchNext is called after the read [off, off+length) has been served.
+// If the read was sequential, and we are not prefetching the following data
+// already, it starts reading the next args.Prefetch blocks in the background.
+func (f *File) prefetchNext(off uint64, length uint64) {
+	blocks := uint64(f.rootNode.args.Prefetch)
+	f.prefetch.Lock()
+	defer f.prefetch.Unlock()
+	sequential := off == f.prefetch.nextOff
+	f.prefetch.nextOff = off + length
+	if !sequential {
+		return
+	}
+	end := off + length
+	if p := f.prefetch.cur; p != nil && p.covers(end) {
+		// The next read will be served from there
+		return
+	}
+	p := &prefetchBuf{
+		off:      end,
+		length:   blocks * f.contentEnc.PlainBS(),
+		writeOps: openfiletable.WriteOpCount(),
+		done:     make(chan struct{}),
+	}
+	f.prefetch.cur = p
+	go f.prefetchRun(p)
+}
+
+// prefetchRun reads the data for "p"
+func (f *File) prefetchRun(p *prefetchBuf) {
+	defer close(p.done)
+	// We run after the read that started us has returned
+	if !f.rootNode.args.KeyLock.Enter() {
+		return
+	}
+	defer f.rootNode.args.KeyLock.Exit()
+	f.fdLock.RLock()
+	defer f.fdLock.RUnlock()
+	if f.released {
+		return
+	}
+	f.fileTableEntry.ContentLock.RLock()
+	defer f.fileTableEntry.ContentLock.RUnlock()
+	data := make([]byte, 0, p.length)
+	// doRead() cannot do more than MAX_KERNEL_WRITE at once
+	for pos := uint64(0); pos < p.length; pos += fuse.MAX_KERNEL_WRITE {
+		n := p.length - pos
+		if n > fuse.MAX_KERNEL_WRITE {
+			n = fuse.MAX_KERNEL_WRITE
+		}
+		var errno syscall.Errno
+		l := len(data)
+		data, errno = f.doRead(data, p.off+pos, n)
+		if errno != 0 {
+			tlog.DebugContent.Printf("ino%d: prefetch at offset %d failed", f.qIno.Ino, p.off+pos)
+			return
+		}
+		if uint64(len(data)-l) < n {
+			// End of file
+			break
+		}
+	}
+	p.data = data
+	p.ok = true
+}
@@ -0,0 +1,76 @@
+package fusefrontend
+
+import (
+	"io"
+
+	"github.com/rfjakob/gocryptfs/internal/stupidgcm"
+)
+
+// readPipelineChunk is the number of ciphertext blocks the read pipeline
+// reads from disk at once.
+const readPipelineChunk = 8
+
+// readChunk is passed from the I/O stage to the decryption stage of the read
+// pipeline.
+type readChunk struct {
+	// Ciphertext that has been read. Points into the caller's buffer.
+	data []byte
+	// Error returned by ReadAt, io.EOF at the end of the file.
+	err error
+}
+
+// readDecryptPipelined fills "ciphertext" from disk, starting at the
+// block-aligned offset "alignedOffset", and decrypts it. It is equivalent to
+// ReadAt() followed by DecryptBlocks(), but overlaps disk latency with CPU
+// work: a goroutine reads chunk n+1 while chunk n is being decrypted. Up to
+// args.ReadPipelineDepth chunks are read ahead.
+//
+// Returns the plaintext (from PReqPool, to be returned by the caller), the
+// number of ciphertext bytes read, and the read and decryption errors
+// separately, because doRead() handles them differently.
+func (f *File) readDecryptPipelined(ciphertext []byte, alignedOffset int64, firstBlockNo uint64,
+	fileID []byte) (plaintext []byte, n int, readErr error, decryptErr error) {
+	cipherBS := int(f.contentEnc.CipherBS())
+	chunkLen := readPipelineChunk * cipherBS
+	chunks := make(chan readChunk, f.rootNode.args.ReadPipelineDepth)
+	// I/O stage
+	go func() {
+		defer close(chunks)
+		for start := 0; start < len(ciphertext); start += chunkLen {
+			end := start + chunkLen
+			if end > len(ciphertext) {
+				end = len(ciphertext)
+			}
+			m, err := f.readCiphertext(ciphertext[start:end], alignedOffset+int64(start))
+			chunks <- readChunk{data: ciphertext[start : start+m], err: err}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	// Decryption stage. We always drain the channel, even after an error, so
+	// the I/O stage is finished with "ciphertext" when we return.
+	plaintext = f.contentEnc.PReqPool.Get()[:0]
+	blockNo := firstBlockNo
+	for c := range chunks {
+		n += len(c.data)
+		if c.err != nil && c.err != io.EOF {
+			readErr = c.err
+		}
+		// Like DecryptBlocks(), we keep going on authentication failures
+		// with -forcedecode.
+		keepGoing := decryptErr == nil ||
+			(f.rootNode.args.ForceDecode && decryptErr == stupidgcm.ErrAuth)
+		if len(c.data) == 0 || !keepGoing {
+			continue
+		}
+		p, err := f.contentEnc.DecryptBlocks(c.data, blockNo, fileID)
+		plaintext = append(plaintext, p...)
+		f.contentEnc.PReqPool.Put(p)
+		if err != nil {
+			decryptErr = err
+		}
+		blockNo += readPipelineChunk
+	}
+	return plaintext, n, readErr, decryptErr
+}
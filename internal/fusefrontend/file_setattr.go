@@ -3,6 +3,9 @@ package fusefrontend
 import (
 	"context"
 	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
 
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
@@ -28,6 +31,7 @@ func (f *File) setAttr(ctx context.Context, in *fuse.SetAttrIn) (errno syscall.E
 	}
 	f.fileTableEntry.ContentLock.Lock()
 	defer f.fileTableEntry.ContentLock.Unlock()
+	defer f.fileTableEntry.InvalidateAttr()
 
 	// fchmod(2)
 	if mode, ok := in.GetMode(); ok {
@@ -56,30 +60,46 @@ func (f *File) setAttr(ctx context.Context, in *fuse.SetAttrIn) (errno syscall.E
 		}
 	}
 
-	// utimens(2)
-	mtime, mok := in.GetMTime()
-	atime, aok := in.GetATime()
-	if mok || aok {
-		ap := &atime
-		mp := &mtime
-		if !aok {
-			ap = nil
-		}
-		if !mok {
-			mp = nil
-		}
-		errno = fs.ToErrno(syscallcompat.FutimesNano(f.intFd(), ap, mp))
+	// truncate(2)
+	if sz, ok := in.GetSize(); ok {
+		errno = syscall.Errno(f.truncate(sz))
 		if errno != 0 {
 			return errno
 		}
 	}
 
-	// truncate(2)
-	if sz, ok := in.GetSize(); ok {
-		errno = syscall.Errno(f.truncate(sz))
+	// utimens(2). Runs after truncate, which would overwrite the mtime.
+	if atime, mtime, ok := setAttrTimes(in); ok {
+		errno = fs.ToErrno(syscallcompat.FutimesNano(f.intFd(), atime, mtime))
 		if errno != 0 {
 			return errno
 		}
 	}
 	return 0
 }
+
+// setAttrTimes returns the access and modification times that "in" sets, in
+// the form utimensat(2) wants them, and false if "in" sets neither.
+// Unlike in.GetATime() and in.GetMTime(), it keeps the full range and
+// nanosecond resolution of the timestamps, and leaves "now" to the backing
+// filesystem via UTIME_NOW.
+func setAttrTimes(in *fuse.SetAttrIn) (atime unix.Timespec, mtime unix.Timespec, ok bool) {
+	conv := func(set uint32, now uint32, sec uint64, nsec uint32) unix.Timespec {
+		if in.Valid&now != 0 {
+			return unix.Timespec{Nsec: syscallcompat.UTIME_NOW}
+		}
+		if in.Valid&set == 0 {
+			return unix.Timespec{Nsec: syscallcompat.UTIME_OMIT}
+		}
+		ts, err := unix.TimeToTimespec(time.Unix(int64(sec), int64(nsec)))
+		if err != nil {
+			// Out of range for this platform. Keep the old value.
+			return unix.Timespec{Nsec: syscallcompat.UTIME_OMIT}
+		}
+		return ts
+	}
+	atime = conv(fuse.FATTR_ATIME, fuse.FATTR_ATIME_NOW, in.Atime, in.Atimensec)
+	mtime = conv(fuse.FATTR_MTIME, fuse.FATTR_MTIME_NOW, in.Mtime, in.Mtimensec)
+	ok = atime.Nsec != syscallcompat.UTIME_OMIT || mtime.Nsec != syscallcompat.UTIME_OMIT
+	return atime, mtime, ok
+}
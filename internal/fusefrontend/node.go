@@ -3,14 +3,19 @@ package fusefrontend
 import (
 	"context"
 	"os"
+	"path/filepath"
+	"sync"
 	"syscall"
+	"time"
 
 	"golang.org/x/sys/unix"
 
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 
+	"github.com/rfjakob/gocryptfs/internal/inomap"
 	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
 	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
@@ -19,13 +24,27 @@ import (
 // in a gocryptfs mount.
 type Node struct {
 	fs.Inode
+	// root is the RootNode this node belongs to. Usually the root of the
+	// mount, but nodes in a subtree with its own key belong to the RootNode
+	// of the subtree.
+	root *RootNode
+	// readdirHint is the entry that Readdir has returned last, see
+	// readdirLookup(). Protected by readdirMu.
+	readdirMu   sync.Mutex
+	readdirHint readdirHint
 }
 
 // Lookup - FUSE call for discovering a file.
 func (n *Node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (ch *fs.Inode, errno syscall.Errno) {
-	dirfd, cName, errno := n.prepareAtSyscall(name)
-	if errno != 0 {
-		return
+	// For READDIRPLUS, go-fuse looks up every entry right after Readdir has
+	// returned it. We know the ciphertext name already then.
+	dirfd, cName, ok := n.readdirLookup(name)
+	diskName := name
+	if !ok {
+		dirfd, cName, diskName, errno = n.prepareAtSyscallCase(name)
+		if errno != 0 {
+			return
+		}
 	}
 	defer syscall.Close(dirfd)
 
@@ -38,8 +57,16 @@ func (n *Node) Lookup(ctx context.Context, name string, out *fuse.EntryOut) (ch
 	// Create new inode and fill `out`
 	ch = n.newChild(ctx, st, out)
 
+	// "-case-insensitive" found the entry under a different spelling. The
+	// kernel must not cache this alias: a rename to this spelling would
+	// look like a rename to itself and be skipped by the kernel. Zero means
+	// "use the default" to go-fuse, so we use the shortest non-zero timeout.
+	if diskName != name {
+		out.SetEntryTimeout(time.Nanosecond)
+	}
+
 	// Translate ciphertext size in `out.Attr.Size` to plaintext size
-	n.translateSize(dirfd, cName, &out.Attr)
+	n.translateSize(dirfd, cName, n.isPassthrough(name), &out.Attr)
 
 	return ch, 0
 }
@@ -70,7 +97,7 @@ func (n *Node) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut)
 	out.Attr.FromStat(st)
 
 	// Translate ciphertext size in `out.Attr.Size` to plaintext size
-	n.translateSize(dirfd, cName, &out.Attr)
+	n.translateSize(dirfd, cName, n.isPassthrough(""), &out.Attr)
 
 	if rn.args.ForceOwner != nil {
 		out.Owner = *rn.args.ForceOwner
@@ -82,6 +109,10 @@ func (n *Node) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut)
 //
 // Symlink-safe through the use of Openat().
 func (n *Node) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (inode *fs.Inode, fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	defer n.audit(ctx, "create", name, flags, &errno)
+	if errno = n.rootNode().checkWritable(); errno != 0 {
+		return
+	}
 	dirfd, cName, errno := n.prepareAtSyscall(name)
 	if errno != 0 {
 		return
@@ -95,7 +126,11 @@ func (n *Node) Create(ctx context.Context, name string, flags uint32, mode uint3
 	if !rn.args.PreserveOwner {
 		ctx = nil
 	}
+	passthrough := n.isPassthrough(name)
 	newFlags := rn.mangleOpenFlags(flags)
+	if passthrough {
+		newFlags = passthroughOpenFlags(flags)
+	}
 	// Handle long file name
 	ctx2 := toFuseCtx(ctx)
 	if !rn.args.PlaintextNames && nametransform.IsLongContent(cName) {
@@ -132,6 +167,9 @@ func (n *Node) Create(ctx context.Context, name string, flags uint32, mode uint3
 	}
 	ch := n.newChild(ctx, &st, out)
 
+	if passthrough {
+		return ch, newPassthroughFile(fd, rn), 0, 0
+	}
 	f := os.NewFile(uintptr(fd), cName)
 	return ch, NewFile(f, rn, &st), 0, 0
 }
@@ -140,24 +178,58 @@ func (n *Node) Create(ctx context.Context, name string, flags uint32, mode uint3
 //
 // Symlink-safe through use of Unlinkat().
 func (n *Node) Unlink(ctx context.Context, name string) (errno syscall.Errno) {
+	defer n.audit(ctx, "unlink", name, 0, &errno)
+	if errno = n.rootNode().checkWritable(); errno != 0 {
+		return
+	}
 	dirfd, cName, errno := n.prepareAtSyscall(name)
 	if errno != 0 {
 		return
 	}
 	defer syscall.Close(dirfd)
 
+	rn := n.rootNode()
+	st, _ := syscallcompat.Fstatat2(dirfd, cName, unix.AT_SYMLINK_NOFOLLOW)
+	if rn.args.TrashRetention > 0 {
+		err := rn.moveToTrash(dirfd, cName, filepath.Join(n.Path(), name))
+		if err == nil {
+			rn.quotaFreeStat(st)
+		}
+		return fs.ToErrno(err)
+	}
+	wipeFd := -1
+	if rn.args.UnlinkWipe || rn.args.Shred {
+		var err error
+		wipeFd, err = syscallcompat.OpenWipeAt(dirfd, cName)
+		if err != nil {
+			tlog.Warn.Printf("Unlink: could not wipe %q: %v", cName, err)
+		}
+	}
+	// A new file may get the same inode number
+	if st != nil {
+		openfiletable.ForgetID(inomap.QInoFromStat(st))
+	}
 	// Delete content
 	err := syscallcompat.Unlinkat(dirfd, cName, 0)
 	if err != nil {
+		if wipeFd >= 0 {
+			syscall.Close(wipeFd)
+		}
 		return fs.ToErrno(err)
 	}
+	if wipeFd >= 0 {
+		wipeUnlinked(wipeFd)
+	}
+	rn.quotaFreeStat(st)
 	// Delete ".name" file
 	if !n.rootNode().args.PlaintextNames && nametransform.IsLongContent(cName) {
+		rn.shredLongNameAt(dirfd, cName)
 		err = nametransform.DeleteLongNameAt(dirfd, cName)
 		if err != nil {
 			tlog.Warn.Printf("Unlink: could not delete .name file: %v", err)
 		}
 	}
+	n.rootNode().deleteXattrSidecar(dirfd, cName)
 	return fs.ToErrno(err)
 }
 
@@ -171,13 +243,19 @@ func (n *Node) Readlink(ctx context.Context) (out []byte, errno syscall.Errno) {
 	}
 	defer syscall.Close(dirfd)
 
-	return n.readlink(dirfd, cName)
+	return n.readlink(dirfd, cName, n.isPassthrough(""))
 }
 
 // Open - FUSE call. Open already-existing file.
 //
 // Symlink-safe through Openat().
 func (n *Node) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	defer n.audit(ctx, "open", "", flags, &errno)
+	if flags&syscall.O_ACCMODE != syscall.O_RDONLY || flags&syscall.O_TRUNC != 0 {
+		if errno = n.rootNode().checkWritable(); errno != 0 {
+			return
+		}
+	}
 	dirfd, cName, errno := n.prepareAtSyscall("")
 	if errno != 0 {
 		return
@@ -185,7 +263,26 @@ func (n *Node) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFl
 	defer syscall.Close(dirfd)
 
 	rn := n.rootNode()
+	if n.isPassthrough("") {
+		// No header and no read-modify-write: open the file as requested
+		fd, err := syscallcompat.Openat(dirfd, cName, passthroughOpenFlags(flags), 0)
+		if err != nil {
+			return nil, 0, fs.ToErrno(err)
+		}
+		if rn.args.KernelCache {
+			fuseFlags = fuse.FOPEN_KEEP_CACHE
+		}
+		return newPassthroughFile(fd, rn), fuseFlags, 0
+	}
 	newFlags := rn.mangleOpenFlags(flags)
+	if flags&syscall.O_TRUNC != 0 {
+		rn.shredAt(dirfd, cName)
+	}
+	// O_TRUNC frees the quota of the old content
+	var truncated *syscall.Stat_t
+	if rn.args.Quota > 0 && flags&syscall.O_TRUNC != 0 {
+		truncated, _ = syscallcompat.Fstatat2(dirfd, cName, unix.AT_SYMLINK_NOFOLLOW)
+	}
 	// Taking this lock makes sure we don't race openWriteOnlyFile()
 	rn.openWriteOnlyLock.RLock()
 	defer rn.openWriteOnlyLock.RUnlock()
@@ -219,6 +316,9 @@ func (n *Node) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFl
 		errno = fs.ToErrno(err)
 		return
 	}
+	if truncated != nil {
+		rn.quotaFree(int64(rn.contentEnc.CipherSizeToPlainSize(uint64(truncated.Size))))
+	}
 	f := os.NewFile(uintptr(fd), cName)
 	fh = NewFile(f, rn, &st)
 	return
@@ -226,10 +326,12 @@ func (n *Node) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFl
 
 // Setattr - FUSE call. Called for chmod, truncate, utimens, ...
 func (n *Node) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) (errno syscall.Errno) {
+	if errno = n.rootNode().checkWritable(); errno != 0 {
+		return
+	}
 	// Use the fd if the kernel gave us one
 	if f != nil {
-		f2 := f.(*File)
-		return f2.Setattr(ctx, in, out)
+		return f.(fs.FileSetattrer).Setattr(ctx, in, out)
 	}
 
 	dirfd, cName, errno := n.prepareAtSyscall("")
@@ -237,6 +339,8 @@ func (n *Node) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn,
 		return
 	}
 	defer syscall.Close(dirfd)
+	// The file may be open. Runs last.
+	defer n.invalidateOpenFileAttr(dirfd, cName)
 
 	// chmod(2)
 	if mode, ok := in.GetMode(); ok {
@@ -265,24 +369,6 @@ func (n *Node) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn,
 		}
 	}
 
-	// utimens(2)
-	mtime, mok := in.GetMTime()
-	atime, aok := in.GetATime()
-	if mok || aok {
-		ap := &atime
-		mp := &mtime
-		if !aok {
-			ap = nil
-		}
-		if !mok {
-			mp = nil
-		}
-		errno = fs.ToErrno(syscallcompat.UtimesNanoAtNofollow(dirfd, cName, ap, mp))
-		if errno != 0 {
-			return errno
-		}
-	}
-
 	// For truncate, the user has to have write permissions. That means we can
 	// depend on opening a RDWR fd and letting the File handle truncate.
 	if sz, ok := in.GetSize(); ok {
@@ -290,13 +376,25 @@ func (n *Node) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn,
 		if errno != 0 {
 			return errno
 		}
-		f2 := f.(*File)
-		defer f2.Release(ctx)
-		errno = syscall.Errno(f2.truncate(sz))
+		if pf, ok := f.(*passthroughFile); ok {
+			errno = fs.ToErrno(syscall.Ftruncate(pf.fd, int64(sz)))
+			pf.Release(ctx)
+		} else {
+			f2 := f.(*File)
+			errno = syscall.Errno(f2.truncate(sz))
+			f2.Release(ctx)
+		}
+		if errno != 0 {
+			return errno
+		}
+	}
+
+	// utimens(2). Runs after truncate, which would overwrite the mtime.
+	if atime, mtime, ok := setAttrTimes(in); ok {
+		errno = fs.ToErrno(syscallcompat.UtimesNanoAtNofollow(dirfd, cName, atime, mtime))
 		if errno != 0 {
 			return errno
 		}
-		return f2.Getattr(ctx, out)
 	}
 
 	return n.Getattr(ctx, nil, out)
@@ -306,12 +404,19 @@ func (n *Node) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn,
 //
 // Symlink-safe because the path is ignored.
 func (n *Node) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
-	p := n.rootNode().args.Cipherdir
+	rn := n.rootNode()
 	var st syscall.Statfs_t
-	err := syscall.Statfs(p, &st)
+	var err error
+	if rn.cipherdirFd >= 0 {
+		err = syscall.Fstatfs(rn.cipherdirFd, &st)
+	} else {
+		err = syscall.Statfs(rn.args.Cipherdir, &st)
+	}
 	if err != nil {
 		return fs.ToErrno(err)
 	}
+	rn.translateStatfs(&st)
+	rn.quotaStatfs(&st)
 	out.FromStatfsT(&st)
 	return 0
 }
@@ -320,6 +425,9 @@ func (n *Node) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
 //
 // Symlink-safe through use of Mknodat().
 func (n *Node) Mknod(ctx context.Context, name string, mode, rdev uint32, out *fuse.EntryOut) (inode *fs.Inode, errno syscall.Errno) {
+	if errno = n.rootNode().checkWritable(); errno != 0 {
+		return
+	}
 	dirfd, cName, errno := n.prepareAtSyscall(name)
 	if errno != 0 {
 		return
@@ -369,6 +477,9 @@ func (n *Node) Mknod(ctx context.Context, name string, mode, rdev uint32, out *f
 //
 // Symlink-safe through use of Linkat().
 func (n *Node) Link(ctx context.Context, target fs.InodeEmbedder, name string, out *fuse.EntryOut) (inode *fs.Inode, errno syscall.Errno) {
+	if errno = n.rootNode().checkWritable(); errno != 0 {
+		return
+	}
 	dirfd, cName, errno := n.prepareAtSyscall(name)
 	if errno != 0 {
 		return
@@ -382,6 +493,11 @@ func (n *Node) Link(ctx context.Context, target fs.InodeEmbedder, name string, o
 	}
 	defer syscall.Close(dirfd2)
 
+	// The link would have to be encrypted or decrypted
+	if n.isPassthrough(name) != n2.isPassthrough("") || n.rootNode() != n2.rootNode() {
+		return nil, syscall.EXDEV
+	}
+
 	// Handle long file name (except in PlaintextNames mode)
 	rn := n.rootNode()
 	var err error
@@ -404,13 +520,18 @@ func (n *Node) Link(ctx context.Context, target fs.InodeEmbedder, name string, o
 		errno = fs.ToErrno(err)
 		return
 	}
+	rn.linkXattrSidecar(dirfd2, cName2, dirfd, cName)
 
 	st, err := syscallcompat.Fstatat2(dirfd, cName, unix.AT_SYMLINK_NOFOLLOW)
 	if err != nil {
 		errno = fs.ToErrno(err)
 		return
 	}
+	// The link count has changed
+	openfiletable.InvalidateAttr(inomap.QInoFromStat(st))
 	inode = n.newChild(ctx, st, out)
+	// The kernel caches the size we return here and uses it for O_APPEND
+	n.translateSize(dirfd, cName, n.isPassthrough(name), &out.Attr)
 	return inode, 0
 }
 
@@ -418,6 +539,9 @@ func (n *Node) Link(ctx context.Context, target fs.InodeEmbedder, name string, o
 //
 // Symlink-safe through use of Symlinkat.
 func (n *Node) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (inode *fs.Inode, errno syscall.Errno) {
+	if errno = n.rootNode().checkWritable(); errno != 0 {
+		return
+	}
 	dirfd, cName, errno := n.prepareAtSyscall(name)
 	if errno != 0 {
 		return
@@ -431,7 +555,7 @@ func (n *Node) Symlink(ctx context.Context, target, name string, out *fuse.Entry
 	}
 
 	cTarget := target
-	if !rn.args.PlaintextNames {
+	if !rn.args.PlaintextNames && !rn.args.PlaintextSymlinks && !n.isPassthrough(name) {
 		// Symlinks are encrypted like file contents (GCM) and base64-encoded
 		cTarget = rn.encryptSymlinkTarget(target)
 	}
@@ -468,6 +592,10 @@ func (n *Node) Symlink(ctx context.Context, target, name string, out *fuse.Entry
 //
 // Symlink-safe through Renameat().
 func (n *Node) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) (errno syscall.Errno) {
+	defer n.auditRename(ctx, name, toNode(newParent), newName, &errno)
+	if errno = n.rootNode().checkWritable(); errno != 0 {
+		return
+	}
 	dirfd, cName, errno := n.prepareAtSyscall(name)
 	if errno != 0 {
 		return
@@ -481,8 +609,36 @@ func (n *Node) Rename(ctx context.Context, name string, newParent fs.InodeEmbedd
 	}
 	defer syscall.Close(dirfd2)
 
-	// Easy case.
+	// Renaming a directory moves everything below it. Drop all cached
+	// directories under the old and the new name once we are done.
 	rn := n.rootNode()
+	defer rn.dirCache.Invalidate(rn.dirCacheKey(filepath.Join(n.Path(), name)))
+	defer rn.dirCache.Invalidate(rn.dirCacheKey(filepath.Join(n2.Path(), newName)))
+
+	// Moving between encrypted and "-passthrough" storage, or between
+	// subtrees with different keys, would require re-encrypting the data.
+	// Return EXDEV so userspace falls back to copy + delete.
+	if n.isPassthrough(name) != n2.isPassthrough(newName) || rn != n2.rootNode() {
+		return syscall.EXDEV
+	}
+	// An overwritten file frees its quota
+	if rn.args.Quota > 0 && flags&(syscallcompat.RENAME_NOREPLACE|syscallcompat.RENAME_EXCHANGE) == 0 {
+		st, err := syscallcompat.Fstatat2(dirfd, cName, unix.AT_SYMLINK_NOFOLLOW)
+		st2, err2 := syscallcompat.Fstatat2(dirfd2, cName2, unix.AT_SYMLINK_NOFOLLOW)
+		// Renaming a file onto a hard link of itself does nothing
+		if err == nil && err2 == nil && (st.Ino != st2.Ino || st.Dev != st2.Dev) {
+			defer func() {
+				if errno == 0 {
+					rn.quotaFreeStat(st2)
+				}
+			}()
+		}
+	}
+	// A replaced file is overwritten after the rename
+	shredFd := rn.openShredTarget(dirfd2, cName2, flags)
+	defer func() { shredTarget(shredFd, errno == 0) }()
+
+	// Easy case.
 	if rn.args.PlaintextNames {
 		return fs.ToErrno(syscallcompat.Renameat2(dirfd, cName, dirfd2, cName2, uint(flags)))
 	}
@@ -522,7 +678,9 @@ func (n *Node) Rename(ctx context.Context, name string, newParent fs.InodeEmbedd
 		return fs.ToErrno(err)
 	}
 	if nametransform.IsLongContent(cName) {
+		rn.shredLongNameAt(dirfd, cName)
 		nametransform.DeleteLongNameAt(dirfd, cName)
 	}
+	rn.renameXattrSidecar(dirfd, cName, dirfd2, cName2, flags)
 	return 0
 }
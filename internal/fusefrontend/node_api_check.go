@@ -25,7 +25,7 @@ var _ = (fs.NodeGetxattrer)((*Node)(nil))
 var _ = (fs.NodeSetxattrer)((*Node)(nil))
 var _ = (fs.NodeRemovexattrer)((*Node)(nil))
 var _ = (fs.NodeListxattrer)((*Node)(nil))
-
-/* TODO
 var _ = (fs.NodeCopyFileRanger)((*Node)(nil))
-*/
+var _ = (fs.NodeGetlker)((*Node)(nil))
+var _ = (fs.NodeSetlker)((*Node)(nil))
+var _ = (fs.NodeSetlkwer)((*Node)(nil))
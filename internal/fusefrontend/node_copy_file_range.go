@@ -0,0 +1,112 @@
+package fusefrontend
+
+import (
+	"context"
+	"math"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// CopyFileRange - FUSE call. Copies "length" bytes from "fhIn" at "offIn" to
+// "fhOut" at "offOut". The data is decrypted and re-encrypted inside
+// gocryptfs, as the file IDs of the two files differ, but does not have to
+// make the round trip through the kernel and the calling process.
+//
+// Returns the number of bytes copied, which is less than "length" when we hit
+// the end of the input file or an error after copying some data.
+func (n *Node) CopyFileRange(ctx context.Context, fhIn fs.FileHandle,
+	offIn uint64, out *fs.Inode, fhOut fs.FileHandle, offOut uint64,
+	length uint64, flags uint64) (uint32, syscall.Errno) {
+	if flags != 0 {
+		return 0, syscall.EINVAL
+	}
+	if errno := n.rootNode().checkWritable(); errno != 0 {
+		return 0, errno
+	}
+	fIn, ok1 := fhIn.(*File)
+	fOut, ok2 := fhOut.(*File)
+	if !ok1 || !ok2 {
+		// Passthrough files. EOPNOTSUPP makes the kernel fall back to
+		// copying through READ and WRITE.
+		return 0, syscall.EOPNOTSUPP
+	}
+	if length > math.MaxUint32 {
+		// The copied size is returned as an uint32
+		length = math.MaxUint32
+	}
+	fIn.fdLock.RLock()
+	defer fIn.fdLock.RUnlock()
+	if fIn != fOut {
+		fOut.fdLock.RLock()
+		defer fOut.fdLock.RUnlock()
+	}
+	for _, f := range []*File{fIn, fOut} {
+		if f.released {
+			// The file descriptor has been closed concurrently
+			tlog.Warn.Printf("ino%d fh%d: CopyFileRange on released file", f.qIno.Ino, f.intFd())
+			return 0, syscall.EBADF
+		}
+	}
+	tlog.DebugContent.Printf("ino%d: FUSE CopyFileRange: offIn=%d ino%d offOut=%d length=%d",
+		fIn.qIno.Ino, offIn, fOut.qIno.Ino, offOut, length)
+	var done uint64
+	var errno syscall.Errno
+	buf := make([]byte, 0, fuse.MAX_KERNEL_WRITE)
+	for done < length {
+		// Chunks end on block boundaries of the output file, so only the
+		// first and the last write need a read-modify-write cycle.
+		chunk := uint64(fuse.MAX_KERNEL_WRITE) - (offOut+done)%fOut.contentEnc.PlainBS()
+		if chunk > length-done {
+			chunk = length - done
+		}
+		// Only hold one ContentLock at a time. Copies in the opposite direction
+		// would deadlock otherwise.
+		fIn.fileTableEntry.ContentLock.RLock()
+		var data []byte
+		data, errno = fIn.doRead(buf[:0], offIn+done, chunk)
+		fIn.fileTableEntry.ContentLock.RUnlock()
+		if errno != 0 {
+			break
+		}
+		if len(data) == 0 {
+			break
+		}
+		fOut.fileTableEntry.ContentLock.Lock()
+		end := offOut + done + uint64(len(data))
+		var before uint64
+		before, errno = fOut.quotaGrow(end)
+		if errno != 0 {
+			fOut.fileTableEntry.ContentLock.Unlock()
+			break
+		}
+		if done == 0 {
+			// Like in Write(), a copy past the end of the file creates a hole
+			errno = fOut.writePadHole(int64(offOut))
+		}
+		if errno == 0 {
+			_, errno = fOut.doWrite(data, int64(offOut+done))
+		}
+		if errno != 0 {
+			fOut.quotaSettle(before, end)
+		}
+		fOut.fileTableEntry.ContentLock.Unlock()
+		if errno != 0 {
+			break
+		}
+		done += uint64(len(data))
+		if uint64(len(data)) < chunk {
+			// End of the input file
+			break
+		}
+	}
+	if errno != 0 && done == 0 {
+		return 0, errno
+	}
+	// Report a partial copy like a short write. The caller will retry the
+	// rest and get the error then.
+	return uint32(done), 0
+}
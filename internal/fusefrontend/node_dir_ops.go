@@ -2,10 +2,9 @@ package fusefrontend
 
 import (
 	"context"
-	"fmt"
 	"io"
 	"path/filepath"
-	"runtime"
+	"strings"
 	"syscall"
 
 	"golang.org/x/sys/unix"
@@ -14,7 +13,7 @@ import (
 	"github.com/hanwen/go-fuse/v2/fuse"
 
 	"github.com/rfjakob/gocryptfs/internal/configfile"
-	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/metrics"
 	"github.com/rfjakob/gocryptfs/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
@@ -22,14 +21,12 @@ import (
 
 const dsStoreName = ".DS_Store"
 
-// haveDsstore return true if one of the entries in "names" is ".DS_Store".
-func haveDsstore(entries []fuse.DirEntry) bool {
-	for _, e := range entries {
-		if e.Name == dsStoreName {
-			return true
-		}
-	}
-	return false
+// isMacMetadata returns true for the ".DS_Store" and "._*" AppleDouble files
+// that MacOS creates in directories, including in CIPHERDIR when it is opened
+// in Finder, or when it is on a filesystem without xattr support. They are
+// never valid encrypted names.
+func isMacMetadata(cName string) bool {
+	return cName == dsStoreName || strings.HasPrefix(cName, "._")
 }
 
 // mkdirWithIv - create a new directory and corresponding diriv file. dirfd
@@ -37,6 +34,10 @@ func haveDsstore(entries []fuse.DirEntry) bool {
 // directory and mode specifies the access permissions to use.
 func (n *Node) mkdirWithIv(dirfd int, cName string, mode uint32, caller *fuse.Caller) error {
 	rn := n.rootNode()
+	if rn.args.DeterministicNames {
+		// No gocryptfs.diriv, no inconsistent state
+		return syscallcompat.MkdiratUser(dirfd, cName, mode, caller)
+	}
 	// Between the creation of the directory and the creation of gocryptfs.diriv
 	// the directory is inconsistent. Take the lock to prevent other readers
 	// from seeing it.
@@ -66,6 +67,9 @@ func (n *Node) mkdirWithIv(dirfd int, cName string, mode uint32, caller *fuse.Ca
 //
 // Symlink-safe through use of Mkdirat().
 func (n *Node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+	if errno := n.rootNode().checkWritable(); errno != 0 {
+		return nil, errno
+	}
 	rn := n.rootNode()
 	newPath := filepath.Join(n.Path(), name)
 	if rn.isFiltered(newPath) {
@@ -83,7 +87,8 @@ func (n *Node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.En
 
 	var st syscall.Stat_t
 
-	if rn.args.PlaintextNames {
+	// Directories stored unencrypted have no gocryptfs.diriv
+	if rn.args.PlaintextNames || rn.isPassthrough(newPath) {
 		err = syscallcompat.MkdiratUser(dirfd, cName, mode, caller)
 		if err != nil {
 			return nil, fs.ToErrno(err)
@@ -155,56 +160,82 @@ func (n *Node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.En
 
 // Readdir - FUSE call.
 //
+// The directory is read and decrypted in batches while the kernel asks for
+// more entries, see dirStream.
+//
 // This function is symlink-safe through use of openBackingDir() and
 // ReadDirIVAt().
 func (n *Node) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
 	rn := n.rootNode()
 	p := n.Path()
-	dirName := filepath.Base(p)
+	passthrough := rn.isPassthrough(p)
 	parentDirFd, cDirName, err := rn.openBackingDir(p)
 	if err != nil {
 		return nil, fs.ToErrno(err)
 	}
 	defer syscall.Close(parentDirFd)
 
-	// Read ciphertext directory
-	var cipherEntries []fuse.DirEntry
+	// Open ciphertext directory
 	fd, err := syscallcompat.Openat(parentDirFd, cDirName, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
 	if err != nil {
 		return nil, fs.ToErrno(err)
 	}
-	defer syscall.Close(fd)
-	cipherEntries, err = syscallcompat.Getdents(fd)
-	if err != nil {
-		return nil, fs.ToErrno(err)
+	ds := &dirStream{
+		rn:       rn,
+		node:     n,
+		fd:       fd,
+		r:        syscallcompat.NewDirReader(fd),
+		cDirName: cDirName,
+		isRoot:   filepath.Base(p) == ".",
+		plain:    rn.args.PlaintextNames || passthrough,
 	}
 	// Get DirIV (stays nil if PlaintextNames is used)
-	var cachedIV []byte
-	if !rn.args.PlaintextNames {
+	if !ds.plain {
 		// Read the DirIV from disk
-		cachedIV, err = nametransform.ReadDirIVAt(fd)
+		ds.iv, err = rn.readDirIVAt(fd)
 		if err != nil {
 			tlog.Warn.Printf("OpenDir %q: could not read %s: %v", cDirName, nametransform.DirIVFilename, err)
+			syscall.Close(fd)
 			return nil, syscall.EIO
 		}
 	}
+	return ds, 0
+}
+
+// decryptDirEntries filters and decrypts the ciphertext directory entries
+// "cipherEntries" of the directory "fd" in place and returns the plaintext
+// entries, and their ciphertext names ("" for names that are not encrypted).
+func (ds *dirStream) decryptDirEntries(cipherEntries []fuse.DirEntry) (plain []fuse.DirEntry, cNames []string) {
+	rn := ds.rn
+	fd, cDirName, cachedIV := ds.fd, ds.cDirName, ds.iv
 	// Decrypted directory entries
-	var plain []fuse.DirEntry
+	plain = cipherEntries[:0]
+	cNames = make([]string, 0, len(cipherEntries))
 	// Filter and decrypt filenames
 	for i := range cipherEntries {
 		cName := cipherEntries[i].Name
-		if dirName == "." && cName == configfile.ConfDefaultName {
-			// silently ignore "gocryptfs.conf" in the top level dir
+		if ds.isRoot && (cName == configfile.ConfDefaultName || isInternalRootName(cName)) {
+			// silently ignore "gocryptfs.conf" and our other internal
+			// files in the top level dir
 			continue
 		}
-		if rn.args.PlaintextNames {
+		if ds.plain {
 			plain = append(plain, cipherEntries[i])
+			cNames = append(cNames, "")
 			continue
 		}
 		if cName == nametransform.DirIVFilename {
 			// silently ignore "gocryptfs.diriv" everywhere if dirIV is enabled
 			continue
 		}
+		if nametransform.IsXattrSidecar(cName) {
+			// ignore "gocryptfs.xattr.*"
+			continue
+		}
+		if isMacMetadata(cName) {
+			// Not ours, and not worth an "invalid entry" warning
+			continue
+		}
 		// Handle long file name
 		isLong := nametransform.LongNameNone
 		if rn.args.LongNames {
@@ -224,35 +255,64 @@ func (n *Node) Readdir(ctx context.Context) (fs.DirStream, syscall.Errno) {
 			continue
 		}
 		name, err := rn.nameTransform.DecryptName(cName, cachedIV)
+		if err != nil && rn.isPassthroughName(cName) {
+			// Stored unencrypted because of "-passthrough"
+			plain = append(plain, cipherEntries[i])
+			cNames = append(cNames, "")
+			continue
+		}
 		if err != nil {
 			tlog.Warn.Printf("OpenDir %q: invalid entry %q: %v",
 				cDirName, cName, err)
+			metrics.NameDecryptFailures.Inc()
 			rn.reportMitigatedCorruption(cName)
 			continue
 		}
+		// The name on disk, which is hashed for long names
+		cNames = append(cNames, cipherEntries[i].Name)
 		// Override the ciphertext name with the plaintext name but reuse the rest
 		// of the structure
 		cipherEntries[i].Name = name
 		plain = append(plain, cipherEntries[i])
 	}
-
-	return fs.NewListDirStream(plain), 0
+	return plain, cNames
 }
 
 // Rmdir - FUSE call.
 //
 // Symlink-safe through Unlinkat() + AT_REMOVEDIR.
 func (n *Node) Rmdir(ctx context.Context, name string) (code syscall.Errno) {
+	defer n.audit(ctx, "rmdir", name, 0, &code)
+	if code = n.rootNode().checkWritable(); code != 0 {
+		return
+	}
 	rn := n.rootNode()
 	p := filepath.Join(n.Path(), name)
+	// Runs last, after the directory is gone
+	defer rn.dirCache.Invalidate(rn.dirCacheKey(p))
 	parentDirFd, cName, err := rn.openBackingDir(p)
 	if err != nil {
 		return fs.ToErrno(err)
 	}
 	defer syscall.Close(parentDirFd)
-	if rn.args.PlaintextNames {
+	if rn.args.TrashRetention > 0 {
+		return fs.ToErrno(rn.rmdirToTrash(parentDirFd, cName, p))
+	}
+	if rn.args.PlaintextNames || rn.isPassthrough(p) {
 		// Unlinkat with AT_REMOVEDIR is equivalent to Rmdir
-		err = unix.Unlinkat(parentDirFd, cName, unix.AT_REMOVEDIR)
+		err = syscallcompat.Unlinkat(parentDirFd, cName, unix.AT_REMOVEDIR)
+		return fs.ToErrno(err)
+	}
+	if rn.args.DeterministicNames {
+		// Without gocryptfs.diriv, an empty directory is really empty
+		err = syscallcompat.Unlinkat(parentDirFd, cName, unix.AT_REMOVEDIR)
+		if err == nil {
+			if nametransform.IsLongContent(cName) {
+				rn.shredLongNameAt(parentDirFd, cName)
+				nametransform.DeleteLongNameAt(parentDirFd, cName)
+			}
+			rn.deleteXattrSidecar(parentDirFd, cName)
+		}
 		return fs.ToErrno(err)
 	}
 	// Unless we are running as root, we need read, write and execute permissions
@@ -302,64 +362,74 @@ retry:
 	if err == io.EOF {
 		// The directory is empty
 		tlog.Warn.Printf("Rmdir: %q: %s is missing", cName, nametransform.DirIVFilename)
-		err = unix.Unlinkat(parentDirFd, cName, unix.AT_REMOVEDIR)
+		err = syscallcompat.Unlinkat(parentDirFd, cName, unix.AT_REMOVEDIR)
 		return fs.ToErrno(err)
 	}
 	if err != nil {
 		tlog.Warn.Printf("Rmdir: Getdents: %v", err)
 		return fs.ToErrno(err)
 	}
-	// MacOS sprinkles .DS_Store files everywhere. This is hard to avoid for
-	// users, so handle it transparently here.
-	if runtime.GOOS == "darwin" && len(children) <= 2 && haveDsstore(children) {
-		err = unix.Unlinkat(dirfd, dsStoreName, 0)
-		if err != nil {
-			tlog.Warn.Printf("Rmdir: failed to delete blocking file %q: %v", dsStoreName, err)
-			return fs.ToErrno(err)
+	// MacOS sprinkles .DS_Store and AppleDouble files everywhere. This is
+	// hard to avoid for users, and OpenDir hides them, so handle it
+	// transparently here.
+	var blocking []string
+	for _, c := range children {
+		if isMacMetadata(c.Name) {
+			blocking = append(blocking, c.Name)
+		}
+	}
+	if len(blocking) > 0 && len(children)-len(blocking) <= 1 {
+		for _, b := range blocking {
+			err = syscallcompat.Unlinkat(dirfd, b, 0)
+			if err != nil {
+				tlog.Warn.Printf("Rmdir: failed to delete blocking file %q: %v", b, err)
+				return fs.ToErrno(err)
+			}
 		}
-		tlog.Warn.Printf("Rmdir: had to delete blocking file %q", dsStoreName)
+		tlog.Info.Printf("Rmdir: had to delete blocking files %q", blocking)
 		goto retry
 	}
 	// If the directory is not empty besides gocryptfs.diriv, do not even
-	// attempt the dance around gocryptfs.diriv.
+	// attempt to delete gocryptfs.diriv.
 	if len(children) > 1 {
 		return fs.ToErrno(syscall.ENOTEMPTY)
 	}
-	// Move "gocryptfs.diriv" to the parent dir as "gocryptfs.diriv.rmdir.XYZ"
-	tmpName := fmt.Sprintf("%s.rmdir.%d", nametransform.DirIVFilename, cryptocore.RandUint64())
-	tlog.Debug.Printf("Rmdir: Renaming %s to %s", nametransform.DirIVFilename, tmpName)
-	// The directory is in an inconsistent state between rename and rmdir.
+	// Keep the IV, so we can write gocryptfs.diriv back if the rmdir fails
+	iv, err := nametransform.ReadDirIVAt(dirfd)
+	if err == syscall.ENOENT {
+		// The only entry is something else
+		return fs.ToErrno(syscall.ENOTEMPTY)
+	} else if err != nil {
+		tlog.Warn.Printf("Rmdir: %q: could not read %s: %v", cName, nametransform.DirIVFilename, err)
+		return fs.ToErrno(err)
+	}
+	// The directory has no gocryptfs.diriv between the unlink and the rmdir.
 	// Protect against concurrent readers.
 	rn.dirIVLock.Lock()
 	defer rn.dirIVLock.Unlock()
-	err = syscallcompat.Renameat(dirfd, nametransform.DirIVFilename,
-		parentDirFd, tmpName)
+	rn.shredAt(dirfd, nametransform.DirIVFilename)
+	err = syscallcompat.Unlinkat(dirfd, nametransform.DirIVFilename, 0)
 	if err != nil {
-		tlog.Warn.Printf("Rmdir: Renaming %s to %s failed: %v",
-			nametransform.DirIVFilename, tmpName, err)
+		tlog.Warn.Printf("Rmdir: deleting %s failed: %v", nametransform.DirIVFilename, err)
 		return fs.ToErrno(err)
 	}
 	// Actual Rmdir
 	err = syscallcompat.Unlinkat(parentDirFd, cName, unix.AT_REMOVEDIR)
 	if err != nil {
 		// This can happen if another file in the directory was created in the
-		// meantime, undo the rename
-		err2 := syscallcompat.Renameat(parentDirFd, tmpName,
-			dirfd, nametransform.DirIVFilename)
+		// meantime. Put gocryptfs.diriv back.
+		err2 := nametransform.RestoreDirIVAt(dirfd, iv)
 		if err2 != nil {
-			tlog.Warn.Printf("Rmdir: Rename rollback failed: %v", err2)
+			tlog.Warn.Printf("Rmdir: restoring %s failed: %v", nametransform.DirIVFilename, err2)
 		}
 		return fs.ToErrno(err)
 	}
-	// Delete "gocryptfs.diriv.rmdir.XYZ"
-	err = syscallcompat.Unlinkat(parentDirFd, tmpName, 0)
-	if err != nil {
-		tlog.Warn.Printf("Rmdir: Could not clean up %s: %v", tmpName, err)
-	}
 	// Delete .name file
 	if nametransform.IsLongContent(cName) {
+		rn.shredLongNameAt(parentDirFd, cName)
 		nametransform.DeleteLongNameAt(parentDirFd, cName)
 	}
+	rn.deleteXattrSidecar(parentDirFd, cName)
 	return 0
 }
 
@@ -5,10 +5,15 @@ import (
 	"path/filepath"
 	"syscall"
 
+	"golang.org/x/sys/unix"
+
 	"github.com/hanwen/go-fuse/v2/fs"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
 
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/inomap"
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
 	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
@@ -36,13 +41,14 @@ func toNode(op fs.InodeEmbedder) *Node {
 }
 
 // readlink reads and decrypts a symlink. Used by Readlink, Getattr, Lookup.
-func (n *Node) readlink(dirfd int, cName string) (out []byte, errno syscall.Errno) {
+// Pass passthrough=true if the symlink is stored unencrypted.
+func (n *Node) readlink(dirfd int, cName string, passthrough bool) (out []byte, errno syscall.Errno) {
 	cTarget, err := syscallcompat.Readlinkat(dirfd, cName)
 	if err != nil {
 		return nil, fs.ToErrno(err)
 	}
 	rn := n.rootNode()
-	if rn.args.PlaintextNames {
+	if rn.args.PlaintextNames || rn.args.PlaintextSymlinks || passthrough {
 		return []byte(cTarget), 0
 	}
 	// Symlinks are encrypted like file contents (GCM) and base64-encoded
@@ -55,24 +61,70 @@ func (n *Node) readlink(dirfd int, cName string) (out []byte, errno syscall.Errn
 }
 
 // translateSize translates the ciphertext size in `out` into plaintext size.
-func (n *Node) translateSize(dirfd int, cName string, out *fuse.Attr) {
+// Files stored unencrypted (passthrough=true) need no translation.
+func (n *Node) translateSize(dirfd int, cName string, passthrough bool, out *fuse.Attr) {
+	if passthrough {
+		return
+	}
 	if out.IsRegular() {
 		rn := n.rootNode()
 		out.Size = rn.contentEnc.CipherSizeToPlainSize(out.Size)
 	} else if out.IsSymlink() {
-		target, _ := n.readlink(dirfd, cName)
+		rn := n.rootNode()
+		if size, ok := rn.sizeCache.Lookup(out); ok {
+			out.Size = size
+			return
+		}
+		target, errno := n.readlink(dirfd, cName, false)
+		if errno == 0 {
+			rn.sizeCache.Store(out, uint64(len(target)))
+		}
 		out.Size = uint64(len(target))
 	}
 }
 
-// Path returns the relative plaintext path of this node
+// translateStatfs translates the block counts in `st` from ciphertext into
+// plaintext terms. Every file costs a header and every block its overhead, so
+// the space is worth less to the user than it is to the backing filesystem.
+// The counts are rounded down, as if the space went into a single file.
+func (rn *RootNode) translateStatfs(st *syscall.Statfs_t) {
+	if st.Bsize <= 0 {
+		return
+	}
+	bsize := uint64(st.Bsize)
+	plain := func(blocks uint64) uint64 {
+		size := blocks * bsize
+		if size <= contentenc.HeaderLen {
+			return 0
+		}
+		size -= contentenc.HeaderLen
+		cBS := rn.contentEnc.CipherBS()
+		n := size / cBS * rn.contentEnc.PlainBS()
+		if rest := size % cBS; rest > rn.contentEnc.BlockOverhead() {
+			n += rest - rn.contentEnc.BlockOverhead()
+		}
+		return n / bsize
+	}
+	st.Blocks = plain(st.Blocks)
+	st.Bfree = plain(st.Bfree)
+	st.Bavail = plain(st.Bavail)
+}
+
+// Path returns the plaintext path of this node, relative to its RootNode
 func (n *Node) Path() string {
+	return n.Inode.Path(n.rootNode().EmbeddedInode())
+}
+
+// mountPath returns the plaintext path of this node relative to the
+// mountpoint. Differs from Path() inside subtrees with their own key.
+func (n *Node) mountPath() string {
 	return n.Inode.Path(n.Root())
 }
 
-// rootNode returns the Root Node of the filesystem.
+// rootNode returns the Root Node of the filesystem, or of the subtree with
+// its own key this node is in.
 func (n *Node) rootNode() *RootNode {
-	return n.Root().Operations().(*RootNode)
+	return n.root
 }
 
 // prepareAtSyscall returns a (dirfd, cName) pair that can be used
@@ -83,6 +135,15 @@ func (n *Node) rootNode() *RootNode {
 // a child of this node.
 // If `child` is empty, the (dirfd, cName) pair refers to this node itself.
 func (n *Node) prepareAtSyscall(child string) (dirfd int, cName string, errno syscall.Errno) {
+	dirfd, cName, _, errno = n.prepareAtSyscallCase(child)
+	return
+}
+
+// prepareAtSyscallCase is like prepareAtSyscall, but also returns the
+// plaintext name of the last path component as it is stored on disk. This
+// differs from `child` when "-case-insensitive" matched a name that differs
+// in case.
+func (n *Node) prepareAtSyscallCase(child string) (dirfd int, cName string, diskName string, errno syscall.Errno) {
 	p := n.Path()
 	if child != "" {
 		p = filepath.Join(p, child)
@@ -92,26 +153,45 @@ func (n *Node) prepareAtSyscall(child string) (dirfd int, cName string, errno sy
 		errno = syscall.EPERM
 		return
 	}
-	dirfd, cName, err := rn.openBackingDir(p)
+	dirfd, cName, diskName, err := rn.openBackingDirCase(p)
 	if err != nil {
 		errno = fs.ToErrno(err)
 	}
 	return
 }
 
+// invalidateOpenFileAttr drops the attributes the open file table caches
+// for (dirfd, cName). Call it after modifying the file through its path.
+func (n *Node) invalidateOpenFileAttr(dirfd int, cName string) {
+	st, err := syscallcompat.Fstatat2(dirfd, cName, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		return
+	}
+	openfiletable.InvalidateAttr(inomap.QInoFromStat(st))
+}
+
 // newChild attaches a new child inode to n.
 // The passed-in `st` will be modified to get a unique inode number.
 func (n *Node) newChild(ctx context.Context, st *syscall.Stat_t, out *fuse.EntryOut) *fs.Inode {
 	// Get unique inode number
 	rn := n.rootNode()
+	qi := inomap.QInoFromStat(st)
 	rn.inoMap.TranslateStat(st)
 	out.Attr.FromStat(st)
+	// The kernel caches these attributes like the ones from Getattr
+	if rn.args.ForceOwner != nil {
+		out.Owner = *rn.args.ForceOwner
+	}
 	// Create child node
 	id := fs.StableAttr{
 		Mode: uint32(st.Mode),
 		Gen:  1,
 		Ino:  st.Ino,
 	}
-	node := &Node{}
+	if sub := rn.subtrees[qi]; sub != nil {
+		// Never forgotten, as the RootNode cannot be initialized twice
+		return n.NewPersistentInode(ctx, sub, id)
+	}
+	node := &Node{root: rn}
 	return n.NewInode(ctx, node, id)
 }
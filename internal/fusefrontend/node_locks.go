@@ -0,0 +1,172 @@
+package fusefrontend
+
+import (
+	"context"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// File locking (flock(2) and fcntl(2) locks) is forwarded to the backing
+// files, so the locks also exclude processes accessing the same CIPHERDIR
+// through another mount.
+//
+// The kernel gives each open() of the plaintext file its own file handle,
+// which has its own backing file descriptor. flock locks belong to the open
+// file description, so we can simply flock the backing file descriptor.
+//
+// POSIX locks belong to the process ("lock owner" in FUSE) instead, but all
+// of them end up in the gocryptfs process. We keep them apart by taking open
+// file description locks on a separate backing file descriptor per lock
+// owner, see openfiletable.Entry.LockFd().
+//
+// The lock methods have to be implemented on the Node, as go-fuse only checks
+// the Node for the Setlk and Setlkw interfaces.
+
+// Getlk - FUSE call. Returns a lock that would conflict with "lk" in "out",
+// or F_UNLCK if there is none.
+func (n *Node) Getlk(ctx context.Context, fh fs.FileHandle, owner uint64, lk *fuse.FileLock, flags uint32, out *fuse.FileLock) syscall.Errno {
+	if p, ok := fh.(*passthroughFile); ok {
+		return p.loopback.(fs.FileGetlker).Getlk(ctx, owner, lk, flags, out)
+	}
+	f, ok := fh.(*File)
+	if !ok {
+		return syscall.EBADF
+	}
+	f.fdLock.RLock()
+	defer f.fdLock.RUnlock()
+	if f.released {
+		return syscall.EBADF
+	}
+	fd, errno := f.lockFd(owner, false)
+	if errno != 0 {
+		return errno
+	}
+	if fd < 0 {
+		// The owner holds no locks, so testing on our own file descriptor,
+		// which never holds POSIX locks, gives the same result.
+		fd = f.intFd()
+	}
+	var flk syscall.Flock_t
+	lk.ToFlockT(&flk)
+	err := syscallcompat.OFDGetlk(fd, &flk)
+	if err != nil {
+		return fs.ToErrno(err)
+	}
+	out.FromFlockT(&flk)
+	tlog.DebugLocks.Printf("ino%d: Getlk: owner=%x type=%d start=%d end=%d -> type=%d pid=%d",
+		f.qIno.Ino, owner, lk.Typ, lk.Start, lk.End, out.Typ, out.Pid)
+	return 0
+}
+
+// Setlk - FUSE call. Acquires or releases a lock, or fails with EAGAIN if a
+// conflicting lock is held.
+func (n *Node) Setlk(ctx context.Context, fh fs.FileHandle, owner uint64, lk *fuse.FileLock, flags uint32) syscall.Errno {
+	return n.setLock(ctx, fh, owner, lk, flags, false)
+}
+
+// Setlkw - FUSE call. Like Setlk, but waits for conflicting locks to go away.
+func (n *Node) Setlkw(ctx context.Context, fh fs.FileHandle, owner uint64, lk *fuse.FileLock, flags uint32) syscall.Errno {
+	return n.setLock(ctx, fh, owner, lk, flags, true)
+}
+
+// Maximum interval between lock attempts in setLock()
+const lockPollMax = 100 * time.Millisecond
+
+func (n *Node) setLock(ctx context.Context, fh fs.FileHandle, owner uint64, lk *fuse.FileLock, flags uint32, wait bool) syscall.Errno {
+	if p, ok := fh.(*passthroughFile); ok {
+		if wait {
+			return p.loopback.(fs.FileSetlkwer).Setlkw(ctx, owner, lk, flags)
+		}
+		return p.loopback.(fs.FileSetlker).Setlk(ctx, owner, lk, flags)
+	}
+	f, ok := fh.(*File)
+	if !ok {
+		return syscall.EBADF
+	}
+	f.fdLock.RLock()
+	defer f.fdLock.RUnlock()
+	if f.released {
+		return syscall.EBADF
+	}
+	tlog.DebugLocks.Printf("ino%d: setLock: owner=%x type=%d start=%d end=%d flags=%x wait=%v",
+		f.qIno.Ino, owner, lk.Typ, lk.Start, lk.End, flags, wait)
+	var try func() error
+	if flags&fuse.FUSE_LK_FLOCK != 0 {
+		var op int
+		switch lk.Typ {
+		case syscall.F_RDLCK:
+			op = syscall.LOCK_SH
+		case syscall.F_WRLCK:
+			op = syscall.LOCK_EX
+		case syscall.F_UNLCK:
+			op = syscall.LOCK_UN
+		default:
+			return syscall.EINVAL
+		}
+		try = func() error {
+			return syscall.Flock(f.intFd(), op|syscall.LOCK_NB)
+		}
+	} else {
+		fd, errno := f.lockFd(owner, lk.Typ != syscall.F_UNLCK)
+		if errno != 0 {
+			return errno
+		}
+		if fd < 0 {
+			// The owner holds no locks, nothing to unlock
+			return 0
+		}
+		var flk syscall.Flock_t
+		lk.ToFlockT(&flk)
+		try = func() error {
+			return syscallcompat.OFDSetlk(fd, &flk)
+		}
+	}
+	// We never block in the syscall, but poll instead. A blocked syscall
+	// could not be interrupted when the caller gets a signal, and would
+	// hang the caller until the lock is released.
+	interval := time.Millisecond
+	for {
+		err := try()
+		if !wait || (err != syscall.EAGAIN && err != syscall.EACCES) {
+			return fs.ToErrno(err)
+		}
+		select {
+		case <-ctx.Done():
+			return syscall.EINTR
+		case <-time.After(interval):
+		}
+		if interval < lockPollMax {
+			interval *= 2
+		}
+	}
+}
+
+// lockFd returns the backing file descriptor that holds the POSIX locks of
+// "owner". If the owner has none yet, it is opened if "create" is set, and
+// -1 is returned otherwise. Caller must hold f.fdLock.
+func (f *File) lockFd(owner uint64, create bool) (int, syscall.Errno) {
+	var open func() (int, error)
+	if create {
+		open = func() (int, error) {
+			// Write locks need a writeable file descriptor. Fall back to
+			// read-only if we do not get one, read locks will still work.
+			fd, err := syscallcompat.Reopen(f.intFd(), syscall.O_RDWR)
+			if err == syscall.EACCES || err == syscall.EROFS {
+				fd, err = syscallcompat.Reopen(f.intFd(), syscall.O_RDONLY)
+			}
+			return fd, err
+		}
+	}
+	fd, err := f.fileTableEntry.LockFd(owner, open)
+	if err != nil {
+		tlog.Warn.Printf("ino%d: opening lock fd failed: %v", f.qIno.Ino, err)
+		return -1, fs.ToErrno(err)
+	}
+	return fd, 0
+}
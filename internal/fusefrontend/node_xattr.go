@@ -7,6 +7,7 @@ import (
 	"strings"
 	"syscall"
 
+	"github.com/rfjakob/gocryptfs/internal/merkle"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
@@ -36,8 +37,30 @@ func (n *Node) Getxattr(ctx context.Context, attr string, dest []byte) (uint32,
 		// and it did not cause trouble. Seems cleaner than saying ENODATA.
 		return 0, syscall.EOPNOTSUPP
 	}
+	if rn.args.Acl && isAcl(attr) {
+		// ACLs are stored unencrypted, so that the backing filesystem
+		// keeps them consistent with the permission bits
+		data, errno := n.getXAttr(attr)
+		if errno != 0 {
+			return 0, errno
+		}
+		if len(data) > len(dest) {
+			return uint32(len(data)), syscall.ERANGE
+		}
+		return uint32(copy(dest, data)), 0
+	}
 	cAttr := rn.encryptXattrName(attr)
 	cData, errno := n.getXAttr(cAttr)
+	if rn.args.XattrSidecar && (errno == errNoXattr || n.useXattrSidecar(errno)) {
+		var data []byte
+		data, errno = n.getXattrSidecar(attr)
+		if errno == 0 {
+			if len(data) > len(dest) {
+				return uint32(len(data)), syscall.ERANGE
+			}
+			return uint32(copy(dest, data)), 0
+		}
+	}
 	if errno != 0 {
 		return 0, errno
 	}
@@ -46,6 +69,10 @@ func (n *Node) Getxattr(ctx context.Context, attr string, dest []byte) (uint32,
 		tlog.Warn.Printf("GetXAttr: %v", err)
 		return ^uint32(0), syscall.EIO
 	}
+	// Applications like rsync first query the size with an empty buffer
+	if len(data) > len(dest) {
+		return uint32(len(data)), syscall.ERANGE
+	}
 	l := copy(dest, data)
 	return uint32(l), 0
 }
@@ -55,10 +82,21 @@ func (n *Node) Getxattr(ctx context.Context, attr string, dest []byte) (uint32,
 // This function is symlink-safe through Fsetxattr.
 func (n *Node) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
 	rn := n.rootNode()
+	if errno := rn.checkWritable(); errno != 0 {
+		return errno
+	}
 	flags = uint32(filterXattrSetFlags(int(flags)))
+	if rn.args.Acl && isAcl(attr) {
+		return n.setXAttr(attr, data, flags)
+	}
 	cAttr := rn.encryptXattrName(attr)
 	cData := rn.encryptXattrValue(data)
-	return n.setXAttr(cAttr, cData, flags)
+	errno := n.setXAttr(cAttr, cData, flags)
+	if n.useXattrSidecar(errno) {
+		tlog.Debug.Printf("Setxattr %q: %v, using sidecar", attr, errno)
+		return n.setXattrSidecar(attr, data, flags)
+	}
+	return errno
 }
 
 // RemoveXAttr - FUSE call.
@@ -66,8 +104,24 @@ func (n *Node) Setxattr(ctx context.Context, attr string, data []byte, flags uin
 // This function is symlink-safe through Fremovexattr.
 func (n *Node) Removexattr(ctx context.Context, attr string) syscall.Errno {
 	rn := n.rootNode()
+	if errno := rn.checkWritable(); errno != 0 {
+		return errno
+	}
+	if rn.args.Acl && isAcl(attr) {
+		return n.removeXAttr(attr)
+	}
 	cAttr := rn.encryptXattrName(attr)
-	return n.removeXAttr(cAttr)
+	errno := n.removeXAttr(cAttr)
+	if !rn.args.XattrSidecar {
+		return errno
+	}
+	if errno == 0 {
+		// Drop a stale copy from the sidecar as well, if there is one
+		n.removeXattrSidecar(attr)
+	} else if errno == errNoXattr || n.useXattrSidecar(errno) {
+		errno = n.removeXattrSidecar(attr)
+	}
+	return errno
 }
 
 // ListXAttr - FUSE call. Lists extended attributes on the file at "relPath".
@@ -75,13 +129,22 @@ func (n *Node) Removexattr(ctx context.Context, attr string) syscall.Errno {
 // This function is symlink-safe through Flistxattr.
 func (n *Node) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errno) {
 	cNames, errno := n.listXAttr()
+	if n.useXattrSidecar(errno) {
+		// Everything is in the sidecar
+		cNames, errno = nil, 0
+	}
 	if errno != 0 {
 		return 0, errno
 	}
 	rn := n.rootNode()
 	var buf bytes.Buffer
+	seen := make(map[string]bool)
 	for _, curName := range cNames {
-		if !strings.HasPrefix(curName, xattrStorePrefix) {
+		if rn.args.Acl && isAcl(curName) {
+			buf.WriteString(curName + "\000")
+			continue
+		}
+		if !strings.HasPrefix(curName, xattrStorePrefix) || curName == merkle.XattrName {
 			continue
 		}
 		name, err := rn.decryptXattrName(curName)
@@ -90,10 +153,22 @@ func (n *Node) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errn
 			rn.reportMitigatedCorruption(curName)
 			continue
 		}
+		seen[name] = true
 		buf.WriteString(name + "\000")
 	}
+	if rn.args.XattrSidecar {
+		names, errno := n.listXattrSidecar()
+		if errno != 0 {
+			return 0, errno
+		}
+		for _, name := range names {
+			if !seen[name] {
+				buf.WriteString(name + "\000")
+			}
+		}
+	}
 	if buf.Len() > len(dest) {
-		return ^uint32(0), syscall.ERANGE
+		return uint32(buf.Len()), syscall.ERANGE
 	}
 	return uint32(copy(dest, buf.Bytes())), 0
 }
@@ -10,6 +10,14 @@ import (
 	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
 )
 
+const (
+	// errNoXattr is returned when an xattr does not exist
+	errNoXattr = syscall.ENOATTR
+	// Flags of setxattr(2)
+	xattrCreate  = unix.XATTR_CREATE
+	xattrReplace = unix.XATTR_REPLACE
+)
+
 // On Darwin we have to unset XATTR_NOSECURITY 0x0008
 func filterXattrSetFlags(flags int) int {
 	// See https://opensource.apple.com/source/xnu/xnu-1504.15.3/bsd/sys/xattr.h.auto.html
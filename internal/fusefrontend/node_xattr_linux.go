@@ -11,6 +11,14 @@ import (
 	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
 )
 
+const (
+	// errNoXattr is returned when an xattr does not exist
+	errNoXattr = syscall.ENODATA
+	// Flags of setxattr(2)
+	xattrCreate  = unix.XATTR_CREATE
+	xattrReplace = unix.XATTR_REPLACE
+)
+
 func filterXattrSetFlags(flags int) int {
 	return flags
 }
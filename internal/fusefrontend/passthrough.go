@@ -0,0 +1,178 @@
+package fusefrontend
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// isPassthroughName returns true if the plaintext file name "name" matches
+// one of the "-passthrough" patterns.
+func (rn *RootNode) isPassthroughName(name string) bool {
+	for _, pattern := range rn.args.Passthrough {
+		// The patterns have been validated in main(), so we can ignore the
+		// error.
+		if match, _ := filepath.Match(pattern, name); match {
+			return true
+		}
+	}
+	return false
+}
+
+// isPassthrough returns true if the plaintext path "relPath" is stored
+// unencrypted in CIPHERDIR. This is the case if the path itself or one of its
+// parent directories matches a "-passthrough" pattern.
+//
+// Because patterns only match file names, renaming a directory keeps the
+// status of everything below it unchanged as long as the status of the
+// directory itself does not change.
+func (rn *RootNode) isPassthrough(relPath string) bool {
+	if len(rn.args.Passthrough) == 0 || relPath == "" {
+		return false
+	}
+	for _, name := range strings.Split(relPath, "/") {
+		if rn.isPassthroughName(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// isFilteredPassthrough returns true if "relPath" would be stored under its
+// plaintext name and clash with our internal files.
+func (rn *RootNode) isFilteredPassthrough(relPath string) bool {
+	if !rn.isPassthrough(relPath) {
+		return false
+	}
+	name := filepath.Base(relPath)
+	if relPath == configfile.ConfDefaultName || isInternalRootName(relPath) || name == nametransform.DirIVFilename ||
+		nametransform.NameType(name) != nametransform.LongNameNone {
+		tlog.Info.Printf("The name %q is reserved and cannot be passed through unencrypted", relPath)
+		return true
+	}
+	return false
+}
+
+// isPassthrough returns true if "child" (or the node itself if "child" is
+// empty) is stored unencrypted. See RootNode.isPassthrough.
+func (n *Node) isPassthrough(child string) bool {
+	rn := n.rootNode()
+	if len(rn.args.Passthrough) == 0 {
+		return false
+	}
+	p := n.Path()
+	if child != "" {
+		p = filepath.Join(p, child)
+	}
+	return rn.isPassthrough(p)
+}
+
+// passthroughOpenFlags is the passthrough equivalent of mangleOpenFlags().
+// As there is no header and no read-modify-write, the flags can be passed on
+// mostly unchanged.
+func passthroughOpenFlags(flags uint32) int {
+	// O_DIRECT would need aligned buffers, but the buffers go-fuse gives us
+	// are not, so drop it like mangleOpenFlags does.
+	return int(flags)&^(syscall.O_CREAT|syscallcompat.O_DIRECT) | syscall.O_NOFOLLOW
+}
+
+// passthroughFile is the file handle for a regular file that is stored
+// unencrypted. All operations go directly to the backing file.
+type passthroughFile struct {
+	// loopback implements the actual I/O
+	loopback fs.FileHandle
+	fd       int
+	rn       *RootNode
+}
+
+// Check that we have implemented the same fs.File* interfaces as File
+var _ = (fs.FileGetattrer)((*passthroughFile)(nil))
+var _ = (fs.FileSetattrer)((*passthroughFile)(nil))
+var _ = (fs.FileReleaser)((*passthroughFile)(nil))
+var _ = (fs.FileReader)((*passthroughFile)(nil))
+var _ = (fs.FileWriter)((*passthroughFile)(nil))
+var _ = (fs.FileFsyncer)((*passthroughFile)(nil))
+var _ = (fs.FileFlusher)((*passthroughFile)(nil))
+var _ = (fs.FileAllocater)((*passthroughFile)(nil))
+var _ = (fs.FileLseeker)((*passthroughFile)(nil))
+
+// newPassthroughFile takes ownership of "fd".
+func newPassthroughFile(fd int, rn *RootNode) *passthroughFile {
+	return &passthroughFile{
+		loopback: fs.NewLoopbackFile(fd),
+		fd:       fd,
+		rn:       rn,
+	}
+}
+
+func (f *passthroughFile) Read(ctx context.Context, buf []byte, off int64) (fuse.ReadResult, syscall.Errno) {
+	return f.loopback.(fs.FileReader).Read(ctx, buf, off)
+}
+
+func (f *passthroughFile) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+	return f.loopback.(fs.FileWriter).Write(ctx, data, off)
+}
+
+func (f *passthroughFile) Release(ctx context.Context) syscall.Errno {
+	return f.loopback.(fs.FileReleaser).Release(ctx)
+}
+
+func (f *passthroughFile) Flush(ctx context.Context) syscall.Errno {
+	return f.loopback.(fs.FileFlusher).Flush(ctx)
+}
+
+func (f *passthroughFile) Fsync(ctx context.Context, flags uint32) syscall.Errno {
+	return f.loopback.(fs.FileFsyncer).Fsync(ctx, flags)
+}
+
+func (f *passthroughFile) Lseek(ctx context.Context, off uint64, whence uint32) (uint64, syscall.Errno) {
+	return f.loopback.(fs.FileLseeker).Lseek(ctx, off, whence)
+}
+
+func (f *passthroughFile) Allocate(ctx context.Context, off uint64, sz uint64, mode uint32) syscall.Errno {
+	err := syscallcompat.Fallocate(f.fd, mode, int64(off), int64(sz))
+	return fs.ToErrno(err)
+}
+
+// Getattr - FUSE call. Like File.Getattr, but without size translation.
+func (f *passthroughFile) Getattr(ctx context.Context, a *fuse.AttrOut) syscall.Errno {
+	var st syscall.Stat_t
+	err := syscall.Fstat(f.fd, &st)
+	if err != nil {
+		return fs.ToErrno(err)
+	}
+	f.rn.inoMap.TranslateStat(&st)
+	a.FromStat(&st)
+	if f.rn.args.ForceOwner != nil {
+		a.Owner = *f.rn.args.ForceOwner
+	}
+	return 0
+}
+
+// Setattr - FUSE call. Called for fchmod, ftruncate, futimens, ...
+func (f *passthroughFile) Setattr(ctx context.Context, in *fuse.SetAttrIn, out *fuse.AttrOut) syscall.Errno {
+	// The loopback sets the timestamps before truncating and with less
+	// precision, so we set them ourselves.
+	in2 := *in
+	in2.Valid &^= fuse.FATTR_ATIME | fuse.FATTR_MTIME | fuse.FATTR_ATIME_NOW | fuse.FATTR_MTIME_NOW
+	errno := f.loopback.(fs.FileSetattrer).Setattr(ctx, &in2, out)
+	if errno != 0 {
+		return errno
+	}
+	if atime, mtime, ok := setAttrTimes(in); ok {
+		errno = fs.ToErrno(syscallcompat.FutimesNano(f.fd, atime, mtime))
+		if errno != 0 {
+			return errno
+		}
+	}
+	return f.Getattr(ctx, out)
+}
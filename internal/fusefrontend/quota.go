@@ -0,0 +1,325 @@
+package fusefrontend
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// Quota, "-quota". The plaintext size of all regular files is kept in
+// RootNode.quotaUsed. Writes, truncates and fallocates that would grow it
+// past the limit fail with EDQUOT. Hard-linked files count once, the trash
+// and the snapshots do not count.
+//
+// The number is stored in "gocryptfs.quota" in the root of CIPHERDIR, so we
+// do not have to walk the whole tree on every mount. The file is marked
+// unclean while mounted. If we crash, it is recomputed on the next mount.
+// "-fsck" also recomputes it. The file is not encrypted, but it tells
+// nothing the sizes of the backing files do not tell already.
+
+// QuotaFileName is the name of the file in the root of CIPHERDIR that
+// stores the quota usage
+const QuotaFileName = "gocryptfs.quota"
+
+// quotaFile is the content of "gocryptfs.quota"
+type quotaFile struct {
+	// Plaintext bytes stored
+	Used int64
+	// Clean is false while the filesystem is mounted
+	Clean bool
+}
+
+// initQuota loads the quota usage, or recomputes it if it has not been saved
+// cleanly, and marks the file unclean.
+func (rn *RootNode) initQuota() {
+	q, err := rn.readQuotaFile()
+	if err != nil || !q.Clean {
+		if err != nil && !os.IsNotExist(err) {
+			tlog.Warn.Printf("quota: %v", err)
+		}
+		tlog.Info.Printf("quota: computing usage of %q", rn.args.Cipherdir)
+		q.Used, err = rn.computeQuotaUsed()
+		if err != nil {
+			tlog.Warn.Printf("quota: computing usage: %v", err)
+		}
+	}
+	atomic.StoreInt64(&rn.quotaUsed, q.Used)
+	if q.Used > rn.args.Quota {
+		tlog.Warn.Printf("quota: %d bytes used, which is over the quota of %d bytes", q.Used, rn.args.Quota)
+	}
+	if rn.args.ReadOnly {
+		// Nothing can change, and we must not write
+		return
+	}
+	if err = rn.writeQuotaFile(quotaFile{Used: q.Used}); err != nil {
+		tlog.Warn.Printf("quota: %v", err)
+	}
+}
+
+// SaveQuota stores the quota usage and marks it clean. Call it after the
+// filesystem has been unmounted.
+func (rn *RootNode) SaveQuota() {
+	if rn.args.Quota == 0 || rn.args.ReadOnly {
+		return
+	}
+	err := rn.writeQuotaFile(quotaFile{Used: atomic.LoadInt64(&rn.quotaUsed), Clean: true})
+	if err != nil {
+		tlog.Warn.Printf("quota: %v", err)
+	}
+}
+
+// RecomputeQuota walks CIPHERDIR and stores the quota usage, if the
+// filesystem has been mounted with "-quota" before. Used by "-fsck".
+// Returns the old and the new usage.
+func (rn *RootNode) RecomputeQuota() (before int64, after int64, err error) {
+	q, err := rn.readQuotaFile()
+	if err != nil {
+		return 0, 0, err
+	}
+	after, err = rn.computeQuotaUsed()
+	if err != nil {
+		return 0, 0, err
+	}
+	return q.Used, after, rn.writeQuotaFile(quotaFile{Used: after, Clean: true})
+}
+
+// invalidateQuota makes the next mount with "-quota" recompute the usage.
+// Used when the files change behind the back of the mount, like
+// "-trash restore" does.
+func (rn *RootNode) invalidateQuota() {
+	q, err := rn.readQuotaFile()
+	if err != nil || !q.Clean {
+		return
+	}
+	if err = rn.writeQuotaFile(quotaFile{Used: q.Used}); err != nil {
+		tlog.Warn.Printf("quota: %v", err)
+	}
+}
+
+func (rn *RootNode) readQuotaFile() (q quotaFile, err error) {
+	dirfd, err := rn.openCipherdir(syscall.O_RDONLY)
+	if err != nil {
+		return q, err
+	}
+	defer syscall.Close(dirfd)
+	fd, err := syscallcompat.Openat(dirfd, QuotaFileName, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return q, &os.PathError{Op: "open", Path: QuotaFileName, Err: err}
+	}
+	f := os.NewFile(uintptr(fd), QuotaFileName)
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return q, err
+	}
+	err = json.Unmarshal(data, &q)
+	return q, err
+}
+
+// writeQuotaFile replaces "gocryptfs.quota" atomically
+func (rn *RootNode) writeQuotaFile(q quotaFile) error {
+	data, err := json.Marshal(q)
+	if err != nil {
+		return err
+	}
+	dirfd, err := rn.openCipherdir(syscall.O_RDONLY)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(dirfd)
+	tmp := QuotaFileName + ".tmp"
+	// Left over from a crash
+	syscallcompat.Unlinkat(dirfd, tmp, 0)
+	fd, err := syscallcompat.Openat(dirfd, tmp, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL|syscall.O_NOFOLLOW, 0600)
+	if err != nil {
+		return err
+	}
+	f := os.NewFile(uintptr(fd), tmp)
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = syscallcompat.Renameat(dirfd, tmp, dirfd, QuotaFileName)
+	}
+	if err != nil {
+		syscallcompat.Unlinkat(dirfd, tmp, 0)
+	}
+	return err
+}
+
+// computeQuotaUsed returns the plaintext size of all regular files in
+// CIPHERDIR
+func (rn *RootNode) computeQuotaUsed() (int64, error) {
+	dirfd, err := rn.openCipherdir(syscall.O_RDONLY)
+	if err != nil {
+		return 0, err
+	}
+	defer syscall.Close(dirfd)
+	var used int64
+	err = rn.quotaWalk(dirfd, true, make(map[uint64]bool), &used)
+	return used, err
+}
+
+// quotaWalk adds the plaintext sizes of the regular files in "dirfd" to
+// "used", recursively. "seen" contains the hard-linked inodes that have been
+// counted already.
+func (rn *RootNode) quotaWalk(dirfd int, isRoot bool, seen map[uint64]bool, used *int64) error {
+	entries, err := syscallcompat.Getdents(dirfd)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		cName := e.Name
+		// Encrypted names never contain a dot, so the internal names of
+		// subtrees with their own key are skipped, too
+		internal := isRoot || !rn.args.PlaintextNames
+		if (internal && (cName == configfile.ConfDefaultName || isInternalRootName(cName))) ||
+			cName == nametransform.DirIVFilename ||
+			nametransform.NameType(cName) == nametransform.LongNameFilename ||
+			nametransform.IsXattrSidecar(cName) {
+			continue
+		}
+		switch e.Mode & syscall.S_IFMT {
+		case syscall.S_IFDIR:
+			fd, err := syscallcompat.Openat(dirfd, cName, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+			if err != nil {
+				return err
+			}
+			err = rn.quotaWalk(fd, false, seen, used)
+			syscall.Close(fd)
+			if err != nil {
+				return err
+			}
+		case syscall.S_IFREG:
+			st, err := syscallcompat.Fstatat2(dirfd, cName, unix.AT_SYMLINK_NOFOLLOW)
+			if err != nil {
+				return err
+			}
+			if st.Nlink > 1 {
+				if seen[uint64(st.Ino)] {
+					continue
+				}
+				seen[uint64(st.Ino)] = true
+			}
+			*used += int64(rn.contentEnc.CipherSizeToPlainSize(uint64(st.Size)))
+		}
+	}
+	return nil
+}
+
+// quotaAlloc accounts for "n" more bytes. Fails with EDQUOT if that would
+// exceed the quota.
+func (rn *RootNode) quotaAlloc(n int64) syscall.Errno {
+	if rn.args.Quota == 0 || n <= 0 {
+		return 0
+	}
+	// Subtrees with their own key count against the whole filesystem
+	rn = rn.top()
+	for {
+		used := atomic.LoadInt64(&rn.quotaUsed)
+		if used+n > rn.args.Quota {
+			return syscall.EDQUOT
+		}
+		if atomic.CompareAndSwapInt64(&rn.quotaUsed, used, used+n) {
+			return 0
+		}
+	}
+}
+
+// quotaFree accounts for "n" bytes less
+func (rn *RootNode) quotaFree(n int64) {
+	if rn.args.Quota == 0 || n <= 0 {
+		return
+	}
+	rn = rn.top()
+	if atomic.AddInt64(&rn.quotaUsed, -n) < 0 {
+		// Cannot happen unless the files have been changed behind our back
+		atomic.StoreInt64(&rn.quotaUsed, 0)
+	}
+}
+
+// quotaFreeStat frees the size of the backing file "st" that is about to
+// be deleted or has been deleted, unless it is not a regular file or has
+// another hard link. "st" may be nil.
+func (rn *RootNode) quotaFreeStat(st *syscall.Stat_t) {
+	if rn.args.Quota == 0 || st == nil {
+		return
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFREG || st.Nlink > 1 {
+		return
+	}
+	rn.quotaFree(int64(rn.contentEnc.CipherSizeToPlainSize(uint64(st.Size))))
+}
+
+// quotaGrow reserves the quota for growing the file to "size" bytes. It
+// returns the size before. If the operation fails, pass both to
+// quotaSettle. The caller must hold ContentLock.
+func (f *File) quotaGrow(size uint64) (before uint64, errno syscall.Errno) {
+	if f.rootNode.args.Quota == 0 {
+		return 0, 0
+	}
+	before, err := f.statPlainSize()
+	if err != nil {
+		return 0, syscall.EIO
+	}
+	if size > before {
+		errno = f.rootNode.quotaAlloc(int64(size - before))
+	}
+	return before, errno
+}
+
+// quotaSettle frees what an operation did not use of the reservation of
+// quotaGrow, or what it freed by shrinking the file. Only call it if
+// quotaGrow has succeeded. The caller must hold ContentLock.
+func (f *File) quotaSettle(before uint64, size uint64) {
+	if f.rootNode.args.Quota == 0 {
+		return
+	}
+	if size < before {
+		size = before
+	}
+	f.fileTableEntry.InvalidateAttr()
+	now, err := f.statPlainSize()
+	if err != nil {
+		return
+	}
+	if now < size {
+		f.rootNode.quotaFree(int64(size - now))
+	}
+}
+
+// quotaStatfs caps the size and free space reported by Statfs to the quota
+func (rn *RootNode) quotaStatfs(st *syscall.Statfs_t) {
+	if rn.args.Quota == 0 || st.Bsize <= 0 {
+		return
+	}
+	rn = rn.top()
+	bsize := uint64(st.Bsize)
+	total := uint64(rn.args.Quota) / bsize
+	var free uint64
+	if used := atomic.LoadInt64(&rn.quotaUsed); used < rn.args.Quota {
+		free = uint64(rn.args.Quota-used) / bsize
+	}
+	if st.Blocks > total {
+		st.Blocks = total
+	}
+	if st.Bfree > free {
+		st.Bfree = free
+	}
+	if st.Bavail > free {
+		st.Bavail = free
+	}
+}
@@ -0,0 +1,181 @@
+package fusefrontend
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// Repair of lost gocryptfs.diriv files, "-fsck -fix".
+//
+// The names in a directory are encrypted with the IV from its
+// gocryptfs.diriv file. When that file is lost, which happens with sync
+// tools that skip files they consider uninteresting, the names cannot be
+// decrypted anymore and the directory is unreadable. The IV is random, so
+// the names are lost for good. The file contents are not affected though.
+//
+// The repair writes a new gocryptfs.diriv and gives each entry a new name,
+// "recovered-" followed by the start of its old encrypted name, encrypted
+// with the new IV. This makes the directory and everything below it
+// readable again.
+
+// RecoveredPrefix is the start of the plaintext names that the repair gives
+// to entries in directories whose gocryptfs.diriv was lost.
+const RecoveredPrefix = "recovered-"
+
+// DirIVReport is called by CheckDirIVs for each directory whose
+// gocryptfs.diriv is missing. "pDir" is the plaintext path of the directory,
+// "renamed" the number of renamed entries if it was repaired, and "err" is
+// set if the repair failed.
+type DirIVReport func(pDir string, renamed int, err error)
+
+// CheckDirIVs looks for directories in CIPHERDIR that have lost their
+// gocryptfs.diriv file and calls "report" for each. If "fix" is set, they
+// are repaired. Must not run while the filesystem is mounted.
+func (rn *RootNode) CheckDirIVs(fix bool, report DirIVReport) error {
+	if rn.args.PlaintextNames || rn.args.DeterministicNames {
+		// There are no gocryptfs.diriv files
+		return nil
+	}
+	dirfd, err := rn.openCipherdir(syscall.O_RDONLY)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(dirfd)
+	rn.checkDirIVsIn(dirfd, "", fix, report)
+	return nil
+}
+
+// checkDirIVsIn checks directory "dirfd", whose plaintext path is "pDir",
+// and everything below it.
+func (rn *RootNode) checkDirIVsIn(dirfd int, pDir string, fix bool, report DirIVReport) {
+	iv, err := rn.readDirIVAt(dirfd)
+	if err == syscall.ENOENT {
+		var renamed int
+		if fix {
+			iv, renamed, err = rn.repairDirIV(dirfd, pDir)
+		}
+		report(filepath.Join(rn.name, pDir), renamed, err)
+		if !fix || err != nil {
+			// The names below cannot be decrypted
+			iv = nil
+		}
+	} else if err != nil {
+		// Corrupt, but not missing. Normal fsck reports this.
+		tlog.Debug.Printf("checkDirIVs: %q: %v", pDir, err)
+		iv = nil
+	}
+	entries, err := syscallcompat.Getdents(dirfd)
+	if err != nil {
+		tlog.Debug.Printf("checkDirIVs: %q: %v", pDir, err)
+		return
+	}
+	for _, e := range entries {
+		if e.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+			continue
+		}
+		cName := e.Name
+		if pDir == "" && isInternalRootName(cName) {
+			// Not part of the filesystem
+			continue
+		}
+		name := cName
+		if iv != nil && !rn.isPassthroughName(cName) {
+			// Without the name, the report uses the encrypted name
+			if n, err := rn.scrubDecryptName(dirfd, cName, iv); err == nil {
+				name = n
+			}
+		}
+		pPath := filepath.Join(pDir, name)
+		if rn.isPassthrough(pPath) {
+			// Stored unencrypted, no gocryptfs.diriv below
+			continue
+		}
+		fd, err := syscallcompat.Openat(dirfd, cName, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+		if err != nil {
+			tlog.Debug.Printf("checkDirIVs: skipping %q: %v", pPath, err)
+			continue
+		}
+		if sub := rn.subtreeAt(dirfd, cName); sub != nil {
+			sub.checkDirIVsIn(fd, "", fix, report)
+		} else {
+			rn.checkDirIVsIn(fd, pPath, fix, report)
+		}
+		syscall.Close(fd)
+	}
+}
+
+// repairDirIV writes a new gocryptfs.diriv into directory "dirfd" and renames
+// all entries to recovered names encrypted with the new IV. Returns the new
+// IV and the number of renamed entries.
+func (rn *RootNode) repairDirIV(dirfd int, pDir string) (iv []byte, renamed int, err error) {
+	entries, err := syscallcompat.Getdents(dirfd)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err = nametransform.WriteDirIVAt(dirfd); err != nil {
+		return nil, 0, err
+	}
+	if iv, err = rn.readDirIVAt(dirfd); err != nil {
+		return nil, 0, err
+	}
+	used := make(map[string]bool)
+	for _, e := range entries {
+		cName := e.Name
+		if (pDir == "" && (strings.HasPrefix(cName, configfile.ConfDefaultName) || isInternalRootName(cName))) ||
+			cName == nametransform.DirIVFilename ||
+			nametransform.NameType(cName) == nametransform.LongNameFilename ||
+			nametransform.IsXattrSidecar(cName) || rn.isPassthroughName(cName) {
+			continue
+		}
+		name := recoveredName(cName, used)
+		newCName, err := rn.nameTransform.EncryptAndHashName(name, iv)
+		if err != nil {
+			return iv, renamed, err
+		}
+		if nametransform.IsLongContent(newCName) {
+			if err = rn.nameTransform.WriteLongNameAt(dirfd, newCName, name); err != nil {
+				return iv, renamed, err
+			}
+		}
+		if err = syscallcompat.Renameat(dirfd, cName, dirfd, newCName); err != nil {
+			return iv, renamed, fmt.Errorf("renaming %q: %v", cName, err)
+		}
+		renamed++
+		if nametransform.IsLongContent(cName) {
+			nametransform.DeleteLongNameAt(dirfd, cName)
+		}
+		// Keep the xattrs stored by "-xattr-sidecar"
+		err = syscallcompat.Renameat(dirfd, rn.nameTransform.XattrSidecarName(cName),
+			dirfd, rn.nameTransform.XattrSidecarName(newCName))
+		if err != nil && err != syscall.ENOENT {
+			tlog.Warn.Printf("repairDirIV: %q: renaming xattr sidecar: %v", pDir, err)
+		}
+	}
+	return iv, renamed, nil
+}
+
+// recoveredName returns a new plaintext name for the entry with the
+// undecryptable name "cName" that is not in "used" yet, and adds it there.
+func recoveredName(cName string, used map[string]bool) string {
+	s := cName
+	if nametransform.IsLongContent(cName) {
+		// Use the hash, not the common prefix
+		s = cName[strings.LastIndex(cName, ".")+1:]
+	}
+	if len(s) > 32 {
+		s = s[:32]
+	}
+	name := RecoveredPrefix + s
+	for i := 2; used[name]; i++ {
+		name = fmt.Sprintf("%s%s-%d", RecoveredPrefix, s, i)
+	}
+	used[name] = true
+	return name
+}
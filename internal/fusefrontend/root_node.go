@@ -20,6 +20,9 @@ import (
 
 // RootNode is the root of the filesystem tree of Nodes.
 type RootNode struct {
+	// quotaUsed is the number of plaintext bytes stored, for "-quota".
+	// Accessed atomically, so it comes first to be 64-bit aligned.
+	quotaUsed int64
 	Node
 	// args stores configuration arguments
 	args Args
@@ -31,6 +34,8 @@ type RootNode struct {
 	nameTransform nametransform.NameTransformer
 	// Content encryption helper
 	contentEnc *contentenc.ContentEnc
+	// Plaintext sizes of symlinks, see sizeCache
+	sizeCache sizeCache
 	// This lock is used by openWriteOnlyFile() to block concurrent opens while
 	// it relaxes the permissions on a file.
 	openWriteOnlyLock sync.RWMutex
@@ -51,6 +56,29 @@ type RootNode struct {
 	// inoMap translates inode numbers from different devices to unique inode
 	// numbers.
 	inoMap *inomap.InoMap
+	// dirCache caches directory fds and DirIVs for openBackingDir()
+	dirCache *dirCacheStruct
+	// foldCache caches directory listings for "-case-insensitive"
+	foldCache foldCacheStruct
+	// xattrSidecarLock serializes access to xattr sidecar files,
+	// "-xattr-sidecar". Sidecars shared by hard links are written in place.
+	xattrSidecarLock sync.Mutex
+	// startTime is when the RootNode was created, for Stats()
+	startTime time.Time
+	// cipherdirFd is CIPHERDIR, opened when the RootNode is created. All
+	// paths are resolved relative to it, so renaming or replacing CIPHERDIR
+	// (or a symlink to it) later does not affect us. -1 if it could not be
+	// opened, then we use the path.
+	cipherdirFd int
+	// parent is the filesystem this one is a subtree with its own key of,
+	// see subtree.go. nil for the top.
+	parent *RootNode
+	// name is the plaintext path of the subtree in the filesystem when it
+	// was added, for messages. Empty for the top.
+	name string
+	// subtrees are the directories in the root that have their own key, by
+	// inode. Only modified before mounting.
+	subtrees map[inomap.QIno]*RootNode
 }
 
 func NewRootNode(args Args, c *contentenc.ContentEnc, n nametransform.NameTransformer) *RootNode {
@@ -60,12 +88,41 @@ func NewRootNode(args Args, c *contentenc.ContentEnc, n nametransform.NameTransf
 	if len(args.Exclude) > 0 {
 		tlog.Warn.Printf("Forward mode does not support -exclude")
 	}
-	return &RootNode{
+	rn := &RootNode{
 		args:          args,
 		nameTransform: n,
 		contentEnc:    c,
 		inoMap:        inomap.New(),
+		dirCache:      newDirCache(args.DirCacheSize),
+		startTime:     time.Now(),
 	}
+	rn.Node.root = rn
+	// Follows symlinks, like the path did before
+	var err error
+	rn.cipherdirFd, err = syscallcompat.Open(args.Cipherdir, syscall.O_DIRECTORY|syscallcompat.O_PATH, 0)
+	if err != nil {
+		tlog.Debug.Printf("NewRootNode: could not open %q: %v", args.Cipherdir, err)
+		rn.cipherdirFd = -1
+	}
+	// Make sure the device of CIPHERDIR gets namespace id zero, so its inode
+	// numbers are passed through unchanged no matter what is looked up first.
+	var st syscall.Stat_t
+	if err := syscall.Stat(args.Cipherdir, &st); err == nil {
+		rn.inoMap.TranslateStat(&st)
+	}
+	if args.Quota > 0 {
+		rn.initQuota()
+	}
+	return rn
+}
+
+// openCipherdir opens CIPHERDIR with "flags" (plus O_DIRECTORY). The caller
+// must close the fd.
+func (rn *RootNode) openCipherdir(flags int) (int, error) {
+	if rn.cipherdirFd < 0 {
+		return syscallcompat.Open(rn.args.Cipherdir, syscall.O_DIRECTORY|flags, 0)
+	}
+	return syscallcompat.Openat(rn.cipherdirFd, ".", syscall.O_DIRECTORY|syscall.O_NOFOLLOW|flags, 0)
 }
 
 // mangleOpenFlags is used by Create() and Open() to convert the open flags the user
@@ -92,16 +149,27 @@ func (rn *RootNode) mangleOpenFlags(flags uint32) (newFlags int) {
 	return newFlags
 }
 
+// checkWritable returns EROFS if the filesystem has been mounted with "-ro".
+// All operations that modify the filesystem call it first, so "-ro" holds
+// even if the kernel does not enforce the "ro" mount option.
+func (rn *RootNode) checkWritable() syscall.Errno {
+	if rn.args.ReadOnly {
+		return syscall.EROFS
+	}
+	return 0
+}
+
 // reportMitigatedCorruption is used to report a corruption that was transparently
 // mitigated and did not return an error to the user. Pass the name of the corrupt
 // item (filename for OpenDir(), xattr name for ListXAttr() etc).
 // See the MitigatedCorruptions channel for more info.
 func (rn *RootNode) reportMitigatedCorruption(item string) {
-	if rn.MitigatedCorruptions == nil {
+	ch := rn.top().MitigatedCorruptions
+	if ch == nil {
 		return
 	}
 	select {
-	case rn.MitigatedCorruptions <- item:
+	case ch <- item:
 	case <-time.After(1 * time.Second):
 		tlog.Warn.Printf("BUG: reportCorruptItem: timeout")
 		//debug.PrintStack()
@@ -109,19 +177,30 @@ func (rn *RootNode) reportMitigatedCorruption(item string) {
 	}
 }
 
+// SnapshotDirName is the directory in the root of CIPHERDIR where
+// "-snapshot create" stores the snapshots
+const SnapshotDirName = "gocryptfs.snapshots"
+
+// isInternalRootName returns true if "cName" in the root of CIPHERDIR is one
+// of our files or directories that are not part of the filesystem
+func isInternalRootName(cName string) bool {
+	return cName == TrashDirName || cName == SnapshotDirName ||
+		cName == QuotaFileName || cName == QuotaFileName+".tmp"
+}
+
 // isFiltered - check if plaintext "path" should be forbidden
 //
 // Prevents name clashes with internal files when file names are not encrypted
 func (rn *RootNode) isFiltered(path string) bool {
-	atomic.StoreUint32(&rn.IsIdle, 0)
+	atomic.StoreUint32(&rn.top().IsIdle, 0)
 
 	if !rn.args.PlaintextNames {
-		return false
+		return rn.isFilteredPassthrough(path)
 	}
-	// gocryptfs.conf in the root directory is forbidden
-	if path == configfile.ConfDefaultName {
-		tlog.Info.Printf("The name /%s is reserved when -plaintextnames is used\n",
-			configfile.ConfDefaultName)
+	// gocryptfs.conf and our other internal names in the root directory are
+	// forbidden
+	if path == configfile.ConfDefaultName || isInternalRootName(path) {
+		tlog.Info.Printf("The name /%s is reserved when -plaintextnames is used\n", path)
 		return true
 	}
 	// Note: gocryptfs.diriv is NOT forbidden because diriv and plaintextnames
@@ -204,54 +283,161 @@ func (rn *RootNode) openWriteOnlyFile(dirfd int, cName string, newFlags int) (rw
 // openBackingDir is secure against symlink races by using Openat and
 // ReadDirIVAt.
 //
+// With "-case-insensitive", every path component is matched against the
+// existing names up to case.
+//
 // Retries on EINTR.
 func (rn *RootNode) openBackingDir(relPath string) (dirfd int, cName string, err error) {
+	dirfd, cName, _, err = rn.openBackingDirCase(relPath)
+	return
+}
+
+// openBackingDirCase is like openBackingDir, but also returns the plaintext
+// name of the last path component as it is stored on disk. With
+// "-case-insensitive", it may differ in case from the name in "relPath".
+func (rn *RootNode) openBackingDirCase(relPath string) (dirfd int, cName string, diskName string, err error) {
 	dirRelPath := nametransform.Dir(relPath)
+	diskName = filepath.Base(relPath)
 	// With PlaintextNames, we don't need to read DirIVs. Easy.
 	if rn.args.PlaintextNames {
-		dirfd, err = syscallcompat.OpenDirNofollow(rn.args.Cipherdir, dirRelPath)
+		dirfd, err = rn.openCipherdir(syscallcompat.O_PATH)
+		if err != nil {
+			return -1, "", "", err
+		}
+		dirfd, err = syscallcompat.OpenDirNofollowAt(dirfd, dirRelPath)
 		if err != nil {
-			return -1, "", err
+			return -1, "", "", err
 		}
 		// If relPath is empty, cName is ".".
 		cName = filepath.Base(relPath)
-		return dirfd, cName, nil
+		return dirfd, cName, diskName, nil
 	}
-	// Open cipherdir (following symlinks)
-	dirfd, err = syscallcompat.Open(rn.args.Cipherdir, syscall.O_DIRECTORY|syscallcompat.O_PATH, 0)
-	if err != nil {
-		return -1, "", err
+	// Cache hit? Then we only have to encrypt the last path component.
+	if relPath != "" {
+		dirfd, iv := rn.dirCache.Lookup(rn.dirCacheKey(dirRelPath))
+		if dirfd > 0 {
+			name := filepath.Base(relPath)
+			if rn.isPassthroughName(name) {
+				return dirfd, name, name, nil
+			}
+			if rn.args.CaseInsensitive {
+				name, err = rn.resolveCase(dirfd, iv, name)
+				if err != nil {
+					syscall.Close(dirfd)
+					return -1, "", "", err
+				}
+			}
+			cName, err = rn.nameTransform.EncryptAndHashBadName(name, iv, dirfd)
+			if err != nil {
+				syscall.Close(dirfd)
+				return -1, "", "", err
+			}
+			return dirfd, cName, name, nil
+		}
 	}
+	generation := rn.dirCache.Generation()
 	// If relPath is empty, cName is ".".
 	if relPath == "" {
-		return dirfd, ".", nil
+		dirfd, err = rn.openCipherdir(syscallcompat.O_PATH)
+		if err != nil {
+			return -1, "", "", err
+		}
+		return dirfd, ".", ".", nil
 	}
-	// Walk the directory tree
 	parts := strings.Split(relPath, "/")
-	for i, name := range parts {
-		iv, err := nametransform.ReadDirIVAt(dirfd)
+	// Start at the deepest directory above that is in the cache, so we only
+	// have to walk and encrypt the rest of the path.
+	dirfd, iv, depth := rn.dirCache.LookupAncestor(rn.dirCacheKey(dirRelPath))
+	if dirfd < 0 {
+		dirfd, err = rn.openCipherdir(syscallcompat.O_PATH)
 		if err != nil {
-			syscall.Close(dirfd)
-			return -1, "", err
+			return -1, "", "", err
 		}
-		cName, err = rn.nameTransform.EncryptAndHashName(name, iv)
-		if err != nil {
-			syscall.Close(dirfd)
-			return -1, "", err
+		depth = 0
+	}
+	// Walk the directory tree
+	passthrough := false
+	for i := depth; i < len(parts); i++ {
+		name := parts[i]
+		// Once we are inside a "-passthrough" directory, everything below
+		// is stored unencrypted and there are no more DirIVs to read.
+		if !passthrough && rn.isPassthroughName(name) {
+			passthrough = true
+		}
+		if passthrough {
+			cName = name
+		} else {
+			if iv == nil {
+				iv, err = rn.readDirIVAt(dirfd)
+				if err != nil {
+					syscall.Close(dirfd)
+					return -1, "", "", err
+				}
+				// Cache every directory on the way, later lookups of
+				// neighbouring paths can start there.
+				rn.dirCache.Store(rn.dirCacheKey(strings.Join(parts[:i], "/")), dirfd, iv, generation)
+			}
+			if rn.args.CaseInsensitive {
+				name, err = rn.resolveCase(dirfd, iv, name)
+				if err != nil {
+					syscall.Close(dirfd)
+					return -1, "", "", err
+				}
+			}
+			cName, err = rn.nameTransform.EncryptAndHashBadName(name, iv, dirfd)
+			if err != nil {
+				syscall.Close(dirfd)
+				return -1, "", "", err
+			}
+			iv = nil
 		}
 		// Last part? We are done.
 		if i == len(parts)-1 {
+			diskName = name
 			break
 		}
 		// Not the last part? Descend into next directory.
 		dirfd2, err := syscallcompat.Openat(dirfd, cName, syscall.O_NOFOLLOW|syscall.O_DIRECTORY|syscallcompat.O_PATH, 0)
 		syscall.Close(dirfd)
 		if err != nil {
-			return -1, "", err
+			return -1, "", "", err
 		}
 		dirfd = dirfd2
 	}
-	return dirfd, cName, nil
+	return dirfd, cName, diskName, nil
+}
+
+// DropCaches empties the directory cache and the case-folding index. Call it
+// when CIPHERDIR has been modified behind our back.
+func (rn *RootNode) DropCaches() {
+	rn.dirCache.Invalidate("")
+	rn.foldCache.Lock()
+	rn.foldCache.dirs = nil
+	rn.foldCache.names = 0
+	rn.foldCache.Unlock()
+	for _, sub := range rn.subtrees {
+		sub.DropCaches()
+	}
+}
+
+// dirCacheKey returns the dirCache key for the plaintext directory path
+// "dirRelPath". With "-case-insensitive", all spellings of a path share one
+// cache entry, so that Invalidate() catches all of them.
+func (rn *RootNode) dirCacheKey(dirRelPath string) string {
+	if rn.args.CaseInsensitive {
+		return foldName(dirRelPath)
+	}
+	return dirRelPath
+}
+
+// readDirIVAt reads the gocryptfs.diriv file from the directory "dirfd".
+// With DeterministicNames, there are no gocryptfs.diriv files and the
+// all-zero IV is returned without doing any I/O.
+func (rn *RootNode) readDirIVAt(dirfd int) (iv []byte, err error) {
+	if rn.args.DeterministicNames {
+		return make([]byte, nametransform.DirIVLen), nil
+	}
+	return nametransform.ReadDirIVAt(dirfd)
 }
 
 // encryptSymlinkTarget: "data" is encrypted like file contents (GCM)
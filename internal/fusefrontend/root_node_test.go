@@ -0,0 +1,70 @@
+package fusefrontend
+
+import (
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// TestReadOnly checks that "-ro" rejects modifications in the frontend,
+// without help from the kernel.
+func TestReadOnly(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	before, err := os.ReadDir(cipherdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := Args{
+		Cipherdir: cipherdir,
+		ReadOnly:  true,
+	}
+	fs := newTestFS(args)
+	out := &fuse.EntryOut{}
+
+	if _, errno := fs.Mkdir(nil, "dir1", 0700, out); errno != syscall.EROFS {
+		t.Errorf("Mkdir: want EROFS, have %v", errno)
+	}
+	if _, _, _, errno := fs.Create(nil, "file1", syscall.O_RDWR, 0600, out); errno != syscall.EROFS {
+		t.Errorf("Create: want EROFS, have %v", errno)
+	}
+	if _, errno := fs.Symlink(nil, "target", "link1", out); errno != syscall.EROFS {
+		t.Errorf("Symlink: want EROFS, have %v", errno)
+	}
+	if _, errno := fs.Mknod(nil, "fifo1", syscall.S_IFIFO|0600, 0, out); errno != syscall.EROFS {
+		t.Errorf("Mknod: want EROFS, have %v", errno)
+	}
+	if errno := fs.Unlink(nil, "gocryptfs.conf"); errno != syscall.EROFS {
+		t.Errorf("Unlink: want EROFS, have %v", errno)
+	}
+	if errno := fs.Rmdir(nil, "dir1"); errno != syscall.EROFS {
+		t.Errorf("Rmdir: want EROFS, have %v", errno)
+	}
+	if errno := fs.Setxattr(nil, "user.foo", []byte("bar"), 0); errno != syscall.EROFS {
+		t.Errorf("Setxattr: want EROFS, have %v", errno)
+	}
+	in := &fuse.SetAttrIn{}
+	in.Valid = fuse.FATTR_MODE
+	in.Mode = 0777
+	if errno := fs.Setattr(nil, nil, in, &fuse.AttrOut{}); errno != syscall.EROFS {
+		t.Errorf("Setattr: want EROFS, have %v", errno)
+	}
+	if _, _, errno := fs.Open(nil, syscall.O_WRONLY); errno != syscall.EROFS {
+		t.Errorf("Open O_WRONLY: want EROFS, have %v", errno)
+	}
+	// Reading still works
+	if errno := fs.Getattr(nil, nil, &fuse.AttrOut{}); errno != 0 {
+		t.Errorf("Getattr: %v", errno)
+	}
+
+	after, err := os.ReadDir(cipherdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(before) {
+		t.Errorf("CIPHERDIR changed: %d entries before, %d after", len(before), len(after))
+	}
+}
@@ -0,0 +1,231 @@
+package fusefrontend
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/inomap"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// Background scrubbing, "-scrub". A low-priority goroutine reads all files
+// in CIPHERDIR and verifies the file headers and the MACs of all blocks, so
+// corruption is found and logged before a user hits it during a read.
+//
+// The scrubber works directly on CIPHERDIR, not through FUSE, and does not
+// use any of the caches. Files that are open at the same time are protected
+// by taking the ContentLock in the open file table, like Read() does.
+
+// Number of ciphertext blocks the scrubber reads at once
+const scrubBlocks = fuse.MAX_KERNEL_WRITE / contentenc.DefaultBS
+
+// Scrub verifies all files in CIPHERDIR in an endless loop, waiting
+// "interval" between passes, until "stop" is closed. Run it in its own
+// goroutine.
+func (rn *RootNode) Scrub(interval time.Duration, stop <-chan struct{}) {
+	// The priority is per thread. The thread exits with the goroutine, so
+	// the lowered priority cannot leak into other goroutines.
+	runtime.LockOSThread()
+	if err := syscallcompat.LowerThreadPriority(); err != nil {
+		tlog.Debug.Printf("scrub: LowerThreadPriority: %v", err)
+	}
+	for {
+		// Nothing can be verified while "-lock" has wiped the keys
+		if !rn.args.KeyLock.Locked() {
+			start := time.Now()
+			corrupt := rn.scrubPass(stop)
+			tlog.Info.Printf("scrub: pass over %q done in %v, %d corrupt items",
+				rn.args.Cipherdir, time.Since(start).Round(time.Second), len(corrupt))
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// scrubPass verifies everything once and returns the plaintext paths of
+// the corrupt items.
+func (rn *RootNode) scrubPass(stop <-chan struct{}) (corrupt []string) {
+	dirfd, err := rn.openCipherdir(syscall.O_RDONLY)
+	if err != nil {
+		tlog.Warn.Printf("scrub: opening CIPHERDIR: %v", err)
+		return nil
+	}
+	defer syscall.Close(dirfd)
+	rn.scrubDir(dirfd, "", stop, &corrupt)
+	return corrupt
+}
+
+// scrubReport logs the corrupt item "pPath" and appends it to "corrupt"
+func (rn *RootNode) scrubReport(corrupt *[]string, pPath string, format string, args ...interface{}) {
+	pPath = filepath.Join(rn.name, pPath)
+	tlog.Warn.Printf("scrub: %q: %s", pPath, fmt.Sprintf(format, args...))
+	*corrupt = append(*corrupt, pPath)
+}
+
+// scrubDir verifies the contents of directory "dirfd", whose plaintext path
+// is "pDir", recursively.
+func (rn *RootNode) scrubDir(dirfd int, pDir string, stop <-chan struct{}, corrupt *[]string) {
+	entries, err := syscallcompat.Getdents(dirfd)
+	if err != nil {
+		rn.scrubReport(corrupt, pDir, "reading directory: %v", err)
+		return
+	}
+	var dirIV []byte
+	if !rn.args.PlaintextNames {
+		dirIV, err = rn.readDirIVAt(dirfd)
+		if err != nil {
+			rn.scrubReport(corrupt, pDir, "reading %s: %v", nametransform.DirIVFilename, err)
+			return
+		}
+	}
+	for _, e := range entries {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		cName := e.Name
+		if (pDir == "" && (cName == configfile.ConfDefaultName || isInternalRootName(cName))) ||
+			cName == nametransform.DirIVFilename ||
+			nametransform.NameType(cName) == nametransform.LongNameFilename ||
+			nametransform.IsXattrSidecar(cName) {
+			continue
+		}
+		name := cName
+		if !rn.args.PlaintextNames {
+			if !rn.args.KeyLock.Enter() {
+				// "-lock" has wiped the keys, the next pass starts over
+				return
+			}
+			name, err = rn.scrubDecryptName(dirfd, cName, dirIV)
+			rn.args.KeyLock.Exit()
+			if err != nil {
+				if !rn.isPassthroughName(cName) {
+					rn.scrubReport(corrupt, filepath.Join(pDir, cName), "decrypting name: %v", err)
+				}
+				continue
+			}
+		}
+		pPath := filepath.Join(pDir, name)
+		if rn.isPassthrough(pPath) {
+			// Stored unencrypted, nothing to verify
+			continue
+		}
+		switch e.Mode & syscall.S_IFMT {
+		case syscall.S_IFDIR:
+			fd, err := syscallcompat.Openat(dirfd, cName, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+			if err != nil {
+				tlog.Debug.Printf("scrub: skipping %q: %v", pPath, err)
+				continue
+			}
+			if sub := rn.subtreeAt(dirfd, cName); sub != nil {
+				sub.scrubDir(fd, "", stop, corrupt)
+			} else {
+				rn.scrubDir(fd, pPath, stop, corrupt)
+			}
+			syscall.Close(fd)
+		case syscall.S_IFREG:
+			rn.scrubFile(dirfd, cName, pPath, corrupt)
+		}
+	}
+}
+
+// scrubDecryptName decrypts the name "cName" found in directory "dirfd".
+func (rn *RootNode) scrubDecryptName(dirfd int, cName string, dirIV []byte) (string, error) {
+	if nametransform.IsLongContent(cName) {
+		var err error
+		cName, err = nametransform.ReadLongNameAt(dirfd, cName)
+		if err != nil {
+			return "", err
+		}
+	}
+	return rn.nameTransform.DecryptName(cName, dirIV)
+}
+
+// scrubFile verifies the header and all blocks of file "cName" in
+// directory "dirfd".
+func (rn *RootNode) scrubFile(dirfd int, cName string, pPath string, corrupt *[]string) {
+	fd, err := syscallcompat.Openat(dirfd, cName, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		// Most likely a permission problem, which is not corruption
+		tlog.Debug.Printf("scrub: skipping %q: %v", pPath, err)
+		return
+	}
+	f := os.NewFile(uintptr(fd), cName)
+	defer f.Close()
+	var st syscall.Stat_t
+	if err = syscall.Fstat(fd, &st); err != nil {
+		tlog.Debug.Printf("scrub: skipping %q: %v", pPath, err)
+		return
+	}
+	qi := inomap.QInoFromStat(&st)
+	entry := openfiletable.Register(qi, nil)
+	defer openfiletable.Unregister(qi)
+
+	cBS := rn.contentEnc.CipherBS()
+	buf := make([]byte, contentenc.HeaderLen+scrubBlocks*int(cBS))
+	var blockNo uint64
+	for {
+		// Read the header together with every chunk. If the file is
+		// truncated and rewritten between two chunks, it has a new ID.
+		entry.ContentLock.RLock()
+		n, err := f.ReadAt(buf[:contentenc.HeaderLen], 0)
+		var m int
+		if err == nil {
+			off := int64(contentenc.HeaderLen) + int64(blockNo*cBS)
+			m, err = f.ReadAt(buf[contentenc.HeaderLen:], off)
+		}
+		entry.ContentLock.RUnlock()
+		if err != nil && err != io.EOF {
+			rn.scrubReport(corrupt, pPath, "read: %v", err)
+			return
+		}
+		if n == 0 || (n == contentenc.HeaderLen && m == 0 && blockNo == 0) {
+			// Empty file, or header-only file, which counts as empty
+			return
+		}
+		if n < contentenc.HeaderLen {
+			rn.scrubReport(corrupt, pPath, "incomplete header, %d bytes", n)
+			return
+		}
+		h, err := contentenc.ParseHeader(buf[:contentenc.HeaderLen])
+		if err != nil {
+			rn.scrubReport(corrupt, pPath, "%v", err)
+			return
+		}
+		if m == 0 {
+			return
+		}
+		if !rn.args.KeyLock.Enter() {
+			return
+		}
+		plaintext, err := rn.contentEnc.DecryptBlocks(buf[contentenc.HeaderLen:contentenc.HeaderLen+m], blockNo, h.ID)
+		rn.args.KeyLock.Exit()
+		ok := len(plaintext) / int(rn.contentEnc.PlainBS())
+		rn.contentEnc.PReqPool.Put(plaintext)
+		if err != nil {
+			rn.scrubReport(corrupt, pPath, "block %d: %v", blockNo+uint64(ok), err)
+			return
+		}
+		if m < len(buf)-contentenc.HeaderLen {
+			// End of file
+			return
+		}
+		blockNo += scrubBlocks
+	}
+}
@@ -0,0 +1,68 @@
+package fusefrontend
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// TestScrub checks that the scrubber finds a corrupt block, and only that.
+func TestScrub(t *testing.T) {
+	cipherdir := test_helpers.InitFS(t)
+	fs := newTestFS(Args{Cipherdir: cipherdir})
+	ctx := context.Background()
+	out := &fuse.EntryOut{}
+
+	dir, errno := fs.Mkdir(ctx, "dir1", 0700, out)
+	if errno != 0 {
+		t.Fatal(errno)
+	}
+	// Without a kernel, we have to add the new directory to the tree ourselves
+	fs.AddChild("dir1", dir, true)
+	// Several scrub chunks, written in pieces that fit into a FUSE request
+	data := make([]byte, 100000)
+	for _, name := range []string{"good", "bad"} {
+		_, fh, _, errno := dir.Operations().(*Node).Create(ctx, name, syscall.O_RDWR, 0600, out)
+		if errno != 0 {
+			t.Fatal(errno)
+		}
+		f := fh.(*File)
+		for off := int64(0); off < 300000; off += int64(len(data)) {
+			if _, errno := f.Write(ctx, data, off); errno != 0 {
+				t.Fatal(errno)
+			}
+		}
+		f.Release(ctx)
+	}
+	if corrupt := fs.scrubPass(nil); len(corrupt) != 0 {
+		t.Fatalf("clean filesystem: scrub reported %v", corrupt)
+	}
+
+	// Flip a byte in block 40 of "bad", which is in the second chunk
+	cPath, err := fs.EncryptPath("dir1/bad")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(cipherdir+"/"+cPath, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	off := int64(18 + 40*fs.contentEnc.CipherBS() + 100)
+	buf := make([]byte, 1)
+	f.ReadAt(buf, off)
+	buf[0] ^= 1
+	if _, err := f.WriteAt(buf, off); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	corrupt := fs.scrubPass(nil)
+	if len(corrupt) != 1 || corrupt[0] != "dir1/bad" {
+		t.Errorf("want [dir1/bad], have %v", corrupt)
+	}
+}
@@ -0,0 +1,104 @@
+package fusefrontend
+
+import (
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/internal/inomap"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// Secure delete, "-shred". Ciphertext is overwritten with random data
+// before it is deleted or cut off: file contents on unlink, when a rename
+// replaces a file, on O_TRUNC and on truncate, and the companion files
+// (".name" files, gocryptfs.diriv and xattr sidecars) when they are deleted.
+// See syscallcompat.Wipe for what this cannot do.
+
+// shredAt overwrites the backing file "cName" in "dirfd" if "-shred" is on.
+// Errors are logged, the caller deletes the file anyway.
+func (rn *RootNode) shredAt(dirfd int, cName string) {
+	if !rn.args.Shred {
+		return
+	}
+	err := syscallcompat.WipeAt(dirfd, cName)
+	if err != nil && err != syscall.ENOENT {
+		tlog.Warn.Printf("shred %q: %v", cName, err)
+	}
+}
+
+// shredLongNameAt overwrites the ".name" file that belongs to "cName", if
+// there is one
+func (rn *RootNode) shredLongNameAt(dirfd int, cName string) {
+	if rn.args.PlaintextNames || !nametransform.IsLongContent(cName) {
+		return
+	}
+	rn.shredAt(dirfd, cName+nametransform.LongNameSuffix)
+}
+
+// openShredTarget opens the file "cName" in "dirfd" that a rename with
+// "flags" is about to replace, so shredTarget can overwrite it once it is
+// gone. Returns -1 if there is nothing to do.
+func (rn *RootNode) openShredTarget(dirfd int, cName string, flags uint32) int {
+	if !rn.args.Shred || flags&(syscallcompat.RENAME_NOREPLACE|syscallcompat.RENAME_EXCHANGE) != 0 {
+		return -1
+	}
+	fd, err := syscallcompat.OpenWipeAt(dirfd, cName)
+	if err != nil && err != syscall.ENOENT {
+		tlog.Warn.Printf("shred %q: %v", cName, err)
+	}
+	return fd
+}
+
+// shredTarget overwrites and closes "fd" from openShredTarget. If the rename
+// failed ("ok" is false), the file is still there and is only closed.
+func shredTarget(fd int, ok bool) {
+	if fd < 0 {
+		return
+	}
+	if !ok {
+		syscall.Close(fd)
+		return
+	}
+	wipeUnlinked(fd)
+}
+
+// wipeUnlinked overwrites and closes "fd", a file that has just lost a name
+// through unlink or rename. While the file is still open through the mount,
+// the wipe waits for the last file handle to be released, so the programs
+// using it do not see their data destroyed. A file that still has a name,
+// through another hard link, is not overwritten.
+func wipeUnlinked(fd int) {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		syscall.Close(fd)
+		return
+	}
+	wipe := func() {
+		defer syscall.Close(fd)
+		var st syscall.Stat_t
+		if err := syscall.Fstat(fd, &st); err != nil || st.Nlink > 0 {
+			return
+		}
+		if err := syscallcompat.Wipe(fd); err != nil {
+			tlog.Warn.Printf("wipe: %v", err)
+		}
+	}
+	if openfiletable.OnRelease(inomap.QInoFromStat(&st), wipe) {
+		tlog.Debug.Printf("wipe: ino%d is still open, waiting for the last release", st.Ino)
+		return
+	}
+	wipe()
+}
+
+// shredFrom overwrites the ciphertext after "cipherOff" before the file is
+// truncated to it
+func (f *File) shredFrom(cipherOff uint64) {
+	if !f.rootNode.args.Shred {
+		return
+	}
+	if err := syscallcompat.WipeFrom(f.intFd(), int64(cipherOff)); err != nil {
+		tlog.Warn.Printf("ino%d: shred: %v", f.qIno.Ino, err)
+	}
+}
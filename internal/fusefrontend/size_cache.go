@@ -0,0 +1,64 @@
+package fusefrontend
+
+import (
+	"sync"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// sizeCacheMax is the number of entries after which the sizeCache is emptied
+const sizeCacheMax = 10000
+
+// sizeKey identifies a version of a backing file. Replacing the file gives
+// a new inode number or a new ctime, so an entry can never be used for the
+// wrong content.
+type sizeKey struct {
+	ino       uint64
+	size      uint64
+	mtime     uint64
+	mtimensec uint32
+	ctime     uint64
+	ctimensec uint32
+}
+
+// sizeCache caches the plaintext sizes of symlinks. The size of a regular
+// file is simple arithmetic, but the size of a symlink is the length of the
+// decrypted target, so every GETATTR and LOOKUP of a symlink would read and
+// decrypt it. For READDIRPLUS, go-fuse looks up every entry, which fills the
+// cache, so the GETATTRs of "ls -l" and "du" that follow only need the backing
+// stat.
+type sizeCache struct {
+	sync.Mutex
+	m map[sizeKey]uint64
+}
+
+func sizeKeyOf(a *fuse.Attr) sizeKey {
+	return sizeKey{
+		ino:       a.Ino,
+		size:      a.Size,
+		mtime:     a.Mtime,
+		mtimensec: a.Mtimensec,
+		ctime:     a.Ctime,
+		ctimensec: a.Ctimensec,
+	}
+}
+
+// Lookup returns the plaintext size of the file described by the
+// ciphertext attributes "a".
+func (c *sizeCache) Lookup(a *fuse.Attr) (size uint64, ok bool) {
+	c.Lock()
+	size, ok = c.m[sizeKeyOf(a)]
+	c.Unlock()
+	return size, ok
+}
+
+// Store remembers that the file described by the ciphertext attributes "a"
+// has the plaintext size "size".
+func (c *sizeCache) Store(a *fuse.Attr, size uint64) {
+	c.Lock()
+	if c.m == nil || len(c.m) >= sizeCacheMax {
+		c.m = make(map[sizeKey]uint64)
+	}
+	c.m[sizeKeyOf(a)] = size
+	c.Unlock()
+}
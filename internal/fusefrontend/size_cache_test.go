@@ -0,0 +1,32 @@
+package fusefrontend
+
+import (
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestSizeCache(t *testing.T) {
+	var c sizeCache
+	a := fuse.Attr{Ino: 1, Size: 40, Mtime: 100, Ctime: 100}
+	if _, ok := c.Lookup(&a); ok {
+		t.Fatal("hit in empty cache")
+	}
+	c.Store(&a, 7)
+	if size, ok := c.Lookup(&a); !ok || size != 7 {
+		t.Errorf("want size 7, have %d, %v", size, ok)
+	}
+	// A new version of the file must miss
+	b := a
+	b.Ctimensec = 1
+	if _, ok := c.Lookup(&b); ok {
+		t.Error("hit after ctime change")
+	}
+	for i := 0; i < sizeCacheMax; i++ {
+		b.Ino = uint64(i + 2)
+		c.Store(&b, 1)
+	}
+	if len(c.m) > sizeCacheMax {
+		t.Errorf("cache has grown to %d entries", len(c.m))
+	}
+}
@@ -0,0 +1,158 @@
+package fusefrontend
+
+import (
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/internal/inomap"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+)
+
+// Per-directory keys, "-dirkey". A top-level directory can have its own
+// master key, derived from the master key of the filesystem and the
+// directory's gocryptfs.diriv. Everything below it is encrypted with that
+// key. The directory contains a gocryptfs.conf that stores the key,
+// encrypted with a password of its own, so the directory is a complete
+// CIPHERDIR by itself: whoever knows that password can mount it, and
+// nothing else.
+//
+// When the whole filesystem is mounted, such a subtree is served by a
+// RootNode of its own, grafted into the tree in place of the directory.
+// Renames and hard links between subtrees return EXDEV.
+
+// SubtreeConfName is the control file in the backing directory of a
+// subtree that has its own key
+const SubtreeConfName = configfile.ConfDefaultName
+
+// ListSubtrees returns the encrypted names of the directories in the root
+// of CIPHERDIR that have their own key.
+func (rn *RootNode) ListSubtrees() ([]string, error) {
+	if rn.args.PlaintextNames || rn.args.DeterministicNames {
+		// Subtree keys are derived from the DirIV
+		return nil, nil
+	}
+	dirfd, err := rn.openCipherdir(syscall.O_RDONLY)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(dirfd)
+	entries, err := syscallcompat.Getdents(dirfd)
+	if err != nil {
+		return nil, err
+	}
+	var out []string
+	for _, e := range entries {
+		if e.Mode&syscall.S_IFMT != syscall.S_IFDIR || isInternalRootName(e.Name) {
+			continue
+		}
+		if _, err := syscallcompat.Fstatat2(dirfd, filepath.Join(e.Name, SubtreeConfName), unix.AT_SYMLINK_NOFOLLOW); err == nil {
+			out = append(out, e.Name)
+		}
+	}
+	return out, nil
+}
+
+// AddSubtree makes the directory "cName" in the root of CIPHERDIR, which
+// has its own key, a subtree that is encrypted with "c" and "n". Must be
+// called before mounting. Returns the new RootNode, so subtrees of the
+// subtree can be added to it.
+func (rn *RootNode) AddSubtree(cName string, c *contentenc.ContentEnc, n nametransform.NameTransformer) (*RootNode, error) {
+	dirfd, err := rn.openCipherdir(syscallcompat.O_PATH)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(dirfd)
+	st, err := syscallcompat.Fstatat2(dirfd, cName, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		return nil, err
+	}
+	args := rn.args
+	args.Cipherdir = filepath.Join(rn.args.Cipherdir, cName)
+	// Both are global, the top RootNode takes care of them
+	args.Quota = 0
+	args.SerializeReads = false
+	sub := NewRootNode(args, c, n)
+	if sub.cipherdirFd < 0 {
+		return nil, syscall.ENOENT
+	}
+	sub.args.Quota = rn.args.Quota
+	sub.args.SerializeReads = rn.args.SerializeReads
+	sub.parent = rn
+	if sub.name, err = rn.DecryptPath(cName); err != nil {
+		sub.name = cName
+	}
+	sub.name = filepath.Join(rn.name, sub.name)
+	sub.inoMap = rn.inoMap
+	if rn.subtrees == nil {
+		rn.subtrees = make(map[inomap.QIno]*RootNode)
+	}
+	rn.subtrees[inomap.QInoFromStat(st)] = sub
+	return sub, nil
+}
+
+// SubtreeDirIV returns the DirIV of the directory "cName" in the root of
+// CIPHERDIR, which the key of a subtree is derived from
+func (rn *RootNode) SubtreeDirIV(cName string) ([]byte, error) {
+	dirfd, err := rn.openCipherdir(syscallcompat.O_PATH)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(dirfd)
+	fd, err := syscallcompat.Openat(dirfd, cName, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(fd)
+	return nametransform.ReadDirIVAt(fd)
+}
+
+// subtreeAt returns the subtree that the directory "cName" in "dirfd" is
+// the root of, or nil
+func (rn *RootNode) subtreeAt(dirfd int, cName string) *RootNode {
+	if rn.subtrees == nil {
+		return nil
+	}
+	st, err := syscallcompat.Fstatat2(dirfd, cName, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		return nil
+	}
+	return rn.subtrees[inomap.QInoFromStat(st)]
+}
+
+// subtreeOf returns the subtree that the first component of "cPath" is the
+// root of, and the rest of "cPath". Returns nil if there is none.
+func (rn *RootNode) subtreeOf(cPath string) (sub *RootNode, cRest string) {
+	if rn.subtrees == nil || rn.args.PlaintextNames {
+		return nil, ""
+	}
+	cFirst, cRest := splitFirst(cPath)
+	dirfd, err := rn.openCipherdir(syscallcompat.O_PATH)
+	if err != nil {
+		return nil, ""
+	}
+	defer syscall.Close(dirfd)
+	return rn.subtreeAt(dirfd, cFirst), cRest
+}
+
+// splitFirst splits "path" after the first component
+func splitFirst(path string) (first string, rest string) {
+	path = strings.Trim(path, "/")
+	if i := strings.IndexByte(path, '/'); i >= 0 {
+		return path[:i], path[i+1:]
+	}
+	return path, ""
+}
+
+// top returns the RootNode of the whole filesystem
+func (rn *RootNode) top() *RootNode {
+	for rn.parent != nil {
+		rn = rn.parent
+	}
+	return rn
+}
@@ -0,0 +1,395 @@
+package fusefrontend
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/inomap"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/openfiletable"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// Trash, "-trash-retention". Unlink and Rmdir do not delete, but move the
+// backing file or directory into the hidden directory "gocryptfs.trash" in
+// the root of CIPHERDIR, where it stays until the retention time is over.
+//
+// Every entry is renamed to "[unix time of deletion]-[random hex]", the ID.
+// The plaintext path it was deleted from is stored encrypted in
+// "[ID].info" next to it. The ID leaks the time of the deletion, but
+// nothing about the name.
+
+// TrashDirName is the name of the trash directory in the root of CIPHERDIR
+const TrashDirName = "gocryptfs.trash"
+
+// trashInfoSuffix is appended to the ID for the file with the trashInfo
+const trashInfoSuffix = ".info"
+
+// trashPurgeInterval is how often TrashPurger looks for expired entries
+const trashPurgeInterval = time.Hour
+
+// trashInfo is stored encrypted in "[ID].info"
+type trashInfo struct {
+	// Plaintext path relative to the root of the filesystem
+	Path string
+}
+
+// TrashEntry is a deleted file or directory, as returned by TrashList
+type TrashEntry struct {
+	ID string
+	// Plaintext path it was deleted from. Empty if "[ID].info" is missing
+	// or corrupt.
+	Path    string
+	Deleted time.Time
+	IsDir   bool
+}
+
+// newTrashID returns a new, unique ID for an entry deleted at "t"
+func newTrashID(t time.Time) string {
+	return fmt.Sprintf("%d-%016x", t.Unix(), cryptocore.RandUint64())
+}
+
+// parseTrashID returns the time of the deletion encoded in "id"
+func parseTrashID(id string) (time.Time, bool) {
+	parts := strings.SplitN(id, "-", 2)
+	if len(parts) != 2 || len(parts[1]) != 16 {
+		return time.Time{}, false
+	}
+	// Also makes sure that user-supplied IDs cannot contain a "/"
+	sec, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	if _, err = strconv.ParseUint(parts[1], 16, 64); err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(sec, 0), true
+}
+
+// openTrash opens the trash directory, and creates it first if "create" is
+// set.
+func (rn *RootNode) openTrash(create bool) (int, error) {
+	rootfd, err := rn.openCipherdir(syscall.O_RDONLY)
+	if err != nil {
+		return -1, err
+	}
+	defer syscall.Close(rootfd)
+	if create {
+		err = syscallcompat.Mkdirat(rootfd, TrashDirName, 0700)
+		if err != nil && err != syscall.EEXIST {
+			return -1, err
+		}
+	}
+	return syscallcompat.Openat(rootfd, TrashDirName,
+		syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+}
+
+// moveToTrash moves the backing file or directory (dirfd, cName), whose
+// plaintext path is "pPath", into the trash.
+func (rn *RootNode) moveToTrash(dirfd int, cName string, pPath string) error {
+	trashfd, err := rn.openTrash(true)
+	if err != nil {
+		tlog.Warn.Printf("moveToTrash: opening %s: %v", TrashDirName, err)
+		return err
+	}
+	defer syscall.Close(trashfd)
+	id := newTrashID(time.Now())
+	data, err := json.Marshal(trashInfo{Path: pPath})
+	if err != nil {
+		return err
+	}
+	err = rn.writeTrashInfo(trashfd, id, rn.contentEnc.EncryptBlock(data, 0, nil))
+	if err != nil {
+		tlog.Warn.Printf("moveToTrash: writing %s%s: %v", id, trashInfoSuffix, err)
+		return err
+	}
+	err = syscallcompat.Renameat(dirfd, cName, trashfd, id)
+	if err != nil {
+		syscallcompat.Unlinkat(trashfd, id+trashInfoSuffix, 0)
+		return err
+	}
+	// The long name is encrypted with the IV of the parent directory, so
+	// there is no point in keeping it. Restoring writes a new one.
+	if !rn.args.PlaintextNames && nametransform.IsLongContent(cName) {
+		err = nametransform.DeleteLongNameAt(dirfd, cName)
+		if err != nil {
+			tlog.Warn.Printf("moveToTrash: could not delete .name file: %v", err)
+		}
+	}
+	rn.renameXattrSidecar(dirfd, cName, trashfd, id, 0)
+	return nil
+}
+
+// writeTrashInfo writes "[id].info" in "trashfd" and syncs it, so it is on
+// disk before the entry is moved into the trash.
+func (rn *RootNode) writeTrashInfo(trashfd int, id string, cData []byte) error {
+	fd, err := syscallcompat.Openat(trashfd, id+trashInfoSuffix,
+		syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL|syscall.O_NOFOLLOW, 0400)
+	if err != nil {
+		return err
+	}
+	f := os.NewFile(uintptr(fd), id+trashInfoSuffix)
+	_, err = f.Write(cData)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		syscallcompat.Unlinkat(trashfd, id+trashInfoSuffix, 0)
+	}
+	return err
+}
+
+// readTrashInfo reads and decrypts "[id].info" in "trashfd"
+func (rn *RootNode) readTrashInfo(trashfd int, id string) (info trashInfo, err error) {
+	fd, err := syscallcompat.Openat(trashfd, id+trashInfoSuffix,
+		syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return info, err
+	}
+	f := os.NewFile(uintptr(fd), id+trashInfoSuffix)
+	cData, err := ioutil.ReadAll(f)
+	f.Close()
+	if err != nil {
+		return info, err
+	}
+	data, err := rn.contentEnc.DecryptBlock(cData, 0, nil)
+	if err != nil {
+		return info, err
+	}
+	err = json.Unmarshal(data, &info)
+	return info, err
+}
+
+// rmdirToTrash moves the directory (parentDirFd, cName), whose plaintext
+// path is "pPath", into the trash if it is empty.
+func (rn *RootNode) rmdirToTrash(parentDirFd int, cName string, pPath string) error {
+	dirfd, err := syscallcompat.Openat(parentDirFd, cName,
+		syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	children, err := syscallcompat.Getdents(dirfd)
+	syscall.Close(dirfd)
+	if err != nil {
+		return err
+	}
+	// gocryptfs.diriv is a user file with plaintext names
+	plain := rn.args.PlaintextNames || rn.isPassthrough(pPath)
+	for _, c := range children {
+		if plain || c.Name != nametransform.DirIVFilename {
+			return syscall.ENOTEMPTY
+		}
+	}
+	// A file created in the directory right now ends up in the trash with
+	// it, and can be restored along with the directory.
+	return rn.moveToTrash(parentDirFd, cName, pPath)
+}
+
+// TrashList returns the entries in the trash, oldest first
+func (rn *RootNode) TrashList() ([]TrashEntry, error) {
+	trashfd, err := rn.openTrash(false)
+	if err == syscall.ENOENT {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(trashfd)
+	names, err := syscallcompat.Getdents(trashfd)
+	if err != nil {
+		return nil, err
+	}
+	var entries []TrashEntry
+	for _, n := range names {
+		deleted, ok := parseTrashID(n.Name)
+		if !ok {
+			// "[ID].info" or xattr sidecar
+			continue
+		}
+		e := TrashEntry{ID: n.Name, Deleted: deleted, IsDir: n.Mode&syscall.S_IFMT == syscall.S_IFDIR}
+		info, err := rn.readTrashInfo(trashfd, n.Name)
+		if err != nil {
+			tlog.Warn.Printf("trash: %s%s: %v", n.Name, trashInfoSuffix, err)
+		} else {
+			e.Path = info.Path
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].Deleted.Equal(entries[j].Deleted) {
+			return entries[i].Deleted.Before(entries[j].Deleted)
+		}
+		return entries[i].ID < entries[j].ID
+	})
+	return entries, nil
+}
+
+// TrashRestore moves the entry "id" back to the path it was deleted from.
+// The parent directory must exist, and nothing else may have taken its
+// place.
+func (rn *RootNode) TrashRestore(id string) error {
+	if _, ok := parseTrashID(id); !ok {
+		return fmt.Errorf("%q is not a trash ID", id)
+	}
+	trashfd, err := rn.openTrash(false)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(trashfd)
+	info, err := rn.readTrashInfo(trashfd, id)
+	if err != nil {
+		return err
+	}
+	dirfd, cName, err := rn.openBackingDir(info.Path)
+	if err != nil {
+		return fmt.Errorf("%q: parent directory: %v", info.Path, err)
+	}
+	defer syscall.Close(dirfd)
+	// Renameat2 ignores RENAME_NOREPLACE on MacOS
+	if _, err = syscallcompat.Fstatat2(dirfd, cName, unix.AT_SYMLINK_NOFOLLOW); err == nil {
+		return fmt.Errorf("%q: %v", info.Path, syscall.EEXIST)
+	}
+	longName := !rn.args.PlaintextNames && nametransform.IsLongContent(cName)
+	if longName {
+		err = rn.nameTransform.WriteLongNameAt(dirfd, cName, filepath.Base(info.Path))
+		if err != nil {
+			return err
+		}
+	}
+	err = syscallcompat.Renameat2(trashfd, id, dirfd, cName, syscallcompat.RENAME_NOREPLACE)
+	if err != nil {
+		if longName {
+			nametransform.DeleteLongNameAt(dirfd, cName)
+		}
+		return fmt.Errorf("%q: %v", info.Path, err)
+	}
+	rn.renameXattrSidecar(trashfd, id, dirfd, cName, 0)
+	// The trash does not count against the quota, but the restored entry does
+	rn.invalidateQuota()
+	return syscallcompat.Unlinkat(trashfd, id+trashInfoSuffix, 0)
+}
+
+// TrashPurge deletes the entry "id" from the trash for good
+func (rn *RootNode) TrashPurge(id string) error {
+	if _, ok := parseTrashID(id); !ok {
+		return fmt.Errorf("%q is not a trash ID", id)
+	}
+	trashfd, err := rn.openTrash(false)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(trashfd)
+	if _, err = syscallcompat.Fstatat2(trashfd, id, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return err
+	}
+	return rn.purgeTrashEntry(trashfd, id)
+}
+
+// purgeTrashEntry deletes "id" and the files that belong to it
+func (rn *RootNode) purgeTrashEntry(trashfd int, id string) error {
+	err := removeAllAt(trashfd, id)
+	if err != nil {
+		return err
+	}
+	rn.deleteXattrSidecar(trashfd, id)
+	err = syscallcompat.Unlinkat(trashfd, id+trashInfoSuffix, 0)
+	if err == syscall.ENOENT {
+		err = nil
+	}
+	return err
+}
+
+// TrashPurger deletes trash entries older than "retention" once an hour, or
+// more often if the retention is shorter, until "stop" is closed. Run it in
+// its own goroutine.
+func (rn *RootNode) TrashPurger(retention time.Duration, stop <-chan struct{}) {
+	interval := trashPurgeInterval
+	if retention < interval {
+		interval = retention
+	}
+	for {
+		rn.purgeExpired(time.Now().Add(-retention))
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// purgeExpired deletes all trash entries deleted before "cutoff"
+func (rn *RootNode) purgeExpired(cutoff time.Time) {
+	// Subtrees with their own key have their own trash
+	for _, sub := range rn.subtrees {
+		sub.purgeExpired(cutoff)
+	}
+	trashfd, err := rn.openTrash(false)
+	if err == syscall.ENOENT {
+		return
+	} else if err != nil {
+		tlog.Warn.Printf("trash: %v", err)
+		return
+	}
+	defer syscall.Close(trashfd)
+	names, err := syscallcompat.Getdents(trashfd)
+	if err != nil {
+		tlog.Warn.Printf("trash: %v", err)
+		return
+	}
+	for _, n := range names {
+		// Also catches "[ID].info" files left behind by a crash in
+		// moveToTrash
+		id := strings.TrimSuffix(n.Name, trashInfoSuffix)
+		deleted, ok := parseTrashID(id)
+		if !ok || !deleted.Before(cutoff) {
+			continue
+		}
+		if err := rn.purgeTrashEntry(trashfd, id); err != nil {
+			tlog.Warn.Printf("trash: purging %s: %v", id, err)
+		}
+	}
+}
+
+// removeAllAt deletes "name" in "dirfd" and, if it is a directory,
+// everything below it. It is not an error if "name" does not exist.
+func removeAllAt(dirfd int, name string) error {
+	st, err := syscallcompat.Fstatat2(dirfd, name, unix.AT_SYMLINK_NOFOLLOW)
+	if err == syscall.ENOENT {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		// A new file may get the same inode number
+		openfiletable.ForgetID(inomap.QInoFromStat(st))
+		return syscallcompat.Unlinkat(dirfd, name, 0)
+	}
+	// Directories moved into the trash keep their permissions
+	syscallcompat.FchmodatNofollow(dirfd, name, 0700)
+	fd, err := syscallcompat.Openat(dirfd, name,
+		syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	children, err := syscallcompat.Getdents(fd)
+	for i := 0; err == nil && i < len(children); i++ {
+		err = removeAllAt(fd, children[i].Name)
+	}
+	syscall.Close(fd)
+	if err != nil {
+		return err
+	}
+	return syscallcompat.Unlinkat(dirfd, name, unix.AT_REMOVEDIR)
+}
@@ -0,0 +1,288 @@
+package fusefrontend
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// xattrSidecar is the decrypted content of an xattr sidecar file: the
+// plaintext xattr names and values of one backing file that the backing
+// filesystem could not store, "-xattr-sidecar".
+type xattrSidecar map[string][]byte
+
+// useXattrSidecar returns true if the backing filesystem refused to store an
+// xattr with "errno", and the xattr should go to the sidecar file instead.
+func (n *Node) useXattrSidecar(errno syscall.Errno) bool {
+	rn := n.rootNode()
+	if !rn.args.XattrSidecar || rn.isPassthrough(n.Path()) {
+		return false
+	}
+	switch errno {
+	case syscall.EOPNOTSUPP, syscall.E2BIG, syscall.ENOSPC:
+		return true
+	case syscall.EPERM:
+		// Linux does not allow "user." xattrs on symlinks and special files.
+		// On files and directories, EPERM is a real permission problem.
+		fmt := n.StableAttr().Mode & syscall.S_IFMT
+		return fmt != syscall.S_IFREG && fmt != syscall.S_IFDIR
+	}
+	return false
+}
+
+// readXattrSidecar reads and decrypts the sidecar file of the backing file
+// (dirfd, cName). A missing sidecar file is returned as an empty map.
+func (rn *RootNode) readXattrSidecar(dirfd int, cName string) (xattrSidecar, error) {
+	sName := rn.nameTransform.XattrSidecarName(cName)
+	fd, err := syscallcompat.Openat(dirfd, sName, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err == syscall.ENOENT {
+		return xattrSidecar{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(fd), sName)
+	defer f.Close()
+	cData, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	data, err := rn.decryptXattrValue(cData)
+	if err != nil {
+		tlog.Warn.Printf("readXattrSidecar %q: %v", sName, err)
+		rn.reportMitigatedCorruption(sName)
+		return nil, syscall.EIO
+	}
+	s := xattrSidecar{}
+	if err = json.Unmarshal(data, &s); err != nil {
+		tlog.Warn.Printf("readXattrSidecar %q: %v", sName, err)
+		return nil, syscall.EIO
+	}
+	return s, nil
+}
+
+// writeXattrSidecar encrypts and writes "s" to the sidecar file of the
+// backing file (dirfd, cName), or deletes the sidecar file if "s" is empty.
+// The file is written under a temporary name and renamed into place, so a
+// crash cannot leave a truncated sidecar behind.
+//
+// A sidecar that is shared by hard links is overwritten in place instead:
+// renaming a new file over it, or deleting it, would only affect this name.
+func (rn *RootNode) writeXattrSidecar(dirfd int, cName string, s xattrSidecar) error {
+	sName := rn.nameTransform.XattrSidecarName(cName)
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	cData := rn.encryptXattrValue(data)
+	fd, err := syscallcompat.Openat(dirfd, sName, syscall.O_WRONLY|syscall.O_NOFOLLOW, 0)
+	if err == nil {
+		var st syscall.Stat_t
+		err = syscall.Fstat(fd, &st)
+		if err == nil && st.Nlink > 1 {
+			f := os.NewFile(uintptr(fd), sName)
+			_, err = f.WriteAt(cData, 0)
+			if err == nil {
+				err = f.Truncate(int64(len(cData)))
+			}
+			if err == nil {
+				err = f.Sync()
+			}
+			if err2 := f.Close(); err == nil {
+				err = err2
+			}
+			return err
+		}
+		syscall.Close(fd)
+	}
+	if len(s) == 0 {
+		err = syscallcompat.Unlinkat(dirfd, sName, 0)
+		if err == syscall.ENOENT {
+			return nil
+		}
+		return err
+	}
+	tmpName := fmt.Sprintf("%s.tmp.%d", sName, cryptocore.RandUint64())
+	fd, err = syscallcompat.Openat(dirfd, tmpName, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL|syscall.O_NOFOLLOW, 0600)
+	if err != nil {
+		return err
+	}
+	f := os.NewFile(uintptr(fd), tmpName)
+	_, err = f.Write(cData)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil {
+		err = syscallcompat.Renameat(dirfd, tmpName, dirfd, sName)
+	}
+	if err != nil {
+		syscallcompat.Unlinkat(dirfd, tmpName, 0)
+	}
+	return err
+}
+
+// getXattrSidecar reads xattr "attr" from the sidecar file of this node.
+func (n *Node) getXattrSidecar(attr string) ([]byte, syscall.Errno) {
+	dirfd, cName, errno := n.prepareAtSyscall("")
+	if errno != 0 {
+		return nil, errno
+	}
+	defer syscall.Close(dirfd)
+	rn := n.rootNode()
+	rn.xattrSidecarLock.Lock()
+	s, err := rn.readXattrSidecar(dirfd, cName)
+	rn.xattrSidecarLock.Unlock()
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	data, ok := s[attr]
+	if !ok {
+		return nil, errNoXattr
+	}
+	return data, 0
+}
+
+// setXattrSidecar stores xattr "attr" in the sidecar file of this node,
+// honoring the XATTR_CREATE and XATTR_REPLACE flags.
+func (n *Node) setXattrSidecar(attr string, data []byte, flags uint32) syscall.Errno {
+	dirfd, cName, errno := n.prepareAtSyscall("")
+	if errno != 0 {
+		return errno
+	}
+	defer syscall.Close(dirfd)
+	rn := n.rootNode()
+	rn.xattrSidecarLock.Lock()
+	defer rn.xattrSidecarLock.Unlock()
+	s, err := rn.readXattrSidecar(dirfd, cName)
+	if err != nil {
+		return fs.ToErrno(err)
+	}
+	_, exists := s[attr]
+	if exists && flags&xattrCreate != 0 {
+		return syscall.EEXIST
+	}
+	if !exists && flags&xattrReplace != 0 {
+		return errNoXattr
+	}
+	s[attr] = data
+	return fs.ToErrno(rn.writeXattrSidecar(dirfd, cName, s))
+}
+
+// removeXattrSidecar deletes xattr "attr" from the sidecar file of this node.
+func (n *Node) removeXattrSidecar(attr string) syscall.Errno {
+	dirfd, cName, errno := n.prepareAtSyscall("")
+	if errno != 0 {
+		return errno
+	}
+	defer syscall.Close(dirfd)
+	rn := n.rootNode()
+	rn.xattrSidecarLock.Lock()
+	defer rn.xattrSidecarLock.Unlock()
+	s, err := rn.readXattrSidecar(dirfd, cName)
+	if err != nil {
+		return fs.ToErrno(err)
+	}
+	if _, ok := s[attr]; !ok {
+		return errNoXattr
+	}
+	delete(s, attr)
+	return fs.ToErrno(rn.writeXattrSidecar(dirfd, cName, s))
+}
+
+// listXattrSidecar returns the names of the xattrs in the sidecar file of
+// this node.
+func (n *Node) listXattrSidecar() ([]string, syscall.Errno) {
+	dirfd, cName, errno := n.prepareAtSyscall("")
+	if errno != 0 {
+		return nil, errno
+	}
+	defer syscall.Close(dirfd)
+	rn := n.rootNode()
+	rn.xattrSidecarLock.Lock()
+	s, err := rn.readXattrSidecar(dirfd, cName)
+	rn.xattrSidecarLock.Unlock()
+	if err != nil {
+		return nil, fs.ToErrno(err)
+	}
+	names := make([]string, 0, len(s))
+	for name := range s {
+		names = append(names, name)
+	}
+	return names, 0
+}
+
+// deleteXattrSidecar deletes the sidecar file of the backing file
+// (dirfd, cName) after the file itself has been deleted. Called
+// unconditionally, so sidecar files created with "-xattr-sidecar" never
+// outlive their file, even if the filesystem is later mounted without it.
+// If other hard links of the file remain, only this name of the shared
+// sidecar goes away.
+func (rn *RootNode) deleteXattrSidecar(dirfd int, cName string) {
+	if rn.args.PlaintextNames {
+		return
+	}
+	sidecar := rn.nameTransform.XattrSidecarName(cName)
+	if st, err := syscallcompat.Fstatat2(dirfd, sidecar, unix.AT_SYMLINK_NOFOLLOW); err == nil && st.Nlink == 1 {
+		rn.shredAt(dirfd, sidecar)
+	}
+	err := syscallcompat.Unlinkat(dirfd, sidecar, 0)
+	if err != nil && err != syscall.ENOENT {
+		tlog.Warn.Printf("deleteXattrSidecar %q: %v", cName, err)
+	}
+}
+
+// linkXattrSidecar hard-links the sidecar file along after the backing file
+// (dirfd, cName) has been hard-linked as (dirfd2, cName2). Both names then
+// share the sidecar, like they share the xattrs stored in the backing file.
+func (rn *RootNode) linkXattrSidecar(dirfd int, cName string, dirfd2 int, cName2 string) {
+	if rn.args.PlaintextNames {
+		return
+	}
+	s1 := rn.nameTransform.XattrSidecarName(cName)
+	s2 := rn.nameTransform.XattrSidecarName(cName2)
+	err := syscallcompat.Linkat(dirfd, s1, dirfd2, s2, 0)
+	if err != nil && err != syscall.ENOENT {
+		tlog.Warn.Printf("linkXattrSidecar %q -> %q: %v", cName, cName2, err)
+	}
+}
+
+// renameXattrSidecar moves the sidecar file along after the backing file has
+// been renamed from (dirfd, cName) to (dirfd2, cName2) with "flags".
+func (rn *RootNode) renameXattrSidecar(dirfd int, cName string, dirfd2 int, cName2 string, flags uint32) {
+	if rn.args.PlaintextNames {
+		return
+	}
+	s1 := rn.nameTransform.XattrSidecarName(cName)
+	s2 := rn.nameTransform.XattrSidecarName(cName2)
+	var err error
+	if flags&syscallcompat.RENAME_EXCHANGE != 0 {
+		err = syscallcompat.Renameat2(dirfd, s1, dirfd2, s2, syscallcompat.RENAME_EXCHANGE)
+		if err == syscall.ENOENT {
+			// Only one of the two has a sidecar
+			err = syscallcompat.Renameat(dirfd, s1, dirfd2, s2)
+			if err == syscall.ENOENT {
+				err = syscallcompat.Renameat(dirfd2, s2, dirfd, s1)
+			}
+		}
+	} else {
+		err = syscallcompat.Renameat(dirfd, s1, dirfd2, s2)
+		if err == syscall.ENOENT {
+			// The file that has been overwritten may have had a sidecar
+			err = syscallcompat.Unlinkat(dirfd2, s2, 0)
+		}
+	}
+	if err != nil && err != syscall.ENOENT {
+		tlog.Warn.Printf("renameXattrSidecar %q -> %q: %v", cName, cName2, err)
+	}
+}
@@ -3,8 +3,7 @@ package fusefrontend_reverse
 import (
 	"path/filepath"
 	"strings"
-
-	"golang.org/x/sys/unix"
+	"syscall"
 
 	"github.com/rfjakob/gocryptfs/internal/ctlsocksrv"
 	"github.com/rfjakob/gocryptfs/internal/pathiv"
@@ -12,10 +11,15 @@ import (
 
 // Verify that the interface is implemented.
 var _ ctlsocksrv.Interface = &RootNode{}
+var _ ctlsocksrv.LockInterface = &RootNode{}
 
 // EncryptPath implements ctlsock.Backend.
 // This is used for the control socket and for the "-exclude" logic.
 func (rn *RootNode) EncryptPath(plainPath string) (string, error) {
+	if !rn.args.KeyLock.Enter() {
+		return "", syscall.EACCES
+	}
+	defer rn.args.KeyLock.Exit()
 	if rn.args.PlaintextNames || plainPath == "" {
 		return plainPath, nil
 	}
@@ -24,7 +28,7 @@ func (rn *RootNode) EncryptPath(plainPath string) (string, error) {
 	for _, part := range parts {
 		dirIV := pathiv.Derive(cipherPath, pathiv.PurposeDirIV)
 		encryptedPart := rn.nameTransform.EncryptName(part, dirIV)
-		if rn.args.LongNames && len(encryptedPart) > unix.NAME_MAX {
+		if rn.args.LongNames && len(encryptedPart) > rn.nameTransform.GetLongNameMax() {
 			encryptedPart = rn.nameTransform.HashLongName(encryptedPart)
 		}
 		cipherPath = filepath.Join(cipherPath, encryptedPart)
@@ -34,6 +38,21 @@ func (rn *RootNode) EncryptPath(plainPath string) (string, error) {
 
 // DecryptPath implements ctlsock.Backend
 func (rn *RootNode) DecryptPath(cipherPath string) (string, error) {
+	if !rn.args.KeyLock.Enter() {
+		return "", syscall.EACCES
+	}
+	defer rn.args.KeyLock.Exit()
 	p, err := rn.decryptPath(cipherPath)
 	return p, err
 }
+
+// Lock implements ctlsocksrv.LockInterface
+func (rn *RootNode) Lock() {
+	rn.args.KeyLock.Lock()
+	rn.args.KeyLock.Wait()
+}
+
+// Unlock implements ctlsocksrv.LockInterface
+func (rn *RootNode) Unlock(password []byte) error {
+	return rn.args.KeyLock.Unlock(password)
+}
@@ -141,7 +141,7 @@ func (n *Node) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFl
 	var derivedIVs pathiv.FileIVs
 	v, found := inodeTable.Load(st.Ino)
 	if found {
-		tlog.Debug.Printf("ino%d: newFile: found in the inode table", st.Ino)
+		tlog.DebugCache.Printf("ino%d: newFile: found in the inode table", st.Ino)
 		derivedIVs = v.(pathiv.FileIVs)
 	} else {
 		p := n.Path()
@@ -156,7 +156,7 @@ func (n *Node) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFl
 				// Another thread has stored a different value before we could.
 				derivedIVs = v.(pathiv.FileIVs)
 			} else {
-				tlog.Debug.Printf("ino%d: newFile: Nlink=%d, stored in the inode table", st.Ino, st.Nlink)
+				tlog.DebugCache.Printf("ino%d: newFile: Nlink=%d, stored in the inode table", st.Ino, st.Nlink)
 			}
 		}
 	}
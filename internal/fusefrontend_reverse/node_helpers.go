@@ -95,6 +95,9 @@ func (n *Node) newChild(ctx context.Context, st *syscall.Stat_t, out *fuse.Entry
 	rn := n.rootNode()
 	rn.inoMap.TranslateStat(st)
 	out.Attr.FromStat(st)
+	if rn.args.ForceOwner != nil {
+		out.Owner = *rn.args.ForceOwner
+	}
 	// Create child node
 	id := fs.StableAttr{
 		Mode: uint32(st.Mode),
@@ -193,6 +196,9 @@ func (n *Node) lookupConf(ctx context.Context, out *fuse.EntryOut) (ch *fs.Inode
 	// Get unique inode number
 	rn.inoMap.TranslateStat(&st)
 	out.Attr.FromStat(&st)
+	if rn.args.ForceOwner != nil {
+		out.Owner = *rn.args.ForceOwner
+	}
 	// Create child node
 	id := fs.StableAttr{
 		Mode: uint32(st.Mode),
@@ -212,7 +218,7 @@ func (n *Node) readlink(dirfd int, cName string, pName string) (out []byte, errn
 		return
 	}
 	rn := n.rootNode()
-	if rn.args.PlaintextNames {
+	if rn.args.PlaintextNames || rn.args.PlaintextSymlinks {
 		return []byte(plainTarget), 0
 	}
 	// Nonce is derived from the relative *ciphertext* path
@@ -48,6 +48,13 @@ func NewRootNode(args fusefrontend.Args, c *contentenc.ContentEnc, n nametransfo
 		contentEnc:    c,
 		inoMap:        inomap.New(),
 	}
+	// Make sure the device of the plaintext directory gets namespace id zero,
+	// so its inode numbers are passed through unchanged. Otherwise, a virtual
+	// file that is looked up first could get it.
+	var st syscall.Stat_t
+	if err := syscall.Stat(args.Cipherdir, &st); err == nil {
+		rn.inoMap.TranslateStat(&st)
+	}
 	if len(args.Exclude) > 0 || len(args.ExcludeWildcard) > 0 || len(args.ExcludeFrom) > 0 {
 		rn.excluder = prepareExcluder(args)
 	}
@@ -57,7 +64,7 @@ func NewRootNode(args fusefrontend.Args, c *contentenc.ContentEnc, n nametransfo
 // You can pass either gocryptfs.longname.XYZ.name or gocryptfs.longname.XYZ.
 func (rn *RootNode) findLongnameParent(fd int, diriv []byte, longname string) (pName string, cFullName string, errno syscall.Errno) {
 	defer func() {
-		tlog.Debug.Printf("findLongnameParent: %d %x %q -> %q %q %d\n", fd, diriv, longname, pName, cFullName, errno)
+		tlog.DebugNames.Printf("findLongnameParent: %d %x %q -> %q %q %d\n", fd, diriv, longname, pName, cFullName, errno)
 	}()
 	if strings.HasSuffix(longname, nametransform.LongNameSuffix) {
 		longname = nametransform.RemoveLongNameSuffix(longname)
@@ -67,14 +74,20 @@ func (rn *RootNode) findLongnameParent(fd int, diriv []byte, longname string) (p
 		errno = fs.ToErrno(err)
 		return
 	}
+	longNameMax := rn.nameTransform.GetLongNameMax()
 	for _, entry := range entries {
-		if len(entry.Name) <= shortNameMax {
+		// Fast path: with the default limit, we know which plaintext names
+		// are too short to get hashed without encrypting them.
+		if longNameMax == unix.NAME_MAX && len(entry.Name) <= shortNameMax {
 			continue
 		}
 		cFullName = rn.nameTransform.EncryptName(entry.Name, diriv)
-		if len(cFullName) <= unix.NAME_MAX {
-			// Entry should have been skipped by the "continue" above
-			log.Panic("logic error or wrong shortNameMax constant?")
+		if len(cFullName) <= longNameMax {
+			if longNameMax == unix.NAME_MAX {
+				// Entry should have been skipped by the "continue" above
+				log.Panic("logic error or wrong shortNameMax constant?")
+			}
+			continue
 		}
 		hName := rn.nameTransform.HashLongName(cFullName)
 		if longname == hName {
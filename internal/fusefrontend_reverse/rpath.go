@@ -102,7 +102,7 @@ func (rn *RootNode) decryptPath(cPath string) (string, error) {
 // friends.
 func (rn *RootNode) openBackingDir(cPath string) (dirfd int, pPath string, err error) {
 	defer func() {
-		tlog.Debug.Printf("openBackingDir %q -> %d %q %v\n", cPath, dirfd, pPath, err)
+		tlog.DebugNames.Printf("openBackingDir %q -> %d %q %v\n", cPath, dirfd, pPath, err)
 	}()
 	dirfd = -1
 	pPath, err = rn.decryptPath(cPath)
@@ -0,0 +1,158 @@
+// Package keylock implements "-lock": the keys of a running mount are wiped
+// from memory, and everything that needs them fails with EACCES until the
+// mount is unlocked with the password again.
+package keylock
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrNotSupported is returned by Unlock when the keys of the mount cannot be
+// derived from a password, for example with "-masterkey".
+var ErrNotSupported = errors.New("this mount cannot be unlocked, unmount it and mount it again")
+
+// KeyLock guards the keys of a mount. Everything that uses them calls
+// Enter before, and Exit after.
+//
+// Unlike a sync.RWMutex, Enter never blocks. Once Lock has been called, Enter
+// fails, and Lock waits for the users that are already inside. A user may
+// Enter again while inside, like the prefetcher that is started by a read.
+type KeyLock struct {
+	mu   sync.Mutex
+	idle *sync.Cond
+	// Number of users inside
+	users  int
+	locked bool
+	// Serializes Lock and Unlock
+	op sync.Mutex
+	// forget wipes the keys, restore derives them from the password again
+	forget  func()
+	restore func(password []byte) error
+	// onLock runs after the keys have been wiped, see OnLock
+	onLock []func()
+	// Number of onLock functions that are still running
+	flushing int
+}
+
+// New returns a KeyLock for the keys that "forget" wipes. "restore" gets
+// them back from the password, it is nil if that is not possible.
+func New(forget func(), restore func(password []byte) error) *KeyLock {
+	k := &KeyLock{forget: forget, restore: restore}
+	k.idle = sync.NewCond(&k.mu)
+	return k
+}
+
+// Enter returns false if the keys are gone. Otherwise, they stay until
+// Exit is called. A nil KeyLock is always unlocked.
+func (k *KeyLock) Enter() bool {
+	if k == nil {
+		return true
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.locked {
+		return false
+	}
+	k.users++
+	return true
+}
+
+// Exit undoes a successful Enter
+func (k *KeyLock) Exit() {
+	if k == nil {
+		return
+	}
+	k.mu.Lock()
+	k.users--
+	if k.users == 0 {
+		k.idle.Broadcast()
+	}
+	k.mu.Unlock()
+}
+
+// Locked returns true if the keys are gone, or about to be
+func (k *KeyLock) Locked() bool {
+	if k == nil {
+		return false
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.locked
+}
+
+// Lock waits until the keys are not in use and wipes them. Locking a locked
+// KeyLock does nothing.
+func (k *KeyLock) Lock() {
+	k.op.Lock()
+	defer k.op.Unlock()
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.locked {
+		return
+	}
+	k.locked = true
+	for k.users > 0 {
+		k.idle.Wait()
+	}
+	k.forget()
+	for _, f := range k.onLock {
+		k.flushing++
+		go func(f func()) {
+			f()
+			k.mu.Lock()
+			k.flushing--
+			k.idle.Broadcast()
+			k.mu.Unlock()
+		}(f)
+	}
+}
+
+// OnLock registers "f" to run every time the keys have been wiped, like
+// dropping the plaintext the kernel caches. It runs in its own goroutine,
+// because Lock may be called from a FUSE request, which the kernel can
+// hold locks for.
+func (k *KeyLock) OnLock(f func()) {
+	if k == nil {
+		return
+	}
+	k.mu.Lock()
+	k.onLock = append(k.onLock, f)
+	k.mu.Unlock()
+}
+
+// Wait waits until a Lock that is in progress, and the OnLock functions it
+// started, have finished.
+func (k *KeyLock) Wait() {
+	if k == nil {
+		return
+	}
+	k.op.Lock()
+	k.op.Unlock()
+	k.mu.Lock()
+	for k.flushing > 0 {
+		k.idle.Wait()
+	}
+	k.mu.Unlock()
+}
+
+// Unlock gets the keys back from "password". Unlocking an unlocked KeyLock
+// does nothing.
+func (k *KeyLock) Unlock(password []byte) error {
+	k.op.Lock()
+	defer k.op.Unlock()
+	if !k.Locked() {
+		return nil
+	}
+	if k.restore == nil {
+		return ErrNotSupported
+	}
+	// Nobody is inside while we are locked, so the keys are ours
+	if err := k.restore(password); err != nil {
+		return err
+	}
+	k.mu.Lock()
+	k.locked = false
+	k.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,105 @@
+package keylock
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestLockUnlock(t *testing.T) {
+	keys := true
+	errPw := errors.New("wrong password")
+	k := New(func() { keys = false }, func(pw []byte) error {
+		if string(pw) != "test" {
+			return errPw
+		}
+		keys = true
+		return nil
+	})
+	// A user that is inside delays the wipe
+	if !k.Enter() {
+		t.Fatal("Enter failed on an unlocked KeyLock")
+	}
+	done := make(chan struct{})
+	go func() {
+		k.Lock()
+		close(done)
+	}()
+	for !k.Locked() {
+		time.Sleep(time.Millisecond)
+	}
+	// Locking has started, new users are turned away
+	if k.Enter() {
+		t.Error("Enter succeeded while locking")
+	}
+	select {
+	case <-done:
+		t.Fatal("Lock did not wait for the user")
+	case <-time.After(10 * time.Millisecond):
+	}
+	if !keys {
+		t.Fatal("keys wiped while in use")
+	}
+	k.Exit()
+	<-done
+	if keys {
+		t.Fatal("keys not wiped")
+	}
+	if err := k.Unlock([]byte("wrong")); err != errPw || !k.Locked() {
+		t.Errorf("wrong password: %v, locked=%v", err, k.Locked())
+	}
+	if err := k.Unlock([]byte("test")); err != nil || k.Locked() || !keys {
+		t.Errorf("right password: %v, locked=%v", err, k.Locked())
+	}
+	if !k.Enter() {
+		t.Error("Enter failed after Unlock")
+	}
+	k.Exit()
+}
+
+func TestUnlockNotSupported(t *testing.T) {
+	k := New(func() {}, nil)
+	k.Lock()
+	if err := k.Unlock([]byte("test")); err != ErrNotSupported {
+		t.Errorf("want ErrNotSupported, got %v", err)
+	}
+	var nilLock *KeyLock
+	if !nilLock.Enter() || nilLock.Locked() {
+		t.Error("a nil KeyLock must be unlocked")
+	}
+	nilLock.Exit()
+}
+
+func TestOnLock(t *testing.T) {
+	k := New(func() {}, func(pw []byte) error { return nil })
+	release := make(chan struct{})
+	var runs int
+	k.OnLock(func() {
+		<-release
+		runs++
+	})
+	// Lock does not wait for the OnLock functions, Wait does
+	k.Lock()
+	waited := make(chan struct{})
+	go func() {
+		k.Wait()
+		close(waited)
+	}()
+	select {
+	case <-waited:
+		t.Fatal("Wait returned while an OnLock function was running")
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(release)
+	<-waited
+	if runs != 1 {
+		t.Errorf("want 1 run, have %d", runs)
+	}
+	// They run again on the next Lock
+	k.Unlock(nil)
+	k.Lock()
+	k.Wait()
+	if runs != 2 {
+		t.Errorf("want 2 runs, have %d", runs)
+	}
+}
@@ -0,0 +1,75 @@
+// Package mempressure reads the memory pressure of the system or of our
+// cgroup from the Linux Pressure Stall Information (PSI) interface.
+//
+// See https://www.kernel.org/doc/html/latest/accounting/psi.html .
+package mempressure
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// System-wide memory pressure, Linux 4.20 and later
+	procPressure = "/proc/pressure/memory"
+	// Where the cgroup v2 hierarchy is usually mounted
+	cgroup2Root = "/sys/fs/cgroup"
+)
+
+// Path returns the PSI file that best describes the memory pressure we
+// are under. This is "memory.pressure" of our cgroup when we are in a
+// cgroup v2 hierarchy (so that limits set by systemd or a container runtime
+// are taken into account), and the system-wide file otherwise.
+//
+// Returns an error if PSI is not available, for example on kernels older
+// than 4.20, with CONFIG_PSI disabled, or on other operating systems.
+func Path() (string, error) {
+	if cg, err := ioutil.ReadFile("/proc/self/cgroup"); err == nil {
+		for _, line := range strings.Split(string(cg), "\n") {
+			// The cgroup v2 entry looks like "0::/user.slice/foo.scope"
+			if !strings.HasPrefix(line, "0::/") {
+				continue
+			}
+			p := filepath.Join(cgroup2Root, line[3:], "memory.pressure")
+			if _, err := Read(p); err == nil {
+				return p, nil
+			}
+		}
+	}
+	if _, err := Read(procPressure); err != nil {
+		return "", err
+	}
+	return procPressure, nil
+}
+
+// Read returns the "some avg10" value from the PSI file at "path": the
+// percentage of the last 10 seconds during which at least one task was
+// stalled waiting for memory.
+func Read(path string) (avg10 float64, err error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return parse(string(content))
+}
+
+// parse extracts "some avg10" from PSI file content like this:
+//
+//	some avg10=0.00 avg60=0.00 avg300=0.00 total=0
+//	full avg10=0.00 avg60=0.00 avg300=0.00 total=0
+func parse(content string) (avg10 float64, err error) {
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[0] != "some" {
+			continue
+		}
+		if !strings.HasPrefix(fields[1], "avg10=") {
+			break
+		}
+		return strconv.ParseFloat(strings.TrimPrefix(fields[1], "avg10="), 64)
+	}
+	return 0, fmt.Errorf("mempressure: could not parse %q", content)
+}
@@ -0,0 +1,31 @@
+package mempressure
+
+import (
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	testcases := []struct {
+		in   string
+		out  float64
+		fail bool
+	}{
+		{"some avg10=0.00 avg60=0.00 avg300=0.00 total=0\nfull avg10=0.00 avg60=0.00 avg300=0.00 total=0\n", 0, false},
+		{"some avg10=12.34 avg60=5.00 avg300=1.00 total=123456\nfull avg10=1.00 avg60=0.00 avg300=0.00 total=0\n", 12.34, false},
+		// The "full" line is optional
+		{"some avg10=100.00 avg60=0.00 avg300=0.00 total=0\n", 100, false},
+		{"", 0, true},
+		{"full avg10=1.00 avg60=0.00 avg300=0.00 total=0\n", 0, true},
+		{"some foo=1.00\n", 0, true},
+	}
+	for _, tc := range testcases {
+		out, err := parse(tc.in)
+		if (err != nil) != tc.fail {
+			t.Errorf("parse(%q): unexpected error %v", tc.in, err)
+			continue
+		}
+		if out != tc.out {
+			t.Errorf("parse(%q): want %v, have %v", tc.in, tc.out, out)
+		}
+	}
+}
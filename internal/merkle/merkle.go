@@ -0,0 +1,228 @@
+// Package merkle computes a Merkle tree over the ciphertext of a file.
+//
+// The root hash is stored in an extended attribute of the backing file when
+// the "MerkleRoots" feature flag is set. It allows to check a file, for
+// example a backup copy, for bit rot and incomplete copies by hashing the
+// ciphertext, without the master key. The hash is not keyed, so it does not
+// protect against deliberate tampering. That is what the authentication
+// tags of the blocks are for.
+//
+// The leaves follow the ciphertext layout: leaf 0 is the file header, leaf
+// i >= 1 is ciphertext block i-1. A write then only changes the leaves of the
+// blocks it touches.
+package merkle
+
+import (
+	"crypto/sha256"
+	"io"
+	"math"
+)
+
+// XattrName is the extended attribute on the backing file that stores the
+// root hash. Encrypted xattr names under the same prefix are much longer, so
+// they cannot collide with it.
+const XattrName = "user.gocryptfs.merkle"
+
+// Domain separation between leaf and inner node hashes, like RFC 6962
+const (
+	leafPrefix = 0
+	nodePrefix = 1
+)
+
+// Maximum number of leaves that Sync reads with one ReadAt call
+const readChunks = 32
+
+// Tree holds the leaf hashes of a file and tracks which of them are out of
+// date. It is not safe for concurrent use.
+type Tree struct {
+	headerLen int64
+	blockLen  int64
+	leaves    [][sha256.Size]byte
+	// File size the leaves have been computed for
+	size int64
+	// Bitmap of out-of-date leaves
+	dirty []uint64
+	// All leaves starting at this index are out of date
+	tail int
+}
+
+// New returns a Tree for files that start with a header of "headerLen" bytes,
+// followed by blocks of "blockLen" bytes. All leaves are out of date until
+// the first Sync.
+func New(headerLen int, blockLen int) *Tree {
+	return &Tree{headerLen: int64(headerLen), blockLen: int64(blockLen)}
+}
+
+// leafOf returns the index of the leaf that contains byte "off".
+func (t *Tree) leafOf(off int64) int {
+	if off < t.headerLen {
+		return 0
+	}
+	return 1 + int((off-t.headerLen)/t.blockLen)
+}
+
+// leafCount returns the number of leaves of a file of "size" bytes.
+func (t *Tree) leafCount(size int64) int {
+	if size == 0 {
+		return 0
+	}
+	return t.leafOf(size-1) + 1
+}
+
+// leafRange returns the byte range of leaf "i" in a file of "size" bytes.
+func (t *Tree) leafRange(i int, size int64) (off int64, end int64) {
+	if i == 0 {
+		off, end = 0, t.headerLen
+	} else {
+		off = t.headerLen + int64(i-1)*t.blockLen
+		end = off + t.blockLen
+	}
+	if end > size {
+		end = size
+	}
+	return off, end
+}
+
+func (t *Tree) isDirty(i int) bool {
+	if i >= t.tail {
+		return true
+	}
+	w := i / 64
+	return w < len(t.dirty) && t.dirty[w]&(1<<uint(i%64)) != 0
+}
+
+// Dirty returns true if the tree has to be synced before Root is valid.
+func (t *Tree) Dirty() bool {
+	if t.tail != math.MaxInt32 {
+		return true
+	}
+	for _, w := range t.dirty {
+		if w != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Invalidate marks the leaves that overlap the byte range "off" to
+// "off+length" as out of date. An empty range marks the leaf at "off".
+func (t *Tree) Invalidate(off int64, length int64) {
+	first := t.leafOf(off)
+	last := first
+	if length > 0 {
+		last = t.leafOf(off + length - 1)
+	}
+	if last >= t.tail {
+		last = t.tail - 1
+	}
+	for i := first; i <= last; i++ {
+		w := i / 64
+		for w >= len(t.dirty) {
+			t.dirty = append(t.dirty, 0)
+		}
+		t.dirty[w] |= 1 << uint(i%64)
+	}
+}
+
+// InvalidateFrom marks all leaves starting with the one that contains byte
+// "off" as out of date. Use it when the file size changes.
+func (t *Tree) InvalidateFrom(off int64) {
+	if i := t.leafOf(off); i < t.tail {
+		t.tail = i
+	}
+}
+
+// Sync brings the out-of-date leaves up to date by reading them from "r",
+// which has "size" bytes.
+func (t *Tree) Sync(r io.ReaderAt, size int64) error {
+	n := t.leafCount(size)
+	if size != t.size && t.size > 0 {
+		// The old last leaf may have been partial
+		t.Invalidate(t.size-1, 0)
+	}
+	if n < len(t.leaves) {
+		t.leaves = t.leaves[:n]
+	}
+	if n > len(t.leaves) {
+		if len(t.leaves) < t.tail {
+			t.tail = len(t.leaves)
+		}
+		t.leaves = append(t.leaves, make([][sha256.Size]byte, n-len(t.leaves))...)
+	}
+	var buf []byte
+	for i := 0; i < n; {
+		if !t.isDirty(i) {
+			i++
+			continue
+		}
+		// Read a run of consecutive out-of-date leaves at once
+		j := i + 1
+		for j < n && j < i+readChunks && t.isDirty(j) {
+			j++
+		}
+		off, _ := t.leafRange(i, size)
+		_, end := t.leafRange(j-1, size)
+		if int64(cap(buf)) < end-off {
+			buf = make([]byte, end-off)
+		}
+		buf = buf[:end-off]
+		if _, err := r.ReadAt(buf, off); err != nil {
+			return err
+		}
+		for k := i; k < j; k++ {
+			o, e := t.leafRange(k, size)
+			t.leaves[k] = leafHash(buf[o-off : e-off])
+		}
+		i = j
+	}
+	t.size = size
+	t.dirty = t.dirty[:0]
+	t.tail = math.MaxInt32
+	return nil
+}
+
+// Root returns the root hash over the current leaves. The root of an empty
+// file is the hash of the empty string.
+func (t *Tree) Root() []byte {
+	if len(t.leaves) == 0 {
+		h := sha256.Sum256(nil)
+		return h[:]
+	}
+	level := make([][sha256.Size]byte, len(t.leaves))
+	copy(level, t.leaves)
+	var buf [1 + 2*sha256.Size]byte
+	buf[0] = nodePrefix
+	for len(level) > 1 {
+		next := level[:0]
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				// An odd node is promoted unchanged
+				next = append(next, level[i])
+				break
+			}
+			copy(buf[1:], level[i][:])
+			copy(buf[1+sha256.Size:], level[i+1][:])
+			next = append(next, sha256.Sum256(buf[:]))
+		}
+		level = next
+	}
+	return level[0][:]
+}
+
+func leafHash(data []byte) [sha256.Size]byte {
+	h := sha256.New()
+	h.Write([]byte{leafPrefix})
+	h.Write(data)
+	var out [sha256.Size]byte
+	h.Sum(out[:0])
+	return out
+}
+
+// FileRoot computes the root hash of "r", which has "size" bytes.
+func FileRoot(r io.ReaderAt, size int64, headerLen int, blockLen int) ([]byte, error) {
+	t := New(headerLen, blockLen)
+	if err := t.Sync(r, size); err != nil {
+		return nil, err
+	}
+	return t.Root(), nil
+}
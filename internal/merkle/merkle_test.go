@@ -0,0 +1,78 @@
+package merkle
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"math/rand"
+	"testing"
+)
+
+// TestRootSmall checks the root of a header and one block against a manual
+// computation.
+func TestRootSmall(t *testing.T) {
+	data := []byte("hhhbbbbbbbbbb")
+	root, err := FileRoot(bytes.NewReader(data), int64(len(data)), 3, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l0 := sha256.Sum256(append([]byte{leafPrefix}, "hhh"...))
+	l1 := sha256.Sum256(append([]byte{leafPrefix}, "bbbbbbbb"...))
+	l2 := sha256.Sum256(append([]byte{leafPrefix}, "bb"...))
+	n01 := sha256.Sum256(append(append([]byte{nodePrefix}, l0[:]...), l1[:]...))
+	want := sha256.Sum256(append(append([]byte{nodePrefix}, n01[:]...), l2[:]...))
+	if !bytes.Equal(root, want[:]) {
+		t.Errorf("have %x, want %x", root, want)
+	}
+	empty, _ := FileRoot(bytes.NewReader(nil), 0, 3, 8)
+	if e := sha256.Sum256(nil); !bytes.Equal(empty, e[:]) {
+		t.Errorf("empty file: have %x", empty)
+	}
+}
+
+// TestIncremental modifies a file at random and checks that updating only
+// the invalidated leaves gives the same root as hashing everything.
+func TestIncremental(t *testing.T) {
+	const headerLen, blockLen = 18, 64
+	rng := rand.New(rand.NewSource(1))
+	var file []byte
+	tree := New(headerLen, blockLen)
+	for i := 0; i < 500; i++ {
+		off := rng.Intn(len(file) + 300)
+		switch rng.Intn(3) {
+		case 0, 1:
+			// Write
+			data := make([]byte, rng.Intn(200)+1)
+			rng.Read(data)
+			if end := off + len(data); end > len(file) {
+				if off > len(file) {
+					tree.InvalidateFrom(int64(len(file)))
+				}
+				file = append(file, make([]byte, end-len(file))...)
+			}
+			copy(file[off:], data)
+			tree.Invalidate(int64(off), int64(len(data)))
+		case 2:
+			// Truncate
+			if off < len(file) {
+				file = file[:off]
+			} else {
+				tree.InvalidateFrom(int64(len(file)))
+				file = append(file, make([]byte, off-len(file))...)
+			}
+			tree.InvalidateFrom(int64(off))
+		}
+		if rng.Intn(4) != 0 {
+			continue
+		}
+		if err := tree.Sync(bytes.NewReader(file), int64(len(file))); err != nil {
+			t.Fatal(err)
+		}
+		if tree.Dirty() {
+			t.Fatal("tree is still dirty after Sync")
+		}
+		want, _ := FileRoot(bytes.NewReader(file), int64(len(file)), headerLen, blockLen)
+		if have := tree.Root(); !bytes.Equal(have, want) {
+			t.Fatalf("iteration %d: have %x, want %x", i, have, want)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+// Package metrics counts what a mounted filesystem is doing and serves the
+// numbers over HTTP in the Prometheus text format, "-metrics".
+//
+// The counters are global and cover all filesystems served by the process.
+// They are always updated, which costs one atomic add each, but only served
+// when "-metrics" is passed.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Counter is a monotonically increasing counter.
+type Counter struct {
+	name string
+	help string
+	v    uint64
+}
+
+// all counters, in output order
+var counters []*Counter
+
+func newCounter(name string, help string) *Counter {
+	c := &Counter{name: name, help: help}
+	counters = append(counters, c)
+	return c
+}
+
+// Add adds "n" to the counter.
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.v, n)
+}
+
+// Inc adds one to the counter.
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.v, 1)
+}
+
+// Value returns the current value of the counter.
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+var (
+	// BytesRead counts the plaintext bytes returned by FUSE reads
+	BytesRead = newCounter("gocryptfs_read_bytes_total",
+		"Plaintext bytes read from files.")
+	// BytesWritten counts the plaintext bytes accepted by FUSE writes
+	BytesWritten = newCounter("gocryptfs_written_bytes_total",
+		"Plaintext bytes written to files.")
+	// ContentDecryptFailures counts file headers and blocks that failed to
+	// decrypt
+	ContentDecryptFailures = newCounter("gocryptfs_content_decrypt_failures_total",
+		"File headers and blocks that could not be decrypted.")
+	// NameDecryptFailures counts file names that failed to decrypt
+	NameDecryptFailures = newCounter("gocryptfs_name_decrypt_failures_total",
+		"File names that could not be decrypted.")
+	// DirCacheLookups counts lookups in the directory cache
+	DirCacheLookups = newCounter("gocryptfs_dircache_lookups_total",
+		"Lookups in the directory cache.")
+	// DirCacheHits counts lookups in the directory cache that found an entry
+	DirCacheHits = newCounter("gocryptfs_dircache_hits_total",
+		"Lookups in the directory cache that found an entry.")
+	// NoncesGenerated counts the random nonces handed out for encryption
+	NoncesGenerated = newCounter("gocryptfs_nonces_generated_total",
+		"Random nonces handed out for encryption.")
+	// NonceFilterHits counts nonces discarded by the nonce reuse filter
+	NonceFilterHits = newCounter("gocryptfs_nonce_filter_hits_total",
+		"Random nonces discarded because they were (probably) used before.")
+	// NonceFilterResets counts how often a part of the nonce reuse filter
+	// was full and has been cleared
+	NonceFilterResets = newCounter("gocryptfs_nonce_filter_resets_total",
+		"Times a shard of the nonce reuse filter was full and has been cleared.")
+	// NonceRepeatErrors counts encryptions that failed because no unused
+	// nonce could be found
+	NonceRepeatErrors = newCounter("gocryptfs_nonce_repeat_errors_total",
+		"Encryptions refused because the random number generator kept repeating nonces.")
+	// RandHealthFailures counts random data that failed the health test
+	RandHealthFailures = newCounter("gocryptfs_rand_health_failures_total",
+		"Random data that failed the random number generator health test.")
+)
+
+// Upper bounds of the latency histogram buckets, in seconds
+var latencyBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+type histogram struct {
+	// Number of observations per bucket, not cumulative. The last one is
+	// for observations above the largest bound.
+	buckets []uint64
+	count   uint64
+	sum     time.Duration
+}
+
+func (h *histogram) observe(dt time.Duration) {
+	s := dt.Seconds()
+	i := sort.SearchFloat64s(latencyBuckets, s)
+	h.buckets[i]++
+	h.count++
+	h.sum += dt
+}
+
+// fuseLatency keeps one latency histogram per FUSE operation. It implements
+// fuse.LatencyMap.
+type fuseLatency struct {
+	sync.Mutex
+	ops map[string]*histogram
+}
+
+// FuseLatency receives the duration of each FUSE request. Pass it to
+// fuse.Server.RecordLatencies.
+var FuseLatency = &fuseLatency{ops: make(map[string]*histogram)}
+
+// Add records that a FUSE request of operation "name" took "dt".
+func (l *fuseLatency) Add(name string, dt time.Duration) {
+	l.Lock()
+	h := l.ops[name]
+	if h == nil {
+		h = &histogram{buckets: make([]uint64, len(latencyBuckets)+1)}
+		l.ops[name] = h
+	}
+	h.observe(dt)
+	l.Unlock()
+}
+
+const latencyName = "gocryptfs_fuse_request_duration_seconds"
+
+// write writes the histograms in the Prometheus text format.
+func (l *fuseLatency) write(w io.Writer) {
+	l.Lock()
+	defer l.Unlock()
+	fmt.Fprintf(w, "# HELP %s Duration of FUSE requests by operation.\n", latencyName)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", latencyName)
+	names := make([]string, 0, len(l.ops))
+	for n := range l.ops {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		h := l.ops[n]
+		var cumulative uint64
+		for i, le := range latencyBuckets {
+			cumulative += h.buckets[i]
+			fmt.Fprintf(w, "%s_bucket{op=%q,le=\"%g\"} %d\n", latencyName, n, le, cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{op=%q,le=\"+Inf\"} %d\n", latencyName, n, h.count)
+		fmt.Fprintf(w, "%s_sum{op=%q} %g\n", latencyName, n, h.sum.Seconds())
+		fmt.Fprintf(w, "%s_count{op=%q} %d\n", latencyName, n, h.count)
+	}
+}
+
+// WriteText writes all metrics to "w" in the Prometheus text format.
+func WriteText(w io.Writer) {
+	for _, c := range counters {
+		fmt.Fprintf(w, "# HELP %s %s\n", c.name, c.help)
+		fmt.Fprintf(w, "# TYPE %s counter\n", c.name)
+		fmt.Fprintf(w, "%s %d\n", c.name, c.Value())
+	}
+	FuseLatency.write(w)
+}
+
+// Serve serves the metrics on "/metrics" for connections on "l". It blocks
+// until "l" is closed, so you probably want to run it in a new goroutine.
+func Serve(l net.Listener) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WriteText(w)
+	})
+	return http.Serve(l, mux)
+}
@@ -0,0 +1,38 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteText(t *testing.T) {
+	BytesRead.Add(4096)
+	l := &fuseLatency{ops: make(map[string]*histogram)}
+	l.Add("READ", 200*time.Microsecond)
+	l.Add("READ", 3*time.Millisecond)
+	l.Add("READ", 10*time.Second)
+	var buf bytes.Buffer
+	WriteText(&buf)
+	l.write(&buf)
+	out := buf.String()
+	for _, want := range []string{
+		"# TYPE gocryptfs_read_bytes_total counter\n",
+		"gocryptfs_read_bytes_total 4096\n",
+		"gocryptfs_dircache_hits_total 0\n",
+		"# TYPE gocryptfs_fuse_request_duration_seconds histogram\n",
+		// Buckets are cumulative
+		`gocryptfs_fuse_request_duration_seconds_bucket{op="READ",le="0.0001"} 0` + "\n",
+		`gocryptfs_fuse_request_duration_seconds_bucket{op="READ",le="0.0005"} 1` + "\n",
+		`gocryptfs_fuse_request_duration_seconds_bucket{op="READ",le="0.005"} 2` + "\n",
+		`gocryptfs_fuse_request_duration_seconds_bucket{op="READ",le="5"} 2` + "\n",
+		`gocryptfs_fuse_request_duration_seconds_bucket{op="READ",le="+Inf"} 3` + "\n",
+		`gocryptfs_fuse_request_duration_seconds_sum{op="READ"} 10.0032` + "\n",
+		`gocryptfs_fuse_request_duration_seconds_count{op="READ"} 3` + "\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in output:\n%s", want, out)
+		}
+	}
+}
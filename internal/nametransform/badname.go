@@ -0,0 +1,70 @@
+package nametransform
+
+import (
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+)
+
+// EncryptAndHashBadName is like EncryptAndHashName, but also maps names
+// that DecryptName() has marked with BadNameFlag back to the undecryptable
+// file in "dirfd" they were generated from. This allows the user to stat,
+// rename and delete such files through the mount.
+//
+// If "name" does not carry the flag, or does not map back to exactly one
+// existing file that matches a "-badname" pattern, the result of
+// EncryptAndHashName is returned.
+func (n *NameTransform) EncryptAndHashBadName(name string, iv []byte, dirfd int) (string, error) {
+	cName, err := n.EncryptAndHashName(name, iv)
+	if err != nil || len(n.BadnamePatterns) == 0 || !strings.HasSuffix(name, BadNameFlag) {
+		return cName, err
+	}
+	var st unix.Stat_t
+	if syscallcompat.Fstatat(dirfd, cName, &st, unix.AT_SYMLINK_NOFOLLOW) == nil {
+		// A regular file that happens to have the flag in its name
+		return cName, nil
+	}
+	name = strings.TrimSuffix(name, BadNameFlag)
+	// Candidate cipher names, see DecryptName(): either the whole cipher
+	// name could not be decrypted and is shown as-is, or a prefix of it
+	// decrypted to name[:charpos].
+	candidates := []string{name}
+	for charpos := len(name) - 1; charpos > 0; charpos-- {
+		candidates = append(candidates, n.EncryptName(name[:charpos], iv)+name[charpos:])
+	}
+	found := ""
+	for _, c := range candidates {
+		if len(c) > NameMax || !n.isBadName(c, iv) {
+			continue
+		}
+		if syscallcompat.Fstatat(dirfd, c, &st, unix.AT_SYMLINK_NOFOLLOW) != nil {
+			continue
+		}
+		if found != "" && found != c {
+			// Ambiguous, don't guess
+			return cName, nil
+		}
+		found = c
+	}
+	if found == "" {
+		return cName, nil
+	}
+	return found, nil
+}
+
+// isBadName returns true if "cName" cannot be decrypted and matches one of
+// the "-badname" patterns.
+func (n *NameTransform) isBadName(cName string, iv []byte) bool {
+	if _, err := n.decryptName(cName, iv); err == nil {
+		return false
+	}
+	for _, pattern := range n.BadnamePatterns {
+		if match, err := filepath.Match(pattern, cName); err == nil && match {
+			return true
+		}
+	}
+	return false
+}
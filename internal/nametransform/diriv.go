@@ -62,6 +62,19 @@ func fdReadDirIV(fd *os.File) (iv []byte, err error) {
 // This function is exported because it is used from fusefrontend, main,
 // and also the automated tests.
 func WriteDirIVAt(dirfd int) error {
+	return writeDirIVAt(dirfd, cryptocore.RandBytes(DirIVLen))
+}
+
+// RestoreDirIVAt writes the gocryptfs.diriv file with the IV "iv" back into
+// the directory opened at "dirfd", after it has been deleted. Rmdir uses it
+// when the directory turns out not to be empty.
+func RestoreDirIVAt(dirfd int, iv []byte) error {
+	return writeDirIVAt(dirfd, iv)
+}
+
+// writeDirIVAt creates gocryptfs.diriv with the IV "iv" in the directory
+// opened at "dirfd"
+func writeDirIVAt(dirfd int, iv []byte) error {
 	// It makes sense to have the diriv files group-readable so the FS can
 	// be mounted from several users from a network drive (see
 	// https://github.com/rfjakob/gocryptfs/issues/387 ).
@@ -70,7 +83,6 @@ func WriteDirIVAt(dirfd int) error {
 	// owner must explicitly chmod it to permit access.
 	const dirivPerms = 0440
 
-	iv := cryptocore.RandBytes(DirIVLen)
 	// 0400 permissions: gocryptfs.diriv should never be modified after creation.
 	// Don't use "ioutil.WriteFile", it causes trouble on NFS:
 	// https://github.com/rfjakob/gocryptfs/commit/7d38f80a78644c8ec4900cc990bfb894387112ed
@@ -103,7 +115,7 @@ func WriteDirIVAt(dirfd int) error {
 }
 
 // encryptAndHashName encrypts "name" and hashes it to a longname if it is
-// too long.
+// longer than longNameMax.
 // Returns ENAMETOOLONG if "name" is longer than 255 bytes.
 func (be *NameTransform) EncryptAndHashName(name string, iv []byte) (string, error) {
 	// Prevent the user from creating files longer than 255 chars.
@@ -111,7 +123,7 @@ func (be *NameTransform) EncryptAndHashName(name string, iv []byte) (string, err
 		return "", syscall.ENAMETOOLONG
 	}
 	cName := be.EncryptName(name, iv)
-	if be.longNames && len(cName) > NameMax {
+	if be.longNames && len(cName) > be.longNameMax {
 		return be.HashLongName(cName), nil
 	}
 	return cName, nil
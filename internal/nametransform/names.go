@@ -5,6 +5,7 @@ import (
 	"bytes"
 	"crypto/aes"
 	"encoding/base64"
+	"math"
 	"path/filepath"
 	"syscall"
 
@@ -16,6 +17,9 @@ import (
 const (
 	// Like ext4, we allow at most 255 bytes for a file name.
 	NameMax = 255
+	// BadNameFlag is appended to names that "-badname" shows even though
+	// they cannot be decrypted.
+	BadNameFlag = " GOCRYPTFS_BAD_NAME"
 )
 
 // NameTransformer is an interface used to transform filenames.
@@ -23,12 +27,16 @@ type NameTransformer interface {
 	DecryptName(cipherName string, iv []byte) (string, error)
 	EncryptName(plainName string, iv []byte) string
 	EncryptAndHashName(name string, iv []byte) (string, error)
+	EncryptAndHashBadName(name string, iv []byte, dirfd int) (string, error)
 	// HashLongName - take the hash of a long string "name" and return
 	// "gocryptfs.longname.[sha256]"
 	//
 	// This function does not do any I/O.
 	HashLongName(name string) string
+	// XattrSidecarName - name of the "-xattr-sidecar" file of "cName"
+	XattrSidecarName(cName string) string
 	WriteLongNameAt(dirfd int, hashName string, plainName string) error
+	GetLongNameMax() int
 	B64EncodeToString(src []byte) string
 	B64DecodeString(s string) ([]byte, error)
 }
@@ -37,26 +45,55 @@ type NameTransformer interface {
 type NameTransform struct {
 	emeCipher *eme.EMECipher
 	longNames bool
+	// Names longer than `longNameMax` are hashed. Set to MaxInt when
+	// longNames is disabled.
+	longNameMax int
 	// B64 = either base64.URLEncoding or base64.RawURLEncoding, depending
 	// on the Raw64 feature flag
 	B64 *base64.Encoding
+	// padNames pads names to fixed buckets instead of the AES block size,
+	// see padBucket()
+	padNames bool
 	// Patterns to bypass decryption
 	BadnamePatterns []string
 }
 
 // New returns a new NameTransform instance.
-func New(e *eme.EMECipher, longNames bool, raw64 bool) *NameTransform {
+//
+// If `longNames` is set, names longer than `longNameMax` are hashed to
+// `gocryptfs.longname.[sha256]`. Pass `longNameMax = 0` to use the default
+// NameMax.
+//
+// If `padNames` is set, names are padded to 32, 64, 128 or 256 bytes before
+// encryption (PadNames feature flag).
+func New(e *eme.EMECipher, longNames bool, longNameMax uint8, raw64 bool, padNames bool) *NameTransform {
 	b64 := base64.URLEncoding
 	if raw64 {
 		b64 = base64.RawURLEncoding
 	}
+	effectiveLongNameMax := math.MaxInt32
+	if longNames {
+		if longNameMax == 0 {
+			effectiveLongNameMax = NameMax
+		} else {
+			effectiveLongNameMax = int(longNameMax)
+		}
+	}
 	return &NameTransform{
-		emeCipher: e,
-		longNames: longNames,
-		B64:       b64,
+		emeCipher:   e,
+		longNames:   longNames,
+		longNameMax: effectiveLongNameMax,
+		B64:         b64,
+		padNames:    padNames,
 	}
 }
 
+// GetLongNameMax returns the length limit above which encrypted names are
+// hashed.
+func (n *NameTransform) GetLongNameMax() int {
+	return n.longNameMax
+}
+
 // DecryptName calls decryptName to try and decrypt a base64-encoded encrypted
 // filename "cipherName", and failing that checks if it can be bypassed
 func (n *NameTransform) DecryptName(cipherName string, iv []byte) (string, error) {
@@ -71,10 +108,10 @@ func (n *NameTransform) DecryptName(cipherName string, iv []byte) (string, error
 				for charpos := len(cipherName) - 1; charpos >= nameMin; charpos-- {
 					res, err = n.decryptName(cipherName[:charpos], iv)
 					if err == nil {
-						return res + cipherName[charpos:] + " GOCRYPTFS_BAD_NAME", nil
+						return res + cipherName[charpos:] + BadNameFlag, nil
 					}
 				}
-				return cipherName + " GOCRYPTFS_BAD_NAME", nil
+				return cipherName + BadNameFlag, nil
 			}
 		}
 	}
@@ -93,14 +130,18 @@ func (n *NameTransform) decryptName(cipherName string, iv []byte) (string, error
 		return "", syscall.EBADMSG
 	}
 	if len(bin)%aes.BlockSize != 0 {
-		tlog.Debug.Printf("DecryptName %q: decoded length %d is not a multiple of 16", cipherName, len(bin))
+		tlog.DebugNames.Printf("DecryptName %q: decoded length %d is not a multiple of 16", cipherName, len(bin))
 		return "", syscall.EBADMSG
 	}
 	bin = n.emeCipher.Decrypt(iv, bin)
-	bin, err = unPad16(bin)
+	if n.padNames {
+		bin, err = unPadBucket(bin)
+	} else {
+		bin, err = unPad16(bin)
+	}
 	if err != nil {
-		tlog.Debug.Printf("DecryptName: unPad16 error detail: %v", err)
-		// unPad16 returns detailed errors including the position of the
+		tlog.DebugNames.Printf("DecryptName: unpad error detail: %v", err)
+		// The unpad functions return detailed errors including the position of the
 		// incorrect bytes. Kill the padding oracle by lumping everything into
 		// a generic error.
 		return "", syscall.EBADMSG
@@ -125,7 +166,11 @@ func (n *NameTransform) decryptName(cipherName string, iv []byte) (string, error
 // to the full (not hashed) name if longname is used.
 func (n *NameTransform) EncryptName(plainName string, iv []byte) (cipherName64 string) {
 	bin := []byte(plainName)
-	bin = pad16(bin)
+	if n.padNames {
+		bin = padBucket(bin)
+	} else {
+		bin = pad16(bin)
+	}
 	bin = n.emeCipher.Encrypt(iv, bin)
 	cipherName64 = n.B64.EncodeToString(bin)
 	return cipherName64
@@ -2,7 +2,11 @@ package nametransform
 
 import (
 	"bytes"
+	"crypto/aes"
+	"strings"
 	"testing"
+
+	"github.com/rfjakob/eme"
 )
 
 func TestPad16(t *testing.T) {
@@ -51,3 +55,99 @@ func TestUnpad16Garbage(t *testing.T) {
 		}
 	}
 }
+
+// TestEMEWideBlock checks that file names are encrypted as one wide block:
+// changing the last plaintext byte must change every ciphertext block, not
+// only the last one like it would with CBC.
+func TestEMEWideBlock(t *testing.T) {
+	bc, err := aes.NewCipher(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := New(eme.New(bc), true, 0, true, false)
+	iv := make([]byte, 16)
+	name := "0123456789abcdef0123456789abcdef0123456789"
+	c1, _ := n.B64.DecodeString(n.EncryptName(name, iv))
+	c2, _ := n.B64.DecodeString(n.EncryptName(name[:len(name)-1]+"X", iv))
+	if len(c1) != 48 || len(c1) != len(c2) {
+		t.Fatalf("unexpected ciphertext lengths %d, %d", len(c1), len(c2))
+	}
+	for i := 0; i < len(c1); i += aes.BlockSize {
+		if bytes.Equal(c1[i:i+aes.BlockSize], c2[i:i+aes.BlockSize]) {
+			t.Errorf("ciphertext block %d did not change", i/aes.BlockSize)
+		}
+	}
+}
+
+// TestRaw64 checks that Raw64 drops the base64 padding, which makes encrypted
+// names shorter.
+func TestRaw64(t *testing.T) {
+	bc, err := aes.NewCipher(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	padded := New(eme.New(bc), true, 0, false, false)
+	raw := New(eme.New(bc), true, 0, true, false)
+	iv := make([]byte, 16)
+	for _, name := range []string{"a", "0123456789abcdef", "0123456789abcdef0"} {
+		p := padded.EncryptName(name, iv)
+		r := raw.EncryptName(name, iv)
+		if strings.Contains(r, "=") {
+			t.Errorf("Raw64 name %q contains padding", r)
+		}
+		if len(r) >= len(p) {
+			t.Errorf("Raw64 name %q is not shorter than %q", r, p)
+		}
+		if d, err := raw.DecryptName(r, iv); err != nil || d != name {
+			t.Errorf("roundtrip failed: %q %v", d, err)
+		}
+	}
+}
+
+// TestPadNames checks that PadNames hides the name length within a bucket and
+// that names still decrypt correctly.
+func TestPadNames(t *testing.T) {
+	bc, err := aes.NewCipher(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := New(eme.New(bc), true, 0, true, true)
+	iv := make([]byte, 16)
+	testCases := []struct {
+		len    int
+		binLen int
+	}{
+		{1, 32}, {31, 32}, {32, 64}, {63, 64}, {64, 128}, {127, 128}, {128, 256}, {255, 256},
+	}
+	for _, tc := range testCases {
+		name := strings.Repeat("x", tc.len)
+		c := n.EncryptName(name, iv)
+		bin, _ := n.B64.DecodeString(c)
+		if len(bin) != tc.binLen {
+			t.Errorf("len=%d: want encrypted length %d, have %d", tc.len, tc.binLen, len(bin))
+		}
+		if d, err := n.DecryptName(c, iv); err != nil || d != name {
+			t.Errorf("len=%d: roundtrip failed: %v", tc.len, err)
+		}
+	}
+}
+
+// TestUnPadBucketGarbage - unPadBucket must reject everything padBucket
+// cannot have produced
+func TestUnPadBucketGarbage(t *testing.T) {
+	testCases := [][]byte{
+		make([]byte, 0),
+		make([]byte, 16),
+		make([]byte, 32),
+		bytes.Repeat([]byte{32}, 32),
+		// Padding that skips a bucket: 10 bytes padded to 64
+		append(make([]byte, 10), bytes.Repeat([]byte{54}, 54)...),
+		// Inconsistent padding bytes
+		append(make([]byte, 30), 1, 2),
+	}
+	for _, v := range testCases {
+		if _, err := unPadBucket(v); err == nil {
+			t.Errorf("unPadBucket accepted %v", v)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package nametransform
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+// padBuckets are the lengths names are padded to with the PadNames feature
+// flag. Plaintext names are at most NameMax = 255 bytes, and PKCS#7 padding
+// adds at least one byte, so the largest bucket is 256.
+var padBuckets = []int{32, 64, 128, 256}
+
+// padBucketLen returns the padded length for a name of length "l".
+func padBucketLen(l int) int {
+	for _, b := range padBuckets {
+		if l < b {
+			return b
+		}
+	}
+	log.Panicf("name too long for padding: %d bytes", l)
+	return 0
+}
+
+// IsPadBucket returns true if "l" is a valid length for a padded name.
+// Used by gocryptfs-xray to check filesystems that use PadNames.
+func IsPadBucket(l int) bool {
+	for _, b := range padBuckets {
+		if l == b {
+			return true
+		}
+	}
+	return false
+}
+
+// padBucket pads "orig" to the next bucket length using PKCS#7 padding. This
+// hides the plaintext name length better than pad16(), which only rounds up
+// to the AES block size. All bucket lengths are multiples of the AES block
+// size, and the padding is never longer than 255 bytes, so it fits in the
+// padding byte.
+func padBucket(orig []byte) (padded []byte) {
+	oldLen := len(orig)
+	if oldLen == 0 {
+		log.Panic("Padding zero-length string makes no sense")
+	}
+	newLen := padBucketLen(oldLen)
+	padded = make([]byte, newLen)
+	copy(padded, orig)
+	padByte := byte(newLen - oldLen)
+	for i := oldLen; i < newLen; i++ {
+		padded[i] = padByte
+	}
+	return padded
+}
+
+// unPadBucket - remove padding added by padBucket()
+func unPadBucket(padded []byte) ([]byte, error) {
+	oldLen := len(padded)
+	if !IsPadBucket(oldLen) {
+		return nil, fmt.Errorf("Invalid padded length %d", oldLen)
+	}
+	// The padding byte's value is the padding length
+	padLen := int(padded[oldLen-1])
+	if padLen == 0 {
+		return nil, errors.New("Padding cannot be zero-length")
+	}
+	if padLen >= oldLen {
+		return nil, fmt.Errorf("Padding too long, oldLen=%d >= padLen=%d", oldLen, padLen)
+	}
+	newLen := oldLen - padLen
+	// Padding must go to the *next* bucket, not further. Otherwise, there
+	// would be more than one valid encryption of a name.
+	if padBucketLen(newLen) != oldLen {
+		return nil, fmt.Errorf("Padding too long, newLen=%d does not belong in bucket %d", newLen, oldLen)
+	}
+	// All padding bytes must be identical
+	for i := newLen; i < oldLen; i++ {
+		if padded[i] != padded[oldLen-1] {
+			return nil, fmt.Errorf("Padding byte at i=%d is invalid", i)
+		}
+	}
+	return padded[0:newLen], nil
+}
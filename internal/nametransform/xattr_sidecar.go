@@ -0,0 +1,29 @@
+package nametransform
+
+import (
+	"crypto/sha256"
+	"strings"
+)
+
+// xattrSidecarPrefix is the name prefix of the files that store extended
+// attributes the backing filesystem cannot hold, "-xattr-sidecar":
+// gocryptfs.xattr.[sha256 of the encrypted name]
+const xattrSidecarPrefix = "gocryptfs.xattr."
+
+// XattrSidecarName returns the name of the xattr sidecar file that belongs to
+// the backing file "cName" in the same directory. Hashing keeps the name
+// short even for long names.
+//
+// This function does not do any I/O.
+func (n *NameTransform) XattrSidecarName(cName string) string {
+	hashBin := sha256.Sum256([]byte(cName))
+	return xattrSidecarPrefix + n.B64.EncodeToString(hashBin[:])
+}
+
+// IsXattrSidecar returns true if "cName" looks like an xattr sidecar file, or
+// a temporary file used while writing one.
+//
+// This function does not do any I/O.
+func IsXattrSidecar(cName string) bool {
+	return strings.HasPrefix(cName, xattrSidecarPrefix)
+}
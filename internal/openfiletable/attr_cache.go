@@ -0,0 +1,83 @@
+package openfiletable
+
+import (
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// attrCache caches the attributes of an open file, so that GETATTR on a file
+// handle does not need an fstat(). Writes through any handle update the
+// cached size and timestamps, all other modifications invalidate the cache.
+type attrCache struct {
+	// Cached attributes, with the plaintext size. Only valid if "valid" is
+	// set.
+	attr  fuse.Attr
+	valid bool
+	// When "attr" was fetched from disk
+	fetched time.Time
+	// generation is incremented on every modification. StoreAttr() drops
+	// attributes that were fetched before a modification.
+	generation uint64
+}
+
+// CachedAttr returns the cached attributes if they are not older than
+// "maxAge".
+func (e *Entry) CachedAttr(maxAge time.Duration) (attr fuse.Attr, ok bool) {
+	e.attrLock.Lock()
+	defer e.attrLock.Unlock()
+	c := &e.attrCache
+	if !c.valid || time.Since(c.fetched) > maxAge {
+		return fuse.Attr{}, false
+	}
+	return c.attr, true
+}
+
+// AttrGeneration returns the current generation. Pass it to StoreAttr().
+func (e *Entry) AttrGeneration() uint64 {
+	e.attrLock.Lock()
+	defer e.attrLock.Unlock()
+	return e.attrCache.generation
+}
+
+// StoreAttr caches "attr". "generation" is the value AttrGeneration()
+// returned before the caller fetched the attributes from disk.
+func (e *Entry) StoreAttr(attr *fuse.Attr, generation uint64) {
+	e.attrLock.Lock()
+	defer e.attrLock.Unlock()
+	c := &e.attrCache
+	if generation != c.generation {
+		// The file has been modified in the meantime
+		return
+	}
+	c.attr = *attr
+	c.valid = true
+	c.fetched = time.Now()
+}
+
+// AttrWritten updates the cached attributes after a successful write that
+// ended at plaintext offset "end". The block count is not updated and may
+// be stale until the cache expires.
+func (e *Entry) AttrWritten(end uint64) {
+	e.attrLock.Lock()
+	defer e.attrLock.Unlock()
+	c := &e.attrCache
+	c.generation++
+	if !c.valid {
+		return
+	}
+	if end > c.attr.Size {
+		c.attr.Size = end
+	}
+	now := time.Now()
+	c.attr.SetTimes(nil, &now, &now)
+}
+
+// InvalidateAttr drops the cached attributes. Call it after modifying the
+// file in a way AttrWritten() does not cover.
+func (e *Entry) InvalidateAttr() {
+	e.attrLock.Lock()
+	defer e.attrLock.Unlock()
+	e.attrCache.generation++
+	e.attrCache.valid = false
+}
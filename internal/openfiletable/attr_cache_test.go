@@ -0,0 +1,41 @@
+package openfiletable
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+func TestAttrCache(t *testing.T) {
+	var e Entry
+	if _, ok := e.CachedAttr(time.Hour); ok {
+		t.Fatal("empty cache should miss")
+	}
+	gen := e.AttrGeneration()
+	e.StoreAttr(&fuse.Attr{Size: 100}, gen)
+	attr, ok := e.CachedAttr(time.Hour)
+	if !ok || attr.Size != 100 {
+		t.Fatalf("want hit with size 100, have ok=%v size=%d", ok, attr.Size)
+	}
+	// Writes grow the size, but never shrink it
+	e.AttrWritten(50)
+	e.AttrWritten(150)
+	attr, _ = e.CachedAttr(time.Hour)
+	if attr.Size != 150 {
+		t.Errorf("want size 150, have %d", attr.Size)
+	}
+	if attr.Mtime == 0 {
+		t.Error("mtime was not updated")
+	}
+	if _, ok = e.CachedAttr(0); ok {
+		t.Error("expired entry should miss")
+	}
+	// Attributes fetched before a modification must be dropped
+	gen = e.AttrGeneration()
+	e.InvalidateAttr()
+	e.StoreAttr(&fuse.Attr{Size: 1}, gen)
+	if _, ok = e.CachedAttr(time.Hour); ok {
+		t.Error("stale StoreAttr should be dropped")
+	}
+}
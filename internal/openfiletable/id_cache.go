@@ -0,0 +1,93 @@
+package openfiletable
+
+import (
+	"container/list"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/inomap"
+)
+
+// idCacheSize is the number of file IDs that we remember after the files
+// have been closed. Every entry needs about 150 bytes.
+const idCacheSize = 4096
+
+// idCache remembers the file IDs of recently closed files, so opening them
+// again does not need to read the file header from disk. Protected by the
+// table lock.
+//
+// The ID is only reused if ctime and size of the backing file are still the
+// same as when the file was opened last. Any write, including writing a new
+// header, changes the ctime. Unlinking a file drops its ID explicitly,
+// because a new file may get the same inode number.
+type idCache struct {
+	// Least recently closed at the back
+	lru   list.List
+	index map[inomap.QIno]*list.Element
+}
+
+// idCacheEntry is an element of idCache.lru
+type idCacheEntry struct {
+	qi inomap.QIno
+	id []byte
+	idStamp
+}
+
+// idStamp identifies the state of a backing file for the idCache
+type idStamp struct {
+	ctime     uint64
+	ctimensec uint32
+	size      uint64
+}
+
+func stampFromStat(st *syscall.Stat_t) idStamp {
+	// fuse.Attr knows where the ctime is on each OS
+	var a fuse.Attr
+	a.FromStat(st)
+	return idStamp{ctime: a.Ctime, ctimensec: a.Ctimensec, size: a.Size}
+}
+
+// take removes the ID of "qi" from the cache and returns it, or nil if it is
+// not cached or the file has changed.
+func (c *idCache) take(qi inomap.QIno, stamp idStamp) []byte {
+	el, ok := c.index[qi]
+	if !ok {
+		return nil
+	}
+	c.drop(qi)
+	e := el.Value.(*idCacheEntry)
+	if e.idStamp != stamp {
+		return nil
+	}
+	return e.id
+}
+
+// put caches the ID "id" of "qi", which was in state "stamp" when it was
+// opened.
+func (c *idCache) put(qi inomap.QIno, id []byte, stamp idStamp) {
+	if c.index == nil {
+		c.index = make(map[inomap.QIno]*list.Element)
+	}
+	c.drop(qi)
+	c.index[qi] = c.lru.PushFront(&idCacheEntry{qi: qi, id: id, idStamp: stamp})
+	if c.lru.Len() > idCacheSize {
+		c.drop(c.lru.Back().Value.(*idCacheEntry).qi)
+	}
+}
+
+// drop removes "qi" from the cache
+func (c *idCache) drop(qi inomap.QIno) {
+	if el, ok := c.index[qi]; ok {
+		c.lru.Remove(el)
+		delete(c.index, qi)
+	}
+}
+
+// ForgetID drops the cached file ID of "qi". Call it before unlinking a
+// file, as the inode number may be reused for a new file.
+func ForgetID(qi inomap.QIno) {
+	t.Lock()
+	defer t.Unlock()
+	t.ids.drop(qi)
+}
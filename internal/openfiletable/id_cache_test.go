@@ -0,0 +1,68 @@
+package openfiletable
+
+import (
+	"bytes"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/internal/inomap"
+)
+
+func TestIDCache(t *testing.T) {
+	qi := inomap.NewQIno(1, 0, 4242)
+	st := &syscall.Stat_t{Size: 100}
+	id := []byte("0123456789abcdef")
+
+	e := Register(qi, st)
+	if e.ID != nil {
+		t.Fatal("empty cache should miss")
+	}
+	e.ID = id
+	Unregister(qi)
+	// Unchanged file
+	e = Register(qi, st)
+	if !bytes.Equal(e.ID, id) {
+		t.Fatalf("want cached ID, have %x", e.ID)
+	}
+	Unregister(qi)
+	// The file has changed
+	e = Register(qi, &syscall.Stat_t{Size: 200})
+	if e.ID != nil {
+		t.Error("changed file should miss")
+	}
+	e.ID = id
+	Unregister(qi)
+	// Unlinked
+	ForgetID(qi)
+	e = Register(qi, &syscall.Stat_t{Size: 200})
+	if e.ID != nil {
+		t.Error("forgotten ID should miss")
+	}
+	Unregister(qi)
+	// Without a stat, nothing is cached
+	e = Register(qi, nil)
+	e.ID = id
+	Unregister(qi)
+	e = Register(qi, st)
+	if e.ID != nil {
+		t.Error("ID should not have been cached")
+	}
+	Unregister(qi)
+}
+
+func TestIDCacheSize(t *testing.T) {
+	var c idCache
+	for i := 0; i < idCacheSize+10; i++ {
+		c.put(inomap.QIno{Ino: uint64(i)}, []byte{1}, idStamp{})
+	}
+	if c.lru.Len() != idCacheSize || len(c.index) != idCacheSize {
+		t.Errorf("cache has grown to %d/%d entries", c.lru.Len(), len(c.index))
+	}
+	// The oldest entries are gone
+	if c.take(inomap.QIno{Ino: 0}, idStamp{}) != nil {
+		t.Error("oldest entry should have been dropped")
+	}
+	if c.take(inomap.QIno{Ino: idCacheSize + 9}, idStamp{}) == nil {
+		t.Error("newest entry should be there")
+	}
+}
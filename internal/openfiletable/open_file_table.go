@@ -7,8 +7,10 @@ package openfiletable
 import (
 	"sync"
 	"sync/atomic"
+	"syscall"
 
 	"github.com/rfjakob/gocryptfs/internal/inomap"
+	"github.com/rfjakob/gocryptfs/internal/merkle"
 )
 
 // wlock - serializes write accesses to each file (identified by inode number)
@@ -34,6 +36,8 @@ type table struct {
 	sync.Mutex
 	// Table entries
 	entries map[inomap.QIno]*Entry
+	// File IDs of recently closed files
+	ids idCache
 }
 
 // Entry is an entry in the open file table
@@ -48,17 +52,41 @@ type Entry struct {
 	// IDLock must be taken before reading or writing the ID field in this struct,
 	// unless you have an exclusive lock on ContentLock.
 	IDLock sync.Mutex
+	// attrCache is protected by attrLock, see attr_cache.go.
+	attrLock  sync.Mutex
+	attrCache attrCache
+	// lockFds maps POSIX lock owners to the file descriptors holding their
+	// locks, see LockFd(). Protected by lockFdsLock.
+	lockFdsLock sync.Mutex
+	lockFds     map[uint64]int
+	// Merkle tracks the leaf hashes of the file while it is being modified.
+	// nil until the first modification. Protected by ContentLock.
+	Merkle *merkle.Tree
+	// State of the backing file when the entry was created, see idCache.
+	// nil if the ID must not be cached. Protected by the table lock.
+	idStamp *idStamp
+	// onRelease is run after the entry has been deleted, see OnRelease.
+	// Protected by the table lock.
+	onRelease []func()
 }
 
 // Register creates an open file table entry for "qi" (or incrementes the
 // reference count if the entry already exists) and returns the entry.
-func Register(qi inomap.QIno) *Entry {
+// "st" is the stat of the freshly opened backing file. If it is not nil,
+// the file ID is taken from the cache of recently closed files, and put back
+// there when the entry is deleted.
+func Register(qi inomap.QIno, st *syscall.Stat_t) *Entry {
 	t.Lock()
 	defer t.Unlock()
 
 	e := t.entries[qi]
 	if e == nil {
 		e = &Entry{}
+		if st != nil {
+			stamp := stampFromStat(st)
+			e.idStamp = &stamp
+			e.ID = t.ids.take(qi, stamp)
+		}
 		t.entries[qi] = e
 	}
 	e.refCount++
@@ -68,13 +96,83 @@ func Register(qi inomap.QIno) *Entry {
 // Unregister decrements the reference count for "qi" and deletes the entry from
 // the open file table if the reference count reaches 0.
 func Unregister(qi inomap.QIno) {
+	t.Lock()
+	e := t.entries[qi]
+	e.refCount--
+	if e.refCount > 0 {
+		t.Unlock()
+		return
+	}
+	delete(t.entries, qi)
+	// Nobody else can access e.ID anymore
+	if e.idStamp != nil && e.ID != nil {
+		t.ids.put(qi, e.ID, *e.idStamp)
+	} else {
+		t.ids.drop(qi)
+	}
+	// Nobody has the file open anymore, so all locks are gone already
+	for _, fd := range e.lockFds {
+		syscall.Close(fd)
+	}
+	t.Unlock()
+	// Outside of the lock, these may take a while
+	for _, f := range e.onRelease {
+		f()
+	}
+}
+
+// OnRelease arranges for "f" to be called when the last file handle of "qi"
+// is unregistered. Returns false, and does not call "f", if "qi" is not open.
+func OnRelease(qi inomap.QIno, f func()) bool {
+	t.Lock()
+	defer t.Unlock()
+	e := t.entries[qi]
+	if e == nil {
+		return false
+	}
+	e.onRelease = append(e.onRelease, f)
+	return true
+}
+
+// Count returns the number of files in the open file table.
+func Count() int {
 	t.Lock()
 	defer t.Unlock()
+	return len(t.entries)
+}
 
+// LockFd returns the file descriptor that holds the POSIX locks of "owner" on
+// this file. The first call for an owner gets the file descriptor from
+// "open", or returns -1 if "open" is nil. The file descriptor stays open until
+// the last file handle is unregistered.
+func (e *Entry) LockFd(owner uint64, open func() (int, error)) (int, error) {
+	e.lockFdsLock.Lock()
+	defer e.lockFdsLock.Unlock()
+	if fd, ok := e.lockFds[owner]; ok {
+		return fd, nil
+	}
+	if open == nil {
+		return -1, nil
+	}
+	fd, err := open()
+	if err != nil {
+		return -1, err
+	}
+	if e.lockFds == nil {
+		e.lockFds = make(map[uint64]int)
+	}
+	e.lockFds[owner] = fd
+	return fd, nil
+}
+
+// InvalidateAttr drops the cached attributes of "qi" if the file is open.
+// Call it after modifying a file through a path instead of a file handle.
+func InvalidateAttr(qi inomap.QIno) {
+	t.Lock()
 	e := t.entries[qi]
-	e.refCount--
-	if e.refCount == 0 {
-		delete(t.entries, qi)
+	t.Unlock()
+	if e != nil {
+		e.InvalidateAttr()
 	}
 }
 
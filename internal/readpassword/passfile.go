@@ -45,6 +45,12 @@ func readPassFile(passfile string) []byte {
 		tlog.Fatal.Printf("fatal: passfile: max password length (%d bytes) exceeded", maxPasswordLen)
 		os.Exit(exitcodes.ReadPassword)
 	}
+	if bytes.HasSuffix(lines[0], []byte("\r")) {
+		// Stripping it would lock out users who created their filesystem
+		// with such a file, so only warn.
+		tlog.Warn.Printf("warning: passfile: %q has Windows line endings (CRLF). "+
+			"The carriage return is used as part of the password.", passfile)
+	}
 	if len(lines) > 1 && len(lines[1]) > 0 {
 		tlog.Warn.Printf("warning: passfile: ignoring trailing garbage (%d bytes) after first line",
 			len(lines[1]))
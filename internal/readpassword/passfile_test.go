@@ -15,6 +15,7 @@ func TestPassfile(t *testing.T) {
 		{"mypassword_garbage.txt", "mypassword"},
 		{"mypassword_missing_newline.txt", "mypassword"},
 		{"file with spaces.txt", "mypassword"},
+		{"mypassword_crlf.txt", "mypassword\r"},
 	}
 	for _, tc := range testcases {
 		pw := readPassFile("passfile_test_files/" + tc.file)
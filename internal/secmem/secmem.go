@@ -0,0 +1,128 @@
+// Package secmem allocates memory for keys outside of the Go heap. The
+// memory is locked into RAM, so it is never written to swap, excluded from
+// core dumps where the OS supports it, and zeroed when it is freed.
+//
+// Every buffer gets its own memory mapping, which takes at least one page.
+// This is fine for the few keys we have. If mapping or locking fails, for
+// example because RLIMIT_MEMLOCK is exhausted, we fall back to less
+// protected memory and say so once.
+package secmem
+
+import (
+	"sync"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+var mu sync.Mutex
+
+// live maps the first byte of every buffer we handed out to its memory
+// mapping
+var live = map[*byte][]byte{}
+
+// warned is set after we have told the user about a fallback
+var warned bool
+
+// fallback logs "msg" the first time any fallback happens. Caller must
+// hold "mu".
+func fallback(msg string, err error) {
+	if warned {
+		tlog.Debug.Printf("secmem: %s: %v", msg, err)
+		return
+	}
+	warned = true
+	tlog.Info.Printf("secmem: %s, keys may be swapped out: %v", msg, err)
+}
+
+// Alloc returns a zeroed buffer of length "n" in locked memory. Release it
+// with Free.
+func Alloc(n int) []byte {
+	if n == 0 {
+		return nil
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	pageSize := unix.Getpagesize()
+	m, err := unix.Mmap(-1, 0, (n+pageSize-1)/pageSize*pageSize,
+		unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANON)
+	if err != nil {
+		fallback("mmap failed", err)
+		return make([]byte, n)
+	}
+	if err = unix.Mlock(m); err != nil {
+		fallback("mlock failed", err)
+	}
+	if err = syscallcompat.DontDump(m); err != nil {
+		tlog.Debug.Printf("secmem: DontDump: %v", err)
+	}
+	b := m[:n:n]
+	live[&b[0]] = m
+	return b
+}
+
+// Copy returns a copy of "in" in locked memory. "in" is left alone.
+func Copy(in []byte) []byte {
+	b := Alloc(len(in))
+	copy(b, in)
+	return b
+}
+
+// Free zeroes "b" and, if it has been allocated by us, releases it. "b"
+// must not be used afterwards. Free accepts any buffer, so it can be used
+// for keys no matter where they come from.
+func Free(b []byte) {
+	Wipe(b)
+	if len(b) == 0 {
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	m, ok := live[&b[0]]
+	if !ok {
+		return
+	}
+	delete(live, &b[0])
+	unix.Munlock(m)
+	if err := unix.Munmap(m); err != nil {
+		tlog.Warn.Printf("secmem: munmap: %v", err)
+	}
+}
+
+// Wipe zeroes "b"
+func Wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// WipeAll zeroes every buffer that has not been freed yet. For when we exit
+// without cleaning up. Everything still using the keys breaks.
+func WipeAll() {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, m := range live {
+		Wipe(m)
+	}
+}
+
+// Live returns the number of buffers that have not been freed yet. Used by
+// the tests.
+func Live() int {
+	mu.Lock()
+	defer mu.Unlock()
+	return len(live)
+}
+
+// IsLocked tells if "b" is one of our buffers
+func IsLocked(b []byte) bool {
+	if len(b) == 0 {
+		return false
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	_, ok := live[&b[0]]
+	return ok
+}
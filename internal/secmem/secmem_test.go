@@ -0,0 +1,49 @@
+package secmem
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestAllocFree(t *testing.T) {
+	n := Live()
+	b := Alloc(64)
+	if len(b) != 64 || cap(b) != 64 {
+		t.Fatalf("len=%d cap=%d", len(b), cap(b))
+	}
+	if !bytes.Equal(b, make([]byte, 64)) {
+		t.Error("buffer is not zeroed")
+	}
+	if !IsLocked(b) || Live() != n+1 {
+		t.Fatal("buffer is not tracked")
+	}
+	c := Copy([]byte("secret"))
+	if string(c) != "secret" {
+		t.Errorf("Copy: %q", c)
+	}
+	WipeAll()
+	if !bytes.Equal(c, make([]byte, 6)) {
+		t.Error("WipeAll did not zero the buffer")
+	}
+	Free(b)
+	Free(c)
+	if Live() != n {
+		t.Errorf("%d buffers left, want %d", Live(), n)
+	}
+}
+
+// Free must take buffers that do not come from Alloc
+func TestFreeHeap(t *testing.T) {
+	h := []byte("secret")
+	Free(h)
+	if !bytes.Equal(h, make([]byte, 6)) {
+		t.Error("Free did not zero the buffer")
+	}
+	if IsLocked(h) {
+		t.Error("heap buffer is tracked")
+	}
+	Free(nil)
+	if Alloc(0) != nil {
+		t.Error("Alloc(0) should return nil")
+	}
+}
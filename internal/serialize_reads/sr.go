@@ -103,7 +103,6 @@ func (sr *serializerState) pop() *submission {
 }
 
 func (sr *serializerState) eventLoop() {
-	sr.input = make(chan *submission)
 	empty := true
 	for {
 		if empty {
@@ -141,10 +140,16 @@ func (sr *serializerState) unblockOne() (empty bool) {
 
 var serializer serializerState
 
+var initOnce sync.Once
+
 // InitSerializer sets up the internal serializer state and starts the event loop.
-// Called by fusefrontend.NewFS.
+// Called by fusefrontend.NewRootNode. The serializer is shared by all
+// filesystems of the process, which usually sit on the same disk, so only
+// the first call does something.
 func InitSerializer() {
-	serializer.input = make(chan *submission)
-	serializer.q = make([]*submission, 10)
-	go serializer.eventLoop()
+	initOnce.Do(func() {
+		serializer.input = make(chan *submission)
+		serializer.q = make([]*submission, 10)
+		go serializer.eventLoop()
+	})
 }
@@ -7,6 +7,8 @@ import (
 	"log"
 
 	"github.com/jacobsa/crypto/siv"
+
+	"github.com/rfjakob/gocryptfs/internal/secmem"
 )
 
 type sivAead struct {
@@ -33,8 +35,9 @@ func New(key []byte) cipher.AEAD {
 
 // Same as "New" without the 64-byte restriction.
 func new2(keyIn []byte) cipher.AEAD {
-	// Create a private copy so the caller can zero the one he owns
-	key := append([]byte{}, keyIn...)
+	// Create a private copy so the caller can zero the one he owns. It
+	// lives in locked memory.
+	key := secmem.Copy(keyIn)
 	return &sivAead{
 		key: key,
 	}
@@ -90,8 +93,6 @@ func (s *sivAead) Open(dst, nonce, ciphertext, authData []byte) ([]byte, error)
 // This is not bulletproof due to possible GC copies, but
 // still raises to bar for extracting the key.
 func (s *sivAead) Wipe() {
-	for i := range s.key {
-		s.key[i] = 0
-	}
+	secmem.Free(s.key)
 	s.key = nil
 }
@@ -13,6 +13,8 @@ import (
 	"fmt"
 	"log"
 	"unsafe"
+
+	"github.com/rfjakob/gocryptfs/internal/secmem"
 )
 
 const (
@@ -38,8 +40,8 @@ func New(keyIn []byte, forceDecode bool) cipher.AEAD {
 	if len(keyIn) != keyLen {
 		log.Panicf("Only %d-byte keys are supported", keyLen)
 	}
-	// Create a private copy of the key
-	key := append([]byte{}, keyIn...)
+	// Create a private copy of the key, in locked memory
+	key := secmem.Copy(keyIn)
 	return &StupidGCM{key: key, forceDecode: forceDecode}
 }
 
@@ -242,8 +244,6 @@ func (g *StupidGCM) Open(dst, iv, in, authData []byte) ([]byte, error) {
 // This is not bulletproof due to possible GC copies, but
 // still raises to bar for extracting the key.
 func (g *StupidGCM) Wipe() {
-	for i := range g.key {
-		g.key[i] = 0
-	}
+	secmem.Free(g.key)
 	g.key = nil
 }
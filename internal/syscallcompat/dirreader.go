@@ -0,0 +1,33 @@
+package syscallcompat
+
+import (
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// dirReaderBufSize is the getdents buffer size of DirReader. Enough for a few
+// hundred entries.
+const dirReaderBufSize = 32 * 1024
+
+// DirReader reads the entries of a directory in batches. Unlike Getdents, it
+// does not need memory for the whole directory at once, which matters for
+// directories with millions of entries.
+type DirReader struct {
+	fd int
+	// getdents buffer (Linux)
+	buf []byte
+	// all entries have been returned (Darwin)
+	done bool
+}
+
+// NewDirReader returns a DirReader for the open directory "fd". The caller
+// keeps ownership of "fd" and must not close it before it is done reading.
+func NewDirReader(fd int) *DirReader {
+	return &DirReader{fd: fd}
+}
+
+// Next returns the next batch of entries, without "." and "..". Returns
+// io.EOF after the last batch. A batch may be empty if all entries in it were
+// skipped.
+func (r *DirReader) Next() ([]fuse.DirEntry, error) {
+	return r.next()
+}
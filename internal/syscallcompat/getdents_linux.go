@@ -8,6 +8,7 @@ package syscallcompat
 
 import (
 	"bytes"
+	"io"
 	"sync"
 	"syscall"
 	"unsafe"
@@ -56,7 +57,38 @@ func getdents(fd int) ([]fuse.DirEntry, error) {
 	// Make sure we have at least Sizeof(Dirent) of zeros after the last
 	// entry. This prevents a cast to Dirent from reading past the buffer.
 	smartBuf.Grow(sizeofDirent)
-	buf := smartBuf.Bytes()
+	return parseDirents(fd, smartBuf.Bytes())
+}
+
+// getdentsBatch reads one batch of entries from the open directory "fd",
+// as many as fit into "tmp". Returns io.EOF at the end of the directory.
+func getdentsBatch(fd int, tmp []byte) ([]fuse.DirEntry, error) {
+	var n int
+	var err error
+	for {
+		n, err = unix.Getdents(fd, tmp[:len(tmp)-sizeofDirent])
+		// unix.Getdents has been observed to return EINTR on cifs mounts
+		if err != unix.EINTR || n > 0 {
+			break
+		}
+	}
+	if err != nil && err != unix.EINTR {
+		return nil, err
+	}
+	if n <= 0 {
+		return nil, io.EOF
+	}
+	// See getdents() for why we need Sizeof(Dirent) zeros at the end
+	for i := n; i < n+sizeofDirent; i++ {
+		tmp[i] = 0
+	}
+	return parseDirents(fd, tmp[:n])
+}
+
+// parseDirents converts the raw getdents output in "buf" to
+// []fuse.DirEntry. "buf" must be followed by at least Sizeof(Dirent) bytes of
+// zeros.
+func parseDirents(fd int, buf []byte) ([]fuse.DirEntry, error) {
 	// Count the number of directory entries in the buffer so we can allocate
 	// a fuse.DirEntry slice of the correct size at once.
 	var numEntries, offset int
@@ -3,8 +3,11 @@
 package syscallcompat
 
 import (
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"reflect"
 	"runtime"
 	"strings"
 	"syscall"
@@ -116,3 +119,49 @@ func testGetdents(t *testing.T) {
 		}
 	}
 }
+
+// TestDirReader checks that DirReader returns the same entries as Getdents,
+// spread over several batches.
+func TestDirReader(t *testing.T) {
+	testDir, err := ioutil.TempDir(tmpDir, "TestDirReader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2000; i++ {
+		err = ioutil.WriteFile(fmt.Sprintf("%s/file%04d", testDir, i), nil, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	fd, err := syscall.Open(testDir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fd)
+	want, err := getdents(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = syscall.Seek(fd, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	r := NewDirReader(fd)
+	var have []fuse.DirEntry
+	batches := 0
+	for {
+		entries, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		have = append(have, entries...)
+		batches++
+	}
+	if batches < 2 {
+		t.Errorf("expected several batches, got %d", batches)
+	}
+	if !reflect.DeepEqual(want, have) {
+		t.Errorf("DirReader returned %d entries, getdents %d", len(have), len(want))
+	}
+}
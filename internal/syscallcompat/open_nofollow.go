@@ -30,7 +30,19 @@ func OpenDirNofollow(baseDir string, relPath string) (fd int, err error) {
 	if err != nil {
 		return -1, err
 	}
-	// Caller wanted to open baseDir itself?
+	return OpenDirNofollowAt(dirfd, relPath)
+}
+
+// OpenDirNofollowAt is like OpenDirNofollow, but starts at the directory
+// "dirfd" instead of a path. "dirfd" is consumed: it is closed, or returned
+// if "relPath" is empty.
+func OpenDirNofollowAt(dirfd int, relPath string) (fd int, err error) {
+	if filepath.IsAbs(relPath) {
+		syscall.Close(dirfd)
+		tlog.Warn.Printf("BUG: OpenDirNofollowAt called with absolute relPath=%q", relPath)
+		return -1, syscall.EINVAL
+	}
+	// Caller wanted to open dirfd itself?
 	if relPath == "" {
 		return dirfd, nil
 	}
@@ -1,6 +1,7 @@
 package syscallcompat
 
 import (
+	"io"
 	"log"
 	"path/filepath"
 	"runtime"
@@ -24,6 +25,20 @@ const (
 	// RENAME_NOREPLACE is only defined on Linux
 	RENAME_NOREPLACE = 0
 
+	// RENAME_EXCHANGE is only defined on Linux
+	RENAME_EXCHANGE = 0
+
+	// SEEK_DATA and SEEK_HOLE have swapped values compared to Linux, see
+	// sys/unistd.h
+	SEEK_HOLE = 3
+	SEEK_DATA = 4
+
+	// UTIME_NOW and UTIME_OMIT are special values for the Nsec field of the
+	// timestamps passed to FutimesNano and UtimesNanoAtNofollow. Same values
+	// as in sys/stat.h.
+	UTIME_NOW  = -1
+	UTIME_OMIT = -2
+
 	// KAUTH_UID_NONE and KAUTH_GID_NONE are special values to
 	// revert permissions to the process credentials.
 	KAUTH_UID_NONE = ^uint32(0) - 100
@@ -69,6 +84,28 @@ func Fallocate(fd int, mode uint32, off int64, len int64) error {
 	return syscall.EOPNOTSUPP
 }
 
+// PunchHole is not implemented on Darwin. F_PUNCHHOLE exists, but is only
+// supported on APFS.
+func PunchHole(fd int, off int64, len int64) error {
+	return syscall.EOPNOTSUPP
+}
+
+// OFDGetlk is not implemented on Darwin, which has no open file description
+// locks.
+func OFDGetlk(fd int, lk *syscall.Flock_t) error {
+	return syscall.EOPNOTSUPP
+}
+
+// See above.
+func OFDSetlk(fd int, lk *syscall.Flock_t) error {
+	return syscall.EOPNOTSUPP
+}
+
+// Reopen is not implemented on Darwin.
+func Reopen(fd int, flags int) (int, error) {
+	return -1, syscall.EOPNOTSUPP
+}
+
 // Dup3 is not available on Darwin, so we use Dup2 instead.
 func Dup3(oldfd int, newfd int, flags int) (err error) {
 	if flags != 0 {
@@ -77,6 +114,12 @@ func Dup3(oldfd int, newfd int, flags int) (err error) {
 	return syscall.Dup2(oldfd, newfd)
 }
 
+// SupplementaryGroups returns the supplementary groups of the process "pid".
+// Not implemented on Darwin, always returns nil.
+func SupplementaryGroups(pid uint32) (gids []int) {
+	return nil
+}
+
 ////////////////////////////////////////////////////////
 //// Emulated Syscalls (see emulate.go) ////////////////
 ////////////////////////////////////////////////////////
@@ -159,25 +202,34 @@ type attrList struct {
 	Forkattr    uint32
 }
 
-func timesToAttrList(a *time.Time, m *time.Time) (attrList attrList, attributes [2]unix.Timespec) {
+func timesToAttrList(a unix.Timespec, m unix.Timespec) (attrList attrList, attributes [2]unix.Timespec) {
 	attrList.bitmapCount = unix.ATTR_BIT_MAP_COUNT
 	attrList.CommonAttr = 0
+	// setattrlist knows no UTIME_NOW
+	now, _ := unix.TimeToTimespec(time.Now())
 	i := 0
-	if m != nil {
-		attributes[i] = unix.Timespec(fuse.UtimeToTimespec(m))
+	if m.Nsec != UTIME_OMIT {
+		if m.Nsec == UTIME_NOW {
+			m = now
+		}
+		attributes[i] = m
 		attrList.CommonAttr |= unix.ATTR_CMN_MODTIME
 		i += 1
 	}
-	if a != nil {
-		attributes[i] = unix.Timespec(fuse.UtimeToTimespec(a))
+	if a.Nsec != UTIME_OMIT {
+		if a.Nsec == UTIME_NOW {
+			a = now
+		}
+		attributes[i] = a
 		attrList.CommonAttr |= unix.ATTR_CMN_ACCTIME
 		i += 1
 	}
 	return attrList, attributes
 }
 
-// FutimesNano syscall.
-func FutimesNano(fd int, a *time.Time, m *time.Time) (err error) {
+// FutimesNano syscall. "a" and "m" are the new access and modification times.
+// Their Nsec field can be UTIME_NOW or UTIME_OMIT.
+func FutimesNano(fd int, a unix.Timespec, m unix.Timespec) (err error) {
 	attrList, attributes := timesToAttrList(a, m)
 	return fsetattrlist(fd, unsafe.Pointer(&attrList), unsafe.Pointer(&attributes),
 		unsafe.Sizeof(attributes), 0)
@@ -186,9 +238,9 @@ func FutimesNano(fd int, a *time.Time, m *time.Time) (err error) {
 // UtimesNanoAtNofollow is like UtimesNanoAt but never follows symlinks.
 //
 // Unfortunately we cannot use unix.UtimesNanoAt since it is broken and just
-// ignores the provided 'dirfd'. In addition, it also lacks handling of 'nil'
-// pointers (used to preserve one of both timestamps).
-func UtimesNanoAtNofollow(dirfd int, path string, a *time.Time, m *time.Time) (err error) {
+// ignores the provided 'dirfd'. In addition, it also lacks handling of
+// UTIME_OMIT (used to preserve one of both timestamps).
+func UtimesNanoAtNofollow(dirfd int, path string, a unix.Timespec, m unix.Timespec) (err error) {
 	if !filepath.IsAbs(path) {
 		chdirMutex.Lock()
 		defer chdirMutex.Unlock()
@@ -219,7 +271,39 @@ func Getdents(fd int) ([]fuse.DirEntry, error) {
 	return emulateGetdents(fd)
 }
 
+// next implements DirReader.Next. There is no getdents on Darwin, so we
+// return the whole directory in the first batch.
+func (r *DirReader) next() ([]fuse.DirEntry, error) {
+	if r.done {
+		return nil, io.EOF
+	}
+	r.done = true
+	return emulateGetdents(r.fd)
+}
+
 // Renameat2 does not exist on Darwin, so we call Renameat and ignore the flags.
 func Renameat2(olddirfd int, oldpath string, newdirfd int, newpath string, flags uint) (err error) {
 	return unix.Renameat(olddirfd, oldpath, newdirfd, newpath)
 }
+
+// Reflink is not implemented on Darwin. clonefile(2) works on paths, not on
+// file descriptors.
+func Reflink(dstFd int, srcFd int) error {
+	return syscall.EOPNOTSUPP
+}
+
+// LowerThreadPriority is not implemented on Darwin, which cannot set the
+// priority of a single thread.
+func LowerThreadPriority() error {
+	return syscall.EOPNOTSUPP
+}
+
+// Setpriority sets the CPU nice value of the whole process.
+func Setpriority(nice int) error {
+	return unix.Setpriority(unix.PRIO_PROCESS, 0, nice)
+}
+
+// DontDump is not implemented on Darwin, which has no MADV_DONTDUMP
+func DontDump(b []byte) error {
+	return syscall.EOPNOTSUPP
+}
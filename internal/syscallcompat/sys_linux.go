@@ -9,7 +9,6 @@ import (
 	"strings"
 	"sync"
 	"syscall"
-	"time"
 
 	"golang.org/x/sys/unix"
 
@@ -30,6 +29,22 @@ const (
 
 	// RENAME_NOREPLACE is only defined on Linux
 	RENAME_NOREPLACE = unix.RENAME_NOREPLACE
+
+	// RENAME_EXCHANGE is only defined on Linux
+	RENAME_EXCHANGE = unix.RENAME_EXCHANGE
+
+	// _FICLONE is the ioctl that makes "fd" share the blocks of another
+	// file, see ioctl_ficlone(2). Not in our version of x/sys/unix yet.
+	_FICLONE = 0x40049409
+
+	// SEEK_DATA and SEEK_HOLE are lseek(2) "whence" values
+	SEEK_DATA = 3
+	SEEK_HOLE = 4
+
+	// UTIME_NOW and UTIME_OMIT are special values for the Nsec field of the
+	// timestamps passed to FutimesNano and UtimesNanoAtNofollow
+	UTIME_NOW  = unix.UTIME_NOW
+	UTIME_OMIT = unix.UTIME_OMIT
 )
 
 var preallocWarn sync.Once
@@ -65,7 +80,46 @@ func Fallocate(fd int, mode uint32, off int64, len int64) (err error) {
 	return syscall.Fallocate(fd, mode, off, len)
 }
 
-func getSupplementaryGroups(pid uint32) (gids []int) {
+// PunchHole deallocates the range "off" to "off+len" of the file without
+// changing the file size. The range reads back as zeros.
+func PunchHole(fd int, off int64, len int64) (err error) {
+	for {
+		err = syscall.Fallocate(fd, unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, off, len)
+		if err != syscall.EINTR {
+			return err
+		}
+	}
+}
+
+// OFDGetlk wraps fcntl(F_OFD_GETLK). Open file description locks belong to
+// the open file description instead of the process, so they let us keep the
+// POSIX locks of different processes apart although they all end up here.
+func OFDGetlk(fd int, lk *syscall.Flock_t) (err error) {
+	return retryEINTR(func() error {
+		return syscall.FcntlFlock(uintptr(fd), unix.F_OFD_GETLK, lk)
+	})
+}
+
+// OFDSetlk wraps fcntl(F_OFD_SETLK). It never blocks and returns EAGAIN if a
+// conflicting lock is held.
+func OFDSetlk(fd int, lk *syscall.Flock_t) (err error) {
+	return retryEINTR(func() error {
+		return syscall.FcntlFlock(uintptr(fd), unix.F_OFD_SETLK, lk)
+	})
+}
+
+// Reopen opens the file behind "fd" again, which gives a new open file
+// description, unlike dup(2).
+func Reopen(fd int, flags int) (newFd int, err error) {
+	procPath := fmt.Sprintf("/proc/self/fd/%d", fd)
+	return retryEINTR2(func() (int, error) {
+		return syscall.Open(procPath, flags|syscall.O_CLOEXEC, 0)
+	})
+}
+
+// SupplementaryGroups returns the supplementary groups of the process "pid",
+// read from /proc. Returns nil on error.
+func SupplementaryGroups(pid uint32) (gids []int) {
 	procPath := fmt.Sprintf("/proc/%d/task/%d/status", pid, pid)
 	blob, err := ioutil.ReadFile(procPath)
 	if err != nil {
@@ -97,7 +151,7 @@ func OpenatUser(dirfd int, path string, flags int, mode uint32, context *fuse.Co
 		runtime.LockOSThread()
 		defer runtime.UnlockOSThread()
 
-		err = syscall.Setgroups(getSupplementaryGroups(context.Pid))
+		err = syscall.Setgroups(SupplementaryGroups(context.Pid))
 		if err != nil {
 			return -1, err
 		}
@@ -130,7 +184,7 @@ func MknodatUser(dirfd int, path string, mode uint32, dev int, context *fuse.Con
 		runtime.LockOSThread()
 		defer runtime.UnlockOSThread()
 
-		err = syscall.Setgroups(getSupplementaryGroups(context.Pid))
+		err = syscall.Setgroups(SupplementaryGroups(context.Pid))
 		if err != nil {
 			return err
 		}
@@ -198,7 +252,7 @@ func SymlinkatUser(oldpath string, newdirfd int, newpath string, context *fuse.C
 		runtime.LockOSThread()
 		defer runtime.UnlockOSThread()
 
-		err = syscall.Setgroups(getSupplementaryGroups(context.Pid))
+		err = syscall.Setgroups(SupplementaryGroups(context.Pid))
 		if err != nil {
 			return err
 		}
@@ -226,7 +280,7 @@ func MkdiratUser(dirfd int, path string, mode uint32, caller *fuse.Caller) (err
 		runtime.LockOSThread()
 		defer runtime.UnlockOSThread()
 
-		err = syscall.Setgroups(getSupplementaryGroups(caller.Pid))
+		err = syscall.Setgroups(SupplementaryGroups(caller.Pid))
 		if err != nil {
 			return err
 		}
@@ -248,16 +302,10 @@ func MkdiratUser(dirfd int, path string, mode uint32, caller *fuse.Caller) (err
 	return Mkdirat(dirfd, path, mode)
 }
 
-func timesToTimespec(a *time.Time, m *time.Time) []unix.Timespec {
-	ts := make([]unix.Timespec, 2)
-	ts[0] = unix.Timespec(fuse.UtimeToTimespec(a))
-	ts[1] = unix.Timespec(fuse.UtimeToTimespec(m))
-	return ts
-}
-
-// FutimesNano syscall.
-func FutimesNano(fd int, a *time.Time, m *time.Time) (err error) {
-	ts := timesToTimespec(a, m)
+// FutimesNano syscall. "a" and "m" are the new access and modification times.
+// Their Nsec field can be UTIME_NOW or UTIME_OMIT.
+func FutimesNano(fd int, a unix.Timespec, m unix.Timespec) (err error) {
+	ts := []unix.Timespec{a, m}
 	// To avoid introducing a separate syscall wrapper for futimens()
 	// (as done in go-fuse, for example), we instead use the /proc/self/fd trick.
 	procPath := fmt.Sprintf("/proc/self/fd/%d", fd)
@@ -265,9 +313,10 @@ func FutimesNano(fd int, a *time.Time, m *time.Time) (err error) {
 }
 
 // UtimesNanoAtNofollow is like UtimesNanoAt but never follows symlinks.
+// See FutimesNano for "a" and "m".
 // Retries on EINTR.
-func UtimesNanoAtNofollow(dirfd int, path string, a *time.Time, m *time.Time) (err error) {
-	ts := timesToTimespec(a, m)
+func UtimesNanoAtNofollow(dirfd int, path string, a unix.Timespec, m unix.Timespec) (err error) {
+	ts := []unix.Timespec{a, m}
 	err = retryEINTR(func() error {
 		return unix.UtimesNanoAt(dirfd, path, ts, unix.AT_SYMLINK_NOFOLLOW)
 	})
@@ -279,6 +328,14 @@ func Getdents(fd int) ([]fuse.DirEntry, error) {
 	return getdents(fd)
 }
 
+// next implements DirReader.Next.
+func (r *DirReader) next() ([]fuse.DirEntry, error) {
+	if r.buf == nil {
+		r.buf = make([]byte, dirReaderBufSize)
+	}
+	return getdentsBatch(r.fd, r.buf)
+}
+
 // Renameat2 does not exist on Darwin, so we have to wrap it here.
 // Retries on EINTR.
 func Renameat2(olddirfd int, oldpath string, newdirfd int, newpath string, flags uint) (err error) {
@@ -287,3 +344,60 @@ func Renameat2(olddirfd int, oldpath string, newdirfd int, newpath string, flags
 	})
 	return err
 }
+
+// Reflink makes the empty file "dstFd" a copy-on-write copy of "srcFd",
+// which shares all blocks with it. Only works on filesystems like Btrfs and
+// XFS, and fails with EOPNOTSUPP, EXDEV or EINVAL elsewhere.
+func Reflink(dstFd int, srcFd int) error {
+	return unix.IoctlSetInt(dstFd, _FICLONE, srcFd)
+}
+
+// LowerThreadPriority gives the calling thread the lowest CPU priority
+// (nice 19) and the "idle" IO scheduling class. The goroutine must be
+// locked to the thread using runtime.LockOSThread().
+func LowerThreadPriority() error {
+	tid := unix.Gettid()
+	err := unix.Setpriority(unix.PRIO_PROCESS, tid, 19)
+	if err != nil {
+		return err
+	}
+	// See ioprio_set(2)
+	const ioprioWhoProcess = 1
+	const ioprioClassIdle = 3
+	const ioprioClassShift = 13
+	_, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), ioprioClassIdle<<ioprioClassShift)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Setpriority sets the CPU nice value of the whole process. On Linux, the
+// nice value is a per-thread attribute, so we have to walk all threads.
+// Threads created later inherit the value from the thread that creates them.
+// A second pass catches threads that were created while we were busy.
+func Setpriority(nice int) error {
+	for pass := 0; pass < 2; pass++ {
+		tasks, err := ioutil.ReadDir("/proc/self/task")
+		if err != nil {
+			return err
+		}
+		for _, t := range tasks {
+			tid, err := strconv.Atoi(t.Name())
+			if err != nil {
+				continue
+			}
+			err = unix.Setpriority(unix.PRIO_PROCESS, tid, nice)
+			// The thread may have exited in the meantime
+			if err != nil && err != syscall.ESRCH {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// DontDump excludes the memory mapping "b" from core dumps
+func DontDump(b []byte) error {
+	return unix.Madvise(b, unix.MADV_DONTDUMP)
+}
@@ -0,0 +1,77 @@
+package syscallcompat
+
+import (
+	"crypto/rand"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// wipeChunk is the size of the random buffer that is written in one go.
+const wipeChunk = 128 * 1024
+
+// Wipe overwrites the contents of the regular file "fd" with random data and
+// syncs it to disk. Files that have more than one hard link are left alone,
+// because the data is still reachable through the other names.
+//
+// Note that this only helps on storage that overwrites data in place. Copy-on-
+// write filesystems, SSDs and snapshots may keep the old blocks around.
+func Wipe(fd int) error {
+	return WipeFrom(fd, 0)
+}
+
+// WipeFrom is like Wipe, but only overwrites the contents after offset "off",
+// for example before the file is truncated to "off".
+func WipeFrom(fd int, off int64) error {
+	var st unix.Stat_t
+	err := unix.Fstat(fd, &st)
+	if err != nil {
+		return err
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFREG || st.Nlink > 1 || off >= st.Size {
+		return nil
+	}
+	buf := make([]byte, wipeChunk)
+	for ; off < st.Size; off += wipeChunk {
+		n := st.Size - off
+		if n > wipeChunk {
+			n = wipeChunk
+		}
+		_, err = rand.Read(buf[:n])
+		if err != nil {
+			return err
+		}
+		_, err = unix.Pwrite(fd, buf[:n], off)
+		if err != nil {
+			return err
+		}
+	}
+	return unix.Fsync(fd)
+}
+
+// OpenWipeAt opens "path" relative to "dirfd" for writing, without following
+// symlinks, so it can be passed to Wipe() later. Returns -1 and no error for
+// anything that is not a regular file (opening a FIFO for writing would
+// block).
+func OpenWipeAt(dirfd int, path string) (fd int, err error) {
+	var st unix.Stat_t
+	err = Fstatat(dirfd, path, &st, unix.AT_SYMLINK_NOFOLLOW)
+	if err != nil {
+		return -1, err
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		return -1, nil
+	}
+	return Openat(dirfd, path, syscall.O_WRONLY|syscall.O_NOFOLLOW, 0)
+}
+
+// WipeAt opens "path" relative to "dirfd" without following symlinks and
+// calls Wipe() on it. Anything that is not a regular file is skipped.
+func WipeAt(dirfd int, path string) error {
+	fd, err := OpenWipeAt(dirfd, path)
+	if fd < 0 {
+		return err
+	}
+	defer syscall.Close(fd)
+	return Wipe(fd)
+}
@@ -6,9 +6,12 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"log/syslog"
 	"os"
+	"strings"
+	"time"
 
 	"golang.org/x/crypto/ssh/terminal"
 )
@@ -53,6 +56,10 @@ type toggledLogger struct {
 	// Private prefix and postfix are used for coloring
 	prefix  string
 	postfix string
+	// Severity name used in JSON output
+	level string
+	// Debug category, prepended to the messages
+	category string
 
 	Logger *log.Logger
 }
@@ -68,12 +75,35 @@ func trimNewline(msg string) string {
 	return msg
 }
 
+// jsonFormat is set by SwitchToJSON
+var jsonFormat bool
+
+// jsonLine formats one message as a JSON object, without a trailing newline.
+func jsonLine(level string, msg string) string {
+	b, err := json.Marshal(struct {
+		Time  string `json:"time"`
+		Level string `json:"level"`
+		Msg   string `json:"msg"`
+	}{time.Now().Format(time.RFC3339Nano), level, msg})
+	if err != nil {
+		return err.Error()
+	}
+	return string(b)
+}
+
 func (l *toggledLogger) Printf(format string, v ...interface{}) {
 	if !l.Enabled {
 		return
 	}
 	msg := trimNewline(fmt.Sprintf(format, v...))
-	l.Logger.Printf(l.prefix + msg + l.postfix)
+	if l.category != "" {
+		msg = l.category + ": " + msg
+	}
+	if jsonFormat {
+		l.Logger.Print(jsonLine(l.level, msg))
+	} else {
+		l.Logger.Printf(l.prefix + msg + l.postfix)
+	}
 	if l.Wpanic {
 		l.Logger.Panic(wpanicMsg + msg)
 	}
@@ -83,7 +113,14 @@ func (l *toggledLogger) Println(v ...interface{}) {
 		return
 	}
 	msg := trimNewline(fmt.Sprint(v...))
-	l.Logger.Println(l.prefix + msg + l.postfix)
+	if l.category != "" {
+		msg = l.category + ": " + msg
+	}
+	if jsonFormat {
+		l.Logger.Print(jsonLine(l.level, msg))
+	} else {
+		l.Logger.Println(l.prefix + msg + l.postfix)
+	}
 	if l.Wpanic {
 		l.Logger.Panic(wpanicMsg + msg)
 	}
@@ -93,6 +130,23 @@ func (l *toggledLogger) Println(v ...interface{}) {
 // Can be enabled by passing "-d"
 var Debug *toggledLogger
 
+// Debug categories. They log like Debug, but can be enabled on their own
+// by passing "-d=CATEGORY,...", see EnableDebug.
+var (
+	// DebugNames logs file name encryption
+	DebugNames *toggledLogger
+	// DebugContent logs file content encryption and file I/O
+	DebugContent *toggledLogger
+	// DebugLocks logs file locking
+	DebugLocks *toggledLogger
+	// DebugCache logs the directory and inode caches
+	DebugCache *toggledLogger
+)
+
+// DebugFuse is set by EnableDebug if the "fuse" category was requested. The
+// FUSE requests are logged by go-fuse, so there is no logger for them.
+var DebugFuse bool
+
 // Info logs informational message
 // Can be disabled by passing "-q"
 var Info *toggledLogger
@@ -116,28 +170,114 @@ func init() {
 
 	Debug = &toggledLogger{
 		Logger: log.New(os.Stdout, "", 0),
+		level:  "debug",
 	}
+	// The categories share the log.Logger of Debug, so they are switched to
+	// syslog together with it
+	DebugNames = &toggledLogger{Logger: Debug.Logger, level: "debug", category: "names"}
+	DebugContent = &toggledLogger{Logger: Debug.Logger, level: "debug", category: "content"}
+	DebugLocks = &toggledLogger{Logger: Debug.Logger, level: "debug", category: "locks"}
+	DebugCache = &toggledLogger{Logger: Debug.Logger, level: "debug", category: "cache"}
 	Info = &toggledLogger{
 		Enabled: true,
 		Logger:  log.New(os.Stdout, "", 0),
+		level:   "info",
 	}
 	Warn = &toggledLogger{
 		Enabled: true,
 		Logger:  log.New(os.Stderr, "", 0),
 		prefix:  ColorYellow,
 		postfix: ColorReset,
+		level:   "warning",
 	}
 	Fatal = &toggledLogger{
 		Enabled: true,
 		Logger:  log.New(os.Stderr, "", 0),
 		prefix:  ColorRed,
 		postfix: ColorReset,
+		level:   "fatal",
 	}
 }
 
-// SwitchToSyslog redirects the output of this logger to syslog.
-func (l *toggledLogger) SwitchToSyslog(p syslog.Priority) {
-	w, err := syslog.New(p, ProgramName)
+// EnableDebug enables debug output. "categories" is a comma-separated list
+// of "names", "content", "fuse", "locks" and "cache", and enables only the
+// messages of those. An empty list or "all" enables all debug messages
+// except for "fuse".
+func EnableDebug(categories string) error {
+	if categories == "" || categories == "all" {
+		Debug.Enabled = true
+		DebugNames.Enabled = true
+		DebugContent.Enabled = true
+		DebugLocks.Enabled = true
+		DebugCache.Enabled = true
+		return nil
+	}
+	for _, c := range strings.Split(categories, ",") {
+		switch c {
+		case "names":
+			DebugNames.Enabled = true
+		case "content":
+			DebugContent.Enabled = true
+		case "fuse":
+			DebugFuse = true
+		case "locks":
+			DebugLocks.Enabled = true
+		case "cache":
+			DebugCache.Enabled = true
+		default:
+			return fmt.Errorf("unknown debug category %q", c)
+		}
+	}
+	return nil
+}
+
+// DisableDebug disables all debug output, including "fuse".
+func DisableDebug() {
+	Debug.Enabled = false
+	DebugNames.Enabled = false
+	DebugContent.Enabled = false
+	DebugLocks.Enabled = false
+	DebugCache.Enabled = false
+	DebugFuse = false
+}
+
+// DebugEnabled returns true if any debug output is enabled.
+func DebugEnabled() bool {
+	return Debug.Enabled || DebugNames.Enabled || DebugContent.Enabled ||
+		DebugLocks.Enabled || DebugCache.Enabled || DebugFuse
+}
+
+// jsonWriter turns each write, which is one line from a log.Logger, into a
+// JSON object.
+type jsonWriter struct {
+	w     io.Writer
+	level string
+}
+
+func (j jsonWriter) Write(p []byte) (int, error) {
+	_, err := fmt.Fprintln(j.w, jsonLine(j.level, trimNewline(string(p))))
+	return len(p), err
+}
+
+// SwitchToJSON makes all loggers, including the generic logger that the
+// go-fuse lib uses, print one JSON object per message, with the fields
+// "time", "level" and "msg". Call it before logging anything else.
+func SwitchToJSON() {
+	jsonFormat = true
+	// Colors would end up inside the messages
+	ColorReset, ColorGrey, ColorRed, ColorGreen, ColorYellow = "", "", "", "", ""
+	for _, l := range []*toggledLogger{Debug, Info, Warn, Fatal} {
+		l.prefix = ""
+		l.postfix = ""
+	}
+	log.SetFlags(0)
+	log.SetOutput(jsonWriter{w: os.Stderr, level: "warning"})
+}
+
+// SwitchToSyslog redirects the output of this logger to syslog. The messages
+// are tagged with "tag".
+func (l *toggledLogger) SwitchToSyslog(p syslog.Priority, tag string) {
+	w, err := syslog.New(p, tag)
 	if err != nil {
 		Warn.Printf("SwitchToSyslog: %v", err)
 	} else {
@@ -150,16 +290,38 @@ func (l *toggledLogger) SwitchToSyslog(p syslog.Priority) {
 
 // SwitchLoggerToSyslog redirects the default log.Logger that the go-fuse lib uses
 // to syslog.
-func SwitchLoggerToSyslog(p syslog.Priority) {
-	w, err := syslog.New(p, ProgramName)
+func SwitchLoggerToSyslog(p syslog.Priority, tag string) {
+	w, err := syslog.New(p, tag)
 	if err != nil {
 		Warn.Printf("SwitchLoggerToSyslog: %v", err)
 	} else {
 		log.SetPrefix("go-fuse: ")
 		// Disable printing the timestamp, syslog already provides that
 		log.SetFlags(0)
-		log.SetOutput(w)
+		if jsonFormat {
+			log.SetOutput(jsonWriter{w: w, level: "warning"})
+		} else {
+			log.SetOutput(w)
+		}
+	}
+}
+
+// SwitchAllToSyslog redirects all of our loggers and the generic logger to
+// syslog, with the severity matching the logger. The messages are tagged
+// with "tag".
+func SwitchAllToSyslog(tag string) {
+	// Warn only once if there is no syslog daemon
+	w, err := syslog.New(syslog.LOG_USER|syslog.LOG_INFO, tag)
+	if err != nil {
+		Warn.Printf("SwitchAllToSyslog: %v", err)
+		return
 	}
+	w.Close()
+	Info.SwitchToSyslog(syslog.LOG_USER|syslog.LOG_INFO, tag)
+	Debug.SwitchToSyslog(syslog.LOG_USER|syslog.LOG_DEBUG, tag)
+	Warn.SwitchToSyslog(syslog.LOG_USER|syslog.LOG_WARNING, tag)
+	Fatal.SwitchToSyslog(syslog.LOG_USER|syslog.LOG_CRIT, tag)
+	SwitchLoggerToSyslog(syslog.LOG_USER|syslog.LOG_WARNING, tag)
 }
 
 // PrintMasterkeyReminder reminds the user that he should store the master key in
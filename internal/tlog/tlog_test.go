@@ -1,6 +1,10 @@
 package tlog
 
 import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"strings"
 	"testing"
 )
 
@@ -24,3 +28,70 @@ func TestTrimNewline(t *testing.T) {
 		}
 	}
 }
+
+// Test that the JSON output is one valid object per message
+func TestJSONOutput(t *testing.T) {
+	var buf bytes.Buffer
+	l := &toggledLogger{
+		Enabled: true,
+		Logger:  log.New(&buf, "", 0),
+		prefix:  "\033[33m",
+		level:   "warning",
+	}
+	jsonFormat = true
+	defer func() { jsonFormat = false }()
+	l.Printf("foo %q\n", "bar")
+	l.Println("multi\nline")
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("want 2 lines, have %q", buf.String())
+	}
+	var m struct {
+		Time  string
+		Level string
+		Msg   string
+	}
+	if err := json.Unmarshal([]byte(lines[0]), &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Level != "warning" || m.Msg != `foo "bar"` || m.Time == "" {
+		t.Errorf("unexpected object %+v", m)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &m); err != nil || m.Msg != "multi\nline" {
+		t.Errorf("err=%v msg=%q", err, m.Msg)
+	}
+}
+
+// Test that EnableDebug only enables the requested categories
+func TestEnableDebug(t *testing.T) {
+	all := []*toggledLogger{Debug, DebugNames, DebugContent, DebugLocks, DebugCache}
+	reset := func() {
+		for _, l := range all {
+			l.Enabled = false
+		}
+		DebugFuse = false
+	}
+	defer reset()
+	if err := EnableDebug("names,fuse"); err != nil {
+		t.Fatal(err)
+	}
+	if !DebugNames.Enabled || !DebugFuse || Debug.Enabled || DebugContent.Enabled {
+		t.Errorf("wrong loggers enabled")
+	}
+	reset()
+	if err := EnableDebug(""); err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range all {
+		if !l.Enabled {
+			t.Errorf("logger %q not enabled", l.category)
+		}
+	}
+	if DebugFuse {
+		t.Errorf("fuse should only be enabled explicitly")
+	}
+	reset()
+	if err := EnableDebug("names,xyz"); err == nil {
+		t.Errorf("unknown category accepted")
+	}
+}
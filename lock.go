@@ -0,0 +1,460 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"runtime"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/internal/configfile"
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/keylock"
+	"github.com/rfjakob/gocryptfs/internal/readpassword"
+	"github.com/rfjakob/gocryptfs/internal/secmem"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// "-lock MOUNTPOINT" and "-unlock MOUNTPOINT" set these xattrs on the root
+// directory of the mount. The kernel does not let that through to read-only
+// mounts, they need "-ctlsock".
+//
+// Reading lockXattr never locks anything. On a locked mount, it waits until
+// the kernel caches have been dropped and returns lockedValue, which tells
+// "-lock" that the gocryptfs process knows the lock xattr.
+const (
+	lockXattr   = "user.gocryptfs.lock"
+	unlockXattr = "user.gocryptfs.unlock"
+	lockedValue = "locked"
+)
+
+var errLockWrongKey = errors.New("the config file does not contain the key of the mount")
+
+// keyCheck encrypts a block of zeros with the name key of "c". Two cores
+// with the same keys give the same result.
+func keyCheck(c *cryptocore.CryptoCore) []byte {
+	return c.EMECipher.Encrypt(make([]byte, 16), make([]byte, 16))
+}
+
+// unlockKey reads the config file of the mount again and decrypts the key the
+// mount was created with, for "-unlock". That is the key of the decrypt-only
+// key slot if the mount uses it.
+func unlockKey(args *argContainer, backend cryptocore.AEADTypeEnum, password []byte) ([]byte, error) {
+	cf, err := configfile.Load(args.config)
+	if err != nil {
+		return nil, err
+	}
+	warn := tlog.Warn.Enabled
+	tlog.Warn.Enabled = false
+	key, slot, err := cf.DecryptKey(password)
+	tlog.Warn.Enabled = warn
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case slot == "" && args._decryptOnly:
+		k := cryptocore.DecryptOnlyKey(key, backend)
+		secmem.Free(key)
+		return k, nil
+	case slot == "" || slot == configfile.KeySlotDecryptOnly && args._decryptOnly:
+		return key, nil
+	}
+	// The decrypt-only key of a normal mount would make it read-only, and
+	// the duress password would reveal the mount
+	secmem.Free(key)
+	return nil, exitcodes.NewErr("Password incorrect.", exitcodes.PasswordIncorrect)
+}
+
+// lockFS implements "-lock". While the keys are wiped, everything but
+// closing files fails with EACCES. Requests in flight when "-lock" comes in
+// finish first.
+//
+// It also implements the lock and unlock xattrs on the root directory,
+// for the owner of the mount and root.
+type lockFS struct {
+	fuse.RawFileSystem
+	k *keylock.KeyLock
+	// owner is the uid gocryptfs runs as
+	owner uint32
+}
+
+func newLockFS(raw fuse.RawFileSystem, k *keylock.KeyLock, owner uint32) *lockFS {
+	return &lockFS{RawFileSystem: raw, k: k, owner: owner}
+}
+
+func (f *lockFS) GetXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr string, dest []byte) (uint32, fuse.Status) {
+	if attr == lockXattr && header.NodeId == fuse.FUSE_ROOT_ID && f.k.Locked() {
+		f.k.Wait()
+		if len(dest) == 0 {
+			return uint32(len(lockedValue)), fuse.OK
+		} else if len(dest) < len(lockedValue) {
+			return uint32(len(lockedValue)), fuse.ERANGE
+		}
+		return uint32(copy(dest, lockedValue)), fuse.OK
+	}
+	if !f.k.Enter() {
+		return 0, fuse.EACCES
+	}
+	defer f.k.Exit()
+	return f.RawFileSystem.GetXAttr(cancel, header, attr, dest)
+}
+
+func (f *lockFS) SetXAttr(cancel <-chan struct{}, input *fuse.SetXAttrIn, attr string, data []byte) fuse.Status {
+	if attr == lockXattr && input.NodeId == fuse.FUSE_ROOT_ID {
+		if input.Uid != f.owner && input.Uid != 0 {
+			return fuse.EPERM
+		}
+		tlog.Info.Printf("-lock: request from pid %d", input.Pid)
+		f.k.Lock()
+		return fuse.OK
+	}
+	if attr == unlockXattr && input.NodeId == fuse.FUSE_ROOT_ID {
+		if input.Uid != f.owner && input.Uid != 0 {
+			return fuse.EPERM
+		}
+		err := f.k.Unlock(data)
+		for i := range data {
+			data[i] = 0
+		}
+		switch {
+		case err == nil:
+			return fuse.OK
+		case err == keylock.ErrNotSupported:
+			return fuse.ENOTSUP
+		case err == errLockWrongKey:
+			tlog.Warn.Printf("-unlock: %v", err)
+			return fuse.EINVAL
+		}
+		tlog.Info.Printf("-unlock: %v", err)
+		return fuse.EACCES
+	}
+	if !f.k.Enter() {
+		return fuse.EACCES
+	}
+	defer f.k.Exit()
+	return f.RawFileSystem.SetXAttr(cancel, input, attr, data)
+}
+
+func (f *lockFS) Lookup(cancel <-chan struct{}, header *fuse.InHeader, name string, out *fuse.EntryOut) fuse.Status {
+	if !f.k.Enter() {
+		return fuse.EACCES
+	}
+	defer f.k.Exit()
+	return f.RawFileSystem.Lookup(cancel, header, name, out)
+}
+
+func (f *lockFS) GetAttr(cancel <-chan struct{}, input *fuse.GetAttrIn, out *fuse.AttrOut) fuse.Status {
+	// The root directory needs no key, and tools like "mountpoint" and
+	// fusermount look at it
+	if input.NodeId == fuse.FUSE_ROOT_ID {
+		return f.RawFileSystem.GetAttr(cancel, input, out)
+	}
+	if !f.k.Enter() {
+		return fuse.EACCES
+	}
+	defer f.k.Exit()
+	return f.RawFileSystem.GetAttr(cancel, input, out)
+}
+
+func (f *lockFS) SetAttr(cancel <-chan struct{}, input *fuse.SetAttrIn, out *fuse.AttrOut) fuse.Status {
+	if !f.k.Enter() {
+		return fuse.EACCES
+	}
+	defer f.k.Exit()
+	return f.RawFileSystem.SetAttr(cancel, input, out)
+}
+
+func (f *lockFS) Mknod(cancel <-chan struct{}, input *fuse.MknodIn, name string, out *fuse.EntryOut) fuse.Status {
+	if !f.k.Enter() {
+		return fuse.EACCES
+	}
+	defer f.k.Exit()
+	return f.RawFileSystem.Mknod(cancel, input, name, out)
+}
+
+func (f *lockFS) Mkdir(cancel <-chan struct{}, input *fuse.MkdirIn, name string, out *fuse.EntryOut) fuse.Status {
+	if !f.k.Enter() {
+		return fuse.EACCES
+	}
+	defer f.k.Exit()
+	return f.RawFileSystem.Mkdir(cancel, input, name, out)
+}
+
+func (f *lockFS) Unlink(cancel <-chan struct{}, header *fuse.InHeader, name string) fuse.Status {
+	if !f.k.Enter() {
+		return fuse.EACCES
+	}
+	defer f.k.Exit()
+	return f.RawFileSystem.Unlink(cancel, header, name)
+}
+
+func (f *lockFS) Rmdir(cancel <-chan struct{}, header *fuse.InHeader, name string) fuse.Status {
+	if !f.k.Enter() {
+		return fuse.EACCES
+	}
+	defer f.k.Exit()
+	return f.RawFileSystem.Rmdir(cancel, header, name)
+}
+
+func (f *lockFS) Rename(cancel <-chan struct{}, input *fuse.RenameIn, oldName string, newName string) fuse.Status {
+	if !f.k.Enter() {
+		return fuse.EACCES
+	}
+	defer f.k.Exit()
+	return f.RawFileSystem.Rename(cancel, input, oldName, newName)
+}
+
+func (f *lockFS) Link(cancel <-chan struct{}, input *fuse.LinkIn, filename string, out *fuse.EntryOut) fuse.Status {
+	if !f.k.Enter() {
+		return fuse.EACCES
+	}
+	defer f.k.Exit()
+	return f.RawFileSystem.Link(cancel, input, filename, out)
+}
+
+func (f *lockFS) Symlink(cancel <-chan struct{}, header *fuse.InHeader, pointedTo string, linkName string, out *fuse.EntryOut) fuse.Status {
+	if !f.k.Enter() {
+		return fuse.EACCES
+	}
+	defer f.k.Exit()
+	return f.RawFileSystem.Symlink(cancel, header, pointedTo, linkName, out)
+}
+
+func (f *lockFS) Readlink(cancel <-chan struct{}, header *fuse.InHeader) ([]byte, fuse.Status) {
+	if !f.k.Enter() {
+		return nil, fuse.EACCES
+	}
+	defer f.k.Exit()
+	return f.RawFileSystem.Readlink(cancel, header)
+}
+
+func (f *lockFS) Access(cancel <-chan struct{}, input *fuse.AccessIn) fuse.Status {
+	if !f.k.Enter() {
+		return fuse.EACCES
+	}
+	defer f.k.Exit()
+	return f.RawFileSystem.Access(cancel, input)
+}
+
+func (f *lockFS) ListXAttr(cancel <-chan struct{}, header *fuse.InHeader, dest []byte) (uint32, fuse.Status) {
+	if !f.k.Enter() {
+		return 0, fuse.EACCES
+	}
+	defer f.k.Exit()
+	return f.RawFileSystem.ListXAttr(cancel, header, dest)
+}
+
+func (f *lockFS) RemoveXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr string) fuse.Status {
+	if !f.k.Enter() {
+		return fuse.EACCES
+	}
+	defer f.k.Exit()
+	return f.RawFileSystem.RemoveXAttr(cancel, header, attr)
+}
+
+func (f *lockFS) Create(cancel <-chan struct{}, input *fuse.CreateIn, name string, out *fuse.CreateOut) fuse.Status {
+	if !f.k.Enter() {
+		return fuse.EACCES
+	}
+	defer f.k.Exit()
+	return f.RawFileSystem.Create(cancel, input, name, out)
+}
+
+func (f *lockFS) Open(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
+	if !f.k.Enter() {
+		return fuse.EACCES
+	}
+	defer f.k.Exit()
+	return f.RawFileSystem.Open(cancel, input, out)
+}
+
+func (f *lockFS) Read(cancel <-chan struct{}, input *fuse.ReadIn, buf []byte) (fuse.ReadResult, fuse.Status) {
+	if !f.k.Enter() {
+		return nil, fuse.EACCES
+	}
+	defer f.k.Exit()
+	return f.RawFileSystem.Read(cancel, input, buf)
+}
+
+func (f *lockFS) Lseek(cancel <-chan struct{}, input *fuse.LseekIn, out *fuse.LseekOut) fuse.Status {
+	if !f.k.Enter() {
+		return fuse.EACCES
+	}
+	defer f.k.Exit()
+	return f.RawFileSystem.Lseek(cancel, input, out)
+}
+
+func (f *lockFS) GetLk(cancel <-chan struct{}, input *fuse.LkIn, out *fuse.LkOut) fuse.Status {
+	if !f.k.Enter() {
+		return fuse.EACCES
+	}
+	defer f.k.Exit()
+	return f.RawFileSystem.GetLk(cancel, input, out)
+}
+
+func (f *lockFS) SetLk(cancel <-chan struct{}, input *fuse.LkIn) fuse.Status {
+	if !f.k.Enter() {
+		return fuse.EACCES
+	}
+	defer f.k.Exit()
+	return f.RawFileSystem.SetLk(cancel, input)
+}
+
+func (f *lockFS) SetLkw(cancel <-chan struct{}, input *fuse.LkIn) fuse.Status {
+	// Waiting for a lock can take forever and does not need the keys, so
+	// we do not hold up "-lock" here
+	if f.k.Locked() {
+		return fuse.EACCES
+	}
+	return f.RawFileSystem.SetLkw(cancel, input)
+}
+
+func (f *lockFS) Write(cancel <-chan struct{}, input *fuse.WriteIn, data []byte) (uint32, fuse.Status) {
+	if !f.k.Enter() {
+		return 0, fuse.EACCES
+	}
+	defer f.k.Exit()
+	return f.RawFileSystem.Write(cancel, input, data)
+}
+
+func (f *lockFS) CopyFileRange(cancel <-chan struct{}, input *fuse.CopyFileRangeIn) (uint32, fuse.Status) {
+	if !f.k.Enter() {
+		return 0, fuse.EACCES
+	}
+	defer f.k.Exit()
+	return f.RawFileSystem.CopyFileRange(cancel, input)
+}
+
+func (f *lockFS) Fsync(cancel <-chan struct{}, input *fuse.FsyncIn) fuse.Status {
+	if !f.k.Enter() {
+		return fuse.EACCES
+	}
+	defer f.k.Exit()
+	return f.RawFileSystem.Fsync(cancel, input)
+}
+
+func (f *lockFS) Fallocate(cancel <-chan struct{}, input *fuse.FallocateIn) fuse.Status {
+	if !f.k.Enter() {
+		return fuse.EACCES
+	}
+	defer f.k.Exit()
+	return f.RawFileSystem.Fallocate(cancel, input)
+}
+
+func (f *lockFS) OpenDir(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
+	if !f.k.Enter() {
+		return fuse.EACCES
+	}
+	defer f.k.Exit()
+	return f.RawFileSystem.OpenDir(cancel, input, out)
+}
+
+func (f *lockFS) ReadDir(cancel <-chan struct{}, input *fuse.ReadIn, out *fuse.DirEntryList) fuse.Status {
+	if !f.k.Enter() {
+		return fuse.EACCES
+	}
+	defer f.k.Exit()
+	return f.RawFileSystem.ReadDir(cancel, input, out)
+}
+
+func (f *lockFS) ReadDirPlus(cancel <-chan struct{}, input *fuse.ReadIn, out *fuse.DirEntryList) fuse.Status {
+	if !f.k.Enter() {
+		return fuse.EACCES
+	}
+	defer f.k.Exit()
+	return f.RawFileSystem.ReadDirPlus(cancel, input, out)
+}
+
+func (f *lockFS) FsyncDir(cancel <-chan struct{}, input *fuse.FsyncIn) fuse.Status {
+	if !f.k.Enter() {
+		return fuse.EACCES
+	}
+	defer f.k.Exit()
+	return f.RawFileSystem.FsyncDir(cancel, input)
+}
+
+// lockMountpoint returns the mountpoint for "-lock" and "-unlock", which
+// accept the cipherdir as well
+func lockMountpoint(op string, path string) (string, int) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		tlog.Fatal.Printf("%s: %v", op, err)
+		return "", exitcodes.Lock
+	}
+	if runtime.GOOS != "linux" {
+		// No mountinfo
+		return abs, 0
+	}
+	m, err := findMount(abs)
+	if err != nil {
+		tlog.Fatal.Printf("%s: %v", op, err)
+		return "", exitcodes.Lock
+	}
+	return m.mountpoint, 0
+}
+
+// doLock wipes the keys of the gocryptfs mount at "path", which can be the
+// mountpoint or the cipherdir. Returns when they are gone. Called for
+// "-lock".
+func doLock(path string) (exitcode int) {
+	mnt, code := lockMountpoint("-lock", path)
+	if code != 0 {
+		return code
+	}
+	err := unix.Setxattr(mnt, lockXattr, nil, 0)
+	if err == nil {
+		// Waits until the kernel caches have been dropped
+		buf := make([]byte, len(lockedValue))
+		var sz int
+		sz, err = unix.Getxattr(mnt, lockXattr, buf)
+		if err != nil || string(buf[:sz]) != lockedValue {
+			// An older gocryptfs has stored the xattr instead
+			unix.Removexattr(mnt, lockXattr)
+			err = errors.New("the gocryptfs process is too old for -lock")
+		}
+	}
+	switch err {
+	case nil:
+		tlog.Info.Printf("Locked %q", mnt)
+		return 0
+	case syscall.ENOTSUP:
+		err = errors.New("the gocryptfs process is too old for -lock")
+	case syscall.EROFS:
+		err = errors.New("the kernel does not let us lock read-only mounts, use the Lock request of -ctlsock")
+	}
+	tlog.Fatal.Printf("-lock: %q: %v", mnt, err)
+	return exitcodes.Lock
+}
+
+// doUnlock asks for the password and gives the gocryptfs mount at "path"
+// its keys back. Called for "-unlock".
+func doUnlock(args *argContainer, path string) (exitcode int) {
+	mnt, code := lockMountpoint("-unlock", path)
+	if code != 0 {
+		return code
+	}
+	pw := readpassword.Once([]string(args.extpass), []string(args.passfile), "")
+	err := unix.Setxattr(mnt, unlockXattr, pw, 0)
+	for i := range pw {
+		pw[i] = 0
+	}
+	switch err {
+	case nil:
+		tlog.Info.Printf("Unlocked %q", mnt)
+		return 0
+	case syscall.EACCES:
+		tlog.Fatal.Println("Password incorrect.")
+		return exitcodes.PasswordIncorrect
+	case syscall.ENOTSUP:
+		err = keylock.ErrNotSupported
+	case syscall.EINVAL:
+		err = errLockWrongKey
+	case syscall.EROFS:
+		err = errors.New("the kernel does not let us unlock read-only mounts, use the Unlock request of -ctlsock")
+	}
+	tlog.Fatal.Printf("-unlock: %q: %v", mnt, err)
+	return exitcodes.Lock
+}
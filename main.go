@@ -11,6 +11,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"syscall"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
 
@@ -19,6 +20,7 @@ import (
 	"github.com/rfjakob/gocryptfs/internal/exitcodes"
 	"github.com/rfjakob/gocryptfs/internal/fido2"
 	"github.com/rfjakob/gocryptfs/internal/readpassword"
+	"github.com/rfjakob/gocryptfs/internal/secmem"
 	"github.com/rfjakob/gocryptfs/internal/speed"
 	"github.com/rfjakob/gocryptfs/internal/stupidgcm"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
@@ -49,6 +51,15 @@ func loadConfig(args *argContainer) (masterkey []byte, cf *configfile.ConfFile,
 	// he forgot the password).
 	masterkey = handleArgsMasterkey(args)
 	if masterkey != nil {
+		if args.masterkey != "" {
+			// We did not decrypt the master key, so the config file MAC has not
+			// been checked yet.
+			err = cf.VerifyMAC(masterkey)
+			if err != nil {
+				tlog.Fatal.Println(err)
+				return nil, nil, err
+			}
+		}
 		return masterkey, cf, nil
 	}
 	var pw []byte
@@ -59,10 +70,10 @@ func loadConfig(args *argContainer) (masterkey []byte, cf *configfile.ConfFile,
 		}
 		pw = fido2.Secret(args.fido2, cf.FIDO2.CredentialID, cf.FIDO2.HMACSalt)
 	} else {
-		pw = readpassword.Once([]string(args.extpass), []string(args.passfile), "")
+		pw = readpassword.Once([]string(args.extpass), []string(args.passfile), args._passwordPrompt)
 	}
 	tlog.Info.Println("Decrypting master key")
-	masterkey, err = cf.DecryptMasterKey(pw)
+	masterkey, slot, err := cf.DecryptKey(pw)
 	for i := range pw {
 		pw[i] = 0
 	}
@@ -71,20 +82,44 @@ func loadConfig(args *argContainer) (masterkey []byte, cf *configfile.ConfFile,
 		tlog.Fatal.Println(err)
 		return nil, nil, err
 	}
+	switch slot {
+	case configfile.KeySlotDecryptOnly:
+		tlog.Info.Println("Unlocked the decrypt-only key slot")
+		args._decryptOnly = true
+	case configfile.KeySlotDuress:
+		return unlockDuress(args, cf, masterkey)
+	}
 	return masterkey, cf, nil
 }
 
+// loadMasterkey is loadConfig for the operations that need the master key,
+// not the key of the decrypt-only or the duress key slot. Calls os.Exit on
+// errors.
+func loadMasterkey(args *argContainer) (masterkey []byte, cf *configfile.ConfFile) {
+	masterkey, cf, err := loadConfig(args)
+	if err != nil {
+		exitcodes.Exit(err)
+	}
+	if args._decryptOnly || args._duress {
+		secmem.Free(masterkey)
+		if args._duress {
+			// Looks like a wrong password
+			tlog.Fatal.Println("Password incorrect.")
+		} else {
+			tlog.Fatal.Printf("This needs the password of the filesystem, not the one of the decrypt-only key slot")
+		}
+		os.Exit(exitcodes.PasswordIncorrect)
+	}
+	return masterkey, cf
+}
+
 // changePassword - change the password of config file "filename"
 // Does not return (calls os.Exit both on success and on error).
 func changePassword(args *argContainer) {
 	var confFile *configfile.ConfFile
 	{
 		var masterkey []byte
-		var err error
-		masterkey, confFile, err = loadConfig(args)
-		if err != nil {
-			exitcodes.Exit(err)
-		}
+		masterkey, confFile = loadMasterkey(args)
 		if len(masterkey) == 0 {
 			log.Panic("empty masterkey")
 		}
@@ -102,9 +137,7 @@ func changePassword(args *argContainer) {
 		for i := range newPw {
 			newPw[i] = 0
 		}
-		for i := range masterkey {
-			masterkey[i] = 0
-		}
+		secmem.Free(masterkey)
 		// masterkey and newPw run out of scope here
 	}
 	// Are we resetting the password without knowing the old one using
@@ -161,20 +194,31 @@ func main() {
 	if os.Getenv("PATH") == "" {
 		os.Setenv("PATH", "/usr/sbin:/usr/bin:/sbin:/bin")
 	}
+	disableCoreDumps()
 	// Show microseconds in go-fuse debug output (-fusedebug)
 	log.SetFlags(log.Lmicroseconds)
 	var err error
 	// Parse all command-line options (i.e. arguments starting with "-")
 	// into "args". Path arguments are parsed below.
 	args := parseCliOpts()
+	if args.notifyfd > 0 {
+		// Do not leak the fd into "-extpass" or "logger"
+		syscall.CloseOnExec(args.notifyfd)
+	}
+	if args.log_format == "json" {
+		tlog.SwitchToJSON()
+	}
 	// Fork a child into the background if "-fg" is not set AND we are mounting
-	// a filesystem. The child will do all the work.
-	if !args.fg && flagSet.NArg() == 2 {
+	// one or more filesystems. The child will do all the work.
+	if !args.fg && countOpFlags(&args) == 0 && flagSet.NArg() >= 2 && flagSet.NArg()%2 == 0 {
 		ret := forkChild()
 		os.Exit(ret)
 	}
-	if args.debug {
-		tlog.Debug.Enabled = true
+	if args.debug.enabled {
+		if err = tlog.EnableDebug(args.debug.categories); err != nil {
+			tlog.Fatal.Printf("Invalid command line: -debug: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
 	}
 	// "-v"
 	if args.version {
@@ -198,6 +242,27 @@ func main() {
 		tlog.Warn.Wpanic = true
 		tlog.Debug.Printf("Panicking on warnings")
 	}
+	// "-cgroup", "-nice"
+	limitResources(&args)
+	// "-wipe"
+	if args.wipe != "" {
+		code := wipe(args.wipe)
+		os.Exit(code)
+	}
+	// "-unmount"
+	if args.unmount != "" {
+		code := doUnmount(args.unmount, args.lazy, args.force)
+		os.Exit(code)
+	}
+	// "-lock", "-unlock"
+	if args.lock != "" {
+		code := doLock(args.lock)
+		os.Exit(code)
+	}
+	if args.unlock != "" {
+		code := doUnlock(&args, args.unlock)
+		os.Exit(code)
+	}
 	// Every operation below requires CIPHERDIR. Exit if we don't have it.
 	if flagSet.NArg() == 0 {
 		if flagSet.NFlag() == 0 {
@@ -230,6 +295,70 @@ func main() {
 			os.Exit(exitcodes.ExcludeError)
 		}
 	}
+	if args.reverse && args.deterministic_names {
+		tlog.Fatal.Printf("-deterministic-names only works in forward mode")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.reverse && args.case_insensitive {
+		tlog.Fatal.Printf("-case-insensitive only works in forward mode")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.reverse && args.xattr_sidecar {
+		tlog.Fatal.Printf("-xattr-sidecar only works in forward mode")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.reverse && args.merkle {
+		tlog.Fatal.Printf("-merkle only works in forward mode")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.reverse && args.audit != "" {
+		tlog.Fatal.Printf("-audit only works in forward mode")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.reverse && args.scrub > 0 {
+		tlog.Fatal.Printf("-scrub only works in forward mode")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.reverse && args.subdir != "" {
+		tlog.Fatal.Printf("-subdir only works in forward mode")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.reverse && args.quota > 0 {
+		tlog.Fatal.Printf("-quota only works in forward mode")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.reverse && args.trash_retention > 0 {
+		tlog.Fatal.Printf("-trash-retention only works in forward mode")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.reverse && args.mount_snapshot != "" {
+		tlog.Fatal.Printf("-mount-snapshot only works in forward mode")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.reverse && args.sparse {
+		tlog.Fatal.Printf("-sparse only works in forward mode")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.reverse && args.acl {
+		tlog.Fatal.Printf("-acl only works in forward mode")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.reverse && args.passthrough != nil {
+		tlog.Fatal.Printf("-passthrough only works in forward mode")
+		os.Exit(exitcodes.Usage)
+	}
+	// "-mount-snapshot": the snapshot is a complete CIPHERDIR by itself
+	if args.mount_snapshot != "" {
+		args.cipherdir, err = snapshotPath(args.cipherdir, args.mount_snapshot)
+		if err == nil {
+			err = isDir(args.cipherdir)
+		}
+		if err != nil {
+			tlog.Fatal.Printf("-mount-snapshot: %v", err)
+			os.Exit(exitcodes.CipherDir)
+		}
+		args.ro = true
+	}
 	// "-config"
 	if args.config != "" {
 		args.config, err = filepath.Abs(args.config)
@@ -292,11 +421,11 @@ func main() {
 	nOps := countOpFlags(&args)
 	if nOps == 0 {
 		// Default operation: mount.
-		if flagSet.NArg() != 2 {
+		if flagSet.NArg() < 2 || flagSet.NArg()%2 != 0 {
 			prettyArgs := prettyArgs()
-			tlog.Info.Printf("Wrong number of arguments (have %d, want 2). You passed: %s",
+			tlog.Info.Printf("Wrong number of arguments (have %d, want CIPHERDIR MOUNTPOINT pairs). You passed: %s",
 				flagSet.NArg(), prettyArgs)
-			tlog.Fatal.Printf("Usage: %s [OPTIONS] CIPHERDIR MOUNTPOINT [-o COMMA-SEPARATED-OPTIONS]", tlog.ProgramName)
+			tlog.Fatal.Printf("Usage: %s [OPTIONS] CIPHERDIR MOUNTPOINT [CIPHERDIR2 MOUNTPOINT2 ...] [-o COMMA-SEPARATED-OPTIONS]", tlog.ProgramName)
 			os.Exit(exitcodes.Usage)
 		}
 		doMount(&args)
@@ -304,17 +433,25 @@ func main() {
 		return
 	}
 	if nOps > 1 {
-		tlog.Fatal.Printf("At most one of -info, -init, -passwd, -fsck is allowed")
+		tlog.Fatal.Printf("At most one of -info, -init, -passwd, -fsck, -destroy, -migrate-encfs, -migrate-ecryptfs, -export, -import, -trash, -snapshot, -dirkey, -decrypt-only, -duress is allowed")
 		os.Exit(exitcodes.Usage)
 	}
-	if flagSet.NArg() != 1 {
-		tlog.Fatal.Printf("The options -info, -init, -passwd, -fsck take exactly one argument, %d given",
+	// "-trash restore" and "-trash purge" take trash IDs after CIPHERDIR,
+	// "-snapshot create" and "-snapshot delete" the name of the snapshot,
+	// "-dirkey add" and "-dirkey remove" the directory, "-duress add" the
+	// decoy
+	moreArgs := (args.trash != "" && args.trash != "list") ||
+		(args.snapshot != "" && args.snapshot != "list") ||
+		(args.dirkey != "" && args.dirkey != "list") ||
+		args.duress == "add"
+	if flagSet.NArg() != 1 && !moreArgs {
+		tlog.Fatal.Printf("The options -info, -init, -passwd, -fsck, -destroy, -migrate-encfs, -migrate-ecryptfs, -export, -import, -trash list, -snapshot list, -dirkey list, -decrypt-only, -duress remove take exactly one argument, %d given",
 			flagSet.NArg())
 		os.Exit(exitcodes.Usage)
 	}
 	// "-info"
 	if args.info {
-		info(args.config)
+		info(&args)
 		os.Exit(0)
 	}
 	// "-init"
@@ -332,4 +469,54 @@ func main() {
 		code := fsck(&args)
 		os.Exit(code)
 	}
+	// "-destroy"
+	if args.destroy {
+		code := destroy(&args)
+		os.Exit(code)
+	}
+	// "-migrate-encfs"
+	if args.migrate_encfs != "" {
+		code := migrate(&args, args.migrate_encfs, "encfs")
+		os.Exit(code)
+	}
+	// "-migrate-ecryptfs"
+	if args.migrate_ecryptfs != "" {
+		code := migrate(&args, args.migrate_ecryptfs, "ecryptfs")
+		os.Exit(code)
+	}
+	// "-export"
+	if args.export_archive != "" {
+		code := exportCipherdir(&args, args.export_archive)
+		os.Exit(code)
+	}
+	// "-import"
+	if args.import_archive != "" {
+		code := importCipherdir(&args, args.import_archive)
+		os.Exit(code)
+	}
+	// "-trash"
+	if args.trash != "" {
+		code := trash(&args, flagSet.Args()[1:])
+		os.Exit(code)
+	}
+	// "-snapshot"
+	if args.snapshot != "" {
+		code := snapshot(&args, flagSet.Args()[1:])
+		os.Exit(code)
+	}
+	// "-decrypt-only"
+	if args.decrypt_only != "" {
+		code := decryptOnly(&args)
+		os.Exit(code)
+	}
+	// "-duress"
+	if args.duress != "" {
+		code := duress(&args, flagSet.Args()[1:])
+		os.Exit(code)
+	}
+	// "-dirkey"
+	if args.dirkey != "" {
+		code := dirkey(&args, flagSet.Args()[1:])
+		os.Exit(code)
+	}
 }
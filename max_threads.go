@@ -0,0 +1,267 @@
+package main
+
+import (
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// threadsFS implements "-max_threads": at most cap(sem) requests are worked
+// on at the same time. The others wait, and fail with EINTR if the kernel
+// interrupts them while waiting. All filesystems of the process share "sem".
+//
+// Requests that can wait for other requests, like SetLkw, and the ones that
+// only release resources are not limited, so the limit cannot deadlock the
+// mount.
+type threadsFS struct {
+	fuse.RawFileSystem
+	sem chan struct{}
+}
+
+func newThreadsFS(raw fuse.RawFileSystem, sem chan struct{}) *threadsFS {
+	return &threadsFS{RawFileSystem: raw, sem: sem}
+}
+
+// enter takes a slot. Returns false if "cancel" fires first.
+func (f *threadsFS) enter(cancel <-chan struct{}) bool {
+	select {
+	case f.sem <- struct{}{}:
+		return true
+	case <-cancel:
+		return false
+	}
+}
+
+func (f *threadsFS) exit() {
+	<-f.sem
+}
+
+func (f *threadsFS) Lookup(cancel <-chan struct{}, header *fuse.InHeader, name string, out *fuse.EntryOut) fuse.Status {
+	if !f.enter(cancel) {
+		return fuse.EINTR
+	}
+	defer f.exit()
+	return f.RawFileSystem.Lookup(cancel, header, name, out)
+}
+
+func (f *threadsFS) GetAttr(cancel <-chan struct{}, input *fuse.GetAttrIn, out *fuse.AttrOut) fuse.Status {
+	if !f.enter(cancel) {
+		return fuse.EINTR
+	}
+	defer f.exit()
+	return f.RawFileSystem.GetAttr(cancel, input, out)
+}
+
+func (f *threadsFS) SetAttr(cancel <-chan struct{}, input *fuse.SetAttrIn, out *fuse.AttrOut) fuse.Status {
+	if !f.enter(cancel) {
+		return fuse.EINTR
+	}
+	defer f.exit()
+	return f.RawFileSystem.SetAttr(cancel, input, out)
+}
+
+func (f *threadsFS) Mknod(cancel <-chan struct{}, input *fuse.MknodIn, name string, out *fuse.EntryOut) fuse.Status {
+	if !f.enter(cancel) {
+		return fuse.EINTR
+	}
+	defer f.exit()
+	return f.RawFileSystem.Mknod(cancel, input, name, out)
+}
+
+func (f *threadsFS) Mkdir(cancel <-chan struct{}, input *fuse.MkdirIn, name string, out *fuse.EntryOut) fuse.Status {
+	if !f.enter(cancel) {
+		return fuse.EINTR
+	}
+	defer f.exit()
+	return f.RawFileSystem.Mkdir(cancel, input, name, out)
+}
+
+func (f *threadsFS) Unlink(cancel <-chan struct{}, header *fuse.InHeader, name string) fuse.Status {
+	if !f.enter(cancel) {
+		return fuse.EINTR
+	}
+	defer f.exit()
+	return f.RawFileSystem.Unlink(cancel, header, name)
+}
+
+func (f *threadsFS) Rmdir(cancel <-chan struct{}, header *fuse.InHeader, name string) fuse.Status {
+	if !f.enter(cancel) {
+		return fuse.EINTR
+	}
+	defer f.exit()
+	return f.RawFileSystem.Rmdir(cancel, header, name)
+}
+
+func (f *threadsFS) Rename(cancel <-chan struct{}, input *fuse.RenameIn, oldName string, newName string) fuse.Status {
+	if !f.enter(cancel) {
+		return fuse.EINTR
+	}
+	defer f.exit()
+	return f.RawFileSystem.Rename(cancel, input, oldName, newName)
+}
+
+func (f *threadsFS) Link(cancel <-chan struct{}, input *fuse.LinkIn, filename string, out *fuse.EntryOut) fuse.Status {
+	if !f.enter(cancel) {
+		return fuse.EINTR
+	}
+	defer f.exit()
+	return f.RawFileSystem.Link(cancel, input, filename, out)
+}
+
+func (f *threadsFS) Symlink(cancel <-chan struct{}, header *fuse.InHeader, pointedTo string, linkName string, out *fuse.EntryOut) fuse.Status {
+	if !f.enter(cancel) {
+		return fuse.EINTR
+	}
+	defer f.exit()
+	return f.RawFileSystem.Symlink(cancel, header, pointedTo, linkName, out)
+}
+
+func (f *threadsFS) Readlink(cancel <-chan struct{}, header *fuse.InHeader) ([]byte, fuse.Status) {
+	if !f.enter(cancel) {
+		return nil, fuse.EINTR
+	}
+	defer f.exit()
+	return f.RawFileSystem.Readlink(cancel, header)
+}
+
+func (f *threadsFS) Access(cancel <-chan struct{}, input *fuse.AccessIn) fuse.Status {
+	if !f.enter(cancel) {
+		return fuse.EINTR
+	}
+	defer f.exit()
+	return f.RawFileSystem.Access(cancel, input)
+}
+
+func (f *threadsFS) GetXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr string, dest []byte) (uint32, fuse.Status) {
+	if !f.enter(cancel) {
+		return 0, fuse.EINTR
+	}
+	defer f.exit()
+	return f.RawFileSystem.GetXAttr(cancel, header, attr, dest)
+}
+
+func (f *threadsFS) ListXAttr(cancel <-chan struct{}, header *fuse.InHeader, dest []byte) (uint32, fuse.Status) {
+	if !f.enter(cancel) {
+		return 0, fuse.EINTR
+	}
+	defer f.exit()
+	return f.RawFileSystem.ListXAttr(cancel, header, dest)
+}
+
+func (f *threadsFS) SetXAttr(cancel <-chan struct{}, input *fuse.SetXAttrIn, attr string, data []byte) fuse.Status {
+	if !f.enter(cancel) {
+		return fuse.EINTR
+	}
+	defer f.exit()
+	return f.RawFileSystem.SetXAttr(cancel, input, attr, data)
+}
+
+func (f *threadsFS) RemoveXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr string) fuse.Status {
+	if !f.enter(cancel) {
+		return fuse.EINTR
+	}
+	defer f.exit()
+	return f.RawFileSystem.RemoveXAttr(cancel, header, attr)
+}
+
+func (f *threadsFS) Create(cancel <-chan struct{}, input *fuse.CreateIn, name string, out *fuse.CreateOut) fuse.Status {
+	if !f.enter(cancel) {
+		return fuse.EINTR
+	}
+	defer f.exit()
+	return f.RawFileSystem.Create(cancel, input, name, out)
+}
+
+func (f *threadsFS) Open(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
+	if !f.enter(cancel) {
+		return fuse.EINTR
+	}
+	defer f.exit()
+	return f.RawFileSystem.Open(cancel, input, out)
+}
+
+func (f *threadsFS) Read(cancel <-chan struct{}, input *fuse.ReadIn, buf []byte) (fuse.ReadResult, fuse.Status) {
+	if !f.enter(cancel) {
+		return nil, fuse.EINTR
+	}
+	defer f.exit()
+	return f.RawFileSystem.Read(cancel, input, buf)
+}
+
+func (f *threadsFS) Lseek(cancel <-chan struct{}, input *fuse.LseekIn, out *fuse.LseekOut) fuse.Status {
+	if !f.enter(cancel) {
+		return fuse.EINTR
+	}
+	defer f.exit()
+	return f.RawFileSystem.Lseek(cancel, input, out)
+}
+
+func (f *threadsFS) Write(cancel <-chan struct{}, input *fuse.WriteIn, data []byte) (uint32, fuse.Status) {
+	if !f.enter(cancel) {
+		return 0, fuse.EINTR
+	}
+	defer f.exit()
+	return f.RawFileSystem.Write(cancel, input, data)
+}
+
+func (f *threadsFS) CopyFileRange(cancel <-chan struct{}, input *fuse.CopyFileRangeIn) (uint32, fuse.Status) {
+	if !f.enter(cancel) {
+		return 0, fuse.EINTR
+	}
+	defer f.exit()
+	return f.RawFileSystem.CopyFileRange(cancel, input)
+}
+
+func (f *threadsFS) Fsync(cancel <-chan struct{}, input *fuse.FsyncIn) fuse.Status {
+	if !f.enter(cancel) {
+		return fuse.EINTR
+	}
+	defer f.exit()
+	return f.RawFileSystem.Fsync(cancel, input)
+}
+
+func (f *threadsFS) Fallocate(cancel <-chan struct{}, input *fuse.FallocateIn) fuse.Status {
+	if !f.enter(cancel) {
+		return fuse.EINTR
+	}
+	defer f.exit()
+	return f.RawFileSystem.Fallocate(cancel, input)
+}
+
+func (f *threadsFS) OpenDir(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
+	if !f.enter(cancel) {
+		return fuse.EINTR
+	}
+	defer f.exit()
+	return f.RawFileSystem.OpenDir(cancel, input, out)
+}
+
+func (f *threadsFS) ReadDir(cancel <-chan struct{}, input *fuse.ReadIn, out *fuse.DirEntryList) fuse.Status {
+	if !f.enter(cancel) {
+		return fuse.EINTR
+	}
+	defer f.exit()
+	return f.RawFileSystem.ReadDir(cancel, input, out)
+}
+
+func (f *threadsFS) ReadDirPlus(cancel <-chan struct{}, input *fuse.ReadIn, out *fuse.DirEntryList) fuse.Status {
+	if !f.enter(cancel) {
+		return fuse.EINTR
+	}
+	defer f.exit()
+	return f.RawFileSystem.ReadDirPlus(cancel, input, out)
+}
+
+func (f *threadsFS) FsyncDir(cancel <-chan struct{}, input *fuse.FsyncIn) fuse.Status {
+	if !f.enter(cancel) {
+		return fuse.EINTR
+	}
+	defer f.exit()
+	return f.RawFileSystem.FsyncDir(cancel, input)
+}
+
+func (f *threadsFS) StatFs(cancel <-chan struct{}, header *fuse.InHeader, out *fuse.StatfsOut) fuse.Status {
+	if !f.enter(cancel) {
+		return fuse.EINTR
+	}
+	defer f.exit()
+	return f.RawFileSystem.StatFs(cancel, header, out)
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// migrateObj moves the files of a mounted filesystem of another encryption
+// tool into CIPHERDIR. Every file is deleted from the source as soon as it
+// has been copied and synced, so the migration needs little extra disk
+// space, and it can be interrupted and restarted at any time.
+type migrateObj struct {
+	// src is the plaintext view of the old filesystem
+	src string
+	// mnt is the mountpoint of the temporary gocryptfs mount
+	mnt string
+	// Hard-linked files that have been copied already, by inode number in
+	// the source. As the source files are deleted, their link count drops,
+	// so we keep track of how many links we have not seen yet.
+	links map[uint64]*migrateLink
+	// Statistics for the progress report and the summary
+	files    int
+	dirs     int
+	bytes    int64
+	problems int
+	// What is there to migrate, for the progress report
+	totalFiles int
+	totalBytes int64
+	// When we have last reported progress
+	lastReport time.Time
+	// abort the migration? Set on SIGINT and SIGTERM.
+	abort bool
+}
+
+// migrateLink is a hard-linked file that has been copied already
+type migrateLink struct {
+	// Path of the copy, relative to the root
+	path string
+	// Number of links that we have not seen yet
+	left uint64
+}
+
+// migrateBufSize is the buffer size for copying file contents
+const migrateBufSize = 1024 * 1024
+
+// migrateReportInterval is how often we report progress
+const migrateReportInterval = 5 * time.Second
+
+// mountFsType returns the filesystem type of the mount at "path", like
+// "fuse.encfs", or "" if "path" is not a mountpoint or we cannot tell.
+func mountFsType(path string) string {
+	mounts, err := readMountinfo()
+	if err != nil {
+		return ""
+	}
+	fsType := ""
+	// Later mounts hide earlier ones
+	for _, m := range mounts {
+		if m.mountpoint == path {
+			fsType = m.fsType
+		}
+	}
+	return fsType
+}
+
+// checkMigrateSource makes sure that "src" looks like the plaintext view of
+// the old filesystem, and explains what to do if it does not.
+func checkMigrateSource(src string, kind string) error {
+	if err := isDir(src); err != nil {
+		return err
+	}
+	switch kind {
+	case "encfs":
+		// Users may pass the encrypted directory by mistake. We would happily
+		// copy the ciphertext.
+		if _, err := os.Stat(filepath.Join(src, ".encfs6.xml")); err == nil {
+			return fmt.Errorf("%q is an encrypted EncFS directory. Mount it with "+
+				"\"encfs %s MOUNTPOINT\" and pass MOUNTPOINT instead", src, src)
+		}
+		if runtime.GOOS == "linux" && mountFsType(src) != "fuse.encfs" {
+			tlog.Warn.Printf("Warning: %q is not a mounted EncFS filesystem. "+
+				"Its contents will be moved into CIPHERDIR anyway.", src)
+		}
+	case "ecryptfs":
+		// The lower directory, usually ~/.Private, has names like
+		// "ECRYPTFS_FNEK_ENCRYPTED.FWa..." with filename encryption
+		entries, err := ioutil.ReadDir(src)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if strings.HasPrefix(e.Name(), "ECRYPTFS_FNEK_ENCRYPTED.") {
+				return fmt.Errorf("%q is an encrypted eCryptfs directory. Mount it "+
+					"with ecryptfs-mount-private or \"mount -t ecryptfs\" and pass "+
+					"the mountpoint instead", src)
+			}
+		}
+		if runtime.GOOS == "linux" && mountFsType(src) != "ecryptfs" {
+			tlog.Warn.Printf("Warning: %q is not a mounted eCryptfs filesystem. "+
+				"Its contents will be moved into CIPHERDIR anyway.", src)
+		}
+	}
+	return nil
+}
+
+// count adds up the files and bytes in the source, for the progress report
+func (m *migrateObj) count() {
+	filepath.Walk(m.src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			// We will run into this again during the migration and report it
+			// there
+			return nil
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		m.totalFiles++
+		if fi.Mode().IsRegular() {
+			m.totalBytes += fi.Size()
+		}
+		return nil
+	})
+}
+
+// progress reports the progress every migrateReportInterval
+func (m *migrateObj) progress() {
+	if time.Since(m.lastReport) < migrateReportInterval {
+		return
+	}
+	m.lastReport = time.Now()
+	percent := int64(100)
+	if m.totalBytes > 0 {
+		percent = m.bytes * 100 / m.totalBytes
+	}
+	tlog.Info.Printf("migrate: %d of %d files, %d of %d MiB (%d%%)",
+		m.files, m.totalFiles, m.bytes>>20, m.totalBytes>>20, percent)
+}
+
+// setMeta copies owner, permissions and timestamps from "st" to "dst"
+func (m *migrateObj) setMeta(dst string, st *unix.Stat_t) {
+	if runsAsRoot() {
+		if err := os.Lchown(dst, int(st.Uid), int(st.Gid)); err != nil {
+			tlog.Warn.Printf("migrate: chown %q: %v", dst, err)
+		}
+	}
+	if st.Mode&unix.S_IFMT == unix.S_IFLNK {
+		return
+	}
+	if err := syscall.Chmod(dst, uint32(st.Mode&07777)); err != nil {
+		tlog.Warn.Printf("migrate: chmod %q: %v", dst, err)
+	}
+	ts := []unix.Timespec{st.Atim, st.Mtim}
+	if err := unix.UtimesNano(dst, ts); err != nil {
+		tlog.Warn.Printf("migrate: utimes %q: %v", dst, err)
+	}
+}
+
+// problem reports a file that could not be migrated. It stays in the source
+// and the migration continues with the next file.
+func (m *migrateObj) problem(relPath string, err error) {
+	tlog.Warn.Printf("migrate: %q: %v", relPath, err)
+	m.problems++
+}
+
+// dir migrates the contents of directory "relPath", and then the directory
+// itself, except for the root directory.
+func (m *migrateObj) dir(relPath string, st *unix.Stat_t) {
+	dst := filepath.Join(m.mnt, relPath)
+	if relPath != "" {
+		err := os.Mkdir(dst, 0700)
+		if err != nil && !os.IsExist(err) {
+			m.problem(relPath, err)
+			return
+		}
+	}
+	entries, err := ioutil.ReadDir(filepath.Join(m.src, relPath))
+	if err != nil {
+		m.problem(relPath, err)
+		return
+	}
+	for _, e := range entries {
+		if m.abort {
+			return
+		}
+		m.entry(filepath.Join(relPath, e.Name()))
+	}
+	if relPath == "" {
+		return
+	}
+	m.setMeta(dst, st)
+	// Fails if something could not be migrated, which has been reported
+	// already
+	if os.Remove(filepath.Join(m.src, relPath)) == nil {
+		m.dirs++
+	}
+}
+
+// entry migrates the file, directory, symlink or special file "relPath"
+func (m *migrateObj) entry(relPath string) {
+	src := filepath.Join(m.src, relPath)
+	dst := filepath.Join(m.mnt, relPath)
+	var st unix.Stat_t
+	if err := unix.Lstat(src, &st); err != nil {
+		m.problem(relPath, err)
+		return
+	}
+	var err error
+	switch st.Mode & unix.S_IFMT {
+	case unix.S_IFDIR:
+		m.dir(relPath, &st)
+		return
+	case unix.S_IFREG:
+		if l, ok := m.links[st.Ino]; ok {
+			if l.left--; l.left == 0 {
+				delete(m.links, st.Ino)
+			}
+			os.Remove(dst)
+			err = os.Link(filepath.Join(m.mnt, l.path), dst)
+			break
+		}
+		err = m.copyFile(src, dst)
+		if err == nil && st.Nlink > 1 {
+			m.links[st.Ino] = &migrateLink{path: relPath, left: uint64(st.Nlink) - 1}
+		}
+	case unix.S_IFLNK:
+		var target string
+		target, err = os.Readlink(src)
+		if err != nil {
+			break
+		}
+		// Left over from an interrupted run
+		os.Remove(dst)
+		err = os.Symlink(target, dst)
+	default:
+		os.Remove(dst)
+		err = syscall.Mknod(dst, uint32(st.Mode), int(st.Rdev))
+	}
+	if err != nil {
+		m.problem(relPath, err)
+		return
+	}
+	m.setMeta(dst, &st)
+	if err = syscall.Unlink(src); err != nil {
+		m.problem(relPath, err)
+		return
+	}
+	m.files++
+	m.progress()
+}
+
+// copyFile copies the contents of "src" to "dst" and syncs "dst" to disk
+func (m *migrateObj) copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	// Truncates what an interrupted run has left behind
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	n, err := io.CopyBuffer(out, in, make([]byte, migrateBufSize))
+	if err == nil {
+		// The source is deleted next, so the copy must be on disk
+		err = out.Sync()
+	}
+	if err2 := out.Close(); err == nil {
+		err = err2
+	}
+	m.bytes += n
+	return err
+}
+
+// migrate moves the contents of "src", which is the mounted plaintext view of
+// a filesystem created by another encryption tool (see checkMigrateSource for
+// the supported "kind"s), into CIPHERDIR. Called for "-migrate-encfs" and
+// "-migrate-ecryptfs".
+func migrate(args *argContainer, src string, kind string) (exitcode int) {
+	if args.reverse {
+		tlog.Fatal.Printf("-migrate-%s does not work with -reverse", kind)
+		return exitcodes.Usage
+	}
+	src, _ = filepath.Abs(src)
+	if strings.HasPrefix(src+"/", args.cipherdir+"/") ||
+		strings.HasPrefix(args.cipherdir+"/", src+"/") {
+		tlog.Fatal.Printf("-migrate-%s: %q and CIPHERDIR must not be inside each other", kind, src)
+		return exitcodes.Usage
+	}
+	if err := checkMigrateSource(src, kind); err != nil {
+		tlog.Fatal.Printf("-migrate-%s: %v", kind, err)
+		return exitcodes.Migrate
+	}
+	args.allow_other = false
+	var err error
+	args.mountpoint, err = ioutil.TempDir("", "gocryptfs.migrate.")
+	if err != nil {
+		tlog.Fatal.Printf("-migrate-%s: TmpDir: %v", kind, err)
+		return exitcodes.MountPoint
+	}
+	defer os.Remove(args.mountpoint)
+	pfs, wipeKeys := initFuseFrontend(args)
+	defer wipeKeys()
+	srv, err := initGoFuse(pfs, args)
+	if err != nil {
+		return exitcodes.FuseNewServer
+	}
+	defer func() {
+		if err := srv.Unmount(); err != nil {
+			tlog.Warn.Printf("failed to unmount %q: %v", args.mountpoint, err)
+		}
+	}()
+	m := migrateObj{
+		src:   src,
+		mnt:   args.mountpoint,
+		links: make(map[uint64]*migrateLink),
+		// The first report comes after migrateReportInterval
+		lastReport: time.Now(),
+	}
+	m.count()
+	// Handle SIGINT & SIGTERM. Every file is either fully migrated or still
+	// in the source, so we can stop between two files.
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ch
+		m.abort = true
+	}()
+	tlog.Info.Printf("Moving %d files (%d MiB) from %q into %q",
+		m.totalFiles, m.totalBytes>>20, src, args.cipherdir)
+	m.dir("", nil)
+	tlog.Info.Printf("migrate summary: %d files and %d directories moved, %d bytes",
+		m.files, m.dirs, m.bytes)
+	if m.abort {
+		tlog.Info.Printf("migrate: aborted. Run the same command again to continue.")
+		return exitcodes.Other
+	}
+	if m.problems > 0 {
+		tlog.Fatal.Printf("migrate: %d files could not be moved and have been left in %q",
+			m.problems, src)
+		return exitcodes.Migrate
+	}
+	tlog.Info.Printf(tlog.ColorGreen+"Migration complete. %q is empty now."+tlog.ColorReset, src)
+	return 0
+}
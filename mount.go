@@ -4,8 +4,8 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
-	"log/syslog"
 	"math"
 	"net"
 	"os"
@@ -15,6 +15,7 @@ import (
 	"path/filepath"
 	"runtime"
 	"runtime/debug"
+	"sort"
 	"strings"
 	"sync/atomic"
 	"syscall"
@@ -25,6 +26,7 @@ import (
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 
+	"github.com/rfjakob/gocryptfs/internal/audit"
 	"github.com/rfjakob/gocryptfs/internal/configfile"
 	"github.com/rfjakob/gocryptfs/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/internal/cryptocore"
@@ -32,49 +34,71 @@ import (
 	"github.com/rfjakob/gocryptfs/internal/exitcodes"
 	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
 	"github.com/rfjakob/gocryptfs/internal/fusefrontend_reverse"
+	"github.com/rfjakob/gocryptfs/internal/keylock"
+	"github.com/rfjakob/gocryptfs/internal/metrics"
 	"github.com/rfjakob/gocryptfs/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/internal/openfiletable"
+	"github.com/rfjakob/gocryptfs/internal/secmem"
 	"github.com/rfjakob/gocryptfs/internal/tlog"
 )
 
-// doMount mounts an encrypted directory.
+// doMount mounts one or more encrypted directories. Every CIPHERDIR
+// MOUNTPOINT pair on the command line is served by this process.
 // Called from main.
 func doMount(args *argContainer) {
-	// Check mountpoint
 	var err error
-	args.mountpoint, err = filepath.Abs(flagSet.Arg(1))
-	if err != nil {
-		tlog.Fatal.Printf("Invalid mountpoint: %v", err)
-		os.Exit(exitcodes.MountPoint)
-	}
-	// We cannot mount "/home/user/.cipher" at "/home/user" because the mount
-	// will hide ".cipher" also for us.
-	if args.cipherdir == args.mountpoint || strings.HasPrefix(args.cipherdir, args.mountpoint+"/") {
-		tlog.Fatal.Printf("Mountpoint %q would shadow cipherdir %q, this is not supported",
-			args.mountpoint, args.cipherdir)
-		os.Exit(exitcodes.MountPoint)
+	// Runs last. The keys of every filesystem are wiped when it is
+	// unmounted, this catches what has been left behind.
+	defer secmem.WipeAll()
+	if args.max_threads > 0 {
+		// Shared by all filesystems, so this must happen before the
+		// argContainer is copied below
+		args._threads = make(chan struct{}, args.max_threads)
 	}
-	// Reverse-mounting "/foo" at "/foo/mnt" means we would be recursively
-	// encrypting ourselves.
-	if strings.HasPrefix(args.mountpoint, args.cipherdir+"/") {
-		tlog.Fatal.Printf("Mountpoint %q is contained in cipherdir %q, this is not supported",
-			args.mountpoint, args.cipherdir)
-		os.Exit(exitcodes.MountPoint)
+	mounts := []*argContainer{args}
+	if flagSet.NArg() > 2 {
+		// Options that name a single file cannot be shared between mounts
+		if args._configCustom || args.ctlsock != "" || args.trace_fuse != "" || args.audit != "" || args.mount_snapshot != "" {
+			tlog.Fatal.Printf("-config, -ctlsock, -trace-fuse, -audit and -mount-snapshot cannot be used when mounting more than one filesystem")
+			os.Exit(exitcodes.Usage)
+		}
+		args._passwordPrompt = "Password for " + args.cipherdir
+		for i := 2; i < flagSet.NArg(); i += 2 {
+			a := *args
+			a.cipherdir, _ = filepath.Abs(flagSet.Arg(i))
+			err = isDir(a.cipherdir)
+			if err != nil {
+				tlog.Fatal.Printf("Invalid cipherdir: %v", err)
+				os.Exit(exitcodes.CipherDir)
+			}
+			if a.reverse {
+				a.config = filepath.Join(a.cipherdir, configfile.ConfReverseName)
+			} else {
+				a.config = filepath.Join(a.cipherdir, configfile.ConfDefaultName)
+			}
+			a._passwordPrompt = "Password for " + a.cipherdir
+			mounts = append(mounts, &a)
+		}
 	}
-	if args.nonempty {
-		err = isDir(args.mountpoint)
-	} else {
-		err = isEmptyDir(args.mountpoint)
-		// OSXFuse will create the mountpoint for us ( https://github.com/rfjakob/gocryptfs/issues/194 )
-		if runtime.GOOS == "darwin" && os.IsNotExist(err) {
-			tlog.Info.Printf("Mountpoint %q does not exist, but should be created by OSXFuse",
-				args.mountpoint)
-			err = nil
+	for i, a := range mounts {
+		checkMountpoint(a, flagSet.Arg(2*i+1))
+		for _, b := range mounts[:i] {
+			if a.mountpoint == b.mountpoint {
+				tlog.Fatal.Printf("Mountpoint %q given more than once", a.mountpoint)
+				os.Exit(exitcodes.MountPoint)
+			}
 		}
 	}
-	if err != nil {
-		tlog.Fatal.Printf("Invalid mountpoint: %v", err)
-		os.Exit(exitcodes.MountPoint)
+	// Check "-setuid" before asking for the password
+	if args.setuid != "" {
+		if os.Getuid() != 0 {
+			tlog.Fatal.Printf("-setuid: only root can switch to another user")
+			os.Exit(exitcodes.Setuid)
+		}
+		if _, _, _, err = lookupUser(args.setuid); err != nil {
+			tlog.Fatal.Printf("-setuid: %v", err)
+			os.Exit(exitcodes.Setuid)
+		}
 	}
 	// Open control socket early so we can error out before asking the user
 	// for the password
@@ -97,44 +121,116 @@ func doMount(args *argContainer) {
 			}
 		}()
 	}
+	// Same for the metrics endpoint
+	if args.metrics != "" {
+		args._metricsFd, err = net.Listen("tcp", args.metrics)
+		if err != nil {
+			tlog.Fatal.Printf("metrics: %v", err)
+			os.Exit(exitcodes.Metrics)
+		}
+		defer args._metricsFd.Close()
+	}
+	if args.trace_fuse != "" {
+		args._fuseTracer, err = newFuseTracer(args.trace_fuse, args.trace_plain)
+		if err != nil {
+			tlog.Fatal.Printf("trace-fuse: %v", err)
+			os.Exit(exitcodes.Profiler)
+		}
+		defer args._fuseTracer.Close()
+	}
+	if args.audit != "" {
+		args._auditLog, err = openAuditLog(args.audit, args.audit_key)
+		if err != nil {
+			tlog.Fatal.Printf("audit: %v", err)
+			os.Exit(exitcodes.Audit)
+		}
+		defer args._auditLog.Close()
+	}
 	// Preallocation on Btrfs is broken ( https://github.com/rfjakob/gocryptfs/issues/395 )
 	// and slow ( https://github.com/rfjakob/gocryptfs/issues/63 ).
-	if !args.noprealloc {
+	for _, a := range mounts {
+		if a.noprealloc {
+			continue
+		}
 		// darwin does not have unix.BTRFS_SUPER_MAGIC, so we define it here
 		const BTRFS_SUPER_MAGIC = 0x9123683e
 		var st unix.Statfs_t
-		err = unix.Statfs(args.cipherdir, &st)
+		err = unix.Statfs(a.cipherdir, &st)
 		// Cast to uint32 avoids compile error on arm: "constant 2435016766 overflows int32"
 		if err == nil && uint32(st.Type) == BTRFS_SUPER_MAGIC {
 			tlog.Info.Printf(tlog.ColorYellow +
 				"Btrfs detected, forcing -noprealloc. See https://github.com/rfjakob/gocryptfs/issues/395 for why." +
 				tlog.ColorReset)
-			args.noprealloc = true
+			a.noprealloc = true
+		}
+	}
+	// Initialize gocryptfs (read config file, ask for password, ...) for all
+	// filesystems before mounting any of them. A wrong password should not
+	// leave some of them mounted.
+	roots := make([]fs.InodeEmbedder, len(mounts))
+	for i, a := range mounts {
+		// We cannot use JSON for pretty-printing as the fields are unexported
+		tlog.Debug.Printf("cli args: %#v", a)
+		var wipeKeys func()
+		roots[i], wipeKeys = initFuseFrontend(a)
+		// Try to wipe secret keys from memory after unmount
+		defer wipeKeys()
+	}
+	// Everything that may need root is done. Mount as the user, so the mount
+	// belongs to them and they can access and unmount it.
+	if args.setuid != "" {
+		if err = dropPrivileges(args.setuid, args.ctlsock); err != nil {
+			tlog.Fatal.Printf("-setuid: %v", err)
+			os.Exit(exitcodes.Setuid)
+		}
+	}
+	// Initialize go-fuse FUSE servers
+	var servers []*fuse.Server
+	unmountAll := func() {
+		for i, srv := range servers {
+			unmount(srv, mounts[i].mountpoint)
 		}
 	}
-	// We cannot use JSON for pretty-printing as the fields are unexported
-	tlog.Debug.Printf("cli args: %#v", args)
-	// Initialize gocryptfs (read config file, ask for password, ...)
-	fs, wipeKeys := initFuseFrontend(args)
-	// Initialize go-fuse FUSE server
-	srv := initGoFuse(fs, args)
-	// Try to wipe secret keys from memory after unmount
-	defer wipeKeys()
+	for i, a := range mounts {
+		srv, err := initGoFuse(roots[i], a)
+		if err != nil {
+			unmountAll()
+			os.Exit(exitcodes.FuseNewServer)
+		}
+		servers = append(servers, srv)
+	}
+	// Make sure the mounts actually work before we report success
+	for _, a := range mounts {
+		if err := checkServing(a.mountpoint); err != nil {
+			tlog.Fatal.Printf("Mount check failed: %v", err)
+			unmountAll()
+			os.Exit(exitcodes.FuseNewServer)
+		}
+		if args.max_readahead > defaultReadahead && runtime.GOOS == "linux" {
+			if err := raiseReadahead(a.mountpoint, args.max_readahead); err != nil {
+				tlog.Warn.Printf("-max_readahead: could not raise the readahead above %d KiB: %v",
+					defaultReadahead/1024, err)
+			}
+		}
+	}
+	// SIGUSR1 and SIGHUP. Install the handlers before we report success, as
+	// the default action for both is to exit.
+	handleSignals(args, roots, servers)
 
-	tlog.Info.Println(tlog.ColorGreen + "Filesystem mounted and ready." + tlog.ColorReset)
+	if len(mounts) == 1 {
+		tlog.Info.Println(tlog.ColorGreen + "Filesystem mounted and ready." + tlog.ColorReset)
+	} else {
+		tlog.Info.Printf(tlog.ColorGreen+"%d filesystems mounted and ready."+tlog.ColorReset, len(mounts))
+	}
 	// We have been forked into the background, as evidenced by the set
-	// "notifypid".
-	if args.notifypid > 0 {
+	// "notifyfd" or "notifypid".
+	if args.notifyfd > 0 || args.notifypid > 0 {
 		// Chdir to the root directory so we don't block unmounting the CWD
 		os.Chdir("/")
 		// Switch to syslog
 		if !args.nosyslog {
 			// Switch all of our logs and the generic logger to syslog
-			tlog.Info.SwitchToSyslog(syslog.LOG_USER | syslog.LOG_INFO)
-			tlog.Debug.SwitchToSyslog(syslog.LOG_USER | syslog.LOG_DEBUG)
-			tlog.Warn.SwitchToSyslog(syslog.LOG_USER | syslog.LOG_WARNING)
-			tlog.Fatal.SwitchToSyslog(syslog.LOG_USER | syslog.LOG_CRIT)
-			tlog.SwitchLoggerToSyslog(syslog.LOG_USER | syslog.LOG_WARNING)
+			tlog.SwitchAllToSyslog(args.syslog_tag)
 			// Daemons should redirect stdin, stdout and stderr
 			redirectStdFds()
 		}
@@ -145,27 +241,129 @@ func doMount(args *argContainer) {
 		if err != nil {
 			tlog.Warn.Printf("Setsid: %v", err)
 		}
-		// Send SIGUSR1 to our parent
-		sendUsr1(args.notifypid)
+		// Tell our parent that the mount is ready
+		if args.notifypid > 0 {
+			sendUsr1(args.notifypid)
+		}
+		if args.notifyfd > 0 {
+			notifyFd(args.notifyfd)
+		}
+	} else if args.syslog {
+		// Running in the foreground, but the user wants syslog anyway
+		tlog.SwitchAllToSyslog(args.syslog_tag)
 	}
+	// Tell systemd that we are ready, if we run as a "Type=notify" service.
+	// MAINPID is for when we have been forked into the background.
+	sdNotify(fmt.Sprintf("READY=1\nMAINPID=%d", os.Getpid()))
 	// Increase the open file limit to 4096. This is not essential, so do it after
 	// we have switched to syslog and don't bother the user with warnings.
 	setOpenFileLimit()
+	if args._metricsFd != nil {
+		go metrics.Serve(args._metricsFd)
+	}
 	// Wait for SIGINT in the background and unmount ourselves if we get it.
 	// This prevents a dangling "Transport endpoint is not connected"
 	// mountpoint if the user hits CTRL-C.
-	handleSigint(srv, args.mountpoint)
+	saveQuotas := func() {
+		if args.quota > 0 && !args.reverse {
+			for _, root := range roots {
+				root.(*fusefrontend.RootNode).SaveQuota()
+			}
+		}
+	}
+	handleSigint(func() {
+		sdNotify("STOPPING=1")
+		unmountAll()
+		saveQuotas()
+		// We exit without running the deferred functions
+		if args._fuseTracer != nil {
+			args._fuseTracer.Close()
+		}
+		secmem.WipeAll()
+	})
 	// Return memory that was allocated for scrypt (64M by default!) and other
 	// stuff that is no longer needed to the OS
 	debug.FreeOSMemory()
 	// Set up autounmount, if requested.
 	if args.idle > 0 && !args.reverse {
-		// Not being in reverse mode means we always have a forward file system.
-		fwdFs := fs.(*fusefrontend.RootNode)
-		go idleMonitor(args.idle, fwdFs, srv, args.mountpoint)
+		for i, srv := range servers {
+			// Not being in reverse mode means we always have a forward file system.
+			fwdFs := roots[i].(*fusefrontend.RootNode)
+			go idleMonitor(args.idle, fwdFs, srv, mounts[i].mountpoint)
+		}
+	}
+	// Start the background scrubbers, which stop when their filesystem is
+	// unmounted.
+	if args.scrub > 0 {
+		for i, srv := range servers {
+			stop := make(chan struct{})
+			go func(srv *fuse.Server) {
+				srv.Wait()
+				close(stop)
+			}(srv)
+			go roots[i].(*fusefrontend.RootNode).Scrub(args.scrub, stop)
+		}
+	}
+	// Same for the trash purgers
+	if args.trash_retention > 0 {
+		for i, srv := range servers {
+			if mounts[i].ro {
+				continue
+			}
+			stop := make(chan struct{})
+			go func(srv *fuse.Server) {
+				srv.Wait()
+				close(stop)
+			}(srv)
+			go roots[i].(*fusefrontend.RootNode).TrashPurger(args.trash_retention, stop)
+		}
+	}
+	// Wait for unmount of all filesystems.
+	for _, srv := range servers {
+		srv.Wait()
+	}
+	saveQuotas()
+	sdNotify("STOPPING=1")
+}
+
+// checkMountpoint sets args.mountpoint to the absolute path of "mountpoint"
+// and checks that it can be used with args.cipherdir. Exits on error.
+func checkMountpoint(args *argContainer, mountpoint string) {
+	var err error
+	args.mountpoint, err = filepath.Abs(mountpoint)
+	if err != nil {
+		tlog.Fatal.Printf("Invalid mountpoint: %v", err)
+		os.Exit(exitcodes.MountPoint)
+	}
+	// We cannot mount "/home/user/.cipher" at "/home/user" because the mount
+	// will hide ".cipher" also for us.
+	if args.cipherdir == args.mountpoint || strings.HasPrefix(args.cipherdir, args.mountpoint+"/") {
+		tlog.Fatal.Printf("Mountpoint %q would shadow cipherdir %q, this is not supported",
+			args.mountpoint, args.cipherdir)
+		os.Exit(exitcodes.MountPoint)
+	}
+	// Reverse-mounting "/foo" at "/foo/mnt" means we would be recursively
+	// encrypting ourselves.
+	if strings.HasPrefix(args.mountpoint, args.cipherdir+"/") {
+		tlog.Fatal.Printf("Mountpoint %q is contained in cipherdir %q, this is not supported",
+			args.mountpoint, args.cipherdir)
+		os.Exit(exitcodes.MountPoint)
+	}
+	if args.nonempty {
+		err = isDir(args.mountpoint)
+	} else {
+		err = isEmptyDir(args.mountpoint)
+		// OSXFuse will create the mountpoint for us ( https://github.com/rfjakob/gocryptfs/issues/194 )
+		if runtime.GOOS == "darwin" && os.IsNotExist(err) {
+			tlog.Info.Printf("Mountpoint %q does not exist, but should be created by OSXFuse",
+				args.mountpoint)
+			err = nil
+		}
+	}
+	if err != nil {
+		tlog.Fatal.Printf("Invalid mountpoint: %v", err)
+		os.Exit(exitcodes.MountPoint)
 	}
-	// Wait for unmount.
-	srv.Wait()
 }
 
 // Based on the EncFS idle monitor:
@@ -240,6 +438,35 @@ func initFuseFrontend(args *argContainer) (rootNode fs.InodeEmbedder, wipeKeys f
 			exitcodes.Exit(err)
 		}
 	}
+	// The duress password without a decoy mounts an empty volume
+	cleanup := func() {}
+	if args._duress && masterkey == nil {
+		masterkey, cleanup = emptyVolume(args, confFile)
+	}
+	rootNode, wipeCores := initFuseFrontendKey(args, masterkey, confFile)
+	// After the crypto backend is initialized,
+	// we can purge the master key from memory.
+	secmem.Free(masterkey)
+	return rootNode, func() {
+		wipeCores()
+		cleanup()
+	}
+}
+
+// initFuseFrontendKey is initFuseFrontend with the master key already
+// known. "confFile" is nil when "-zerokey" or "-masterkey" was used.
+func initFuseFrontendKey(args *argContainer, masterkey []byte, confFile *configfile.ConfFile) (rootNode fs.InodeEmbedder, wipeKeys func()) {
+	// The key of the decrypt-only key slot cannot encrypt file contents
+	if args._decryptOnly {
+		if args.reverse {
+			tlog.Fatal.Printf("The decrypt-only key slot does not work in reverse mode")
+			os.Exit(exitcodes.Usage)
+		}
+		if !args.ro {
+			tlog.Info.Printf("Mounting read-only")
+		}
+		args.ro = true
+	}
 	// Reconciliate CLI and config file arguments into a fusefrontend.Args struct
 	// that is passed to the filesystem implementation
 	cryptoBackend := cryptocore.BackendGoGCM
@@ -254,27 +481,82 @@ func initFuseFrontend(args *argContainer) (rootNode fs.InodeEmbedder, wipeKeys f
 	if args._forceOwner != nil {
 		args.allow_other = true
 	}
+	// allow_root is implemented on top of allow_other, see allowRootFS.
+	if args.allow_root {
+		if args.allow_other {
+			tlog.Fatal.Printf("-allow_root and -allow_other (or -force_owner) cannot be used at the same time")
+			os.Exit(exitcodes.Usage)
+		}
+		args.allow_other = true
+	}
 	frontendArgs := fusefrontend.Args{
-		Cipherdir:       args.cipherdir,
-		PlaintextNames:  args.plaintextnames,
-		LongNames:       args.longnames,
-		ConfigCustom:    args._configCustom,
-		NoPrealloc:      args.noprealloc,
-		SerializeReads:  args.serialize_reads,
-		ForceDecode:     args.forcedecode,
-		ForceOwner:      args._forceOwner,
-		Exclude:         args.exclude,
-		ExcludeWildcard: args.excludeWildcard,
-		ExcludeFrom:     args.excludeFrom,
-		Suid:            args.suid,
-		KernelCache:     args.kernel_cache,
+		Cipherdir:          args.cipherdir,
+		PlaintextNames:     args.plaintextnames,
+		LongNames:          args.longnames,
+		ConfigCustom:       args._configCustom,
+		NoPrealloc:         args.noprealloc,
+		SerializeReads:     args.serialize_reads,
+		ForceDecode:        args.forcedecode,
+		ForceOwner:         args._forceOwner,
+		Exclude:            args.exclude,
+		ExcludeWildcard:    args.excludeWildcard,
+		ExcludeFrom:        args.excludeFrom,
+		Suid:               args.suid,
+		KernelCache:        args.kernel_cache,
+		UnlinkWipe:         args.unlink_wipe,
+		Shred:              args.shred,
+		Passthrough:        args.passthrough,
+		DeterministicNames: args.deterministic_names,
+		DirCacheSize:       args.dircache,
+		ReadPipelineDepth:  args.read_pipeline,
+		Prefetch:           args.prefetch,
+		CaseInsensitive:    args.case_insensitive,
+		SharedStorage:      args.sharedstorage,
+		AttrTimeout:        args.attr_timeout,
+		XattrSidecar:       args.xattr_sidecar,
+		Acl:                args.acl,
+		Sparse:             args.sparse,
+		ReadOnly:           args.ro,
+		MerkleRoots:        args.merkle,
+		Audit:              args._auditLog,
+		TrashRetention:     args.trash_retention,
+		Quota:              int64(args.quota),
+	}
+	// With -sharedstorage, other machines may rename and delete directories
+	// behind our back, so we cannot keep them open
+	if args.sharedstorage {
+		frontendArgs.DirCacheSize = 0
 	}
 	// confFile is nil when "-zerokey" or "-masterkey" was used
 	if confFile != nil {
 		// Settings from the config file override command line args
 		frontendArgs.PlaintextNames = confFile.IsFeatureFlagSet(configfile.FlagPlaintextNames)
+		frontendArgs.DeterministicNames = confFile.IsFeatureFlagSet(configfile.FlagDeterministicNames)
 		args.raw64 = confFile.IsFeatureFlagSet(configfile.FlagRaw64)
 		args.hkdf = confFile.IsFeatureFlagSet(configfile.FlagHKDF)
+		args.pad_names = confFile.IsFeatureFlagSet(configfile.FlagPadNames)
+		frontendArgs.PlaintextSymlinks = confFile.IsFeatureFlagSet(configfile.FlagPlaintextSymlinks)
+		frontendArgs.MerkleRoots = confFile.IsFeatureFlagSet(configfile.FlagMerkleRoots)
+		// A different value would encode names differently, so they could
+		// not be decrypted anymore
+		longNameMax := 255
+		if confFile.IsFeatureFlagSet(configfile.FlagLongNameMax) {
+			longNameMax = int(confFile.LongNameMax)
+		}
+		if args._explicitLongnamemax && args.longnamemax != longNameMax {
+			tlog.Fatal.Printf("-longnamemax=%d does not match the value %d that is stored in the config file",
+				args.longnamemax, longNameMax)
+			os.Exit(exitcodes.Usage)
+		}
+		args.longnamemax = longNameMax
+		// Same for the passthrough patterns: files stored differently than
+		// the patterns say are inaccessible
+		if args.passthrough != nil && !samePatterns(args.passthrough, confFile.Passthrough) {
+			tlog.Fatal.Printf("-passthrough %q does not match the patterns %q that are stored in the config file",
+				[]string(args.passthrough), confFile.Passthrough)
+			os.Exit(exitcodes.Usage)
+		}
+		frontendArgs.Passthrough = confFile.Passthrough
 		if confFile.IsFeatureFlagSet(configfile.FlagAESSIV) {
 			cryptoBackend = cryptocore.BackendAESSIV
 		} else if args.reverse {
@@ -282,35 +564,104 @@ func initFuseFrontend(args *argContainer) (rootNode fs.InodeEmbedder, wipeKeys f
 			os.Exit(exitcodes.Usage)
 		}
 	}
+	if args.quota > 0 && frontendArgs.Passthrough != nil {
+		// Passthrough files bypass the accounting
+		tlog.Fatal.Printf("-quota does not work with -passthrough")
+		os.Exit(exitcodes.Usage)
+	}
+	if frontendArgs.CaseInsensitive && frontendArgs.PlaintextNames {
+		tlog.Fatal.Printf("-case-insensitive does not work with plaintextnames")
+		os.Exit(exitcodes.Usage)
+	}
+	if frontendArgs.XattrSidecar && frontendArgs.PlaintextNames {
+		tlog.Fatal.Printf("-xattr-sidecar does not work with plaintextnames")
+		os.Exit(exitcodes.Usage)
+	}
 	// If allow_other is set and we run as root, try to give newly created files to
 	// the right user.
-	if args.allow_other && os.Getuid() == 0 {
+	if args.allow_other && os.Getuid() == 0 && args.setuid == "" {
 		frontendArgs.PreserveOwner = true
 	}
 	jsonBytes, _ := json.MarshalIndent(frontendArgs, "", "\t")
 	tlog.Debug.Printf("frontendArgs: %s", string(jsonBytes))
 
-	// Init crypto backend
-	cCore := cryptocore.New(masterkey, cryptoBackend, contentenc.DefaultIVBits, args.hkdf, args.forcedecode)
-	cEnc := contentenc.New(cCore, contentenc.DefaultBS, args.forcedecode)
-	nameTransform := nametransform.New(cCore.EMECipher, frontendArgs.LongNames, args.raw64)
-	// Init badname patterns
-	nameTransform.BadnamePatterns = make([]string, 0)
+	// Check badname patterns
 	for _, pattern := range args.badname {
 		_, err := filepath.Match(pattern, "") // Make sure pattern is valid
 		if err != nil {
 			tlog.Fatal.Printf("-badname: invalid pattern %q supplied", pattern)
 			os.Exit(exitcodes.Usage)
-		} else {
-			nameTransform.BadnamePatterns = append(nameTransform.BadnamePatterns, pattern)
 		}
 	}
-	// After the crypto backend is initialized,
-	// we can purge the master key from memory.
-	for i := range masterkey {
-		masterkey[i] = 0
+	// Init crypto backend. Subtrees with their own key need one each.
+	newCore := func(key []byte) *cryptocore.CryptoCore {
+		if args._decryptOnly {
+			return cryptocore.NewDecryptOnly(key, cryptoBackend, contentenc.DefaultIVBits, args.forcedecode)
+		}
+		return cryptocore.New(key, cryptoBackend, contentenc.DefaultIVBits, args.hkdf, args.forcedecode)
 	}
-	masterkey = nil
+	var cores []*cryptocore.CryptoCore
+	// The DirIVs of the subtrees that lead from masterkey to the key of
+	// each core, see attachSubtrees. "-unlock" derives them again.
+	var coreDirIVs [][][]byte
+	newCrypto := func(key []byte, dirIVs [][]byte) (*contentenc.ContentEnc, *nametransform.NameTransform) {
+		cCore := newCore(key)
+		cores = append(cores, cCore)
+		coreDirIVs = append(coreDirIVs, dirIVs)
+		cEnc := contentenc.New(cCore, contentenc.DefaultBS, args.forcedecode, args.zero_corrupt)
+		nameTransform := nametransform.New(cCore.EMECipher, frontendArgs.LongNames, uint8(args.longnamemax), args.raw64, args.pad_names)
+		nameTransform.BadnamePatterns = append([]string{}, args.badname...)
+		return cEnc, nameTransform
+	}
+	cEnc, nameTransform := newCrypto(masterkey, nil)
+	// "-lock" wipes the keys of all cores. "-unlock" needs the config file
+	// to get them back. The empty volume of the duress password has a random
+	// key, and the decoy has another password.
+	var restore func([]byte) error
+	if confFile != nil && !args._duress && !confFile.IsFeatureFlagSet(configfile.FlagFIDO2) {
+		check := keyCheck(cores[0])
+		restore = func(password []byte) error {
+			key, err := unlockKey(args, cryptoBackend, password)
+			if err != nil {
+				return err
+			}
+			fresh := make([]*cryptocore.CryptoCore, len(cores))
+			for i := range cores {
+				k := secmem.Copy(key)
+				for _, dirIV := range coreDirIVs[i] {
+					k2 := cryptocore.SubtreeKey(k, dirIV)
+					secmem.Free(k)
+					k = k2
+				}
+				fresh[i] = newCore(k)
+				secmem.Free(k)
+			}
+			secmem.Free(key)
+			if !bytes.Equal(keyCheck(fresh[0]), check) {
+				// The config file has been replaced by one with another key
+				for _, c := range fresh {
+					c.Wipe()
+				}
+				return errLockWrongKey
+			}
+			for i, c := range cores {
+				c.Restore(fresh[i])
+			}
+			tlog.Info.Printf("-unlock: keys restored")
+			return nil
+		}
+	}
+	args._keyLock = keylock.New(func() {
+		for _, c := range cores {
+			c.Forget()
+		}
+		// The caches hold plaintext paths and names
+		if rn, ok := rootNode.(*fusefrontend.RootNode); ok {
+			rn.DropCaches()
+		}
+		tlog.Info.Printf("-lock: keys wiped")
+	}, restore)
+	frontendArgs.KeyLock = args._keyLock
 	// Spawn fusefrontend
 	if args.reverse {
 		if cryptoBackend != cryptocore.BackendAESSIV {
@@ -318,62 +669,193 @@ func initFuseFrontend(args *argContainer) (rootNode fs.InodeEmbedder, wipeKeys f
 		}
 		rootNode = fusefrontend_reverse.NewRootNode(frontendArgs, cEnc, nameTransform)
 	} else {
-		rootNode = fusefrontend.NewRootNode(frontendArgs, cEnc, nameTransform)
+		if args.subdir != "" {
+			frontendArgs.Cipherdir = resolveSubdir(frontendArgs, cEnc, nameTransform, args.subdir)
+		}
+		rn := fusefrontend.NewRootNode(frontendArgs, cEnc, nameTransform)
+		// resolveSubdir makes sure that "-subdir" is not below a directory
+		// with its own key. Their keys cannot be derived from the key of
+		// the decrypt-only key slot.
+		if args.subdir == "" && !args._decryptOnly {
+			attachSubtrees(rn, masterkey, nil, newCrypto)
+		}
+		rootNode = rn
 	}
 	// We have opened the socket early so that we cannot fail here after
 	// asking the user for the password
 	if args._ctlsockFd != nil {
 		go ctlsocksrv.Serve(args._ctlsockFd, rootNode.(ctlsocksrv.Interface))
 	}
-	return rootNode, func() { cCore.Wipe() }
+	return rootNode, func() {
+		s := cores[0].IVGenerator.Stats()
+		if s.FilterHits > 0 || s.EntropyFailures > 0 {
+			tlog.Warn.Printf("Random number generator health: %+v", s)
+		} else {
+			tlog.Debug.Printf("Random number generator health: %+v", s)
+		}
+		for _, c := range cores {
+			c.Wipe()
+		}
+	}
+}
+
+// attachSubtrees adds the directories in the root of "rn" that have their
+// own key ("-dirkey") as subtrees, and theirs to them. Their keys are
+// derived from "masterkey", the key of "rn". "dirIVs" are the DirIVs of the
+// subtrees above "rn". "newCrypto" sets up the encryption for a key.
+func attachSubtrees(rn *fusefrontend.RootNode, masterkey []byte, dirIVs [][]byte,
+	newCrypto func([]byte, [][]byte) (*contentenc.ContentEnc, *nametransform.NameTransform)) {
+	names, err := rn.ListSubtrees()
+	if err != nil {
+		tlog.Warn.Printf("-dirkey: %v", err)
+		return
+	}
+	for _, cName := range names {
+		dirIV, err := rn.SubtreeDirIV(cName)
+		if err != nil {
+			tlog.Warn.Printf("-dirkey: %q: %v", cName, err)
+			continue
+		}
+		key := cryptocore.SubtreeKey(masterkey, dirIV)
+		subDirIVs := append(dirIVs[:len(dirIVs):len(dirIVs)], dirIV)
+		cEnc, nameTransform := newCrypto(key, subDirIVs)
+		sub, err := rn.AddSubtree(cName, cEnc, nameTransform)
+		if err == nil {
+			attachSubtrees(sub, key, subDirIVs, newCrypto)
+		} else {
+			tlog.Warn.Printf("-dirkey: %q: %v", cName, err)
+		}
+		secmem.Free(key)
+	}
+}
+
+// resolveSubdir returns the backing directory of the plaintext directory
+// "subdir" for "-subdir". Every encrypted directory has its own DirIV, so the
+// backing directory can serve as the root of the mount.
+// On error, it calls os.Exit and does not return.
+// samePatterns returns true if "a" and "b" contain the same patterns, in any
+// order
+func samePatterns(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a2 := append([]string(nil), a...)
+	b2 := append([]string(nil), b...)
+	sort.Strings(a2)
+	sort.Strings(b2)
+	for i := range a2 {
+		if a2[i] != b2[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func resolveSubdir(frontendArgs fusefrontend.Args, cEnc *contentenc.ContentEnc, nameTransform *nametransform.NameTransform, subdir string) string {
+	// Also makes sure we cannot escape CIPHERDIR with ".."
+	subdir = strings.Trim(filepath.Clean("/"+subdir), "/")
+	if subdir == "" {
+		return frontendArgs.Cipherdir
+	}
+	// Everything below a "-passthrough" directory is stored unencrypted, but
+	// the mount would treat the subdirectory as encrypted.
+	for _, name := range strings.Split(subdir, "/") {
+		for _, pattern := range frontendArgs.Passthrough {
+			if match, _ := filepath.Match(pattern, name); match {
+				tlog.Fatal.Printf("-subdir: %q is inside a -passthrough directory", subdir)
+				os.Exit(exitcodes.Usage)
+			}
+		}
+	}
+	// A temporary root node for the whole CIPHERDIR resolves the path. No
+	// need for caches or the read serializer.
+	frontendArgs.DirCacheSize = 0
+	frontendArgs.SerializeReads = false
+	rn := fusefrontend.NewRootNode(frontendArgs, cEnc, nameTransform)
+	cSubdir, err := rn.EncryptPath(subdir)
+	if err != nil {
+		tlog.Fatal.Printf("-subdir: %q: %v", subdir, err)
+		os.Exit(exitcodes.CipherDir)
+	}
+	cipherdir := filepath.Join(frontendArgs.Cipherdir, cSubdir)
+	// Names below a directory with its own key are encrypted with that key
+	cTop := strings.SplitN(cSubdir, "/", 2)[0]
+	if _, err = os.Lstat(filepath.Join(frontendArgs.Cipherdir, cTop, fusefrontend.SubtreeConfName)); err == nil {
+		tlog.Fatal.Printf("-subdir: %q has its own key. Mount %q with its password instead.",
+			strings.SplitN(subdir, "/", 2)[0], filepath.Join(frontendArgs.Cipherdir, cTop))
+		os.Exit(exitcodes.Usage)
+	}
+	var st syscall.Stat_t
+	err = syscall.Lstat(cipherdir, &st)
+	if err != nil {
+		tlog.Fatal.Printf("-subdir: %q: %v", subdir, err)
+		os.Exit(exitcodes.CipherDir)
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		tlog.Fatal.Printf("-subdir: %q is not a directory", subdir)
+		os.Exit(exitcodes.CipherDir)
+	}
+	tlog.Debug.Printf("-subdir: %q -> %q", subdir, cipherdir)
+	return cipherdir
 }
 
 // initGoFuse calls into go-fuse to mount `rootNode` on `args.mountpoint`.
 // The mountpoint is ready to use when the functions returns.
-// On error, it calls os.Exit and does not return.
-func initGoFuse(rootNode fs.InodeEmbedder, args *argContainer) *fuse.Server {
+// On error, it prints a message and returns the error.
+func initGoFuse(rootNode fs.InodeEmbedder, args *argContainer) (*fuse.Server, error) {
 	var fuseOpts *fs.Options
-	sec := time.Second
 	if args.sharedstorage {
 		// sharedstorage mode sets all cache timeouts to zero so changes to the
 		// backing shared storage show up immediately.
 		fuseOpts = &fs.Options{}
 	} else {
 		fuseOpts = &fs.Options{
-			// These options are to be compatible with libfuse defaults,
-			// making benchmarking easier.
-			NegativeTimeout: &sec,
-			AttrTimeout:     &sec,
-			EntryTimeout:    &sec,
+			// The defaults of 1s are compatible with libfuse, making
+			// benchmarking easier.
+			NegativeTimeout: &args.negative_timeout,
+			AttrTimeout:     &args.attr_timeout,
+			EntryTimeout:    &args.entry_timeout,
 		}
 	}
 	fuseOpts.NullPermissions = true
 	// Enable go-fuse warnings
 	fuseOpts.Logger = log.New(os.Stderr, "go-fuse: ", log.Lmicroseconds)
 	fuseOpts.MountOptions = fuse.MountOptions{
-		// Writes and reads are usually capped at 128kiB on Linux through
-		// the FUSE_MAX_PAGES_PER_REQ kernel constant in fuse_i.h. Our
-		// sync.Pool buffer pools are sized acc. to the default. Users may set
-		// the kernel constant higher, and Synology NAS kernels are known to
-		// have it >128kiB. We cannot handle more than 128kiB, so we tell
-		// the kernel to limit the size explicitly.
-		MaxWrite: fuse.MAX_KERNEL_WRITE,
-		Options:  []string{fmt.Sprintf("max_read=%d", fuse.MAX_KERNEL_WRITE)},
-		Debug:    args.fusedebug,
+		// Linux 4.20 and later accept reads and writes of up to 1 MiB
+		// (fuse.MAX_KERNEL_WRITE), older kernels cap them at 128 KiB.
+		// go-fuse negotiates "max_pages" and sets "max_read" from MaxWrite.
+		// Our sync.Pool buffer pools are sized for fuse.MAX_KERNEL_WRITE.
+		MaxWrite: args.max_write,
+		Debug:    args.fusedebug || tlog.DebugFuse,
+		// The kernel proposes a value, and this can only lower it. See
+		// raiseReadahead() for the other direction.
+		MaxReadAhead: args.max_readahead,
+		// 0 keeps the kernel default, which is 12
+		MaxBackground: args.max_background,
 	}
 
 	mOpts := &fuseOpts.MountOptions
 	if args.allow_other {
-		tlog.Info.Printf(tlog.ColorYellow + "The option \"-allow_other\" is set. Make sure the file " +
-			"permissions protect your data from unwanted access." + tlog.ColorReset)
+		if !args.allow_root {
+			tlog.Info.Printf(tlog.ColorYellow + "The option \"-allow_other\" is set. Make sure the file " +
+				"permissions protect your data from unwanted access." + tlog.ColorReset)
+		}
 		mOpts.AllowOther = true
-		// Make the kernel check the file permissions for us
+	}
+	// Make the kernel check the file permissions for us. With -acl, it
+	// evaluates the ACLs as well, which it reads through Getxattr.
+	if args.allow_other || args.acl {
 		mOpts.Options = append(mOpts.Options, "default_permissions")
 	}
+	mOpts.EnableAcl = args.acl
 	if args.forcedecode {
 		tlog.Info.Printf(tlog.ColorYellow + "THE OPTION \"-forcedecode\" IS ACTIVE. GOCRYPTFS WILL RETURN CORRUPT DATA!" +
 			tlog.ColorReset)
 	}
+	if args.zero_corrupt {
+		tlog.Info.Printf(tlog.ColorYellow + "THE OPTION \"-zero-corrupt\" IS ACTIVE. CORRUPT BLOCKS WILL READ AS ZEROS!" +
+			tlog.ColorReset)
+	}
 	// fusermount from libfuse 3.x removed the "nonempty" option and exits
 	// with an error if it sees it. Only add it to the options on libfuse 2.x.
 	if args.nonempty && haveFusermount2() {
@@ -399,8 +881,16 @@ func initGoFuse(rootNode fs.InodeEmbedder, args *argContainer) *fuse.Server {
 	// Add a volume name if running osxfuse. Otherwise the Finder will show it as
 	// something like "osxfuse Volume 0 (gocryptfs)".
 	if runtime.GOOS == "darwin" {
-		volname := strings.Replace(path.Base(args.mountpoint), ",", "_", -1)
+		volname := path.Base(args.mountpoint)
+		if args.volname != "" {
+			volname = args.volname
+		}
+		volname = strings.Replace(volname, ",", "_", -1)
 		mOpts.Options = append(mOpts.Options, "volname="+volname)
+	} else if args.volname != "" {
+		// Linux has no volume names. File managers show the name of the
+		// mountpoint.
+		tlog.Info.Printf("-volname is only supported on MacOS, ignoring it")
 	}
 	// The kernel enforces read-only operation, we just have to pass "ro".
 	// Reverse mounts are always read-only.
@@ -432,13 +922,44 @@ func initGoFuse(rootNode fs.InodeEmbedder, args *argContainer) *fuse.Server {
 		tlog.Debug.Printf("Adding -ko mount options: %v", parts)
 		mOpts.Options = append(mOpts.Options, parts...)
 	}
-	srv, err := fs.Mount(args.mountpoint, rootNode, fuseOpts)
+	// Forward flock and POSIX locks to CIPHERDIR. The implementation needs
+	// open file description locks, which only Linux has. Reverse mounts are
+	// read-only and let the kernel handle locking locally.
+	locks := runtime.GOOS == "linux" && !args.reverse
+	mOpts.EnableLocks = locks
+	// Like fs.Mount(), but with the allowRootFS wrapper for -allow_root
+	var rawFS fuse.RawFileSystem = fs.NewNodeFS(rootNode, fuseOpts)
+	if locks {
+		rawFS = newPosixLocksFS(rawFS)
+	}
+	rawFS = newLockFS(rawFS, args._keyLock, uint32(os.Getuid()))
+	if args._threads != nil {
+		rawFS = newThreadsFS(rawFS, args._threads)
+	}
+	if args.allow_root {
+		rawFS = newAllowRootFS(rawFS, uint32(os.Getuid()))
+	}
+	if args._fuseTracer != nil {
+		rawFS = newTraceFS(rawFS, args._fuseTracer)
+	}
+	// The kernel caches plaintext: file contents, attributes and names
+	args._keyLock.OnLock(func() {
+		dropKernelCaches(rootNode.EmbeddedInode())
+	})
+	srv, err := fuse.NewServer(rawFS, args.mountpoint, &fuseOpts.MountOptions)
+	if err == nil {
+		if args.metrics != "" {
+			srv.RecordLatencies(metrics.FuseLatency)
+		}
+		go srv.Serve()
+		err = srv.WaitMount()
+	}
 	if err != nil {
 		tlog.Fatal.Printf("fs.Mount failed: %s", strings.TrimSpace(err.Error()))
 		if runtime.GOOS == "darwin" {
-			tlog.Info.Printf("Maybe you should run: /Library/Filesystems/osxfuse.fs/Contents/Resources/load_osxfuse")
+			tlog.Info.Println(macosFuseHint())
 		}
-		os.Exit(exitcodes.FuseNewServer)
+		return nil, err
 	}
 
 	// All FUSE file and directory create calls carry explicit permission
@@ -446,7 +967,7 @@ func initGoFuse(rootNode fs.InodeEmbedder, args *argContainer) *fuse.Server {
 	// directories with the requested permissions.
 	syscall.Umask(0000)
 
-	return srv
+	return srv, nil
 }
 
 // haveFusermount2 finds out if the "fusermount" binary is from libfuse 2.x.
@@ -472,17 +993,94 @@ func haveFusermount2() bool {
 	return false
 }
 
-func handleSigint(srv *fuse.Server, mountpoint string) {
+func handleSigint(unmountAll func()) {
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, os.Interrupt)
 	signal.Notify(ch, syscall.SIGTERM)
 	go func() {
 		<-ch
-		unmount(srv, mountpoint)
+		unmountAll()
 		os.Exit(exitcodes.SigInt)
 	}()
 }
 
+// macosFuseHint looks at which FUSE implementation is installed on MacOS and
+// returns a hint about what to do when mounting failed.
+func macosFuseHint() string {
+	exists := func(p string) bool {
+		_, err := os.Stat(p)
+		return err == nil
+	}
+	const osxfuse = "/Library/Filesystems/osxfuse.fs"
+	const macfuse = "/Library/Filesystems/macfuse.fs"
+	switch {
+	case exists(osxfuse):
+		return "Maybe you should run: " + osxfuse + "/Contents/Resources/load_osxfuse"
+	case exists(macfuse):
+		return "macFUSE 4 is installed, but gocryptfs needs its osxfuse 3 compatible mount helper, " +
+			"which macFUSE 4 does not ship. Install osxfuse 3 or macFUSE 3."
+	case exists("/usr/local/lib/libfuse-t.dylib"):
+		return "FUSE-T is installed, but gocryptfs does not support it yet. Install osxfuse 3 or macFUSE 3."
+	}
+	return "No FUSE implementation found. Install osxfuse 3 or macFUSE 3 from https://osxfuse.github.io/"
+}
+
+// defaultReadahead is the readahead the Linux kernel uses for new FUSE mounts
+const defaultReadahead = 128 * 1024
+
+// raiseReadahead sets the kernel readahead of the FUSE mount at "mountpoint"
+// to "bytes" through sysfs, for "-max_readahead" values above the default.
+// Needs root.
+func raiseReadahead(mountpoint string, bytes int) error {
+	var st syscall.Stat_t
+	if err := syscall.Stat(mountpoint, &st); err != nil {
+		return err
+	}
+	dev := uint64(st.Dev)
+	bdi := fmt.Sprintf("/sys/class/bdi/%d:%d/read_ahead_kb", unix.Major(dev), unix.Minor(dev))
+	return ioutil.WriteFile(bdi, []byte(fmt.Sprintf("%d", bytes/1024)), 0)
+}
+
+// checkServing verifies that "mountpoint" is a mounted filesystem that
+// answers requests, by comparing its device number with that of the
+// directory it is mounted on.
+func checkServing(mountpoint string) error {
+	var st, parent syscall.Stat_t
+	if err := syscall.Stat(mountpoint, &st); err != nil {
+		return fmt.Errorf("stat %q: %v", mountpoint, err)
+	}
+	if err := syscall.Stat(filepath.Join(mountpoint, ".."), &parent); err != nil {
+		return fmt.Errorf("stat parent of %q: %v", mountpoint, err)
+	}
+	if st.Dev == parent.Dev {
+		return fmt.Errorf("%q is not a mountpoint", mountpoint)
+	}
+	return nil
+}
+
+// notifyFd writes notifyMsg to "fd" and closes it. Our parent, see
+// forkChild(), waits for it and then exits with success.
+func notifyFd(fd int) {
+	f := os.NewFile(uintptr(fd), "notifyfd")
+	if _, err := f.WriteString(notifyMsg); err != nil {
+		tlog.Warn.Printf("notifyFd: %v", err)
+	}
+	f.Close()
+}
+
+// dropKernelCaches makes the kernel forget the file contents, attributes
+// and directory entries it caches for the inodes below "n", for "-lock".
+// Errors are ignored, they mean that the kernel has forgotten the inode
+// already.
+func dropKernelCaches(n *fs.Inode) {
+	for name, child := range n.Children() {
+		dropKernelCaches(child)
+		n.NotifyEntry(name)
+	}
+	// A length of zero means up to the end of the file
+	n.NotifyContent(0, 0)
+}
+
 func unmount(srv *fuse.Server, mountpoint string) {
 	err := srv.Unmount()
 	if err != nil {
@@ -497,3 +1095,20 @@ func unmount(srv *fuse.Server, mountpoint string) {
 		}
 	}
 }
+
+// openAuditLog opens the "-audit" log. If "keyFile" is set, the entries are
+// HMAC-chained with the key read from it.
+func openAuditLog(path string, keyFile string) (*audit.Log, error) {
+	var key []byte
+	if keyFile != "" {
+		var err error
+		key, err = ioutil.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		if len(key) < 16 {
+			return nil, fmt.Errorf("key file %q is shorter than 16 bytes", keyFile)
+		}
+	}
+	return audit.Open(path, key)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Support for being called by mount(8) as a mount helper, so that gocryptfs
+// filesystems can be declared in /etc/fstab with type "fuse.gocryptfs":
+//
+//	/tmp/cipher /tmp/plain fuse.gocryptfs nofail,passfile=/tmp/password 0 0
+//
+// mount(8) then runs "/sbin/mount.fuse.gocryptfs", which should be a
+// symlink to gocryptfs, like this:
+//
+//	mount.fuse.gocryptfs CIPHERDIR MOUNTPOINT [-sfnv] [-o OPTIONS] [-t TYPE]
+//
+// If the symlink does not exist, mount(8) falls back to "mount.fuse" from
+// the fuse package, which runs "gocryptfs CIPHERDIR MOUNTPOINT -o OPTIONS".
+
+// isMountHelper returns true if we have been called as a mount helper, by a
+// name like "mount.gocryptfs" or "mount.fuse.gocryptfs".
+func isMountHelper(arg0 string) bool {
+	return strings.HasPrefix(filepath.Base(arg0), "mount.")
+}
+
+// mountHelperArgs translates the mount helper command line "osArgs" into the
+// gocryptfs command line. "fake" is set if "-f" was passed, which means that
+// everything should be done except for the actual mount. We then just check
+// the arguments.
+// Testcases in TestMountHelperArgs().
+func mountHelperArgs(osArgs []string) (newArgs []string, fake bool, err error) {
+	var positional, opts []string
+	for i := 1; i < len(osArgs); i++ {
+		a := osArgs[i]
+		switch a {
+		case "-o":
+			if i+1 >= len(osArgs) {
+				return nil, false, fmt.Errorf("The \"-o\" option requires an argument")
+			}
+			opts = append(opts, osArgs[i+1])
+			i++
+		case "-t":
+			// The filesystem type, "fuse.gocryptfs". We know that.
+			i++
+		case "-f":
+			fake = true
+		case "-s", "-n", "-v":
+			// Sloppy mode, "do not write /etc/mtab" and verbose mode.
+			// Nothing to do for us.
+		default:
+			if strings.HasPrefix(a, "-") {
+				return nil, false, fmt.Errorf("mount helper: unsupported option %q", a)
+			}
+			positional = append(positional, a)
+		}
+	}
+	if len(positional) != 2 {
+		return nil, false, fmt.Errorf("mount helper: need CIPHERDIR and MOUNTPOINT, got %q", positional)
+	}
+	newArgs = []string{osArgs[0]}
+	newArgs = append(newArgs, positional...)
+	if len(opts) > 0 {
+		newArgs = append(newArgs, "-o", strings.Join(opts, ","))
+	}
+	return newArgs, fake, nil
+}
+
+// isFstabOnlyOpt returns true for options in /etc/fstab that are meant for
+// mount(8) or systemd. mount(8) passes some of them on to the mount helper,
+// and we ignore them.
+func isFstabOnlyOpt(o string) bool {
+	switch o {
+	case "defaults", "auto", "noauto", "user", "nouser", "users", "owner", "group", "_netdev":
+		return true
+	}
+	return strings.HasPrefix(o, "x-") || strings.HasPrefix(o, "comment=")
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// posixLocksFS releases the POSIX locks of a process when it closes the file,
+// like the kernel does on local filesystems. Only the FLUSH request tells us
+// the lock owner, and go-fuse does not pass it on to the filesystem, so we
+// turn FLUSH into an unlock of the whole file here. libfuse does the same.
+type posixLocksFS struct {
+	fuse.RawFileSystem
+}
+
+func newPosixLocksFS(raw fuse.RawFileSystem) *posixLocksFS {
+	return &posixLocksFS{RawFileSystem: raw}
+}
+
+func (f *posixLocksFS) Flush(cancel <-chan struct{}, input *fuse.FlushIn) fuse.Status {
+	unlock := fuse.LkIn{
+		InHeader: input.InHeader,
+		Fh:       input.Fh,
+		Owner:    input.LockOwner,
+		Lk: fuse.FileLock{
+			Start: 0,
+			End:   (1 << 63) - 1,
+			Typ:   syscall.F_UNLCK,
+		},
+	}
+	f.RawFileSystem.SetLk(cancel, &unlock)
+	return f.RawFileSystem.Flush(cancel, input)
+}
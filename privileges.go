@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// lookupUser returns the uid, the primary gid and the supplementary groups
+// of "name", which can be a user name or a numeric uid.
+func lookupUser(name string) (uid int, gid int, groups []int, err error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		u, err = user.LookupId(name)
+		if err != nil {
+			return 0, 0, nil, fmt.Errorf("unknown user %q", name)
+		}
+	}
+	uid, err = strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	gid, err = strconv.Atoi(u.Gid)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	ids, err := u.GroupIds()
+	if err != nil {
+		// Not fatal, the user then only has the primary group
+		tlog.Warn.Printf("setuid: looking up the groups of %q failed: %v", name, err)
+		ids = []string{u.Gid}
+	}
+	for _, id := range ids {
+		g, err := strconv.Atoi(id)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		groups = append(groups, g)
+	}
+	return uid, gid, groups, nil
+}
+
+// dropPrivileges switches the whole process to user "name", for "-setuid".
+// "ctlsock" is the path of the control socket, if any, which is handed over
+// to the user.
+func dropPrivileges(name string, ctlsock string) error {
+	if os.Getuid() != 0 {
+		return fmt.Errorf("only root can switch to another user")
+	}
+	uid, gid, groups, err := lookupUser(name)
+	if err != nil {
+		return err
+	}
+	if ctlsock != "" {
+		if err = os.Chown(ctlsock, uid, gid); err != nil {
+			return err
+		}
+	}
+	// On Linux, Go applies these to all threads of the process
+	if err = syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("setgroups: %v", err)
+	}
+	if err = syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setgid: %v", err)
+	}
+	if err = syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setuid: %v", err)
+	}
+	tlog.Debug.Printf("setuid: now running as uid=%d gid=%d groups=%v", uid, gid, groups)
+	return nil
+}
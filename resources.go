@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// disableCoreDumps sets the core file size limit to zero, so that a crash
+// does not write the keys and passwords in our memory to disk. The keys in
+// package secmem are excluded from core dumps anyway, but the AES key
+// schedules of the Go standard library and the passwords are not.
+// GOTRACEBACK=crash asks for a core dump, so we leave the limit alone then.
+func disableCoreDumps() {
+	if os.Getenv("GOTRACEBACK") == "crash" {
+		return
+	}
+	var lim syscall.Rlimit
+	err := syscall.Getrlimit(syscall.RLIMIT_CORE, &lim)
+	if err == nil && lim.Cur != 0 {
+		// The hard limit stays, programs we start can raise it again
+		lim.Cur = 0
+		err = syscall.Setrlimit(syscall.RLIMIT_CORE, &lim)
+	}
+	if err != nil {
+		tlog.Debug.Printf("disableCoreDumps: %v", err)
+	}
+}
+
+// limitResources handles "-cgroup" and "-nice". Both settings are inherited
+// by all threads we create later, so this should run as early as possible.
+func limitResources(args *argContainer) {
+	if args.cgroup != "" {
+		// Writing our pid to "cgroup.procs" moves all our threads into the
+		// cgroup. CPU and IO weights are configured on the cgroup by the
+		// administrator.
+		procs := filepath.Join(args.cgroup, "cgroup.procs")
+		err := ioutil.WriteFile(procs, []byte(strconv.Itoa(os.Getpid())), 0)
+		if err != nil {
+			tlog.Fatal.Printf("-cgroup: could not join cgroup: %v", err)
+			os.Exit(exitcodes.Other)
+		}
+		tlog.Debug.Printf("limitResources: joined cgroup %q", args.cgroup)
+	}
+	if args.nice != 0 {
+		// The Linux CFQ and BFQ IO schedulers derive the IO priority from the
+		// nice value unless an explicit IO priority is set, so this lowers
+		// the IO weight as well.
+		err := syscallcompat.Setpriority(args.nice)
+		if err != nil {
+			tlog.Fatal.Printf("-nice: could not set priority: %v", err)
+			os.Exit(exitcodes.Other)
+		}
+		tlog.Debug.Printf("limitResources: nice value set to %d", args.nice)
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"net"
+	"os"
+
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// sdNotify sends "state" to the service manager, like sd_notify(3) does, if
+// we have been started by systemd as a "Type=notify" service. Otherwise,
+// NOTIFY_SOCKET is not set, and it does nothing.
+//
+// Example states are "READY=1" and "STOPPING=1".
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	// Abstract sockets have a leading "@", which Go understands as well
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		tlog.Warn.Printf("sdNotify: %v", err)
+		return
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	if err != nil {
+		tlog.Warn.Printf("sdNotify: %v", err)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// handleSignals handles the signals that control a running mount:
+//
+// SIGUSR1 drops our caches of CIPHERDIR, which is useful after it has been
+// modified behind our back.
+//
+// SIGHUP toggles the debug output, using the categories passed to "-d", or
+// all categories if "-d" was not passed.
+func handleSignals(args *argContainer, roots []fs.InodeEmbedder, servers []*fuse.Server) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGUSR1, syscall.SIGHUP)
+	go func() {
+		for sig := range ch {
+			switch sig {
+			case syscall.SIGUSR1:
+				for _, r := range roots {
+					// Reverse mode does not cache anything that could go stale
+					if rn, ok := r.(*fusefrontend.RootNode); ok {
+						rn.DropCaches()
+					}
+				}
+				tlog.Info.Printf("SIGUSR1: caches dropped")
+			case syscall.SIGHUP:
+				if tlog.DebugEnabled() {
+					tlog.DisableDebug()
+				} else {
+					// Validated in main() already
+					tlog.EnableDebug(args.debug.categories)
+				}
+				for _, srv := range servers {
+					srv.SetDebug(args.fusedebug || tlog.DebugFuse)
+				}
+				tlog.Info.Printf("SIGHUP: debug output enabled=%v", tlog.DebugEnabled())
+			}
+		}
+	}()
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// Snapshots, "-snapshot create|list|delete". A snapshot is a copy of
+// CIPHERDIR, including the config file, in
+// "CIPHERDIR/gocryptfs.snapshots/NAME". It is a complete CIPHERDIR by
+// itself and can be mounted with "-mount-snapshot NAME".
+//
+// Files are reflinked where the filesystem supports it, so a snapshot takes
+// no space until the files change. Elsewhere, they are copied. We cannot use
+// hard links, because gocryptfs writes into files in place, and the change
+// would show up in the snapshot.
+
+// snapshotStats counts what snapshotCreate has done
+type snapshotStats struct {
+	entries   int
+	reflinked int
+	copied    int
+}
+
+// snapshotPath returns the path of snapshot "name" of "cipherdir"
+func snapshotPath(cipherdir string, name string) (string, error) {
+	if name == "" || name == "." || name == ".." || filepath.Base(name) != name || name[0] == '.' {
+		return "", fmt.Errorf("invalid snapshot name %q", name)
+	}
+	return filepath.Join(cipherdir, fusefrontend.SnapshotDirName, name), nil
+}
+
+// snapshot creates, lists or deletes the snapshots of CIPHERDIR. This is
+// called when you pass the "-snapshot" option. "names" are the arguments
+// given after CIPHERDIR.
+func snapshot(args *argContainer, names []string) (exitcode int) {
+	if args.reverse {
+		tlog.Fatal.Printf("-snapshot only works in forward mode")
+		return exitcodes.Usage
+	}
+	if args.snapshot == "list" {
+		entries, err := ioutil.ReadDir(filepath.Join(args.cipherdir, fusefrontend.SnapshotDirName))
+		if err != nil && !os.IsNotExist(err) {
+			tlog.Fatal.Printf("-snapshot: %v", err)
+			return exitcodes.Snapshot
+		}
+		for _, e := range entries {
+			if e.IsDir() && e.Name()[0] != '.' {
+				fmt.Printf("%s  %s\n", e.Name(), e.ModTime().Format("2006-01-02 15:04:05"))
+			}
+		}
+		return 0
+	}
+	if len(names) != 1 {
+		tlog.Fatal.Printf("Usage: %s -snapshot %s CIPHERDIR NAME", tlog.ProgramName, args.snapshot)
+		return exitcodes.Usage
+	}
+	dst, err := snapshotPath(args.cipherdir, names[0])
+	if err != nil {
+		tlog.Fatal.Printf("-snapshot: %v", err)
+		return exitcodes.Usage
+	}
+	if args.snapshot == "delete" {
+		if _, err = os.Lstat(dst); err != nil {
+			tlog.Fatal.Printf("-snapshot: %v", err)
+			return exitcodes.Snapshot
+		}
+		if err = snapshotRemove(dst); err != nil {
+			tlog.Fatal.Printf("-snapshot: %v", err)
+			return exitcodes.Snapshot
+		}
+		tlog.Info.Printf("Deleted snapshot %q", names[0])
+		return 0
+	}
+	// A mounted filesystem may change files while we copy them
+	if m, err := findMount(args.cipherdir); err == nil {
+		tlog.Fatal.Printf("-snapshot: %q is mounted at %q. Unmount it first.",
+			args.cipherdir, m.mountpoint)
+		return exitcodes.Snapshot
+	}
+	if _, err = os.Lstat(dst); err == nil {
+		tlog.Fatal.Printf("-snapshot: snapshot %q exists already", names[0])
+		return exitcodes.Snapshot
+	}
+	if err = os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		tlog.Fatal.Printf("-snapshot: %v", err)
+		return exitcodes.Snapshot
+	}
+	// Incomplete snapshots are hidden from "-snapshot list" and cannot be
+	// mounted
+	tmp := filepath.Join(filepath.Dir(dst), "."+names[0]+".incomplete")
+	snapshotRemove(tmp)
+	var stats snapshotStats
+	err = snapshotCreate(args.cipherdir, tmp, &stats)
+	if err == nil {
+		err = syscall.Rename(tmp, dst)
+	}
+	if err != nil {
+		tlog.Fatal.Printf("-snapshot: %v", err)
+		snapshotRemove(tmp)
+		return exitcodes.Snapshot
+	}
+	tlog.Info.Printf(tlog.ColorGreen+"Created snapshot %q: %d files and directories, %d files reflinked, %d copied"+
+		tlog.ColorReset, names[0], stats.entries, stats.reflinked, stats.copied)
+	return 0
+}
+
+// snapshotCreate copies "cipherdir" to the new directory "dst", except for
+// the snapshots and the trash.
+func snapshotCreate(cipherdir string, dst string, stats *snapshotStats) error {
+	// Paths of hard-linked files that we have already copied, by inode number
+	links := make(map[uint64]string)
+	// Metadata of directories is set at the end, see importTar
+	var dirs []*tar.Header
+	err := filepath.Walk(cipherdir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(cipherdir, path)
+		if err != nil {
+			return err
+		}
+		to := filepath.Join(dst, name)
+		if name == fusefrontend.SnapshotDirName || name == fusefrontend.TrashDirName {
+			return filepath.SkipDir
+		}
+		if fi.Mode()&os.ModeSocket != 0 {
+			tlog.Warn.Printf("-snapshot: skipping socket %q", name)
+			return nil
+		}
+		hdr, err := exportHeader(path, name, fi)
+		if err != nil {
+			return err
+		}
+		if name != "." {
+			stats.entries++
+		}
+		st := fi.Sys().(*syscall.Stat_t)
+		if fi.Mode().IsRegular() && st.Nlink > 1 {
+			if first, ok := links[uint64(st.Ino)]; ok {
+				return os.Link(first, to)
+			}
+			links[uint64(st.Ino)] = to
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			hdr.Name = name
+			dirs = append(dirs, hdr)
+			return os.Mkdir(to, 0700)
+		case tar.TypeReg:
+			err = snapshotFile(path, to, stats)
+		case tar.TypeSymlink:
+			err = os.Symlink(hdr.Linkname, to)
+		default:
+			err = syscall.Mknod(to, uint32(st.Mode), int(st.Rdev))
+		}
+		if err != nil {
+			return fmt.Errorf("%q: %v", name, err)
+		}
+		return importMeta(to, hdr)
+	})
+	if err != nil {
+		return err
+	}
+	// Innermost first
+	sort.Slice(dirs, func(i, j int) bool { return dirs[i].Name > dirs[j].Name })
+	for _, hdr := range dirs {
+		if err := importMeta(filepath.Join(dst, hdr.Name), hdr); err != nil {
+			return fmt.Errorf("%q: %v", hdr.Name, err)
+		}
+	}
+	return nil
+}
+
+// snapshotFile reflinks or copies the file "src" to the new file "dst"
+func snapshotFile(src string, dst string, stats *snapshotStats) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if syscallcompat.Reflink(int(out.Fd()), int(in.Fd())) == nil {
+		stats.reflinked++
+	} else {
+		stats.copied++
+		_, err = io.Copy(out, in)
+	}
+	if err2 := out.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// snapshotRemove deletes the snapshot directory "dir". Directories in the
+// snapshot may have been read-only in CIPHERDIR.
+func snapshotRemove(dir string) error {
+	filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && fi.IsDir() {
+			os.Chmod(path, 0700)
+		}
+		return nil
+	})
+	return os.RemoveAll(dir)
+}
@@ -3,18 +3,34 @@ package cli
 // Test CLI operations like "-init", "-password" etc
 
 import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"testing"
 	"time"
 
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/ctlsock"
+	"github.com/rfjakob/gocryptfs/internal/audit"
 	"github.com/rfjakob/gocryptfs/internal/configfile"
 	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
 
 	"github.com/rfjakob/gocryptfs/tests/test_helpers"
 )
@@ -323,6 +339,100 @@ func TestInitConfig(t *testing.T) {
 	}
 }
 
+// Test -info -json
+func TestInfoJSON(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-aessiv")
+	out, err := exec.Command(test_helpers.GocryptfsBinary, "-info", "-json", dir).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var info struct {
+		Version      uint16
+		Cipher       string
+		FeatureFlags []string
+		KDF          string
+		Created      time.Time
+		KeySlots     int
+	}
+	err = json.Unmarshal(out, &info)
+	if err != nil {
+		t.Fatalf("%v: %q", err, string(out))
+	}
+	if info.Version != 2 {
+		t.Errorf("wrong version %d", info.Version)
+	}
+	if !strings.HasPrefix(info.Cipher, "AES-SIV") {
+		t.Errorf("wrong cipher %q", info.Cipher)
+	}
+	if info.KDF != "scrypt" {
+		t.Errorf("wrong KDF %q", info.KDF)
+	}
+	if info.KeySlots != 1 {
+		t.Errorf("wrong number of key slots %d", info.KeySlots)
+	}
+	if time.Since(info.Created) > time.Hour {
+		t.Errorf("implausible creation time %v", info.Created)
+	}
+}
+
+// Test -init -longnamemax
+func TestLongnamemax(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-longnamemax=100")
+	_, c, err := configfile.LoadAndDecrypt(dir+"/"+configfile.ConfDefaultName, testPw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(configfile.FlagLongNameMax) || c.LongNameMax != 100 {
+		t.Fatalf("LongNameMax not stored correctly: %d", c.LongNameMax)
+	}
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	// A 70-byte name encrypts to 107 base64 characters and must be hashed.
+	// A 40-byte name encrypts to 64 characters and must not.
+	for _, n := range []string{strings.Repeat("x", 70), strings.Repeat("y", 40)} {
+		err = ioutil.WriteFile(mnt+"/"+n, nil, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var longnames, short int
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), "gocryptfs.") {
+			if strings.HasPrefix(e.Name(), "gocryptfs.longname.") && !strings.HasSuffix(e.Name(), ".name") {
+				longnames++
+			}
+			continue
+		}
+		short++
+		if len(e.Name()) > 100 {
+			t.Errorf("name longer than 100 bytes: %q", e.Name())
+		}
+	}
+	if longnames != 1 || short != 1 {
+		t.Errorf("want one long and one short name, have %d and %d", longnames, short)
+	}
+	// Invalid values must be rejected
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-init", "-extpass", "echo test", "-longnamemax=20", dir+".2")
+	err = cmd.Run()
+	if test_helpers.ExtractCmdExitCode(err) != exitcodes.Usage {
+		t.Errorf("-longnamemax=20 should have failed with a usage error, got %v", err)
+	}
+	// Mounting with a different value would make the long names unreadable
+	if err = os.Mkdir(mnt+".2", 0700); err != nil {
+		t.Fatal(err)
+	}
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-extpass", "echo test", "-longnamemax=255", dir, mnt+".2")
+	err = cmd.Run()
+	if test_helpers.ExtractCmdExitCode(err) != exitcodes.Usage {
+		t.Errorf("mounting with -longnamemax=255 should have failed with a usage error, got %v", err)
+	}
+}
+
 // Test -ro
 func TestRo(t *testing.T) {
 	dir := test_helpers.InitFS(t)
@@ -362,461 +472,3071 @@ func TestNonempty(t *testing.T) {
 	test_helpers.UnmountPanic(mnt)
 }
 
-// -nofail should be ignored and the mount should succeed
-func TestNofail(t *testing.T) {
+// Test -destroy
+func TestDestroy(t *testing.T) {
 	dir := test_helpers.InitFS(t)
-	mnt := dir + ".mnt"
-	test_helpers.MountOrFatal(t, dir, mnt, "-nofail", "-extpass=echo test")
-	defer test_helpers.UnmountPanic(mnt)
+	conf := dir + "/" + configfile.ConfDefaultName
+	// Wrong confirmation must not destroy anything
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-destroy", dir)
+	cmd.Stdin = strings.NewReader("yes\n")
+	err := cmd.Run()
+	if exitcodes.Usage != test_helpers.ExtractCmdExitCode(err) {
+		t.Errorf("wrong exit code: %v", err)
+	}
+	if _, err = os.Stat(conf); err != nil {
+		t.Fatal(err)
+	}
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-q", "-destroy", dir)
+	cmd.Stdin = strings.NewReader("DESTROY\n")
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(conf); !os.IsNotExist(err) {
+		t.Errorf("config file should be gone, stat returned %v", err)
+	}
 }
 
-// Test "mountpoint shadows cipherdir" handling
-func TestShadows(t *testing.T) {
-	mnt := test_helpers.InitFS(t)
-	cipher := mnt + ".cipher"
-	err := os.Rename(mnt, cipher)
-	if err != nil {
+// Test that -destroy also wipes the config files of the subtrees of -dirkey
+func TestDestroySubtree(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	if err := os.Mkdir(mnt+"/sub", 0700); err != nil {
 		t.Fatal(err)
 	}
-	// This should work
-	// (note that MountOrFatal creates "mnt" again)
-	test_helpers.MountOrFatal(t, cipher, mnt, "-extpass=echo test")
 	test_helpers.UnmountPanic(mnt)
-	cipher2 := mnt + "/cipher"
-	err = os.Rename(cipher, cipher2)
-	if err != nil {
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-dirkey", "add", "-scryptn=10", dir, "sub")
+	cmd.Stdin = strings.NewReader("test\nsub\n")
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
 		t.Fatal(err)
 	}
-	// This should fail
-	err = test_helpers.Mount(cipher2, mnt, false, "-extpass=echo test")
-	if err == nil {
-		t.Errorf("Should have failed")
+	confs, err := filepath.Glob(dir + "/*/" + configfile.ConfDefaultName)
+	if err != nil || len(confs) != 1 {
+		t.Fatalf("want one subtree config, have %v %v", confs, err)
+	}
+	cSub := filepath.Dir(confs[0])
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-q", "-destroy", dir)
+	cmd.Stdin = strings.NewReader("DESTROY\n")
+	cmd.Stderr = os.Stderr
+	if err = cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(confs[0]); !os.IsNotExist(err) {
+		t.Errorf("subtree config file should be gone, stat returned %v", err)
+	}
+	mnt2 := dir + ".sub"
+	if err = test_helpers.Mount(cSub, mnt2, false, "-extpass=echo sub"); err == nil {
+		test_helpers.UnmountPanic(mnt2)
+		t.Error("the subtree can still be mounted")
 	}
 }
 
-// TestMountPasswordIncorrect makes sure the correct exit code is used when the password
-// was incorrect while mounting
-func TestMountPasswordIncorrect(t *testing.T) {
-	cDir := test_helpers.InitFS(t) // Create filesystem with password "test"
-	pDir := cDir + ".mnt"
-	err := test_helpers.Mount(cDir, pDir, false, "-extpass", "echo WRONG", "-wpanic=false")
-	exitCode := test_helpers.ExtractCmdExitCode(err)
-	if exitCode != exitcodes.PasswordIncorrect {
-		t.Errorf("want=%d, got=%d", exitcodes.PasswordIncorrect, exitCode)
+// Test that -destroy refuses to wipe a file that is not a gocryptfs config
+func TestDestroyNotConfig(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	notConf := dir + ".txt"
+	content := []byte("not a config file\n")
+	if err := ioutil.WriteFile(notConf, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-destroy", "-config", notConf, dir)
+	cmd.Stdin = strings.NewReader("DESTROY\n")
+	err := cmd.Run()
+	if exitcodes.LoadConf != test_helpers.ExtractCmdExitCode(err) {
+		t.Errorf("wrong exit code: %v", err)
+	}
+	have, err := ioutil.ReadFile(notConf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(have, content) {
+		t.Errorf("file has been overwritten: %q", have)
 	}
 }
 
-// TestPasswdPasswordIncorrect makes sure the correct exit code is used when the password
-// was incorrect while changing the password
-func TestPasswdPasswordIncorrect(t *testing.T) {
-	cDir := test_helpers.InitFS(t) // Create filesystem with password "test"
-	// Change password
-	cmd := exec.Command(test_helpers.GocryptfsBinary, "-passwd", cDir)
-	childStdin, err := cmd.StdinPipe()
+// Test -unlink-wipe
+func TestUnlinkWipe(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-plaintextnames")
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-unlink-wipe", "-extpass=echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	err := ioutil.WriteFile(mnt+"/foo", []byte("hello world"), 0600)
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = cmd.Start()
+	// With -plaintextnames, the ciphertext file has the same name
+	f, err := os.Open(dir + "/foo")
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, err = childStdin.Write([]byte("WRONGPASSWORD\nNewPassword"))
+	defer f.Close()
+	before, err := ioutil.ReadAll(f)
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = childStdin.Close()
+	err = os.Remove(mnt + "/foo")
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = cmd.Wait()
-	exitCode := test_helpers.ExtractCmdExitCode(err)
-	if exitCode != exitcodes.PasswordIncorrect {
-		t.Errorf("want=%d, got=%d", exitcodes.PasswordIncorrect, exitCode)
+	// The release of the WriteFile above is asynchronous. If it arrives after
+	// the unlink, the wipe waits for it.
+	after := make([]byte, len(before))
+	for i := 0; i < 20; i++ {
+		if _, err = f.ReadAt(after, 0); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(before, after) {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
 	}
+	t.Error("ciphertext has not been overwritten")
 }
 
-// Check that we correctly background on mount and close stderr and stdout.
-// Something like
-//   gocryptfs a b | cat
-// must not hang ( https://github.com/rfjakob/gocryptfs/issues/130 ).
-func TestMountBackground(t *testing.T) {
-	dir := test_helpers.InitFS(t)
+// Test that -unlink-wipe waits until a file that is still open is closed
+func TestUnlinkWipeOpen(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-plaintextnames")
 	mnt := dir + ".mnt"
-	err := os.Mkdir(mnt, 0700)
+	test_helpers.MountOrFatal(t, dir, mnt, "-unlink-wipe", "-extpass=echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	content := []byte("hello world")
+	err := ioutil.WriteFile(mnt+"/foo", content, 0600)
 	if err != nil {
 		t.Fatal(err)
 	}
-	// Manually create a pipe pair and connect the child's stdout and stderr
-	// to it. We cannot use StdoutPipe because that will close the pipe
-	// when the child forks away.
-	pr, pw, err := os.Pipe()
+	pf, err := os.Open(mnt + "/foo")
 	if err != nil {
 		t.Fatal(err)
 	}
-	args := []string{"-extpass", "echo test", dir, mnt}
-	cmd := exec.Command(test_helpers.GocryptfsBinary, args...)
-	cmd.Stdout = pw
-	cmd.Stderr = pw
-	err = cmd.Run()
+	defer pf.Close()
+	f, err := os.Open(dir + "/foo")
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
-	pw.Close()
-	defer test_helpers.UnmountPanic(mnt)
-	// Read until we get EOF.
-	c1 := make(chan struct{}, 1)
-	go func() {
-		buf := make([]byte, 1000)
-		for {
-			_, err = pr.Read(buf)
-			// We should get io.EOF when the child closes stdout
-			// and stderr.
-			if err != nil {
-				pr.Close()
-				c1 <- struct{}{}
-				return
-			}
-		}
-	}()
-	select {
-	case <-c1:
-		return
-	case <-time.After(time.Second * 5):
-		t.Fatal("timeout")
+	defer f.Close()
+	before, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
 	}
-}
-
-// Test that "gocryptfs -init -info CIPHERDIR" returns an error to the
-// user. Only one operation flag is allowed.
-func TestMultipleOperationFlags(t *testing.T) {
-	// Test all combinations
-	opFlags := []string{"-init", "-info", "-passwd", "-fsck"}
-	for _, flag1 := range opFlags {
-		var flag2 string
-		for _, flag2 = range opFlags {
-			if flag1 == flag2 {
-				continue
-			}
-			args := []string{flag1, flag2, "/tmp"}
-			//t.Logf("testing %v", args)
-			cmd := exec.Command(test_helpers.GocryptfsBinary, args...)
-			err := cmd.Run()
-			exitCode := test_helpers.ExtractCmdExitCode(err)
-			if exitCode != exitcodes.Usage {
-				t.Fatalf("this should have failed with code %d, but returned %d",
-					exitcodes.Usage, exitCode)
-			}
+	if err = os.Remove(mnt + "/foo"); err != nil {
+		t.Fatal(err)
+	}
+	// The open file must still be readable
+	buf := make([]byte, len(content))
+	if _, err = pf.ReadAt(buf, 0); err != nil || !bytes.Equal(buf, content) {
+		t.Fatalf("reading the unlinked file: %q, %v", buf, err)
+	}
+	// The wipe happens after the release, which is asynchronous
+	pf.Close()
+	after := make([]byte, len(before))
+	for i := 0; i < 20; i++ {
+		if _, err = f.ReadAt(after, 0); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(before, after) {
+			return
 		}
+		time.Sleep(50 * time.Millisecond)
 	}
+	t.Error("ciphertext has not been overwritten after the close")
 }
 
-func TestNoexec(t *testing.T) {
-	dir := test_helpers.InitFS(t)
+// Test that "-passthrough" stores matching files and directories unencrypted
+func TestPassthrough(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-passthrough=*.iso", "-passthrough=.git/")
 	mnt := dir + ".mnt"
-	err := os.Mkdir(mnt, 0700)
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	content := []byte("hello world")
+	if err := ioutil.WriteFile(mnt+"/foo.iso", content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(mnt+"/.git/objects", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(mnt+"/.git/objects/bar", content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(mnt+"/secret", content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("target", mnt+"/.git/link"); err != nil {
+		t.Fatal(err)
+	}
+	// O_DIRECT must not impose alignment requirements on passthrough files
+	f, err := os.OpenFile(mnt+"/foo.iso", os.O_RDWR|syscallcompat.O_DIRECT, 0)
 	if err != nil {
 		t.Fatal(err)
 	}
-	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test", "-noexec")
+	if _, err = f.WriteAt(content[:5], 0); err != nil {
+		t.Errorf("unaligned O_DIRECT write: %v", err)
+	}
+	f.Close()
+	// Moving between encrypted and unencrypted storage is not possible
+	err = os.Rename(mnt+"/secret", mnt+"/.git/secret")
+	if err == nil || err.(*os.LinkError).Err != syscall.EXDEV {
+		t.Errorf("want EXDEV, got %v", err)
+	}
+	// Ciphertext side: the passthrough files are stored verbatim
+	for _, p := range []string{"/foo.iso", "/.git/objects/bar"} {
+		c, err := ioutil.ReadFile(dir + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(c, content) {
+			t.Errorf("%s: content is not stored verbatim: %q", p, c)
+		}
+	}
+	if target, err := os.Readlink(dir + "/.git/link"); err != nil || target != "target" {
+		t.Errorf("symlink target is not stored verbatim: %q, %v", target, err)
+	}
+	if _, err := os.Stat(dir + "/.git/" + nametransform.DirIVFilename); !os.IsNotExist(err) {
+		t.Errorf("passthrough directory should not have a diriv file: %v", err)
+	}
+	if _, err := os.Stat(dir + "/secret"); !os.IsNotExist(err) {
+		t.Errorf("\"secret\" should be encrypted: %v", err)
+	}
+	// The patterns come from the config file. Different ones are rejected.
+	test_helpers.UnmountPanic(mnt)
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-extpass", "echo test", "-passthrough=*.iso", dir, mnt)
+	if err = cmd.Run(); test_helpers.ExtractCmdExitCode(err) != exitcodes.Usage {
+		t.Errorf("mounting with different patterns should have failed with a usage error, got %v", err)
+	}
+	// Remount, in a different order, and check that the plaintext view is
+	// unchanged
+	test_helpers.MountOrFatal(t, dir, mnt, "-passthrough=.git", "-passthrough=*.iso", "-extpass=echo test")
+	test_helpers.UnmountPanic(mnt)
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
 	defer test_helpers.UnmountPanic(mnt)
-	sh := mnt + "/x.sh"
-	content := `#!/bin/bash
-echo hello
-`
-	err = ioutil.WriteFile(sh, []byte(content), 0755)
+	for _, p := range []string{"/foo.iso", "/.git/objects/bar", "/secret"} {
+		c, err := ioutil.ReadFile(mnt + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(c, content) {
+			t.Errorf("%s: wrong content %q", p, c)
+		}
+	}
+	names, err := ioutil.ReadDir(mnt)
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = exec.Command(sh).Run()
-	exitCode := test_helpers.ExtractCmdExitCode(err)
-	if exitCode != int(syscall.EACCES) {
-		t.Errorf("got exitcode %d instead of EPERM (%d)", exitCode, syscall.EPERM)
+	if len(names) != 3 {
+		t.Errorf("want 3 entries, have %d: %v", len(names), names)
 	}
-}
-
-// Test that a missing argument to "-o" triggers exit code 1.
-// See also cli_args_test.go for comprehensive tests of "-o" parsing.
-func TestMissingOArg(t *testing.T) {
-	cmd := exec.Command(test_helpers.GocryptfsBinary, "foo", "bar", "-o")
-	err := cmd.Run()
-	exitCode := test_helpers.ExtractCmdExitCode(err)
-	if exitCode != exitcodes.Usage {
-		t.Fatalf("this should have failed with code %d, but returned %d",
-			exitcodes.Usage, exitCode)
+	if err := os.Truncate(mnt+"/foo.iso", 5); err != nil {
+		t.Fatal(err)
 	}
-}
-
-// -exclude must return an error in forward mode
-func TestExcludeForward(t *testing.T) {
-	dir := test_helpers.InitFS(t)
-	mnt := dir + ".mnt"
-	err := test_helpers.Mount(dir, mnt, false, "-extpass", "echo test", "-exclude", "foo")
-	if err == nil {
-		t.Errorf("-exclude in forward mode should fail")
+	if st, err := os.Stat(dir + "/foo.iso"); err != nil || st.Size() != 5 {
+		t.Errorf("truncate was not passed through: %v", err)
 	}
-	t.Log(err)
 }
 
-// Check that the config file can be read from a named pipe.
-// Make sure bug https://github.com/rfjakob/gocryptfs/issues/258 does not come
-// back.
-func TestConfigPipe(t *testing.T) {
+// Test that "-nice" applies to all threads of the gocryptfs process
+func TestNice(t *testing.T) {
 	dir := test_helpers.InitFS(t)
 	mnt := dir + ".mnt"
-	err := os.Mkdir(mnt, 0700)
+	test_helpers.MountOrFatal(t, dir, mnt, "-nice=7", "-extpass=echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	// Generate some load so that more threads get started
+	for i := 0; i < 10; i++ {
+		ioutil.WriteFile(fmt.Sprintf("%s/%d", mnt, i), []byte("x"), 0600)
+	}
+	taskDir := fmt.Sprintf("/proc/%d/task", test_helpers.MountInfo[mnt].Pid)
+	tasks, err := ioutil.ReadDir(taskDir)
 	if err != nil {
 		t.Fatal(err)
 	}
-	bashLine := fmt.Sprintf("%s -q -extpass \"echo test\" -config <(cat %s/gocryptfs.conf) %s %s", test_helpers.GocryptfsBinary, dir, dir, mnt)
-	cmd := exec.Command("bash", "-c", bashLine)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stdout
-	err = cmd.Run()
-	exitCode := test_helpers.ExtractCmdExitCode(err)
-	if exitCode != 0 {
-		t.Errorf("bash command\n%q\nresulted in exit code %d", bashLine, exitCode)
-		return
+	for _, task := range tasks {
+		stat, err := ioutil.ReadFile(taskDir + "/" + task.Name() + "/stat")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The nice value is field 19, the 17th field after the ")" that
+		// terminates the command name
+		fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+		if fields[16] != "7" {
+			t.Errorf("thread %s: nice value is %s, want 7", task.Name(), fields[16])
+		}
 	}
-	test_helpers.UnmountPanic(mnt)
 }
 
-// Ciphertext dir and mountpoint contains a comma
-// https://github.com/rfjakob/gocryptfs/issues/262
-func TestComma(t *testing.T) {
-	dir0 := test_helpers.InitFS(t)
-	dir := dir0 + ",foo,bar"
-	err := os.Rename(dir0, dir)
+// Test that "-init -deterministic-names" creates a filesystem without
+// gocryptfs.diriv files where equal names encrypt equally in all directories
+func TestDeterministicNames(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-deterministic-names")
+	_, c, err := configfile.LoadAndDecrypt(dir+"/"+configfile.ConfDefaultName, testPw)
 	if err != nil {
 		t.Fatal(err)
 	}
+	if !c.IsFeatureFlagSet(configfile.FlagDeterministicNames) || c.IsFeatureFlagSet(configfile.FlagDirIV) {
+		t.Errorf("wrong feature flags: %v", c.FeatureFlags)
+	}
 	mnt := dir + ".mnt"
-	err = test_helpers.Mount(dir, mnt, false, "-extpass", "echo test", "-wpanic=0")
-	if err != nil {
-		t.Fatalf("Failed to mount %q on %q: %v", dir, mnt, err)
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	if err = os.Mkdir(mnt+"/a", 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"/foo", "/a/foo"} {
+		if err = ioutil.WriteFile(mnt+p, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cNames := func(cDir string) (names []string) {
+		entries, err := ioutil.ReadDir(cDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			if e.Name() == nametransform.DirIVFilename {
+				t.Errorf("%s: unexpected %s file", cDir, e.Name())
+			}
+			names = append(names, e.Name())
+		}
+		return names
+	}
+	// Root dir contains gocryptfs.conf, "a" and "foo"
+	root := cNames(dir)
+	if len(root) != 3 {
+		t.Fatalf("unexpected root dir contents: %v", root)
+	}
+	var cA string
+	for _, n := range root {
+		if fi, err := os.Stat(dir + "/" + n); err == nil && fi.IsDir() {
+			cA = n
+		}
+	}
+	sub := cNames(dir + "/" + cA)
+	if len(sub) != 1 {
+		t.Fatalf("unexpected contents of %q: %v", cA, sub)
+	}
+	if sub[0] == cA || !test_helpers.VerifyExistence(t, dir+"/"+sub[0]) {
+		t.Errorf("\"foo\" should have the same encrypted name in both directories")
+	}
+	// Without gocryptfs.diriv, empty directories can be removed and
+	// overwritten like on any other filesystem
+	if err = os.Mkdir(mnt+"/b", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove(mnt + "/a/foo"); err != nil {
+		t.Fatal(err)
+	}
+	// os.Rename refuses to overwrite directories, use syscall.Rename
+	if err = syscall.Rename(mnt+"/b", mnt+"/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove(mnt + "/a"); err != nil {
+		t.Fatal(err)
 	}
-	test_helpers.UnmountPanic(mnt)
 }
 
-// Mount with idle timeout 10ms and check that the process exits by itself
-// within 5 seconds.
-func TestIdle(t *testing.T) {
+// Test that the read pipeline returns the same data as the serial read path
+func TestReadPipeline(t *testing.T) {
 	dir := test_helpers.InitFS(t)
 	mnt := dir + ".mnt"
-	err := os.Mkdir(mnt, 0700)
-	if err != nil {
-		t.Fatal(err)
+	content := make([]byte, 1000*1000)
+	for i := range content {
+		content[i] = byte(i * 7)
 	}
-	cmd := exec.Command(test_helpers.GocryptfsBinary,
-		"-q", "-nosyslog", "-fg", "-extpass", "echo test", "-i", "10ms", dir, mnt)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err = cmd.Start()
-	if err != nil {
+	test_helpers.MountOrFatal(t, dir, mnt, "-read-pipeline=0", "-extpass=echo test")
+	if err := ioutil.WriteFile(mnt+"/foo", content, 0600); err != nil {
 		t.Fatal(err)
 	}
-	timer := time.AfterFunc(5*time.Second, func() {
-		t.Error("timeout waiting for umount")
-		cmd.Process.Kill()
-	})
-	err = cmd.Wait()
-	timer.Stop()
-	if err != nil {
-		t.Error(err)
+	test_helpers.UnmountPanic(mnt)
+	for _, depth := range []string{"0", "1", "4"} {
+		test_helpers.MountOrFatal(t, dir, mnt, "-read-pipeline="+depth, "-extpass=echo test")
+		f, err := os.Open(mnt + "/foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Unaligned reads that span many blocks, including one that runs
+		// past the end of the file
+		buf := make([]byte, 128*1024)
+		for _, off := range []int64{0, 4095, 100001, int64(len(content)) - 5000} {
+			n, err := f.ReadAt(buf, off)
+			if err != nil && err != io.EOF {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buf[:n], content[off:off+int64(n)]) {
+				t.Errorf("depth=%s off=%d: wrong content", depth, off)
+			}
+		}
+		f.Close()
+		test_helpers.UnmountPanic(mnt)
 	}
 }
 
-// Mount with idle timeout of 100ms read something every 10ms. The fs should
-// NOT get unmounted. Regression test for https://github.com/rfjakob/gocryptfs/issues/421
-func TestNotIdle(t *testing.T) {
+// Test that -case-insensitive finds names regardless of case, but preserves
+// the case they were created with
+func TestCaseInsensitive(t *testing.T) {
 	dir := test_helpers.InitFS(t)
 	mnt := dir + ".mnt"
-	err := os.Mkdir(mnt, 0700)
-	if err != nil {
+	test_helpers.MountOrFatal(t, dir, mnt, "-case-insensitive", "-extpass=echo test")
+	if err := os.Mkdir(mnt+"/Dir", 0700); err != nil {
 		t.Fatal(err)
 	}
-	err = test_helpers.Mount(dir, mnt, false, "-extpass", "echo test", "-i=100ms")
-	if err != nil {
+	if err := ioutil.WriteFile(mnt+"/Dir/File.txt", []byte("hello"), 0600); err != nil {
 		t.Fatal(err)
 	}
-	err = ioutil.WriteFile(mnt+"/foo", []byte("foo"), 0600)
+	content, err := ioutil.ReadFile(mnt + "/DIR/file.TXT")
 	if err != nil {
 		t.Fatal(err)
 	}
-	// Read every 10 milliseconds for a total of 1 second
-	for i := 1; i < 100; i++ {
-		_, err = ioutil.ReadFile(mnt + "/foo")
-		if err != nil {
-			t.Fatalf("iteration %d failed: %v", i, err)
-		}
-		time.Sleep(10 * time.Millisecond)
+	if string(content) != "hello" {
+		t.Errorf("wrong content: %q", content)
 	}
-	// Keep a file handle open for 1 second
-	fd, err := os.Open(mnt + "/foo")
+	// Creating a name that only differs in case must find the existing file
+	_, err = os.OpenFile(mnt+"/dir/FILE.TXT", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if !os.IsExist(err) {
+		t.Errorf("want EEXIST, got %v", err)
+	}
+	if err = os.Mkdir(mnt+"/dir", 0700); !os.IsExist(err) {
+		t.Errorf("want EEXIST, got %v", err)
+	}
+	// The kernel sees "File.txt" and "file.txt" as the same file and skips
+	// renames between them. Changing the case works via a temporary name.
+	if err = os.Rename(mnt+"/dir/File.txt", mnt+"/dir/tmp"); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Rename(mnt+"/dir/tmp", mnt+"/dir/file.txt"); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(mnt + "/Dir")
 	if err != nil {
 		t.Fatal(err)
 	}
-	time.Sleep(1 * time.Second)
-	buf := make([]byte, 100)
-	_, err = fd.Read(buf)
+	names, err := f.Readdirnames(0)
+	f.Close()
 	if err != nil {
 		t.Fatal(err)
 	}
-	fd.Close()
-	// All good.
+	if len(names) != 1 || names[0] != "file.txt" {
+		t.Errorf("wrong directory listing: %v", names)
+	}
+	if err = syscall.Rmdir(mnt + "/Dir"); err != syscall.ENOTEMPTY {
+		t.Errorf("want ENOTEMPTY, got %v", err)
+	}
+	if err = os.Remove(mnt + "/DIR/FILE.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err = syscall.Rmdir(mnt + "/dIR"); err != nil {
+		t.Fatal(err)
+	}
 	test_helpers.UnmountPanic(mnt)
+	// Without -case-insensitive, names must match exactly
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	if err = os.Mkdir(mnt+"/x", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(mnt + "/X"); !os.IsNotExist(err) {
+		t.Errorf("want ENOENT, got %v", err)
+	}
 }
 
-// TestSymlinkedCipherdir checks that if CIPHERDIR itself is a symlink, it is
-// followed.
-// https://github.com/rfjakob/gocryptfs/issues/450
-func TestSymlinkedCipherdir(t *testing.T) {
-	dir := test_helpers.InitFS(t)
-	dirSymlink := dir + ".symlink"
-	err := os.Symlink(dir, dirSymlink)
+// Test that -pad-names pads names to fixed buckets
+func TestPadNames(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-pad-names")
+	_, c, err := configfile.LoadAndDecrypt(dir+"/"+configfile.ConfDefaultName, testPw)
 	if err != nil {
 		t.Fatal(err)
 	}
+	if !c.IsFeatureFlagSet(configfile.FlagPadNames) {
+		t.Errorf("PadNames feature flag not set: %v", c.FeatureFlags)
+	}
 	mnt := dir + ".mnt"
-	test_helpers.MountOrFatal(t, dirSymlink, mnt, "-extpass=echo test")
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
 	defer test_helpers.UnmountPanic(mnt)
-
-	file := mnt + "/file"
-	f, err := os.Create(file)
-	if err != nil {
-		t.Fatal(err)
+	for _, l := range []int{1, 31, 32} {
+		if err = ioutil.WriteFile(mnt+"/"+strings.Repeat("x", l), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
 	}
-	f.Close()
-
-	f, err = os.Open(mnt)
+	// Names of 1 and 31 bytes pad to 32 bytes = 43 base64 characters,
+	// 32 bytes pads to 64 bytes = 86 base64 characters.
+	entries, err := ioutil.ReadDir(dir)
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer f.Close()
-	names, err := f.Readdirnames(0)
+	var have []int
+	for _, e := range entries {
+		if e.Name() != configfile.ConfDefaultName && e.Name() != nametransform.DirIVFilename {
+			have = append(have, len(e.Name()))
+		}
+	}
+	sort.Ints(have)
+	if len(have) != 3 || have[0] != 43 || have[1] != 43 || have[2] != 86 {
+		t.Errorf("unexpected encrypted name lengths: %v", have)
+	}
+	f, err := os.Open(mnt)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(names) != 1 || names[0] != "file" {
-		t.Errorf("wrong Readdirnames result: %v", names)
+	names, err := f.Readdirnames(0)
+	f.Close()
+	if err != nil || len(names) != 3 {
+		t.Errorf("readdir: %v %v", names, err)
 	}
 }
 
-// TestBadname tests the `-badname` option
-func TestBadname(t *testing.T) {
+// TestFsname checks that -fsname sets the name shown in /proc/mounts.
+func TestFsname(t *testing.T) {
 	dir := test_helpers.InitFS(t)
 	mnt := dir + ".mnt"
-	validFileName := "file"
-	invalidSuffix := ".invalid_file"
-
-	// use static suffix for testing
-	test_helpers.MountOrFatal(t, dir, mnt, "-badname=*", "-extpass=echo test")
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test", "-fsname=myvault")
 	defer test_helpers.UnmountPanic(mnt)
-
-	// write one valid filename (empty content)
-	file := mnt + "/" + validFileName
-	err := ioutil.WriteFile(file, nil, 0600)
+	mounts, err := ioutil.ReadFile("/proc/self/mounts")
 	if err != nil {
 		t.Fatal(err)
 	}
+	want := "myvault " + mnt + " fuse.gocryptfs "
+	if !strings.Contains(string(mounts), want) {
+		t.Errorf("%q not found in /proc/self/mounts", want)
+	}
+}
 
-	// read encrypted file name
-	fread, err := os.Open(dir)
+// Test that -plaintext-symlinks stores symlink targets, but not names,
+// unencrypted
+func TestPlaintextSymlinks(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-plaintext-symlinks")
+	_, c, err := configfile.LoadAndDecrypt(dir+"/"+configfile.ConfDefaultName, testPw)
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer fread.Close()
-
-	encryptedfilename := ""
-	ciphernames, err := fread.Readdirnames(0)
-	if err != nil {
+	if !c.IsFeatureFlagSet(configfile.FlagPlaintextSymlinks) {
+		t.Errorf("PlaintextSymlinks feature flag not set: %v", c.FeatureFlags)
+	}
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	const target = "../some/relative/target"
+	if err = os.Symlink(target, mnt+"/link"); err != nil {
 		t.Fatal(err)
 	}
-	for _, ciphername := range ciphernames {
-		if ciphername != "gocryptfs.conf" && ciphername != "gocryptfs.diriv" {
-			encryptedfilename = ciphername
-			// found cipher name of "file"
-			break
-		}
+	if have, err := os.Readlink(mnt + "/link"); err != nil || have != target {
+		t.Errorf("Readlink on the mount: have %q %v, want %q", have, err, target)
 	}
-
-	// write invalid file which should be decodable
-	err = ioutil.WriteFile(dir+"/"+encryptedfilename+invalidSuffix, nil, 0600)
+	fi, err := os.Lstat(mnt + "/link")
 	if err != nil {
 		t.Fatal(err)
 	}
-	// write invalid file which is not decodable (cropping the encrpyted file name)
-	err = ioutil.WriteFile(dir+"/"+encryptedfilename[:len(encryptedfilename)-2]+invalidSuffix, nil, 0600)
+	if fi.Size() != int64(len(target)) {
+		t.Errorf("Lstat on the mount: have size %d, want %d", fi.Size(), len(target))
+	}
+	if _, err = os.Lstat(dir + "/link"); !os.IsNotExist(err) {
+		t.Errorf("symlink name is not encrypted: %v", err)
+	}
+	entries, err := ioutil.ReadDir(dir)
 	if err != nil {
 		t.Fatal(err)
 	}
+	found := false
+	for _, e := range entries {
+		if e.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		found = true
+		if have, _ := os.Readlink(dir + "/" + e.Name()); have != target {
+			t.Errorf("backing symlink target: have %q, want %q", have, target)
+		}
+	}
+	if !found {
+		t.Error("backing symlink not found")
+	}
+}
 
-	// check for filenames
-	f, err := os.Open(mnt)
+// TestXattrSidecar checks that "-xattr-sidecar" stores xattrs the backing
+// filesystem refuses (here: on a symlink) and moves and deletes them along
+// with the file.
+func TestXattrSidecar(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("setting trusted.* xattrs needs root")
+	}
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test", "-xattr-sidecar")
+	defer test_helpers.UnmountPanic(mnt)
+
+	// The kernel only allows "user." xattrs on files and directories, but
+	// gocryptfs stores every xattr as "user.gocryptfs.*" on the backing file.
+	link := mnt + "/link"
+	if err := os.Symlink("/nonexistent", link); err != nil {
+		t.Fatal(err)
+	}
+	attr := "trusted.gocryptfs_test"
+	val := []byte("123456789")
+	if err := unix.Lsetxattr(link, attr, val, 0); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 100)
+	sz, err := unix.Lgetxattr(link, attr, buf)
 	if err != nil {
 		t.Fatal(err)
 	}
-	defer f.Close()
-	names, err := f.Readdirnames(0)
+	if !bytes.Equal(buf[:sz], val) {
+		t.Errorf("wrong value: want %q, have %q", val, buf[:sz])
+	}
+	sz, err = unix.Llistxattr(link, buf)
 	if err != nil {
 		t.Fatal(err)
 	}
-	foundDecodable := false
-	foundUndecodable := false
-	for _, name := range names {
-		if strings.Contains(name, validFileName+invalidSuffix+" GOCRYPTFS_BAD_NAME") {
-			foundDecodable = true
-		} else if strings.Contains(name, encryptedfilename[:len(encryptedfilename)-2]+invalidSuffix+" GOCRYPTFS_BAD_NAME") {
-			foundUndecodable = true
+	if string(buf[:sz]) != attr+"\000" {
+		t.Errorf("wrong list: %q", buf[:sz])
+	}
+	if err = unix.Lsetxattr(link, attr, val, unix.XATTR_CREATE); err != syscall.EEXIST {
+		t.Errorf("XATTR_CREATE: want EEXIST, have %v", err)
+	}
+	// The sidecar file is in CIPHERDIR, but hidden in the mount
+	countSidecars := func() int {
+		names, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := 0
+		for _, fi := range names {
+			if strings.HasPrefix(fi.Name(), "gocryptfs.xattr.") {
+				n++
+			}
 		}
+		return n
 	}
-
-	if !foundDecodable {
-		t.Errorf("did not find invalid name %s in %v", validFileName+invalidSuffix+" GOCRYPTFS_BAD_NAME", names)
+	if n := countSidecars(); n != 1 {
+		t.Errorf("want 1 sidecar file in CIPHERDIR, have %d", n)
 	}
-
-	if !foundUndecodable {
-		t.Errorf("did not find invalid name %s in %v", encryptedfilename[:len(encryptedfilename)-2]+invalidSuffix+" GOCRYPTFS_BAD_NAME", names)
+	names, err := ioutil.ReadDir(mnt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 {
+		t.Errorf("sidecar file is visible in the mount: %v", names)
+	}
+	// The xattr moves along on rename
+	link2 := mnt + "/link2"
+	if err = os.Rename(link, link2); err != nil {
+		t.Fatal(err)
+	}
+	sz, err = unix.Lgetxattr(link2, attr, buf)
+	if err != nil || !bytes.Equal(buf[:sz], val) {
+		t.Errorf("xattr lost on rename: %q, %v", buf[:sz], err)
+	}
+	// Remove and set again
+	if err = unix.Lremovexattr(link2, attr); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = unix.Lgetxattr(link2, attr, buf); err != unix.ENODATA {
+		t.Errorf("want ENODATA after remove, have %v", err)
+	}
+	if n := countSidecars(); n != 0 {
+		t.Errorf("empty sidecar file was not deleted, have %d", n)
+	}
+	if err = unix.Lsetxattr(link2, attr, val, 0); err != nil {
+		t.Fatal(err)
+	}
+	// The sidecar file is deleted together with the file
+	if err = syscall.Unlink(link2); err != nil {
+		t.Fatal(err)
+	}
+	if n := countSidecars(); n != 0 {
+		t.Errorf("sidecar file survived unlink, have %d", n)
 	}
 }
 
-// TestPassfile tests the `-passfile` option
-func TestPassfile(t *testing.T) {
-	dir := test_helpers.InitFS(t)
-	mnt := dir + ".mnt"
-	passfile1 := mnt + ".1.txt"
-	ioutil.WriteFile(passfile1, []byte("test"), 0600)
-	test_helpers.MountOrFatal(t, dir, mnt, "-passfile="+passfile1)
-	defer test_helpers.UnmountPanic(mnt)
-}
-
-// TestPassfileX2 tests that the `-passfile` option can be passed twice
-func TestPassfileX2(t *testing.T) {
+// Test that hard links share the xattr sidecar file, and that unlinking one
+// name keeps it for the others
+func TestXattrSidecarHardlink(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("setting trusted.* xattrs needs root")
+	}
 	dir := test_helpers.InitFS(t)
 	mnt := dir + ".mnt"
-	passfile1 := mnt + ".1.txt"
-	passfile2 := mnt + ".2.txt"
-	ioutil.WriteFile(passfile1, []byte("te"), 0600)
-	ioutil.WriteFile(passfile2, []byte("st"), 0600)
-	test_helpers.MountOrFatal(t, dir, mnt, "-passfile="+passfile1, "-passfile="+passfile2)
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test", "-xattr-sidecar")
 	defer test_helpers.UnmountPanic(mnt)
-}
 
-// TestInitNotEmpty checks that `gocryptfs -init` returns the right error code
-// if CIPHERDIR is not empty. See https://github.com/rfjakob/gocryptfs/pull/503
-func TestInitNotEmpty(t *testing.T) {
-	dir := test_helpers.TmpDir + "/" + t.Name()
-	if err := os.Mkdir(dir, 0700); err != nil {
+	link := mnt + "/link"
+	if err := os.Symlink("/nonexistent", link); err != nil {
 		t.Fatal(err)
 	}
-	if err := ioutil.WriteFile(dir+"/foo", nil, 0700); err != nil {
+	attr := "trusted.gocryptfs_test"
+	if err := unix.Lsetxattr(link, attr, []byte("v1"), 0); err != nil {
 		t.Fatal(err)
 	}
-	cmd := exec.Command(test_helpers.GocryptfsBinary, "-init", "-extpass", "echo test", dir)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err := cmd.Run()
+	// os.Link would follow the symlink
+	link2 := mnt + "/link2"
+	if err := unix.Linkat(unix.AT_FDCWD, link, unix.AT_FDCWD, link2, 0); err != nil {
+		t.Fatal(err)
+	}
+	get := func(path string) string {
+		buf := make([]byte, 100)
+		sz, err := unix.Lgetxattr(path, attr, buf)
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		return string(buf[:sz])
+	}
+	if v := get(link2); v != "v1" {
+		t.Errorf("new hard link: want v1, have %q", v)
+	}
+	// A change through one name is visible through the other
+	if err := unix.Lsetxattr(link2, attr, []byte("v2"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if v := get(link); v != "v2" {
+		t.Errorf("old hard link: want v2, have %q", v)
+	}
+	if err := syscall.Unlink(link); err != nil {
+		t.Fatal(err)
+	}
+	if v := get(link2); v != "v2" {
+		t.Errorf("after unlink of the other name: want v2, have %q", v)
+	}
+	if err := syscall.Unlink(link2); err != nil {
+		t.Fatal(err)
+	}
+	names, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fi := range names {
+		if strings.HasPrefix(fi.Name(), "gocryptfs.xattr.") {
+			t.Errorf("sidecar file survived: %s", fi.Name())
+		}
+	}
+}
+
+// Test that -acl stores ACLs unencrypted and enforces them
+func TestAcl(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("must run as root to check access as another user")
+	}
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test", "-acl", "-allow_other")
+	defer test_helpers.UnmountPanic(mnt)
+	// Let "nobody" get to the mount
+	if err := os.Chmod(test_helpers.TmpDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(mnt, 0755); err != nil {
+		t.Fatal(err)
+	}
+	const nobody = 65534
+	asNobody := func(args ...string) error {
+		cmd := exec.Command(args[0], args[1:]...)
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			Credential: &syscall.Credential{Uid: nobody, Gid: nobody},
+		}
+		return cmd.Run()
+	}
+	fn := mnt + "/file"
+	if err := ioutil.WriteFile(fn, []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := asNobody("cat", fn); err == nil {
+		t.Fatal("nobody can read a 0600 file without an ACL")
+	}
+	// u::rw-,u:nobody:r--,g::---,m::r--,o::---
+	acl := []byte("\002\000\000\000" +
+		"\001\000\006\000\377\377\377\377" +
+		"\002\000\004\000\376\377\000\000" +
+		"\004\000\000\000\377\377\377\377" +
+		"\020\000\004\000\377\377\377\377" +
+		"\040\000\000\000\377\377\377\377")
+	if err := unix.Setxattr(fn, "system.posix_acl_access", acl, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := asNobody("cat", fn); err != nil {
+		t.Errorf("nobody cannot read the file despite the ACL: %v", err)
+	}
+	if err := asNobody("sh", "-c", "echo foo >> "+fn); err == nil {
+		t.Error("nobody can write the file, but the ACL only allows reading")
+	}
+	// Only the owner may change the metadata
+	if err := asNobody("chmod", "666", fn); err == nil {
+		t.Error("nobody can chmod a file owned by root")
+	}
+	if err := asNobody("touch", "-d", "2000-01-01", fn); err == nil {
+		t.Error("nobody can set the times of a file owned by root")
+	}
+	if err := asNobody("chown", fmt.Sprint(nobody), fn); err == nil {
+		t.Error("nobody can chown a file owned by root")
+	}
+	// The sticky bit protects the files of other users
+	sticky := mnt + "/sticky"
+	if err := os.Mkdir(sticky, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(sticky, 0777|os.ModeSticky); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(sticky+"/file", nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(sticky+"/file", 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := asNobody("rm", "-f", sticky+"/file"); err == nil {
+		t.Error("nobody can delete a file of root in a sticky directory")
+	}
+	if err := asNobody("mv", sticky+"/file", sticky+"/file2"); err == nil {
+		t.Error("nobody can rename a file of root in a sticky directory")
+	}
+	// The ACL is stored unencrypted on the backing file
+	matches, err := filepath.Glob(dir + "/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, m := range matches {
+		buf := make([]byte, 100)
+		sz, err := unix.Lgetxattr(m, "system.posix_acl_access", buf)
+		if err == nil && bytes.Equal(buf[:sz], acl) {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("ACL not found on the backing file")
+	}
+}
+
+// Test that -force_owner applies to all files, also right after they have
+// been created and after a remount
+func TestForceOwner(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test", "-force_owner=1234:5678")
+	check := func() {
+		t.Helper()
+		for _, n := range []string{"file", "dir", "symlink"} {
+			var st syscall.Stat_t
+			if err := syscall.Lstat(mnt+"/"+n, &st); err != nil {
+				t.Fatal(err)
+			}
+			if st.Uid != 1234 || st.Gid != 5678 {
+				t.Errorf("%s: want owner 1234:5678, have %d:%d", n, st.Uid, st.Gid)
+			}
+		}
+	}
+	if err := ioutil.WriteFile(mnt+"/file", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(mnt+"/dir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("file", mnt+"/symlink"); err != nil {
+		t.Fatal(err)
+	}
+	check()
+	test_helpers.UnmountPanic(mnt)
+	// After a remount, the attributes come from LOOKUP
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test", "-force_owner=1234:5678")
+	defer test_helpers.UnmountPanic(mnt)
+	check()
+}
+
+// Test that -allow_root lets root in, but not other users
+func TestAllowRoot(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("must run as root to check access as another user")
+	}
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test", "-allow_root")
+	defer test_helpers.UnmountPanic(mnt)
+	if err := os.Chmod(test_helpers.TmpDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(mnt, 0755); err != nil {
+		t.Fatal(err)
+	}
+	fn := mnt + "/file"
+	if err := ioutil.WriteFile(fn, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// World-readable, but nobody must not get in anyway
+	const nobody = 65534
+	cmd := exec.Command("cat", fn)
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Credential: &syscall.Credential{Uid: nobody, Gid: nobody},
+	}
+	if out, err := cmd.CombinedOutput(); err == nil {
+		t.Errorf("nobody can read the file: %q", out)
+	}
+	if _, err := ioutil.ReadFile(fn); err != nil {
+		t.Errorf("root cannot read the file: %v", err)
+	}
+}
+
+// Test that -sparse stores blocks of zeros as file holes
+func TestSparse(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test", "-sparse")
+	defer test_helpers.UnmountPanic(mnt)
+	// 1 MiB of zeros, framed by some data
+	content := make([]byte, 1024*1024+200)
+	copy(content, "foo")
+	copy(content[len(content)-3:], "bar")
+	fn := mnt + "/file"
+	if err := ioutil.WriteFile(fn, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	content2, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, content2) {
+		t.Fatal("content mismatch")
+	}
+	names, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var backing string
+	for _, fi := range names {
+		if !strings.HasPrefix(fi.Name(), "gocryptfs.") {
+			backing = dir + "/" + fi.Name()
+		}
+	}
+	var st syscall.Stat_t
+	if err = syscall.Stat(backing, &st); err != nil {
+		t.Fatal(err)
+	}
+	// The backing filesystem may not support punching holes
+	if st.Blocks*512 >= int64(len(content)) {
+		t.Skipf("backing file is not sparse: %d blocks", st.Blocks)
+	}
+	// Overwriting the zeros with data must work
+	f, err := os.OpenFile(fn, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt([]byte("xyz"), 500000)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(content[500000:], "xyz")
+	content2, err = ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, content2) {
+		t.Error("content mismatch after overwrite")
+	}
+}
+
+// -nofail should be ignored and the mount should succeed
+func TestNofail(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-nofail", "-extpass=echo test")
+	defer test_helpers.UnmountPanic(mnt)
+}
+
+// Test "mountpoint shadows cipherdir" handling
+func TestShadows(t *testing.T) {
+	mnt := test_helpers.InitFS(t)
+	cipher := mnt + ".cipher"
+	err := os.Rename(mnt, cipher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// This should work
+	// (note that MountOrFatal creates "mnt" again)
+	test_helpers.MountOrFatal(t, cipher, mnt, "-extpass=echo test")
+	test_helpers.UnmountPanic(mnt)
+	cipher2 := mnt + "/cipher"
+	err = os.Rename(cipher, cipher2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// This should fail
+	err = test_helpers.Mount(cipher2, mnt, false, "-extpass=echo test")
+	if err == nil {
+		t.Errorf("Should have failed")
+	}
+}
+
+// TestMountPasswordIncorrect makes sure the correct exit code is used when the password
+// was incorrect while mounting
+func TestMountPasswordIncorrect(t *testing.T) {
+	cDir := test_helpers.InitFS(t) // Create filesystem with password "test"
+	pDir := cDir + ".mnt"
+	err := test_helpers.Mount(cDir, pDir, false, "-extpass", "echo WRONG", "-wpanic=false")
 	exitCode := test_helpers.ExtractCmdExitCode(err)
-	if exitCode != exitcodes.CipherDir {
-		t.Fatalf("wrong exit code: have=%d, want=%d", exitCode, exitcodes.CipherDir)
+	if exitCode != exitcodes.PasswordIncorrect {
+		t.Errorf("want=%d, got=%d", exitcodes.PasswordIncorrect, exitCode)
+	}
+}
+
+// TestPasswdPasswordIncorrect makes sure the correct exit code is used when the password
+// was incorrect while changing the password
+func TestPasswdPasswordIncorrect(t *testing.T) {
+	cDir := test_helpers.InitFS(t) // Create filesystem with password "test"
+	// Change password
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-passwd", cDir)
+	childStdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = childStdin.Write([]byte("WRONGPASSWORD\nNewPassword"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = childStdin.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cmd.Wait()
+	exitCode := test_helpers.ExtractCmdExitCode(err)
+	if exitCode != exitcodes.PasswordIncorrect {
+		t.Errorf("want=%d, got=%d", exitcodes.PasswordIncorrect, exitCode)
+	}
+}
+
+// Check that we correctly background on mount and close stderr and stdout.
+// Something like
+//   gocryptfs a b | cat
+// must not hang ( https://github.com/rfjakob/gocryptfs/issues/130 ).
+func TestMountBackground(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	err := os.Mkdir(mnt, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Manually create a pipe pair and connect the child's stdout and stderr
+	// to it. We cannot use StdoutPipe because that will close the pipe
+	// when the child forks away.
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := []string{"-extpass", "echo test", dir, mnt}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, args...)
+	cmd.Stdout = pw
+	cmd.Stderr = pw
+	err = cmd.Run()
+	if err != nil {
+		t.Error(err)
+	}
+	pw.Close()
+	defer test_helpers.UnmountPanic(mnt)
+	// Read until we get EOF.
+	c1 := make(chan struct{}, 1)
+	go func() {
+		buf := make([]byte, 1000)
+		for {
+			_, err = pr.Read(buf)
+			// We should get io.EOF when the child closes stdout
+			// and stderr.
+			if err != nil {
+				pr.Close()
+				c1 <- struct{}{}
+				return
+			}
+		}
+	}()
+	select {
+	case <-c1:
+		return
+	case <-time.After(time.Second * 5):
+		t.Fatal("timeout")
+	}
+}
+
+// Check that the exit code of a background mount tells whether the mount
+// worked, and that the filesystem is ready when it returns.
+func TestMountBackgroundExitCode(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	err := os.Mkdir(mnt, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-extpass", "echo WRONG", "-nosyslog", dir, mnt)
+	err = cmd.Run()
+	exitCode := test_helpers.ExtractCmdExitCode(err)
+	if exitCode != exitcodes.PasswordIncorrect {
+		t.Errorf("want=%d, got=%d", exitcodes.PasswordIncorrect, exitCode)
+	}
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-extpass", "echo test", "-nosyslog", dir, mnt)
+	err = cmd.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer test_helpers.UnmountPanic(mnt)
+	// No waiting, the mount must be usable right away
+	err = os.WriteFile(mnt+"/foo", []byte("bar"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Test that "gocryptfs -init -info CIPHERDIR" returns an error to the
+// user. Only one operation flag is allowed.
+func TestMultipleOperationFlags(t *testing.T) {
+	// Test all combinations
+	opFlags := []string{"-init", "-info", "-passwd", "-fsck", "-destroy"}
+	for _, flag1 := range opFlags {
+		var flag2 string
+		for _, flag2 = range opFlags {
+			if flag1 == flag2 {
+				continue
+			}
+			args := []string{flag1, flag2, "/tmp"}
+			//t.Logf("testing %v", args)
+			cmd := exec.Command(test_helpers.GocryptfsBinary, args...)
+			err := cmd.Run()
+			exitCode := test_helpers.ExtractCmdExitCode(err)
+			if exitCode != exitcodes.Usage {
+				t.Fatalf("this should have failed with code %d, but returned %d",
+					exitcodes.Usage, exitCode)
+			}
+		}
+	}
+}
+
+func TestNoexec(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	err := os.Mkdir(mnt, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test", "-noexec")
+	defer test_helpers.UnmountPanic(mnt)
+	sh := mnt + "/x.sh"
+	content := `#!/bin/bash
+echo hello
+`
+	err = ioutil.WriteFile(sh, []byte(content), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = exec.Command(sh).Run()
+	exitCode := test_helpers.ExtractCmdExitCode(err)
+	if exitCode != int(syscall.EACCES) {
+		t.Errorf("got exitcode %d instead of EPERM (%d)", exitCode, syscall.EPERM)
+	}
+}
+
+// Test that a missing argument to "-o" triggers exit code 1.
+// See also cli_args_test.go for comprehensive tests of "-o" parsing.
+func TestMissingOArg(t *testing.T) {
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "foo", "bar", "-o")
+	err := cmd.Run()
+	exitCode := test_helpers.ExtractCmdExitCode(err)
+	if exitCode != exitcodes.Usage {
+		t.Fatalf("this should have failed with code %d, but returned %d",
+			exitcodes.Usage, exitCode)
+	}
+}
+
+// -syslog and -nosyslog contradict each other
+func TestSyslogNosyslog(t *testing.T) {
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-syslog", "-nosyslog", "foo", "bar")
+	err := cmd.Run()
+	exitCode := test_helpers.ExtractCmdExitCode(err)
+	if exitCode != exitcodes.Usage {
+		t.Fatalf("this should have failed with code %d, but returned %d",
+			exitcodes.Usage, exitCode)
+	}
+}
+
+// Test that "-metrics" serves the counters over HTTP
+func TestMetrics(t *testing.T) {
+	// Find a free port
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test", "-metrics="+addr)
+	defer test_helpers.UnmountPanic(mnt)
+	if err = ioutil.WriteFile(mnt+"/foo", make([]byte, 1234), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// No keep-alive, the connection would show up as an fd leak
+	client := http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	resp, err := client.Get("http://" + addr + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"\ngocryptfs_written_bytes_total 1234\n",
+		// The duration is recorded after the reply has been sent, so don't
+		// look at the last request
+		`gocryptfs_fuse_request_duration_seconds_count{op="CREATE"} 1`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("missing %q in metrics:\n%s", want, body)
+		}
+	}
+}
+
+// Test that "-trace-fuse" logs the requests, and only shows the file names
+// with "-trace-plain"
+func TestTraceFuse(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	trace := dir + ".trace"
+	for _, plain := range []bool{false, true} {
+		args := []string{"-extpass=echo test", "-trace-fuse=" + trace}
+		if plain {
+			args = append(args, "-trace-plain")
+		}
+		test_helpers.MountOrFatal(t, dir, mnt, args...)
+		name := fmt.Sprintf("secretname%v", plain)
+		if err := ioutil.WriteFile(mnt+"/"+name, []byte("foo"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		pid := test_helpers.MountInfo[mnt].Pid
+		test_helpers.UnmountPanic(mnt)
+		// The trace is written out when gocryptfs exits
+		for i := 0; i < 100 && syscall.Kill(pid, 0) == nil; i++ {
+			time.Sleep(20 * time.Millisecond)
+		}
+		content, err := ioutil.ReadFile(trace)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(content), " CREATE n1 ") ||
+			!strings.Contains(string(content), " WRITE ") {
+			t.Errorf("requests missing in trace:\n%s", content)
+		}
+		if strings.Contains(string(content), name) != plain {
+			t.Errorf("plain=%v, but name found=%v:\n%s", plain, !plain, content)
+		}
+	}
+}
+
+// Test that "-audit" logs file accesses with plaintext paths, and that the
+// HMAC chain continues across mounts
+func TestAudit(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	log := dir + ".audit"
+	keyFile := dir + ".key"
+	key := []byte("0123456789abcdef")
+	if err := ioutil.WriteFile(keyFile, key, 0600); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test", "-audit="+log, "-audit-key="+keyFile)
+		foo := fmt.Sprintf("%s/foo%d", mnt, i)
+		if err := ioutil.WriteFile(foo, []byte("x"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(foo, mnt+"/bar"); err != nil {
+			t.Fatal(err)
+		}
+		if err := syscall.Unlink(mnt + "/bar"); err != nil {
+			t.Fatal(err)
+		}
+		test_helpers.UnmountPanic(mnt)
+	}
+	f, err := os.Open(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	n, err := audit.Verify(f, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 6 {
+		t.Errorf("want 6 entries, have %d", n)
+	}
+	content, _ := ioutil.ReadFile(log)
+	for _, want := range []string{
+		`"Op":"create","Path":"foo1",`,
+		`"Op":"rename","Path":"foo1","NewPath":"bar",`,
+		`"Op":"unlink","Path":"bar",`,
+		fmt.Sprintf(`"Uid":%d,`, os.Getuid()),
+	} {
+		if !strings.Contains(string(content), want) {
+			t.Errorf("missing %q in audit log:\n%s", want, content)
+		}
+	}
+}
+
+// TestSdNotify checks that we tell systemd when we are ready and when we
+// stop, when started as a "Type=notify" service.
+func TestSdNotify(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	sock := dir + ".notify"
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: sock, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	read := func() string {
+		buf := make([]byte, 1000)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	}
+	os.Setenv("NOTIFY_SOCKET", sock)
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	os.Unsetenv("NOTIFY_SOCKET")
+	pid := test_helpers.MountInfo[mnt].Pid
+	if msg, want := read(), fmt.Sprintf("READY=1\nMAINPID=%d", pid); msg != want {
+		t.Errorf("want %q, got %q", want, msg)
+	}
+	test_helpers.UnmountPanic(mnt)
+	if msg := read(); msg != "STOPPING=1" {
+		t.Errorf("want STOPPING=1, got %q", msg)
+	}
+}
+
+// TestSignals checks that SIGUSR1 drops the directory cache, and that
+// SIGUSR1 and SIGHUP do not kill a running mount.
+func TestSignals(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	sock := dir + ".sock"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test", "-ctlsock="+sock)
+	defer test_helpers.UnmountPanic(mnt)
+	if err := os.MkdirAll(mnt+"/a/b", 0700); err != nil {
+		t.Fatal(err)
+	}
+	os.Stat(mnt + "/a/b/c")
+	entries := func() int {
+		r := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{Stats: true})
+		if r.Stats == nil {
+			t.Fatalf("got an error reply: %+v", r)
+		}
+		return r.Stats.DirCacheEntries
+	}
+	if entries() == 0 {
+		t.Fatal("directory cache is empty")
+	}
+	pid := test_helpers.MountInfo[mnt].Pid
+	syscall.Kill(pid, syscall.SIGUSR1)
+	for i := 0; entries() != 0; i++ {
+		if i > 500 {
+			t.Fatal("directory cache was not dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Toggle the debug output on and off
+	syscall.Kill(pid, syscall.SIGHUP)
+	syscall.Kill(pid, syscall.SIGHUP)
+	if _, err := os.Stat(mnt + "/a/b"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestUnmount tests "-unmount" with the mountpoint and the cipherdir, and
+// with a busy mount.
+func TestUnmount(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	mounted := func() bool {
+		var st1, st2 syscall.Stat_t
+		syscall.Stat(mnt, &st1)
+		syscall.Stat(dir, &st2)
+		return st1.Dev != st2.Dev
+	}
+	unmount := func(path string, flags ...string) error {
+		args := append([]string{"-q"}, flags...)
+		cmd := exec.Command(test_helpers.GocryptfsBinary, append(args, "-unmount", path)...)
+		cmd.Stderr = os.Stderr
+		return cmd.Run()
+	}
+	for _, path := range []string{mnt, dir} {
+		test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+		if err := unmount(path); err != nil {
+			test_helpers.UnmountPanic(mnt)
+			t.Fatal(err)
+		}
+		if mounted() {
+			test_helpers.UnmountPanic(mnt)
+			t.Fatalf("still mounted after -unmount %q", path)
+		}
+	}
+	// Not mounted anymore
+	if code := test_helpers.ExtractCmdExitCode(unmount(mnt)); code != exitcodes.Unmount {
+		t.Errorf("want exit code %d, got %d", exitcodes.Unmount, code)
+	}
+	// Busy
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	f, err := os.Create(mnt + "/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := test_helpers.ExtractCmdExitCode(unmount(mnt)); code != exitcodes.Unmount {
+		t.Errorf("busy: want exit code %d, got %d", exitcodes.Unmount, code)
+	}
+	if err = unmount(mnt, "-lazy"); err != nil {
+		t.Error(err)
+	}
+	f.Close()
+	if mounted() {
+		test_helpers.UnmountPanic(mnt)
+		t.Fatal("still mounted after -unmount -lazy")
+	}
+}
+
+// TestSetuidError checks that "-setuid" fails before asking for the
+// password if it cannot switch to the user. See root_test for the
+// successful case.
+func TestSetuidError(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	err := test_helpers.Mount(dir, mnt, false, "-extpass=false", "-wpanic=false", "-setuid=nosuchuser.gocryptfs")
+	if code := test_helpers.ExtractCmdExitCode(err); code != exitcodes.Setuid {
+		t.Errorf("want exit code %d, got %d", exitcodes.Setuid, code)
+	}
+}
+
+// TestMacMetadata checks that the .DS_Store and "._" AppleDouble files that
+// MacOS puts into CIPHERDIR are hidden and do not block rmdir.
+func TestMacMetadata(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	if err := os.Mkdir(mnt+"/d", 0700); err != nil {
+		t.Fatal(err)
+	}
+	var cDir string
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			cDir = dir + "/" + e.Name()
+		}
+	}
+	for _, n := range []string{".DS_Store", "._foo", "._.DS_Store"} {
+		if err = ioutil.WriteFile(cDir+"/"+n, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err = ioutil.ReadDir(mnt + "/d")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("metadata files are visible: %v", entries)
+	}
+	if err = syscall.Rmdir(mnt + "/d"); err != nil {
+		t.Error(err)
+	}
+}
+
+// -exclude must return an error in forward mode
+func TestExcludeForward(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	err := test_helpers.Mount(dir, mnt, false, "-extpass", "echo test", "-exclude", "foo")
+	if err == nil {
+		t.Errorf("-exclude in forward mode should fail")
+	}
+	t.Log(err)
+}
+
+// Check that the config file can be read from a named pipe.
+// Make sure bug https://github.com/rfjakob/gocryptfs/issues/258 does not come
+// back.
+func TestConfigPipe(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	err := os.Mkdir(mnt, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bashLine := fmt.Sprintf("%s -q -extpass \"echo test\" -config <(cat %s/gocryptfs.conf) %s %s", test_helpers.GocryptfsBinary, dir, dir, mnt)
+	cmd := exec.Command("bash", "-c", bashLine)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stdout
+	err = cmd.Run()
+	exitCode := test_helpers.ExtractCmdExitCode(err)
+	if exitCode != 0 {
+		t.Errorf("bash command\n%q\nresulted in exit code %d", bashLine, exitCode)
+		return
+	}
+	test_helpers.UnmountPanic(mnt)
+}
+
+// Ciphertext dir and mountpoint contains a comma
+// https://github.com/rfjakob/gocryptfs/issues/262
+func TestComma(t *testing.T) {
+	dir0 := test_helpers.InitFS(t)
+	dir := dir0 + ",foo,bar"
+	err := os.Rename(dir0, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mnt := dir + ".mnt"
+	err = test_helpers.Mount(dir, mnt, false, "-extpass", "echo test", "-wpanic=0")
+	if err != nil {
+		t.Fatalf("Failed to mount %q on %q: %v", dir, mnt, err)
+	}
+	test_helpers.UnmountPanic(mnt)
+}
+
+// Mount with idle timeout 10ms and check that the process exits by itself
+// within 5 seconds.
+func TestIdle(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	err := os.Mkdir(mnt, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary,
+		"-q", "-nosyslog", "-fg", "-extpass", "echo test", "-i", "10ms", dir, mnt)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	timer := time.AfterFunc(5*time.Second, func() {
+		t.Error("timeout waiting for umount")
+		cmd.Process.Kill()
+	})
+	err = cmd.Wait()
+	timer.Stop()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+// Mount with idle timeout of 100ms read something every 10ms. The fs should
+// NOT get unmounted. Regression test for https://github.com/rfjakob/gocryptfs/issues/421
+func TestNotIdle(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	err := os.Mkdir(mnt, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = test_helpers.Mount(dir, mnt, false, "-extpass", "echo test", "-i=100ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(mnt+"/foo", []byte("foo"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Read every 10 milliseconds for a total of 1 second
+	for i := 1; i < 100; i++ {
+		_, err = ioutil.ReadFile(mnt + "/foo")
+		if err != nil {
+			t.Fatalf("iteration %d failed: %v", i, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Keep a file handle open for 1 second
+	fd, err := os.Open(mnt + "/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1 * time.Second)
+	buf := make([]byte, 100)
+	_, err = fd.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd.Close()
+	// All good.
+	test_helpers.UnmountPanic(mnt)
+}
+
+// TestSymlinkedCipherdir checks that if CIPHERDIR itself is a symlink, it is
+// followed.
+// https://github.com/rfjakob/gocryptfs/issues/450
+func TestSymlinkedCipherdir(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	dirSymlink := dir + ".symlink"
+	err := os.Symlink(dir, dirSymlink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dirSymlink, mnt, "-extpass=echo test")
+	defer test_helpers.UnmountPanic(mnt)
+
+	file := mnt + "/file"
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	f, err = os.Open(mnt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 || names[0] != "file" {
+		t.Errorf("wrong Readdirnames result: %v", names)
+	}
+}
+
+// TestBadname tests the `-badname` option
+func TestBadname(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	validFileName := "file"
+	invalidSuffix := ".invalid_file"
+
+	// use static suffix for testing
+	test_helpers.MountOrFatal(t, dir, mnt, "-badname=*", "-extpass=echo test")
+	defer test_helpers.UnmountPanic(mnt)
+
+	// write one valid filename (empty content)
+	file := mnt + "/" + validFileName
+	err := ioutil.WriteFile(file, nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// read encrypted file name
+	fread, err := os.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fread.Close()
+
+	encryptedfilename := ""
+	ciphernames, err := fread.Readdirnames(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ciphername := range ciphernames {
+		if ciphername != "gocryptfs.conf" && ciphername != "gocryptfs.diriv" {
+			encryptedfilename = ciphername
+			// found cipher name of "file"
+			break
+		}
+	}
+
+	// write invalid file which should be decodable
+	err = ioutil.WriteFile(dir+"/"+encryptedfilename+invalidSuffix, nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// write invalid file which is not decodable (cropping the encrpyted file name)
+	err = ioutil.WriteFile(dir+"/"+encryptedfilename[:len(encryptedfilename)-2]+invalidSuffix, nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// check for filenames
+	f, err := os.Open(mnt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	foundDecodable := false
+	foundUndecodable := false
+	for _, name := range names {
+		if strings.Contains(name, validFileName+invalidSuffix+" GOCRYPTFS_BAD_NAME") {
+			foundDecodable = true
+		} else if strings.Contains(name, encryptedfilename[:len(encryptedfilename)-2]+invalidSuffix+" GOCRYPTFS_BAD_NAME") {
+			foundUndecodable = true
+		}
+	}
+
+	if !foundDecodable {
+		t.Errorf("did not find invalid name %s in %v", validFileName+invalidSuffix+" GOCRYPTFS_BAD_NAME", names)
+	}
+
+	if !foundUndecodable {
+		t.Errorf("did not find invalid name %s in %v", encryptedfilename[:len(encryptedfilename)-2]+invalidSuffix+" GOCRYPTFS_BAD_NAME", names)
+	}
+
+	// the invalid files should be accessible and deletable through the mount
+	for _, name := range names {
+		if !strings.HasSuffix(name, " GOCRYPTFS_BAD_NAME") {
+			continue
+		}
+		if _, err = os.Lstat(mnt + "/" + name); err != nil {
+			t.Error(err)
+		}
+		if err = syscall.Unlink(mnt + "/" + name); err != nil {
+			t.Error(err)
+		}
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// gocryptfs.conf, gocryptfs.diriv, file
+	if len(entries) != 3 {
+		t.Errorf("invalid files were not deleted from the cipherdir, %d entries left", len(entries))
+	}
+	// the valid file must be unaffected
+	if _, err = os.Stat(file); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestPassfile tests the `-passfile` option
+func TestPassfile(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	passfile1 := mnt + ".1.txt"
+	ioutil.WriteFile(passfile1, []byte("test"), 0600)
+	test_helpers.MountOrFatal(t, dir, mnt, "-passfile="+passfile1)
+	defer test_helpers.UnmountPanic(mnt)
+}
+
+// TestMountHelper tests mounting like mount(8) does for an /etc/fstab entry
+// of type "fuse.gocryptfs"
+func TestMountHelper(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	if err := os.Mkdir(mnt, 0700); err != nil {
+		t.Fatal(err)
+	}
+	passfile := mnt + ".txt"
+	ioutil.WriteFile(passfile, []byte("test"), 0600)
+	bin, err := filepath.Abs(test_helpers.GocryptfsBinary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Mkdir(dir+".sbin", 0700); err != nil {
+		t.Fatal(err)
+	}
+	helper := dir + ".sbin/mount.fuse.gocryptfs"
+	if err = os.Symlink(bin, helper); err != nil {
+		t.Fatal(err)
+	}
+	// "-f" is "fake": check everything, but don't mount
+	cmd := exec.Command(helper, dir, mnt, "-f", "-o", "defaults,passfile="+passfile)
+	cmd.Stderr = os.Stderr
+	if err = cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	var st1, st2 syscall.Stat_t
+	syscall.Stat(mnt, &st1)
+	syscall.Stat(dir, &st2)
+	if st1.Dev != st2.Dev {
+		test_helpers.UnmountPanic(mnt)
+		t.Fatal("fake mount has mounted")
+	}
+	cmd = exec.Command(helper, dir, mnt, "-n", "-o", "rw,noauto,nosyslog,passfile="+passfile, "-t", "fuse.gocryptfs")
+	cmd.Stderr = os.Stderr
+	if err = cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(mnt)
+}
+
+// TestPassfileX2 tests that the `-passfile` option can be passed twice
+func TestPassfileX2(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	passfile1 := mnt + ".1.txt"
+	passfile2 := mnt + ".2.txt"
+	ioutil.WriteFile(passfile1, []byte("te"), 0600)
+	ioutil.WriteFile(passfile2, []byte("st"), 0600)
+	test_helpers.MountOrFatal(t, dir, mnt, "-passfile="+passfile1, "-passfile="+passfile2)
+	defer test_helpers.UnmountPanic(mnt)
+}
+
+// TestInitNotEmpty checks that `gocryptfs -init` returns the right error code
+// if CIPHERDIR is not empty. See https://github.com/rfjakob/gocryptfs/pull/503
+func TestInitNotEmpty(t *testing.T) {
+	dir := test_helpers.TmpDir + "/" + t.Name()
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dir+"/foo", nil, 0700); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-init", "-extpass", "echo test", dir)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	exitCode := test_helpers.ExtractCmdExitCode(err)
+	if exitCode != exitcodes.CipherDir {
+		t.Fatalf("wrong exit code: have=%d, want=%d", exitCode, exitcodes.CipherDir)
+	}
+}
+
+// Test -wipe
+func TestWipe(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	file := dir + "/foo"
+	err := ioutil.WriteFile(file, make([]byte, 10000), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Keep the file open so we can look at the contents after deletion
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-wipe", file)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("file should be gone, stat returned %v", err)
+	}
+	content, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(content) != 10000 {
+		t.Fatalf("wrong length %d", len(content))
+	}
+	if bytes.Equal(content, make([]byte, 10000)) {
+		t.Error("file content has not been overwritten")
+	}
+}
+
+// TestSubdir mounts a subdirectory of CIPHERDIR with -subdir
+func TestSubdir(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	if err := os.MkdirAll(mnt+"/a/b", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(mnt+"/a/b/file", []byte("foo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(mnt)
+
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test", "-subdir=a/b")
+	if content, err := ioutil.ReadFile(mnt + "/file"); err != nil || string(content) != "foo" {
+		t.Errorf("reading file: %q %v", content, err)
+	}
+	if err := ioutil.WriteFile(mnt+"/file2", []byte("bar"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(mnt)
+
+	// Files created through the subdir mount show up in the full mount
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	if content, err := ioutil.ReadFile(mnt + "/a/b/file2"); err != nil || string(content) != "bar" {
+		t.Errorf("reading file2: %q %v", content, err)
+	}
+	test_helpers.UnmountPanic(mnt)
+
+	for _, subdir := range []string{"a/nonexisting", "a/b/file"} {
+		if err := test_helpers.Mount(dir, mnt, false, "-extpass=echo test", "-subdir="+subdir); err == nil {
+			test_helpers.UnmountPanic(mnt)
+			t.Errorf("-subdir=%s: mount should have failed", subdir)
+		}
+	}
+}
+
+// TestMigrateEncfs tests "-migrate-encfs", with a plain directory standing in
+// for the EncFS mount.
+func TestMigrateEncfs(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	src := dir + ".encfs"
+	if err := os.MkdirAll(src+"/a/b", 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(src+"/a/b/file", []byte("foo"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(src+"/a/b/file", src+"/a/link"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("b/file", src+"/a/symlink"); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2010, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(src+"/a/b/file", mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	migrate := func(src string) error {
+		cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-migrate-encfs", src,
+			"-extpass=echo test", dir)
+		cmd.Stderr = os.Stderr
+		return cmd.Run()
+	}
+	if err := migrate(src); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := ioutil.ReadDir(src); err != nil || len(entries) != 0 {
+		t.Errorf("source should be empty, have %d entries, err=%v", len(entries), err)
+	}
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	if content, err := ioutil.ReadFile(mnt + "/a/symlink"); err != nil || string(content) != "foo" {
+		t.Errorf("reading through the symlink: %q %v", content, err)
+	}
+	fi, err := os.Stat(mnt + "/a/b/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	st := fi.Sys().(*syscall.Stat_t)
+	if st.Mode&0777 != 0640 || st.Nlink != 2 || !fi.ModTime().Equal(mtime) {
+		t.Errorf("wrong metadata: mode=%o nlink=%d mtime=%v", st.Mode, st.Nlink, fi.ModTime())
+	}
+	if err := syscall.Stat(mnt+"/a", st); err != nil || st.Mode&0777 != 0750 {
+		t.Errorf("wrong dir mode %o, err=%v", st.Mode, err)
+	}
+	// The encrypted EncFS directory is rejected
+	if err := ioutil.WriteFile(src+"/.encfs6.xml", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	err = migrate(src)
+	if code := test_helpers.ExtractCmdExitCode(err); code != exitcodes.Migrate {
+		t.Errorf("want exit code %d, got %d", exitcodes.Migrate, code)
+	}
+}
+
+// TestMigrateEcryptfs tests "-migrate-ecryptfs", and that a migration can be
+// run again after new files have shown up in the source.
+func TestMigrateEcryptfs(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	src := dir + ".ecryptfs"
+	migrate := func() error {
+		cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-migrate-ecryptfs", src,
+			"-extpass=echo test", dir)
+		cmd.Stderr = os.Stderr
+		return cmd.Run()
+	}
+	// The encrypted eCryptfs directory is rejected
+	if err := os.MkdirAll(src+"/d", 0700); err != nil {
+		t.Fatal(err)
+	}
+	lower := src + "/ECRYPTFS_FNEK_ENCRYPTED.FWbZ"
+	if err := ioutil.WriteFile(lower, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	err := migrate()
+	if code := test_helpers.ExtractCmdExitCode(err); code != exitcodes.Migrate {
+		t.Errorf("want exit code %d, got %d", exitcodes.Migrate, code)
+	}
+	if err = os.Remove(lower); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"f1", "f2"} {
+		// The first run has moved "d" as well
+		if err = os.MkdirAll(src+"/d", 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err = ioutil.WriteFile(src+"/d/"+f, []byte(f), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err = migrate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	for _, f := range []string{"f1", "f2"} {
+		if content, err := ioutil.ReadFile(mnt + "/d/" + f); err != nil || string(content) != f {
+			t.Errorf("reading %q: %q %v", f, content, err)
+		}
+	}
+}
+
+// TestExportImport exports a filesystem with "-export", imports it into a new
+// directory with "-import" and checks that the copy works.
+func TestExportImport(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	longName := strings.Repeat("x", 200)
+	if err := os.MkdirAll(mnt+"/d/"+longName, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(mnt+"/d/file", []byte("foo"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(mnt+"/d/file", mnt+"/d/link"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("file", mnt+"/d/symlink"); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(mnt)
+	run := func(args ...string) error {
+		cmd := exec.Command(test_helpers.GocryptfsBinary, append([]string{"-q"}, args...)...)
+		cmd.Stderr = os.Stderr
+		return cmd.Run()
+	}
+	archive := dir + ".tar"
+	if err := run("-export", archive, dir); err != nil {
+		t.Fatal(err)
+	}
+	// Importing needs an empty directory
+	err := run("-import", archive, dir)
+	if code := test_helpers.ExtractCmdExitCode(err); code != exitcodes.CipherDir {
+		t.Errorf("import into non-empty dir: want exit code %d, got %d", exitcodes.CipherDir, code)
+	}
+	dir2 := dir + ".imported"
+	if err = os.Mkdir(dir2, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = run("-import", archive, dir2); err != nil {
+		t.Fatal(err)
+	}
+	mnt2 := dir2 + ".mnt"
+	test_helpers.MountOrFatal(t, dir2, mnt2, "-extpass=echo test")
+	defer test_helpers.UnmountPanic(mnt2)
+	if content, err := ioutil.ReadFile(mnt2 + "/d/symlink"); err != nil || string(content) != "foo" {
+		t.Errorf("reading through the symlink: %q %v", content, err)
+	}
+	fi, err := os.Stat(mnt2 + "/d/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := fi.Sys().(*syscall.Stat_t); fi.Mode().Perm() != 0640 || st.Nlink != 2 {
+		t.Errorf("wrong metadata: mode=%v nlink=%d", fi.Mode(), st.Nlink)
+	}
+	if _, err = os.Stat(mnt2 + "/d/" + longName); err != nil {
+		t.Error(err)
+	}
+	// Archives cannot write outside of CIPHERDIR
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "s", Typeflag: tar.TypeSymlink, Linkname: "/tmp"})
+	tw.WriteHeader(&tar.Header{Name: "s/evil", Typeflag: tar.TypeReg, Mode: 0600})
+	tw.Close()
+	evil := dir + ".evil.tar"
+	if err = ioutil.WriteFile(evil, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+	dir3 := dir + ".evil"
+	if err = os.Mkdir(dir3, 0700); err != nil {
+		t.Fatal(err)
+	}
+	err = run("-import", evil, dir3)
+	if code := test_helpers.ExtractCmdExitCode(err); code != exitcodes.Archive {
+		t.Errorf("importing through a symlink: want exit code %d, got %d", exitcodes.Archive, code)
+	}
+	if _, err = os.Stat("/tmp/evil"); err == nil {
+		t.Error("/tmp/evil has been created")
+	}
+}
+
+// TestPrefetch reads a file sequentially with "-prefetch", and checks that
+// data written in between is not served from the prefetched blocks.
+func TestPrefetch(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test", "-prefetch=32",
+		"-max_readahead=1048576")
+	defer test_helpers.UnmountPanic(mnt)
+	content := make([]byte, 1000000)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	file := mnt + "/file"
+	if err := ioutil.WriteFile(file, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	readAll := func() []byte {
+		// O_DIRECT so that the kernel sends every read to us
+		fd, err := syscall.Open(file, syscall.O_RDONLY|syscallcompat.O_DIRECT, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer syscall.Close(fd)
+		var out []byte
+		buf := make([]byte, 64*1024)
+		for {
+			n, err := syscall.Read(fd, buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n == 0 {
+				return out
+			}
+			out = append(out, buf[:n]...)
+		}
+	}
+	if !bytes.Equal(readAll(), content) {
+		t.Fatal("content mismatch")
+	}
+	// The first read starts the next prefetch. Change the data in between.
+	fd, err := syscall.Open(file, syscall.O_RDWR|syscallcompat.O_DIRECT, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fd)
+	buf := make([]byte, 64*1024)
+	if _, err = syscall.Pread(fd, buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = syscall.Pwrite(fd, []byte("xxx"), 70000); err != nil {
+		t.Fatal(err)
+	}
+	copy(content[70000:], "xxx")
+	if _, err = syscall.Pread(fd, buf, int64(len(buf))); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, content[len(buf):2*len(buf)]) {
+		t.Error("stale data after write")
+	}
+	if !bytes.Equal(readAll(), content) {
+		t.Error("content mismatch after write")
+	}
+	// -max_readahead raises the readahead through sysfs, if we are root
+	var st syscall.Stat_t
+	if err = syscall.Stat(mnt, &st); err != nil {
+		t.Fatal(err)
+	}
+	ra, err := ioutil.ReadFile(fmt.Sprintf("/sys/class/bdi/%d:%d/read_ahead_kb",
+		unix.Major(uint64(st.Dev)), unix.Minor(uint64(st.Dev))))
+	if err == nil && os.Getuid() == 0 && strings.TrimSpace(string(ra)) != "1024" {
+		t.Errorf("read_ahead_kb=%q, want 1024", ra)
+	}
+}
+
+// With a long -negative_timeout, a file created through the mount must show up
+// even though its name has been looked up before, when it did not exist.
+func TestNegativeTimeout(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test", "-negative_timeout=1h")
+	defer test_helpers.UnmountPanic(mnt)
+	file := mnt + "/file"
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Fatalf("want ENOENT, got %v", err)
+	}
+	if err := ioutil.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(mnt+"/dir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(file, mnt+"/dir/file"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(mnt + "/dir/file"); err != nil {
+		t.Fatal(err)
+	}
+	// Not allowed together
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-extpass=echo test",
+		"-sharedstorage", "-negative_timeout=1s", dir, mnt)
+	err := cmd.Run()
+	exitCode := test_helpers.ExtractCmdExitCode(err)
+	if exitCode != exitcodes.Usage {
+		t.Errorf("wrong exit code: want %d, have %d", exitcodes.Usage, exitCode)
+	}
+}
+
+// With -attr_timeout=0 and -entry_timeout=0, changes made directly in
+// CIPHERDIR must show up right away.
+func TestAttrEntryTimeout(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test", "-attr_timeout=0",
+		"-entry_timeout=0")
+	defer test_helpers.UnmountPanic(mnt)
+	file := mnt + "/file"
+	if err := ioutil.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Fatal(err)
+	}
+	// Find the ciphertext file
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cfile string
+	for _, e := range entries {
+		if e.Name() != "gocryptfs.conf" && e.Name() != "gocryptfs.diriv" {
+			cfile = dir + "/" + e.Name()
+		}
+	}
+	if err = os.Chmod(cfile, 0640); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0640 {
+		t.Errorf("stale mode %v", fi.Mode())
+	}
+	if err = os.Remove(cfile); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("want ENOENT, got %v", err)
+	}
+	// Negative timeouts make no sense
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-extpass=echo test",
+		"-attr_timeout=-1s", dir, mnt)
+	err = cmd.Run()
+	exitCode := test_helpers.ExtractCmdExitCode(err)
+	if exitCode != exitcodes.Usage {
+		t.Errorf("wrong exit code: want %d, have %d", exitcodes.Usage, exitCode)
+	}
+}
+
+// Rmdir must never leave a directory without gocryptfs.diriv behind, even
+// when a file shows up in CIPHERDIR while it runs, and it must not leave
+// temporary files behind either.
+func TestRmdirRace(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	for i := 0; i < 100; i++ {
+		if err := os.Mkdir(mnt+"/d", 0700); err != nil {
+			t.Fatal(err)
+		}
+		// Find the ciphertext directory
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var cDir string
+		for _, e := range entries {
+			if e.IsDir() {
+				cDir = dir + "/" + e.Name()
+			}
+		}
+		done := make(chan struct{})
+		go func() {
+			// Not a valid encrypted name, but it makes the directory non-empty
+			ioutil.WriteFile(cDir+"/foreign", nil, 0600)
+			close(done)
+		}()
+		err = syscall.Rmdir(mnt + "/d")
+		<-done
+		if err == nil {
+			// The rmdir was first, and the file could not be created
+			continue
+		}
+		if err != syscall.ENOTEMPTY {
+			t.Fatal(err)
+		}
+		// The directory must still work
+		if err = ioutil.WriteFile(mnt+"/d/file", nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = os.Stat(mnt + "/d/file"); err != nil {
+			t.Fatal(err)
+		}
+		os.Remove(mnt + "/d/file")
+		os.Remove(cDir + "/foreign")
+		if err = syscall.Rmdir(mnt + "/d"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("leftover files in CIPHERDIR: %v", entries)
+	}
+}
+
+// The mount keeps working on the CIPHERDIR it was started with, even if it is
+// renamed and another directory takes its place.
+func TestCipherdirMoved(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	// Without the dirCache, which would hide the problem
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test", "-dircache=0")
+	defer test_helpers.UnmountPanic(mnt)
+	if err := os.Mkdir(mnt+"/dir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(mnt+"/dir/file1", []byte("1"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	moved := dir + ".moved"
+	if err := os.Rename(dir, moved); err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(moved)
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(mnt+"/dir2", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(mnt+"/dir2/file2", []byte("2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(mnt + "/dir/file1")
+	if err != nil || string(content) != "1" {
+		t.Errorf("reading file1: %q %v", content, err)
+	}
+	if err := syscall.Statfs(mnt, &syscall.Statfs_t{}); err != nil {
+		t.Error(err)
+	}
+	// Everything went into the moved directory
+	if entries, _ := ioutil.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("new directory is not empty: %v", entries)
+	}
+	if entries, _ := ioutil.ReadDir(moved); len(entries) != 4 {
+		t.Errorf("want 4 entries in the moved directory, have %d", len(entries))
+	}
+}
+
+// TestTrash deletes files with -trash-retention and restores and purges them
+// with -trash
+func TestTrash(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test", "-trash-retention=1h")
+	longName := strings.Repeat("x", 200)
+	if err := os.Mkdir(mnt+"/d", 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []string{"file", longName} {
+		if err := ioutil.WriteFile(mnt+"/d/"+n, []byte(n), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Remove(mnt + "/d"); err == nil {
+		t.Error("rmdir of a non-empty directory should fail")
+	}
+	for _, n := range []string{"/d/file", "/d/" + longName, "/d"} {
+		if err := os.Remove(mnt + n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The trash is hidden
+	if entries, _ := ioutil.ReadDir(mnt); len(entries) != 0 {
+		t.Errorf("want an empty root directory, have %v", entries)
+	}
+	test_helpers.UnmountPanic(mnt)
+	run := func(args ...string) (string, error) {
+		args = append([]string{"-q", "-extpass=echo test", "-trash"}, args...)
+		cmd := exec.Command(test_helpers.GocryptfsBinary, args...)
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		return string(out), err
+	}
+	out, err := run("list", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		f := strings.Fields(line)
+		ids[f[len(f)-1]] = f[0]
+	}
+	if len(ids) != 3 || ids["d/"] == "" || ids["d/file"] == "" || ids["d/"+longName] == "" {
+		t.Fatalf("unexpected list output:\n%s", out)
+	}
+	// The parent directory has to come back first
+	_, err = run("restore", dir, ids["d/file"])
+	if code := test_helpers.ExtractCmdExitCode(err); code != exitcodes.Trash {
+		t.Errorf("restore without parent: want exit code %d, got %d", exitcodes.Trash, code)
+	}
+	if _, err = run("restore", dir, ids["d/"], ids["d/"+longName]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = run("purge", dir); err != nil {
+		t.Fatal(err)
+	}
+	if out, _ = run("list", dir); out != "" {
+		t.Errorf("trash should be empty:\n%s", out)
+	}
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	content, err := ioutil.ReadFile(mnt + "/d/" + longName)
+	if err != nil || string(content) != longName {
+		t.Errorf("reading restored file: %q %v", content, err)
+	}
+	if _, err = os.Stat(mnt + "/d/file"); !os.IsNotExist(err) {
+		t.Errorf("purged file should be gone: %v", err)
+	}
+}
+
+// TestTrashRetention checks that the mounted filesystem purges expired
+// entries from the trash
+func TestTrashRetention(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test", "-trash-retention=1s")
+	defer test_helpers.UnmountPanic(mnt)
+	if err := ioutil.WriteFile(mnt+"/file", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(mnt + "/file"); err != nil {
+		t.Fatal(err)
+	}
+	trash := dir + "/gocryptfs.trash"
+	if entries, _ := ioutil.ReadDir(trash); len(entries) != 2 {
+		t.Fatalf("want 2 entries in the trash, have %d", len(entries))
+	}
+	// The ID has a resolution of one second
+	for i := 0; i < 50; i++ {
+		if entries, _ := ioutil.ReadDir(trash); len(entries) == 0 {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Error("the trash has not been purged")
+}
+
+// TestSnapshot creates a snapshot, changes the filesystem and mounts the
+// snapshot
+func TestSnapshot(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	if err := os.Mkdir(mnt+"/d", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(mnt+"/d/file", []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(mnt+"/d/file", mnt+"/d/link"); err != nil {
+		t.Fatal(err)
+	}
+	run := func(args ...string) (string, error) {
+		cmd := exec.Command(test_helpers.GocryptfsBinary, append([]string{"-q", "-snapshot"}, args...)...)
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		return string(out), err
+	}
+	// The filesystem must not be mounted
+	_, err := run("create", dir, "snap")
+	if code := test_helpers.ExtractCmdExitCode(err); code != exitcodes.Snapshot {
+		t.Errorf("snapshot of a mounted filesystem: want exit code %d, got %d", exitcodes.Snapshot, code)
+	}
+	test_helpers.UnmountPanic(mnt)
+	if _, err = run("create", dir, "snap"); err != nil {
+		t.Fatal(err)
+	}
+	if out, _ := run("list", dir); !strings.HasPrefix(out, "snap ") {
+		t.Errorf("unexpected list output: %q", out)
+	}
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	if err = ioutil.WriteFile(mnt+"/d/file", []byte("new"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// The snapshots are hidden
+	if entries, _ := ioutil.ReadDir(mnt); len(entries) != 1 {
+		t.Errorf("want 1 entry in the root directory, have %v", entries)
+	}
+	test_helpers.UnmountPanic(mnt)
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test", "-mount-snapshot=snap")
+	for _, n := range []string{"file", "link"} {
+		content, err := ioutil.ReadFile(mnt + "/d/" + n)
+		if err != nil || string(content) != "old" {
+			t.Errorf("%s in the snapshot: %q %v", n, content, err)
+		}
+	}
+	if err = ioutil.WriteFile(mnt+"/new", nil, 0600); err == nil {
+		t.Error("the snapshot should be mounted read-only")
+	}
+	test_helpers.UnmountPanic(mnt)
+	if _, err = run("delete", dir, "snap"); err != nil {
+		t.Fatal(err)
+	}
+	if out, _ := run("list", dir); out != "" {
+		t.Errorf("snapshot should be gone: %q", out)
+	}
+}
+
+// TestQuota fills the filesystem up to the quota, checks that the usage
+// survives a remount and that -fsck corrects it
+func TestQuota(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test", "-quota=100K")
+	data := make([]byte, 60*1024)
+	if err := ioutil.WriteFile(mnt+"/file1", data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	err := ioutil.WriteFile(mnt+"/file2", data, 0600)
+	if !errors.Is(err, syscall.EDQUOT) {
+		t.Errorf("want EDQUOT, got %v", err)
+	}
+	var st syscall.Statfs_t
+	if err = syscall.Statfs(mnt, &st); err != nil {
+		t.Fatal(err)
+	}
+	if size := st.Blocks * uint64(st.Bsize); size > 100*1024 {
+		t.Errorf("statfs reports %d bytes, more than the quota", size)
+	}
+	// Truncating and deleting frees the quota
+	if err = os.Truncate(mnt+"/file1", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(mnt+"/file2", data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Remove(mnt + "/file2"); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(mnt+"/file1", data[:1000], 0600); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(mnt)
+	readQuota := func() (q struct {
+		Used  int64
+		Clean bool
+	}) {
+		content, err := ioutil.ReadFile(dir + "/gocryptfs.quota")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = json.Unmarshal(content, &q); err != nil {
+			t.Fatal(err)
+		}
+		return q
+	}
+	if q := readQuota(); q.Used != 1000 || !q.Clean {
+		t.Errorf("after unmount: %+v", q)
+	}
+	// -fsck recomputes the usage
+	if err = ioutil.WriteFile(dir+"/gocryptfs.quota", []byte(`{"Used":5,"Clean":true}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-fsck", "-extpass=echo test", dir)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("fsck: %v\n%s", err, out)
+	}
+	if q := readQuota(); q.Used != 1000 {
+		t.Errorf("after fsck: %+v", q)
+	}
+	// The quota file is hidden
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test", "-quota=100K")
+	defer test_helpers.UnmountPanic(mnt)
+	if _, err = os.Stat(mnt + "/file1"); err != nil {
+		t.Error(err)
+	}
+	if entries, _ := ioutil.ReadDir(mnt); len(entries) != 1 {
+		t.Errorf("want 1 entry, have %d", len(entries))
+	}
+	if q := readQuota(); q.Clean {
+		t.Errorf("mounted: %+v", q)
+	}
+}
+
+// TestDirKey gives a directory its own key and checks that it can be
+// mounted by itself with its own password, and that the whole filesystem
+// still shows it
+func TestDirKey(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	for _, d := range []string{"alice", "bob"} {
+		if err := os.Mkdir(mnt+"/"+d, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+	test_helpers.UnmountPanic(mnt)
+	run := func(stdin string, args ...string) (string, error) {
+		cmd := exec.Command(test_helpers.GocryptfsBinary, append([]string{"-q", "-dirkey"}, args...)...)
+		cmd.Stdin = strings.NewReader(stdin)
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		return string(out), err
+	}
+	// Asks for the password of the filesystem, then for the new one
+	if _, err := run("test\nalice\n", "add", "-scryptn=10", dir, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	out, err := run("test\n", "list", dir)
+	fields := strings.Fields(out)
+	if err != nil || len(fields) != 2 || fields[0] != "alice" {
+		t.Fatalf("unexpected list output: %q %v", out, err)
+	}
+	cAlice := fields[1]
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	if err = ioutil.WriteFile(mnt+"/alice/file", []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(mnt+"/bob/file", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := ioutil.ReadDir(mnt + "/alice"); len(entries) != 1 {
+		t.Errorf("want 1 entry in alice, have %v", entries)
+	}
+	err = os.Rename(mnt+"/bob/file", mnt+"/alice/file2")
+	if !errors.Is(err, syscall.EXDEV) {
+		t.Errorf("rename into alice: want EXDEV, got %v", err)
+	}
+	test_helpers.UnmountPanic(mnt)
+	// Mount alice by herself
+	mnt2 := dir + ".alice"
+	if err = test_helpers.Mount(cAlice, mnt2, false, "-extpass=echo test"); err == nil {
+		test_helpers.UnmountPanic(mnt2)
+		t.Fatal("alice should not be mountable with the password of the filesystem")
+	}
+	test_helpers.MountOrFatal(t, cAlice, mnt2, "-extpass=echo alice")
+	content, err := ioutil.ReadFile(mnt2 + "/file")
+	if err != nil || string(content) != "secret" {
+		t.Errorf("file in alice: %q %v", content, err)
+	}
+	test_helpers.UnmountPanic(mnt2)
+	// The key can only be removed from an empty directory
+	if _, err = run("test\n", "remove", dir, "alice"); test_helpers.ExtractCmdExitCode(err) != exitcodes.DirKey {
+		t.Errorf("remove from a non-empty directory: want exit code %d, got %v", exitcodes.DirKey, err)
+	}
+}
+
+// TestDecryptOnly adds a decrypt-only key slot and checks that its password
+// mounts the filesystem read-only and cannot change the password
+func TestDecryptOnly(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	if err := ioutil.WriteFile(mnt+"/file", []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(mnt)
+	run := func(stdin string, args ...string) error {
+		cmd := exec.Command(test_helpers.GocryptfsBinary, append([]string{"-q"}, args...)...)
+		cmd.Stdin = strings.NewReader(stdin)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		return cmd.Run()
+	}
+	if err := run("test\nreader\n", "-decrypt-only", "add", "-scryptn=10", dir); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo reader")
+	content, err := ioutil.ReadFile(mnt + "/file")
+	if err != nil || string(content) != "data" {
+		t.Errorf("reading with the decrypt-only key: %q %v", content, err)
+	}
+	err = ioutil.WriteFile(mnt+"/file2", nil, 0600)
+	if !errors.Is(err, syscall.EROFS) {
+		t.Errorf("writing with the decrypt-only key: want EROFS, got %v", err)
+	}
+	test_helpers.UnmountPanic(mnt)
+	err = run("reader\nnew\n", "-passwd", dir)
+	if code := test_helpers.ExtractCmdExitCode(err); code != exitcodes.PasswordIncorrect {
+		t.Errorf("-passwd with the decrypt-only key: want exit code %d, got %d", exitcodes.PasswordIncorrect, code)
+	}
+	// The password of the filesystem still mounts it read-write
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	if err = ioutil.WriteFile(mnt+"/file2", nil, 0600); err != nil {
+		t.Error(err)
+	}
+	test_helpers.UnmountPanic(mnt)
+	if err = run("test\n", "-decrypt-only", "remove", dir); err != nil {
+		t.Fatal(err)
+	}
+	if err = test_helpers.Mount(dir, mnt, false, "-extpass=echo reader"); err == nil {
+		test_helpers.UnmountPanic(mnt)
+		t.Error("the decrypt-only key slot should be gone")
+	}
+}
+
+// TestDuress checks that the duress password mounts the decoy or an empty
+// volume, and starts the hook
+func TestDuress(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	decoy := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, decoy, mnt, "-extpass=echo test")
+	if err := ioutil.WriteFile(mnt+"/decoy", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(mnt)
+	run := func(stdin string, args ...string) error {
+		cmd := exec.Command(test_helpers.GocryptfsBinary, append([]string{"-q"}, args...)...)
+		cmd.Stdin = strings.NewReader(stdin)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		return cmd.Run()
+	}
+	// The duress password must differ from the real one
+	err := run("test\ntest\ntest\ntest\n", "-duress", "add", "-scryptn=10", dir, decoy)
+	if code := test_helpers.ExtractCmdExitCode(err); code != exitcodes.Usage {
+		t.Errorf("reusing the password: want exit code %d, got %d", exitcodes.Usage, code)
+	}
+	hook := dir + ".hook"
+	err = run("test\ntest\nduress\nduress\n", "-duress", "add", "-scryptn=10", "-duress-hook", "touch "+hook, dir, decoy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo duress")
+	if _, err = os.Stat(mnt + "/decoy"); err != nil {
+		t.Errorf("the decoy is not mounted: %v", err)
+	}
+	test_helpers.UnmountPanic(mnt)
+	// The hook runs in the background
+	for i := 0; i < 50; i++ {
+		if _, err = os.Stat(hook); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		t.Errorf("the hook did not run: %v", err)
+	}
+	err = run("duress\nnew\n", "-passwd", dir)
+	if code := test_helpers.ExtractCmdExitCode(err); code != exitcodes.PasswordIncorrect {
+		t.Errorf("-passwd with the duress password: want exit code %d, got %d", exitcodes.PasswordIncorrect, code)
+	}
+	// Without a decoy, it mounts an empty volume
+	if err = run("test\nempty\nempty\n", "-duress", "add", "-scryptn=10", dir); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo empty")
+	entries, err := ioutil.ReadDir(mnt)
+	if err != nil || len(entries) != 0 {
+		t.Errorf("the empty volume is not empty: %v %v", entries, err)
+	}
+	if err = ioutil.WriteFile(mnt+"/file", nil, 0600); err != nil {
+		t.Error(err)
+	}
+	test_helpers.UnmountPanic(mnt)
+	// The real password still mounts CIPHERDIR
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	if _, err = os.Stat(mnt + "/file"); err == nil {
+		t.Error("a file of the empty volume shows up in CIPHERDIR")
+	}
+	test_helpers.UnmountPanic(mnt)
+	if err = run("test\n", "-duress", "remove", dir); err != nil {
+		t.Fatal(err)
+	}
+	if err = test_helpers.Mount(dir, mnt, false, "-extpass=echo empty"); err == nil {
+		test_helpers.UnmountPanic(mnt)
+		t.Error("the duress key slot should be gone")
+	}
+}
+
+// TestShred checks that -shred overwrites file contents, .name files,
+// gocryptfs.diriv and files that are replaced by a rename
+func TestShred(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-shred", "-extpass=echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	// newBacking runs "create" and returns the new entries in CIPHERDIR
+	newBacking := func(create func() error) (names []string) {
+		before, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = create(); err != nil {
+			t.Fatal(err)
+		}
+		after, err := ioutil.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		old := make(map[string]bool)
+		for _, e := range before {
+			old[e.Name()] = true
+		}
+		for _, e := range after {
+			if !old[e.Name()] {
+				names = append(names, dir+"/"+e.Name())
+			}
+		}
+		return names
+	}
+	// Keep the backing files open and remember their content
+	files := make(map[string]*os.File)
+	content := make(map[string][]byte)
+	watch := func(path string) {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[path] = f
+		if content[path], err = ioutil.ReadAll(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	long := strings.Repeat("x", 200)
+	for _, p := range newBacking(func() error { return ioutil.WriteFile(mnt+"/"+long, []byte("secret"), 0600) }) {
+		watch(p)
+	}
+	var d string
+	for _, p := range newBacking(func() error { return os.Mkdir(mnt+"/d", 0700) }) {
+		d = p
+	}
+	watch(d + "/gocryptfs.diriv")
+	for _, p := range newBacking(func() error { return ioutil.WriteFile(mnt+"/target", []byte("secret"), 0600) }) {
+		watch(p)
+	}
+	if len(files) != 4 {
+		t.Fatalf("want 4 backing files, got %v", content)
+	}
+	if err := ioutil.WriteFile(mnt+"/source", []byte("new"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(mnt + "/" + long); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(mnt + "/d"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(mnt+"/source", mnt+"/target"); err != nil {
+		t.Fatal(err)
+	}
+	for path, f := range files {
+		after := make([]byte, len(content[path]))
+		if _, err := f.ReadAt(after, 0); err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(content[path], after) {
+			t.Errorf("%q was not overwritten", path)
+		}
+		f.Close()
+	}
+	c, err := ioutil.ReadFile(mnt + "/target")
+	if err != nil || string(c) != "new" {
+		t.Errorf("target: %q %v", c, err)
+	}
+}
+
+// TestLock tests "-lock" and "-unlock", including the key of a "-dirkey"
+// subtree, which is derived from the master key
+func TestLock(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	if err := os.Mkdir(mnt+"/sub", 0700); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(mnt)
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-dirkey", "add", "-scryptn=10", dir, "sub")
+	cmd.Stdin = strings.NewReader("test\nsub\n")
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	for _, f := range []string{"/file", "/sub/file"} {
+		if err := ioutil.WriteFile(mnt+f, []byte("content"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	run := func(stdin string, args ...string) error {
+		cmd := exec.Command(test_helpers.GocryptfsBinary, append([]string{"-q"}, args...)...)
+		cmd.Stdin = strings.NewReader(stdin)
+		cmd.Stderr = os.Stderr
+		return cmd.Run()
+	}
+	// Reading the lock xattr, like a size probe, does not lock the mount
+	if _, err := unix.Getxattr(mnt, "user.gocryptfs.lock", nil); err == nil {
+		t.Error("the lock xattr exists on an unlocked mount")
+	}
+	if _, err := ioutil.ReadFile(mnt + "/file"); err != nil {
+		t.Fatalf("getxattr locked the mount: %v", err)
+	}
+	// Let the kernel cache the content, attributes and name of the file
+	fd, err := os.Open(mnt + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fd.Close()
+	buf := make([]byte, 7)
+	if _, err = fd.ReadAt(buf, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(mnt + "/file"); err != nil {
+		t.Fatal(err)
+	}
+	// The cipherdir works as well
+	if err = run("", "-lock", dir); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"/file", "/sub/file"} {
+		if _, err := ioutil.ReadFile(mnt + f); !errors.Is(err, syscall.EACCES) {
+			t.Errorf("%s: want EACCES, got %v", f, err)
+		}
+	}
+	// The kernel caches have been dropped
+	if _, err = fd.ReadAt(buf, 0); !errors.Is(err, syscall.EACCES) {
+		t.Errorf("read from an open file: want EACCES, got %v", err)
+	}
+	if _, err = os.Stat(mnt + "/file"); !errors.Is(err, syscall.EACCES) {
+		t.Errorf("stat: want EACCES, got %v", err)
+	}
+	err = run("wrong\n", "-unlock", mnt)
+	if code := test_helpers.ExtractCmdExitCode(err); code != exitcodes.PasswordIncorrect {
+		t.Errorf("wrong password: want exit code %d, got %d", exitcodes.PasswordIncorrect, code)
+	}
+	// The password of the subtree cannot unlock the filesystem
+	if err = run("sub\n", "-unlock", mnt); err == nil {
+		t.Error("the subtree password was accepted")
+	}
+	if err = run("test\n", "-unlock", mnt); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"/file", "/sub/file"} {
+		content, err := ioutil.ReadFile(mnt + f)
+		if err != nil || string(content) != "content" {
+			t.Errorf("%s after -unlock: %q %v", f, content, err)
+		}
+	}
+}
+
+// TestMaxThreads works through the mount with "-max_threads=1" while a
+// request waits for a file lock, which must not take the only slot.
+func TestMaxThreads(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test", "-max_threads=1", "-max_background=32")
+	defer test_helpers.UnmountPanic(mnt)
+	file := mnt + "/file"
+	if err := ioutil.WriteFile(file, []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	f1, err := os.OpenFile(file, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f1.Close()
+	f2, err := os.OpenFile(file, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f2.Close()
+	if err = syscall.Flock(int(f1.Fd()), syscall.LOCK_EX); err != nil {
+		t.Fatal(err)
+	}
+	locked := make(chan error)
+	go func() {
+		locked <- syscall.Flock(int(f2.Fd()), syscall.LOCK_EX)
+	}()
+	// Many requests in parallel while the lock request waits
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("%s/f%d", mnt, i)
+			content := bytes.Repeat([]byte{byte(i)}, 300000)
+			if err := ioutil.WriteFile(name, content, 0600); err != nil {
+				t.Error(err)
+				return
+			}
+			have, err := ioutil.ReadFile(name)
+			if err != nil || !bytes.Equal(have, content) {
+				t.Errorf("%s: content mismatch, err=%v", name, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	select {
+	case err = <-locked:
+		t.Fatalf("flock returned early: %v", err)
+	default:
+	}
+	if err = syscall.Flock(int(f1.Fd()), syscall.LOCK_UN); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err = <-locked:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("flock did not get the lock")
+	}
+}
+
+// TestStatfsOverhead checks that statfs on the mount reports the size of
+// the backing filesystem minus the encryption overhead
+func TestStatfsOverhead(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass=echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	var cst, pst syscall.Statfs_t
+	if err := syscall.Statfs(dir, &cst); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Statfs(mnt, &pst); err != nil {
+		t.Fatal(err)
+	}
+	csize := cst.Blocks * uint64(cst.Bsize)
+	psize := pst.Blocks * uint64(pst.Bsize)
+	// 4096 plaintext bytes take 4128 bytes on disk
+	want := csize / 4128 * 4096
+	if psize > want || psize+2*4096 < want {
+		t.Errorf("statfs reports %d bytes for %d bytes of backing storage, want about %d", psize, csize, want)
+	}
+}
+
+// TestMultiMount mounts two filesystems with one gocryptfs process
+func TestMultiMount(t *testing.T) {
+	dir1 := test_helpers.InitFS(t)
+	dir2 := test_helpers.InitFS(t)
+	mnt1 := dir1 + ".mnt"
+	mnt2 := dir2 + ".mnt"
+	if err := os.Mkdir(mnt2, 0700); err != nil {
+		t.Fatal(err)
+	}
+	// Mount() appends "dir1 mnt1" after the extra arguments
+	test_helpers.MountOrFatal(t, dir1, mnt1, "-extpass=echo test", dir2, mnt2)
+	test_helpers.MountInfo[mnt2] = test_helpers.MountInfo[mnt1]
+	if err := ioutil.WriteFile(mnt1+"/file1", []byte("foo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(mnt2+"/file2", []byte("bar"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(mnt2 + "/file1"); !os.IsNotExist(err) {
+		t.Errorf("file1 should only exist in mnt1, have %v", err)
+	}
+	// Unmounting one filesystem leaves the other one running
+	test_helpers.UnmountPanic(mnt1)
+	if content, err := ioutil.ReadFile(mnt2 + "/file2"); err != nil || string(content) != "bar" {
+		t.Errorf("reading file2: %q %v", content, err)
+	}
+	pid := test_helpers.MountInfo[mnt2].Pid
+	test_helpers.UnmountPanic(mnt2)
+	// The process exits after the last unmount
+	for i := 0; syscall.Kill(pid, 0) == nil; i++ {
+		if i == 100 {
+			t.Fatalf("process %d still running after all unmounts", pid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Odd number of arguments
+	if err := test_helpers.Mount(dir1, mnt1, false, "-extpass=echo test", dir2); err == nil {
+		test_helpers.UnmountPanic(mnt1)
+		t.Error("mount with three arguments should have failed")
 	}
 }
@@ -1,6 +1,7 @@
 package defaults
 
 import (
+	"errors"
 	"os"
 	"syscall"
 	"testing"
@@ -96,3 +97,76 @@ func TestCtlSockDecryptCrash(t *testing.T) {
 	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test")
 	defer test_helpers.UnmountPanic(pDir)
 }
+
+func TestCtlSockStats(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+	f, err := os.Create(pDir + "/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err = f.Write(make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	response := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{Stats: true})
+	s := response.Stats
+	if response.ErrNo != 0 || s == nil {
+		t.Fatalf("got an error reply: %+v", response)
+	}
+	if s.OpenFiles != 1 || s.BytesWritten != 100 || s.Seconds <= 0 || s.DirCacheSize == 0 {
+		t.Errorf("unexpected stats: %+v", s)
+	}
+	// Stats cannot be combined with a path
+	response = test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{Stats: true, EncryptPath: "foo"})
+	if response.ErrNo == 0 || response.Stats != nil {
+		t.Errorf("ambiguous request was accepted: %+v", response)
+	}
+}
+
+// Lock wipes the keys, Unlock brings them back. Files that were open before
+// stay usable afterwards.
+func TestCtlSockLock(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+	f, err := os.Create(pDir + "/foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	response := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{Lock: true})
+	if response.ErrNo != 0 {
+		t.Fatalf("got an error reply: %+v", response)
+	}
+	if _, err = f.Write([]byte("x")); !errors.Is(err, syscall.EACCES) {
+		t.Errorf("write while locked: want EACCES, got %v", err)
+	}
+	if _, err = os.Open(pDir + "/foo"); !errors.Is(err, syscall.EACCES) {
+		t.Errorf("open while locked: want EACCES, got %v", err)
+	}
+	response = test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{EncryptPath: "foo"})
+	if response.ErrNo != int32(syscall.EACCES) {
+		t.Errorf("EncryptPath while locked: want EACCES, got %+v", response)
+	}
+	response = test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{Unlock: "wrong"})
+	if response.ErrNo == 0 {
+		t.Errorf("wrong password was accepted: %+v", response)
+	}
+	response = test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{Unlock: "test"})
+	if response.ErrNo != 0 {
+		t.Fatalf("got an error reply: %+v", response)
+	}
+	if _, err = f.Write([]byte("x")); err != nil {
+		t.Errorf("write after unlock: %v", err)
+	}
+	response = test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{Lock: true, Stats: true})
+	if response.ErrNo == 0 {
+		t.Errorf("ambiguous request was accepted: %+v", response)
+	}
+}
@@ -295,6 +295,48 @@ func TestSeekData(t *testing.T) {
 	f.Close()
 }
 
+// TestSeekHole checks that SEEK_HOLE finds a hole between two data sections,
+// and never returns its own input offset when that offset is in data. That
+// would make "cp --sparse=auto" loop forever.
+func TestSeekHole(t *testing.T) {
+	fn := filepath.Join(test_helpers.DefaultPlainDir, t.Name())
+	f, err := os.Create(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var oneMiB int64 = 1024 * 1024
+	if _, err = f.WriteAt([]byte("foo"), 5000); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteAt([]byte("bar"), 10*oneMiB); err != nil {
+		t.Fatal(err)
+	}
+	const SEEK_DATA = 3
+	const SEEK_HOLE = 4
+	hole, err := f.Seek(0, SEEK_HOLE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hole <= 5000 || hole > oneMiB {
+		t.Errorf("SEEK_HOLE: hole=%d, expected between 5000 and %d", hole, oneMiB)
+	}
+	data, err := f.Seek(hole, SEEK_DATA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data < 9*oneMiB || data > 10*oneMiB {
+		t.Errorf("SEEK_DATA: data=%d, expected close to %d", data, 10*oneMiB)
+	}
+	hole, err = f.Seek(data, SEEK_HOLE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hole != 10*oneMiB+3 {
+		t.Errorf("SEEK_HOLE at the end: hole=%d, expected=%d", hole, 10*oneMiB+3)
+	}
+}
+
 /*
 TestMd5sumMaintainers tries to repro this interesting
 bug that was seen during gocryptfs v2.0 development:
@@ -2,6 +2,8 @@ package fsck
 
 import (
 	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"runtime"
@@ -49,6 +51,37 @@ func TestBrokenFsV14(t *testing.T) {
 	}
 }
 
+// TestBrokenFsV14JSON checks the "-fsck -json" report
+func TestBrokenFsV14JSON(t *testing.T) {
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-fsck", "-json", "-extpass", "echo test", "broken_fs_v1.4")
+	outBin, err := cmd.Output()
+	code := test_helpers.ExtractCmdExitCode(err)
+	if code != exitcodes.FsckErrors {
+		t.Errorf("wrong exit code, have=%d want=%d", code, exitcodes.FsckErrors)
+	}
+	// Every line of stdout must be a report entry
+	status := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(string(outBin)), "\n") {
+		var d struct {
+			Path    string
+			Status  string
+			Message string
+		}
+		if err := json.Unmarshal([]byte(line), &d); err != nil {
+			t.Fatalf("invalid report line %q: %v", line, err)
+		}
+		status[d.Path] = d.Status
+	}
+	for _, p := range []string{"corrupt_file", "missing_diriv", "diriv_too_short", "corrupt_symlink", "invalid_file_name.3"} {
+		if status[p] != "corrupt" {
+			t.Errorf("%q: want status corrupt, have %q", p, status[p])
+		}
+	}
+	if _, ok := status["xattr_good"]; ok {
+		t.Errorf("xattr_good should not be reported")
+	}
+}
+
 func TestExampleFses(t *testing.T) {
 	dirfd, err := os.Open("../example_filesystems")
 	if err != nil {
@@ -126,3 +159,80 @@ func TestTerabyteFile(t *testing.T) {
 	cmd.Wait()
 	timer.Stop()
 }
+
+// TestFixMissingDirIV deletes a gocryptfs.diriv file and checks that
+// "-fsck -fix" makes the directory readable again.
+func TestFixMissingDirIV(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	if err := os.MkdirAll(pDir+"/dir1/sub", 0700); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"dir1/a":                           "hello",
+		"dir1/" + strings.Repeat("x", 200): "long",
+		"dir1/sub/c":                       "world",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(pDir+"/"+name, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	test_helpers.UnmountPanic(pDir)
+	// dir1 is the only directory in the root
+	entries, err := ioutil.ReadDir(cDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.IsDir() {
+			if err := syscall.Unlink(cDir + "/" + e.Name() + "/gocryptfs.diriv"); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	fsck := func(args ...string) (string, int) {
+		args = append([]string{"-fsck", "-extpass", "echo test"}, args...)
+		out, err := exec.Command(test_helpers.GocryptfsBinary, append(args, cDir)...).CombinedOutput()
+		return string(out), test_helpers.ExtractCmdExitCode(err)
+	}
+	if out, code := fsck(); code != exitcodes.FsckErrors || !strings.Contains(out, "gocryptfs.diriv is missing") {
+		t.Errorf("without -fix: code=%d\n%s", code, out)
+	}
+	if out, code := fsck("-fix"); code != 0 || !strings.Contains(out, "renamed 3 entries") {
+		t.Errorf("with -fix: code=%d\n%s", code, out)
+	}
+	if out, code := fsck(); code != 0 {
+		t.Errorf("after -fix: code=%d\n%s", code, out)
+	}
+
+	// The entries have new names, but the content is still there
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+	names, err := ioutil.ReadDir(pDir + "/dir1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	have := make(map[string]bool)
+	for _, fi := range names {
+		if !strings.HasPrefix(fi.Name(), "recovered-") {
+			t.Errorf("unexpected name %q", fi.Name())
+		}
+		if fi.IsDir() {
+			if _, err := os.Stat(pDir + "/dir1/" + fi.Name() + "/c"); err != nil {
+				t.Error(err)
+			}
+			continue
+		}
+		content, err := ioutil.ReadFile(pDir + "/dir1/" + fi.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		have[string(content)] = true
+	}
+	if len(names) != 3 || !have["hello"] || !have["long"] {
+		t.Errorf("wrong directory content: %d entries, file contents %v", len(names), have)
+	}
+}
@@ -0,0 +1,77 @@
+package matrix
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// TestCopyFileRange copies between files on the mount with unaligned offsets,
+// past the end of the output file, and past the end of the input file.
+func TestCopyFileRange(t *testing.T) {
+	fnIn := test_helpers.DefaultPlainDir + "/TestCopyFileRange.in"
+	fnOut := test_helpers.DefaultPlainDir + "/TestCopyFileRange.out"
+	content := make([]byte, 300000)
+	rand.Read(content)
+	if err := os.WriteFile(fnIn, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Unlink(fnIn)
+	defer syscall.Unlink(fnOut)
+	fIn, err := os.Open(fnIn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fIn.Close()
+	fOut, err := os.Create(fnOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fOut.Close()
+	copyRange := func(offIn int64, offOut int64, length int) int {
+		t.Helper()
+		var total int
+		for total < length {
+			n, err := unix.CopyFileRange(int(fIn.Fd()), &offIn, int(fOut.Fd()), &offOut, length-total, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n == 0 {
+				break
+			}
+			total += n
+		}
+		return total
+	}
+	// Unaligned, starting past the end of the (empty) output file
+	if n := copyRange(1000, 5000, 250000); n != 250000 {
+		t.Errorf("copied %d bytes, want 250000", n)
+	}
+	want := make([]byte, 5000)
+	want = append(want, content[1000:251000]...)
+	have, err := os.ReadFile(fnOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(have, want) {
+		t.Errorf("content mismatch after first copy: have %d bytes, want %d", len(have), len(want))
+	}
+	// Overwrite in the middle, reading up to the end of the input file
+	if n := copyRange(290000, 7000, 20000); n != 10000 {
+		t.Errorf("copied %d bytes, want 10000", n)
+	}
+	copy(want[7000:], content[290000:])
+	have, err = os.ReadFile(fnOut)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(have, want) {
+		t.Errorf("content mismatch after second copy: have %d bytes, want %d", len(have), len(want))
+	}
+}
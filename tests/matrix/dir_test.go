@@ -2,7 +2,9 @@ package matrix
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
+	"strings"
 	"syscall"
 	"testing"
 
@@ -48,3 +50,37 @@ func TestRmdirPerms(t *testing.T) {
 		}
 	}
 }
+
+// The attributes that READDIRPLUS returns together with the names must be
+// the same as a normal lookup gets
+func TestReaddirAttr(t *testing.T) {
+	dir := test_helpers.DefaultPlainDir + "/TestReaddirAttr"
+	if err := os.Mkdir(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int64{
+		"short":                  1234,
+		strings.Repeat("x", 200): 5,
+	}
+	for name, size := range want {
+		if err := ioutil.WriteFile(dir+"/"+name, make([]byte, size), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("target", dir+"/link"); err != nil {
+		t.Fatal(err)
+	}
+	want["link"] = int64(len("target"))
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("want %d entries, got %d", len(want), len(entries))
+	}
+	for _, e := range entries {
+		if e.Size() != want[e.Name()] {
+			t.Errorf("%q: want size %d, got %d", e.Name(), want[e.Name()], e.Size())
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package matrix
 
 import (
+	"bytes"
 	"os"
 	"runtime"
 	"syscall"
@@ -33,6 +34,8 @@ func isWellKnownFS(fn string) bool {
 
 const FALLOC_DEFAULT = 0x00
 const FALLOC_FL_KEEP_SIZE = 0x01
+const FALLOC_FL_PUNCH_HOLE = 0x02
+const FALLOC_FL_ZERO_RANGE = 0x10
 
 func TestFallocate(t *testing.T) {
 	if runtime.GOOS == "darwin" {
@@ -173,3 +176,77 @@ func TestFallocate(t *testing.T) {
 		t.Skipf("backing fs is not ext4 or tmpfs, skipped some disk-usage checks\n")
 	}
 }
+
+// TestFallocateZero tests hole punching and zeroing ranges that start and end
+// in the middle of blocks
+func TestFallocateZero(t *testing.T) {
+	if runtime.GOOS == "darwin" {
+		t.Skipf("OSX does not support fallocate")
+	}
+	fn := test_helpers.DefaultPlainDir + "/TestFallocateZero"
+	want := make([]byte, 4*4096+100)
+	for i := range want {
+		want[i] = byte(i%255 + 1)
+	}
+	if err := os.WriteFile(fn, want, 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Unlink(fn)
+	f, err := os.OpenFile(fn, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fd := int(f.Fd())
+	check := func() {
+		t.Helper()
+		have, err := os.ReadFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(have, want) {
+			t.Errorf("content mismatch: have %d bytes, want %d bytes", len(have), len(want))
+		}
+	}
+	zero := func(off, sz int) {
+		for i := off; i < off+sz && i < len(want); i++ {
+			want[i] = 0
+		}
+	}
+	// Partial first block, two full blocks, partial fourth block
+	err = syscallcompat.Fallocate(fd, FALLOC_FL_PUNCH_HOLE|FALLOC_FL_KEEP_SIZE, 1000, 2*4096+500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zero(1000, 2*4096+500)
+	check()
+	// Inside a single block
+	err = syscallcompat.Fallocate(fd, FALLOC_FL_PUNCH_HOLE|FALLOC_FL_KEEP_SIZE, 3*4096+10, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zero(3*4096+10, 20)
+	check()
+	// The partial last block, past the end of the file
+	err = syscallcompat.Fallocate(fd, FALLOC_FL_PUNCH_HOLE|FALLOC_FL_KEEP_SIZE, 4*4096+50, 10000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zero(4*4096+50, 10000)
+	check()
+	// Zero range that grows the file
+	err = syscallcompat.Fallocate(fd, FALLOC_FL_ZERO_RANGE, 4096, 5*4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zero(4096, 5*4096)
+	want = append(want, make([]byte, 6*4096-len(want))...)
+	check()
+	// Modes we do not implement should be rejected, not ignored
+	const FALLOC_FL_COLLAPSE_RANGE = 0x08
+	err = syscallcompat.Fallocate(fd, FALLOC_FL_COLLAPSE_RANGE, 0, 4096)
+	if err == nil {
+		t.Error("FALLOC_FL_COLLAPSE_RANGE should have failed")
+	}
+	check()
+}
@@ -0,0 +1,153 @@
+package matrix
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
+)
+
+// cipherPath returns the path of the backing file of "plainPath", found by
+// inode number.
+func cipherPath(t *testing.T, plainPath string) string {
+	var st syscall.Stat_t
+	if err := syscall.Stat(plainPath, &st); err != nil {
+		t.Fatal(err)
+	}
+	var found string
+	filepath.Walk(test_helpers.DefaultCipherDir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Sys().(*syscall.Stat_t).Ino == st.Ino {
+			found = path
+		}
+		return nil
+	})
+	if found == "" {
+		t.Fatalf("backing file of %q not found", plainPath)
+	}
+	return found
+}
+
+// TestFlock checks that flock(2) locks exclude each other and are held on the
+// backing file.
+func TestFlock(t *testing.T) {
+	fn := test_helpers.DefaultPlainDir + "/TestFlock"
+	if err := os.WriteFile(fn, []byte("foo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Unlink(fn)
+	f1, err := os.Open(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f1.Close()
+	f2, err := os.Open(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f2.Close()
+	cf, err := os.Open(cipherPath(t, fn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cf.Close()
+
+	if err := syscall.Flock(int(f1.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Flock(int(f2.Fd()), syscall.LOCK_SH|syscall.LOCK_NB); err != syscall.EWOULDBLOCK {
+		t.Errorf("second flock: want EWOULDBLOCK, have %v", err)
+	}
+	if err := syscall.Flock(int(cf.Fd()), syscall.LOCK_SH|syscall.LOCK_NB); err != syscall.EWOULDBLOCK {
+		t.Errorf("flock on backing file: want EWOULDBLOCK, have %v", err)
+	}
+	// A blocking flock must wait until the lock is released
+	done := make(chan error)
+	go func() {
+		done <- syscall.Flock(int(f2.Fd()), syscall.LOCK_SH)
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("blocking flock returned early: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := syscall.Flock(int(f1.Fd()), syscall.LOCK_UN); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("blocking flock: %v", err)
+	}
+}
+
+// TestPosixLocks checks fcntl(2) record locks. Open file description locks on
+// two file descriptors stand in for two processes.
+func TestPosixLocks(t *testing.T) {
+	fn := test_helpers.DefaultPlainDir + "/TestPosixLocks"
+	if err := os.WriteFile(fn, make([]byte, 100), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Unlink(fn)
+	f1, err := os.OpenFile(fn, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f2, err := os.OpenFile(fn, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f2.Close()
+	cf, err := os.OpenFile(cipherPath(t, fn), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cf.Close()
+
+	wrlck := func(start int64, len int64) *unix.Flock_t {
+		return &unix.Flock_t{Type: unix.F_WRLCK, Whence: 0, Start: start, Len: len}
+	}
+	// Process-associated lock on bytes 10-19
+	if err := unix.FcntlFlock(f1.Fd(), unix.F_SETLK, wrlck(10, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.FcntlFlock(f2.Fd(), unix.F_OFD_SETLK, wrlck(15, 10)); err != syscall.EAGAIN {
+		t.Errorf("overlapping lock: want EAGAIN, have %v", err)
+	}
+	if err := unix.FcntlFlock(f2.Fd(), unix.F_OFD_SETLK, wrlck(20, 10)); err != nil {
+		t.Errorf("adjacent lock: %v", err)
+	}
+	lk := wrlck(0, 0)
+	if err := unix.FcntlFlock(f2.Fd(), unix.F_OFD_GETLK, lk); err != nil {
+		t.Fatal(err)
+	}
+	if lk.Type != unix.F_WRLCK || lk.Start != 10 || lk.Len != 10 {
+		t.Errorf("F_OFD_GETLK: have type=%d start=%d len=%d, want the lock on 10-19", lk.Type, lk.Start, lk.Len)
+	}
+	// The locks are held on the backing file
+	if err := unix.FcntlFlock(cf.Fd(), unix.F_OFD_SETLK, wrlck(0, 0)); err != syscall.EAGAIN {
+		t.Errorf("lock on backing file: want EAGAIN, have %v", err)
+	}
+	// A blocking lock must wait until the conflicting lock goes away. Closing
+	// any file descriptor releases the POSIX locks of the process.
+	done := make(chan error)
+	go func() {
+		done <- unix.FcntlFlock(f2.Fd(), unix.F_OFD_SETLKW, wrlck(0, 20))
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("blocking lock returned early: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	f1.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("blocking lock: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("closing the file did not release the lock")
+	}
+}
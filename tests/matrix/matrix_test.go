@@ -17,16 +17,19 @@ import (
 	"fmt"
 	"io/ioutil"
 	"math/rand"
+	"net"
 	"os"
 	"os/exec"
 	"runtime"
 	"sync"
 	"syscall"
 	"testing"
+	"time"
 
 	"golang.org/x/sys/unix"
 
 	"github.com/rfjakob/gocryptfs/internal/stupidgcm"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/tests/test_helpers"
 )
 
@@ -308,6 +311,79 @@ func TestFileHoles(t *testing.T) {
 	}
 }
 
+// TestODirect checks that files can be opened with O_DIRECT, and that
+// unaligned accesses work
+func TestODirect(t *testing.T) {
+	fn := test_helpers.DefaultPlainDir + "/TestODirect"
+	f, err := os.OpenFile(fn, os.O_RDWR|os.O_CREATE|syscallcompat.O_DIRECT, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	want := make([]byte, 10000)
+	rand.Read(want)
+	if _, err = f.WriteAt(want[1:], 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteAt(want[:1], 0); err != nil {
+		t.Fatal(err)
+	}
+	have := make([]byte, len(want)+100)
+	n, err := f.ReadAt(have, 0)
+	if n != len(want) {
+		t.Fatalf("read %d bytes, want %d: %v", n, len(want), err)
+	}
+	if !bytes.Equal(have[:n], want) {
+		t.Error("content mismatch")
+	}
+}
+
+// TestMmapShared checks that writes through a shared writable mapping reach
+// the file, including the partial last page
+func TestMmapShared(t *testing.T) {
+	fn := test_helpers.DefaultPlainDir + "/TestMmapShared"
+	f, err := os.Create(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	const sz = 3*4096 + 123
+	if err = f.Truncate(sz); err != nil {
+		t.Fatal(err)
+	}
+	m, err := unix.Mmap(int(f.Fd()), 0, sz, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rand.Read(m)
+	want := append([]byte{}, m...)
+	if err = unix.Msync(m, unix.MS_SYNC); err != nil {
+		t.Fatal(err)
+	}
+	// Visible through another file descriptor after msync
+	have, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(have, want) {
+		t.Error("content mismatch after msync")
+	}
+	// Modify a single page and let munmap + close write it back
+	copy(m[5000:], "hello")
+	copy(want[5000:], "hello")
+	if err = unix.Munmap(m); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	have, err = ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(have, want) {
+		t.Error("content mismatch after munmap")
+	}
+}
+
 // sContains - does the slice of strings "haystack" contain "needle"?
 func sContains(haystack []string, needle string) bool {
 	for _, element := range haystack {
@@ -619,6 +695,58 @@ func TestLongLink(t *testing.T) {
 	}
 }
 
+// Hard links share the content, and the size reported for the new link must
+// be the plaintext size. Appending through the new link used to write at the
+// ciphertext size, leaving a hole.
+func TestHardlink(t *testing.T) {
+	wd := test_helpers.DefaultPlainDir + "/"
+	target := wd + "TestHardlink.target"
+	if err := ioutil.WriteFile(target, []byte("hello\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	link := wd + "TestHardlink.link"
+	if err := os.Link(target, link); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(link, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteString("world\n")
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "hello\nworld\n" {
+		t.Errorf("wrong content: %q", content)
+	}
+	var st1, st2 syscall.Stat_t
+	if err = syscall.Stat(target, &st1); err != nil {
+		t.Fatal(err)
+	}
+	if err = syscall.Stat(link, &st2); err != nil {
+		t.Fatal(err)
+	}
+	if st1.Ino != st2.Ino || st1.Nlink != 2 {
+		t.Errorf("ino %d vs %d, nlink %d", st1.Ino, st2.Ino, st1.Nlink)
+	}
+	// The content survives deleting the original name
+	if err = syscall.Unlink(target); err != nil {
+		t.Fatal(err)
+	}
+	content, err = ioutil.ReadFile(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "hello\nworld\n" {
+		t.Errorf("wrong content after unlink: %q", content)
+	}
+}
+
 func TestLchown(t *testing.T) {
 	name := test_helpers.DefaultPlainDir + "/symlink"
 	err := os.Symlink("/target/does/not/exist", name)
@@ -696,6 +824,11 @@ func doTestUtimesNano(t *testing.T, path string) {
 			in:  [2]syscall.Timespec{{Sec: 99, Nsec: _UTIME_OMIT}, {Sec: 5, Nsec: 6}},
 			out: [2]syscall.Timespec{{Sec: 7, Nsec: 8}, {Sec: 5, Nsec: 6}},
 		},
+		// Before 1970 and after 2262, the end of the int64 nanosecond range
+		{
+			in:  [2]syscall.Timespec{{Sec: -1000, Nsec: 999999999}, {Sec: 10000000000, Nsec: 123456789}},
+			out: [2]syscall.Timespec{{Sec: -1000, Nsec: 999999999}, {Sec: 10000000000, Nsec: 123456789}},
+		},
 	}
 	if runtime.GOOS == "darwin" {
 		// darwin neither supports UTIME_OMIT nor nanoseconds (!?)
@@ -722,6 +855,41 @@ func doTestUtimesNano(t *testing.T, path string) {
 	}
 }
 
+// TestUtimesNanoNow checks that UTIME_NOW sets the current time and leaves
+// the other timestamp alone.
+func TestUtimesNanoNow(t *testing.T) {
+	if runtime.GOOS == "darwin" {
+		t.Skipf("darwin does not support UTIME_OMIT")
+	}
+	path := test_helpers.DefaultPlainDir + "/TestUtimesNanoNow"
+	err := ioutil.WriteFile(path, nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Unlink(path)
+	err = syscall.UtimesNano(path, []syscall.Timespec{{Sec: 1, Nsec: 2}, {Sec: 3, Nsec: 4}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := time.Now().Add(-time.Second)
+	err = syscall.UtimesNano(path, []syscall.Timespec{{Nsec: unix.UTIME_NOW}, {Nsec: _UTIME_OMIT}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var st syscall.Stat_t
+	err = syscall.Stat(path, &st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	have := extractAtimeMtime(st)
+	if time.Unix(have[0].Unix()).Before(before) {
+		t.Errorf("atime was not set to now: %v", have[0])
+	}
+	if !compareTimespec(syscall.Timespec{Sec: 3, Nsec: 4}, have[1]) {
+		t.Errorf("mtime changed: %v", have[1])
+	}
+}
+
 // Set nanoseconds by path, normal file
 func TestUtimesNano(t *testing.T) {
 	path := test_helpers.DefaultPlainDir + "/utimesnano"
@@ -765,6 +933,54 @@ func TestMkfifo(t *testing.T) {
 	}
 }
 
+// TestUnixSocket binds a unix socket on the mount, which goes through Mknod,
+// and talks to it
+func TestUnixSocket(t *testing.T) {
+	path := test_helpers.DefaultPlainDir + "/sock1"
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		c.Write([]byte("x"))
+		c.Close()
+	}()
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	buf := make([]byte, 1)
+	if _, err = c.Read(buf); err != nil || buf[0] != 'x' {
+		t.Errorf("read %q: %v", buf, err)
+	}
+	var st syscall.Stat_t
+	if err = syscall.Lstat(path, &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFSOCK {
+		t.Errorf("wrong file type: %o", st.Mode)
+	}
+}
+
+// TestOTmpfile checks that O_TMPFILE fails with EOPNOTSUPP. Programs only
+// fall back to a named temporary file on this error.
+func TestOTmpfile(t *testing.T) {
+	fd, err := unix.Open(test_helpers.DefaultPlainDir, unix.O_TMPFILE|unix.O_RDWR, 0600)
+	if err == nil {
+		unix.Close(fd)
+		t.Fatal("O_TMPFILE works now, update the man page")
+	}
+	if err != unix.EOPNOTSUPP {
+		t.Errorf("want EOPNOTSUPP, got %v", err)
+	}
+}
+
 // TestMagicNames verifies that "magic" names are handled correctly
 // https://github.com/rfjakob/gocryptfs/issues/174
 func TestMagicNames(t *testing.T) {
@@ -851,6 +1067,60 @@ func TestChmod(t *testing.T) {
 	}
 }
 
+// Test that fstat on an open file sees changes made through other file
+// handles and through the path. The attributes of open files are cached.
+func TestFstatOpenFile(t *testing.T) {
+	path := test_helpers.DefaultPlainDir + "/" + t.Name()
+	f1, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f1.Close()
+	f2, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f2.Close()
+	checkSize := func(want int64) {
+		t.Helper()
+		for _, f := range []*os.File{f1, f2} {
+			fi, err := f.Stat()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Size() != want {
+				t.Errorf("%s: want size %d, have %d", f.Name(), want, fi.Size())
+			}
+		}
+	}
+	buf := make([]byte, 5000)
+	checkSize(0)
+	f1.WriteAt(buf, 0)
+	checkSize(5000)
+	f2.WriteAt(buf[:10], 9000)
+	checkSize(9010)
+	f1.WriteAt(buf[:10], 100)
+	checkSize(9010)
+	if err = f2.Truncate(3); err != nil {
+		t.Fatal(err)
+	}
+	checkSize(3)
+	if err = os.Truncate(path, 20000); err != nil {
+		t.Fatal(err)
+	}
+	checkSize(20000)
+	if err = os.Chmod(path, 0640); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := f1.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode() != 0640 {
+		t.Errorf("want mode 0640, have %#o", fi.Mode())
+	}
+}
+
 // Test that access(2) works correctly
 func TestAccess(t *testing.T) {
 	path := test_helpers.DefaultPlainDir + "/" + t.Name()
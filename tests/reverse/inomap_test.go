@@ -6,6 +6,8 @@ import (
 	"strings"
 	"syscall"
 	"testing"
+
+	"github.com/rfjakob/gocryptfs/tests/test_helpers"
 )
 
 // findIno looks for the file having inode number `ino` in `dir`.
@@ -143,3 +145,30 @@ func TestVirtualFileIno(t *testing.T) {
 		t.Errorf("name ino mismatch: %#x vs %#x", origInos.child, cipherInos.name)
 	}
 }
+
+// TestInoPassthroughVirtualFirst checks that real files keep their inode
+// numbers even if a virtual file is the first thing that is looked up after
+// mounting.
+func TestInoPassthroughVirtualFirst(t *testing.T) {
+	if plaintextnames {
+		t.Skip("plaintextnames mode does not have virtual files")
+	}
+	dir := test_helpers.InitFS(t, "-reverse")
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-reverse", "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	var st syscall.Stat_t
+	if err := syscall.Lstat(mnt+"/gocryptfs.diriv", &st); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Lstat(dir+"/.gocryptfs.reverse.conf", &st); err != nil {
+		t.Fatal(err)
+	}
+	origIno := st.Ino
+	if err := syscall.Lstat(mnt+"/gocryptfs.conf", &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Ino != origIno {
+		t.Errorf("ino mismatch: %d != %d", st.Ino, origIno)
+	}
+}
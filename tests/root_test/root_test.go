@@ -1,8 +1,11 @@
 package root_test
 
 import (
+	"io/ioutil"
 	"os"
+	"os/exec"
 	"runtime"
+	"strconv"
 	"syscall"
 	"testing"
 
@@ -73,3 +76,53 @@ func TestSupplementaryGroups(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+// TestSetuid mounts as root with "-setuid" and checks that the mount belongs
+// to the user.
+func TestSetuid(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("must run as root")
+	}
+	// Mounting as the user needs the real, setuid root fusermount
+	path, err := exec.LookPath("fusermount")
+	if err != nil {
+		t.Skip(err)
+	}
+	if st, err := os.Stat(path); err != nil || st.Mode()&os.ModeSetuid == 0 {
+		t.Skip("fusermount is not setuid root")
+	}
+	const uid = 1236
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	if err = os.Mkdir(pDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{cDir, cDir + "/gocryptfs.diriv", pDir} {
+		if err = os.Chown(p, uid, uid); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-nosyslog", "-extpass=echo test",
+		"-setuid="+strconv.Itoa(uid), cDir, pDir)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err = cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	defer test_helpers.UnmountPanic(pDir)
+	err = asUser(uid, uid, nil, func() error {
+		return ioutil.WriteFile(pDir+"/foo", []byte("bar"), 0600)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ioutil.ReadDir(cDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Sys().(*syscall.Stat_t).Uid != uid {
+			t.Errorf("%q is owned by uid %d", e.Name(), e.Sys().(*syscall.Stat_t).Uid)
+		}
+	}
+}
@@ -17,6 +17,7 @@ import (
 	"testing"
 
 	"github.com/pkg/xattr"
+	"golang.org/x/sys/unix"
 
 	"github.com/rfjakob/gocryptfs/internal/cryptocore"
 	"github.com/rfjakob/gocryptfs/tests/test_helpers"
@@ -212,6 +213,44 @@ func TestXattrList(t *testing.T) {
 	}
 }
 
+// TestXattrSizeQuery checks that getxattr and listxattr report the
+// required buffer size when called with an empty or too small buffer, like
+// rsync -X and KDE's file metadata library do.
+func TestXattrSizeQuery(t *testing.T) {
+	fn := test_helpers.DefaultPlainDir + "/TestXattrSizeQuery"
+	err := ioutil.WriteFile(fn, nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attr := "user.TestXattrSizeQuery"
+	val := []byte("0123456789abcdef0123")
+	if err = unix.Lsetxattr(fn, attr, val, 0); err != nil {
+		t.Fatal(err)
+	}
+	sz, err := unix.Lgetxattr(fn, attr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sz != len(val) {
+		t.Errorf("getxattr size query: want=%d have=%d", len(val), sz)
+	}
+	_, err = unix.Lgetxattr(fn, attr, make([]byte, 4))
+	if err != syscall.ERANGE {
+		t.Errorf("getxattr with short buffer: want ERANGE, have %v", err)
+	}
+	sz, err = unix.Llistxattr(fn, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := len(attr) + 1; sz != want {
+		t.Errorf("listxattr size query: want=%d have=%d", want, sz)
+	}
+	_, err = unix.Llistxattr(fn, make([]byte, 4))
+	if err != syscall.ERANGE {
+		t.Errorf("listxattr with short buffer: want ERANGE, have %v", err)
+	}
+}
+
 func xattrSupported(path string) bool {
 	_, err := xattr.LGet(path, "user.xattrSupported-dummy-value")
 	if err == nil {
@@ -352,9 +391,13 @@ func TestAcl(t *testing.T) {
 	//   $ strace -e setxattr setfacl -m u:root:r file
 	//   setxattr("file", "system.posix_acl_access", "\2\0\0\0\1\0\6\0\377\377\377\377\2\0\4\0\0\0\0\0\4\0\4\0\377\377\377\377\20\0\4", 44, 0) = 0
 	//
+	// strace truncates the string, the last 12 bytes are the rest of the
+	// mask entry and the "other" entry. The kernel validates ACLs before
+	// passing them on, so they must be complete.
+	//
 	// The ACL gives user root additional read rights, in other words, it should
 	// have no effect at all.
-	acl := "\002\000\000\000\001\000\006\000\377\377\377\377\002\000\004\000\000\000\000\000\004\000\004\000\377\377\377\377\020\000\004"
+	acl := "\002\000\000\000\001\000\006\000\377\377\377\377\002\000\004\000\000\000\000\000\004\000\004\000\377\377\377\377\020\000\004\000\377\377\377\377\040\000\004\000\377\377\377\377"
 	err = setGetRmList3(fn, "system.posix_acl_access", []byte(acl))
 	if err != nil {
 		t.Error(err)
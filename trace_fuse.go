@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// fuseTracer writes one line per FUSE request to the "-trace-fuse" file:
+//
+//	15:04:05.000000 LOOKUP n1 #6f3a0c1d9e2b4a57 -> OK n7 12us
+//
+// That is the time the request arrived, the operation, the node id and the
+// arguments, the result, and how long it took. Names are replaced by the
+// first 8 bytes of their HMAC-SHA256 under a random key that is not stored.
+// The same name gives the same hash within one trace, so the requests can be
+// correlated, but the names cannot be recovered from the trace. With
+// "-trace-plain", the names are written as they are.
+type fuseTracer struct {
+	sync.Mutex
+	f     *os.File
+	w     *bufio.Writer
+	plain bool
+	key   []byte
+	// closed by Close to stop the flush thread
+	stop chan struct{}
+}
+
+// How often the buffered trace is written out
+const traceFlushInterval = time.Second
+
+func newFuseTracer(path string, plain bool) (*fuseTracer, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	t := &fuseTracer{
+		f:     f,
+		w:     bufio.NewWriterSize(f, 64*1024),
+		plain: plain,
+		key:   cryptocore.RandBytes(32),
+		stop:  make(chan struct{}),
+	}
+	go t.flushThread()
+	return t, nil
+}
+
+// flushThread writes the buffer out periodically, so that the trace is
+// useful even if gocryptfs crashes or hangs.
+func (t *fuseTracer) flushThread() {
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
+			t.Lock()
+			t.w.Flush()
+			t.Unlock()
+		}
+	}
+}
+
+// Close writes out the rest of the trace and closes the file.
+func (t *fuseTracer) Close() {
+	close(t.stop)
+	t.Lock()
+	defer t.Unlock()
+	err := t.w.Flush()
+	if err2 := t.f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		tlog.Warn.Printf("trace-fuse: %v", err)
+	}
+}
+
+// name formats a file or xattr name for the trace.
+func (t *fuseTracer) name(n string) string {
+	if t.plain {
+		return fmt.Sprintf("%q", n)
+	}
+	h := hmac.New(sha256.New, t.key)
+	h.Write([]byte(n))
+	return "#" + hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// log writes one trace line. "args" describes the request, "result" what
+// was returned on success.
+func (t *fuseTracer) log(start time.Time, op string, node uint64, args string, st fuse.Status, result string) {
+	dt := time.Since(start)
+	status := "OK"
+	if !st.Ok() {
+		status = unix.ErrnoName(syscall.Errno(st))
+		if status == "" {
+			status = fmt.Sprintf("errno%d", int32(st))
+		}
+		result = ""
+	}
+	line := fmt.Sprintf("%s %s n%d", start.Format("15:04:05.000000"), op, node)
+	if args != "" {
+		line += " " + args
+	}
+	line += " -> " + status
+	if result != "" {
+		line += " " + result
+	}
+	line += fmt.Sprintf(" %dus\n", dt.Microseconds())
+	t.Lock()
+	t.w.WriteString(line)
+	t.Unlock()
+}
+
+// traceFS implements "-trace-fuse" by logging every request it passes on to
+// the wrapped RawFileSystem.
+type traceFS struct {
+	fuse.RawFileSystem
+	t *fuseTracer
+}
+
+func newTraceFS(raw fuse.RawFileSystem, t *fuseTracer) *traceFS {
+	return &traceFS{RawFileSystem: raw, t: t}
+}
+
+func (f *traceFS) Lookup(cancel <-chan struct{}, header *fuse.InHeader, name string, out *fuse.EntryOut) fuse.Status {
+	start := time.Now()
+	st := f.RawFileSystem.Lookup(cancel, header, name, out)
+	f.t.log(start, "LOOKUP", header.NodeId, f.t.name(name), st, fmt.Sprintf("n%d", out.NodeId))
+	return st
+}
+
+func (f *traceFS) Forget(nodeid, nlookup uint64) {
+	start := time.Now()
+	f.RawFileSystem.Forget(nodeid, nlookup)
+	f.t.log(start, "FORGET", nodeid, fmt.Sprintf("nlookup=%d", nlookup), fuse.OK, "")
+}
+
+func (f *traceFS) GetAttr(cancel <-chan struct{}, input *fuse.GetAttrIn, out *fuse.AttrOut) fuse.Status {
+	start := time.Now()
+	st := f.RawFileSystem.GetAttr(cancel, input, out)
+	f.t.log(start, "GETATTR", input.NodeId, "", st, fmt.Sprintf("mode=%o size=%d", out.Mode, out.Size))
+	return st
+}
+
+func (f *traceFS) SetAttr(cancel <-chan struct{}, input *fuse.SetAttrIn, out *fuse.AttrOut) fuse.Status {
+	start := time.Now()
+	st := f.RawFileSystem.SetAttr(cancel, input, out)
+	args := fmt.Sprintf("valid=%#x", input.Valid)
+	if input.Valid&fuse.FATTR_SIZE != 0 {
+		args += fmt.Sprintf(" size=%d", input.Size)
+	}
+	if input.Valid&fuse.FATTR_MODE != 0 {
+		args += fmt.Sprintf(" mode=%o", input.Mode)
+	}
+	f.t.log(start, "SETATTR", input.NodeId, args, st, "")
+	return st
+}
+
+func (f *traceFS) Mknod(cancel <-chan struct{}, input *fuse.MknodIn, name string, out *fuse.EntryOut) fuse.Status {
+	start := time.Now()
+	st := f.RawFileSystem.Mknod(cancel, input, name, out)
+	f.t.log(start, "MKNOD", input.NodeId, fmt.Sprintf("%s mode=%o", f.t.name(name), input.Mode), st, fmt.Sprintf("n%d", out.NodeId))
+	return st
+}
+
+func (f *traceFS) Mkdir(cancel <-chan struct{}, input *fuse.MkdirIn, name string, out *fuse.EntryOut) fuse.Status {
+	start := time.Now()
+	st := f.RawFileSystem.Mkdir(cancel, input, name, out)
+	f.t.log(start, "MKDIR", input.NodeId, fmt.Sprintf("%s mode=%o", f.t.name(name), input.Mode), st, fmt.Sprintf("n%d", out.NodeId))
+	return st
+}
+
+func (f *traceFS) Unlink(cancel <-chan struct{}, header *fuse.InHeader, name string) fuse.Status {
+	start := time.Now()
+	st := f.RawFileSystem.Unlink(cancel, header, name)
+	f.t.log(start, "UNLINK", header.NodeId, f.t.name(name), st, "")
+	return st
+}
+
+func (f *traceFS) Rmdir(cancel <-chan struct{}, header *fuse.InHeader, name string) fuse.Status {
+	start := time.Now()
+	st := f.RawFileSystem.Rmdir(cancel, header, name)
+	f.t.log(start, "RMDIR", header.NodeId, f.t.name(name), st, "")
+	return st
+}
+
+func (f *traceFS) Rename(cancel <-chan struct{}, input *fuse.RenameIn, oldName string, newName string) fuse.Status {
+	start := time.Now()
+	st := f.RawFileSystem.Rename(cancel, input, oldName, newName)
+	args := fmt.Sprintf("%s to n%d %s flags=%#x", f.t.name(oldName), input.Newdir, f.t.name(newName), input.Flags)
+	f.t.log(start, "RENAME", input.NodeId, args, st, "")
+	return st
+}
+
+func (f *traceFS) Link(cancel <-chan struct{}, input *fuse.LinkIn, filename string, out *fuse.EntryOut) fuse.Status {
+	start := time.Now()
+	st := f.RawFileSystem.Link(cancel, input, filename, out)
+	f.t.log(start, "LINK", input.NodeId, fmt.Sprintf("%s from n%d", f.t.name(filename), input.Oldnodeid), st, fmt.Sprintf("n%d", out.NodeId))
+	return st
+}
+
+func (f *traceFS) Symlink(cancel <-chan struct{}, header *fuse.InHeader, pointedTo string, linkName string, out *fuse.EntryOut) fuse.Status {
+	start := time.Now()
+	st := f.RawFileSystem.Symlink(cancel, header, pointedTo, linkName, out)
+	f.t.log(start, "SYMLINK", header.NodeId, fmt.Sprintf("%s target=%s", f.t.name(linkName), f.t.name(pointedTo)), st, fmt.Sprintf("n%d", out.NodeId))
+	return st
+}
+
+func (f *traceFS) Readlink(cancel <-chan struct{}, header *fuse.InHeader) ([]byte, fuse.Status) {
+	start := time.Now()
+	out, st := f.RawFileSystem.Readlink(cancel, header)
+	f.t.log(start, "READLINK", header.NodeId, "", st, f.t.name(string(out)))
+	return out, st
+}
+
+func (f *traceFS) Access(cancel <-chan struct{}, input *fuse.AccessIn) fuse.Status {
+	start := time.Now()
+	st := f.RawFileSystem.Access(cancel, input)
+	f.t.log(start, "ACCESS", input.NodeId, fmt.Sprintf("mask=%o", input.Mask), st, "")
+	return st
+}
+
+func (f *traceFS) GetXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr string, dest []byte) (uint32, fuse.Status) {
+	start := time.Now()
+	sz, st := f.RawFileSystem.GetXAttr(cancel, header, attr, dest)
+	f.t.log(start, "GETXATTR", header.NodeId, fmt.Sprintf("%s size=%d", f.t.name(attr), len(dest)), st, fmt.Sprintf("%d", sz))
+	return sz, st
+}
+
+func (f *traceFS) ListXAttr(cancel <-chan struct{}, header *fuse.InHeader, dest []byte) (uint32, fuse.Status) {
+	start := time.Now()
+	sz, st := f.RawFileSystem.ListXAttr(cancel, header, dest)
+	f.t.log(start, "LISTXATTR", header.NodeId, fmt.Sprintf("size=%d", len(dest)), st, fmt.Sprintf("%d", sz))
+	return sz, st
+}
+
+func (f *traceFS) SetXAttr(cancel <-chan struct{}, input *fuse.SetXAttrIn, attr string, data []byte) fuse.Status {
+	start := time.Now()
+	st := f.RawFileSystem.SetXAttr(cancel, input, attr, data)
+	f.t.log(start, "SETXATTR", input.NodeId, fmt.Sprintf("%s size=%d flags=%#x", f.t.name(attr), len(data), input.Flags), st, "")
+	return st
+}
+
+func (f *traceFS) RemoveXAttr(cancel <-chan struct{}, header *fuse.InHeader, attr string) fuse.Status {
+	start := time.Now()
+	st := f.RawFileSystem.RemoveXAttr(cancel, header, attr)
+	f.t.log(start, "REMOVEXATTR", header.NodeId, f.t.name(attr), st, "")
+	return st
+}
+
+func (f *traceFS) Create(cancel <-chan struct{}, input *fuse.CreateIn, name string, out *fuse.CreateOut) fuse.Status {
+	start := time.Now()
+	st := f.RawFileSystem.Create(cancel, input, name, out)
+	args := fmt.Sprintf("%s flags=%#x mode=%o", f.t.name(name), input.Flags, input.Mode)
+	f.t.log(start, "CREATE", input.NodeId, args, st, fmt.Sprintf("n%d fh%d", out.NodeId, out.Fh))
+	return st
+}
+
+func (f *traceFS) Open(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
+	start := time.Now()
+	st := f.RawFileSystem.Open(cancel, input, out)
+	f.t.log(start, "OPEN", input.NodeId, fmt.Sprintf("flags=%#x", input.Flags), st, fmt.Sprintf("fh%d", out.Fh))
+	return st
+}
+
+func (f *traceFS) Read(cancel <-chan struct{}, input *fuse.ReadIn, buf []byte) (fuse.ReadResult, fuse.Status) {
+	start := time.Now()
+	res, st := f.RawFileSystem.Read(cancel, input, buf)
+	var result string
+	if res != nil {
+		result = fmt.Sprintf("%d", res.Size())
+	}
+	f.t.log(start, "READ", input.NodeId, fmt.Sprintf("fh%d off=%d size=%d", input.Fh, input.Offset, input.Size), st, result)
+	return res, st
+}
+
+func (f *traceFS) Lseek(cancel <-chan struct{}, input *fuse.LseekIn, out *fuse.LseekOut) fuse.Status {
+	start := time.Now()
+	st := f.RawFileSystem.Lseek(cancel, input, out)
+	f.t.log(start, "LSEEK", input.NodeId, fmt.Sprintf("fh%d off=%d whence=%d", input.Fh, input.Offset, input.Whence), st, fmt.Sprintf("%d", out.Offset))
+	return st
+}
+
+func (f *traceFS) GetLk(cancel <-chan struct{}, input *fuse.LkIn, out *fuse.LkOut) fuse.Status {
+	start := time.Now()
+	st := f.RawFileSystem.GetLk(cancel, input, out)
+	f.t.log(start, "GETLK", input.NodeId, traceLk(input), st, fmt.Sprintf("type=%d", out.Lk.Typ))
+	return st
+}
+
+func (f *traceFS) SetLk(cancel <-chan struct{}, input *fuse.LkIn) fuse.Status {
+	start := time.Now()
+	st := f.RawFileSystem.SetLk(cancel, input)
+	f.t.log(start, "SETLK", input.NodeId, traceLk(input), st, "")
+	return st
+}
+
+func (f *traceFS) SetLkw(cancel <-chan struct{}, input *fuse.LkIn) fuse.Status {
+	start := time.Now()
+	st := f.RawFileSystem.SetLkw(cancel, input)
+	f.t.log(start, "SETLKW", input.NodeId, traceLk(input), st, "")
+	return st
+}
+
+func traceLk(input *fuse.LkIn) string {
+	return fmt.Sprintf("fh%d type=%d start=%d end=%d", input.Fh, input.Lk.Typ, input.Lk.Start, input.Lk.End)
+}
+
+func (f *traceFS) Release(cancel <-chan struct{}, input *fuse.ReleaseIn) {
+	start := time.Now()
+	f.RawFileSystem.Release(cancel, input)
+	f.t.log(start, "RELEASE", input.NodeId, fmt.Sprintf("fh%d", input.Fh), fuse.OK, "")
+}
+
+func (f *traceFS) Write(cancel <-chan struct{}, input *fuse.WriteIn, data []byte) (uint32, fuse.Status) {
+	start := time.Now()
+	n, st := f.RawFileSystem.Write(cancel, input, data)
+	f.t.log(start, "WRITE", input.NodeId, fmt.Sprintf("fh%d off=%d size=%d", input.Fh, input.Offset, len(data)), st, fmt.Sprintf("%d", n))
+	return n, st
+}
+
+func (f *traceFS) CopyFileRange(cancel <-chan struct{}, input *fuse.CopyFileRangeIn) (uint32, fuse.Status) {
+	start := time.Now()
+	n, st := f.RawFileSystem.CopyFileRange(cancel, input)
+	args := fmt.Sprintf("fh%d off=%d to n%d fh%d off=%d len=%d", input.FhIn, input.OffIn,
+		input.NodeIdOut, input.FhOut, input.OffOut, input.Len)
+	f.t.log(start, "COPY_FILE_RANGE", input.NodeId, args, st, fmt.Sprintf("%d", n))
+	return n, st
+}
+
+func (f *traceFS) Flush(cancel <-chan struct{}, input *fuse.FlushIn) fuse.Status {
+	start := time.Now()
+	st := f.RawFileSystem.Flush(cancel, input)
+	f.t.log(start, "FLUSH", input.NodeId, fmt.Sprintf("fh%d", input.Fh), st, "")
+	return st
+}
+
+func (f *traceFS) Fsync(cancel <-chan struct{}, input *fuse.FsyncIn) fuse.Status {
+	start := time.Now()
+	st := f.RawFileSystem.Fsync(cancel, input)
+	f.t.log(start, "FSYNC", input.NodeId, fmt.Sprintf("fh%d flags=%#x", input.Fh, input.FsyncFlags), st, "")
+	return st
+}
+
+func (f *traceFS) Fallocate(cancel <-chan struct{}, input *fuse.FallocateIn) fuse.Status {
+	start := time.Now()
+	st := f.RawFileSystem.Fallocate(cancel, input)
+	f.t.log(start, "FALLOCATE", input.NodeId, fmt.Sprintf("fh%d off=%d len=%d mode=%#x", input.Fh, input.Offset, input.Length, input.Mode), st, "")
+	return st
+}
+
+func (f *traceFS) OpenDir(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
+	start := time.Now()
+	st := f.RawFileSystem.OpenDir(cancel, input, out)
+	f.t.log(start, "OPENDIR", input.NodeId, fmt.Sprintf("flags=%#x", input.Flags), st, fmt.Sprintf("fh%d", out.Fh))
+	return st
+}
+
+func (f *traceFS) ReadDir(cancel <-chan struct{}, input *fuse.ReadIn, out *fuse.DirEntryList) fuse.Status {
+	start := time.Now()
+	st := f.RawFileSystem.ReadDir(cancel, input, out)
+	f.t.log(start, "READDIR", input.NodeId, fmt.Sprintf("fh%d off=%d", input.Fh, input.Offset), st, "")
+	return st
+}
+
+func (f *traceFS) ReadDirPlus(cancel <-chan struct{}, input *fuse.ReadIn, out *fuse.DirEntryList) fuse.Status {
+	start := time.Now()
+	st := f.RawFileSystem.ReadDirPlus(cancel, input, out)
+	f.t.log(start, "READDIRPLUS", input.NodeId, fmt.Sprintf("fh%d off=%d", input.Fh, input.Offset), st, "")
+	return st
+}
+
+func (f *traceFS) ReleaseDir(input *fuse.ReleaseIn) {
+	start := time.Now()
+	f.RawFileSystem.ReleaseDir(input)
+	f.t.log(start, "RELEASEDIR", input.NodeId, fmt.Sprintf("fh%d", input.Fh), fuse.OK, "")
+}
+
+func (f *traceFS) FsyncDir(cancel <-chan struct{}, input *fuse.FsyncIn) fuse.Status {
+	start := time.Now()
+	st := f.RawFileSystem.FsyncDir(cancel, input)
+	f.t.log(start, "FSYNCDIR", input.NodeId, fmt.Sprintf("fh%d flags=%#x", input.Fh, input.FsyncFlags), st, "")
+	return st
+}
+
+func (f *traceFS) StatFs(cancel <-chan struct{}, header *fuse.InHeader, out *fuse.StatfsOut) fuse.Status {
+	start := time.Now()
+	st := f.RawFileSystem.StatFs(cancel, header, out)
+	f.t.log(start, "STATFS", header.NodeId, "", st, "")
+	return st
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// trash lists, restores or purges the entries in the trash of CIPHERDIR
+// that "-trash-retention" has kept. This is called when you pass the
+// "-trash" option. "ids" are the trash IDs given after CIPHERDIR.
+//
+// Works directly on CIPHERDIR, so the filesystem does not need to be
+// mounted. It may be, though.
+func trash(args *argContainer, ids []string) (exitcode int) {
+	if args.reverse {
+		tlog.Fatal.Printf("-trash only works in forward mode")
+		return exitcodes.Usage
+	}
+	if args.trash == "restore" && len(ids) == 0 {
+		tlog.Fatal.Printf("Usage: %s -trash restore CIPHERDIR ID [ID ...]", tlog.ProgramName)
+		return exitcodes.Usage
+	}
+	if args.trash == "list" {
+		// Keep stdout free for the list
+		tlog.Info.Logger.SetOutput(os.Stderr)
+	}
+	pfs, wipeKeys := initFuseFrontend(args)
+	defer wipeKeys()
+	rn := pfs.(*fusefrontend.RootNode)
+	if args.trash == "list" || (args.trash == "purge" && len(ids) == 0) {
+		entries, err := rn.TrashList()
+		if err != nil {
+			tlog.Fatal.Printf("-trash: %v", err)
+			return exitcodes.Trash
+		}
+		if args.trash == "list" {
+			for _, e := range entries {
+				path := e.Path
+				if path == "" {
+					path = "?"
+				} else if e.IsDir {
+					path += "/"
+				}
+				fmt.Printf("%s  %s  %s\n", e.ID, e.Deleted.Format("2006-01-02 15:04:05"), path)
+			}
+			return 0
+		}
+		// "-trash purge" without IDs empties the trash
+		for _, e := range entries {
+			ids = append(ids, e.ID)
+		}
+	}
+	for _, id := range ids {
+		var err error
+		if args.trash == "restore" {
+			err = rn.TrashRestore(id)
+		} else {
+			err = rn.TrashPurge(id)
+		}
+		if err != nil {
+			tlog.Warn.Printf("-trash %s %s: %v", args.trash, id, err)
+			exitcode = exitcodes.Trash
+			continue
+		}
+		tlog.Info.Printf("%sd %s", args.trash, id)
+	}
+	if exitcode == 0 {
+		tlog.Info.Printf(tlog.ColorGreen+"%d entries %sd"+tlog.ColorReset, len(ids), args.trash)
+	}
+	return exitcode
+}
+
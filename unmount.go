@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// mountEntry is a mount found in /proc/self/mountinfo
+type mountEntry struct {
+	mountpoint string
+	// The cipherdir, or the value of "-fsname"
+	source string
+	// Like "fuse.gocryptfs"
+	fsType string
+	// Minor device number, which is the number of the FUSE connection
+	minor int
+}
+
+// readMountinfo parses /proc/self/mountinfo.
+func readMountinfo() ([]mountEntry, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var out []mountEntry
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// 36 35 0:42 / /mnt/plain rw,nosuid,nodev - fuse.gocryptfs /mnt/cipher rw,...
+		fields := strings.Fields(s.Text())
+		sep := -1
+		for i, f := range fields {
+			if f == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 5 || sep+2 >= len(fields) {
+			continue
+		}
+		m := mountEntry{
+			mountpoint: unescapeMountinfo(fields[4]),
+			source:     unescapeMountinfo(fields[sep+2]),
+			fsType:     fields[sep+1],
+		}
+		if dev := strings.SplitN(fields[2], ":", 2); len(dev) == 2 {
+			m.minor, _ = strconv.Atoi(dev[1])
+		}
+		out = append(out, m)
+	}
+	return out, s.Err()
+}
+
+// findMount returns the gocryptfs mount that is mounted at "path" or has
+// "path" as its cipherdir.
+func findMount(path string) (*mountEntry, error) {
+	mounts, err := readMountinfo()
+	if err != nil {
+		return nil, err
+	}
+	for i, m := range mounts {
+		if (m.fsType == "fuse.gocryptfs" || m.fsType == "fuse.gocryptfs-reverse") && (m.mountpoint == path || m.source == path) {
+			return &mounts[i], nil
+		}
+	}
+	return nil, fmt.Errorf("%q is not a gocryptfs mountpoint or cipherdir", path)
+}
+
+// unescapeMountinfo decodes the octal escapes like "\040" for a space that
+// the kernel uses in /proc/self/mountinfo.
+func unescapeMountinfo(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if v, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// doUnmount unmounts the gocryptfs mount at "path", which can be the
+// mountpoint or the cipherdir. The gocryptfs process then flushes and exits.
+// If files are still open, the unmount fails, unless "lazy" is set, which
+// detaches the mount right away and finishes the unmount when the files are
+// closed. "force" aborts the FUSE connection first, which makes all pending
+// and future file operations fail. Called for "-unmount".
+func doUnmount(path string, lazy bool, force bool) (exitcode int) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		tlog.Fatal.Printf("-unmount: %v", err)
+		return exitcodes.Unmount
+	}
+	if runtime.GOOS != "linux" {
+		// No mountinfo, and no lazy unmount. "umount -f" works for FUSE.
+		cmd := exec.Command("umount", abs)
+		if force {
+			cmd = exec.Command("umount", "-f", abs)
+		}
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err = cmd.Run(); err != nil {
+			tlog.Fatal.Printf("-unmount: umount failed: %v", err)
+			return exitcodes.Unmount
+		}
+		return 0
+	}
+	m, err := findMount(abs)
+	if err != nil {
+		tlog.Fatal.Printf("-unmount: %v", err)
+		return exitcodes.Unmount
+	}
+	if force {
+		// Needs root
+		abort := fmt.Sprintf("/sys/fs/fuse/connections/%d/abort", m.minor)
+		if err = ioutil.WriteFile(abort, []byte("1"), 0); err != nil {
+			tlog.Fatal.Printf("-unmount: aborting the FUSE connection failed: %v", err)
+			return exitcodes.Unmount
+		}
+		// Requests fail now, but the mount would still be busy
+		lazy = true
+	}
+	fusermountArgs := []string{"-u", m.mountpoint}
+	if lazy {
+		fusermountArgs = []string{"-u", "-z", m.mountpoint}
+	}
+	cmd := exec.Command("fusermount", fusermountArgs...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err = cmd.Run(); err != nil {
+		tlog.Fatal.Printf("-unmount: fusermount failed: %v", err)
+		if !lazy {
+			tlog.Info.Printf("If files are still open, you can pass -lazy to unmount anyway")
+		}
+		return exitcodes.Unmount
+	}
+	tlog.Info.Printf("Unmounted %q", m.mountpoint)
+	return 0
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/internal/tlog"
+)
+
+// wipe overwrites the (ciphertext) file at "path" with random data and
+// deletes it. If it is a long name file, the accompanying ".name" file is
+// deleted as well.
+// This is called when you pass the "-wipe" option.
+func wipe(path string) (exitcode int) {
+	st, err := os.Lstat(path)
+	if err != nil {
+		tlog.Fatal.Printf("-wipe: %v", err)
+		return exitcodes.Other
+	}
+	if st.IsDir() {
+		tlog.Fatal.Printf("-wipe: %q is a directory", path)
+		return exitcodes.Usage
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		tlog.Fatal.Printf("-wipe: %v", err)
+		return exitcodes.Other
+	}
+	dir, name := filepath.Split(abs)
+	dirfd, err := syscallcompat.OpenDirNofollow(dir, "")
+	if err != nil {
+		tlog.Fatal.Printf("-wipe: %v", err)
+		return exitcodes.Other
+	}
+	defer syscall.Close(dirfd)
+	err = syscallcompat.WipeAt(dirfd, name)
+	if err != nil {
+		tlog.Fatal.Printf("-wipe: overwriting %q failed: %v", path, err)
+		return exitcodes.Other
+	}
+	err = syscallcompat.Unlinkat(dirfd, name, 0)
+	if err != nil {
+		tlog.Fatal.Printf("-wipe: %v", err)
+		return exitcodes.Other
+	}
+	if nametransform.IsLongContent(name) {
+		err = nametransform.DeleteLongNameAt(dirfd, name)
+		if err != nil {
+			tlog.Warn.Printf("-wipe: could not delete .name file: %v", err)
+		}
+	}
+	return 0
+}